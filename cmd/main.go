@@ -14,6 +14,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -23,6 +26,7 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb-binlog/pkg/util"
 	"github.com/pingcap/tidb-binlog/pkg/version"
@@ -34,12 +38,54 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	if len(os.Args) > 1 && os.Args[1] == "server" {
+		runServer(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-output" {
+		runVerifyOutput(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		runInspect(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "range" {
+		runRange(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "search-tso" {
+		runSearchTSO(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		runCheckConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bisect" {
+		runBisect(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		runUpload(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		runGen(os.Args[2:])
+		return
+	}
+
 	cfg := pitr.NewConfig()
 	if err := cfg.Parse(os.Args[1:]); err != nil {
-		log.Fatal("verifying flags failed. See 'pitr --help'.", zap.Error(err))
+		log.Error("verifying flags failed. See 'pitr --help'.", zap.Error(err))
+		exitWithError(cfg.ErrorFormat, pitr.ErrorClassConfig, err)
 	}
 
-	if err := util.InitLogger(cfg.LogLevel, cfg.LogFile); err != nil {
+	if err := pitr.InitLogger(cfg); err != nil {
 		log.Fatal("Failed to initialize log", zap.Error(err))
 	}
 	version.PrintVersionInfo("PITR")
@@ -53,20 +99,336 @@ func main() {
 
 	r, err := pitr.New(cfg)
 	if err != nil {
-		log.Fatal("create pitr failed", zap.Error(err))
+		log.Error("create pitr failed", zap.Error(err))
+		exitWithError(cfg.ErrorFormat, pitr.ErrorClassConfig, err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		sig := <-sc
-		log.Info("got signal to exit.", zap.Stringer("signale", sig))
-		r.Close()
-		os.Exit(0)
+		log.Info("got signal to exit, wait for the checkpoint saved.", zap.Stringer("signal", sig))
+		cancel()
 	}()
 
-	if err := r.Process(); err != nil {
-		log.Error("pitr processing failed", zap.Error(err))
+	err = r.Process(ctx)
+	if errors.Cause(err) == context.Canceled {
+		log.Info("pitr is canceled, the temp dir is reserved, run with --resume to continue")
+	} else if err != nil {
+		log.Error("pitr processing failed", zap.String("class", string(pitr.ClassifyError(err))), zap.Error(err))
 	}
 	if err := r.Close(); err != nil {
 		log.Fatal("close pitr failed", zap.Error(err))
 	}
+	if err != nil {
+		exitWithError(cfg.ErrorFormat, pitr.ErrorClassUnknown, err)
+	}
+}
+
+// exitWithError prints err in format to stderr, and exits with the exit code of its class, class is used if err
+// is not classified, e.g. all the errors of parsing the flags are config errors.
+func exitWithError(format string, class pitr.ErrorClass, err error) {
+	if c := pitr.ClassifyError(err); c != pitr.ErrorClassUnknown {
+		class = c
+	}
+	if werr := pitr.WriteError(os.Stderr, format, class, err); werr != nil {
+		log.Warn("print error failed", zap.Error(werr))
+	}
+	log.Sync()
+	os.Exit(class.ExitCode())
+}
+
+// runServer runs PITR in server mode, the jobs are submitted by HTTP API.
+func runServer(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8261", "address of HTTP API to submit, query and cancel jobs, the web UI showing the progress of jobs is at /, the API is not authenticated")
+	logLevel := fs.String("L", "info", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path, it's rotated every 300MB")
+	logFormat := fs.String("log-format", "text", "format of logs, text or json")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	logCfg := pitr.NewConfig()
+	logCfg.LogLevel, logCfg.LogFile, logCfg.LogFormat = *logLevel, *logFile, *logFormat
+	if err := pitr.InitLogger(logCfg); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+	version.PrintVersionInfo("PITR")
+
+	s, err := pitr.NewServer(*addr)
+	if err != nil {
+		log.Fatal("create pitr server failed", zap.Error(err))
+	}
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+	go func() {
+		sig := <-sc
+		log.Info("got signal to exit.", zap.Stringer("signal", sig))
+		if err := s.Close(); err != nil {
+			log.Error("close pitr server failed", zap.Error(err))
+		}
+	}()
+
+	if err := s.Run(); err != nil {
+		log.Fatal("pitr server failed", zap.Error(err))
+	}
+}
+
+// runVerifyOutput checks the files in output dir against the checksums written by PITR.
+func runVerifyOutput(args []string) {
+	fs := flag.NewFlagSet("verify-output", flag.ExitOnError)
+	dir := fs.String("output-dir", "./new_binlog", "the output dir of PITR which contains checksums.txt")
+	logLevel := fs.String("L", "info", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.VerifyOutput(*dir); err != nil {
+		log.Fatal("verify output failed", zap.String("dir", *dir), zap.Error(err))
+	}
+}
+
+// runInspect prints the summary of binlog files, which helps to pick start-tso and stop-tso.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of inspect: pitr inspect [flags] <binlog file, dir or storage uri>...")
+		fs.PrintDefaults()
+	}
+	relax := fs.String("relax-corruption", "abort", "how to handle a damaged binlog file, abort, skip-tail or skip-file")
+	jsonFormat := fs.Bool("json", false, "print the summaries as a JSON array")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.Inspect(os.Stdout, fs.Args(), *relax, *jsonFormat); err != nil {
+		log.Fatal("inspect binlog files failed", zap.Error(err))
+	}
+}
+
+// runRange prints the commit ts range of the binlog files, which are the valid bounds of start-tso and stop-tso.
+func runRange(args []string) {
+	fs := flag.NewFlagSet("range", flag.ExitOnError)
+	cfg := &pitr.TSORangeConfig{}
+	fs.StringVar(&cfg.Dir, "data-dir", "", "drainer data directory path, can be a comma separated list of directories or glob patterns")
+	fs.StringVar(&cfg.Storage, "storage", "", "uri of the storage which saves drainer's binlog files, used instead of data-dir")
+	fs.StringVar(&cfg.TimeZone, "timezone", "", "time zone of the printed datetime, empty string means the local time zone")
+	fs.StringVar(&cfg.RelaxCorruption, "relax-corruption", "abort", "how to handle a damaged binlog file, abort, skip-tail or skip-file")
+	fs.BoolVar(&cfg.JSON, "json", false, "print the ranges as a JSON object")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.TSORange(os.Stdout, cfg); err != nil {
+		log.Fatal("get commit ts range failed", zap.Error(err))
+	}
+}
+
+// runSearchTSO prints the commit ts of the changes of a row, which helps to find the stop-tso before an incident.
+func runSearchTSO(args []string) {
+	fs := flag.NewFlagSet("search-tso", flag.ExitOnError)
+	cfg := &pitr.SearchTSOConfig{}
+	fs.StringVar(&cfg.Dir, "data-dir", "", "drainer data directory path, can be a comma separated list of directories or glob patterns")
+	fs.StringVar(&cfg.Storage, "storage", "", "uri of the storage which saves drainer's binlog files, used instead of data-dir")
+	fs.StringVar(&cfg.Table, "table", "", "table of the row, like db.orders")
+	fs.StringVar(&cfg.Where, "where", "", "expression which identifies the row like `id = 42`, it supports the same syntax as row-filter, the update is reported if the row before or after it matches")
+	fs.StringVar(&cfg.Around, "around", "", "approximate datetime of the change like 2023-06-01 12:00:00, empty string means searching all the binlogs")
+	fs.DurationVar(&cfg.Window, "window", time.Hour, "range searched before and after around")
+	fs.StringVar(&cfg.TimeZone, "timezone", "", "time zone of around, empty string means the local time zone")
+	fs.StringVar(&cfg.RelaxCorruption, "relax-corruption", "abort", "how to handle a damaged binlog file, abort, skip-tail or skip-file")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.SearchTSO(os.Stdout, cfg); err != nil {
+		log.Fatal("search tso failed", zap.Error(err))
+	}
+}
+
+// runCheckConfig checks the config of a run without merging any binlog, and prints all the problems found.
+func runCheckConfig(args []string) {
+	if err := util.InitLogger("warn", ""); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.CheckConfig(os.Stdout, args); err != nil {
+		log.Fatal("check config failed", zap.Error(err))
+	}
+}
+
+// runBisect replays the sliced output to a downstream, and finds the first slice which breaks the data.
+func runBisect(args []string) {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	cfg := &pitr.BisectConfig{}
+	fs.StringVar(&cfg.OutputDir, "output-dir", "./new_binlog", "the output dir of PITR written with slice-interval in pb format")
+	fs.StringVar(&cfg.DestDB.DSN, "dsn", "", "data source name of the downstream like `user:password@tcp(127.0.0.1:3306)/`, it should be restored to the state before the first slice")
+	fs.IntVar(&cfg.DestDB.BatchSize, "batch-size", 100, "max number of DML statements executed in one transaction")
+	fs.IntVar(&cfg.DestDB.WorkerCount, "worker-count", 1, "number of connections executing DMLs, the DMLs of a table are executed by one of them")
+	fs.IntVar(&cfg.DestDB.MaxRetry, "max-retry", 3, "max retry times when executing SQL failed")
+	fs.StringVar(&cfg.Query, "query", "", "validation query run after every slice, the data is broken if it returns any row, like `SELECT id FROM db.accounts WHERE balance < 0`")
+	fs.BoolVar(&cfg.Txn, "txn", false, "run the query after every binlog instead of every slice to find the first broken transaction, the output should be merged with preserve-txn")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		cancel()
+	}()
+
+	if err := pitr.Bisect(ctx, os.Stdout, cfg); err != nil {
+		log.Fatal("bisect failed", zap.Error(err))
+	}
+}
+
+// runUpload uploads the output dir to object storage, it resumes the upload of output-storage left by a failed run.
+func runUpload(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	cfg := &pitr.UploadConfig{}
+	fs.StringVar(&cfg.Dir, "output-dir", "./new_binlog", "the output dir of PITR")
+	fs.StringVar(&cfg.Storage, "output-storage", "", "s3 uri like s3://bucket/prefix?endpoint=xxx to upload the output dir to, the upload to the same uri is resumed from the uploaded files and parts")
+	fs.IntVar(&cfg.Concurrency, "upload-concurrency", 4, "max number of files or parts uploaded at the same time")
+	fs.StringVar(&cfg.RateLimit, "upload-rate-limit", "", "max size uploaded per second like 50MiB, empty means no limit")
+	logLevel := fs.String("L", "info", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		cancel()
+	}()
+
+	if err := pitr.Upload(ctx, cfg); err != nil {
+		log.Fatal("upload failed", zap.Error(err))
+	}
+}
+
+// runBench merges a synthetic workload of binlogs, and prints the throughput of Map and Reduce.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	cfg := &pitr.BenchConfig{}
+	fs.IntVar(&cfg.Tables, "tables", 8, "number of tables in the workload")
+	fs.IntVar(&cfg.Binlogs, "binlogs", 100000, "number of DML binlogs in the workload")
+	fs.IntVar(&cfg.EventsPerBinlog, "events-per-binlog", 10, "number of row changes in every binlog, the tables of them are random")
+	fs.IntVar(&cfg.RowSize, "row-size", 256, "size of the payload of every row in bytes")
+	fs.Float64Var(&cfg.UpdateRatio, "update-ratio", 0.6, "ratio of updates in the row changes")
+	fs.Float64Var(&cfg.DeleteRatio, "delete-ratio", 0.1, "ratio of deletes in the row changes, the others are inserts")
+	fs.Float64Var(&cfg.UpdateSkew, "update-skew", 0, "exponent of the zipf distribution of the rows updated and deleted, greater than 1, a larger one changes the recently inserted rows more often, 0 means the uniform distribution")
+	fs.StringVar(&cfg.KeyOrder, "key-order", "sequential", "order of the primary keys of the inserted rows, sequential or random")
+	fs.IntVar(&cfg.DDLInterval, "ddl-interval", 0, "number of DML binlogs between the DDLs adding a column to a random table, 0 means no DDL")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "seed of the random workload, the same seed generates the same rows")
+	fs.StringVar(&cfg.Dir, "dir", "", "dir of the binlog files, temp files and output of the bench, empty means a new temp dir")
+	fs.BoolVar(&cfg.Keep, "keep", false, "keep the binlog files, temp files and output after the bench")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 1, "number of workers in Map")
+	fs.IntVar(&cfg.ReduceConcurrency, "reduce-concurrency", 0, "max number of tables reduced at the same time, 0 means no limit")
+	fs.StringVar(&cfg.OutputFormat, "output-format", "pb", "format of the merged binlog files, pb, sql, jsonl or csv")
+	fs.StringVar(&cfg.Compress, "compress", "none", "codec used to compress the merged binlog files: none, gzip, zstd or lz4")
+	fs.StringVar(&cfg.MaxMemory, "max-memory", "", "max memory of the deduplicated events in Reduce like 4GiB, the events over it are spilled to disk, empty means no limit")
+	fs.StringVar(&cfg.PprofAddr, "pprof-addr", "", "address of HTTP server which exposes the runtime profiles by /debug/pprof during the bench")
+	fs.BoolVar(&cfg.JSON, "json", false, "print the result as a JSON object")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		cancel()
+	}()
+
+	if err := pitr.Bench(ctx, os.Stdout, cfg); err != nil {
+		log.Fatal("bench failed", zap.Error(err))
+	}
+}
+
+// runGen writes the binlog files of a synthetic workload like drainer.
+func runGen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	cfg := &pitr.GenConfig{}
+	fs.StringVar(&cfg.Dir, "dir", "", "dir of the generated binlog files, it should be empty or not exist")
+	fs.StringVar(&cfg.Database, "database", "pitr_bench", "database of the tables")
+	fs.StringVar(&cfg.SchemaFile, "schema-file", "", "file of the CREATE TABLE statements of the tables used instead of tables, every table should have a primary key of one integer column")
+	fs.IntVar(&cfg.Tables, "tables", 8, "number of tables like t1 (id bigint primary key, v bigint, payload varchar(row-size))")
+	fs.IntVar(&cfg.Binlogs, "binlogs", 10000, "number of DML binlogs")
+	fs.IntVar(&cfg.EventsPerBinlog, "events-per-binlog", 10, "number of row changes in every binlog, the tables of them are random")
+	fs.IntVar(&cfg.RowSize, "row-size", 256, "size of the payload of every row in bytes, the max size of a string column in schema-file")
+	fs.Float64Var(&cfg.UpdateRatio, "update-ratio", 0.6, "ratio of updates in the row changes")
+	fs.Float64Var(&cfg.DeleteRatio, "delete-ratio", 0.1, "ratio of deletes in the row changes, the others are inserts")
+	fs.Float64Var(&cfg.UpdateSkew, "update-skew", 0, "exponent of the zipf distribution of the rows updated and deleted, greater than 1, a larger one changes the recently inserted rows more often, 0 means the uniform distribution")
+	fs.StringVar(&cfg.KeyOrder, "key-order", "sequential", "order of the primary keys of the inserted rows, sequential or random")
+	fs.IntVar(&cfg.DDLInterval, "ddl-interval", 0, "number of DML binlogs between the DDLs adding a column to a random table, 0 means no DDL after the tables are created")
+	fs.StringVar(&cfg.StartTime, "start-time", "", "datetime of the first binlog in the local time zone like 2020-01-02 15:04:05, empty means now")
+	fs.DurationVar(&cfg.Interval, "interval", time.Millisecond, "interval between the commit ts of the binlogs")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "seed of the random workload, the same seed and start-time generate the same binlogs")
+	fs.BoolVar(&cfg.JSON, "json", false, "print the result as a JSON object")
+	logLevel := fs.String("L", "warn", "log level: debug, info, warn, error, fatal")
+	logFile := fs.String("log-file", "", "log file path")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal("parse flags failed", zap.Error(err))
+	}
+
+	if err := util.InitLogger(*logLevel, *logFile); err != nil {
+		log.Fatal("Failed to initialize log", zap.Error(err))
+	}
+
+	if err := pitr.Gen(os.Stdout, cfg); err != nil {
+		log.Fatal("generate binlog files failed", zap.Error(err))
+	}
 }
@@ -0,0 +1,272 @@
+package pitr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+const (
+	// autoIDFileName is the file of the statements rebasing the auto ids of the tables in output dir
+	autoIDFileName = "auto_id.sql"
+	// defaultAutoRandomShardBits is the shard bits of AUTO_RANDOM without the number in TiDB
+	defaultAutoRandomShardBits = 5
+)
+
+// autoIDColumn is the AUTO_INCREMENT or AUTO_RANDOM column of a table.
+type autoIDColumn struct {
+	name string
+	// autoRandom is true if the column is AUTO_RANDOM, the ids are allocated in the low bits below the shard bits
+	autoRandom bool
+	shardBits  int
+	unsigned   bool
+}
+
+// autoIDColumnOf returns the AUTO_INCREMENT or AUTO_RANDOM column of the table, nil if it has neither.
+// The parser doesn't support AUTO_RANDOM, it's only found in the CREATE TABLE statement with the comment
+// syntax of TiDB like `/*T![auto_rand] AUTO_RANDOM(5) */`, which is written by SHOW CREATE TABLE.
+func autoIDColumnOf(table *ast.CreateTableStmt) *autoIDColumn {
+	for _, col := range table.Cols {
+		for _, opt := range col.Options {
+			if opt.Tp == ast.ColumnOptionAutoIncrement {
+				return &autoIDColumn{name: col.Name.Name.O}
+			}
+		}
+	}
+
+	text := table.Text()
+	if !strings.Contains(strings.ToUpper(text), "AUTO_RANDOM") {
+		return nil
+	}
+	for _, col := range table.Cols {
+		if col.Tp == nil || col.Tp.Tp != mysql.TypeLonglong {
+			continue
+		}
+		m := autoRandomPattern(col.Name.Name.O).FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		shardBits := defaultAutoRandomShardBits
+		if len(m[1]) != 0 {
+			shardBits, _ = strconv.Atoi(m[1])
+		}
+		return &autoIDColumn{
+			name:       col.Name.Name.O,
+			autoRandom: true,
+			shardBits:  shardBits,
+			unsigned:   mysql.HasUnsignedFlag(col.Tp.Flag),
+		}
+	}
+	return nil
+}
+
+// autoRandomPattern matches the definition of the bigint column with AUTO_RANDOM, the shard bits are captured.
+func autoRandomPattern(column string) *regexp.Regexp {
+	return regexp.MustCompile("(?is)(?:^|[\\s,(`])`?" + regexp.QuoteMeta(column) +
+		"`?\\s+bigint\\b[^,]*?\\bAUTO_RANDOM\\b(?:\\s*\\(\\s*(\\d+))?")
+}
+
+// idBase returns the part of the id allocated by the table, the shard bits of AUTO_RANDOM and the sign bit are
+// removed, false if the id is not positive.
+func (c *autoIDColumn) idBase(value types.Datum) (uint64, bool) {
+	var id uint64
+	switch value.Kind() {
+	case types.KindInt64:
+		if value.GetInt64() <= 0 {
+			return 0, false
+		}
+		id = uint64(value.GetInt64())
+	case types.KindUint64:
+		id = value.GetUint64()
+	default:
+		return 0, false
+	}
+	if !c.autoRandom {
+		return id, id > 0
+	}
+	bits := uint(64 - c.shardBits)
+	if !c.unsigned {
+		bits--
+	}
+	id &= 1<<bits - 1
+	return id, id > 0
+}
+
+// autoIDMax is the max id allocated by a table in the window.
+type autoIDMax struct {
+	column autoIDColumn
+	max    uint64
+}
+
+// autoIDTracker tracks the max ids of the rows of the tables in Reduce, they're written as the statements to rebase
+// the auto ids in downstream, so the inserts after restoring don't allocate the ids of the restored rows.
+type autoIDTracker struct {
+	mu sync.Mutex
+	// maxIDs is the max ids of the target tables renamed by router
+	maxIDs map[schemaTable]*autoIDMax
+}
+
+func newAutoIDTracker() *autoIDTracker {
+	return &autoIDTracker{maxIDs: make(map[schemaTable]*autoIDMax)}
+}
+
+// observe records the ids of the rows in the DML events, the ids of the deleted rows are counted too, they're
+// allocated in the window.
+func (t *autoIDTracker) observe(events []pb.Event, router *tableRouter) error {
+	for i := range events {
+		ev := &events[i]
+		info, err := ddlHandle.GetTableInfo(ev.GetSchemaName(), ev.GetTableName())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if info.autoID == nil {
+			continue
+		}
+
+		var max uint64
+		for _, data := range ev.GetRow() {
+			col := &pb.Column{}
+			if err := col.Unmarshal(data); err != nil {
+				return errors.Trace(err)
+			}
+			if !strings.EqualFold(col.Name, info.autoID.name) {
+				continue
+			}
+			values := [][]byte{col.Value}
+			if ev.GetTp() == pb.EventType_Update {
+				values = append(values, col.ChangedValue)
+			}
+			for _, value := range values {
+				_, d, err := codec.DecodeOne(value)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if id, ok := info.autoID.idBase(d); ok && id > max {
+					max = id
+				}
+			}
+			break
+		}
+		if max == 0 {
+			continue
+		}
+
+		schema, table := router.route(info.schema, info.table)
+		key := schemaTable{schema: schema, table: table}
+		t.mu.Lock()
+		if m, ok := t.maxIDs[key]; !ok {
+			t.maxIDs[key] = &autoIDMax{column: *info.autoID, max: max}
+		} else if max > m.max {
+			m.max = max
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// statements returns the statements rebasing the auto ids of the tables to the max ids plus one, in the order of
+// the tables. TiDB and MySQL never rebase AUTO_INCREMENT below the ids in use, so they're safe to execute again.
+func (t *autoIDTracker) statements() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]schemaTable, 0, len(t.maxIDs))
+	for key := range t.maxIDs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].schema != keys[j].schema {
+			return keys[i].schema < keys[j].schema
+		}
+		return keys[i].table < keys[j].table
+	})
+
+	stmts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		m := t.maxIDs[key]
+		option := "AUTO_INCREMENT"
+		if m.column.autoRandom {
+			option = "AUTO_RANDOM_BASE"
+		}
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s %s = %d", quoteSchema(key.schema, key.table), option, m.max+1))
+	}
+	return stmts
+}
+
+// writeAutoIDFile writes the statements rebasing the auto ids of the tables changed in the window to auto_id.sql
+// in output dir, nothing is written if no auto id is allocated.
+func (m *Merge) writeAutoIDFile() (string, error) {
+	stmts := m.autoIDs.statements()
+	if len(stmts) == 0 {
+		return "", nil
+	}
+	if m.resumed && len(m.cp.ReducedTables) != 0 {
+		log.Warn("the auto ids of tables reduced in the last run are not rebased",
+			zap.Int("tables", len(m.cp.ReducedTables)))
+	}
+
+	name := filepath.Join(m.outputDir, autoIDFileName)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	for _, stmt := range stmts {
+		if _, err := fmt.Fprintf(f, "%s;\n", stmt); err != nil {
+			return "", errors.Annotatef(err, "write auto ids to %s", name)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	log.Info("auto id file is written", zap.String("file", name), zap.Int("tables", len(stmts)))
+	return name, nil
+}
+
+// rebaseAutoIDs executes the statements of auto_id.sql in output dir in dest-db after the merged binlogs are
+// applied, it does nothing if the file doesn't exist.
+func (r *PITR) rebaseAutoIDs(ctx context.Context, outputDir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, autoIDFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := sql.Open("mysql", r.cfg.DestDB.DSN)
+	if err != nil {
+		return errors.Annotatef(err, "open downstream %s", redactDSN(r.cfg.DestDB.DSN))
+	}
+	defer db.Close()
+
+	var count int
+	for _, stmt := range strings.Split(string(data), ";\n") {
+		if stmt = strings.TrimSpace(stmt); len(stmt) == 0 {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return errors.Annotatef(err, "rebase auto id by %s", stmt)
+		}
+		count++
+	}
+	log.Info("auto ids are rebased in dest-db", zap.Int("tables", count))
+	return nil
+}
@@ -0,0 +1,79 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestAutoIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoid")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	ddl.ResetDB()
+	for _, sql := range []string{
+		"use test; create table t1 (id bigint primary key auto_increment, v int)",
+		"use test; create table t2 (id bigint /*T![auto_rand] AUTO_RANDOM(3) */ primary key, v int)",
+		"use test; create table t3 (id bigint primary key, v int)",
+		"use test; create table t4 like t1",
+	} {
+		assert.NilError(t, ddl.ExecuteDDL("", sql), sql)
+	}
+	for table, expected := range map[string]*autoIDColumn{
+		"t1": {name: "id"},
+		"t2": {name: "id", autoRandom: true, shardBits: 3},
+		"t3": nil,
+		"t4": {name: "id"},
+	} {
+		info, err := ddl.GetTableInfo("test", table)
+		assert.NilError(t, err)
+		if expected == nil {
+			assert.Assert(t, info.autoID == nil, table)
+			continue
+		}
+		assert.Assert(t, info.autoID != nil, table)
+		assert.Equal(t, *info.autoID, *expected, table)
+	}
+
+	event := func(table string, tp pb.EventType, id, changedID int64) pb.Event {
+		schema := "test"
+		col := &pb.Column{Name: "id", Tp: []byte{mysql.TypeLonglong}, Value: encodeIntValue(id), ChangedValue: encodeIntValue(changedID)}
+		data, err := col.Marshal()
+		assert.NilError(t, err)
+		return pb.Event{SchemaName: &schema, TableName: &table, Tp: tp, Row: [][]byte{data}}
+	}
+	tracker := newAutoIDTracker()
+	assert.NilError(t, tracker.observe([]pb.Event{
+		event("t1", pb.EventType_Insert, 5, 0),
+		event("t1", pb.EventType_Update, 5, 9),
+		// the id of the deleted row is allocated in the window too
+		event("t1", pb.EventType_Delete, 12, 0),
+		// the shard bits of AUTO_RANDOM are removed
+		event("t2", pb.EventType_Insert, 5<<60|100, 0),
+		event("t2", pb.EventType_Insert, 7<<60|42, 0),
+		event("t3", pb.EventType_Insert, 1000, 0),
+	}, nil))
+
+	m := &Merge{outputDir: dir, autoIDs: tracker}
+	name, err := m.writeAutoIDFile()
+	assert.NilError(t, err)
+	assert.Equal(t, name, filepath.Join(dir, autoIDFileName))
+	data, err := ioutil.ReadFile(name)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "ALTER TABLE `test`.`t1` AUTO_INCREMENT = 13;\nALTER TABLE `test`.`t2` AUTO_RANDOM_BASE = 101;\n")
+
+	// no file is written if no auto id is allocated
+	m = &Merge{outputDir: filepath.Join(dir, "empty"), autoIDs: newAutoIDTracker()}
+	name, err = m.writeAutoIDFile()
+	assert.NilError(t, err)
+	assert.Equal(t, name, "")
+}
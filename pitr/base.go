@@ -0,0 +1,103 @@
+package pitr
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// maxCommitTSOfBase returns the max commit ts of the binlogs in baseDir, which is the merged output
+// of a previous run in pb format, every table's binlogs are saved in a sub dir.
+func maxCommitTSOfBase(baseDir string, opts runOptions) (int64, error) {
+	tables, err := readSubDirs(baseDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var maxTS int64
+	for _, table := range tables {
+		files, err := searchBaseFiles(filepath.Join(baseDir, table))
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		// the binlogs of one table are written in the order of commit ts, so only the last
+		// not empty file need to be scanned
+		for i := len(files) - 1; i >= 0; i-- {
+			var ts int64
+			if err := scanBinlogFile(files[i], opts, func(binlog *pb.Binlog) error {
+				ts = binlog.CommitTs
+				return nil
+			}); err != nil {
+				return 0, errors.Trace(err)
+			}
+			if ts == 0 {
+				continue
+			}
+			if ts > maxTS {
+				maxTS = ts
+			}
+			break
+		}
+	}
+
+	if maxTS == 0 {
+		return 0, errors.Errorf("no binlog is found in base-dir %s, it should be the output of a previous run in %s format", baseDir, outputFormatPB)
+	}
+	log.Info("get max commit ts of base dir", zap.String("dir", baseDir), zap.String("ts", formatTSO(maxTS)))
+	return maxTS, nil
+}
+
+// searchBaseFiles returns the binlog files of a table in base dir, the dir may not exist or be empty.
+func searchBaseFiles(dir string) ([]string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	files, err := searchFiles(dir)
+	if errors.Cause(err) == binlogfile.ErrFileNotFound {
+		return nil, nil
+	}
+	return files, errors.Trace(err)
+}
+
+// mergeSubDirs returns the sorted union of the table dirs in tempDir and baseDir, baseDir can be empty.
+func mergeSubDirs(tempDir, baseDir string) ([]string, error) {
+	dirs, err := readSubDirs(tempDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(baseDir) == 0 {
+		return dirs, nil
+	}
+
+	baseDirs, err := readSubDirs(baseDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	exists := make(map[string]struct{}, len(dirs))
+	for _, dir := range dirs {
+		exists[dir] = struct{}{}
+	}
+	for _, dir := range baseDirs {
+		if _, ok := exists[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// dirSizeIfExists returns the size of dir, 0 if dir doesn't exist.
+func dirSizeIfExists(dir string) (int64, error) {
+	size, err := dirSize(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, errors.Trace(err)
+}
@@ -0,0 +1,43 @@
+package pitr
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/check"
+)
+
+type testBaseSuite struct{}
+
+var _ = check.Suite(&testBaseSuite{})
+
+func (s *testBaseSuite) TestMaxCommitTSOfBase(c *check.C) {
+	baseDir := c.MkDir()
+	_, err := maxCommitTSOfBase(baseDir, runOptions{})
+	c.Assert(err, check.ErrorMatches, ".*no binlog is found in base-dir.*")
+
+	tableDir := filepath.Join(baseDir, "test_tb1")
+	c.Assert(os.Mkdir(tableDir, 0700), check.IsNil)
+	binlogs := writeBinlogsInDir(tableDir, c)
+	c.Assert(os.Mkdir(filepath.Join(baseDir, "test_tb2"), 0700), check.IsNil)
+
+	ts, err := maxCommitTSOfBase(baseDir, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(ts, check.Equals, binlogs[len(binlogs)-1].CommitTs)
+}
+
+func (s *testBaseSuite) TestMergeSubDirs(c *check.C) {
+	tempDir := c.MkDir()
+	baseDir := c.MkDir()
+	for _, dir := range []string{filepath.Join(tempDir, "b_t"), filepath.Join(tempDir, "a_t"), filepath.Join(baseDir, "a_t"), filepath.Join(baseDir, "c_t")} {
+		c.Assert(os.Mkdir(dir, 0700), check.IsNil)
+	}
+
+	dirs, err := mergeSubDirs(tempDir, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(dirs, check.DeepEquals, []string{"a_t", "b_t"})
+
+	dirs, err = mergeSubDirs(tempDir, baseDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(dirs, check.DeepEquals, []string{"a_t", "b_t", "c_t"})
+}
@@ -0,0 +1,187 @@
+package pitr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// BenchConfig is the config of the bench subcommand, which generates a synthetic workload of drainer binlogs and
+// measures the throughput of Map and Reduce on it.
+type BenchConfig struct {
+	WorkloadConfig
+	// Dir is the dir of the binlog files, temp files and output of the bench, empty means a new temp dir
+	Dir string
+	// Keep keeps the files of the bench in Dir
+	Keep bool
+
+	// Concurrency, ReduceConcurrency, OutputFormat, Compress and MaxMemory are the tuning knobs like Config
+	Concurrency       int
+	ReduceConcurrency int
+	OutputFormat      string
+	Compress          string
+	MaxMemory         string
+
+	// PprofAddr is the address of HTTP server which exposes the runtime profiles during the bench
+	PprofAddr string
+	// JSON prints the result as a JSON object
+	JSON bool
+}
+
+// benchPhase is the throughput of a phase.
+type benchPhase struct {
+	Phase           string  `json:"phase"`
+	ElapsedSeconds  float64 `json:"elapsed-seconds"`
+	EventsPerSecond float64 `json:"events-per-second"`
+	BytesPerSecond  float64 `json:"bytes-per-second"`
+}
+
+// benchResult is the result of a bench, the bytes are the size of the binlog files.
+type benchResult struct {
+	Workload    workloadStats `json:"workload"`
+	InputBytes  int64         `json:"input-bytes"`
+	OutputBytes int64         `json:"output-bytes"`
+	Phases      []benchPhase  `json:"phases"`
+}
+
+func newBenchPhase(phase string, elapsed time.Duration, events, bytes int64) benchPhase {
+	p := benchPhase{Phase: phase, ElapsedSeconds: elapsed.Seconds()}
+	if elapsed > 0 {
+		p.EventsPerSecond = float64(events) / elapsed.Seconds()
+		p.BytesPerSecond = float64(bytes) / elapsed.Seconds()
+	}
+	return p
+}
+
+// Bench writes the binlog files of the workload to the data dir in cfg.Dir, merges them to the output dir like
+// a run without history DDLs, and prints the throughput of Map and Reduce to w.
+func Bench(ctx context.Context, w io.Writer, cfg *BenchConfig) error {
+	if err := cfg.WorkloadConfig.validate(); err != nil {
+		return errors.Trace(err)
+	}
+	format := cfg.OutputFormat
+	if len(format) == 0 {
+		format = outputFormatPB
+	}
+	if format != outputFormatPB && !isTextFormat(format) {
+		return errors.Errorf("unknown output format %s", format)
+	}
+	if cfg.Compress != "" && !isValidCompress(cfg.Compress) {
+		return errors.Errorf("unknown compress %s", cfg.Compress)
+	}
+
+	dir := cfg.Dir
+	if len(dir) == 0 {
+		var err error
+		if dir, err = ioutil.TempDir("", "pitr-bench"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	dataDir, tempDir, outputDir := filepath.Join(dir, "data"), filepath.Join(dir, "temp"), filepath.Join(dir, "output")
+	// the files of the last bench are removed, so the temp dir is not resumed
+	for _, d := range []string{dataDir, tempDir, outputDir} {
+		if err := os.RemoveAll(d); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !cfg.Keep {
+		defer func() {
+			for _, d := range []string{dataDir, tempDir, outputDir} {
+				os.RemoveAll(d)
+			}
+			if len(cfg.Dir) == 0 {
+				os.Remove(dir)
+			}
+		}()
+	}
+	if len(cfg.PprofAddr) != 0 {
+		server, err := newPprofServer(cfg.PprofAddr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer server.close()
+	}
+
+	start := time.Now()
+	stats, err := writeWorkload(dataDir, cfg.WorkloadConfig)
+	if err != nil {
+		return errors.Annotate(err, "write workload")
+	}
+	files, err := searchFiles(dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	files, inputBytes, err := filterFiles(files, 0, 0, runOptions{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("workload is written", zap.String("dir", dataDir), zap.Int("binlogs", stats.Binlogs),
+		zap.Int64("events", stats.Events), zap.Int64("bytes", inputBytes), zap.Duration("elapsed", time.Since(start)))
+
+	if ddlHandle, err = NewDDLHandle(); err != nil {
+		return errors.Trace(err)
+	}
+	mergeCfg := NewConfig()
+	mergeCfg.TempDir = tempDir
+	mergeCfg.Concurrency = cfg.Concurrency
+	mergeCfg.ReduceConcurrency = cfg.ReduceConcurrency
+	mergeCfg.OutputFormat = format
+	mergeCfg.Compress = cfg.Compress
+	mergeCfg.MaxMemory = cfg.MaxMemory
+	merge, err := NewMerge(mergeCfg, files, inputBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer merge.Close(cfg.Keep)
+	merge.outputDir = outputDir
+
+	result := benchResult{Workload: stats, InputBytes: inputBytes}
+	start = time.Now()
+	if err := merge.Map(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	result.Phases = append(result.Phases, newBenchPhase(phaseMap, time.Since(start), stats.Events, inputBytes))
+
+	// Reduce starts from the schema before the binlogs like a run
+	ddlHandle.ResetDB()
+	tempBytes, err := merge.tempDirSize()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	start = time.Now()
+	if err := merge.Reduce(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	result.Phases = append(result.Phases, newBenchPhase(phaseReduce, time.Since(start), stats.Events, tempBytes))
+	if result.OutputBytes, err = dirTreeSize(outputDir); err != nil {
+		return errors.Trace(err)
+	}
+
+	if cfg.JSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return errors.Trace(err)
+	}
+	fmt.Fprintf(w, "workload: %d tables, %d binlogs, %d events (%d inserts, %d updates, %d deletes), %s\n",
+		cfg.Tables, stats.Binlogs, stats.Events, stats.Inserts, stats.Updates, stats.Deletes, formatSize(inputBytes))
+	for _, p := range result.Phases {
+		fmt.Fprintf(w, "%-8s %8.2fs %12.0f events/s %10s/s\n", p.Phase, p.ElapsedSeconds, p.EventsPerSecond, formatSize(int64(p.BytesPerSecond)))
+	}
+	fmt.Fprintf(w, "output: %s\n", formatSize(result.OutputBytes))
+	if cfg.Keep {
+		fmt.Fprintf(w, "the binlog files, temp files and output are kept in %s\n", dir)
+	}
+	return nil
+}
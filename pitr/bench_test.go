@@ -0,0 +1,49 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestBench(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &BenchConfig{
+		WorkloadConfig: WorkloadConfig{Tables: 3, Binlogs: 50, EventsPerBinlog: 4, RowSize: 16, UpdateRatio: 0.5, DeleteRatio: 0.1, UpdateSkew: 1.5, Seed: 1},
+		Dir:            dir,
+		Keep:           true,
+		OutputFormat:   outputFormatSQL,
+		JSON:           true,
+	}
+	var out bytes.Buffer
+	assert.NilError(t, Bench(context.Background(), &out, cfg))
+
+	var result benchResult
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &result), out.String())
+	assert.Equal(t, result.Workload.Binlogs, 50)
+	assert.Equal(t, result.Workload.Events, int64(200))
+	assert.Equal(t, result.Workload.Inserts+result.Workload.Updates+result.Workload.Deletes, int64(200))
+	assert.Assert(t, result.Workload.Updates > 0 && result.Workload.Deletes > 0)
+	assert.Assert(t, result.InputBytes > 0 && result.OutputBytes > 0)
+	assert.Equal(t, len(result.Phases), 2)
+	assert.Equal(t, result.Phases[0].Phase, phaseMap)
+	assert.Equal(t, result.Phases[1].Phase, phaseReduce)
+	for _, table := range []string{"t1", "t2", "t3"} {
+		_, err := os.Stat(filepath.Join(dir, "output", workloadSchema+"_"+table+sqlFileSuffix))
+		assert.NilError(t, err, table)
+	}
+
+	cfg.UpdateSkew = 0.5
+	assert.ErrorContains(t, Bench(context.Background(), &out, cfg), "update skew should be greater than 1 or 0")
+	cfg.UpdateSkew, cfg.DeleteRatio = 0, 0.6
+	assert.ErrorContains(t, Bench(context.Background(), &out, cfg), "their sum should not be greater than 1")
+}
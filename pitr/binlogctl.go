@@ -1,9 +1,10 @@
 package pitr
 
 import (
+	"fmt"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"sync"
 
 	"github.com/pingcap/errors"
@@ -14,6 +15,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// binlogName is binlogfile.BinlogName without the time of creating the file, which binlogfile still parses,
+// so the output files of the same binlogs have the same names in every run.
+func binlogName(index uint64) string {
+	return fmt.Sprintf("binlog-%016d", index)
+}
+
 type myBinlogger struct {
 	dir string
 
@@ -23,6 +30,9 @@ type myBinlogger struct {
 	lastSuffix uint64
 	lastOffset int64
 
+	// cipher encrypts the payloads written, nil means not encrypted
+	cipher *payloadCipher
+
 	// file is the lastest file in the dir
 	file    *file.LockedFile
 	dirLock *file.LockedFile
@@ -44,7 +54,7 @@ func OpenMyBinlogger(dirpath string) (*myBinlogger, error) {
 	}
 
 	// lock directory firstly
-	dirLockFile := path.Join(dirpath, ".lock")
+	dirLockFile := filepath.Join(dirpath, ".lock")
 	dirLock, err = file.LockFile(dirLockFile, os.O_WRONLY|os.O_CREATE, file.PrivateFileMode)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -59,9 +69,9 @@ func OpenMyBinlogger(dirpath string) (*myBinlogger, error) {
 
 	// ignore file not found error
 	names, _ := binlogfile.ReadBinlogNames(dirpath)
-	// if no binlog files, we create from index 0, the file name like binlog-0000000000000000-20190101010101
+	// if no binlog files, we create from index 0, the file name like binlog-0000000000000000
 	if len(names) == 0 {
-		lastFileName = path.Join(dirpath, binlogfile.BinlogName(0))
+		lastFileName = filepath.Join(dirpath, binlogName(0))
 		lastFileSuffix = 0
 	} else {
 		// check binlog files and find last binlog file
@@ -70,7 +80,7 @@ func OpenMyBinlogger(dirpath string) (*myBinlogger, error) {
 			return nil, errors.Trace(err)
 		}
 
-		lastFileName = path.Join(dirpath, names[len(names)-1])
+		lastFileName = filepath.Join(dirpath, names[len(names)-1])
 		lastFileSuffix, _, err = binlogfile.ParseBinlogName(names[len(names)-1])
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -109,6 +119,12 @@ func (b *myBinlogger) WriteTail(entity *binlog.Entity) (int64, error) {
 	if len(payload) == 0 {
 		return 0, nil
 	}
+	if b.cipher != nil {
+		var err error
+		if payload, err = b.cipher.encryptPayload(payload); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
 
 	curOffset, err := b.encoder.Encode(payload)
 	if err != nil {
@@ -147,11 +163,11 @@ func (b *myBinlogger) Close() error {
 
 // rotate creates a new file for append binlog
 func (b *myBinlogger) rotate() error {
-	filename := binlogfile.BinlogName(b.seq() + 1)
+	filename := binlogName(b.seq() + 1)
 	b.lastSuffix = b.seq() + 1
 	b.lastOffset = 0
 
-	fpath := path.Join(b.dir, filename)
+	fpath := filepath.Join(b.dir, filename)
 
 	newTail, err := file.LockFile(fpath, os.O_WRONLY|os.O_CREATE, file.PrivateFileMode)
 	if err != nil {
@@ -168,6 +184,14 @@ func (b *myBinlogger) rotate() error {
 	return nil
 }
 
+// position returns the suffix of the last binlog file and the offset written.
+func (b *myBinlogger) position() tempFilePos {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return tempFilePos{Suffix: b.lastSuffix, Offset: b.lastOffset}
+}
+
 func (b *myBinlogger) ManualRotate() error {
 	return b.rotate()
 }
@@ -177,7 +201,7 @@ func (b *myBinlogger) seq() uint64 {
 		return 0
 	}
 
-	seq, _, err := binlogfile.ParseBinlogName(path.Base(b.file.Name()))
+	seq, _, err := binlogfile.ParseBinlogName(filepath.Base(b.file.Name()))
 	if err != nil {
 		log.Fatal("bad binlog name", zap.String("name", b.file.Name()), zap.Error(err))
 	}
@@ -0,0 +1,176 @@
+package pitr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// errBrokenBinlog stops replaying a slice after the binlog which breaks the data.
+var errBrokenBinlog = errors.New("the data is broken by the binlog")
+
+// BisectConfig is the config of the bisect subcommand.
+type BisectConfig struct {
+	// OutputDir is the output dir of a run with slice-interval in pb format
+	OutputDir string
+	// DestDB is the downstream to replay the slices, it should be restored to the state before the first slice
+	DestDB DBConfig
+	// Query is the validation query, the data is broken if it returns any row
+	Query string
+	// Txn runs the query after every binlog instead of every slice, so the first broken transaction is found
+	// if the output is merged with preserve-txn
+	Txn bool
+}
+
+// bisectResult is the first slice and binlog after which the validation query returns rows.
+type bisectResult struct {
+	slice *manifestSlice
+	// commitTS is the commit ts of the first broken binlog, only set if Txn is true
+	commitTS int64
+}
+
+// Bisect replays the slices in output dir to the downstream in order, and runs the validation query after
+// every slice, it reports the first slice after which the query returns any row, which is the time window
+// when the data is broken.
+func Bisect(ctx context.Context, w io.Writer, cfg *BisectConfig) error {
+	if len(strings.TrimSpace(cfg.Query)) == 0 {
+		return errors.New("the validation query is required")
+	}
+	manifest, err := readSlicedManifest(cfg.OutputDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	sink, err := newMySQLSink(cfg.DestDB, newApplyLimiter(0, 0), runOptions{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	check := func() (bool, error) {
+		if err := sink.Flush(); err != nil {
+			return false, errors.Trace(err)
+		}
+		return queryReturnsRows(ctx, sink.db, cfg.Query)
+	}
+	result, err := bisectSlices(ctx, w, cfg.OutputDir, manifest.Slices, sink.Apply, check, cfg.Txn)
+	if err != nil {
+		sink.abort()
+		return errors.Trace(err)
+	}
+	if err := sink.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch {
+	case result == nil:
+		fmt.Fprintln(w, "the query returns no row after all the slices are replayed")
+	case result.slice == nil:
+		fmt.Fprintln(w, "the query already returns rows before replaying any slice")
+	default:
+		fmt.Fprintf(w, "the data is broken in slice %s, the last correct point is before %s\n",
+			result.slice.Name, formatTSO(result.slice.StartTSO))
+		if result.commitTS != 0 {
+			fmt.Fprintf(w, "the first broken binlog has commit ts %s\n", formatTSO(result.commitTS))
+		}
+	}
+	return nil
+}
+
+// readSlicedManifest reads the manifest of the sliced output which can be replayed by the mysql sink.
+func readSlicedManifest(outputDir string) (*outputManifest, error) {
+	name := filepath.Join(outputDir, manifestFileName)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read manifest %s", name)
+	}
+	manifest := &outputManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, errors.Annotatef(err, "decode manifest %s", name)
+	}
+	if len(manifest.Slices) == 0 {
+		return nil, errors.Errorf("no slice in %s, the output should be written with slice-interval", outputDir)
+	}
+	if manifest.Format != outputFormatPB || manifest.Encrypted {
+		return nil, errors.Errorf("bisect requires the output in %s format without encryption", outputFormatPB)
+	}
+	return manifest, nil
+}
+
+// bisectSlices applies the slices in order, and calls check after every slice, or every binlog if txn
+// is true. It returns the first slice after which check returns true, the slice of the result is nil if
+// check returns true before any slice is applied, and nil is returned if check never returns true.
+func bisectSlices(ctx context.Context, w io.Writer, outputDir string, slices []manifestSlice,
+	apply func(binlog *pb.Binlog) error, check func() (bool, error), txn bool) (*bisectResult, error) {
+	broken, err := check()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if broken {
+		return &bisectResult{}, nil
+	}
+
+	for i := range slices {
+		slice := &slices[i]
+		var brokenTS int64
+		applyAndCheck := apply
+		if txn {
+			applyAndCheck = func(binlog *pb.Binlog) error {
+				if err := apply(binlog); err != nil {
+					return errors.Trace(err)
+				}
+				broken, err := check()
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if broken {
+					brokenTS = binlog.CommitTs
+					return errBrokenBinlog
+				}
+				return nil
+			}
+		}
+		count, err := replayDir(ctx, filepath.Join(outputDir, slice.Name), runOptions{}, applyAndCheck)
+		if err != nil && errors.Cause(err) != errBrokenBinlog {
+			return nil, errors.Annotatef(err, "replay slice %s", slice.Name)
+		}
+		if !txn {
+			if broken, err = check(); err != nil {
+				return nil, errors.Trace(err)
+			}
+		} else if broken = brokenTS != 0; broken {
+			// the broken binlog is applied
+			count++
+		}
+
+		state := "ok"
+		if broken {
+			state = "broken"
+		}
+		fmt.Fprintf(w, "%s [%s, %s) %d binlogs: %s\n", slice.Name, formatTSO(slice.StartTSO), formatTSO(slice.StopTSO), count, state)
+		log.Info("slice is replayed", zap.String("slice", slice.Name), zap.Int("binlogs", count), zap.Bool("broken", broken))
+		if broken {
+			return &bisectResult{slice: slice, commitTS: brokenTS}, nil
+		}
+	}
+	return nil, nil
+}
+
+// queryReturnsRows returns true if the query returns any row.
+func queryReturnsRows(ctx context.Context, db *sql.DB, query string) (bool, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return false, errors.Annotatef(err, "run query %s", query)
+	}
+	defer rows.Close()
+	found := rows.Next()
+	return found, errors.Annotatef(rows.Err(), "run query %s", query)
+}
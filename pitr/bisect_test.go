@@ -0,0 +1,91 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestBisectSlices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-bisect")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := &Merge{
+		tempDir:       filepath.Join(dir, "temp"),
+		outputDir:     filepath.Join(dir, "output"),
+		outputFormat:  outputFormatPB,
+		compress:      compressNone,
+		sliceInterval: time.Hour,
+	}
+	// 3 slices of 1h, every slice has 2 binlogs of t1 and t2
+	base := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	for _, table := range []string{"test_t1", "test_t2"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, table), 0700))
+		w := newSlicedWriter(runOptions{}, m.outputFormat, m.outputDir, table, m.compress, 0, m.sliceInterval)
+		for i := 0; i < 3; i++ {
+			ts := timeToTSO(base.Add(time.Duration(i) * time.Hour))
+			if table == "test_t2" {
+				ts++
+			}
+			assert.NilError(t, w.Write(genTestDDL("test", table, "create table if not exists test.t (id int)", ts)))
+		}
+		assert.NilError(t, w.Close())
+	}
+	_, err = m.writeManifest()
+	assert.NilError(t, err)
+	manifest, err := readSlicedManifest(m.outputDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(manifest.Slices), 3)
+
+	var applied []int64
+	apply := func(binlog *pb.Binlog) error {
+		applied = append(applied, binlog.CommitTs)
+		return nil
+	}
+	// the data is broken after the 3rd binlog is applied
+	check := func() (bool, error) {
+		return len(applied) >= 3, nil
+	}
+
+	var out bytes.Buffer
+	result, err := bisectSlices(context.Background(), &out, m.outputDir, manifest.Slices, apply, check, false)
+	assert.NilError(t, err)
+	assert.Equal(t, result.slice.Name, "slice-20200102-110000")
+	assert.Equal(t, result.commitTS, int64(0))
+	assert.Equal(t, len(applied), 4)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Assert(t, strings.HasSuffix(lines[0], "2 binlogs: ok"), lines[0])
+	assert.Assert(t, strings.HasSuffix(lines[1], "2 binlogs: broken"), lines[1])
+
+	// the first broken binlog is found by txn
+	applied = nil
+	out.Reset()
+	result, err = bisectSlices(context.Background(), &out, m.outputDir, manifest.Slices, apply, check, true)
+	assert.NilError(t, err)
+	assert.Equal(t, result.slice.Name, "slice-20200102-110000")
+	assert.Equal(t, result.commitTS, timeToTSO(base.Add(time.Hour)))
+	assert.Equal(t, len(applied), 3)
+
+	// not broken
+	result, err = bisectSlices(context.Background(), &out, m.outputDir, manifest.Slices, apply, func() (bool, error) { return false, nil }, false)
+	assert.NilError(t, err)
+	assert.Assert(t, result == nil)
+
+	// broken before replaying
+	result, err = bisectSlices(context.Background(), &out, m.outputDir, manifest.Slices, apply, func() (bool, error) { return true, nil }, false)
+	assert.NilError(t, err)
+	assert.Assert(t, result.slice == nil)
+
+	_, err = readSlicedManifest(filepath.Join(dir, "not-exist"))
+	assert.ErrorContains(t, err, "read manifest")
+}
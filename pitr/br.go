@@ -0,0 +1,198 @@
+package pitr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// backupMetaFileName is the meta file in the storage of a BR backup
+	backupMetaFileName = "backupmeta"
+	// backupMetaEndVersionField is the field number of end_version in BackupMeta of kvproto's brpb,
+	// it's the backup ts of a full backup
+	backupMetaEndVersionField = 6
+
+	defaultBRPath = "br"
+)
+
+// backupMetaEndVersion decodes end_version from the BackupMeta protobuf, the other fields are skipped,
+// so the backup can be read without kvproto.
+func backupMetaEndVersion(data []byte) (int64, error) {
+	var endVersion uint64
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid field key in backupmeta")
+		}
+		data = data[n:]
+
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return 0, errors.Errorf("invalid varint of field %d in backupmeta", field)
+			}
+			data = data[n:]
+			if field == backupMetaEndVersionField {
+				endVersion = v
+			}
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return 0, errors.Errorf("truncated field %d in backupmeta", field)
+			}
+			data = data[size:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return 0, errors.Errorf("truncated field %d in backupmeta", field)
+			}
+			data = data[n+int(l):]
+		default:
+			return 0, errors.Errorf("unsupported wire type %d of field %d in backupmeta", wireType, field)
+		}
+	}
+	if endVersion == 0 {
+		return 0, errors.New("end_version is not found in backupmeta")
+	}
+	return int64(endVersion), nil
+}
+
+// readBackupTS returns the backup ts of the BR backup in storage.
+func readBackupTS(backup string) (int64, error) {
+	s, err := NewStorage(backup)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	rc, _, err := s.Open(backupMetaFileName)
+	if err != nil {
+		return 0, errors.Annotatef(err, "open %s", redactStorageURI(s.FullPath(backupMetaFileName)))
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	ts, err := backupMetaEndVersion(data)
+	return ts, errors.Annotatef(err, "decode %s", redactStorageURI(s.FullPath(backupMetaFileName)))
+}
+
+// checkBinlogsAfterBackup warns if the first binlog of a dir is after startTS, which is the backup ts + 1.
+// It's expected if drainer is started with the backup ts as initial-commit-ts, otherwise the changes between
+// the backup and the first binlog are lost, it can't be told by the binlog files.
+func checkBinlogsAfterBackup(sources [][]string, backupTS int64, opts runOptions) error {
+	for _, source := range sources {
+		ts, _, err := getFirstBinlogCommitTSAndFileSize(source[0], opts)
+		if err != nil {
+			return errors.Annotate(err, "get first binlog commit ts failed")
+		}
+		if ts > backupTS+1 {
+			log.Warn("the first binlog is after the backup ts, make sure drainer's initial-commit-ts is the backup ts",
+				zap.String("file", redactStorageURI(source[0])),
+				zap.String("first commit ts", formatTSO(ts)),
+				zap.String("backup ts", formatTSO(backupTS)))
+		}
+	}
+	return nil
+}
+
+// prepareRestoredCluster restores the BR backup to the dest cluster by br if br-restore is set, the restore is
+// saved in checkpoint so it's not run again when resumed. Otherwise dest-db should be already restored from
+// the backup, it's checked by the tables existing at the backup ts.
+func (r *PITR) prepareRestoredCluster(ctx context.Context, cp *checkpoint, backupTS int64) error {
+	if !r.cfg.BRRestore {
+		return errors.Trace(r.checkRestoredCluster(ctx, backupTS))
+	}
+	if cp.BRRestored {
+		log.Info("the backup is restored in the last run", zap.String("storage", redactStorageURI(r.cfg.BRBackup)))
+		return nil
+	}
+
+	storage := r.cfg.BRBackup
+	if !strings.Contains(storage, "://") {
+		abs, err := filepath.Abs(storage)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		storage = "local://" + abs
+	}
+	log.Info("restore the backup by br", zap.String("br", r.cfg.BRPath),
+		zap.String("storage", redactStorageURI(storage)), zap.String("pd", r.cfg.BRPD))
+	cmd := exec.CommandContext(ctx, r.cfg.BRPath, "restore", "full", "--pd", r.cfg.BRPD, "--storage", storage)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Annotatef(err, "run %s restore full", r.cfg.BRPath)
+	}
+
+	cp.Lock()
+	cp.BRRestored = true
+	cp.Unlock()
+	return errors.Trace(cp.save())
+}
+
+// checkRestoredCluster checks the selected tables existing at the backup ts are in dest-db.
+func (r *PITR) checkRestoredCluster(ctx context.Context, backupTS int64) error {
+	tables, err := r.historyTables(ctx, backupTS+1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tables) == 0 {
+		log.Warn("no table is found by the history DDLs or schema file, dest-db is not checked")
+		return nil
+	}
+
+	db, err := sql.Open("mysql", r.cfg.DestDB.DSN)
+	if err != nil {
+		return errors.Annotatef(err, "open downstream %s", redactDSN(r.cfg.DestDB.DSN))
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "SELECT table_schema, table_name FROM information_schema.tables WHERE table_type = 'BASE TABLE'")
+	if err != nil {
+		return errors.Annotatef(err, "query tables of downstream %s", redactDSN(r.cfg.DestDB.DSN))
+	}
+	defer rows.Close()
+	restored := make(map[schemaTable]struct{})
+	for rows.Next() {
+		var table schemaTable
+		if err := rows.Scan(&table.schema, &table.table); err != nil {
+			return errors.Trace(err)
+		}
+		restored[schemaTable{schema: strings.ToLower(table.schema), table: strings.ToLower(table.table)}] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	var missing []string
+	for _, table := range sortedTables(tables) {
+		if r.filter.skip(table.schema, table.table) {
+			continue
+		}
+		if _, ok := restored[schemaTable{schema: strings.ToLower(table.schema), table: strings.ToLower(table.table)}]; !ok {
+			missing = append(missing, quoteSchema(table.schema, table.table))
+		}
+	}
+	if len(missing) != 0 {
+		if len(missing) > 3 {
+			missing = append(missing[:3], "...")
+		}
+		return errors.Errorf("the tables %s at backup ts %s are not in dest-db, restore the backup by br first, or set br-restore",
+			strings.Join(missing, ", "), formatTSO(backupTS))
+	}
+	log.Info("dest-db is restored from the backup", zap.Int("tables", len(tables)), zap.String("backup ts", formatTSO(backupTS)))
+	return nil
+}
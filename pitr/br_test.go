@@ -0,0 +1,65 @@
+package pitr
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// appendProtoField appends a protobuf field of varint or bytes.
+func appendProtoField(data []byte, field int, value interface{}) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	switch v := value.(type) {
+	case uint64:
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(field<<3))]...)
+		data = append(data, buf[:binary.PutUvarint(buf, v)]...)
+	case []byte:
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(field<<3|2))]...)
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(v)))]...)
+		data = append(data, v...)
+	}
+	return data
+}
+
+func TestReadBackupTS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "br")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	var meta []byte
+	meta = appendProtoField(meta, 1, uint64(6800000000000000000))
+	meta = appendProtoField(meta, 2, []byte("v4.0.0"))
+	meta = appendProtoField(meta, 4, appendProtoField(nil, 1, []byte("1_2_3.sst")))
+	meta = appendProtoField(meta, 5, uint64(417000000000000000))
+	meta = appendProtoField(meta, backupMetaEndVersionField, uint64(417000000000000000))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, backupMetaFileName), meta, 0600))
+
+	ts, err := readBackupTS(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, ts, int64(417000000000000000))
+
+	_, err = backupMetaEndVersion(meta[:len(meta)-3])
+	assert.ErrorContains(t, err, "invalid varint of field 6")
+	_, err = backupMetaEndVersion(appendProtoField(nil, 2, []byte("v4.0.0")))
+	assert.ErrorContains(t, err, "end_version is not found")
+	_, err = readBackupTS(filepath.Join(dir, "not-exist"))
+	assert.ErrorContains(t, err, "open")
+}
+
+func TestValidateBRBackup(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.BRRestore = true
+	assert.ErrorContains(t, cfg.validate(), "br-restore requires br-backup")
+	cfg.BRBackup = "backup"
+	assert.ErrorContains(t, cfg.validate(), "br-backup requires dest-type mysql")
+	cfg.DestType = destTypeMySQL
+	cfg.DestDB.DSN = "root@tcp(127.0.0.1:4000)/"
+	assert.ErrorContains(t, cfg.validate(), "br-pd is required by br-restore")
+	cfg.BRPD = "127.0.0.1:2379"
+	assert.NilError(t, cfg.validate())
+}
@@ -0,0 +1,232 @@
+package pitr
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	tidbconfig "github.com/pingcap/tidb/config"
+)
+
+// pdVersionAPI is the API of PD requested to check it's reachable
+const pdVersionAPI = "/pd/api/v1/version"
+
+// CheckConfig parses the flags and config file in args like a run, and checks the config without merging any
+// binlog: the options, the syntax of the filters, the data dirs, the TSO range against the binlog files, PD and
+// the writability of the output paths. All the problems are printed to w, and an error is returned if any.
+func CheckConfig(w io.Writer, args []string) error {
+	cfg := NewConfig()
+	if err := cfg.parseFlags(args); err != nil {
+		return errors.Trace(err)
+	}
+
+	problems := cfg.checkProblems()
+	for _, problem := range problems {
+		fmt.Fprintf(w, "[problem] %s\n", problem)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("%d problems are found in the config", len(problems))
+	}
+	fmt.Fprintln(w, "the config is ok")
+	return nil
+}
+
+// checkProblems returns all the problems of the config, the checks go on after a problem is found, so they are
+// reported at once instead of one per run.
+func (c *Config) checkProblems() []error {
+	var (
+		problems []error
+		seen     = make(map[string]struct{})
+	)
+	add := func(err error) {
+		if err == nil {
+			return
+		}
+		// validate may report the same problem as the checks before it
+		if _, ok := seen[err.Error()]; ok {
+			return
+		}
+		seen[err.Error()] = struct{}{}
+		problems = append(problems, err)
+	}
+
+	add(c.checkFilterSyntax())
+	datetimeErrs := c.checkDatetimes()
+	for _, err := range datetimeErrs {
+		add(err)
+	}
+	add(c.validate())
+	// the range is checked against the binlog files only if it's valid
+	tsoOK := len(datetimeErrs) == 0 && c.StartTSO >= 0 && c.StopTSO >= 0 && (c.StopTSO == 0 || c.StartTSO <= c.StopTSO)
+
+	if c.KafkaAddrs == "" && (c.Dir != "" || c.Storage != "") {
+		dirs, errs := c.checkDataDirs()
+		for _, err := range errs {
+			add(err)
+		}
+		if tsoOK && len(dirs) > 0 && c.InputFormat == inputFormatDrainer {
+			if _, _, err := searchSources(dirs, c.StartTSO, c.StopTSO, c.OnFileGap, runOptions{}); err != nil {
+				add(errors.Annotate(err, "check the TSO range against the binlog files"))
+			}
+		}
+	}
+	if c.PDURLs != "" {
+		for _, err := range checkPDReachable(c.PDURLs, c.pdSecurity(), time.Duration(c.PDTimeout)*time.Second) {
+			add(err)
+		}
+	}
+	for _, err := range c.checkOutputPaths() {
+		add(err)
+	}
+	return problems
+}
+
+// checkFilterSyntax checks tables, filter-rules-file, row-filter and partitions.
+func (c *Config) checkFilterSyntax() error {
+	var msgs []string
+	if _, _, err := parseTables(c.Tables); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if c.FilterRulesFile != "" {
+		if _, err := loadFilterRules(c.FilterRulesFile); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if _, err := parseRowFilter(c.RowFilter); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if _, err := parsePartitions(c.Partitions); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid filters: %s", strings.Join(msgs, "; "))
+}
+
+// checkDatetimes converts start-datetime and stop-datetime to the TSOs like Adjust.
+func (c *Config) checkDatetimes() []error {
+	loc, err := c.location()
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	if c.StartDatetime != "" {
+		if c.StartTSO, err = dateTimeToTSO(c.StartDatetime, loc); err != nil {
+			errs = append(errs, errors.Annotate(err, "start-datetime"))
+		}
+	}
+	if c.StopDatetime != "" {
+		if c.StopTSO, err = dateTimeToTSO(c.StopDatetime, loc); err != nil {
+			errs = append(errs, errors.Annotate(err, "stop-datetime"))
+		}
+	}
+	return errs
+}
+
+// checkDataDirs checks the local dirs in data-dir exist, and returns the dirs which can be searched.
+// The storage uris are returned as they are, they are checked by listing the files.
+func (c *Config) checkDataDirs() ([]string, []error) {
+	dirs, err := c.binlogDirs()
+	if err != nil {
+		return nil, []error{err}
+	}
+	var (
+		existing []string
+		errs     []error
+	)
+	for _, dir := range dirs {
+		if strings.Contains(dir, "://") {
+			existing = append(existing, dir)
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			errs = append(errs, errors.Annotatef(err, "data dir %s", dir))
+			continue
+		}
+		if !info.IsDir() {
+			errs = append(errs, errors.Errorf("data dir %s is not a directory", dir))
+			continue
+		}
+		existing = append(existing, dir)
+	}
+	return existing, errs
+}
+
+// checkPDReachable requests the version API of every PD in urls.
+func checkPDReachable(urls string, security tidbconfig.Security, timeout time.Duration) []error {
+	client, scheme, err := newPDHTTPClient(security, timeout)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, addr := range pdAddrs(urls, scheme) {
+		resp, err := client.Get(addr + pdVersionAPI)
+		if err != nil {
+			errs = append(errs, errors.Annotatef(err, "PD %s is not reachable", addr))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, errors.Errorf("PD %s is not reachable, got status %s", addr, resp.Status))
+		}
+	}
+	return errs
+}
+
+// checkOutputPaths checks the output dir, temp-dir and the dirs of report-file and savepoint-file are writable.
+func (c *Config) checkOutputPaths() []error {
+	dirs := []string{defaultOutputDir, c.TempDir}
+	for _, file := range []string{c.ReportFile, c.SavepointFile} {
+		if file != "" {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	var errs []error
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if err := checkWritable(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkWritable creates and removes a file in dir, the dir not created yet is checked by its nearest existing
+// parent, which the dir will be created in.
+func checkWritable(dir string) error {
+	probeDir := filepath.Clean(dir)
+	for {
+		info, err := os.Stat(probeDir)
+		if err == nil {
+			if !info.IsDir() {
+				return errors.Errorf("%s is not a directory, can't write to %s", probeDir, dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return errors.Annotatef(err, "check %s", dir)
+		}
+		parent := filepath.Dir(probeDir)
+		if parent == probeDir {
+			return errors.Errorf("no parent of %s exists", dir)
+		}
+		probeDir = parent
+	}
+
+	f, err := ioutil.TempFile(probeDir, ".pitr-check-")
+	if err != nil {
+		return errors.Annotatef(err, "%s is not writable", dir)
+	}
+	f.Close()
+	return errors.Trace(os.Remove(f.Name()))
+}
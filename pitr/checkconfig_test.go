@@ -0,0 +1,60 @@
+package pitr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-check-config")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	err = CheckConfig(&out, []string{
+		"--data-dir", filepath.Join(dir, "not-exist"),
+		"--tables", "db1",
+		"--start-tso", "200",
+		"--stop-tso", "100",
+		"--temp-dir", filepath.Join(dir, "temp"),
+	})
+	assert.ErrorContains(t, err, "3 problems")
+	problems := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, len(problems), 3)
+	assert.Assert(t, strings.Contains(problems[0], "invalid table db1"))
+	assert.Assert(t, strings.Contains(problems[1], "greater than stop-tso"))
+	assert.Assert(t, strings.Contains(problems[2], "not-exist"))
+
+	out.Reset()
+	err = CheckConfig(&out, []string{
+		"--data-dir", dir,
+		"--input-format", inputFormatTiCDC,
+		"--temp-dir", filepath.Join(dir, "temp", "sub"),
+		"--report-file", filepath.Join(dir, "report.json"),
+	})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, out.String(), "the config is ok\n")
+	_, err = os.Stat(filepath.Join(dir, "temp"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-check-writable")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	assert.Assert(t, checkWritable(filepath.Join(dir, "a", "b")) == nil)
+	files, err := ioutil.ReadDir(dir)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, len(files), 0)
+
+	file := filepath.Join(dir, "file")
+	assert.Assert(t, ioutil.WriteFile(file, nil, 0600) == nil)
+	assert.ErrorContains(t, checkWritable(filepath.Join(file, "sub")), "is not a directory")
+}
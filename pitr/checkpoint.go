@@ -0,0 +1,287 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	bf "github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"go.uber.org/zap"
+)
+
+const checkpointFileName = "checkpoint.json"
+
+// tempFilePos is the position of the last written temp binlog file of a table.
+type tempFilePos struct {
+	Suffix uint64 `json:"suffix"`
+	Offset int64  `json:"offset"`
+}
+
+// checkpoint saves the progress of Map and Reduce, so the processing can be resumed after crash.
+type checkpoint struct {
+	sync.Mutex `json:"-"`
+
+	path string
+
+	// MapCommitTS is the commit ts of the last binlog which is already saved in temp files
+	MapCommitTS int64 `json:"map-commit-ts"`
+	// MapFinished is true if all binlog files are mapped
+	MapFinished bool `json:"map-finished"`
+	// TempFiles saves the position of temp files for every table when saving checkpoint
+	TempFiles map[string]tempFilePos `json:"temp-files"`
+	// ReducedTables saves the tables already reduced
+	ReducedTables map[string]bool `json:"reduced-tables"`
+	// TempStore is how the split events are saved in temp dir, empty means file
+	TempStore string `json:"temp-store,omitempty"`
+	// Renamed maps the temp dir of every table renamed in the window to the name of its output
+	Renamed map[string]string `json:"renamed,omitempty"`
+	// BRRestored is true if the BR backup is restored by br-restore
+	BRRestored bool `json:"br-restored,omitempty"`
+	// Run is the parameters of the run which saves the checkpoint, nil in the checkpoints of the old versions
+	Run *checkpointRun `json:"run,omitempty"`
+}
+
+// checkpointRun is the parameters selecting the merged binlogs and tables, the checkpoint can only be resumed by
+// a run with the same parameters, otherwise the output would mix the binlogs selected by two runs.
+type checkpointRun struct {
+	StartTSO      int64   `json:"start-tso"`
+	StopTSO       int64   `json:"stop-tso"`
+	StopTSOs      []int64 `json:"stop-tsos,omitempty"`
+	StartDatetime string  `json:"start-datetime,omitempty"`
+	StopDatetime  string  `json:"stop-datetime,omitempty"`
+	DataDir       string  `json:"data-dir"`
+	// Storage and BRBackup are redacted, the credentials are not saved
+	Storage         string             `json:"storage,omitempty"`
+	InputFormat     string             `json:"input-format,omitempty"`
+	KafkaAddrs      string             `json:"kafka-addrs,omitempty"`
+	KafkaTopic      string             `json:"kafka-topic,omitempty"`
+	BaseDir         string             `json:"base-dir,omitempty"`
+	BRBackup        string             `json:"br-backup,omitempty"`
+	DoTables        []filter.TableName `json:"replicate-do-table,omitempty"`
+	DoDBs           []string           `json:"replicate-do-db,omitempty"`
+	IgnoreTables    []filter.TableName `json:"replicate-ignore-table,omitempty"`
+	IgnoreDBs       []string           `json:"replicate-ignore-db,omitempty"`
+	Tables          string             `json:"tables,omitempty"`
+	FilterRulesFile string             `json:"filter-rules-file,omitempty"`
+	RowFilter       string             `json:"row-filter,omitempty"`
+	Partitions      string             `json:"partitions,omitempty"`
+	MergeKeys       []MergeKey         `json:"merge-keys,omitempty"`
+	NoPKPolicy      string             `json:"no-pk-policy,omitempty"`
+	// MaskRules is the SHA256 of mask-rules-file, the rules may be changed in the same file
+	MaskRules string `json:"mask-rules,omitempty"`
+}
+
+func newCheckpointRun(cfg *Config) (*checkpointRun, error) {
+	run := &checkpointRun{
+		StartTSO:        cfg.StartTSO,
+		StopTSO:         cfg.StopTSO,
+		StopTSOs:        cfg.StopTSOs,
+		StartDatetime:   cfg.StartDatetime,
+		StopDatetime:    cfg.StopDatetime,
+		DataDir:         cfg.Dir,
+		Storage:         redactStorageURI(cfg.Storage),
+		InputFormat:     cfg.InputFormat,
+		KafkaAddrs:      cfg.KafkaAddrs,
+		KafkaTopic:      cfg.KafkaTopic,
+		BaseDir:         cfg.BaseDir,
+		BRBackup:        redactStorageURI(cfg.BRBackup),
+		DoTables:        cfg.DoTables,
+		DoDBs:           cfg.DoDBs,
+		IgnoreTables:    cfg.IgnoreTables,
+		IgnoreDBs:       cfg.IgnoreDBs,
+		Tables:          cfg.Tables,
+		FilterRulesFile: cfg.FilterRulesFile,
+		RowFilter:       cfg.RowFilter,
+		Partitions:      cfg.Partitions,
+		NoPKPolicy:      cfg.NoPKPolicy,
+	}
+	for _, key := range cfg.MergeKeys {
+		run.MergeKeys = append(run.MergeKeys, *key)
+	}
+	if len(cfg.MaskRulesFile) != 0 {
+		sum, err := fileSHA256(cfg.MaskRulesFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "read mask-rules-file %s", cfg.MaskRulesFile)
+		}
+		run.MaskRules = sum
+	}
+	return run, nil
+}
+
+// checkRun returns an error if the checkpoint is saved by a run with different parameters.
+func (cp *checkpoint) checkRun(run *checkpointRun) error {
+	last := cp.Run
+	if last == nil {
+		log.Warn("the checkpoint doesn't have the parameters of the last run, resume without checking them", zap.String("file", cp.path))
+		return nil
+	}
+	for _, param := range []struct {
+		name          string
+		current, last interface{}
+	}{
+		{"start-tso", run.StartTSO, last.StartTSO},
+		{"stop-tso", run.StopTSO, last.StopTSO},
+		{"stop-tsos", run.StopTSOs, last.StopTSOs},
+		{"start-datetime", run.StartDatetime, last.StartDatetime},
+		{"stop-datetime", run.StopDatetime, last.StopDatetime},
+		{"data-dir", run.DataDir, last.DataDir},
+		{"storage", run.Storage, last.Storage},
+		{"input-format", run.InputFormat, last.InputFormat},
+		{"kafka-addrs", run.KafkaAddrs, last.KafkaAddrs},
+		{"kafka-topic", run.KafkaTopic, last.KafkaTopic},
+		{"base-dir", run.BaseDir, last.BaseDir},
+		{"br-backup", run.BRBackup, last.BRBackup},
+		{"replicate-do-table", run.DoTables, last.DoTables},
+		{"replicate-do-db", run.DoDBs, last.DoDBs},
+		{"replicate-ignore-table", run.IgnoreTables, last.IgnoreTables},
+		{"replicate-ignore-db", run.IgnoreDBs, last.IgnoreDBs},
+		{"tables", run.Tables, last.Tables},
+		{"filter-rules-file", run.FilterRulesFile, last.FilterRulesFile},
+		{"row-filter", run.RowFilter, last.RowFilter},
+		{"partitions", run.Partitions, last.Partitions},
+		{"merge-keys", run.MergeKeys, last.MergeKeys},
+		{"no-pk-policy", run.NoPKPolicy, last.NoPKPolicy},
+		{"mask-rules-file sha256", run.MaskRules, last.MaskRules},
+	} {
+		// nil and empty lists are the same
+		if current, last := fmt.Sprint(param.current), fmt.Sprint(param.last); current != last {
+			return errors.Errorf("%s %s is different from %s of the last run, resume with the same %s, or remove the temp dir to start from the beginning",
+				param.name, current, last, param.name)
+		}
+	}
+	return nil
+}
+
+func newCheckpoint(dir string) *checkpoint {
+	return &checkpoint{
+		path:          filepath.Join(dir, checkpointFileName),
+		TempFiles:     make(map[string]tempFilePos),
+		ReducedTables: make(map[string]bool),
+	}
+}
+
+// loadCheckpoint loads checkpoint saved in dir.
+func loadCheckpoint(dir string) (*checkpoint, error) {
+	cp := newCheckpoint(dir)
+	data, err := ioutil.ReadFile(cp.path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read checkpoint %s", cp.path)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, errors.Annotatef(err, "decode checkpoint %s", cp.path)
+	}
+
+	return cp, nil
+}
+
+// save writes checkpoint to a temp file and then renames it, so the checkpoint file is always complete. The lock
+// is held until the file is renamed, so the concurrent saves don't write the same temp file, and the file saved
+// last has the latest state.
+func (cp *checkpoint) save() error {
+	cp.Lock()
+	defer cp.Unlock()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tmpPath := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Annotatef(err, "write checkpoint %s", tmpPath)
+	}
+
+	return errors.Trace(os.Rename(tmpPath, cp.path))
+}
+
+// saveMap saves the progress of Map, all the binlogs with commit ts <= commitTS are saved in temp files.
+func (cp *checkpoint) saveMap(commitTS int64, positions map[string]tempFilePos, finished bool) error {
+	cp.Lock()
+	cp.MapCommitTS = commitTS
+	cp.MapFinished = finished
+	cp.TempFiles = positions
+	cp.Unlock()
+
+	return cp.save()
+}
+
+// saveReducedTable saves the table already reduced.
+func (cp *checkpoint) saveReducedTable(table string) error {
+	cp.Lock()
+	cp.ReducedTables[table] = true
+	cp.Unlock()
+
+	return cp.save()
+}
+
+func (cp *checkpoint) isReduced(table string) bool {
+	cp.Lock()
+	defer cp.Unlock()
+
+	return cp.ReducedTables[table]
+}
+
+// restoreTempFiles truncates the temp files in tempDir to the positions saved in checkpoint,
+// binlogs written after the checkpoint will be written again when resuming.
+func (cp *checkpoint) restoreTempFiles(tempDir string) error {
+	tables, err := readSubDirs(tempDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, table := range tables {
+		tableDir := filepath.Join(tempDir, table)
+		pos, ok := cp.TempFiles[table]
+		if !ok {
+			log.Info("remove temp dir not in checkpoint", zap.String("dir", tableDir))
+			if err := os.RemoveAll(tableDir); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		names, err := bf.ReadBinlogNames(tableDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, name := range names {
+			suffix, _, err := bf.ParseBinlogName(name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			fileName := filepath.Join(tableDir, name)
+			if suffix > pos.Suffix {
+				err = os.Remove(fileName)
+			} else if suffix == pos.Suffix {
+				err = os.Truncate(fileName, pos.Offset)
+			}
+			if err != nil {
+				return errors.Annotatef(err, "restore temp file %s", fileName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSubDirs returns the names of sub directories in dir.
+func readSubDirs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
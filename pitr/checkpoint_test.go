@@ -0,0 +1,161 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	dir := "./test_checkpoint"
+	os.RemoveAll(dir)
+	err := os.Mkdir(dir, 0700)
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	cp := newCheckpoint(dir)
+	err = cp.saveMap(100, map[string]tempFilePos{"db1_tb1": {Suffix: 1, Offset: 20}}, false)
+	assert.Assert(t, err == nil)
+	err = cp.saveReducedTable("db1_tb2")
+	assert.Assert(t, err == nil)
+
+	cp, err = loadCheckpoint(dir)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, cp.MapCommitTS == 100)
+	assert.Assert(t, !cp.MapFinished)
+	assert.Assert(t, cp.TempFiles["db1_tb1"] == tempFilePos{Suffix: 1, Offset: 20})
+	assert.Assert(t, cp.isReduced("db1_tb2"))
+	assert.Assert(t, !cp.isReduced("db1_tb1"))
+}
+
+func TestCheckpointConcurrentSave(t *testing.T) {
+	dir := "./test_checkpoint_concurrent"
+	os.RemoveAll(dir)
+	assert.NilError(t, os.Mkdir(dir, 0700))
+	defer os.RemoveAll(dir)
+
+	cp := newCheckpoint(dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NilError(t, cp.saveReducedTable(fmt.Sprintf("db_t%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	cp, err := loadCheckpoint(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(cp.ReducedTables), 10)
+}
+
+func TestCheckpointCheckRun(t *testing.T) {
+	dir := "./test_checkpoint_run"
+	os.RemoveAll(dir)
+	assert.NilError(t, os.Mkdir(dir, 0700))
+	defer os.RemoveAll(dir)
+
+	maskRules := filepath.Join(dir, "mask.yaml")
+	assert.NilError(t, ioutil.WriteFile(maskRules, []byte("- {table: db.t1, column: phone, method: hash}\n"), 0600))
+	cfg := &Config{Dir: "data.drainer", StartTSO: 100, StopTSO: 200, DoDBs: []string{"db"}, Storage: "s3://bucket/binlog?secret-access-key=sk",
+		MergeKeys: []*MergeKey{{SchemaPattern: "db", TablePattern: "t1", Index: "uk"}}, MaskRulesFile: maskRules}
+	newRun := func(cfg *Config) *checkpointRun {
+		run, err := newCheckpointRun(cfg)
+		assert.NilError(t, err)
+		return run
+	}
+	cp := newCheckpoint(dir)
+	cp.Run = newRun(cfg)
+	assert.NilError(t, cp.saveMap(150, nil, false))
+
+	cp, err := loadCheckpoint(dir)
+	assert.NilError(t, err)
+	assert.NilError(t, cp.checkRun(newRun(cfg)))
+	// the credentials are not saved
+	assert.Equal(t, cp.Run.Storage, redactStorageURI(cfg.Storage))
+
+	for _, c := range []struct {
+		change func(cfg *Config)
+		msg    string
+	}{
+		{func(cfg *Config) { cfg.StopTSO = 300 }, "stop-tso 300 is different from 200"},
+		{func(cfg *Config) { cfg.StopTSOs = []int64{150} }, "stop-tsos [150] is different from []"},
+		{func(cfg *Config) { cfg.Dir = "data.other" }, "data-dir data.other is different"},
+		{func(cfg *Config) { cfg.DoDBs = nil }, "replicate-do-db [] is different from [db]"},
+		{func(cfg *Config) { cfg.RowFilter = "id > 1" }, "row-filter"},
+		{func(cfg *Config) { cfg.MergeKeys = nil }, "merge-keys [] is different from [{db t1 uk}]"},
+		{func(cfg *Config) { cfg.NoPKPolicy = noPKPolicyAppendOnly }, "no-pk-policy append-only is different"},
+		{func(cfg *Config) { cfg.BaseDir = "base" }, "base-dir base is different"},
+		{func(cfg *Config) { cfg.InputFormat = inputFormatPump }, "input-format pump is different"},
+	} {
+		changed := *cfg
+		c.change(&changed)
+		assert.ErrorContains(t, cp.checkRun(newRun(&changed)), c.msg)
+	}
+
+	// the rules are changed in the same file
+	assert.NilError(t, ioutil.WriteFile(maskRules, []byte("- {table: db.t1, column: phone, method: redact}\n"), 0600))
+	assert.ErrorContains(t, cp.checkRun(newRun(cfg)), "mask-rules-file sha256")
+
+	// the checkpoint of the old versions has no parameters
+	cp.Run = nil
+	assert.NilError(t, cp.checkRun(newRun(cfg)))
+}
+
+func TestCheckpointRestoreTempFiles(t *testing.T) {
+	dir := "./test_checkpoint_restore"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	schema := "db1"
+	table := "tb1"
+	cols := generateColumns()
+	ev := pb.Event{
+		Tp:         pb.EventType_Insert,
+		SchemaName: &schema,
+		TableName:  &table,
+		Row:        [][]byte{cols[0], cols[1]},
+	}
+
+	f, err := NewPbFile(dir, schema, table, 1)
+	assert.Assert(t, err == nil)
+	f.AddDMLEvent(ev, 35, string(cols[0]))
+	pos, err := f.flush()
+	assert.Assert(t, err == nil)
+	assert.Assert(t, pos.Offset > 0)
+
+	// events written after checkpoint
+	f.AddDMLEvent(ev, 36, string(cols[1]))
+	f.Close()
+
+	f, err = NewPbFile(dir, "db1", "tb2", 1)
+	assert.Assert(t, err == nil)
+	f.AddDMLEvent(ev, 37, string(cols[1]))
+	f.Close()
+
+	cp := newCheckpoint(dir)
+	cp.TempFiles["db1_tb1"] = pos
+	err = cp.restoreTempFiles(dir)
+	assert.Assert(t, err == nil)
+
+	tables, err := readSubDirs(dir)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, tables, []string{"db1_tb1"})
+
+	files, err := searchFiles(filepath.Join(dir, "db1_tb1"))
+	assert.Assert(t, err == nil)
+	reader, err := newDirPbReader(filepath.Join(dir, "db1_tb1"), 0, 0, runOptions{})
+	assert.Assert(t, err == nil)
+	binlogs, err := readAll(reader)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(files) == 1)
+	assert.Assert(t, len(binlogs) == 1)
+	assert.Assert(t, binlogs[0].CommitTs == 35)
+}
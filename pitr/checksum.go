@@ -0,0 +1,144 @@
+package pitr
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// checksumFileName is the checksums of all the files in output dir, in the format of sha256sum.
+const checksumFileName = "checksums.txt"
+
+// writeChecksums writes the SHA256 of all the files in dir to checksums.txt, the names are relative to dir.
+// filepath.Walk visits the files in lexical order, so the content is deterministic, and the SHA256 of
+// checksums.txt is the digest of the whole output, two runs have the same output if their digests are equal.
+func writeChecksums(dir string) (string, error) {
+	var lines []string
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == checksumFileName {
+			return nil
+		}
+		sum, err := fileSHA256(name)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s\n", sum, rel))
+		return nil
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	name := filepath.Join(dir, checksumFileName)
+	tmp := name + ".tmp"
+	content := []byte(strings.Join(lines, ""))
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return "", errors.Annotatef(err, "write checksums %s", tmp)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return "", errors.Trace(err)
+	}
+	digest := sha256.Sum256(content)
+	log.Info("checksums are written", zap.String("file", name), zap.Int("files", len(lines)),
+		zap.String("digest", hex.EncodeToString(digest[:])))
+	return name, nil
+}
+
+// readChecksums reads checksums.txt in dir, it returns the map from relative file name to SHA256.
+func readChecksums(dir string) (map[string]string, error) {
+	name := filepath.Join(dir, checksumFileName)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open checksums %s", name)
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != 64 || len(fields[1]) == 0 {
+			return nil, errors.Errorf("invalid line %d in %s: %q", lineNo, name, line)
+		}
+		sums[fields[1]] = fields[0]
+	}
+	return sums, errors.Trace(scanner.Err())
+}
+
+// VerifyOutput checks all the files listed in checksums.txt of dir exist and aren't changed.
+// The files not listed are only warned, so that the output dir can hold other files.
+func VerifyOutput(dir string) error {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		sum, err := fileSHA256(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(errors.Cause(err)) {
+			problems = append(problems, fmt.Sprintf("%s is missing", name))
+			continue
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if sum != sums[name] {
+			problems = append(problems, fmt.Sprintf("%s has checksum %s, expect %s", name, sum, sums[name]))
+		}
+	}
+
+	err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := sums[rel]; !ok && rel != checksumFileName {
+			log.Warn("file is not in checksums", zap.String("file", rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("%d of %d files failed verification: %s", len(problems), len(names), strings.Join(problems, "; "))
+	}
+	log.Info("all the output files are verified", zap.String("dir", dir), zap.Int("files", len(names)))
+	return nil
+}
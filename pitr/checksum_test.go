@@ -0,0 +1,74 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestVerifyOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(dir, "test_t1"), 0700))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "test_t1", "binlog-0000000000000000-20200101000000"), []byte("binlog"), 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "test_t2.sql"), []byte("insert"), 0600))
+
+	_, err = writeChecksums(dir)
+	assert.NilError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, checksumFileName))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "8b0ae9ad5bc098bbe9bf9b562c4a49ce7b54f966198a8a164411fd4907b2f306  test_t1/binlog-0000000000000000-20200101000000\n"+
+		"1e22560cee2c4b727c6a117792e04a6769efbe2395f8e2528c603a153a446477  test_t2.sql\n")
+	assert.NilError(t, VerifyOutput(dir))
+
+	// the files not in checksums are ignored
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0600))
+	assert.NilError(t, VerifyOutput(dir))
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "test_t2.sql"), []byte("insers"), 0600))
+	assert.NilError(t, os.Remove(filepath.Join(dir, "test_t1", "binlog-0000000000000000-20200101000000")))
+	err = VerifyOutput(dir)
+	assert.ErrorContains(t, err, "2 of 2 files failed verification")
+	assert.ErrorContains(t, err, "test_t1/binlog-0000000000000000-20200101000000 is missing")
+	assert.ErrorContains(t, err, "test_t2.sql has checksum")
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, checksumFileName), []byte("abc test_t2.sql\n"), 0600))
+	assert.ErrorContains(t, VerifyOutput(dir), "invalid line 1")
+}
+
+func TestReproducibleOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the same binlogs are written to the same files in every run
+	var digests []string
+	for _, run := range []string{"run1", "run2"} {
+		outputDir := filepath.Join(dir, run)
+		w, err := newPBWriter(runOptions{}, filepath.Join(outputDir, "test_t1"), compressGzip, 0)
+		assert.NilError(t, err)
+		for ts := int64(1); ts <= 3; ts++ {
+			assert.NilError(t, w.Write(genTestDDL("test", "t1", "create table if not exists test.t1 (id int)", ts)))
+		}
+		assert.NilError(t, w.Close())
+
+		_, err = writeChecksums(outputDir)
+		assert.NilError(t, err)
+		rp := newRunReport()
+		assert.NilError(t, rp.collectOutputFiles(outputDir))
+		sum, err := fileSHA256(filepath.Join(outputDir, checksumFileName))
+		assert.NilError(t, err)
+		assert.Equal(t, rp.OutputDigest, sum)
+		digests = append(digests, rp.OutputDigest)
+	}
+	assert.Equal(t, digests[0], digests[1])
+	sums, err := readChecksums(filepath.Join(dir, "run1"))
+	assert.NilError(t, err)
+	_, ok := sums["test_t1/binlog-0000000000000000"+compressSuffix(compressGzip)]
+	assert.Assert(t, ok, "%v", sums)
+}
@@ -0,0 +1,177 @@
+package pitr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+)
+
+const (
+	// defaultCollation is the collation of the columns without charset or collation in the table and database
+	defaultCollation = "utf8mb4_bin"
+	// binaryCollation compares the strings byte-wise without padding
+	binaryCollation = "binary"
+)
+
+// charsetDefaultCollations is the default collation of the charsets supported by TiDB.
+var charsetDefaultCollations = map[string]string{
+	"utf8mb4": "utf8mb4_bin",
+	"utf8":    "utf8_bin",
+	"latin1":  "latin1_bin",
+	"ascii":   "ascii_bin",
+	"binary":  binaryCollation,
+}
+
+// collationOf returns the collation of the charset and collation options, the default collation of the charset
+// is used if only the charset is set, empty means neither is set.
+func collationOf(charset, collation string) string {
+	if len(collation) != 0 {
+		return strings.ToLower(collation)
+	}
+	if len(charset) != 0 {
+		if collation, ok := charsetDefaultCollations[strings.ToLower(charset)]; ok {
+			return collation
+		}
+		return strings.ToLower(charset) + "_bin"
+	}
+	return ""
+}
+
+// columnCollations returns the collations of the string columns of the table, the collation of a column is from
+// the column, the table, the database and defaultCollation in turn like MySQL.
+func columnCollations(db *ast.CreateDatabaseStmt, table *ast.CreateTableStmt) map[string]string {
+	var dbCharset, dbCollation string
+	for _, opt := range db.Options {
+		switch opt.Tp {
+		case ast.DatabaseOptionCharset:
+			dbCharset = opt.Value
+		case ast.DatabaseOptionCollate:
+			dbCollation = opt.Value
+		}
+	}
+	var tableCharset, tableCollation string
+	for _, opt := range table.Options {
+		switch opt.Tp {
+		case ast.TableOptionCharset:
+			tableCharset = opt.StrValue
+		case ast.TableOptionCollate:
+			tableCollation = opt.StrValue
+		}
+	}
+	inherited := collationOf(tableCharset, tableCollation)
+	if len(inherited) == 0 {
+		inherited = collationOf(dbCharset, dbCollation)
+	}
+	if len(inherited) == 0 {
+		inherited = defaultCollation
+	}
+
+	collations := make(map[string]string)
+	for _, col := range table.Cols {
+		if col.Tp == nil || !isStringType(col.Tp.Tp) {
+			continue
+		}
+		collation := col.Tp.Collate
+		for _, opt := range col.Options {
+			if opt.Tp == ast.ColumnOptionCollate {
+				collation = opt.StrValue
+			}
+		}
+		if collation = collationOf(col.Tp.Charset, collation); len(collation) == 0 {
+			collation = inherited
+		}
+		collations[col.Name.Name.O] = collation
+	}
+	return collations
+}
+
+func isStringType(tp byte) bool {
+	switch tp {
+	case mysql.TypeVarchar, mysql.TypeString, mysql.TypeVarString,
+		mysql.TypeTinyBlob, mysql.TypeBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+		return true
+	}
+	return false
+}
+
+// keyValue returns the value of the key column col in the row key, the strings are normalized by the collation
+// of the column, so the values equal under the collation have the same key.
+func (info *tableInfo) keyValue(col string, value interface{}) string {
+	collation, ok := info.collations[col]
+	if !ok {
+		return fmt.Sprintf("%v", value)
+	}
+	switch v := value.(type) {
+	case string:
+		return collationKey(collation, v)
+	case []byte:
+		return collationKey(collation, string(v))
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// collationKey returns the key of s under the collation, two strings are equal under the collation if and only
+// if their keys are equal. The collations other than binary are PAD SPACE in TiDB, the trailing spaces are
+// ignored. The case-insensitive collations are compared by the weights of utf8mb4_general_ci, which fold the
+// case of all the scripts and the accents of Latin-1, the others like utf8mb4_unicode_ci are approximated by it.
+func collationKey(collation, s string) string {
+	switch {
+	case collation == binaryCollation:
+		return s
+	case strings.HasSuffix(collation, "_ci"):
+		return generalCIKey(strings.TrimRight(s, " "))
+	default:
+		return strings.TrimRight(s, " ")
+	}
+}
+
+// generalCIKey replaces every rune of s by its weight in utf8mb4_general_ci.
+func generalCIKey(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		sb.WriteRune(generalCIWeight(r))
+	}
+	return sb.String()
+}
+
+// generalCIWeight returns the weight of r in utf8mb4_general_ci, the runes out of the BMP have the same weight
+// 0xFFFD, the Latin-1 letters with accents have the weights of their base letters, and the other runes have
+// the weights of their upper case.
+func generalCIWeight(r rune) rune {
+	if r > 0xFFFF {
+		return 0xFFFD
+	}
+	if r < 0x100 {
+		return latin1GeneralCIWeights[r]
+	}
+	return unicode.ToUpper(r)
+}
+
+// latin1GeneralCIWeights is the weights of U+0000 to U+00FF in utf8mb4_general_ci.
+var latin1GeneralCIWeights = func() [0x100]rune {
+	var weights [0x100]rune
+	for r := range weights {
+		weights[r] = unicode.ToUpper(rune(r))
+	}
+	for base, runes := range map[rune]string{
+		'A': "ÀÁÂÃÄÅàáâãäå",
+		'C': "Çç",
+		'E': "ÈÉÊËèéêë",
+		'I': "ÌÍÎÏìíîï",
+		'N': "Ññ",
+		'O': "ÒÓÔÕÖòóôõö",
+		'S': "ß",
+		'U': "ÙÚÛÜùúûü",
+		'Y': "Ýýÿ",
+	} {
+		for _, r := range runes {
+			weights[r] = base
+		}
+	}
+	return weights
+}()
@@ -0,0 +1,88 @@
+package pitr
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+func TestCollationKey(t *testing.T) {
+	for _, c := range []struct {
+		collation string
+		a, b      string
+		equal     bool
+	}{
+		{"utf8mb4_general_ci", "abc", "ABC", true},
+		{"utf8mb4_general_ci", "Résumé", "RESUME", true},
+		{"utf8mb4_general_ci", "straße", "STRASE", true},
+		{"utf8mb4_general_ci", "abc  ", "ABC", true},
+		{"utf8mb4_general_ci", "σ", "Σ", true},
+		{"utf8mb4_general_ci", "😀", "😃", true},
+		{"utf8mb4_general_ci", "abc", "abd", false},
+		{"utf8mb4_bin", "abc", "ABC", false},
+		{"utf8mb4_bin", "abc  ", "abc", true},
+		{binaryCollation, "abc  ", "abc", false},
+	} {
+		equal := collationKey(c.collation, c.a) == collationKey(c.collation, c.b)
+		assert.Equal(t, equal, c.equal, "%s: %s, %s", c.collation, c.a, c.b)
+	}
+}
+
+func TestNewCollationKeys(t *testing.T) {
+	var tracker schemaTracker
+	for _, ddl := range []string{
+		"create database db1 default charset utf8mb4 collate utf8mb4_general_ci",
+		"use db1; create table t1 (name varchar(32) primary key, v int)",
+		"use db1; create table t2 (name varchar(32) collate utf8mb4_bin primary key, v int)",
+		"use db1; create table t3 (name varbinary(32) primary key, v int) default charset utf8mb4 collate utf8mb4_general_ci",
+		"use db1; create table t4 (id int, name varchar(32), primary key (id, name)) collate utf8mb4_unicode_ci",
+	} {
+		assert.NilError(t, tracker.execute("", ddl), ddl)
+	}
+
+	rowKey := func(info *tableInfo, name string) string {
+		nameValue, err := codec.EncodeValue(&stmtctx.StatementContext{}, nil, types.NewDatum(name))
+		assert.NilError(t, err)
+		var row [][]byte
+		for _, col := range []*pb.Column{
+			{Name: "id", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(1)},
+			{Name: "name", Tp: []byte{mysql.TypeVarchar}, MysqlType: "varchar", Value: nameValue},
+		} {
+			data, err := col.Marshal()
+			assert.NilError(t, err)
+			row = append(row, data)
+		}
+		key, _, err := getInsertAndDeleteRowKey(row, info)
+		assert.NilError(t, err)
+		return key
+	}
+
+	for _, c := range []struct {
+		table string
+		equal bool
+	}{
+		{"t1", true},
+		{"t2", false},
+		{"t3", false},
+		{"t4", true},
+	} {
+		// the keys are compared byte-wise without new collations
+		for _, enabled := range []bool{false, true} {
+			tracker.newCollation = enabled
+			info, err := tracker.tableInfo("db1", c.table)
+			assert.NilError(t, err)
+			equal := rowKey(info, "Alice") == rowKey(info, "ALICE ")
+			assert.Equal(t, equal, c.equal && enabled, "%s: new collations %v", c.table, enabled)
+		}
+	}
+
+	tracker.newCollation = true
+	info, err := tracker.tableInfo("db1", "t1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.collations, map[string]string{"name": "utf8mb4_general_ci"})
+}
@@ -0,0 +1,199 @@
+package pitr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pingcap/errors"
+)
+
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+	compressLZ4  = "lz4"
+)
+
+// compressSuffixes is the file name suffix of every codec.
+var compressSuffixes = map[string]string{
+	compressGzip: ".gz",
+	compressZstd: ".zst",
+	compressLZ4:  ".lz4",
+}
+
+// compressMagics is the magic bytes at the beginning of the file compressed by every codec.
+var compressMagics = map[string][]byte{
+	compressGzip: {0x1f, 0x8b},
+	compressZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	compressLZ4:  {0x04, 0x22, 0x4d, 0x18},
+}
+
+const maxMagicLen = 4
+
+func isValidCompress(codec string) bool {
+	_, ok := compressSuffixes[codec]
+	return ok || codec == compressNone || codec == ""
+}
+
+// compressSuffix returns the file name suffix of the codec, empty string means not compressed.
+func compressSuffix(codec string) string {
+	return compressSuffixes[codec]
+}
+
+// trimCompressSuffix returns the file name without compression suffix, and the codec of the file.
+func trimCompressSuffix(name string) (string, string) {
+	for codec, suffix := range compressSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), codec
+		}
+	}
+	return name, compressNone
+}
+
+// newCompressWriter returns a writer which compresses the data by codec and writes to w,
+// the returned writer should be closed before closing w.
+func newCompressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case compressGzip:
+		return gzip.NewWriter(w), nil
+	case compressZstd:
+		return zstd.NewWriter(w), nil
+	case compressLZ4:
+		return lz4.NewWriter(w), nil
+	case compressNone, "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, errors.Errorf("unknown compression codec %s", codec)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newDecompressReader returns a reader which decompresses r by the codec decided by the suffix of name,
+// or by the magic bytes at the beginning of r if name has no compression suffix. r is decrypted first
+// by c if name has the encryption suffix.
+// closing the returned reader also closes r.
+func newDecompressReader(name string, r io.ReadCloser, c *payloadCipher) (io.ReadCloser, error) {
+	var (
+		src    io.Reader = r
+		reader io.Reader
+		closer func() error
+	)
+	// the file is compressed before encryption
+	if strings.HasSuffix(name, encryptSuffix) {
+		dr, err := newDecryptReader(c, r)
+		if err != nil {
+			return nil, errors.Annotatef(err, "open file %s", name)
+		}
+		src = dr
+		name = strings.TrimSuffix(name, encryptSuffix)
+	}
+	_, codec := trimCompressSuffix(name)
+	if codec == compressNone {
+		br := bufio.NewReader(src)
+		// Peek returns less bytes with error if the file is too short, it's not compressed in this case
+		magic, _ := br.Peek(maxMagicLen)
+		codec = detectCompress(magic)
+		if codec == compressNone {
+			return &decompressReader{Reader: br, file: r}, nil
+		}
+		src = br
+	}
+
+	switch codec {
+	case compressGzip:
+		gr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, errors.Annotatef(err, "open gzip file %s", name)
+		}
+		reader, closer = gr, gr.Close
+	case compressZstd:
+		zr := zstd.NewReader(src)
+		reader, closer = zr, zr.Close
+	case compressLZ4:
+		reader = lz4.NewReader(src)
+	}
+
+	return &decompressReader{Reader: reader, closer: closer, file: r}, nil
+}
+
+// detectCompress returns the codec by the magic bytes at the beginning of file.
+func detectCompress(magic []byte) string {
+	for codec, m := range compressMagics {
+		if bytes.HasPrefix(magic, m) {
+			return codec
+		}
+	}
+	return compressNone
+}
+
+type decompressReader struct {
+	io.Reader
+	closer func() error
+	file   io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	var err error
+	if r.closer != nil {
+		err = r.closer()
+	}
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+	return errors.Trace(err)
+}
+
+// compressFile compresses the file by codec to a new file named with the codec's suffix,
+// and removes the original file.
+func compressFile(name string, codec string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer src.Close()
+
+	dstName := name + compressSuffix(codec)
+	tmpName := dstName + ".tmp"
+	dst, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	w, err := newCompressWriter(codec, dst)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		return errors.Annotatef(err, "compress file %s", name)
+	}
+	if err = w.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = dst.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = dst.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = os.Rename(tmpName, dstName); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Remove(name))
+}
@@ -0,0 +1,115 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestCompressFile(t *testing.T) {
+	for _, codec := range []string{compressGzip, compressZstd, compressLZ4} {
+		dir, err := ioutil.TempDir("", "compress")
+		assert.Assert(t, err == nil)
+		defer os.RemoveAll(dir)
+
+		name := filepath.Join(dir, binlogfile.BinlogName(0))
+		f, err := os.Create(name)
+		assert.Assert(t, err == nil)
+		for i := 1; i <= 10; i++ {
+			data, err := genTestDML("test", "tb1", int64(i)).Marshal()
+			assert.Assert(t, err == nil)
+			_, err = f.Write(binlogfile.Encode(data))
+			assert.Assert(t, err == nil)
+		}
+		f.Close()
+
+		err = compressFile(name, codec)
+		assert.Assert(t, err == nil, codec)
+		_, err = os.Stat(name)
+		assert.Assert(t, os.IsNotExist(err))
+
+		// the compressed files are found and decompressed transparently
+		files, err := searchFiles(dir)
+		assert.Assert(t, err == nil)
+		assert.DeepEqual(t, files, []string{name + compressSuffix(codec)})
+
+		var binlogs []*pb.Binlog
+		err = scanBinlogFile(files[0], runOptions{}, func(binlog *pb.Binlog) error {
+			binlogs = append(binlogs, binlog)
+			return nil
+		})
+		assert.Assert(t, err == nil, codec)
+		assert.Assert(t, len(binlogs) == 10)
+		assert.Assert(t, binlogs[9].CommitTs == 10)
+	}
+}
+
+func TestCompressSQLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	w, err := newBinlogWriter(runOptions{}, outputFormatSQL, filepath.Join(dir, "test_tb1"), compressZstd, 0)
+	assert.Assert(t, err == nil)
+	err = w.Write(genTestDDL("test", "tb1", "create table tb1 (a int)", 1))
+	assert.Assert(t, err == nil)
+	err = w.Close()
+	assert.Assert(t, err == nil)
+
+	f, err := os.Open(filepath.Join(dir, "test_tb1.sql.zst"))
+	assert.Assert(t, err == nil)
+	r, err := newDecompressReader(f.Name(), f, nil)
+	assert.Assert(t, err == nil)
+	data, err := ioutil.ReadAll(r)
+	assert.Assert(t, err == nil)
+	r.Close()
+	assert.Equal(t, string(data), "create table tb1 (a int);\n")
+}
+
+func TestTrimCompressSuffix(t *testing.T) {
+	name, codec := trimCompressSuffix("binlog-0000000000000000-20191010101010.zst")
+	assert.Equal(t, name, "binlog-0000000000000000-20191010101010")
+	assert.Equal(t, codec, compressZstd)
+
+	name, codec = trimCompressSuffix("test_tb1.sql")
+	assert.Equal(t, name, "test_tb1.sql")
+	assert.Equal(t, codec, compressNone)
+
+	assert.Assert(t, isValidCompress(compressLZ4))
+	assert.Assert(t, !isValidCompress("snappy"))
+}
+
+func TestDetectCompressByMagic(t *testing.T) {
+	for _, codec := range []string{compressGzip, compressZstd, compressLZ4} {
+		dir, err := ioutil.TempDir("", "compress")
+		assert.Assert(t, err == nil)
+		defer os.RemoveAll(dir)
+
+		// compress the binlog file, and rename it to the name without suffix
+		name := filepath.Join(dir, binlogfile.BinlogName(0))
+		data, err := genTestDML("test", "tb1", 1).Marshal()
+		assert.Assert(t, err == nil)
+		err = ioutil.WriteFile(name, binlogfile.Encode(data), 0600)
+		assert.Assert(t, err == nil)
+		err = compressFile(name, codec)
+		assert.Assert(t, err == nil)
+		err = os.Rename(name+compressSuffix(codec), name)
+		assert.Assert(t, err == nil)
+
+		var binlogs []*pb.Binlog
+		err = scanBinlogFile(name, runOptions{}, func(binlog *pb.Binlog) error {
+			binlogs = append(binlogs, binlog)
+			return nil
+		})
+		assert.Assert(t, err == nil, codec)
+		assert.Assert(t, len(binlogs) == 1)
+	}
+
+	assert.Equal(t, detectCompress(binlogfile.Encode([]byte("payload"))), compressNone)
+	assert.Equal(t, detectCompress(nil), compressNone)
+}
@@ -5,11 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
 	"github.com/pingcap/tidb-binlog/pkg/filter"
 	"github.com/pingcap/tidb-binlog/pkg/flags"
 	"github.com/pingcap/tidb-binlog/pkg/util"
@@ -21,18 +24,61 @@ import (
 const (
 	toolName   = "tidb-binlog-pitr"
 	timeFormat = "2006-01-02 15:04:05"
+
+	defaultConcurrency = 4
+	// defaultReduceConcurrency is the default max number of tables reduced at the same time
+	defaultReduceConcurrency = 16
+
+	destTypeFile  = "file"
+	destTypeMySQL = "mysql"
+	destTypeKafka = "kafka"
+	destTypeGRPC  = "grpc"
+
+	// onGapAbort and onGapWarn are the values of on-file-gap
+	onGapAbort = "abort"
+	onGapWarn  = "warn"
+
+	defaultDestBatchSize = 100
+	defaultDestMaxRetry  = 3
+	defaultDestWorkers   = 1
 )
 
 // Config is the main configuration for the retore tool.
 type Config struct {
 	*flag.FlagSet `toml:"-" json:"-"`
 	Dir           string `toml:"data-dir" json:"data-dir"`
+	Storage       string `toml:"storage" json:"storage"`
 	StartDatetime string `toml:"start-datetime" json:"start-datetime"`
 	StopDatetime  string `toml:"stop-datetime" json:"stop-datetime"`
 	StartTSO      int64  `toml:"start-tso" json:"start-tso"`
 	StopTSO       int64  `toml:"stop-tso" json:"stop-tso"`
+	// StopTSOs is the earlier stop points before StopTSO, the output at every stop point is written to the
+	// dir stop-{tso} in output dir, empty means only StopTSO
+	StopTSOs []int64 `toml:"stop-tsos" json:"stop-tsos"`
+	// TimeZone is the time zone of start-datetime and stop-datetime, empty string means the local time zone
+	TimeZone string `toml:"timezone" json:"timezone"`
 
 	PDURLs string `toml:"pd-urls" json:"pd-urls"`
+	// PDMaxRetry is the max retry times when fetching the history DDL jobs failed
+	PDMaxRetry int `toml:"pd-max-retry" json:"pd-max-retry"`
+	// PDTimeout is the timeout in seconds of connecting to PD and fetching the history DDL jobs
+	PDTimeout int `toml:"pd-timeout" json:"pd-timeout"`
+	// GCTTL is the TTL in seconds of the service GC safepoint registered in PD during the run, 0 means not registering
+	GCTTL int `toml:"gc-ttl" json:"gc-ttl"`
+	// PDSSLCA, PDSSLCert and PDSSLKey are the TLS certs to connect PD and TiKV of a secured cluster
+	PDSSLCA   string `toml:"pd-ssl-ca" json:"pd-ssl-ca"`
+	PDSSLCert string `toml:"pd-ssl-cert" json:"pd-ssl-cert"`
+	PDSSLKey  string `toml:"pd-ssl-key" json:"pd-ssl-key"`
+	// HistoryDDLCache is the file to cache the history DDL jobs fetched from TiKV, it's reused by later runs
+	HistoryDDLCache string `toml:"history-ddl-cache" json:"history-ddl-cache"`
+	// HistoryDDLFile is the dumped history DDL jobs in JSON, or DDL statements in a .sql file, used instead of PD
+	HistoryDDLFile string `toml:"history-ddl-file" json:"history-ddl-file"`
+	// DDLSource is where the history DDL jobs are read, pd, tidb or file, empty means inferring it from the other options
+	DDLSource string `toml:"ddl-source" json:"ddl-source"`
+	// TiDBStatusAddr is the status address of TiDB to fetch the history DDL jobs by ddl-source tidb
+	TiDBStatusAddr string `toml:"tidb-status-addr" json:"tidb-status-addr"`
+	// OnDDLError is how to handle the history DDLs failed to execute, abort, skip or quarantine
+	OnDDLError string `toml:"on-ddl-error" json:"on-ddl-error"`
 
 	DoTables []filter.TableName `toml:"replicate-do-table" json:"replicate-do-table"`
 	DoDBs    []string           `toml:"replicate-do-db" json:"replicate-do-db"`
@@ -40,43 +86,349 @@ type Config struct {
 	IgnoreTables []filter.TableName `toml:"replicate-ignore-table" json:"replicate-ignore-table"`
 	IgnoreDBs    []string           `toml:"replicate-ignore-db" json:"replicate-ignore-db"`
 
+	// RouteRules renames the schemas and tables in the merged binlogs
+	RouteRules []*RouteRule `toml:"route-rules" json:"route-rules"`
+	// MergeKeys chooses the unique index identifying the rows of tables instead of the primary key
+	MergeKeys []*MergeKey `toml:"merge-keys" json:"merge-keys"`
+
+	// Tables is the list of tables to restore, like `db1.t1,db2.*`, it's added to replicate-do-table and replicate-do-db
+	Tables string `toml:"tables" json:"tables"`
+	// FilterRulesFile is the TOML file of table rules, they are added to the rules above
+	FilterRulesFile string `toml:"filter-rules-file" json:"filter-rules-file"`
+	// CheckFilter only prints the tables matched by every table rule
+	CheckFilter bool `toml:"check-filter" json:"check-filter"`
+
+	// RowFilter is the list of expressions to filter the rows of tables, like `db.orders: tenant_id = 42`
+	RowFilter string `toml:"row-filter" json:"row-filter"`
+	// Partitions is the list of partitions to restore of the partitioned tables, like `db.orders: p2023, p2024`
+	Partitions string `toml:"partitions" json:"partitions"`
+	// MaskRulesFile is the YAML file of the rules masking the values of columns in Map, empty means not masking
+	MaskRulesFile string `toml:"mask-rules-file" json:"mask-rules-file"`
+	// EventHookPlugin is the Go plugin of the EventHook called with the DDLs and merged rows in Reduce, empty means no hook
+	EventHookPlugin string `toml:"event-hook-plugin" json:"event-hook-plugin"`
+	// EventHookConfig is passed to NewEventHook of the plugin
+	EventHookConfig string `toml:"event-hook-config" json:"event-hook-config"`
+
 	LogFile  string `toml:"log-file" json:"log-file"`
 	LogLevel string `toml:"log-level" json:"log-level"`
+	// LogFormat is the format of logs, text or json
+	LogFormat string `toml:"log-format" json:"log-format"`
+	// LogMaxSize is the size of the log file in MB before it's rotated
+	LogMaxSize int `toml:"log-max-size" json:"log-max-size"`
+	// LogMaxDays and LogMaxBackups are how many rotated log files are kept, 0 means keeping all
+	LogMaxDays    int `toml:"log-max-days" json:"log-max-days"`
+	LogMaxBackups int `toml:"log-max-backups" json:"log-max-backups"`
+	// LogSampleLimit is the number of the repetitive logs printed for every message, the later ones are only
+	// counted, 0 means printing all
+	LogSampleLimit int `toml:"log-sample-limit" json:"log-sample-limit"`
+	// RunID tags every log line of the run, a new id is generated if it's empty
+	RunID string `toml:"run-id" json:"run-id"`
+
+	// ReserveTempDir keeps the temp dir after the run
+	ReserveTempDir bool `toml:"reserve-tmpdir" json:"reserve-tmpdir"`
+	// TempDir is the dir to save the temp files of Map and the checkpoint
+	TempDir string `toml:"temp-dir" json:"temp-dir"`
+	// Force only warns when the disk space preflight check fails
+	Force bool `toml:"force" json:"force"`
+	// TempQuota is the max size of temp files like 100GiB, empty means no limit
+	TempQuota string `toml:"temp-quota" json:"temp-quota"`
+	// TempStore is how Map saves the split events in temp dir, file or kv
+	TempStore string `toml:"temp-store" json:"temp-store"`
+
+	Resume bool `toml:"resume" json:"resume"`
+	// ForceUnlock takes over the locks of temp dir and output dir held by another run
+	ForceUnlock bool `toml:"force-unlock" json:"force-unlock"`
+	// OnLeftoverTemp is how to handle the temp dir left by a crashed run, abort, resume or clean, empty means abort
+	OnLeftoverTemp string `toml:"on-leftover-temp" json:"on-leftover-temp"`
+
+	// StatusAddr is the address of HTTP server which exposes the progress and metrics
+	StatusAddr string `toml:"status-addr" json:"status-addr"`
+	// PprofAddr is the address of HTTP server which exposes the runtime profiles by /debug/pprof
+	PprofAddr string `toml:"pprof-addr" json:"pprof-addr"`
+
+	// DryRun only prints the summary of binlogs which will be merged
+	DryRun bool `toml:"dry-run" json:"dry-run"`
+
+	// ReportFile is the file to write the JSON report of the run, empty means not writing report
+	ReportFile string `toml:"report-file" json:"report-file"`
+	// ErrorFormat is the format of the error printed to stderr when the run fails, text or json, the exit code is
+	// decided by the class of the error in both formats
+	ErrorFormat string `toml:"error-format" json:"error-format"`
+
+	// SavepointFile is the file to write the savepoint of drainer's file checkpoint after the run, empty means
+	// not writing savepoint
+	SavepointFile string `toml:"savepoint-file" json:"savepoint-file"`
+
+	// Flashback writes the SQL statements which undo the DML changes between start and stop tso instead of merging
+	Flashback bool `toml:"flashback" json:"flashback"`
+	// SchemaOnly writes the DDLs of the selected tables between start and stop tso instead of merging
+	SchemaOnly bool `toml:"schema-only" json:"schema-only"`
+
+	// Verify checks the net row changes of merged binlogs are the same as the source binlogs after Reduce
+	Verify bool `toml:"verify" json:"verify"`
+
+	// NoPKPolicy is how to merge the tables without primary key or unique key, rowid, append-only or error
+	NoPKPolicy string `toml:"no-pk-policy" json:"no-pk-policy"`
+	// NewCollationsEnabled compares the string values of the key columns by the collations of the columns,
+	// it should be the same as new_collations_enabled_on_first_bootstrap of the source cluster
+	NewCollationsEnabled bool `toml:"new-collations-enabled" json:"new-collations-enabled"`
+
+	// PreserveTxn keeps the DML binlogs of every table as they are in the source binlogs, the rows are not
+	// merged across transactions
+	PreserveTxn bool `toml:"preserve-txn" json:"preserve-txn"`
+
+	// SkipDDL drops the DDLs from the output, they're still executed to track the schema
+	SkipDDL bool `toml:"skip-ddl" json:"skip-ddl"`
+
+	// RenamePolicy is how to merge the tables renamed in the window, merge or split
+	RenamePolicy string `toml:"rename-policy" json:"rename-policy"`
+
+	// MaxMemory is the max memory of the events in Reduce like 4GiB, the events are spilled to disk when
+	// it's exceeded, empty means no limit
+	MaxMemory string `toml:"max-memory" json:"max-memory"`
+
+	// Concurrency is the number of workers used to split binlogs in Map
+	Concurrency int `toml:"concurrency" json:"concurrency"`
+	// ReduceConcurrency is the max number of tables reduced at the same time, the largest tables are reduced first
+	ReduceConcurrency int `toml:"reduce-concurrency" json:"reduce-concurrency"`
+
+	// OutputFormat is the format of merged binlog files, pb, sql, jsonl or csv
+	OutputFormat string `toml:"output-format" json:"output-format"`
+	// Lightning also writes the csv files and schema in the layout of TiDB Lightning to the lightning dir in output dir
+	Lightning bool `toml:"lightning" json:"lightning"`
+
+	// BaseDir is the merged output of a previous run in pb format, only the binlogs after its max commit ts
+	// are merged and folded into it, empty means merging from scratch
+	BaseDir string `toml:"base-dir" json:"base-dir"`
+	// BRBackup is the storage of a BR full backup, only the binlogs after its backup ts are merged and applied
+	// to dest-db, which is restored from the backup
+	BRBackup string `toml:"br-backup" json:"br-backup"`
+	// BRRestore restores the backup to the dest cluster by br before applying the merged binlogs
+	BRRestore bool `toml:"br-restore" json:"br-restore"`
+	// BRPath is the path of br binary
+	BRPath string `toml:"br-path" json:"br-path"`
+	// BRPD is the PD addresses of the dest cluster used by br restore
+	BRPD string `toml:"br-pd" json:"br-pd"`
+
+	// MaxEventSize is the max size of a binlog read from or written to the binlog files like 64MiB, empty or 0 means no limit
+	MaxEventSize string `toml:"max-event-size" json:"max-event-size"`
+	// OnOversizedEvent is how to handle the binlogs larger than MaxEventSize, abort or skip
+	OnOversizedEvent string `toml:"on-oversized-event" json:"on-oversized-event"`
+	// OutputFileSize is the size to rotate the output files of every table like 512MiB, empty means the default
+	OutputFileSize string `toml:"output-file-size" json:"output-file-size"`
+	// SyncMode is how the output files are synced before they're renamed from .tmp, none, file or dir
+	SyncMode string `toml:"sync-mode" json:"sync-mode"`
+	// OutputStorage is the s3 uri the output dir is uploaded to after it's written, empty means not uploaded
+	OutputStorage string `toml:"output-storage" json:"output-storage"`
+	// UploadConcurrency is the max number of files or parts uploaded to OutputStorage at the same time
+	UploadConcurrency int `toml:"upload-concurrency" json:"upload-concurrency"`
+	// UploadRateLimit is the max size uploaded to OutputStorage per second like 50MiB, empty means no limit
+	UploadRateLimit string `toml:"upload-rate-limit" json:"upload-rate-limit"`
+	// SliceInterval splits the output into the slices of consecutive time windows like 1h, every slice is
+	// replayable after the previous slices, empty means not sliced
+	SliceInterval string `toml:"slice-interval" json:"slice-interval"`
+
+	// EncryptKeyFile is the file of AES key to encrypt the output files, empty means not encrypted
+	EncryptKeyFile string `toml:"encrypt-key-file" json:"encrypt-key-file"`
+	// EncryptTemp also encrypts the temp files by the key of encrypt-key-file
+	EncryptTemp bool `toml:"encrypt-temp" json:"encrypt-temp"`
+
+	// InputFormat is the format of the binlog files in data-dir, drainer, pump, ticdc or mysql
+	InputFormat string `toml:"input-format" json:"input-format"`
+	// KafkaAddrs is the addresses of kafka brokers separated by comma, the binlogs are read from the topic
+	// written by drainer instead of data-dir when it's set
+	KafkaAddrs string `toml:"kafka-addrs" json:"kafka-addrs"`
+	// KafkaTopic is the topic of drainer's kafka sink
+	KafkaTopic string `toml:"kafka-topic" json:"kafka-topic"`
+	// KafkaVersion is the version of kafka
+	KafkaVersion string `toml:"kafka-version" json:"kafka-version"`
+	// OnFileGap is how to handle the missing binlog files between the selected files, abort or warn
+	OnFileGap string `toml:"on-file-gap" json:"on-file-gap"`
+	// RelaxCorruption is how to handle the corrupted binlog files, abort, skip-tail or skip-file
+	RelaxCorruption string `toml:"relax-corruption" json:"relax-corruption"`
+
+	// Compress is the codec used to compress the merged binlog files, none, gzip, zstd or lz4
+	Compress string `toml:"compress" json:"compress"`
+
+	// SafeMode writes and executes the idempotent DML statements, INSERT is replaced by REPLACE, and UPDATE is
+	// replaced by DELETE and REPLACE, like drainer's safe mode
+	SafeMode bool `toml:"safe-mode" json:"safe-mode"`
+	// ForeignKeyMode is how to replay the tables with foreign keys, disable-checks or ordered, empty means replaying
+	// the tables as they're
+	ForeignKeyMode string `toml:"foreign-key-mode" json:"foreign-key-mode"`
 
-	reserveTempDir bool `toml:"reserve-tmpdir" json:"reserve-tmpdir"`
+	// DestType is the type of destination, file, mysql, kafka or grpc
+	DestType string   `toml:"dest-type" json:"dest-type"`
+	DestDB   DBConfig `toml:"dest-db" json:"dest-db"`
+	// ConflictCheck is how to handle the rows to insert already in dest-db, error or safe-mode, empty means not
+	// checking
+	ConflictCheck string `toml:"conflict-check" json:"conflict-check"`
+	// ApplyQPS is the max number of statements executed in dest-db per second, 0 means no limit
+	ApplyQPS int `toml:"apply-qps" json:"apply-qps"`
+	// ApplyBytesPerSec is the max size of statements executed in dest-db per second like 10MiB, empty means no limit
+	ApplyBytesPerSec string `toml:"apply-bytes-per-sec" json:"apply-bytes-per-sec"`
+	// DestKafka is the kafka to publish the merged binlogs when dest-type is kafka
+	DestKafka KafkaSinkConfig `toml:"dest-kafka" json:"dest-kafka"`
+	// DestGRPCAddr is the address of the gRPC server streaming the merged binlogs when dest-type is grpc
+	DestGRPCAddr string `toml:"dest-grpc-addr" json:"dest-grpc-addr"`
 
-	schemaFile string `toml:"schema-file" json:"schema-file"`
+	// SchemaFile is the DDL statements of the base schema, used instead of the history DDL jobs
+	SchemaFile string `toml:"schema-file" json:"schema-file"`
 
-	configFile   string
-	printVersion bool
+	configFile        string
+	printVersion      bool
+	printSampleConfig bool
+}
+
+// DBConfig is the config of downstream TiDB/MySQL.
+type DBConfig struct {
+	// DSN is the data source name, like `user:password@tcp(127.0.0.1:3306)/`
+	DSN string `toml:"dsn" json:"dsn"`
+	// BatchSize is the max number of DML statements executed in one transaction
+	BatchSize int `toml:"batch-size" json:"batch-size"`
+	// MaxRetry is the max retry times when execute SQL failed
+	MaxRetry int `toml:"max-retry" json:"max-retry"`
+	// WorkerCount is the number of connections executing DMLs, the DMLs of a table are executed by one of them
+	WorkerCount int `toml:"worker-count" json:"worker-count"`
+}
+
+// KafkaSinkConfig is the config of the kafka to publish the merged binlogs.
+type KafkaSinkConfig struct {
+	// Addrs is the addresses of kafka brokers separated by comma
+	Addrs   string `toml:"addrs" json:"addrs"`
+	Topic   string `toml:"topic" json:"topic"`
+	Version string `toml:"version" json:"version"`
+	// Protocol is the format of messages, open-binlog or canal-json
+	Protocol string `toml:"protocol" json:"protocol"`
+	// MaxMessageBytes is the max size of a message
+	MaxMessageBytes int `toml:"max-message-bytes" json:"max-message-bytes"`
 }
 
 // NewConfig creates a Config object.
 func NewConfig() *Config {
-	c := &Config{}
+	c := &Config{
+		DestDB: DBConfig{
+			BatchSize:   defaultDestBatchSize,
+			MaxRetry:    defaultDestMaxRetry,
+			WorkerCount: defaultDestWorkers,
+		},
+		DestKafka: KafkaSinkConfig{
+			Version:         defaultKafkaVersion,
+			Protocol:        kafkaProtocolOpenBinlog,
+			MaxMessageBytes: defaultKafkaMaxMessageBytes,
+		},
+	}
 	c.FlagSet = flag.NewFlagSet(toolName, flag.ContinueOnError)
 	fs := c.FlagSet
 	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Usage of %s:", toolName))
 		fs.PrintDefaults()
 	}
-	fs.StringVar(&c.Dir, "data-dir", "", "drainer data directory path")
+	fs.StringVar(&c.Dir, "data-dir", "", "drainer data directory path, can be a comma separated list of directories or glob patterns of multiple drainers, the binlogs are merged by commit ts")
+	fs.StringVar(&c.Storage, "storage", "", "uri of the storage which saves drainer's binlog files, e.g. s3://bucket/prefix?endpoint=http://127.0.0.1:9000, used instead of data-dir")
 	fs.StringVar(&c.StartDatetime, "start-datetime", "", "recovery from start-datetime, empty string means starting from the beginning of the first file")
 	fs.StringVar(&c.StopDatetime, "stop-datetime", "", "recovery end in stop-datetime, empty string means never end.")
+	fs.StringVar(&c.TimeZone, "timezone", "", "time zone of start-datetime and stop-datetime, e.g. UTC, Asia/Shanghai, empty string means the local time zone")
 	fs.Int64Var(&c.StartTSO, "start-tso", 0, "similar to start-datetime but in pd-server tso format")
-	fs.Int64Var(&c.StopTSO, "stop-tso", 0, "similar to stop-datetime, but in pd-server tso format")
+	fs.Var(stopTSOValue{c}, "stop-tso", "similar to stop-datetime, but in pd-server tso format, it can be a comma separated list of stop points, the output at the last one is written to output dir, and the output at every earlier one is written to the dir stop-{tso} in output dir by one pass over the binlogs")
+	fs.StringVar(&c.Tables, "tables", "", "comma separated list of tables to restore, e.g. db1.t1,db2.*, only the binlogs and history DDLs of these tables are handled")
+	fs.StringVar(&c.FilterRulesFile, "filter-rules-file", "", "TOML file of table rules, which may have tables, replicate-do-db, replicate-do-table, replicate-ignore-db and replicate-ignore-table like the config file, they are added to the rules set by other options")
+	fs.BoolVar(&c.CheckFilter, "check-filter", false, "only print the tables matched by every table rule and the selected tables, which are discovered from the history DDLs and the binlogs, don't write any file, it fails if a replicate-do rule matches no table")
+	fs.StringVar(&c.RowFilter, "row-filter", "", "semicolon separated list of row filters like `db.orders: tenant_id = 42`, only the rows matching the expression are merged, the expression supports =, !=, <, <=, >, >=, IN, BETWEEN, IS [NOT] NULL, AND, OR, NOT and parentheses")
+	fs.StringVar(&c.Partitions, "partitions", "", "semicolon separated list of partitions to restore like `db.orders: p2023, p2024`, only the rows in these partitions of the tables are merged, the partitions by RANGE, LIST or HASH of a column are supported")
+	fs.StringVar(&c.MaskRulesFile, "mask-rules-file", "", "YAML file of the rules masking the columns of tables in the merged binlogs, every rule hashes, nulls or replaces by a static value the columns of db.table or db.*")
+	fs.StringVar(&c.EventHookPlugin, "event-hook-plugin", "", "Go plugin built by go build -buildmode=plugin, which exports NewEventHook of type func(string) (pitr.EventHook, error), the hook is called with every DDL and merged row in Reduce to filter, count or transform them")
+	fs.StringVar(&c.EventHookConfig, "event-hook-config", "", "the config passed to NewEventHook of event-hook-plugin")
 	fs.StringVar(&c.LogFile, "log-file", "", "log file path")
 	fs.StringVar(&c.LogLevel, "L", "info", "log level: debug, info, warn, error, fatal")
-	fs.StringVar(&c.configFile, "config", "", "[REQUIRED] path to configuration file")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "log level: debug, info, warn, error, fatal, same as -L")
+	fs.StringVar(&c.LogFormat, "log-format", logFormatText, "format of logs, text or json")
+	fs.IntVar(&c.LogMaxSize, "log-max-size", defaultLogMaxSize, "max size of log-file in MB, it's rotated when the size is exceeded")
+	fs.IntVar(&c.LogMaxDays, "log-max-days", 0, "max days to keep the rotated log files, 0 means keeping them forever")
+	fs.IntVar(&c.LogMaxBackups, "log-max-backups", 0, "max number of the rotated log files, 0 means keeping all of them")
+	fs.IntVar(&c.LogSampleLimit, "log-sample-limit", defaultLogSampleLimit, "number of the repetitive logs printed for every message like skipping a binlog or history DDL job, the later ones are only counted and the counts are logged at the end and written to report-file, 0 means printing all")
+	fs.StringVar(&c.RunID, "run-id", "", "id added to every log line to tell the logs of the concurrent runs on one host apart, a new id is generated if it's empty")
+	fs.StringVar(&c.configFile, "config", "", "path to the TOML configuration file which can define all the options, the options set by command line flags override it")
+	fs.BoolVar(&c.printSampleConfig, "print-sample-config", false, "print a sample configuration file with all the options and their default values")
 	fs.StringVar(&c.PDURLs, "pd-urls", "", "a comma separated list of PD endpoints")
-	fs.BoolVar(&c.reserveTempDir, "reserve-tmpdir", false, "reserve temp dir")
+	fs.IntVar(&c.PDMaxRetry, "pd-max-retry", defaultPDMaxRetry, "max retry times when fetching the history DDL jobs from PD/TiKV failed, the interval between retries doubles from 1s up to 30s")
+	fs.IntVar(&c.PDTimeout, "pd-timeout", defaultPDTimeout, "timeout in seconds of connecting to PD and fetching the history DDL jobs in one attempt")
+	fs.IntVar(&c.GCTTL, "gc-ttl", defaultGCTTL, "TTL in seconds of the service GC safepoint registered in PD when pd-urls is set, it's renewed during the run and removed at the end, so TiKV doesn't GC the history DDL jobs being read, requires PD v4.0 or later, 0 means not registering")
+	fs.StringVar(&c.PDSSLCA, "pd-ssl-ca", "", "path of the CA cert to connect PD and TiKV with TLS, the PD addresses without a scheme use https if it's set")
+	fs.StringVar(&c.PDSSLCert, "pd-ssl-cert", "", "path of the client cert to connect PD and TiKV with TLS")
+	fs.StringVar(&c.PDSSLKey, "pd-ssl-key", "", "path of the key of pd-ssl-cert")
+	fs.StringVar(&c.HistoryDDLFile, "history-ddl-file", "", "file of the history DDLs used instead of PD, a JSON array of DDL jobs like the output of TiDB's /ddl/history HTTP API or the file of history-ddl-cache, or DDL statements if the file name ends with .sql")
+	fs.StringVar(&c.DDLSource, "ddl-source", "", "source of the history DDL jobs, pd reads them from TiKV by pd-urls, tidb requests the status API of tidb-status-addr, file reads history-ddl-file, empty means file if history-ddl-file is set, tidb if tidb-status-addr is set, otherwise pd")
+	fs.StringVar(&c.TiDBStatusAddr, "tidb-status-addr", "", "status address of TiDB like 127.0.0.1:10080, the history DDL jobs are fetched by its /ddl/history API when the ports of PD and TiKV are not reachable")
+	fs.StringVar(&c.HistoryDDLCache, "history-ddl-cache", "", "file to cache the history DDL jobs, they are read from it if it covers the first binlog, otherwise fetched from PD/TiKV and saved to it, so the run can be repeated offline")
+	fs.StringVar(&c.OnDDLError, "on-ddl-error", onDDLErrorAbort, "how to handle the history DDLs failed to execute, e.g. unsupported syntax or already applied, abort: fail the run, skip: log and skip them, quarantine: also write them to skipped_ddls.sql in output dir for manual review")
+	fs.BoolVar(&c.ReserveTempDir, "reserve-tmpdir", false, "reserve temp dir")
+	fs.StringVar(&c.TempDir, "temp-dir", defaultTempDir, "dir to save the temp files split by map, put it on a dedicated fast disk if possible")
+	fs.BoolVar(&c.Force, "force", false, "only warn instead of failing when the temp dir or output dir may not have enough disk space")
+	fs.StringVar(&c.TempQuota, "temp-quota", "", "max size of the temp files like 100GiB, pitr fails when it's exceeded, empty means no limit")
+	fs.StringVar(&c.TempStore, "temp-store", tempStoreFile, "how Map saves the split events in temp-dir, file: binlog files of every table, kv: an embedded LSM store keyed by table, row and commit ts, which needs less memory in Reduce")
+	fs.BoolVar(&c.PreserveTxn, "preserve-txn", false, "keep the transactions of every table in the output instead of merging the rows across transactions, the output is larger but every transaction is applied as a whole at its commit ts")
+	fs.BoolVar(&c.SkipDDL, "skip-ddl", false, "drop the DDLs from the output after they're executed to track the schema, only the DMLs are written, for the downstream whose schema is already at stop-tso")
+	fs.StringVar(&c.NoPKPolicy, "no-pk-policy", noPKPolicyRowID, "how to merge the tables without primary key or unique key, rowid: identify rows by _tidb_rowid if binlogs have it, otherwise by all the columns, append-only: keep all the changes of the tables without merging, error: fail when such a table is changed")
+	fs.BoolVar(&c.NewCollationsEnabled, "new-collations-enabled", false, "compare the string values of the primary keys and unique keys by the collations of their columns in the tracked schema like TiDB with new_collations_enabled_on_first_bootstrap, so the rows whose keys differ only in case, accents or trailing spaces under utf8mb4_general_ci are merged as one row, it should be the same as the source cluster, otherwise the keys are compared byte-wise")
+	fs.StringVar(&c.RenamePolicy, "rename-policy", renamePolicyMerge, "how to merge the tables renamed in the window, merge: merge the events before and after renaming under the final name, split: merge them as different tables")
+	fs.StringVar(&c.MaxMemory, "max-memory", "", "max memory of the deduplicated events in Reduce like 4GiB, the events of the tables using the most memory are spilled to disk next to temp-dir when it's exceeded, empty means no limit")
+	fs.IntVar(&c.Concurrency, "concurrency", defaultConcurrency, "number of workers used to split binlog files, binlogs of the same table are always handled by one worker")
+	fs.IntVar(&c.ReduceConcurrency, "reduce-concurrency", defaultReduceConcurrency, "max number of tables reduced at the same time, the largest tables are reduced first, every table is reduced by one goroutine, it also limits the memory used by the events of the tables in Reduce")
+	fs.StringVar(&c.OutputFormat, "output-format", outputFormatPB, "format of the merged binlog files, pb: drainer's binlog files which can be replayed by reparo, sql: SQL files which can be replayed by mysql client, jsonl: a JSON object of schema, table, type, commit ts and the row before and after the change per line, for audit systems or analysis by jq, csv: the rows inserted or updated by the merged binlogs in their state at stop-tso, with a header line, the deleted rows are not written")
+	fs.BoolVar(&c.Lightning, "lightning", false, "also write the files in the layout of TiDB Lightning to the lightning dir in output dir, {db}-schema-create.sql, {db}.{table}-schema.sql and the csv files hard linked as {db}.{table}.csv, it can be used as data-source-dir of Lightning to import the tables into a new cluster, requires output-format csv")
+	fs.StringVar(&c.BaseDir, "base-dir", "", "merged output of a previous run in pb format, only the binlogs after its max commit ts are merged and folded into it, the output is written to a new dir")
+	fs.StringVar(&c.BRBackup, "br-backup", "", "storage of a BR full backup, local dir or s3 uri, only the binlogs after its backup ts are merged and applied to dest-db, which should be restored from the backup, requires dest-type mysql")
+	fs.BoolVar(&c.BRRestore, "br-restore", false, "restore br-backup to the dest cluster by `br restore full` before applying the merged binlogs, otherwise dest-db should be already restored from the backup, it's checked by the tables existing at the backup ts")
+	fs.StringVar(&c.BRPath, "br-path", defaultBRPath, "path of br binary used by br-restore")
+	fs.StringVar(&c.BRPD, "br-pd", "", "PD addresses of the dest cluster used by br-restore, like 127.0.0.1:2379")
+	fs.StringVar(&c.MaxEventSize, "max-event-size", defaultMaxEventSize, "max size of a binlog read from or written to the binlog files like 64MiB, the size is checked before reading the binlog, the merged DML binlogs larger than it are split by rows, 0 means no limit")
+	fs.StringVar(&c.OnOversizedEvent, "on-oversized-event", onOversizedAbort, "how to handle a binlog or a merged row larger than max-event-size, abort fails the run, skip skips it with a warning")
+	fs.StringVar(&c.OutputFileSize, "output-file-size", "", "size to rotate the output files of every table like 512MiB, the files in pb format are always rotated at 512MiB, the sql files are never rotated by default")
+	fs.StringVar(&c.SyncMode, "sync-mode", syncModeFile, "the output files are written with the suffix .tmp and renamed when complete, none: rename without fsync, file: fsync every file before renaming, dir: also fsync the dir after renaming")
+	fs.StringVar(&c.OutputStorage, "output-storage", "", "s3 uri like s3://bucket/prefix?endpoint=xxx to upload the output dir to after it's written, the files larger than 64MiB are uploaded by multipart upload, the failed requests are retried, and a failed upload is resumed from the uploaded parts by the upload subcommand, checksums.txt is uploaded last, requires dest-type file")
+	fs.IntVar(&c.UploadConcurrency, "upload-concurrency", defaultUploadConcurrency, "max number of files or parts uploaded to output-storage at the same time")
+	fs.StringVar(&c.UploadRateLimit, "upload-rate-limit", "", "max size uploaded to output-storage per second like 50MiB, so the upload doesn't saturate the network of the host, empty means no limit")
+	fs.StringVar(&c.SliceInterval, "slice-interval", "", "split the output into the slices of consecutive time windows like 1h, the windows are aligned to the local time, every slice is written to the dir slice-{start time} in output dir and the rows are merged only in the slice, so the schema file and the slices up to any window can be replayed in order to restore to the end of the window")
+	fs.StringVar(&c.EncryptKeyFile, "encrypt-key-file", "", "file of the AES key in hex (16, 24 or 32 bytes), the output files are encrypted by AES-GCM with it, and the encrypted files are decrypted with it when reading")
+	fs.BoolVar(&c.EncryptTemp, "encrypt-temp", false, "also encrypt the temp files by the key of encrypt-key-file")
+	fs.StringVar(&c.InputFormat, "input-format", inputFormatDrainer, "format of the binlog files in data-dir, drainer: the binlog files of drainer, pump: the raw binlog files of pump, every dir is a pump, the prewrite and commit binlogs are paired and the rows are decoded by the history DDL jobs, ticdc: the canal-json files of TiCDC's storage sink with enable-tidb-extension, every dir is a changefeed, the rows with the same commit ts are a transaction, mysql: the ROW format binlog files of MySQL or MariaDB with binlog_row_image and binlog_row_metadata FULL, every dir is a server")
+	fs.StringVar(&c.KafkaAddrs, "kafka-addrs", "", "addresses of kafka brokers separated by comma, the binlogs between start and stop tso are read from kafka-topic written by drainer's kafka sink instead of data-dir")
+	fs.StringVar(&c.KafkaTopic, "kafka-topic", "", "topic of drainer's kafka sink, usually <cluster-id>_obinlog")
+	fs.StringVar(&c.KafkaVersion, "kafka-version", defaultKafkaVersion, "version of kafka")
+	fs.StringVar(&c.OnFileGap, "on-file-gap", onGapAbort, "how to handle the missing binlog files found by the file indexes in data-dir, abort: fail the run, warn: only log the gap with its commit ts range")
+	fs.StringVar(&c.RelaxCorruption, "relax-corruption", relaxAbort, "how to handle a binlog file with a truncated tail or bad CRC, abort: fail the run, skip-tail: skip the damaged region and the rest of the file, skip-file: skip the whole file, the lost commit ts range is logged and written to report-file")
+	fs.StringVar(&c.Compress, "compress", compressNone, "codec used to compress the merged binlog files: none, gzip, zstd or lz4, the compressed binlog files in data-dir are always decompressed by the suffix of file name or the magic bytes")
+	fs.BoolVar(&c.SafeMode, "safe-mode", false, "write the idempotent DML statements to sql files and execute them in dest-db, INSERT is replaced by REPLACE, and UPDATE is replaced by DELETE and REPLACE like drainer's safe mode, so the statements can be replayed again after a partial failure")
+	fs.StringVar(&c.ForeignKeyMode, "foreign-key-mode", "", "how to replay the tables with foreign keys, disable-checks: write SET FOREIGN_KEY_CHECKS=0 at the head of every sql file and disable the checks in dest-db, ordered: also write the statements of all the tables to replay.sql in output dir, the deletes from the child tables to the parent tables first, then the other statements from the parent tables to the child tables, empty means no special handling")
+	fs.StringVar(&c.ConflictCheck, "conflict-check", "", "probe the rows to insert by the merged binlogs in dest-db before applying them, error: stop if any of them exists, safe-mode: switch to safe-mode if any of them exists, empty means no check")
+	fs.IntVar(&c.ApplyQPS, "apply-qps", 0, "max number of statements executed in dest-db per second, so the recovery doesn't starve the live workloads of a production cluster, 0 means no limit")
+	fs.StringVar(&c.ApplyBytesPerSec, "apply-bytes-per-sec", "", "max size of the statements executed in dest-db per second like 10MiB, empty means no limit")
+	fs.StringVar(&c.DestType, "dest-type", destTypeFile, "type of destination, file: only write merged binlog files, mysql: also replay the merged binlogs to the downstream TiDB/MySQL set by dest-db in config file, kafka: also publish the merged binlogs to the topic set by dest-kafka in config file, grpc: also stream the merged binlogs to the subscriber of BinlogStream in stream.proto at dest-grpc-addr")
+	fs.StringVar(&c.DestGRPCAddr, "dest-grpc-addr", "", "address of the gRPC server streaming the merged binlogs when dest-type is grpc, the run waits until a subscriber receives all of them")
+	fs.StringVar(&c.StatusAddr, "status-addr", "", "address of HTTP server which exposes the progress of merging by /status and prometheus metrics by /metrics, empty string means not start the server")
+	fs.StringVar(&c.PprofAddr, "pprof-addr", "", "address of HTTP server which exposes the runtime profiles by /debug/pprof for live profiling like go tool pprof http://addr/debug/pprof/profile, empty string means not start the server")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "only print the summary of binlogs which will be merged, don't write any file")
+	fs.StringVar(&c.SavepointFile, "savepoint-file", "", "file to write the commit ts of the last merged binlog in the format of drainer's savepoint after the output is written and applied, put it in drainer's data-dir or use it as TiCDC's start-ts to continue the replication without gap or duplicate")
+	fs.StringVar(&c.ReportFile, "report-file", "", "file to write the JSON report of the run at the end, including input files, skipped tables, events of every table before and after merging, DDLs, and output files with checksums")
+	fs.StringVar(&c.ErrorFormat, "error-format", errorFormatText, "format of the error when the run fails, text: only log it, json: also print a JSON object with the exit code, class and message to stderr. The exit code is 2 for config error, 3 for missing binlog files, 4 for tso gap, 5 for DDL failure, 6 for disk full, 7 for downstream failure, 8 for canceled and 1 for the others")
+	fs.BoolVar(&c.Flashback, "flashback", false, "instead of merging binlogs, write the SQL statements which undo the DML changes between start and stop tso to flashback.sql in output dir, in the descending order of commit ts")
+	fs.BoolVar(&c.SchemaOnly, "schema-only", false, "instead of merging binlogs, write the DDLs of the selected tables between start and stop tso to ddl.sql in output dir in the order of commit ts, which roll the schema forward without touching the data")
+	fs.BoolVar(&c.Verify, "verify", false, "verify the net row change of every table in merged binlogs is the same as the source binlogs before finish")
+	fs.BoolVar(&c.Resume, "resume", false, "resume from the checkpoint saved in temp dir by the last failed run")
+	fs.BoolVar(&c.ForceUnlock, "force-unlock", false, "take over the locks of temp dir and output dir held by another run, only use it when the run holding the locks is not running, e.g. it's killed on another host sharing the dirs")
+	fs.StringVar(&c.OnLeftoverTemp, "on-leftover-temp", onLeftoverAbort, "how to handle the temp dir left by a crashed run, abort: fail the run with the size and the pid of the last run, resume: the same as resume, clean: remove it and start from the beginning")
 	fs.BoolVar(&c.printVersion, "V", false, "print pitr version info")
-	fs.StringVar(&c.schemaFile, "schema-file", "", "base schema info")
+	fs.StringVar(&c.SchemaFile, "schema-file", "", "base schema info, the DDL statements like the output of mysqldump --no-data, other statements are skipped")
 	return c
 }
 
 func (c *Config) String() string {
-	cfgBytes, err := json.Marshal(c)
+	cfg := *c
+	cfg.Storage = redactStorageURI(cfg.Storage)
+	cfg.OutputStorage = redactStorageURI(cfg.OutputStorage)
+	cfg.DestDB.DSN = redactDSN(cfg.DestDB.DSN)
+	cfgBytes, err := json.Marshal(&cfg)
 	if err != nil {
 		log.Error("marshal config failed", zap.Error(err))
 	}
@@ -86,6 +438,14 @@ func (c *Config) String() string {
 
 // Parse parses keys/values from command line flags and toml configuration file.
 func (c *Config) Parse(args []string) (err error) {
+	if err := c.parseFlags(args); err != nil {
+		return withErrorClass(ErrorClassConfig, errors.Trace(err))
+	}
+	return withErrorClass(ErrorClassConfig, errors.Trace(c.Adjust()))
+}
+
+// parseFlags loads the config file, command line flags and environment vars without adjusting the config.
+func (c *Config) parseFlags(args []string) error {
 	// Parse first to get config file
 	perr := c.FlagSet.Parse(args)
 	switch perr {
@@ -100,6 +460,10 @@ func (c *Config) Parse(args []string) (err error) {
 		fmt.Println(version.GetRawVersionInfo())
 		os.Exit(0)
 	}
+	if c.printSampleConfig {
+		fmt.Print(sampleConfig)
+		os.Exit(0)
+	}
 
 	if c.configFile != "" {
 		// Load config file if specified
@@ -115,15 +479,35 @@ func (c *Config) Parse(args []string) (err error) {
 	if len(c.FlagSet.Args()) > 0 {
 		return errors.Errorf("'%s' is not a valid flag", c.FlagSet.Arg(0))
 	}
-	c.adjustDoDBAndTable()
 
 	// replace with environment vars
-	if err := flags.SetFlagsFromEnv(toolName, c.FlagSet); err != nil {
-		return errors.Trace(err)
+	return errors.Trace(flags.SetFlagsFromEnv(toolName, c.FlagSet))
+}
+
+// Adjust converts the table list and datetimes to the rules and TSOs used internally, and validates the config.
+// it's called by Parse, and should be called if the config is not created by Parse.
+func (c *Config) Adjust() (err error) {
+	if c.Tables != "" {
+		doDBs, doTables, err := parseTables(c.Tables)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.DoDBs = append(c.DoDBs, doDBs...)
+		c.DoTables = append(c.DoTables, doTables...)
 	}
+	if c.FilterRulesFile != "" {
+		if err := c.addFilterRules(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	c.adjustDoDBAndTable()
 
+	loc, err := c.location()
+	if err != nil {
+		return errors.Trace(err)
+	}
 	if c.StartDatetime != "" {
-		c.StartTSO, err = dateTimeToTSO(c.StartDatetime)
+		c.StartTSO, err = dateTimeToTSO(c.StartDatetime, loc)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -131,7 +515,7 @@ func (c *Config) Parse(args []string) (err error) {
 		log.Info("Parsed start TSO", zap.Int64("ts", c.StartTSO))
 	}
 	if c.StopDatetime != "" {
-		c.StopTSO, err = dateTimeToTSO(c.StopDatetime)
+		c.StopTSO, err = dateTimeToTSO(c.StopDatetime, loc)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -151,22 +535,475 @@ func (c *Config) adjustDoDBAndTable() {
 	}
 }
 
+// configFromFile loads the config file, it fails if the file has unknown options.
 func (c *Config) configFromFile(path string) error {
-	return util.StrictDecodeFile(path, toolName, c)
+	return errors.Annotatef(util.StrictDecodeFile(path, toolName, c), "load config file %s", path)
 }
 
 func (c *Config) validate() error {
-	if c.Dir == "" {
-		return errors.New("data-dir is empty")
+	if c.KafkaAddrs != "" {
+		if c.KafkaTopic == "" {
+			return errors.New("kafka-topic is required by kafka-addrs")
+		}
+		if c.Dir != "" || c.Storage != "" || c.InputFormat != inputFormatDrainer {
+			return errors.Errorf("kafka-addrs can't be used with data-dir, storage or input-format %s", c.InputFormat)
+		}
+	} else if c.Dir == "" && c.Storage == "" {
+		return errors.New("data-dir, storage and kafka-addrs are all empty")
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return errors.Errorf("unknown log-format %s, should be %s or %s", c.LogFormat, logFormatText, logFormatJSON)
+	}
+	if c.ErrorFormat != "" && c.ErrorFormat != errorFormatText && c.ErrorFormat != errorFormatJSON {
+		return errors.Errorf("unknown error-format %s, should be %s or %s", c.ErrorFormat, errorFormatText, errorFormatJSON)
+	}
+	if c.LogMaxSize < 0 || c.LogMaxDays < 0 || c.LogMaxBackups < 0 || c.LogSampleLimit < 0 {
+		return errors.New("log-max-size, log-max-days, log-max-backups and log-sample-limit should not be negative")
+	}
+	if c.StartTSO < 0 || c.StopTSO < 0 {
+		return errors.Errorf("start-tso %d and stop-tso %d should not be negative", c.StartTSO, c.StopTSO)
+	}
+	if c.StopTSO != 0 && c.StartTSO > c.StopTSO {
+		return errors.Errorf("start-tso %d is greater than stop-tso %d", c.StartTSO, c.StopTSO)
+	}
+	if c.Concurrency <= 0 {
+		return errors.Errorf("concurrency should be greater than 0, but got %d", c.Concurrency)
+	}
+	if c.ReduceConcurrency <= 0 {
+		return errors.Errorf("reduce-concurrency should be greater than 0, but got %d", c.ReduceConcurrency)
+	}
+	if c.OutputFormat != outputFormatPB && !isTextFormat(c.OutputFormat) {
+		return errors.Errorf("unknown output-format %s, should be %s, %s, %s or %s", c.OutputFormat, outputFormatPB, outputFormatSQL, outputFormatJSONL, outputFormatCSV)
+	}
+	if c.Verify && c.OutputFormat == outputFormatCSV {
+		return errors.Errorf("verify can't be used with output-format %s, the deleted rows are not in the csv files", outputFormatCSV)
+	}
+	if c.Lightning {
+		if c.OutputFormat != outputFormatCSV {
+			return errors.Errorf("lightning requires output-format %s, but got %s", outputFormatCSV, c.OutputFormat)
+		}
+		if c.EncryptKeyFile != "" || c.Compress == compressLZ4 {
+			return errors.Errorf("lightning can't be used with encrypt-key-file or compress %s, the files can't be read by Lightning", compressLZ4)
+		}
+	}
+	if c.Flashback {
+		if c.StartTSO == 0 {
+			return errors.New("start-tso or start-datetime is required by flashback")
+		}
+		if c.BaseDir != "" || c.DestType != destTypeFile {
+			return errors.Errorf("flashback can't be used with base-dir or dest-type %s", c.DestType)
+		}
+	}
+	if c.SchemaOnly {
+		if c.Flashback || c.BaseDir != "" || c.DestType != destTypeFile || c.Verify || c.SliceInterval != "" || c.Lightning ||
+			len(c.StopTSOs) != 0 {
+			return errors.New("schema-only can't be used with flashback, base-dir, dest-type other than file, verify, slice-interval, lightning or multiple stop-tso, no DML is written")
+		}
+		if c.SavepointFile != "" {
+			return errors.New("savepoint-file can't be used with schema-only, the DMLs are not merged")
+		}
+	}
+	if c.SavepointFile != "" && (c.Flashback || c.DryRun) {
+		return errors.New("savepoint-file can't be used with flashback or dry-run, no binlog is merged")
+	}
+	if _, ok := inputCodecs[c.InputFormat]; !ok {
+		return errors.Errorf("unknown input-format %s, should be one of %s", c.InputFormat, inputFormats())
+	}
+	if (c.InputFormat == inputFormatTiCDC || c.InputFormat == inputFormatMySQL) && c.Storage != "" {
+		return errors.Errorf("input-format %s only reads local dirs in data-dir, storage is not supported", c.InputFormat)
+	}
+	if err := c.validateDDLSource(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.validateOnLeftoverTemp(); err != nil {
+		return errors.Trace(err)
+	}
+	if source := c.historyDDLSource(); c.InputFormat == inputFormatPump && (source == "" || source == ddlSourceFile && isSQLFile(c.HistoryDDLFile)) {
+		return errors.Errorf("input-format %s requires the history DDL jobs from pd-urls, tidb-status-addr, history-ddl-cache or a JSON history-ddl-file to decode the rows", inputFormatPump)
+	}
+	if c.OnFileGap != onGapAbort && c.OnFileGap != onGapWarn {
+		return errors.Errorf("unknown on-file-gap %s, should be %s or %s", c.OnFileGap, onGapAbort, onGapWarn)
+	}
+	if !isValidRelaxCorruption(c.RelaxCorruption) {
+		return errors.Errorf("unknown relax-corruption %s, should be %s, %s or %s", c.RelaxCorruption, relaxAbort, relaxSkipTail, relaxSkipFile)
+	}
+	if c.PDMaxRetry < 0 {
+		return errors.Errorf("pd-max-retry should not be negative, but got %d", c.PDMaxRetry)
+	}
+	if c.GCTTL < 0 {
+		return errors.Errorf("gc-ttl should not be negative, but got %d", c.GCTTL)
+	}
+	if err := c.validatePDSecurity(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.PDTimeout <= 0 {
+		return errors.Errorf("pd-timeout should be greater than 0, but got %d", c.PDTimeout)
+	}
+	if c.HistoryDDLFile != "" && (c.PDURLs != "" || c.HistoryDDLCache != "" || c.SchemaFile != "") {
+		return errors.New("history-ddl-file can't be used with pd-urls, history-ddl-cache or schema-file")
+	}
+	if c.TempDir == "" {
+		return errors.New("temp-dir is empty")
+	}
+	switch c.NoPKPolicy {
+	case "", noPKPolicyRowID, noPKPolicyAppendOnly, noPKPolicyError:
+	default:
+		return errors.Errorf("no-pk-policy should be %s, %s or %s, but got %s", noPKPolicyRowID, noPKPolicyAppendOnly, noPKPolicyError, c.NoPKPolicy)
+	}
+	switch c.OnDDLError {
+	case "", onDDLErrorAbort, onDDLErrorSkip, onDDLErrorQuarantine:
+	default:
+		return errors.Errorf("on-ddl-error should be %s, %s or %s, but got %s", onDDLErrorAbort, onDDLErrorSkip, onDDLErrorQuarantine, c.OnDDLError)
+	}
+	if c.PreserveTxn {
+		if c.TempStore == tempStoreKV {
+			return errors.Errorf("preserve-txn can't be used with temp-store %s, the transactions are not kept in it", tempStoreKV)
+		}
+		if c.OutputFormat == outputFormatCSV {
+			return errors.Errorf("preserve-txn can't be used with output-format %s, only the final rows are in the csv files", outputFormatCSV)
+		}
+		if c.DestType == destTypeMySQL && c.DestDB.WorkerCount > 1 {
+			return errors.Errorf("preserve-txn can't be used with worker-count %d in dest-db, the tables of a transaction would be executed by different workers, set it to 1",
+				c.DestDB.WorkerCount)
+		}
+	}
+	if c.SkipDDL && (c.Flashback || c.SchemaOnly) {
+		return errors.New("skip-ddl can't be used with flashback or schema-only")
+	}
+	switch c.RenamePolicy {
+	case "", renamePolicyMerge, renamePolicySplit:
+	default:
+		return errors.Errorf("rename-policy should be %s or %s, but got %s", renamePolicyMerge, renamePolicySplit, c.RenamePolicy)
+	}
+	switch c.TempStore {
+	case "", tempStoreFile, tempStoreKV:
+	default:
+		return errors.Errorf("temp-store should be %s or %s, but got %s", tempStoreFile, tempStoreKV, c.TempStore)
+	}
+	if c.MaxMemory != "" {
+		if _, err := parseSize(c.MaxMemory); err != nil {
+			return errors.Annotate(err, "max-memory")
+		}
+	}
+	if c.TempQuota != "" {
+		if _, err := parseSize(c.TempQuota); err != nil {
+			return errors.Annotate(err, "temp-quota")
+		}
+	}
+	if c.MaxEventSize != "" {
+		if _, err := parseSize(c.MaxEventSize); err != nil {
+			return errors.Annotate(err, "max-event-size")
+		}
+	}
+	if c.OnOversizedEvent != "" && c.OnOversizedEvent != onOversizedAbort && c.OnOversizedEvent != onOversizedSkip {
+		return errors.Errorf("unknown on-oversized-event %s, should be %s or %s", c.OnOversizedEvent, onOversizedAbort, onOversizedSkip)
 	}
+	if c.OutputFileSize != "" {
+		size, err := parseSize(c.OutputFileSize)
+		if err != nil {
+			return errors.Annotate(err, "output-file-size")
+		}
+		if size <= 0 {
+			return errors.Errorf("output-file-size should be greater than 0, but got %s", c.OutputFileSize)
+		}
+		if c.OutputFormat == outputFormatPB && size > binlogfile.SegmentSizeBytes {
+			return errors.Errorf("output-file-size should not be greater than %s in %s format", formatSize(binlogfile.SegmentSizeBytes), outputFormatPB)
+		}
+	}
+	if c.SyncMode != "" && !isValidSyncMode(c.SyncMode) {
+		return errors.Errorf("unknown sync-mode %s, should be %s, %s or %s", c.SyncMode, syncModeNone, syncModeFile, syncModeDir)
+	}
+	if c.OutputStorage != "" {
+		if err := c.uploadConfig(defaultOutputDir).validate(); err != nil {
+			return errors.Trace(err)
+		}
+		if c.DestType != destTypeFile {
+			return errors.New("output-storage can only be used with dest-type file")
+		}
+	}
+	if c.SliceInterval != "" {
+		if err := c.validateSliceInterval(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := c.validateStopTSOs(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.EncryptTemp && c.EncryptKeyFile == "" {
+		return errors.New("encrypt-temp requires encrypt-key-file")
+	}
+	if c.EncryptKeyFile != "" && c.OutputFormat == outputFormatPB && compressSuffix(c.Compress) != "" {
+		return errors.Errorf("compress can't be used with encrypt-key-file in %s format, the encrypted binlogs can't be compressed", outputFormatPB)
+	}
+	if _, err := parseRowFilter(c.RowFilter); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := parsePartitions(c.Partitions); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := newTableRouter(c.RouteRules); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkMergeKeys(c.MergeKeys); err != nil {
+		return errors.Trace(err)
+	}
+	if len(c.RouteRules) != 0 && c.Flashback {
+		return errors.New("route-rules can't be used with flashback, the undo statements should be executed in the original tables")
+	}
+	if c.MaskRulesFile != "" {
+		if c.Flashback {
+			return errors.New("mask-rules-file can't be used with flashback, the undo statements need the original values")
+		}
+		if _, err := loadColumnMasker(c.MaskRulesFile); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.EventHookPlugin != "" && c.Flashback {
+		return errors.New("event-hook-plugin can't be used with flashback, the binlogs are not reduced")
+	}
+	if c.EventHookPlugin == "" && c.EventHookConfig != "" {
+		return errors.New("event-hook-config requires event-hook-plugin")
+	}
+	if c.BRBackup != "" {
+		if c.DestType != destTypeMySQL {
+			return errors.Errorf("br-backup requires dest-type %s, the merged binlogs are applied to the restored cluster", destTypeMySQL)
+		}
+		if c.BaseDir != "" || c.Flashback {
+			return errors.New("br-backup can't be used with base-dir or flashback")
+		}
+		if c.BRRestore && c.BRPD == "" {
+			return errors.New("br-pd is required by br-restore")
+		}
+	} else if c.BRRestore {
+		return errors.New("br-restore requires br-backup")
+	}
+	if c.SafeMode && c.OutputFormat != outputFormatSQL && c.DestType != destTypeMySQL {
+		return errors.Errorf("safe-mode requires output-format %s or dest-type %s", outputFormatSQL, destTypeMySQL)
+	}
+	switch c.ForeignKeyMode {
+	case "":
+	case foreignKeyModeDisableChecks:
+		if c.OutputFormat != outputFormatSQL && c.DestType != destTypeMySQL {
+			return errors.Errorf("foreign-key-mode %s requires output-format %s or dest-type %s", c.ForeignKeyMode, outputFormatSQL, destTypeMySQL)
+		}
+	case foreignKeyModeOrdered:
+		if c.OutputFormat != outputFormatSQL {
+			return errors.Errorf("foreign-key-mode %s requires output-format %s", c.ForeignKeyMode, outputFormatSQL)
+		}
+		if c.Flashback || c.SliceInterval != "" || len(c.StopTSOs) != 0 {
+			return errors.Errorf("foreign-key-mode %s can't be used with flashback, slice-interval or stop-tsos", c.ForeignKeyMode)
+		}
+	default:
+		return errors.Errorf("unknown foreign-key-mode %s, should be %s or %s", c.ForeignKeyMode, foreignKeyModeDisableChecks, foreignKeyModeOrdered)
+	}
+	if c.ConflictCheck != "" {
+		if c.ConflictCheck != conflictCheckError && c.ConflictCheck != conflictCheckSafeMode {
+			return errors.Errorf("unknown conflict-check %s, should be %s or %s", c.ConflictCheck, conflictCheckError, conflictCheckSafeMode)
+		}
+		if c.DestType != destTypeMySQL {
+			return errors.Errorf("conflict-check requires dest-type %s", destTypeMySQL)
+		}
+	}
+	if c.ApplyQPS < 0 {
+		return errors.Errorf("apply-qps should not be negative, but got %d", c.ApplyQPS)
+	}
+	if c.ApplyBytesPerSec != "" {
+		if _, err := parseSize(c.ApplyBytesPerSec); err != nil {
+			return errors.Annotate(err, "apply-bytes-per-sec")
+		}
+	}
+	if (c.ApplyQPS > 0 || c.ApplyBytesPerSec != "") && c.DestType != destTypeMySQL {
+		return errors.Errorf("apply-qps and apply-bytes-per-sec require dest-type %s", destTypeMySQL)
+	}
+	if c.BaseDir != "" && filepath.Clean(c.BaseDir) == filepath.Clean(defaultOutputDir) {
+		return errors.Errorf("base-dir %s should not be the output dir", c.BaseDir)
+	}
+	if !isValidCompress(c.Compress) {
+		return errors.Errorf("unknown compress %s, should be %s, %s, %s or %s", c.Compress, compressNone, compressGzip, compressZstd, compressLZ4)
+	}
+	switch c.DestType {
+	case destTypeFile:
+	case destTypeMySQL:
+		if c.DestDB.DSN == "" {
+			return errors.New("dsn in dest-db is empty")
+		}
+		if c.OutputFormat != outputFormatPB {
+			return errors.Errorf("output-format should be %s when dest-type is %s", outputFormatPB, destTypeMySQL)
+		}
+		if c.DestDB.BatchSize <= 0 {
+			return errors.Errorf("batch-size in dest-db should be greater than 0, but got %d", c.DestDB.BatchSize)
+		}
+		if c.DestDB.WorkerCount <= 0 {
+			return errors.Errorf("worker-count in dest-db should be greater than 0, but got %d", c.DestDB.WorkerCount)
+		}
+	case destTypeKafka:
+		if c.DestKafka.Addrs == "" || c.DestKafka.Topic == "" {
+			return errors.New("addrs and topic in dest-kafka are required")
+		}
+		if c.OutputFormat != outputFormatPB {
+			return errors.Errorf("output-format should be %s when dest-type is %s", outputFormatPB, destTypeKafka)
+		}
+		if c.DestKafka.Protocol != kafkaProtocolOpenBinlog && c.DestKafka.Protocol != kafkaProtocolCanalJSON {
+			return errors.Errorf("unknown protocol %s in dest-kafka, should be %s or %s", c.DestKafka.Protocol, kafkaProtocolOpenBinlog, kafkaProtocolCanalJSON)
+		}
+		if c.DestKafka.MaxMessageBytes <= 0 {
+			return errors.Errorf("max-message-bytes in dest-kafka should be greater than 0, but got %d", c.DestKafka.MaxMessageBytes)
+		}
+	case destTypeGRPC:
+		if c.DestGRPCAddr == "" {
+			return errors.New("dest-grpc-addr is required by dest-type grpc")
+		}
+		if c.OutputFormat != outputFormatPB {
+			return errors.Errorf("output-format should be %s when dest-type is %s", outputFormatPB, destTypeGRPC)
+		}
+	default:
+		return errors.Errorf("unknown dest-type %s, should be %s, %s, %s or %s", c.DestType, destTypeFile, destTypeMySQL, destTypeKafka, destTypeGRPC)
+	}
+
+	return nil
+}
+
+// historyDDLSource returns the source of the history DDL jobs, empty if there is none.
+func (c *Config) historyDDLSource() string {
+	switch {
+	case c.DDLSource != "":
+		return c.DDLSource
+	case c.HistoryDDLFile != "":
+		return ddlSourceFile
+	case c.TiDBStatusAddr != "":
+		return ddlSourceTiDB
+	case c.PDURLs != "" || c.HistoryDDLCache != "":
+		return ddlSourcePD
+	}
+	return ""
+}
+
+// historyDDLOrigin identifies the cluster the history DDL jobs are fetched from by its addresses, so the cache
+// of another cluster is not used. It's empty if the jobs are not fetched.
+func (c *Config) historyDDLOrigin() string {
+	trimScheme := func(addr string) string {
+		if i := strings.Index(addr, "://"); i >= 0 {
+			addr = addr[i+3:]
+		}
+		return strings.TrimSuffix(addr, "/")
+	}
+	switch c.historyDDLSource() {
+	case ddlSourceTiDB:
+		return ddlSourceTiDB + " " + trimScheme(c.TiDBStatusAddr)
+	case ddlSourcePD:
+		var hosts []string
+		for _, addr := range pdAddrs(c.PDURLs, "") {
+			hosts = append(hosts, trimScheme(addr))
+		}
+		if len(hosts) == 0 {
+			return ""
+		}
+		sort.Strings(hosts)
+		return ddlSourcePD + " " + strings.Join(hosts, ",")
+	}
+	return ""
+}
+
+// validateDDLSource checks ddl-source and the options it requires.
+func (c *Config) validateDDLSource() error {
+	switch c.DDLSource {
+	case "", ddlSourcePD, ddlSourceTiDB, ddlSourceFile:
+	default:
+		return errors.Errorf("unknown ddl-source %s, should be %s, %s or %s", c.DDLSource, ddlSourcePD, ddlSourceTiDB, ddlSourceFile)
+	}
+	source := c.historyDDLSource()
+	if c.HistoryDDLFile != "" && source != ddlSourceFile {
+		return errors.Errorf("history-ddl-file can't be used with ddl-source %s", source)
+	}
+	if c.TiDBStatusAddr != "" && source != ddlSourceTiDB {
+		return errors.Errorf("tidb-status-addr can't be used with ddl-source %s", source)
+	}
+	switch {
+	case source == ddlSourceFile && c.HistoryDDLFile == "":
+		return errors.New("ddl-source file requires history-ddl-file")
+	case source == ddlSourceTiDB && c.TiDBStatusAddr == "":
+		return errors.New("ddl-source tidb requires tidb-status-addr")
+	case source == ddlSourcePD && c.PDURLs == "" && c.HistoryDDLCache == "":
+		return errors.New("ddl-source pd requires pd-urls or history-ddl-cache")
+	}
+	return nil
+}
 
+// validateSliceInterval checks slice-interval and the flags which can't be used with the sliced output.
+func (c *Config) validateSliceInterval() error {
+	interval, err := time.ParseDuration(c.SliceInterval)
+	if err != nil {
+		return errors.Annotate(err, "slice-interval")
+	}
+	if interval < time.Minute || interval%time.Second != 0 {
+		return errors.Errorf("slice-interval should be whole seconds and at least 1m, but got %s", c.SliceInterval)
+	}
+	if c.DestType != destTypeFile || c.Flashback || c.Verify || c.BaseDir != "" {
+		return errors.New("slice-interval can't be used with dest-type mysql or kafka, flashback, verify or base-dir, they read the output as one window")
+	}
+	if c.TempStore == tempStoreKV {
+		return errors.Errorf("slice-interval can't be used with temp-store %s, the events are not read in the order of commit ts", tempStoreKV)
+	}
+	if c.OutputFormat == outputFormatCSV {
+		return errors.Errorf("slice-interval can't be used with output-format %s, the deleted rows are not in the csv files", outputFormatCSV)
+	}
 	return nil
 }
 
-func dateTimeToTSO(dateTimeStr string) (int64, error) {
-	t, err := time.ParseInLocation(timeFormat, dateTimeStr, time.Local)
+// uploadConfig returns the config of uploading dir to output-storage.
+func (c *Config) uploadConfig(dir string) *UploadConfig {
+	return &UploadConfig{Dir: dir, Storage: c.OutputStorage, Concurrency: c.UploadConcurrency, RateLimit: c.UploadRateLimit}
+}
+
+// binlogDirs returns the directories or storage uri of the binlog files, data-dir can be
+// a comma separated list of directories, and every directory can be a glob pattern.
+func (c *Config) binlogDirs() ([]string, error) {
+	if c.Storage != "" {
+		return []string{c.Storage}, nil
+	}
+
+	var dirs []string
+	for _, dir := range strings.Split(c.Dir, ",") {
+		dir = strings.TrimSpace(dir)
+		if len(dir) == 0 {
+			continue
+		}
+		if !strings.ContainsAny(dir, "*?[") {
+			dirs = append(dirs, dir)
+			continue
+		}
+
+		matches, err := filepath.Glob(dir)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid data-dir pattern %s", dir)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no directory matches data-dir pattern %s", dir)
+		}
+		dirs = append(dirs, matches...)
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("data-dir is empty")
+	}
+	return dirs, nil
+}
+
+// location returns the time zone used to parse start-datetime and stop-datetime.
+func (c *Config) location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid timezone %s", c.TimeZone)
+	}
+	return loc, nil
+}
+
+func dateTimeToTSO(dateTimeStr string, loc *time.Location) (int64, error) {
+	t, err := time.ParseInLocation(timeFormat, dateTimeStr, loc)
 	if err != nil {
-		return 0, errors.Trace(err)
+		return 0, errors.Annotatef(err, "invalid datetime %s, should be in format %s", dateTimeStr, timeFormat)
 	}
 
 	return int64(oracle.ComposeTS(t.Unix()*1000, 0)), nil
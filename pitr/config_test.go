@@ -0,0 +1,261 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"gotest.tools/assert"
+)
+
+func TestDateTimeToTSO(t *testing.T) {
+	utc, err := (&Config{TimeZone: "UTC"}).location()
+	assert.Assert(t, err == nil)
+	ts, err := dateTimeToTSO("2023-06-01 12:00:00", utc)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, oracle.GetTimeFromTS(uint64(ts)).UTC(), time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	shanghai, err := (&Config{TimeZone: "Asia/Shanghai"}).location()
+	assert.Assert(t, err == nil)
+	ts2, err := dateTimeToTSO("2023-06-01 20:00:00", shanghai)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, ts2, ts)
+
+	loc, err := (&Config{}).location()
+	assert.Assert(t, err == nil)
+	assert.Equal(t, loc, time.Local)
+
+	_, err = (&Config{TimeZone: "Mars/Olympus"}).location()
+	assert.Assert(t, err != nil)
+
+	_, err = dateTimeToTSO("2023/06/01 12:00", utc)
+	assert.Assert(t, err != nil)
+}
+
+func TestValidateTSORange(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.StartTSO = 100
+	cfg.StopTSO = 200
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.StopTSO = 0
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.StopTSO = 50
+	assert.ErrorContains(t, cfg.validate(), "greater than stop-tso")
+
+	cfg.StopTSO = 200
+	cfg.BaseDir = "./new_binlog/"
+	assert.ErrorContains(t, cfg.validate(), "should not be the output dir")
+}
+
+func TestValidateFlashback(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.Flashback = true
+	assert.ErrorContains(t, cfg.validate(), "required by flashback")
+
+	cfg.StartTSO = 100
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.BaseDir = "base"
+	assert.ErrorContains(t, cfg.validate(), "flashback can't be used")
+}
+
+func TestValidateOutputFileSize(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.OutputFileSize = "1GiB"
+	assert.ErrorContains(t, cfg.validate(), "should not be greater than 512.0MiB")
+
+	cfg.OutputFormat = outputFormatSQL
+	assert.Assert(t, cfg.validate() == nil)
+}
+
+func TestValidateSliceInterval(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.SliceInterval = "1h"
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.SliceInterval = "30s"
+	assert.ErrorContains(t, cfg.validate(), "at least 1m")
+	cfg.SliceInterval = "1h"
+	cfg.Verify = true
+	assert.ErrorContains(t, cfg.validate(), "slice-interval can't be used")
+	cfg.Verify = false
+	cfg.TempStore = tempStoreKV
+	assert.ErrorContains(t, cfg.validate(), "slice-interval can't be used with temp-store kv")
+}
+
+func TestValidateDDLSource(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.DDLSource = "tikv"
+	assert.ErrorContains(t, cfg.validate(), "unknown ddl-source")
+	cfg.DDLSource = ddlSourceTiDB
+	assert.ErrorContains(t, cfg.validate(), "requires tidb-status-addr")
+	cfg.TiDBStatusAddr = "127.0.0.1:10080"
+	assert.Assert(t, cfg.validate() == nil)
+	cfg.DDLSource = ddlSourcePD
+	assert.ErrorContains(t, cfg.validate(), "tidb-status-addr can't be used with ddl-source pd")
+
+	cfg.DDLSource = ""
+	cfg.PDURLs = "http://127.0.0.1:2379"
+	assert.Equal(t, cfg.historyDDLSource(), ddlSourceTiDB)
+	cfg.TiDBStatusAddr = ""
+	assert.Equal(t, cfg.historyDDLSource(), ddlSourcePD)
+	cfg.DDLSource = ddlSourceFile
+	assert.ErrorContains(t, cfg.validate(), "requires history-ddl-file")
+
+	cfg.DDLSource = ""
+	cfg.PDURLs = "http://127.0.0.2:2379/,127.0.0.1:2379"
+	assert.Equal(t, cfg.historyDDLOrigin(), "pd 127.0.0.1:2379,127.0.0.2:2379")
+	cfg.PDURLs = ""
+	assert.Equal(t, cfg.historyDDLOrigin(), "")
+}
+
+func TestValidateLog(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	assert.Equal(t, cfg.LogFormat, logFormatText)
+	assert.Equal(t, cfg.LogMaxSize, defaultLogMaxSize)
+	cfg.LogFormat = "xml"
+	assert.ErrorContains(t, cfg.validate(), "unknown log-format xml")
+
+	cfg.LogFormat = logFormatJSON
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.LogMaxBackups = -1
+	assert.ErrorContains(t, cfg.validate(), "should not be negative")
+}
+
+func TestNewRunID(t *testing.T) {
+	id := newRunID()
+	assert.Equal(t, len(id), len("20060102150405-abcdef"))
+	assert.Assert(t, id != newRunID())
+}
+
+func TestValidateHistoryDDLFile(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.HistoryDDLFile = "history.json"
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.PDURLs = "http://127.0.0.1:2379"
+	assert.ErrorContains(t, cfg.validate(), "history-ddl-file can't be used")
+}
+
+func TestValidateKafka(t *testing.T) {
+	cfg := NewConfig()
+	cfg.KafkaAddrs = "127.0.0.1:9092"
+	assert.ErrorContains(t, cfg.validate(), "kafka-topic is required")
+	cfg.KafkaTopic = "6789_obinlog"
+	assert.Assert(t, cfg.validate() == nil)
+	cfg.Dir = "data"
+	assert.ErrorContains(t, cfg.validate(), "can't be used with data-dir")
+}
+
+func TestValidateDestKafka(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.DestType = destTypeKafka
+	assert.ErrorContains(t, cfg.validate(), "addrs and topic in dest-kafka are required")
+	cfg.DestKafka.Addrs = "127.0.0.1:9092"
+	cfg.DestKafka.Topic = "pitr"
+	assert.Assert(t, cfg.validate() == nil)
+	cfg.DestKafka.Protocol = "avro"
+	assert.ErrorContains(t, cfg.validate(), "unknown protocol avro")
+	cfg.DestKafka.Protocol = kafkaProtocolCanalJSON
+	cfg.OutputFormat = outputFormatSQL
+	assert.ErrorContains(t, cfg.validate(), "output-format should be pb")
+}
+
+func TestValidatePreserveTxn(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.PreserveTxn = true
+	cfg.DestType = destTypeMySQL
+	cfg.DestDB.DSN = "root@tcp(127.0.0.1:4000)/"
+	cfg.DestDB.WorkerCount = 4
+	assert.ErrorContains(t, cfg.validate(), "preserve-txn can't be used with worker-count 4")
+	cfg.DestDB.WorkerCount = 1
+	assert.Assert(t, cfg.validate() == nil)
+}
+
+func TestValidateInputFormat(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.InputFormat = inputFormatPump
+	assert.ErrorContains(t, cfg.validate(), "requires the history DDL jobs")
+
+	cfg.HistoryDDLFile = "history.sql"
+	assert.ErrorContains(t, cfg.validate(), "requires the history DDL jobs")
+	cfg.HistoryDDLFile = "history.json"
+	assert.Assert(t, cfg.validate() == nil)
+
+	cfg.InputFormat = "binlog"
+	assert.ErrorContains(t, cfg.validate(), "unknown input-format binlog, should be one of drainer, pump, ticdc")
+}
+
+func TestBinlogDirs(t *testing.T) {
+	base, err := ioutil.TempDir("", "dirs")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(base)
+	for _, name := range []string{"drainer1", "drainer2", "other"} {
+		err = os.Mkdir(filepath.Join(base, name), 0700)
+		assert.Assert(t, err == nil)
+	}
+
+	cfg := &Config{Dir: "data"}
+	dirs, err := cfg.binlogDirs()
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dirs, []string{"data"})
+
+	cfg.Dir = filepath.Join(base, "other") + ", " + filepath.Join(base, "drainer*")
+	dirs, err = cfg.binlogDirs()
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dirs, []string{filepath.Join(base, "other"), filepath.Join(base, "drainer1"), filepath.Join(base, "drainer2")})
+
+	cfg.Dir = filepath.Join(base, "none*")
+	_, err = cfg.binlogDirs()
+	assert.ErrorContains(t, err, "no directory matches")
+
+	cfg.Storage = "s3://bucket/prefix"
+	dirs, err = cfg.binlogDirs()
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, dirs, []string{"s3://bucket/prefix"})
+}
+
+func TestSampleConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pitr.toml")
+	assert.Assert(t, ioutil.WriteFile(file, []byte(sampleConfig), 0600) == nil)
+
+	// the sample has all the default values
+	def := NewConfig()
+	assert.NilError(t, def.Parse([]string{"--data-dir", "data.drainer"}))
+	cfg := NewConfig()
+	assert.NilError(t, cfg.Parse([]string{"--config", file}))
+	assert.Equal(t, cfg.String(), def.String())
+
+	// the flags override the config file
+	cfg = NewConfig()
+	assert.NilError(t, cfg.Parse([]string{"--config", file, "--concurrency", "8", "--tables", "db1.t1"}))
+	assert.Equal(t, cfg.Concurrency, 8)
+	assert.Equal(t, cfg.Dir, "data.drainer")
+	assert.Equal(t, len(cfg.DoTables), 1)
+	assert.Equal(t, cfg.DoTables[0].Table, "t1")
+
+	assert.Assert(t, ioutil.WriteFile(file, []byte(sampleConfig+"\nunknown-option = 1\n"), 0600) == nil)
+	assert.ErrorContains(t, NewConfig().Parse([]string{"--config", file}), "unknown-option")
+	assert.Assert(t, ioutil.WriteFile(file, []byte(strings.Replace(sampleConfig, `concurrency = 4`, `concurrency = 0`, 1)), 0600) == nil)
+	assert.ErrorContains(t, NewConfig().Parse([]string{"--config", file}), "concurrency should be greater than 0")
+}
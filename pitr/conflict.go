@@ -0,0 +1,178 @@
+package pitr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// conflictCheckError stops the apply if any row to insert already exists in dest-db
+	conflictCheckError = "error"
+	// conflictCheckSafeMode switches to safe mode if any row to insert already exists in dest-db
+	conflictCheckSafeMode = "safe-mode"
+)
+
+// conflictConds returns the conditions locating the rows which should not exist in downstream before the event
+// is applied, they are the inserted row and the new row of an update changing the key.
+func conflictConds(ev *pb.Event, info *tableInfo) ([]string, error) {
+	tp := ev.GetTp()
+	if tp == pb.EventType_Delete {
+		return nil, nil
+	}
+	cols, err := decodeSQLColumns(ev.GetRow(), tp == pb.EventType_Update)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cols = info.dropGeneratedColumns(cols)
+	if tp == pb.EventType_Insert {
+		return []string{whereClause(info, cols)}, nil
+	}
+
+	newCols := make([]sqlColumn, 0, len(cols))
+	for _, col := range cols {
+		newCols = append(newCols, sqlColumn{name: col.name, value: col.changedValue})
+	}
+	if cond := whereClause(info, newCols); cond != whereClause(info, cols) {
+		return []string{cond}, nil
+	}
+	return nil, nil
+}
+
+// countConflicts returns the number of rows matching any of conds in the table of downstream.
+func countConflicts(ctx context.Context, db *sql.DB, schema, table string, conds []string) (int64, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE (%s)", quoteSchema(schema, table), strings.Join(conds, ") OR ("))
+	var count int64
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return 0, errors.Annotatef(err, "probe the existing rows of %s", quoteSchema(schema, table))
+	}
+	return count, nil
+}
+
+// findTableConflicts probes the rows to insert by the merged binlogs of a table in downstream, batchSize rows are
+// probed by a query. The probe stops at the first DDL of the table, the rows after it depend on the DDL, and the
+// tables not in downstream are created in the window so they have no conflict.
+func findTableConflicts(ctx context.Context, db *sql.DB, dir string, batchSize int, opts runOptions) (int64, error) {
+	reader, err := newDirPbReader(dir, 0, 0, opts)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer reader.close()
+
+	var (
+		info          *tableInfo
+		schema, table string
+		conds         []string
+		conflicts     int64
+	)
+	flush := func() error {
+		if len(conds) == 0 {
+			return nil
+		}
+		count, err := countConflicts(ctx, db, schema, table, conds)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		conflicts += count
+		conds = conds[:0]
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		binlog, err := reader.read()
+		if errors.Cause(err) == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if binlog.Tp == pb.BinlogType_DDL {
+			break
+		}
+		for i := range binlog.GetDmlData().GetEvents() {
+			ev := &binlog.DmlData.Events[i]
+			if info == nil {
+				schema, table = ev.GetSchemaName(), ev.GetTableName()
+				if info, err = getTableInfo(db, schema, table); err != nil {
+					if errors.Cause(err) == ErrTableNotExist {
+						return 0, nil
+					}
+					return 0, errors.Annotatef(err, "get table info of %s from downstream", quoteSchema(schema, table))
+				}
+				// the rows of the tables without unique key can be duplicated
+				if len(info.uniqueKeys) == 0 {
+					return 0, nil
+				}
+			}
+			evConds, err := conflictConds(ev, info)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+			conds = append(conds, evConds...)
+			if len(conds) >= batchSize {
+				if err := flush(); err != nil {
+					return 0, errors.Trace(err)
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return conflicts, nil
+}
+
+// checkConflicts probes the rows to insert by the merged binlogs in dest-db before applying them, the rows already
+// in a partially-populated cluster fail the INSERTs or are overwritten by the UPDATEs. It stops the run or switches
+// to safe mode by conflict-check.
+func (r *PITR) checkConflicts(ctx context.Context, outputDir string) error {
+	db, err := sql.Open("mysql", r.cfg.DestDB.DSN)
+	if err != nil {
+		return errors.Annotatef(err, "open downstream %s", redactDSN(r.cfg.DestDB.DSN))
+	}
+	defer db.Close()
+
+	tables, err := readSubDirs(outputDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	conflicts := make(map[string]int64)
+	for _, table := range tables {
+		count, err := findTableConflicts(ctx, db, filepath.Join(outputDir, table), r.cfg.DestDB.BatchSize, r.opts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if count > 0 {
+			conflicts[table] = count
+			log.Warn("the rows to insert already exist in dest-db", zap.String("table", table), zap.Int64("rows", count))
+		}
+	}
+	if len(conflicts) == 0 {
+		log.Info("no conflict is found in dest-db", zap.Int("tables", len(tables)))
+		return nil
+	}
+
+	if r.cfg.ConflictCheck == conflictCheckSafeMode {
+		log.Warn("conflicts are found in dest-db, switch to safe mode", zap.Int("tables", len(conflicts)))
+		r.opts.safeMode = true
+		return nil
+	}
+	names := make([]string, 0, len(conflicts))
+	for table, count := range conflicts {
+		names = append(names, fmt.Sprintf("%s(%d)", table, count))
+	}
+	sort.Strings(names)
+	return errors.Errorf("the rows to insert already exist in dest-db: %s, use conflict-check %s to overwrite them", strings.Join(names, ", "), conflictCheckSafeMode)
+}
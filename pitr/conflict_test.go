@@ -0,0 +1,31 @@
+package pitr
+
+import (
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestConflictConds(t *testing.T) {
+	byID := &tableInfo{schema: "test", table: "t1", columns: []string{"id", "v"}, uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}}}
+	byV := &tableInfo{schema: "test", table: "t1", columns: []string{"id", "v"}, uniqueKeys: []indexInfo{{name: "uk", columns: []string{"v"}}}}
+
+	conds, err := conflictConds(&genRowBinlog(pb.EventType_Insert, 1, 10, 100).DmlData.Events[0], byID)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, conds, []string{"`id` = 1"})
+
+	// the update not changing the key can't conflict
+	update := &genRowBinlog(pb.EventType_Update, 1, 10, 100).DmlData.Events[0]
+	conds, err = conflictConds(update, byID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(conds), 0)
+
+	conds, err = conflictConds(update, byV)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, conds, []string{"`v` = 11"})
+
+	conds, err = conflictConds(&genRowBinlog(pb.EventType_Delete, 1, 10, 100).DmlData.Events[0], byID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(conds), 0)
+}
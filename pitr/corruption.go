@@ -0,0 +1,134 @@
+package pitr
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// relaxAbort fails the run when a binlog file is corrupted
+	relaxAbort = "abort"
+	// relaxSkipTail skips the damaged region and the rest of the file, the binlogs before it are kept
+	relaxSkipTail = "skip-tail"
+	// relaxSkipFile skips the whole file if any part of it is damaged
+	relaxSkipFile = "skip-file"
+)
+
+// errStopScan stops scanning a binlog file without error.
+var errStopScan = errors.New("stop scanning binlog file")
+
+// corruptionGap is the binlogs lost by skipping the damaged region of a binlog file.
+type corruptionGap struct {
+	File string `json:"file"`
+	// Offset is the offset of the damaged region in the decompressed file
+	Offset int64  `json:"offset"`
+	Mode   string `json:"mode"`
+	Error  string `json:"error"`
+	// AfterCommitTS and BeforeCommitTS are the commit ts of the binlogs around the gap,
+	// 0 means the gap is at the beginning or the end of binlogs
+	AfterCommitTS  int64 `json:"after-commit-ts"`
+	BeforeCommitTS int64 `json:"before-commit-ts"`
+}
+
+func isValidRelaxCorruption(mode string) bool {
+	switch mode {
+	case relaxAbort, relaxSkipTail, relaxSkipFile:
+		return true
+	}
+	return false
+}
+
+// scanSourceBinlogFile decodes all the binlogs in file, and calls fn with every binlog and its size.
+// If the file is corrupted, it fails in abort mode, otherwise the damaged region is skipped according to
+// relax, and the returned gap describes it. In skip-file mode the file is checked before calling fn.
+// The binlogs are decoded with the max-event-size and the cipher of opts.
+func scanSourceBinlogFile(file, relax string, opts runOptions, fn func(binlog *pb.Binlog, n int64) error) (*corruptionGap, error) {
+	if relax == relaxSkipFile {
+		gap, err := scanSourceBinlogFile(file, relaxSkipTail, opts, func(*pb.Binlog, int64) error { return nil })
+		if err != nil || gap != nil {
+			if gap != nil {
+				gap.Mode = relaxSkipFile
+			}
+			return gap, errors.Trace(err)
+		}
+	}
+
+	f, _, err := openBinlogFile(file, opts.cipher)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset, lastTS int64
+	for {
+		binlog, n, err := decodeBinlog(reader, opts)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil, nil
+			}
+			if relax != relaxSkipTail && relax != relaxSkipFile {
+				return nil, errors.Annotatef(err, "decode binlog file %s at offset %d", redactStorageURI(file), offset)
+			}
+			log.Warn("binlog file is corrupted, skip the damaged region",
+				zap.String("file", redactStorageURI(file)), zap.Int64("offset", offset), zap.String("relax-corruption", relax),
+				zap.Int64("last commit ts", lastTS), zap.Error(err))
+			return &corruptionGap{File: file, Offset: offset, Mode: relax, Error: err.Error()}, nil
+		}
+		offset += n
+		lastTS = binlog.CommitTs
+
+		if err = fn(binlog, n); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
+
+// gapTracker fills the commit ts around the gaps of binlogs read in order, the gap is passed to onGap
+// once the next binlog is read or all the binlogs are read.
+type gapTracker struct {
+	lastTS  int64
+	pending []*corruptionGap
+	onGap   func(gap *corruptionGap)
+}
+
+// add is called with the commit ts of every binlog.
+func (t *gapTracker) add(commitTS int64) {
+	for _, gap := range t.pending {
+		gap.BeforeCommitTS = commitTS
+		t.report(gap)
+	}
+	t.pending = t.pending[:0]
+	t.lastTS = commitTS
+}
+
+// fileDone is called after a file is read, gap is nil if the file isn't corrupted.
+func (t *gapTracker) fileDone(gap *corruptionGap) {
+	if gap == nil {
+		return
+	}
+	gap.AfterCommitTS = t.lastTS
+	t.pending = append(t.pending, gap)
+}
+
+// finish is called after all the files are read.
+func (t *gapTracker) finish() {
+	for _, gap := range t.pending {
+		t.report(gap)
+	}
+	t.pending = nil
+}
+
+func (t *gapTracker) report(gap *corruptionGap) {
+	log.Warn("binlogs are lost in the corrupted region",
+		zap.String("file", redactStorageURI(gap.File)), zap.Int64("offset", gap.Offset), zap.String("relax-corruption", gap.Mode),
+		zap.Int64("after commit ts", gap.AfterCommitTS), zap.Int64("before commit ts", gap.BeforeCommitTS))
+	if t.onGap != nil {
+		t.onGap(gap)
+	}
+}
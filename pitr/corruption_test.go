@@ -0,0 +1,121 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pingcap/check"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+type testCorruptionSuite struct{}
+
+var _ = check.Suite(&testCorruptionSuite{})
+
+// readWithGaps reads the binlog files like Map, and returns the commit ts of binlogs and the gaps.
+func readWithGaps(files []string, relax string) ([]int64, []*corruptionGap, error) {
+	var (
+		commitTSs []int64
+		gaps      []*corruptionGap
+	)
+	tracker := &gapTracker{onGap: func(gap *corruptionGap) { gaps = append(gaps, gap) }}
+	quit := make(chan struct{})
+	defer close(quit)
+	for r := range readBinlogFiles(files, 2, relax, runOptions{}, newProgress(), quit) {
+		for binlog := range r.binlogCh {
+			tracker.add(binlog.CommitTs)
+			commitTSs = append(commitTSs, binlog.CommitTs)
+		}
+		if err := r.err(); err != nil {
+			return nil, nil, err
+		}
+		tracker.fileDone(r.gap)
+	}
+	tracker.finish()
+	return commitTSs, gaps, nil
+}
+
+func expectCommitTSs(from, to int64, skipped ...int64) []int64 {
+	var tss []int64
+	for ts := from; ts <= to; ts++ {
+		var skip bool
+		for _, s := range skipped {
+			skip = skip || s == ts
+		}
+		if !skip {
+			tss = append(tss, ts)
+		}
+	}
+	return tss
+}
+
+func (s *testCorruptionSuite) TestTruncatedTail(c *check.C) {
+	dir := c.MkDir()
+	writeBinlogsInDir(dir, c)
+	files, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+
+	// the 4th file has the binlogs with commit ts 7-10
+	info, err := os.Stat(files[3])
+	c.Assert(err, check.IsNil)
+	c.Assert(os.Truncate(files[3], info.Size()-5), check.IsNil)
+
+	_, _, err = readWithGaps(files, relaxAbort)
+	c.Assert(err, check.ErrorMatches, ".*decode binlog file .* at offset .*")
+
+	commitTSs, gaps, err := readWithGaps(files, relaxSkipTail)
+	c.Assert(err, check.IsNil)
+	c.Assert(commitTSs, check.DeepEquals, expectCommitTSs(1, 55, 10))
+	c.Assert(gaps, check.HasLen, 1)
+	c.Assert(gaps[0].File, check.Equals, files[3])
+	c.Assert(gaps[0].Offset, check.Equals, (info.Size()/4)*3)
+	c.Assert(gaps[0].AfterCommitTS, check.Equals, int64(9))
+	c.Assert(gaps[0].BeforeCommitTS, check.Equals, int64(11))
+
+	commitTSs, gaps, err = readWithGaps(files, relaxSkipFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(commitTSs, check.DeepEquals, expectCommitTSs(1, 55, 7, 8, 9, 10))
+	c.Assert(gaps, check.HasLen, 1)
+	c.Assert(gaps[0].Mode, check.Equals, relaxSkipFile)
+	c.Assert(gaps[0].AfterCommitTS, check.Equals, int64(6))
+	c.Assert(gaps[0].BeforeCommitTS, check.Equals, int64(11))
+}
+
+func (s *testCorruptionSuite) TestBadCRC(c *check.C) {
+	dir := c.MkDir()
+	writeBinlogsInDir(dir, c)
+	files, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+
+	// break the first binlog of the 4th file and the last binlog of the last file
+	for _, name := range []string{files[3], files[9]} {
+		data, err := ioutil.ReadFile(name)
+		c.Assert(err, check.IsNil)
+		n := len(data) / 4
+		if name == files[9] {
+			n = len(data)
+		}
+		data[n-1] ^= 0xff
+		c.Assert(ioutil.WriteFile(name, data, 0600), check.IsNil)
+	}
+
+	commitTSs, gaps, err := readWithGaps(files, relaxSkipTail)
+	c.Assert(err, check.IsNil)
+	c.Assert(commitTSs, check.DeepEquals, expectCommitTSs(1, 54, 7, 8, 9, 10))
+	c.Assert(gaps, check.HasLen, 2)
+	c.Assert(gaps[0].Offset, check.Equals, int64(0))
+	c.Assert(gaps[0].AfterCommitTS, check.Equals, int64(6))
+	c.Assert(gaps[0].BeforeCommitTS, check.Equals, int64(11))
+	// the gap at the end
+	c.Assert(gaps[1].AfterCommitTS, check.Equals, int64(54))
+	c.Assert(gaps[1].BeforeCommitTS, check.Equals, int64(0))
+
+	// other scanners skip the same binlogs
+	var n int
+	_, err = scanSourceBinlogFile(files[9], relaxSkipFile, runOptions{}, func(*pb.Binlog, int64) error {
+		n++
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
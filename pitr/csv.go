@@ -0,0 +1,143 @@
+package pitr
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+const (
+	// outputFormatCSV outputs the rows of every table in their state at the end of binlogs as CSV files
+	outputFormatCSV = "csv"
+
+	csvFileSuffix = ".csv"
+
+	// csvNull is NULL in CSV files, like the default of TiDB Lightning and LOAD DATA
+	csvNull = `\N`
+)
+
+var csvEscaper = strings.NewReplacer(`\`, `\\`)
+
+// csvEncoder encodes the rows inserted or updated by the merged binlogs of a table, every row is in its
+// final state because the binlogs are merged. the deleted rows and DDLs are skipped, and the first line is
+// the header of the columns of the first row.
+type csvEncoder struct {
+	columns []string
+	// index is the index of every column in columns
+	index map[string]int
+}
+
+func (e *csvEncoder) encode(binlog *pb.Binlog) ([]byte, error) {
+	if binlog.Tp != pb.BinlogType_DML {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	events := binlog.GetDmlData().GetEvents()
+	for i := range events {
+		ev := &events[i]
+		row := ev.GetRow()
+		switch ev.GetTp() {
+		case pb.EventType_Insert:
+		case pb.EventType_Update:
+			var err error
+			if row, err = getImageRow(row, afterImageRow); err != nil {
+				return nil, errors.Trace(err)
+			}
+		default:
+			continue
+		}
+
+		names, values, err := csvRow(row)
+		if err != nil {
+			return nil, errors.Annotatef(err, "event of %s", quoteSchema(ev.GetSchemaName(), ev.GetTableName()))
+		}
+		if e.columns == nil {
+			e.columns = names
+			e.index = make(map[string]int, len(names))
+			for i, name := range names {
+				e.index[name] = i
+			}
+			if err := w.Write(names); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		record := make([]string, len(e.columns))
+		for i := range record {
+			record[i] = csvNull
+		}
+		for i, name := range names {
+			idx, ok := e.index[name]
+			if !ok {
+				return nil, errors.Errorf("column %s of table %s is not in the csv header %v, the columns are changed by DDL",
+					name, quoteSchema(ev.GetSchemaName(), ev.GetTableName()), e.columns)
+			}
+			record[idx] = values[i]
+		}
+		if err := w.Write(record); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), errors.Trace(w.Error())
+}
+
+// csvRow decodes the names and values of the columns of the row.
+func csvRow(row [][]byte) (names, values []string, err error) {
+	names = make([]string, 0, len(row))
+	values = make([]string, 0, len(row))
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		value, err := csvValue(col.Value, col.Tp[0])
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "format value of column %s", col.Name)
+		}
+		names = append(names, col.Name)
+		values = append(values, value)
+	}
+	return names, values, nil
+}
+
+// csvValue decodes the column value, and formats it as a CSV field, the backslashes are escaped
+// because `\N` is NULL.
+func csvValue(data []byte, tp byte) (string, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	val = formatValue(val, tp)
+
+	switch v := val.GetValue().(type) {
+	case nil:
+		return csvNull, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		return csvEscaper.Replace(v), nil
+	case []byte:
+		return csvEscaper.Replace(string(v)), nil
+	case types.BinaryLiteral:
+		return csvEscaper.Replace(string(v)), nil
+	default:
+		return csvEscaper.Replace(fmt.Sprintf("%v", v)), nil
+	}
+}
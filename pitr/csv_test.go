@@ -0,0 +1,72 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func TestCSVWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	w, err := newBinlogWriter(runOptions{}, outputFormatCSV, filepath.Join(dir, "test_t1"), compressNone, 0)
+	assert.NilError(t, err)
+	for _, binlog := range []*pb.Binlog{
+		genTestDDL("test", "t1", "alter table test.t1 add column v int", 100),
+		genRowBinlog(pb.EventType_Insert, 1, 10, 200),
+		genRowBinlog(pb.EventType_Update, 2, 10, 300),
+		genRowBinlog(pb.EventType_Delete, 3, 10, 400),
+	} {
+		assert.NilError(t, w.Write(binlog))
+	}
+
+	// the string with comma and backslash, and NULL
+	schema, table := "test", "t1"
+	var row [][]byte
+	for _, col := range []*pb.Column{
+		{Name: "v", Tp: []byte{mysql.TypeVarchar}, MysqlType: "varchar", Value: encodeDatum(t, types.NewStringDatum(`a,b\c`))},
+		{Name: "id", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(4)},
+	} {
+		data, _ := col.Marshal()
+		row = append(row, data)
+	}
+	binlog := &pb.Binlog{
+		Tp:       pb.BinlogType_DML,
+		DmlData:  &pb.DMLData{Events: []pb.Event{{Tp: pb.EventType_Insert, SchemaName: &schema, TableName: &table, Row: row[:1]}}},
+		CommitTs: 500,
+	}
+	assert.NilError(t, w.Write(binlog))
+	binlog.DmlData.Events[0].Row = row[1:]
+	assert.NilError(t, w.Write(binlog))
+	assert.NilError(t, w.Close())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "test_t1.csv"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "id,v\n1,10\n2,11\n\\N,\"a,b\\\\c\"\n4,\\N\n")
+
+	// the column not in the header
+	w, err = newBinlogWriter(runOptions{}, outputFormatCSV, filepath.Join(dir, "test_t2"), compressNone, 0)
+	assert.NilError(t, err)
+	binlog.DmlData.Events[0].Row = row[1:]
+	assert.NilError(t, w.Write(binlog))
+	binlog.DmlData.Events[0].Row = row
+	assert.ErrorContains(t, w.Write(binlog), "column v of table `test`.`t1` is not in the csv header")
+	assert.NilError(t, w.Close())
+}
+
+func TestValidateCSVOutput(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.OutputFormat = outputFormatCSV
+	assert.NilError(t, cfg.validate())
+	cfg.Verify = true
+	assert.ErrorContains(t, cfg.validate(), "verify can't be used with output-format csv")
+}
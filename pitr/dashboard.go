@@ -0,0 +1,178 @@
+package pitr
+
+import (
+	"net/http"
+	"sort"
+)
+
+// dashboardMaxTables is the max number of tables shown in the dashboard, the tables with the most events are shown.
+const dashboardMaxTables = 100
+
+// dashboardTable is the events of a table in the dashboard.
+type dashboardTable struct {
+	Table             string `json:"table"`
+	EventsBeforeMerge int64  `json:"events-before-merge"`
+	RowsAfterMerge    int64  `json:"rows-after-merge"`
+	// Reduction is the percent of the events removed by merging
+	Reduction float64 `json:"reduction"`
+	// EventsPerSecond is the events split by Map per second
+	EventsPerSecond float64 `json:"events-per-second"`
+}
+
+// jobDashboard is the details of a job shown in the web UI.
+type jobDashboard struct {
+	jobStatus
+	// Phases is the finished phases, the current phase is in Progress
+	Phases    []phaseRecord    `json:"phases"`
+	TempDir   string           `json:"temp-dir"`
+	TempBytes int64            `json:"temp-bytes"`
+	Tables    []dashboardTable `json:"tables"`
+	// Warnings is the skipped history DDLs and damaged regions of binlog files
+	Warnings []string `json:"warnings"`
+}
+
+// dashboard returns the details of the job, status is the job's status got with Server's mutex held, the others
+// are read without the mutex because walking the temp dir may be slow.
+func (j *job) dashboard(status jobStatus) jobDashboard {
+	r := j.pitr
+	d := jobDashboard{
+		jobStatus: status,
+		Phases:    r.progress.finishedPhases(),
+		TempDir:   r.cfg.TempDir,
+		Warnings:  append(r.ddlErrors.skippedDDLs(), r.report.corruptionWarnings()...),
+	}
+	// the temp files may be removed while walking, the size is just not shown
+	d.TempBytes, _ = dirTreeSize(r.cfg.TempDir)
+
+	mapSeconds := 0.0
+	for _, phase := range d.Phases {
+		if phase.Phase == phaseMap {
+			mapSeconds += phase.ElapsedSeconds
+		}
+	}
+	if status.Progress.Phase == phaseMap {
+		mapSeconds += status.Progress.ElapsedSeconds
+	}
+	for name, t := range r.report.tableEvents() {
+		table := dashboardTable{Table: name, EventsBeforeMerge: t.EventsBeforeMerge, RowsAfterMerge: t.RowsAfterMerge,
+			Reduction: reduction(t.EventsBeforeMerge, t.RowsAfterMerge)}
+		if mapSeconds > 0 {
+			table.EventsPerSecond = float64(t.EventsBeforeMerge) / mapSeconds
+		}
+		d.Tables = append(d.Tables, table)
+	}
+	sort.Slice(d.Tables, func(i, k int) bool {
+		if d.Tables[i].EventsBeforeMerge != d.Tables[k].EventsBeforeMerge {
+			return d.Tables[i].EventsBeforeMerge > d.Tables[k].EventsBeforeMerge
+		}
+		return d.Tables[i].Table < d.Tables[k].Table
+	})
+	if len(d.Tables) > dashboardMaxTables {
+		d.Tables = d.Tables[:dashboardMaxTables]
+	}
+	return d
+}
+
+func handleDashboardPage(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardHTML is the web UI of Server, it polls the API of jobs and cancels a job by DELETE /jobs/{id}.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pitr jobs</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+table { border-collapse: collapse; margin: 8px 0 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num { text-align: right; }
+.bar { width: 400px; height: 16px; background: #eee; display: inline-block; vertical-align: middle; }
+.bar div { height: 100%; background: #4a90d9; }
+.state-failed { color: #c00; }
+.state-finished { color: #080; }
+.warning { color: #a60; }
+button { margin-left: 8px; }
+</style>
+</head>
+<body>
+<h2>pitr jobs</h2>
+<table id="jobs"><thead><tr><th>id</th><th>state</th><th>phase</th><th>start time</th><th></th></tr></thead><tbody></tbody></table>
+<div id="job"></div>
+<script>
+var selected = "";
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function(c) { return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]; });
+}
+
+function size(n) {
+  var units = ["B", "KiB", "MiB", "GiB", "TiB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(1) + units[i];
+}
+
+function bar(percent) {
+  return '<span class="bar"><div style="width:' + Math.min(percent, 100).toFixed(1) + '%"></div></span> ' + percent.toFixed(1) + '%';
+}
+
+function cancelJob(id) {
+  if (!confirm("cancel job " + id + "?")) { return; }
+  fetch("jobs/" + id, {method: "DELETE"}).then(refresh);
+}
+
+function renderJobs(jobs) {
+  var rows = jobs.map(function(j) {
+    var cancel = j.state === "running" ? '<button onclick="cancelJob(\'' + esc(j.id) + '\')">cancel</button>' : "";
+    return '<tr><td><a href="#" onclick="selected=\'' + esc(j.id) + '\';refresh();return false">' + esc(j.id) + '</a></td>' +
+      '<td class="state-' + esc(j.state) + '">' + esc(j.state) + '</td><td>' + esc(j.progress.phase) + '</td>' +
+      '<td>' + esc(j["start-time"]) + '</td><td>' + cancel + '</td></tr>';
+  });
+  document.querySelector("#jobs tbody").innerHTML = rows.join("");
+  if (!selected && jobs.length > 0) { selected = jobs[jobs.length - 1].id; }
+}
+
+function renderJob(d) {
+  var p = d.progress, html = "<h3>job " + esc(d.id) + ' <span class="state-' + esc(d.state) + '">' + esc(d.state) + "</span></h3>";
+  if (d.error) { html += '<p class="state-failed">' + esc(d.error) + "</p>"; }
+  html += "<table><tr><th>phase</th><th>progress</th><th>events</th><th>elapsed</th></tr>";
+  (d.phases || []).forEach(function(ph) {
+    html += "<tr><td>" + esc(ph.phase) + "</td><td>" + bar(100) + '</td><td class="num">' + ph.events + '</td><td class="num">' + ph["elapsed-seconds"].toFixed(0) + "s</td></tr>";
+  });
+  if (p.phase) {
+    var eta = p["eta-seconds"] >= 0 ? ", eta " + p["eta-seconds"].toFixed(0) + "s" : "";
+    html += "<tr><td>" + esc(p.phase) + "</td><td>" + bar(p.percent) + '</td><td class="num">' + p.events + '</td><td class="num">' + p["elapsed-seconds"].toFixed(0) + "s" + eta + "</td></tr>";
+  }
+  html += "</table>";
+  html += "<p>temp dir " + esc(d["temp-dir"]) + ": " + size(d["temp-bytes"]) + "</p>";
+  var warnings = d.warnings || [];
+  html += "<h4>warnings (" + warnings.length + ")</h4><ul>" + warnings.map(function(w) { return '<li class="warning">' + esc(w) + "</li>"; }).join("") + "</ul>";
+  html += "<h4>tables</h4><table><tr><th>table</th><th>events before merge</th><th>rows after merge</th><th>reduction</th><th>events/s in map</th></tr>";
+  (d.tables || []).forEach(function(t) {
+    html += "<tr><td>" + esc(t.table) + '</td><td class="num">' + t["events-before-merge"] + '</td><td class="num">' + t["rows-after-merge"] + '</td><td class="num">' + t.reduction.toFixed(1) + "%" + '</td><td class="num">' + t["events-per-second"].toFixed(1) + "</td></tr>";
+  });
+  html += "</table>";
+  document.getElementById("job").innerHTML = html;
+}
+
+function refresh() {
+  fetch("jobs").then(function(resp) { return resp.json(); }).then(function(jobs) {
+    renderJobs(jobs);
+    if (selected) {
+      return fetch("jobs/" + selected + "/dashboard").then(function(resp) { return resp.json(); }).then(renderJob);
+    }
+  });
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
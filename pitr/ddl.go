@@ -1,14 +1,9 @@
 package pitr
 
 import (
-	"database/sql"
-	"fmt"
-	"os"
-	"strings"
+	"context"
 	"sync"
-	"time"
 
-	tidblite "github.com/WangXiangUSTC/tidb-lite"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser"
@@ -17,75 +12,55 @@ import (
 	"go.uber.org/zap"
 )
 
-const (
-	colsSQL = `
-SELECT column_name, extra FROM information_schema.columns
-WHERE table_schema = ? AND table_name = ?;`
-	uniqKeysSQL = `
-SELECT non_unique, index_name, seq_in_index, column_name 
-FROM information_schema.statistics
-WHERE table_schema = ? AND table_name = ?
-ORDER BY seq_in_index ASC;`
-	alldatabases   = `SHOW DATABASES;`
-	alltables      = `SHOW TABLES;`
-	createMapDB    = `CREATE DATABASE _interval_map_;`
-	createMapTable = `USE _interval_map_; create table _inter_map_ (curKey varchar(128) unique, srcKey varchar(128));`
-	useIntervalDB  = `USE _interval_map_;`
-)
-
 var (
 	// ErrTableNotExist means the table not exist.
 	ErrTableNotExist = errors.New("table not exist")
-
-	// used for run a mock tidb
-	defaultTiDBDir  = "/tmp/pitr_tidb"
-	defaultTiDBPort = 40404
 )
 
 // DDLHandle used to handle ddl, and privide the table info
 type DDLHandle struct {
-	db *sql.DB
+	// tracker tracks the schema changed by the executed DDLs in memory
+	tracker schemaTracker
 
 	tableInfos sync.Map
 
-	tidbServer *tidblite.TiDBServer
-
 	historyDDLs []*model.Job
-}
 
-func NewDDLHandle() (*DDLHandle, error) {
-	// run a mock tidb in local, used to execute ddl and get table info
-	if err := os.Mkdir(defaultTiDBDir, os.ModePerm); err != nil {
-		return nil, err
-	}
-	tidbServer, err := tidblite.NewTiDBServer(tidblite.NewOptions(defaultTiDBDir).WithPort(defaultTiDBPort))
-	if err != nil {
-		return nil, err
-	}
+	// renames tracks the tables renamed by the DDLs in Map
+	renames renameTracker
 
-	var dbConn *sql.DB
-	for i := 0; i < 5; i++ {
-		dbConn, err = tidbServer.CreateConn()
-		if err != nil {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-		break
-	}
-	if err != nil {
-		return nil, err
-	}
+	// intervalMap maps a key to the key it's derived from
+	mapMu       sync.Mutex
+	intervalMap map[string]string
+}
 
-	ddlHandle := &DDLHandle{
-		db:         dbConn,
-		tidbServer: tidbServer,
+// configure sets the options of cfg choosing the keys of the tables, cfg can be nil.
+func (d *DDLHandle) configure(cfg *Config) {
+	if cfg != nil {
+		d.tracker.mergeKeys = cfg.MergeKeys
+		d.tracker.newCollation = cfg.NewCollationsEnabled
 	}
+}
 
+// setSampler samples the repetitive logs of the handle and its tracker by s.
+func (d *DDLHandle) setSampler(s *sampledLogger) {
+	d.tracker.sampler = s
+}
+
+// NewDDLHandle creates a DDLHandle with only the default database.
+func NewDDLHandle() (*DDLHandle, error) {
+	ddlHandle := &DDLHandle{}
+	ddlHandle.tracker.reset()
 	return ddlHandle, nil
 }
 
-func (d *DDLHandle) ExecuteHistoryDDLs(historyDDLs []*model.Job) error {
+// ExecuteHistoryDDLs executes the history DDL jobs in order, it stops when ctx is canceled.
+// the DDLs failed to execute are passed to onErr, which may skip them.
+func (d *DDLHandle) ExecuteHistoryDDLs(ctx context.Context, historyDDLs []*model.Job, onErr *ddlErrorHandler) error {
 	for _, ddl := range historyDDLs {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
 		if skipJob(ddl) {
 			continue
 		}
@@ -95,7 +70,7 @@ func (d *DDLHandle) ExecuteHistoryDDLs(historyDDLs []*model.Job) error {
 			schemaName = ddl.BinlogInfo.DBInfo.Name.O
 		}
 		err := d.ExecuteDDL(schemaName, ddl.Query)
-		if err != nil {
+		if err = onErr.handle(schemaName, ddl.Query, err); err != nil {
 			return errors.Trace(err)
 		}
 	}
@@ -103,7 +78,7 @@ func (d *DDLHandle) ExecuteHistoryDDLs(historyDDLs []*model.Job) error {
 	return nil
 }
 
-// ExecuteDDL executes ddl, and then update the table's info
+// ExecuteDDL executes ddl, and then update the table's info, the error is classified as a DDL failure
 func (d *DDLHandle) ExecuteDDL(schema string, ddl string) error {
 	log.Info("execute ddl", zap.String("ddl", ddl))
 
@@ -112,33 +87,22 @@ func (d *DDLHandle) ExecuteDDL(schema string, ddl string) error {
 	}
 	schemaInDDL, table, err := parserSchemaTableFromDDL(ddl)
 	if err != nil {
-		return errors.Trace(err)
+		return withErrorClass(ErrorClassDDL, errors.Trace(err))
 	}
 
 	if len(schema) == 0 {
 		schema = schemaInDDL
 	}
 
-	if _, err := d.db.Exec(ddl); err != nil {
-		if strings.Contains(err.Error(), "Unknown database") {
-			err := d.ExecuteDDL(schema, fmt.Sprintf("create database if not exists `%s`", schema))
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			return d.ExecuteDDL(schema, ddl)
-		} else if strings.Contains(err.Error(), "No database selected") {
-			if len(schema) != 0 {
-				return d.ExecuteDDL(schema, fmt.Sprintf("use %s; %s", schema, ddl))
-			}
-		} else if strings.Contains(err.Error(), "already exists") {
-			return nil
-		}
-
-		return errors.Trace(err)
+	if err := d.tracker.execute(schema, ddl); err != nil {
+		return withErrorClass(ErrorClassDDL, errors.Trace(err))
+	}
+	ddlCounter.Inc()
+	if len(table) == 0 {
+		return nil
 	}
 
-	info, err := getTableInfo(d.db, schema, table)
+	info, err := d.tracker.tableInfo(schema, table)
 	if err != nil {
 		// ddl drop table
 		if err == ErrTableNotExist {
@@ -158,59 +122,27 @@ func (d *DDLHandle) GetTableInfo(schema, table string) (*tableInfo, error) {
 		info := v.(*tableInfo)
 		return info, nil
 	}
-	log.Warn("table info not in memory, will get from local tidb")
+	d.tracker.sampler.warn("table info not in memory, will get from schema tracker", zap.String("schema", schema), zap.String("table", table))
 
-	return getTableInfo(d.db, schema, table)
+	return d.tracker.tableInfo(schema, table)
 }
 
 func (d *DDLHandle) getAllDatabaseNames() ([]string, error) {
-	rows, err := d.db.Query(alldatabases)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	defer rows.Close()
-
-	var names []string
-
-	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		if strings.EqualFold(name, "mysql") || strings.EqualFold(name, "INFORMATION_SCHEMA") || strings.EqualFold(name, "PERFORMANCE_SCHEMA") {
-			continue
-		}
-		names = append(names, name)
-	}
-	return names, nil
+	return d.tracker.databases(), nil
 }
 
+// ResetDB drops all the databases, only the default database is left.
 func (d *DDLHandle) ResetDB() error {
-	names, err := d.getAllDatabaseNames()
-	if err != nil {
-		return err
-	}
-	var sql string
-	for _, v := range names {
-		sql = fmt.Sprintf("DROP DATABASE %s", v)
-		err = d.ExecuteDDL(v, sql)
-		if err != nil {
-			return err
-		}
-	}
+	d.tracker.reset()
 
-	sql = "CREATE DATABASE IF NOT EXISTS test"
-	return d.ExecuteDDL("test", sql)
+	d.mapMu.Lock()
+	d.intervalMap = nil
+	d.mapMu.Unlock()
+	return nil
 }
 
-func (d *DDLHandle) Close() {
-	d.tidbServer.Close()
-
-	if err := os.RemoveAll(defaultTiDBDir); err != nil {
-		log.Warn("remove temp dir", zap.String("dir", defaultTiDBDir), zap.Error(err))
-	}
-}
+// Close does nothing, the schema is only tracked in memory.
+func (d *DDLHandle) Close() {}
 
 type tableInfo struct {
 	schema string
@@ -220,6 +152,14 @@ type tableInfo struct {
 	primaryKey *indexInfo
 	// include primary key if have
 	uniqueKeys []indexInfo
+	// collations is the collations of the string columns, it's only set with new-collations-enabled
+	collations map[string]string
+	// generatedColumns is the lower case names of the generated columns, they're not in columns
+	generatedColumns map[string]bool
+	// autoID is the AUTO_INCREMENT or AUTO_RANDOM column, nil if the table has neither
+	autoID *autoIDColumn
+	// partition is the partitions of the table, nil if it's not partitioned
+	partition *ast.PartitionOptions
 }
 
 type indexInfo struct {
@@ -227,117 +167,19 @@ type indexInfo struct {
 	columns []string
 }
 
-// getTableInfo returns information like (non-generated) column names and
-// unique keys about the specified table
-func getTableInfo(db *sql.DB, schema string, table string) (info *tableInfo, err error) {
-	info = &tableInfo{
-		schema: schema,
-		table:  table,
-	}
-
-	if info.columns, err = getColsOfTbl(db, schema, table); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	if info.uniqueKeys, err = getUniqKeys(db, schema, table); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	// put primary key at first place
-	// and set primaryKey
-	for i := 0; i < len(info.uniqueKeys); i++ {
-		if info.uniqueKeys[i].name == "PRIMARY" {
-			info.uniqueKeys[i], info.uniqueKeys[0] = info.uniqueKeys[0], info.uniqueKeys[i]
-			info.primaryKey = &info.uniqueKeys[0]
-			break
-		}
-	}
-
-	return
-}
-
-// getColsOfTbl returns a slice of the names of all columns,
-// generated columns are excluded.
-// https://dev.mysql.com/doc/mysql-infoschema-excerpt/5.7/en/columns-table.html
-func getColsOfTbl(db *sql.DB, schema, table string) ([]string, error) {
-	rows, err := db.Query(colsSQL, schema, table)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	defer rows.Close()
-
-	cols := make([]string, 0, 1)
-	for rows.Next() {
-		var name, extra string
-		err = rows.Scan(&name, &extra)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		isGenerated := strings.Contains(extra, "VIRTUAL GENERATED") || strings.Contains(extra, "STORED GENERATED")
-		if isGenerated {
-			continue
-		}
-		cols = append(cols, name)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	// if no any columns returns, means the table not exist.
-	if len(cols) == 0 {
-		return nil, ErrTableNotExist
-	}
-
-	return cols, nil
-}
-
-// https://dev.mysql.com/doc/mysql-infoschema-excerpt/5.7/en/statistics-table.html
-func getUniqKeys(db *sql.DB, schema, table string) (uniqueKeys []indexInfo, err error) {
-	rows, err := db.Query(uniqKeysSQL, schema, table)
+// isDestructiveDDL returns true if the DDL removes all the rows of the table, like TRUNCATE TABLE and DROP TABLE.
+func isDestructiveDDL(ddlQuery string) (bool, error) {
+	stmts, _, err := parser.New().Parse(ddlQuery, "", "")
 	if err != nil {
-		err = errors.Trace(err)
-		return
+		return false, errors.Trace(err)
 	}
-	defer rows.Close()
-
-	var nonUnique int
-	var keyName string
-	var columnName string
-	var seqInIndex int // start at 1
-
-	// get pk and uk
-	// key for PRIMARY or other index name
-	for rows.Next() {
-		err = rows.Scan(&nonUnique, &keyName, &seqInIndex, &columnName)
-		if err != nil {
-			err = errors.Trace(err)
-			return
-		}
-
-		if nonUnique == 1 {
-			continue
-		}
-
-		var i int
-		// Search for indexInfo with the current keyName
-		for i = 0; i < len(uniqueKeys); i++ {
-			if uniqueKeys[i].name == keyName {
-				uniqueKeys[i].columns = append(uniqueKeys[i].columns, columnName)
-				break
-			}
-		}
-		// If we don't find the indexInfo with the loop above, create a new one
-		if i == len(uniqueKeys) {
-			uniqueKeys = append(uniqueKeys, indexInfo{keyName, []string{columnName}})
+	for _, stmt := range stmts {
+		switch stmt.(type) {
+		case *ast.TruncateTableStmt, *ast.DropTableStmt:
+			return true, nil
 		}
 	}
-
-	if err = rows.Err(); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	return
+	return false, nil
 }
 
 // parserSchemaTableFromDDL parses ddl query to get schema and table
@@ -414,64 +256,39 @@ func parserSchemaTableFromDDL(ddlQuery string) (schema, table string, err error)
 }
 
 func (d *DDLHandle) getAllTableNames(schema string) ([]string, error) {
-	udb := fmt.Sprintf("USE %s;", schema)
-	rows, err := d.db.Query(udb + alltables)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	defer rows.Close()
-
-	var names []string
-	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		names = append(names, name)
-	}
-	return names, nil
+	return d.tracker.tables(schema)
 }
 
 func (d *DDLHandle) createMapTable() error {
-	err := d.ExecuteDDL("", createMapDB)
-	if err != nil {
-		return err
+	d.mapMu.Lock()
+	defer d.mapMu.Unlock()
+	if d.intervalMap == nil {
+		d.intervalMap = make(map[string]string)
 	}
-	return d.ExecuteDDL("", createMapTable)
+	return nil
 }
 
+// fetchMapKeyFromDB returns the key which key is derived from, it's empty if key is not derived.
 func (d *DDLHandle) fetchMapKeyFromDB(key string) (string, error) {
-	sel := fmt.Sprintf(`SELECT srcKey FROM _inter_map_ WHERE curKey = '%s'`, key)
-	rows, err := d.db.Query(useIntervalDB + sel)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	defer rows.Close()
-
-	var cKey string
-	rows.Next()
-	err = rows.Scan(&cKey)
-	if err != nil {
-		return "", nil
-	}
-	return cKey, nil
+	d.mapMu.Lock()
+	defer d.mapMu.Unlock()
+	return d.intervalMap[key], nil
 }
 
 func (d *DDLHandle) insertMapKeyFromDB(newKey, oldKey string) error {
-	s, err := d.fetchMapKeyFromDB(oldKey)
-	if err != nil {
-		return err
+	d.mapMu.Lock()
+	defer d.mapMu.Unlock()
+	if d.intervalMap == nil {
+		d.intervalMap = make(map[string]string)
 	}
-	var ins string
-	if s != "" {
-		ins = fmt.Sprintf(`INSERT INTO _interval_map_._inter_map_ VALUES ('%s', '%s')`, newKey, s)
-
-	} else {
-		ins = fmt.Sprintf(`INSERT INTO _interval_map_._inter_map_ VALUES ('%s', '%s')`, newKey, oldKey)
+	if src, ok := d.intervalMap[oldKey]; ok && src != "" {
+		oldKey = src
+	}
+	if _, ok := d.intervalMap[newKey]; ok {
+		return errors.Errorf("duplicate entry %s for key curKey", newKey)
 	}
-	_, err = d.db.Exec(ins)
-	return err
+	d.intervalMap[newKey] = oldKey
+	return nil
 }
 
 // TiDB write DDL Binlog for every DDL Job, we must ignore jobs that are cancelled or rollback
@@ -2,7 +2,6 @@ package pitr
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"testing"
 
@@ -15,7 +14,6 @@ func TestGetAllDatabaseNames(t *testing.T) {
 	sql := "use test; create table t1 (a int)"
 	sql1 := "create database test1"
 
-	os.RemoveAll(defaultTiDBDir)
 	ddl, err := NewDDLHandle()
 	assert.Assert(t, err == nil)
 
@@ -38,7 +36,6 @@ func TestGetAllDatabaseNames(t *testing.T) {
 
 func TestResetDB(t *testing.T) {
 	sql := "create database test1"
-	os.RemoveAll(defaultTiDBDir)
 	ddl, err := NewDDLHandle()
 	assert.Assert(t, err == nil)
 
@@ -86,7 +83,6 @@ func TestRestore(t *testing.T) {
 func TestGetAllTableNames(t *testing.T) {
 	sql := "create database test1"
 	sql1 := "use test1; create table t1(a int)"
-	os.RemoveAll(defaultTiDBDir)
 	ddl, err := NewDDLHandle()
 	ddl.ResetDB()
 	assert.Assert(t, err == nil)
@@ -103,7 +99,6 @@ func TestGetAllTableNames(t *testing.T) {
 }
 
 func TestFetchMapKeyFromDB(t *testing.T) {
-	os.RemoveAll(defaultTiDBDir)
 	ddl, err := NewDDLHandle()
 	assert.Assert(t, err == nil)
 	ddl.ResetDB()
@@ -128,3 +123,42 @@ func TestFetchMapKeyFromDB(t *testing.T) {
 	assert.Assert(t, err == nil)
 	assert.Assert(t, strings.EqualFold("mt_src", key))
 }
+
+func TestDumpSchema(t *testing.T) {
+	ddl, err := NewDDLHandle()
+	assert.Assert(t, err == nil)
+	ddl.ResetDB()
+
+	for _, sql := range []string{
+		"create database db1",
+		"use db1; create table t1 (a int primary key)",
+		"use db1; create table t2 (a int primary key)",
+		"use db1; alter table t1 add column b varchar(10)",
+		"create database db2",
+		"use db2; create table t1 (a int)",
+	} {
+		err = ddl.ExecuteDDL("", sql)
+		assert.Assert(t, err == nil, sql)
+	}
+
+	var sb strings.Builder
+	err = ddl.dumpSchema(&sb, nil, nil)
+	assert.Assert(t, err == nil)
+	schema := sb.String()
+	assert.Assert(t, strings.Contains(schema, "CREATE DATABASE `db1`"))
+	assert.Assert(t, strings.Contains(schema, "USE `db1`;"))
+	assert.Assert(t, strings.Contains(schema, "`b` VARCHAR(10)"))
+	assert.Assert(t, strings.Contains(schema, "CREATE TABLE `t2`"))
+	assert.Assert(t, strings.Contains(schema, "CREATE DATABASE `db2`"))
+	assert.Assert(t, strings.Index(schema, "`db1`") < strings.Index(schema, "`db2`"))
+
+	doDBs, doTables, err := parseTables("db1.t1")
+	assert.Assert(t, err == nil)
+	sb.Reset()
+	err = ddl.dumpSchema(&sb, newTableFilter(&Config{DoDBs: doDBs, DoTables: doTables}), nil)
+	assert.Assert(t, err == nil)
+	schema = sb.String()
+	assert.Assert(t, strings.Contains(schema, "CREATE TABLE `t1`"))
+	assert.Assert(t, !strings.Contains(schema, "CREATE TABLE `t2`"))
+	assert.Assert(t, !strings.Contains(schema, "`db2`"))
+}
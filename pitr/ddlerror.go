@@ -0,0 +1,128 @@
+package pitr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// onDDLErrorAbort, onDDLErrorSkip and onDDLErrorQuarantine are the values of on-ddl-error
+	onDDLErrorAbort      = "abort"
+	onDDLErrorSkip       = "skip"
+	onDDLErrorQuarantine = "quarantine"
+
+	skippedDDLsFileName = "skipped_ddls.sql"
+)
+
+// ddlErrorHandler decides what to do with a history DDL which fails to execute. the history DDLs are
+// executed by both Map and Reduce, a DDL skipped twice is only counted and quarantined once.
+// a nil ddlErrorHandler aborts on any error.
+type ddlErrorHandler struct {
+	mu sync.Mutex
+
+	policy string
+	// file is the file to write the quarantined DDLs, it's truncated by the first DDL of a run
+	file    string
+	created bool
+
+	skipped map[string]struct{}
+}
+
+func newDDLErrorHandler(policy, dir string) *ddlErrorHandler {
+	if policy == "" || policy == onDDLErrorAbort {
+		return nil
+	}
+	return &ddlErrorHandler{
+		policy:  policy,
+		file:    filepath.Join(dir, skippedDDLsFileName),
+		skipped: make(map[string]struct{}),
+	}
+}
+
+// handle returns err if the policy is abort, otherwise it logs the DDL, writes it to the quarantine
+// file if the policy is quarantine, and returns nil.
+func (h *ddlErrorHandler) handle(schema, ddl string, err error) error {
+	if h == nil || err == nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := schema + "\x00" + ddl
+	if _, ok := h.skipped[key]; ok {
+		return nil
+	}
+	log.Warn("skip the history ddl which failed to execute", zap.String("policy", h.policy),
+		zap.String("schema", schema), zap.String("ddl", ddl), zap.Error(err))
+
+	if h.policy == onDDLErrorQuarantine {
+		if werr := h.quarantine(schema, ddl, err); werr != nil {
+			return errors.Annotatef(werr, "quarantine ddl %s", ddl)
+		}
+	}
+	h.skipped[key] = struct{}{}
+	return nil
+}
+
+// quarantine appends the DDL with the error and its schema to the quarantine file, so it can be
+// reviewed and executed manually.
+func (h *ddlErrorHandler) quarantine(schema, ddl string, err error) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !h.created {
+		if err := os.MkdirAll(filepath.Dir(h.file), 0700); err != nil {
+			return errors.Trace(err)
+		}
+		flag |= os.O_TRUNC
+	}
+	f, ferr := os.OpenFile(h.file, flag, 0600)
+	if ferr != nil {
+		return errors.Trace(ferr)
+	}
+	defer f.Close()
+	h.created = true
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+	if len(schema) != 0 {
+		fmt.Fprintf(&b, "USE %s;\n", quoteName(schema))
+	}
+	fmt.Fprintf(&b, "%s;\n\n", strings.TrimSuffix(strings.TrimSpace(ddl), ";"))
+	if _, err := f.WriteString(b.String()); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
+
+// skippedDDLs returns the DDLs skipped in this run like `schema: ddl`.
+func (h *ddlErrorHandler) skippedDDLs() []string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ddls := make([]string, 0, len(h.skipped))
+	for key := range h.skipped {
+		ddls = append(ddls, strings.TrimPrefix(strings.Replace(key, "\x00", ": ", 1), ": "))
+	}
+	sort.Strings(ddls)
+	return ddls
+}
+
+// skippedCount returns the number of DDLs skipped in this run.
+func (h *ddlErrorHandler) skippedCount() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.skipped)
+}
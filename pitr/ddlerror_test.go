@@ -0,0 +1,65 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"gotest.tools/assert"
+)
+
+func TestDDLErrorHandler(t *testing.T) {
+	var abort *ddlErrorHandler
+	assert.ErrorContains(t, abort.handle("test", "alter table t add column c int", errors.New("duplicate column")), "duplicate column")
+	assert.Assert(t, newDDLErrorHandler(onDDLErrorAbort, "out") == nil)
+
+	skip := newDDLErrorHandler(onDDLErrorSkip, "out")
+	assert.Assert(t, skip.handle("test", "alter table t add column c int", errors.New("duplicate column")) == nil)
+	assert.Equal(t, skip.skippedCount(), 1)
+	_, err := os.Stat(filepath.Join("out", skippedDDLsFileName))
+	assert.Assert(t, os.IsNotExist(err))
+
+	dir, err := ioutil.TempDir("", "ddlerror")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "output", skippedDDLsFileName)
+
+	quarantine := newDDLErrorHandler(onDDLErrorQuarantine, filepath.Join(dir, "output"))
+	assert.Assert(t, quarantine.handle("test", "alter table t add column c int;", errors.New("duplicate column")) == nil)
+	// executed again by Reduce
+	assert.Assert(t, quarantine.handle("test", "alter table t add column c int;", errors.New("duplicate column")) == nil)
+	assert.Assert(t, quarantine.handle("", "create table test.t2 (a int) partition by system_time", errors.New("syntax error\nnear system_time")) == nil)
+	assert.Equal(t, quarantine.skippedCount(), 2)
+
+	data, err := ioutil.ReadFile(file)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(data), strings.Join([]string{
+		"-- duplicate column",
+		"USE `test`;",
+		"alter table t add column c int;",
+		"",
+		"-- syntax error near system_time",
+		"create table test.t2 (a int) partition by system_time;",
+		"", "",
+	}, "\n"))
+
+	// the file of the last run is truncated
+	quarantine = newDDLErrorHandler(onDDLErrorQuarantine, filepath.Join(dir, "output"))
+	assert.Assert(t, quarantine.handle("test", "drop index idx on t", errors.New("index not exist")) == nil)
+	data, err = ioutil.ReadFile(file)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(data), "-- index not exist\nUSE `test`;\ndrop index idx on t;\n\n")
+}
+
+func TestValidateOnDDLError(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	assert.Equal(t, cfg.OnDDLError, onDDLErrorAbort)
+	cfg.OnDDLError = onDDLErrorQuarantine
+	assert.Assert(t, cfg.validate() == nil)
+	cfg.OnDDLError = "ignore"
+	assert.ErrorContains(t, cfg.validate(), "on-ddl-error should be")
+}
@@ -4,14 +4,33 @@ import (
 	"io"
 
 	"github.com/pingcap/errors"
-	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
 )
 
 // Decode decodes binlog from protobuf content.
 // return *pb.Binlog and how many bytes read from reader
 func Decode(r io.Reader) (*pb.Binlog, int64, error) {
-	payload, length, err := binlogfile.Decode(r)
+	return decodeBinlog(r, runOptions{})
+}
+
+// decodeBinlog decodes binlog like Decode with the max-event-size and the cipher of opts, the binlogs
+// skipped by on-oversized-event are included in the bytes read.
+func decodeBinlog(r io.Reader, opts runOptions) (*pb.Binlog, int64, error) {
+	var skipped int64
+	payload, length, err := decodePayload(r, opts.maxEventSize)
+	for opts.skipOversizedEvents && errors.Cause(err) == errOversizedEvent {
+		opts.sampler.warn("skip the oversized binlog", zap.Int64("length", length), zap.Error(err))
+		skipped += length
+		payload, length, err = decodePayload(r, opts.maxEventSize)
+	}
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	length += skipped
+
+	// the temp files and output files may be encrypted
+	payload, err = decryptPayload(payload, opts.cipher)
 	if err != nil {
 		return nil, 0, errors.Trace(err)
 	}
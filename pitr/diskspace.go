@@ -0,0 +1,131 @@
+package pitr
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// spaceRequirement is the space needed by the files in dir.
+type spaceRequirement struct {
+	dir  string
+	size int64
+}
+
+// fsSpace is the available space of a filesystem.
+type fsSpace struct {
+	dirs      []string
+	available int64
+	required  int64
+}
+
+// statFS returns the device id and available bytes of the filesystem where dir is, if dir doesn't exist,
+// its nearest existing parent is used.
+func statFS(dir string) (uint64, int64, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			return statDirFS(dir, info)
+		}
+		if !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return 0, 0, errors.Trace(err)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// checkDiskSpace checks the filesystems have enough available space for the requirements,
+// the requirements in the same filesystem are added up.
+func checkDiskSpace(requirements []spaceRequirement) error {
+	var spaces []uint64
+	fsSpaces := make(map[uint64]*fsSpace)
+	for _, req := range requirements {
+		dev, available, err := statFS(req.dir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s, ok := fsSpaces[dev]
+		if !ok {
+			s = &fsSpace{available: available}
+			fsSpaces[dev] = s
+			spaces = append(spaces, dev)
+		}
+		s.dirs = append(s.dirs, req.dir)
+		s.required += req.size
+	}
+
+	for _, dev := range spaces {
+		s := fsSpaces[dev]
+		log.Info("check disk space", zap.Strings("dirs", s.dirs),
+			zap.String("required", formatSize(s.required)), zap.String("available", formatSize(s.available)))
+		if s.required > s.available {
+			return withErrorClass(ErrorClassDiskFull, errors.Errorf("not enough disk space for %v, required %s, but only %s is available",
+				s.dirs, formatSize(s.required), formatSize(s.available)))
+		}
+	}
+	return nil
+}
+
+// dirTreeSize returns the total size of the files in dir and its sub dirs, 0 if dir doesn't exist.
+func dirTreeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, errors.Trace(err)
+}
+
+// preflightDiskSpace estimates the space needed by Map and Reduce, and checks the temp dir and output dir have
+// enough space before merging. The temp files and the merged binlogs are about as large as the source binlogs
+// in the worst case, the temp files already written in the last run are excluded when resuming.
+func (r *PITR) preflightDiskSpace(fileSize int64) error {
+	tempDir := r.cfg.TempDir
+	if tempDir == "" {
+		tempDir = defaultTempDir
+	}
+	tempSize := fileSize
+	if r.cfg.resumeTempDir() {
+		written, err := dirTreeSize(tempDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tempSize -= written
+		if tempSize < 0 {
+			tempSize = 0
+		}
+	}
+	outputSize := fileSize
+	if len(r.cfg.BaseDir) != 0 {
+		baseSize, err := dirTreeSize(r.cfg.BaseDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		outputSize += baseSize
+	}
+
+	err := checkDiskSpace([]spaceRequirement{
+		{dir: tempDir, size: tempSize},
+		{dir: defaultOutputDir, size: outputSize},
+	})
+	if err != nil && r.cfg.Force {
+		log.Warn("disk space check failed, continue because of --force", zap.Error(err))
+		return nil
+	}
+	return errors.Annotate(err, "use --force to skip the check")
+}
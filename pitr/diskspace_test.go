@@ -0,0 +1,50 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskspace")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// the dir doesn't exist, its parent is used
+	notExist := filepath.Join(dir, "a", "b")
+	_, available, err := statFS(notExist)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, available > 0)
+
+	assert.Assert(t, checkDiskSpace([]spaceRequirement{{dir: dir, size: 1}, {dir: notExist, size: 1}}) == nil)
+
+	// the requirements in the same filesystem are added up
+	err = checkDiskSpace([]spaceRequirement{{dir: dir, size: math.MaxInt64 / 2}, {dir: notExist, size: math.MaxInt64 / 2}})
+	assert.ErrorContains(t, err, "not enough disk space")
+}
+
+func TestDirTreeSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskspace")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	assert.Assert(t, os.Mkdir(filepath.Join(dir, "sub"), 0700) == nil)
+	assert.Assert(t, ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 10), 0600) == nil)
+	assert.Assert(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 5), 0600) == nil)
+
+	size, err := dirTreeSize(dir)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, size, int64(15))
+
+	size, err = dirTreeSize(filepath.Join(dir, "not-exist"))
+	assert.Assert(t, err == nil)
+	assert.Equal(t, size, int64(0))
+
+	assert.Equal(t, formatSize(1023), "1023B")
+	assert.Equal(t, formatSize(1536<<20), "1.5GiB")
+}
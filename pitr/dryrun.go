@@ -0,0 +1,170 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"go.uber.org/zap"
+)
+
+// tableSummary is the number of events of one table.
+type tableSummary struct {
+	Inserts int64 `json:"inserts"`
+	Updates int64 `json:"updates"`
+	Deletes int64 `json:"deletes"`
+	DDLs    int64 `json:"ddls"`
+}
+
+// dryRunSummary is the summary of binlogs which will be merged.
+type dryRunSummary struct {
+	Files    []string `json:"files"`
+	FileSize int64    `json:"file-size"`
+
+	MinCommitTS int64 `json:"min-commit-ts"`
+	MaxCommitTS int64 `json:"max-commit-ts"`
+
+	Binlogs     int64 `json:"binlogs"`
+	HistoryDDLs int   `json:"history-ddls"`
+	// SkippedEvents is the number of events skipped by table filter
+	SkippedEvents int64 `json:"skipped-events"`
+
+	Tables map[string]*tableSummary `json:"tables"`
+}
+
+func newDryRunSummary(files []string, fileSize int64) *dryRunSummary {
+	return &dryRunSummary{
+		Files:    files,
+		FileSize: fileSize,
+		Tables:   make(map[string]*tableSummary),
+	}
+}
+
+func (s *dryRunSummary) table(schema, table string) *tableSummary {
+	key := fmt.Sprintf("%s_%s", schema, table)
+	ts, ok := s.Tables[key]
+	if !ok {
+		ts = &tableSummary{}
+		s.Tables[key] = ts
+	}
+	return ts
+}
+
+// addBinlog counts the binlog's events, the events of tables skipped by filter are not counted.
+func (s *dryRunSummary) addBinlog(binlog *pb.Binlog, f *tableFilter) error {
+	s.Binlogs++
+	if s.MinCommitTS == 0 || binlog.CommitTs < s.MinCommitTS {
+		s.MinCommitTS = binlog.CommitTs
+	}
+	if binlog.CommitTs > s.MaxCommitTS {
+		s.MaxCommitTS = binlog.CommitTs
+	}
+
+	switch binlog.Tp {
+	case pb.BinlogType_DML:
+		for _, event := range binlog.GetDmlData().GetEvents() {
+			schema := event.GetSchemaName()
+			table := event.GetTableName()
+			if f.skip(schema, table) {
+				s.SkippedEvents++
+				continue
+			}
+
+			ts := s.table(schema, table)
+			switch event.GetTp() {
+			case pb.EventType_Insert:
+				ts.Inserts++
+			case pb.EventType_Update:
+				ts.Updates++
+			case pb.EventType_Delete:
+				ts.Deletes++
+			}
+		}
+	case pb.BinlogType_DDL:
+		schema, table, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if f.skip(schema, table) {
+			s.SkippedEvents++
+			return nil
+		}
+		s.table(schema, table).DDLs++
+	}
+
+	return nil
+}
+
+// print prints the summary in human readable format.
+func (s *dryRunSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "files: %d, size: %d bytes\n", len(s.Files), s.FileSize)
+	for _, file := range s.Files {
+		fmt.Fprintf(w, "  %s\n", redactStorageURI(file))
+	}
+	if s.Binlogs > 0 {
+		fmt.Fprintf(w, "commit ts: [%d, %d], time: [%s, %s]\n", s.MinCommitTS, s.MaxCommitTS,
+			oracle.GetTimeFromTS(uint64(s.MinCommitTS)).Format(timeFormat),
+			oracle.GetTimeFromTS(uint64(s.MaxCommitTS)).Format(timeFormat))
+	}
+	fmt.Fprintf(w, "binlogs: %d, history ddls: %d, events skipped by filter: %d\n", s.Binlogs, s.HistoryDDLs, s.SkippedEvents)
+
+	tables := make([]string, 0, len(s.Tables))
+	for table := range s.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	fmt.Fprintf(w, "tables: %d\n", len(tables))
+	if len(tables) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %-40s %12s %12s %12s %8s\n", "table", "insert", "update", "delete", "ddl")
+	for _, table := range tables {
+		ts := s.Tables[table]
+		fmt.Fprintf(w, "  %-40s %12d %12d %12d %8d\n", table, ts.Inserts, ts.Updates, ts.Deletes, ts.DDLs)
+	}
+}
+
+// dryRun scans the binlog files, and prints the summary of binlogs which will be merged,
+// but doesn't split and merge binlogs.
+func (r *PITR) dryRun(ctx context.Context, files []string, fileSize int64, firstBinlogTs int64) error {
+	summary := newDryRunSummary(files, fileSize)
+
+	historyDDLs, err := r.loadHistoryDDLJobs(ctx, firstBinlogTs)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+	summary.HistoryDDLs = len(historyDDLs)
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := scanSourceBinlogFile(file, r.cfg.RelaxCorruption, r.opts, func(binlog *pb.Binlog, _ int64) error {
+			if !isAcceptableBinlog(binlog, r.cfg.StartTSO, r.cfg.StopTSO) {
+				return nil
+			}
+			return summary.addBinlog(binlog, r.filter)
+		}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	log.Info("dry run finished", zap.Int64("binlogs", summary.Binlogs), zap.Int("tables", len(summary.Tables)))
+	summary.print(os.Stdout)
+	return nil
+}
+
+// scanBinlogFile decodes all the binlogs in file with opts, and calls fn for every binlog.
+func scanBinlogFile(file string, opts runOptions, fn func(binlog *pb.Binlog) error) error {
+	_, err := scanSourceBinlogFile(file, relaxAbort, opts, func(binlog *pb.Binlog, _ int64) error {
+		return fn(binlog)
+	})
+	return errors.Trace(err)
+}
@@ -0,0 +1,33 @@
+package pitr
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDryRunSummary(t *testing.T) {
+	summary := newDryRunSummary([]string{"binlog-0000000000000000-20191010101010"}, 100)
+	f := newTableFilter(&Config{IgnoreDBs: []string{"ignore"}})
+
+	err := summary.addBinlog(genTestDDL("test", "tb1", "use test; create table tb1 (a int primary key)", 100), f)
+	assert.Assert(t, err == nil)
+	err = summary.addBinlog(genTestDML("test", "tb1", 200), f)
+	assert.Assert(t, err == nil)
+	err = summary.addBinlog(genTestDML("ignore", "tb1", 201), f)
+	assert.Assert(t, err == nil)
+
+	assert.Assert(t, summary.Binlogs == 3)
+	assert.Assert(t, summary.MinCommitTS == 100)
+	assert.Assert(t, summary.MaxCommitTS == 201)
+	assert.Assert(t, summary.SkippedEvents == 3)
+	assert.Assert(t, len(summary.Tables) == 1)
+	assert.DeepEqual(t, *summary.Tables["test_tb1"], tableSummary{Inserts: 1, Updates: 1, Deletes: 1, DDLs: 1})
+
+	var sb strings.Builder
+	summary.print(&sb)
+	assert.Assert(t, strings.Contains(sb.String(), "files: 1, size: 100 bytes"))
+	assert.Assert(t, strings.Contains(sb.String(), "test_tb1"))
+	assert.Assert(t, !strings.Contains(sb.String(), "ignore_tb1"))
+}
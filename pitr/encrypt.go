@@ -0,0 +1,235 @@
+package pitr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	// encryptedPayloadMagic is the prefix of an encrypted binlog payload, 0xff can't be the first byte of
+	// a protobuf message, so the binlogs not encrypted are never mistaken.
+	encryptedPayloadMagic = "\xffENC"
+	// encryptedFileMagic is the header of an encrypted SQL file
+	encryptedFileMagic = "PITRENC1"
+	encryptSuffix      = ".enc"
+
+	encryptChunkSize = 64 * 1024
+)
+
+// payloadCipher encrypts the data by AES-GCM, every sealed data has a random nonce.
+type payloadCipher struct {
+	aead cipher.AEAD
+}
+
+// loadEncryptKey reads the AES key from file, the key is 16, 24 or 32 bytes encoded in hex,
+// or the raw bytes.
+func loadEncryptKey(file string) (*payloadCipher, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read encrypt key file %s", file)
+	}
+	key := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		key = decoded
+	}
+	c, err := newPayloadCipher(key)
+	return c, errors.Annotatef(err, "encrypt key file %s", file)
+}
+
+func newPayloadCipher(key []byte) (*payloadCipher, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.Errorf("the key should be 16, 24 or 32 bytes, but got %d bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &payloadCipher{aead: aead}, nil
+}
+
+// seal returns the nonce followed by the encrypted data, ad is authenticated but not encrypted.
+func (c *payloadCipher) seal(dst, data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Trace(err)
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, data, ad), nil
+}
+
+func (c *payloadCipher) open(sealed, ad []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < n+c.aead.Overhead() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	data, err := c.aead.Open(nil, sealed[:n], sealed[n:], ad)
+	if err != nil {
+		return nil, errors.Annotate(err, "decrypt failed, the key may be wrong or the data is corrupted")
+	}
+	return data, nil
+}
+
+// encryptPayload encrypts the binlog payload written to file.
+func (c *payloadCipher) encryptPayload(payload []byte) ([]byte, error) {
+	return c.seal([]byte(encryptedPayloadMagic), payload, []byte(encryptedPayloadMagic))
+}
+
+// decryptPayload decrypts the payload by c if it's encrypted, otherwise returns it directly.
+func decryptPayload(payload []byte, c *payloadCipher) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte(encryptedPayloadMagic)) {
+		return payload, nil
+	}
+	if c == nil {
+		return nil, errors.New("the binlog is encrypted, set encrypt-key-file to decrypt it")
+	}
+	return c.open(payload[len(encryptedPayloadMagic):], []byte(encryptedPayloadMagic))
+}
+
+// encryptSuffixOf returns the file name suffix of the files encrypted by c.
+func encryptSuffixOf(c *payloadCipher) string {
+	if c == nil {
+		return ""
+	}
+	return encryptSuffix
+}
+
+// encryptWriter encrypts the data written to it in chunks, every chunk is written as its length in 4 bytes
+// and the sealed data. the index of chunk and whether it's the last one are authenticated, so the chunks
+// can't be reordered or truncated.
+type encryptWriter struct {
+	c     *payloadCipher
+	w     io.Writer
+	buf   []byte
+	index uint64
+}
+
+// newEncryptWriter returns a writer which encrypts the data by c and writes to w, it should be closed
+// before closing w.
+func newEncryptWriter(c *payloadCipher, w io.Writer) (io.WriteCloser, error) {
+	if _, err := w.Write([]byte(encryptedFileMagic)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &encryptWriter{c: c, w: w, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if len(w.buf) == encryptChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, errors.Trace(err)
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) flush(last bool) error {
+	sealed, err := w.c.seal(make([]byte, 4), w.buf, chunkAD(w.index, last))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	if _, err := w.w.Write(sealed); err != nil {
+		return errors.Trace(err)
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the last chunk, it doesn't close the underlying writer.
+func (w *encryptWriter) Close() error {
+	return errors.Trace(w.flush(true))
+}
+
+func chunkAD(index uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// decryptReader decrypts the data written by encryptWriter.
+type decryptReader struct {
+	c     *payloadCipher
+	r     io.Reader
+	buf   []byte
+	index uint64
+	last  bool
+	// err is kept so that the reader doesn't resume from the middle of a chunk
+	err error
+}
+
+func newDecryptReader(c *payloadCipher, r io.Reader) (io.Reader, error) {
+	if c == nil {
+		return nil, errors.New("the file is encrypted, set encrypt-key-file to decrypt it")
+	}
+	magic := make([]byte, len(encryptedFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptedFileMagic {
+		return nil, errors.New("the file is not encrypted by pitr")
+	}
+	return &decryptReader{c: c, r: r}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		data, err := r.readChunk()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.index++
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decryptReader) readChunk() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r.r, length[:]); err != nil {
+		return nil, errors.Annotate(err, "the encrypted file is truncated")
+	}
+	sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return nil, errors.Annotate(err, "the encrypted file is truncated")
+	}
+	// the chunk is the last one if it's only authenticated with the last flag
+	data, err := r.c.open(sealed, chunkAD(r.index, false))
+	if err != nil {
+		if data, err = r.c.open(sealed, chunkAD(r.index, true)); err != nil {
+			return nil, errors.Trace(err)
+		}
+		r.last = true
+	}
+	return data, nil
+}
@@ -0,0 +1,119 @@
+package pitr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+const testEncryptKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestLoadEncryptKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "key")
+	assert.NilError(t, ioutil.WriteFile(file, []byte(testEncryptKey+"\n"), 0600))
+	_, err = loadEncryptKey(file)
+	assert.NilError(t, err)
+
+	assert.NilError(t, ioutil.WriteFile(file, []byte("0102"), 0600))
+	_, err = loadEncryptKey(file)
+	assert.ErrorContains(t, err, "should be 16, 24 or 32 bytes")
+}
+
+func TestEncryptBinlogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	cipher, err := loadEncryptKeyString(testEncryptKey)
+	assert.NilError(t, err)
+	opts := runOptions{cipher: cipher}
+	w, err := newBinlogWriter(opts, outputFormatPB, dir, compressNone, 0)
+	assert.NilError(t, err)
+	writeTestDDLs(t, w, 3)
+
+	files, err := searchFiles(dir)
+	assert.NilError(t, err)
+	data, err := ioutil.ReadFile(files[0])
+	assert.NilError(t, err)
+	assert.Assert(t, !bytes.Contains(data, []byte("create table")))
+
+	var ddls []string
+	assert.NilError(t, scanBinlogFile(files[0], opts, func(binlog *pb.Binlog) error {
+		ddls = append(ddls, string(binlog.DdlQuery))
+		return nil
+	}))
+	assert.Equal(t, len(ddls), 3)
+	assert.Equal(t, ddls[0], "create table if not exists test.t1 (id int)")
+
+	err = scanBinlogFile(files[0], runOptions{}, func(*pb.Binlog) error { return nil })
+	assert.ErrorContains(t, err, "set encrypt-key-file")
+}
+
+func TestEncryptSQLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	cipher, err := loadEncryptKeyString(testEncryptKey)
+	assert.NilError(t, err)
+	w, err := newBinlogWriter(runOptions{cipher: cipher}, outputFormatSQL, filepath.Join(dir, "test_t1"), compressNone, 0)
+	assert.NilError(t, err)
+	// write more than one chunk
+	n := encryptChunkSize/45 + 10
+	writeTestDDLs(t, w, n)
+
+	name := filepath.Join(dir, "test_t1.sql.enc")
+	readAll := func() (string, error) {
+		f, err := os.Open(name)
+		assert.NilError(t, err)
+		r, err := newDecompressReader(name, f, cipher)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+	data, err := readAll()
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(data, "create table"), n)
+
+	// the truncated file can't be read
+	info, err := os.Stat(name)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Truncate(name, info.Size()-100))
+	_, err = readAll()
+	assert.ErrorContains(t, err, "the encrypted file is truncated")
+
+	// the file encrypted by another key
+	other, err := loadEncryptKeyString(strings.Repeat("ff", 32))
+	assert.NilError(t, err)
+	w, err = newBinlogWriter(runOptions{cipher: other}, outputFormatSQL, filepath.Join(dir, "test_t1"), compressNone, 0)
+	assert.NilError(t, err)
+	writeTestDDLs(t, w, 1)
+	_, err = readAll()
+	assert.ErrorContains(t, err, "decrypt failed")
+}
+
+func loadEncryptKeyString(key string) (*payloadCipher, error) {
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(file, []byte(key), 0600); err != nil {
+		return nil, err
+	}
+	return loadEncryptKey(file)
+}
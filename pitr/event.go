@@ -2,9 +2,11 @@ package pitr
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/pingcap/log"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/util/codec"
 	"go.uber.org/zap"
 )
 
@@ -30,6 +32,26 @@ func (e *Event) String() string {
 	return fmt.Sprintf("{schema: %s, table: %s, eventType: %s, oldKey: %s, newKey: %s, isDeleted: %v}", e.schema, e.table, e.eventType, e.oldKey, e.newKey, e.isDeleted)
 }
 
+// toPb returns the pb event of the merged row.
+func (e *Event) toPb() (pb.Event, error) {
+	r := make([][]byte, 0, len(e.cols))
+	for _, c := range e.cols {
+		data, err := c.Marshal()
+		if err != nil {
+			return pb.Event{}, err
+		}
+		r = append(r, data)
+	}
+
+	log.Debug("generate new event", zap.String("event", fmt.Sprintf("%v", e)))
+	return pb.Event{
+		SchemaName: &e.schema,
+		TableName:  &e.table,
+		Tp:         e.eventType,
+		Row:        r,
+	}, nil
+}
+
 // Merge two event with same oldKey
 // insert + delete = nil, this event should be ignore
 // insert + update = insert, and need update oldKey
@@ -76,18 +98,38 @@ func (e *Event) Merge(newEvent *Event) {
 
 func (e *Event) oldToNew(newEvent *Event) {
 	for i, col := range newEvent.cols {
-		e.cols[i].Value = col.ChangedValue
+		e.column(i, col, nullValue).Value = col.ChangedValue
 	}
 }
 
 func (e *Event) newToNew(newEvent *Event) {
 	for i, col := range newEvent.cols {
-		e.cols[i].ChangedValue = col.ChangedValue
+		e.column(i, col, col.Value).ChangedValue = col.ChangedValue
 	}
 }
 
 func (e *Event) newToOld(newEvent *Event) {
 	for i, col := range newEvent.cols {
-		e.cols[i].ChangedValue = col.Value
+		e.column(i, col, nullValue).ChangedValue = col.Value
+	}
+}
+
+// nullValue is the encoded NULL, it's the value of the columns unknown in the before image
+var nullValue = []byte{codec.NilFlag}
+
+// column returns the column of e with the same name as col which is the ith column of another event,
+// the columns are merged by name because e may be merged before a DDL adding columns. If the column is
+// added after e, it's appended with value.
+func (e *Event) column(i int, col *pb.Column, value []byte) *pb.Column {
+	if i < len(e.cols) && e.cols[i].Name == col.Name {
+		return e.cols[i]
+	}
+	for _, c := range e.cols {
+		if strings.EqualFold(c.Name, col.Name) {
+			return c
+		}
 	}
+	c := &pb.Column{Name: col.Name, Tp: col.Tp, MysqlType: col.MysqlType, Value: value}
+	e.cols = append(e.cols, c)
+	return c
 }
@@ -0,0 +1,85 @@
+package pitr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMaxEventSize is the default max size of a binlog, the same as the default max message size of drainer's kafka
+	defaultMaxEventSize = "1GiB"
+
+	// onOversizedAbort and onOversizedSkip are the values of on-oversized-event
+	onOversizedAbort = "abort"
+	onOversizedSkip  = "skip"
+
+	// binlogHeaderSize is the size of the magic number and the payload size before the payload of a record
+	binlogHeaderSize = 12
+)
+
+var (
+	errOversizedEvent = errors.New("binlog exceeds max-event-size")
+
+	// binlogMagic is the magic number at the beginning of every record in binlog files
+	binlogMagic = func() []byte {
+		var buf bytes.Buffer
+		if _, err := binlogfile.NewEncoder(&buf, 0).Encode(nil); err != nil {
+			panic(err)
+		}
+		return buf.Bytes()[:4]
+	}()
+)
+
+// decodePayload reads a record of binlog file like binlogfile.Decode, but the size of the payload is checked
+// against maxEventSize before reading it, so a huge binlog doesn't exhaust the memory. The oversized payload
+// is discarded and errOversizedEvent is returned with the length of the record, so the next record can be read.
+func decodePayload(r io.Reader, maxEventSize int64) ([]byte, int64, error) {
+	header := make([]byte, binlogHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == nil && bytes.Equal(header[:4], binlogMagic) {
+		size := int64(binary.LittleEndian.Uint64(header[4:]))
+		if maxEventSize > 0 && size > maxEventSize {
+			// the payload is followed by its crc
+			if _, err := io.CopyN(ioutil.Discard, r, size+4); err != nil {
+				return nil, 0, errors.Annotatef(err, "read the binlog of %s", formatSize(size))
+			}
+			return nil, binlogHeaderSize + size + 4, errors.Annotatef(errOversizedEvent, "the binlog is %s, max-event-size is %s",
+				formatSize(size), formatSize(maxEventSize))
+		}
+	}
+	// the errors of the broken header are returned by binlogfile
+	payload, length, err := binlogfile.Decode(io.MultiReader(bytes.NewReader(header[:n]), r))
+	return payload, length, errors.Trace(err)
+}
+
+// writeOversized writes the binlog whose payload of size bytes exceeds max-event-size, the events of a DML
+// binlog are split to several binlogs with the same commit ts, a single row or DDL which is still too
+// large is skipped or fails the run by on-oversized-event.
+func (w *pbWriter) writeOversized(binlog *pb.Binlog, size int) error {
+	if events := binlog.GetDmlData().GetEvents(); len(events) > 1 {
+		half := len(events) / 2
+		for _, part := range [][]pb.Event{events[:half], events[half:]} {
+			split := *binlog
+			split.DmlData = &pb.DMLData{Events: part}
+			if err := w.Write(&split); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+
+	if !w.opts.skipOversizedEvents {
+		return errors.Annotatef(errOversizedEvent, "the binlog at commit ts %d is %s, max-event-size is %s",
+			binlog.CommitTs, formatSize(int64(size)), formatSize(w.opts.maxEventSize))
+	}
+	w.opts.sampler.warn("skip the oversized binlog", zap.Int64("commit ts", binlog.CommitTs),
+		zap.String("type", binlog.Tp.String()), zap.String("size", formatSize(int64(size))))
+	return nil
+}
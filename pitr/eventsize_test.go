@@ -0,0 +1,108 @@
+package pitr
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestDecodeOversizedEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventsize")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newPBWriter(runOptions{}, dir, compressNone, 0)
+	assert.NilError(t, err)
+	for ts, query := range []string{"create table test.t1 (id int)", "create table test.t2 (b blob) comment '" + strings.Repeat("x", 4096) + "'", "create table test.t3 (id int)"} {
+		assert.NilError(t, w.Write(genTestDDL("test", "t", query, int64(ts+1))))
+	}
+	assert.NilError(t, w.Close())
+
+	readAll := func(opts runOptions) ([]int64, int64, error) {
+		f, err := os.Open(filepath.Join(dir, binlogName(0)))
+		assert.NilError(t, err)
+		defer f.Close()
+		r := bufio.NewReader(f)
+		var commitTS []int64
+		var offset int64
+		for {
+			binlog, n, err := decodeBinlog(r, opts)
+			if errors.Cause(err) == io.EOF {
+				return commitTS, offset, nil
+			}
+			if err != nil {
+				return commitTS, offset, err
+			}
+			commitTS = append(commitTS, binlog.CommitTs)
+			offset += n
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, binlogName(0)))
+	assert.NilError(t, err)
+
+	opts := runOptions{maxEventSize: 1024}
+	commitTS, _, err := readAll(opts)
+	assert.ErrorContains(t, err, "exceeds max-event-size")
+	assert.DeepEqual(t, commitTS, []int64{1})
+
+	// the offset includes the skipped binlog
+	opts.skipOversizedEvents = true
+	commitTS, offset, err := readAll(opts)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, commitTS, []int64{1, 3})
+	assert.Equal(t, offset, info.Size())
+
+	// the broken header is reported by binlogfile
+	_, _, err = decodeBinlog(strings.NewReader(strings.Repeat("\xff", binlogHeaderSize+8)), opts)
+	assert.Assert(t, err != nil && errors.Cause(err) != errOversizedEvent, "%v", err)
+}
+
+func TestWriteOversizedEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventsize")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	binlog := newDMLBinlog(10)
+	for id := int64(1); id <= 8; id++ {
+		ev, err := genSpillEvent(t, pb.EventType_Insert, id, id, id, 0).toPb()
+		assert.NilError(t, err)
+		binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+	}
+	data, err := binlog.Marshal()
+	assert.NilError(t, err)
+
+	// the rows are split to the binlogs not larger than max-event-size
+	w, err := newPBWriter(runOptions{maxEventSize: int64(len(data)) / 3}, dir, compressNone, 0)
+	assert.NilError(t, err)
+	assert.NilError(t, w.Write(binlog))
+	assert.ErrorContains(t, w.Write(genTestDDL("test", "t1", "create table test.t1 (id int) comment '"+strings.Repeat("x", len(data))+"'", 11)), "exceeds max-event-size")
+	w.opts.skipOversizedEvents = true
+	assert.NilError(t, w.Write(genTestDDL("test", "t1", "create table test.t1 (id int) comment '"+strings.Repeat("x", len(data))+"'", 12)))
+	assert.NilError(t, w.Close())
+
+	f, err := os.Open(filepath.Join(dir, binlogName(0)))
+	assert.NilError(t, err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var binlogs, events int
+	for {
+		binlog, _, err := Decode(r)
+		if errors.Cause(err) == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, binlog.CommitTs, int64(10))
+		binlogs++
+		events += len(binlog.DmlData.Events)
+	}
+	assert.Equal(t, binlogs, 4)
+	assert.Equal(t, events, 8)
+}
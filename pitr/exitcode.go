@@ -0,0 +1,146 @@
+package pitr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pingcap/errors"
+)
+
+// ErrorClass is the type of a failure, every class has its exit code, so the orchestration scripts can branch on
+// the failure without grepping the logs.
+type ErrorClass string
+
+const (
+	// ErrorClassUnknown is the failures not classified
+	ErrorClassUnknown ErrorClass = "unknown"
+	// ErrorClassConfig is the invalid flags and config file, the exit code is 2 like the flag errors
+	ErrorClassConfig ErrorClass = "config"
+	// ErrorClassMissingFiles is the binlog files not found in the dirs or in the range of start-tso and stop-tso
+	ErrorClassMissingFiles ErrorClass = "missing-files"
+	// ErrorClassTSOGap is the binlogs lost between the files, or between the backup and the binlogs
+	ErrorClassTSOGap ErrorClass = "tso-gap"
+	// ErrorClassDDL is the history DDLs and the DDLs in the binlogs which fail to execute
+	ErrorClassDDL ErrorClass = "ddl"
+	// ErrorClassDiskFull is the disk space not enough for the temp files and output
+	ErrorClassDiskFull ErrorClass = "disk-full"
+	// ErrorClassDownstream is the failures of dest-db, dest-kafka, dest-grpc-addr and output-storage
+	ErrorClassDownstream ErrorClass = "downstream"
+	// ErrorClassCanceled is the run canceled by a signal, it can be continued by --resume
+	ErrorClassCanceled ErrorClass = "canceled"
+
+	// errorFormatText only logs the error, errorFormatJSON also prints it as a JSON object to stderr
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+var errorClassExitCodes = map[ErrorClass]int{
+	ErrorClassUnknown:      1,
+	ErrorClassConfig:       2,
+	ErrorClassMissingFiles: 3,
+	ErrorClassTSOGap:       4,
+	ErrorClassDDL:          5,
+	ErrorClassDiskFull:     6,
+	ErrorClassDownstream:   7,
+	ErrorClassCanceled:     8,
+}
+
+// ExitCode returns the exit code of the class.
+func (c ErrorClass) ExitCode() int {
+	if code, ok := errorClassExitCodes[c]; ok {
+		return code
+	}
+	return errorClassExitCodes[ErrorClassUnknown]
+}
+
+// classifiedError tags err with its class, the cause of it is still the cause of err.
+type classifiedError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the cause of err, so errors.Cause skips the tag.
+func (e *classifiedError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// withErrorClass tags err with class, nil is returned if err is nil.
+func withErrorClass(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// ClassifyError returns the class of err. A canceled context and a full disk are recognized by the cause,
+// otherwise the innermost tag is the most specific one, e.g. a gap found while searching the files is a tso-gap.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	cause := errors.Cause(err)
+	if cause == context.Canceled {
+		return ErrorClassCanceled
+	}
+	if isDiskFull(cause) {
+		return ErrorClassDiskFull
+	}
+	class := ErrorClassUnknown
+	for err != nil {
+		if e, ok := err.(*classifiedError); ok {
+			class = e.class
+			err = e.err
+			continue
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return class
+}
+
+// isDiskFull returns true if the write failed for no space left on the device.
+func isDiskFull(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	for _, errno := range diskFullErrnos {
+		if err == errno {
+			return true
+		}
+	}
+	return false
+}
+
+// errorOutput is the machine-readable error printed by error-format json.
+type errorOutput struct {
+	ExitCode int        `json:"exit-code"`
+	Class    ErrorClass `json:"class"`
+	Error    string     `json:"error"`
+}
+
+// WriteError prints runErr with its class and exit code to w as a JSON object in one line if format is json,
+// nothing is printed in text format, the error is only logged.
+func WriteError(w io.Writer, format string, class ErrorClass, runErr error) error {
+	if format != errorFormatJSON {
+		return nil
+	}
+	data, err := json.Marshal(&errorOutput{ExitCode: class.ExitCode(), Class: class, Error: runErr.Error()})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errors.Trace(err)
+}
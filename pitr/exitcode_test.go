@@ -0,0 +1,52 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"gotest.tools/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	errGap := errors.New("binlog file 2 is missing")
+	for _, c := range []struct {
+		err   error
+		class ErrorClass
+		code  int
+	}{
+		{errors.New("unknown"), ErrorClassUnknown, 1},
+		{withErrorClass(ErrorClassConfig, errors.New("unknown log-format")), ErrorClassConfig, 2},
+		// the innermost class wins
+		{withErrorClass(ErrorClassMissingFiles, errors.Annotate(withErrorClass(ErrorClassTSOGap, errGap), "search binlog files failed")), ErrorClassTSOGap, 4},
+		{errors.Annotate(withErrorClass(ErrorClassDDL, errors.New("table exists")), "load history ddls"), ErrorClassDDL, 5},
+		{withErrorClass(ErrorClassDownstream, errors.Trace(&os.PathError{Op: "write", Path: "t.sql", Err: diskFullErrnos[0]})), ErrorClassDiskFull, 6},
+		{withErrorClass(ErrorClassDownstream, errors.New("connection refused")), ErrorClassDownstream, 7},
+		{withErrorClass(ErrorClassDDL, errors.Trace(context.Canceled)), ErrorClassCanceled, 8},
+	} {
+		class := ClassifyError(c.err)
+		assert.Equal(t, class, c.class, c.err.Error())
+		assert.Equal(t, class.ExitCode(), c.code, c.err.Error())
+	}
+	assert.Equal(t, ClassifyError(nil), ErrorClass(""))
+
+	// the tag doesn't change the message and the cause
+	err := errors.Annotate(withErrorClass(ErrorClassTSOGap, errGap), "check files in data")
+	assert.Equal(t, err.Error(), "check files in data: binlog file 2 is missing")
+	assert.Equal(t, errors.Cause(err), errGap)
+
+	_, _, err = searchSources([]string{"/nonexistent/pitr"}, 0, 0, onGapAbort, runOptions{})
+	assert.Equal(t, ClassifyError(err), ErrorClassMissingFiles, err.Error())
+	assert.Equal(t, ClassifyError(checkFilesOverlap(nil, 0, 0, runOptions{})), ErrorClassMissingFiles)
+
+	var out bytes.Buffer
+	assert.NilError(t, WriteError(&out, errorFormatText, ErrorClassDDL, err))
+	assert.Equal(t, out.Len(), 0)
+	assert.NilError(t, WriteError(&out, errorFormatJSON, ErrorClassTSOGap, errGap))
+	var output errorOutput
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &output))
+	assert.DeepEqual(t, output, errorOutput{ExitCode: 4, Class: ErrorClassTSOGap, Error: "binlog file 2 is missing"})
+}
@@ -2,36 +2,83 @@ package pitr
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"os"
-	"path"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	bf "github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
 	"go.uber.org/zap"
 )
 
-// searchFiles return matched file with full path
+// searchFiles return matched file with full path, dir can be a local directory or a storage uri
 func searchFiles(dir string) ([]string, error) {
+	s, err := NewStorage(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	// read all file names
-	sortedNames, err := bf.ReadBinlogNames(dir)
+	sortedNames, err := s.ReadBinlogNames()
 	if err != nil {
 		return nil, errors.Annotatef(err, "read binlog file name error")
 	}
 
 	binlogFiles := make([]string, 0, len(sortedNames))
 	for _, name := range sortedNames {
-		fullpath := path.Join(dir, name)
+		fullpath := s.FullPath(name)
 		binlogFiles = append(binlogFiles, fullpath)
 	}
 
 	return binlogFiles, nil
 }
 
+// searchSources searches and filters the binlog files in every dir, the dirs have no binlog in [startTS, endTS]
+// are ignored if there are more than one dir. The missing files between the filtered files of every dir are
+// handled by onGap. It returns the files of every dir and the size of all files.
+func searchSources(dirs []string, startTS int64, endTS int64, onGap string, opts runOptions) ([][]string, int64, error) {
+	var (
+		sources  [][]string
+		allSize  int64
+		firstErr error
+	)
+	for _, dir := range dirs {
+		files, err := searchFiles(dir)
+		if err != nil {
+			return nil, 0, withErrorClass(ErrorClassMissingFiles, errors.Annotatef(err, "search files in %s", redactStorageURI(dir)))
+		}
+		files, fileSize, err := filterFiles(files, startTS, endTS, opts)
+		if err != nil {
+			return nil, 0, errors.Annotatef(err, "filter files in %s", redactStorageURI(dir))
+		}
+		if err := checkFileGaps(files, onGap, opts); err != nil {
+			return nil, 0, errors.Annotatef(err, "check files in %s", redactStorageURI(dir))
+		}
+		if err := checkFilesOverlap(files, startTS, endTS, opts); err != nil {
+			if len(dirs) == 1 {
+				return nil, 0, errors.Trace(err)
+			}
+			log.Warn("ignore the dir", zap.String("dir", redactStorageURI(dir)), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		sources = append(sources, files)
+		allSize += fileSize
+	}
+	if len(sources) == 0 {
+		return nil, 0, errors.Annotate(firstErr, "no dir has binlogs in the range")
+	}
+	return sources, allSize, nil
+}
+
 // filterFiles assume fileNames is sorted by commit time stamp,
 // and may filter files not not overlap with [startTS, endTS]
-func filterFiles(fileNames []string, startTS int64, endTS int64) ([]string, int64, error) {
+func filterFiles(fileNames []string, startTS int64, endTS int64, opts runOptions) ([]string, int64, error) {
 	binlogFiles := make([]string, 0, len(fileNames))
 	var (
 		latestBinlogFile string
@@ -48,7 +95,7 @@ func filterFiles(fileNames []string, startTS int64, endTS int64) ([]string, int6
 	}
 
 	for _, file := range fileNames {
-		ts, fileSize, err := getFirstBinlogCommitTSAndFileSize(file)
+		ts, fileSize, err := getFirstBinlogCommitTSAndFileSize(file, opts)
 		if err != nil {
 			return nil, 0, errors.Trace(err)
 		}
@@ -69,27 +116,123 @@ func filterFiles(fileNames []string, startTS int64, endTS int64) ([]string, int6
 	appendFile()
 
 	log.Info("after filter files",
-		zap.Strings("files", binlogFiles),
+		zap.Strings("files", redactStorageURIs(binlogFiles)),
 		zap.Int64("all file's size", allFileSize),
 		zap.Int64("start tso", startTS),
 		zap.Int64("stop tso", endTS))
 	return binlogFiles, allFileSize, nil
 }
 
-func getFirstBinlogCommitTSAndFileSize(filename string) (int64, int64, error) {
-	fd, err := os.OpenFile(filename, os.O_RDONLY, 0600)
+// checkFilesOverlap checks the range [startTS, endTS] overlaps with the binlogs in the filtered files.
+func checkFilesOverlap(files []string, startTS int64, endTS int64, opts runOptions) error {
+	if len(files) == 0 {
+		return withErrorClass(ErrorClassMissingFiles, errors.Errorf("no binlog file overlaps with the range [%s, %s]", formatTSO(startTS), formatTSO(endTS)))
+	}
+	if startTS == 0 {
+		return nil
+	}
+
+	// only the last file may contain binlogs after startTS
+	var lastTS int64
+	lastFile := files[len(files)-1]
+	if err := scanBinlogFile(lastFile, opts, func(binlog *pb.Binlog) error {
+		if binlog.CommitTs > lastTS {
+			lastTS = binlog.CommitTs
+		}
+		return nil
+	}); err != nil {
+		return errors.Trace(err)
+	}
+	if lastTS < startTS {
+		return withErrorClass(ErrorClassMissingFiles, errors.Errorf("the range [%s, %s] is after the last binlog %s in %s",
+			formatTSO(startTS), formatTSO(endTS), formatTSO(lastTS), redactStorageURI(lastFile)))
+	}
+	return nil
+}
+
+// checkFileGaps checks the indexes in the names of files are contiguous, a missing file between them means
+// the binlogs in it are lost. The gap fails the check if onGap is abort, otherwise it's only warned.
+// The files whose names have no index are not checked.
+func checkFileGaps(files []string, onGap string, opts runOptions) error {
+	var (
+		prevFile  string
+		prevIndex uint64
+	)
+	for _, file := range files {
+		_, name, err := splitStorageURI(file)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		index, _, err := bf.ParseBinlogName(name)
+		if err != nil {
+			prevFile = ""
+			continue
+		}
+		if prevFile != "" && index != prevIndex+1 {
+			if err := reportFileGap(prevFile, file, prevIndex, index, onGap, opts); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		prevFile, prevIndex = file, index
+	}
+	return nil
+}
+
+// reportFileGap reports the binlogs lost between prevFile and nextFile.
+func reportFileGap(prevFile, nextFile string, prevIndex, nextIndex uint64, onGap string, opts runOptions) error {
+	var afterTS int64
+	if err := scanBinlogFile(prevFile, opts, func(binlog *pb.Binlog) error {
+		afterTS = binlog.CommitTs
+		return nil
+	}); err != nil {
+		return errors.Trace(err)
+	}
+	beforeTS, _, err := getFirstBinlogCommitTSAndFileSize(nextFile, opts)
 	if err != nil {
-		return 0, 0, errors.Annotatef(err, "open file %s error", filename)
+		return errors.Trace(err)
 	}
-	defer fd.Close()
 
-	stat, err := fd.Stat()
+	var missing string
+	if nextIndex <= prevIndex {
+		missing = fmt.Sprintf("binlog file index %d is not after %d", nextIndex, prevIndex)
+	} else if nextIndex == prevIndex+2 {
+		missing = fmt.Sprintf("binlog file %d is missing", prevIndex+1)
+	} else {
+		missing = fmt.Sprintf("binlog files %d-%d are missing", prevIndex+1, nextIndex-1)
+	}
+	if onGap == onGapAbort {
+		return withErrorClass(ErrorClassTSOGap, errors.Errorf("%s between %s and %s, the binlogs between commit ts %s and %s may be lost, set on-file-gap to %s to ignore it",
+			missing, redactStorageURI(prevFile), redactStorageURI(nextFile), formatTSO(afterTS), formatTSO(beforeTS), onGapWarn))
+	}
+	log.Warn("binlog files are missing, the binlogs in the gap may be lost",
+		zap.String("gap", missing),
+		zap.String("previous file", redactStorageURI(prevFile)),
+		zap.String("next file", redactStorageURI(nextFile)),
+		zap.String("after commit ts", formatTSO(afterTS)),
+		zap.String("before commit ts", formatTSO(beforeTS)))
+	return nil
+}
+
+// formatTSO formats the tso with its physical time, 0 means unlimited.
+func formatTSO(ts int64) string {
+	if ts == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d(%s)", ts, oracle.GetTimeFromTS(uint64(ts)).Format(timeFormat))
+}
+
+func getFirstBinlogCommitTSAndFileSize(filename string, opts runOptions) (int64, int64, error) {
+	_, binlogFileName, err := splitStorageURI(filename)
 	if err != nil {
-		return 0, 0, errors.Annotatef(err, "get file stat %s error", filename)
+		return 0, 0, errors.Trace(err)
+	}
+
+	fd, fileSize, err := openBinlogFile(filename, opts.cipher)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
 	}
-	fileSize := stat.Size()
+	defer fd.Close()
 
-	_, binlogFileName := path.Split(filename)
 	_, ts, err := bf.ParseBinlogName(binlogFileName)
 	if err != nil {
 		return 0, 0, errors.Trace(err)
@@ -100,9 +243,9 @@ func getFirstBinlogCommitTSAndFileSize(filename string) (int64, int64, error) {
 
 	// get the first binlog in file
 	br := bufio.NewReader(fd)
-	binlog, _, err := Decode(br)
+	binlog, _, err := decodeBinlog(br, opts)
 	if errors.Cause(err) == io.EOF {
-		log.Warn("no binlog find in file", zap.String("filename", filename))
+		opts.sampler.warn("no binlog find in file", zap.String("filename", filename))
 		return 0, 0, nil
 	}
 	if err != nil {
@@ -0,0 +1,82 @@
+package pitr
+
+import (
+	"os"
+
+	"github.com/pingcap/check"
+)
+
+type testFileSuite struct{}
+
+var _ = check.Suite(&testFileSuite{})
+
+func (s *testFileSuite) TestCheckFilesOverlap(c *check.C) {
+	dir := c.MkDir()
+	// the commit ts of binlogs are 1 to 55
+	writeBinlogsInDir(dir, c)
+
+	allFiles, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+
+	files, _, err := filterFiles(allFiles, 10, 20, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFilesOverlap(files, 10, 20, runOptions{}), check.IsNil)
+
+	files, _, err = filterFiles(allFiles, 0, 0, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFilesOverlap(files, 0, 0, runOptions{}), check.IsNil)
+
+	files, _, err = filterFiles(allFiles, 55, 0, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFilesOverlap(files, 55, 0, runOptions{}), check.IsNil)
+
+	files, _, err = filterFiles(allFiles, 56, 100, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFilesOverlap(files, 56, 100, runOptions{}), check.ErrorMatches, ".*is after the last binlog.*")
+
+	c.Assert(checkFilesOverlap(nil, 56, 100, runOptions{}), check.ErrorMatches, "no binlog file overlaps.*")
+}
+
+func (s *testFileSuite) TestSearchSources(c *check.C) {
+	dir1 := c.MkDir()
+	dir2 := c.MkDir()
+	// the commit ts of binlogs are 1 to 55 in both dirs
+	writeBinlogsInDir(dir1, c)
+	writeBinlogsInDir(dir2, c)
+
+	sources, fileSize, err := searchSources([]string{dir1, dir2}, 0, 0, onGapAbort, runOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(sources, check.HasLen, 2)
+	c.Assert(sources[0], check.HasLen, 10)
+	c.Assert(fileSize > 0, check.IsTrue)
+
+	_, _, err = searchSources([]string{dir1, dir2}, 56, 0, onGapAbort, runOptions{})
+	c.Assert(err, check.ErrorMatches, "no dir has binlogs in the range.*")
+
+	_, _, err = searchSources([]string{dir1}, 56, 0, onGapAbort, runOptions{})
+	c.Assert(err, check.ErrorMatches, ".*is after the last binlog.*")
+}
+
+func (s *testFileSuite) TestCheckFileGaps(c *check.C) {
+	dir := c.MkDir()
+	writeBinlogsInDir(dir, c)
+
+	files, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFileGaps(files, onGapAbort, runOptions{}), check.IsNil)
+
+	// the 4th file with commit ts 7-10 and the 5th file with commit ts 11-15 are missing
+	c.Assert(os.Remove(files[3]), check.IsNil)
+	c.Assert(os.Remove(files[4]), check.IsNil)
+	files, err = searchFiles(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(checkFileGaps(files, onGapAbort, runOptions{}), check.ErrorMatches,
+		"binlog files 3-4 are missing between .*, the binlogs between commit ts 6\\(.*\\) and 16\\(.*\\) may be lost.*")
+	c.Assert(checkFileGaps(files, onGapWarn, runOptions{}), check.IsNil)
+
+	_, _, err = searchSources([]string{dir}, 0, 0, onGapAbort, runOptions{})
+	c.Assert(err, check.ErrorMatches, "check files in .*: binlog files 3-4 are missing.*")
+	// the gap is not checked if it's not in the range
+	_, _, err = searchSources([]string{dir}, 16, 0, onGapAbort, runOptions{})
+	c.Assert(err, check.IsNil)
+}
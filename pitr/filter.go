@@ -0,0 +1,116 @@
+package pitr
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"go.uber.org/zap"
+)
+
+// tableFilter filters binlogs and history DDL jobs by the table rules in config.
+type tableFilter struct {
+	*filter.Filter
+
+	// schemaFilter is used for the DDLs which don't belong to any table, like CREATE DATABASE,
+	// a schema passes it if any table in the schema may pass Filter.
+	schemaFilter *filter.Filter
+	// sampler samples the warnings of the history DDL jobs can't be parsed, nil prints all of them
+	sampler *sampledLogger
+}
+
+func newTableFilter(cfg *Config) *tableFilter {
+	doDBs := append([]string(nil), cfg.DoDBs...)
+	if len(doDBs) != 0 || len(cfg.DoTables) != 0 {
+		for _, tb := range cfg.DoTables {
+			doDBs = append(doDBs, tb.Schema)
+		}
+	}
+
+	return &tableFilter{
+		Filter:       filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables),
+		schemaFilter: filter.NewFilter(cfg.IgnoreDBs, nil, doDBs, nil),
+	}
+}
+
+// skip returns true if the events of the table should be skipped, table is empty for schema level DDL.
+// a nil tableFilter skips nothing.
+func (f *tableFilter) skip(schema, table string) bool {
+	if f == nil {
+		return false
+	}
+	if len(table) == 0 {
+		return f.schemaFilter.SkipSchemaAndTable(schema, table)
+	}
+	return f.SkipSchemaAndTable(schema, table)
+}
+
+// skipJob returns true if the history DDL job doesn't belong to the selected tables.
+// the job is kept if its schema can't be decided.
+func (f *tableFilter) skipJob(job *model.Job) bool {
+	if f == nil {
+		return false
+	}
+
+	schema, table, err := parserSchemaTableFromDDL(job.Query)
+	if err != nil {
+		f.sampler.warn("parse history ddl failed, keep it", zap.String("ddl", job.Query), zap.Error(err))
+		return false
+	}
+	if len(schema) == 0 && job.BinlogInfo != nil && job.BinlogInfo.DBInfo != nil {
+		schema = job.BinlogInfo.DBInfo.Name.O
+	}
+	if len(schema) == 0 {
+		return false
+	}
+	return f.skip(schema, table)
+}
+
+// parseTables parses the table list like `db1.t1,db2.*`, `db.*` selects all the tables in db,
+// and `*` and `?` in table name are used as wildcard.
+func parseTables(tables string) (doDBs []string, doTables []filter.TableName, err error) {
+	for _, item := range strings.Split(tables, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		names := strings.SplitN(item, ".", 2)
+		if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 {
+			return nil, nil, errors.Errorf("invalid table %s in tables, should be like db.table or db.*", item)
+		}
+		schema := strings.ToLower(names[0])
+		table := strings.ToLower(names[1])
+
+		if table == "*" {
+			doDBs = append(doDBs, schema)
+			continue
+		}
+		if strings.ContainsAny(table, "*?") {
+			table = wildcardToRegex(table)
+		}
+		doTables = append(doTables, filter.TableName{Schema: schema, Table: table})
+	}
+	return doDBs, doTables, nil
+}
+
+// wildcardToRegex converts the wildcard pattern to the regex pattern used by filter.
+func wildcardToRegex(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("~^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
@@ -0,0 +1,60 @@
+package pitr
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"gotest.tools/assert"
+)
+
+func TestParseTables(t *testing.T) {
+	doDBs, doTables, err := parseTables("db1.t1, DB2.*,db3.t_?x*,")
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, doDBs, []string{"db2"})
+	assert.DeepEqual(t, doTables, []filter.TableName{
+		{Schema: "db1", Table: "t1"},
+		{Schema: "db3", Table: "~^t_.x.*$"},
+	})
+
+	for _, tables := range []string{"db1", "db1.", ".t1"} {
+		_, _, err = parseTables(tables)
+		assert.Assert(t, err != nil, tables)
+	}
+}
+
+func TestTableFilter(t *testing.T) {
+	doDBs, doTables, err := parseTables("db1.t1,db2.*,db3.t_*")
+	assert.Assert(t, err == nil)
+	f := newTableFilter(&Config{DoDBs: doDBs, DoTables: doTables})
+
+	assert.Assert(t, !f.skip("db1", "t1"))
+	assert.Assert(t, f.skip("db1", "t2"))
+	assert.Assert(t, !f.skip("db2", "any"))
+	assert.Assert(t, !f.skip("db3", "t_abc"))
+	assert.Assert(t, f.skip("db3", "abc"))
+	assert.Assert(t, f.skip("db4", "t1"))
+
+	// schema level ddl
+	assert.Assert(t, !f.skip("db1", ""))
+	assert.Assert(t, !f.skip("db3", ""))
+	assert.Assert(t, f.skip("db4", ""))
+
+	job := &model.Job{Query: "create table db1.t2 (a int)"}
+	assert.Assert(t, f.skipJob(job))
+	job.Query = "create table db1.t1 (a int)"
+	assert.Assert(t, !f.skipJob(job))
+	job.Query = "create database db4"
+	assert.Assert(t, f.skipJob(job))
+	// can't decide the schema
+	job.Query = "create table t2 (a int)"
+	assert.Assert(t, !f.skipJob(job))
+
+	// no rules, skip nothing
+	f = newTableFilter(&Config{})
+	assert.Assert(t, !f.skip("db4", "t1"))
+	assert.Assert(t, !f.skip("db4", ""))
+
+	var nilFilter *tableFilter
+	assert.Assert(t, !nilFilter.skip("db4", "t1"))
+}
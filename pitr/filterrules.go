@@ -0,0 +1,295 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"github.com/pingcap/tidb-binlog/pkg/util"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// filterRules is the table rules in filter-rules-file, they are added to the rules in config.
+type filterRules struct {
+	Tables       string             `toml:"tables"`
+	DoDBs        []string           `toml:"replicate-do-db"`
+	DoTables     []filter.TableName `toml:"replicate-do-table"`
+	IgnoreDBs    []string           `toml:"replicate-ignore-db"`
+	IgnoreTables []filter.TableName `toml:"replicate-ignore-table"`
+}
+
+// loadFilterRules reads the rules file, it fails if the file has unknown options.
+func loadFilterRules(file string) (*filterRules, error) {
+	rules := &filterRules{}
+	if err := util.StrictDecodeFile(file, toolName, rules); err != nil {
+		return nil, errors.Annotatef(err, "load filter rules file %s", file)
+	}
+	return rules, nil
+}
+
+// addFilterRules adds the rules in filter-rules-file to the config.
+func (c *Config) addFilterRules() error {
+	rules, err := loadFilterRules(c.FilterRulesFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	doDBs, doTables, err := parseTables(rules.Tables)
+	if err != nil {
+		return errors.Annotatef(err, "filter rules file %s", c.FilterRulesFile)
+	}
+	c.DoDBs = append(append(c.DoDBs, rules.DoDBs...), doDBs...)
+	c.DoTables = append(append(c.DoTables, rules.DoTables...), doTables...)
+	c.IgnoreDBs = append(c.IgnoreDBs, rules.IgnoreDBs...)
+	c.IgnoreTables = append(c.IgnoreTables, rules.IgnoreTables...)
+	return nil
+}
+
+// hasTableRules returns true if any table rule is set.
+func (c *Config) hasTableRules() bool {
+	return len(c.DoDBs) != 0 || len(c.DoTables) != 0 || len(c.IgnoreDBs) != 0 || len(c.IgnoreTables) != 0
+}
+
+// ruleMatch is the tables matched by one table rule.
+type ruleMatch struct {
+	rule string
+	// do is true for the replicate-do rules, a table must match one of them to be selected
+	do     bool
+	tables []string
+}
+
+// matchTableRules returns the tables matched by every rule in config, and the tables selected by all the rules.
+func matchTableRules(cfg *Config, tables []schemaTable) ([]ruleMatch, []string) {
+	type rule struct {
+		ruleMatch
+		filter *filter.Filter
+	}
+	var rules []*rule
+	for _, db := range cfg.DoDBs {
+		rules = append(rules, &rule{ruleMatch{rule: "replicate-do-db " + db, do: true}, filter.NewFilter(nil, nil, []string{db}, nil)})
+	}
+	for _, tb := range cfg.DoTables {
+		rules = append(rules, &rule{ruleMatch{rule: fmt.Sprintf("replicate-do-table %s.%s", tb.Schema, tb.Table), do: true},
+			filter.NewFilter(nil, nil, nil, []filter.TableName{tb})})
+	}
+	for _, db := range cfg.IgnoreDBs {
+		rules = append(rules, &rule{ruleMatch{rule: "replicate-ignore-db " + db}, filter.NewFilter([]string{db}, nil, nil, nil)})
+	}
+	for _, tb := range cfg.IgnoreTables {
+		rules = append(rules, &rule{ruleMatch{rule: fmt.Sprintf("replicate-ignore-table %s.%s", tb.Schema, tb.Table)},
+			filter.NewFilter(nil, []filter.TableName{tb}, nil, nil)})
+	}
+
+	all := newTableFilter(cfg)
+	var selected []string
+	for _, table := range tables {
+		name := quoteSchema(table.schema, table.table)
+		for _, r := range rules {
+			// a table matches a do rule if the rule doesn't skip it, and matches an ignore rule if the rule skips it
+			if r.filter.SkipSchemaAndTable(table.schema, table.table) != r.do {
+				r.tables = append(r.tables, name)
+			}
+		}
+		if !all.skip(table.schema, table.table) {
+			selected = append(selected, name)
+		}
+	}
+
+	matches := make([]ruleMatch, 0, len(rules))
+	for _, r := range rules {
+		matches = append(matches, r.ruleMatch)
+	}
+	return matches, selected
+}
+
+// printTableRules prints the tables matched by every rule, and the selected tables.
+func printTableRules(w io.Writer, matches []ruleMatch, selected []string, total int) {
+	fmt.Fprintf(w, "discovered tables: %d\n", total)
+	for _, m := range matches {
+		fmt.Fprintf(w, "%s: %d\n", m.rule, len(m.tables))
+		for _, table := range m.tables {
+			fmt.Fprintf(w, "  %s\n", table)
+		}
+	}
+	fmt.Fprintf(w, "selected tables: %d\n", len(selected))
+	for _, table := range selected {
+		fmt.Fprintf(w, "  %s\n", table)
+	}
+}
+
+// unmatchedDoRules returns the replicate-do rules which match no table, they are likely typos.
+func unmatchedDoRules(matches []ruleMatch) []string {
+	var rules []string
+	for _, m := range matches {
+		if m.do && len(m.tables) == 0 {
+			rules = append(rules, m.rule)
+		}
+	}
+	return rules
+}
+
+// isSystemSchema returns true for the schemas of TiDB itself, their tables are not discovered.
+func isSystemSchema(schema string) bool {
+	switch strings.ToLower(schema) {
+	case "mysql", "information_schema", "performance_schema", "metrics_schema":
+		return true
+	}
+	return false
+}
+
+// historyTables returns the tables existing before beginTS, they are tracked by all the history DDLs
+// or the schema file without filtering. the DDLs failed to track are ignored.
+func (r *PITR) historyTables(ctx context.Context, beginTS int64) (map[schemaTable]struct{}, error) {
+	var tracker schemaTracker
+	track := func(schema, ddl string) {
+		if err := tracker.execute(schema, ddl); err != nil {
+			log.Debug("track history ddl failed", zap.String("ddl", ddl), zap.Error(err))
+		}
+	}
+
+	sqlFile := r.cfg.SchemaFile
+	if len(sqlFile) == 0 && isSQLFile(r.cfg.HistoryDDLFile) {
+		sqlFile = r.cfg.HistoryDDLFile
+	}
+	if len(sqlFile) != 0 {
+		ddls, err := readSQLFile(sqlFile, r.opts.sampler)
+		if err != nil {
+			return nil, errors.Annotatef(err, "read %s", sqlFile)
+		}
+		var schema string
+		for _, ddl := range ddls {
+			if db, ok := parseUseStmt(ddl); ok {
+				schema = db
+				continue
+			}
+			track(schema, ddl)
+		}
+	} else if r.loadsHistoryDDLs() {
+		jobs, err := r.getHistoryDDLJobs(ctx, beginTS)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, job := range jobs {
+			if int64(job.BinlogInfo.FinishedTS) >= beginTS || skipJob(job) {
+				continue
+			}
+			var schema string
+			if job.BinlogInfo.DBInfo != nil {
+				schema = job.BinlogInfo.DBInfo.Name.O
+			}
+			track(schema, job.Query)
+		}
+	}
+
+	tables := make(map[schemaTable]struct{})
+	for _, db := range tracker.databases() {
+		if isSystemSchema(db) {
+			continue
+		}
+		names, err := tracker.tables(db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, name := range names {
+			tables[schemaTable{schema: db, table: name}] = struct{}{}
+		}
+	}
+	return tables, nil
+}
+
+// sortedTables returns the tables sorted by schema and name.
+func sortedTables(tables map[schemaTable]struct{}) []schemaTable {
+	sorted := make([]schemaTable, 0, len(tables))
+	for table := range tables {
+		sorted = append(sorted, table)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].schema != sorted[j].schema {
+			return sorted[i].schema < sorted[j].schema
+		}
+		return sorted[i].table < sorted[j].table
+	})
+	return sorted
+}
+
+// checkTableRules prints the tables matched by every rule of --check-filter, the tables are discovered
+// from the history DDLs and the binlogs in files. it fails if a replicate-do rule matches no table.
+// the rules file is read again by every check, so the rules can be fixed and checked without merging.
+func (r *PITR) checkTableRules(ctx context.Context, files []string, beginTS int64) error {
+	tables, err := r.historyTables(ctx, beginTS)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := scanSourceBinlogFile(file, r.cfg.RelaxCorruption, r.opts, func(binlog *pb.Binlog, _ int64) error {
+			if !isAcceptableBinlog(binlog, r.cfg.StartTSO, r.cfg.StopTSO) {
+				return nil
+			}
+			if binlog.Tp == pb.BinlogType_DDL {
+				schema, table, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if len(table) != 0 && !isSystemSchema(schema) {
+					tables[schemaTable{schema: schema, table: table}] = struct{}{}
+				}
+				return nil
+			}
+			for _, event := range binlog.GetDmlData().GetEvents() {
+				tables[schemaTable{schema: event.GetSchemaName(), table: event.GetTableName()}] = struct{}{}
+			}
+			return nil
+		}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	matches, selected := matchTableRules(r.cfg, sortedTables(tables))
+	printTableRules(os.Stdout, matches, selected, len(tables))
+	if rules := unmatchedDoRules(matches); len(rules) != 0 {
+		return errors.Errorf("the rules match no table: %s", strings.Join(rules, ", "))
+	}
+	if len(selected) == 0 {
+		return errors.New("the rules select no table")
+	}
+	return nil
+}
+
+// validateTableRules checks the rules against the tables of the history DDLs before merging, so a typo in
+// the rules fails the run instead of merging nothing. the tables created in the window are unknown here,
+// so the rules matching no table only cause warnings, and the run fails if no table is selected at all.
+func (r *PITR) validateTableRules(ctx context.Context, beginTS int64) error {
+	if !r.cfg.hasTableRules() {
+		return nil
+	}
+	tables, err := r.historyTables(ctx, beginTS)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+	if len(tables) == 0 {
+		log.Info("no history tables to validate the table rules")
+		return nil
+	}
+
+	matches, selected := matchTableRules(r.cfg, sortedTables(tables))
+	for _, m := range matches {
+		log.Info("table rule matches", zap.String("rule", m.rule), zap.Strings("tables", m.tables))
+	}
+	if rules := unmatchedDoRules(matches); len(rules) != 0 {
+		log.Warn("the rules match no history table, check them by --check-filter", zap.Strings("rules", rules))
+	}
+	if len(selected) == 0 {
+		return errors.Errorf("the rules select none of the %d history tables, check them by --check-filter", len(tables))
+	}
+	log.Info("tables selected by the rules", zap.Int("history tables", len(tables)), zap.Strings("tables", selected))
+	return nil
+}
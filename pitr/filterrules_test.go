@@ -0,0 +1,102 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"gotest.tools/assert"
+)
+
+func TestFilterRulesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filterrules")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rules.toml")
+	assert.NilError(t, ioutil.WriteFile(file, []byte(`
+tables = "db3.t_*"
+replicate-do-db = ["DB2"]
+replicate-ignore-db = ["db4"]
+
+[[replicate-do-table]]
+db-name = "db1"
+tbl-name = "t1"
+`), 0644))
+
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.Tables = "db5.t1"
+	cfg.FilterRulesFile = file
+	assert.NilError(t, cfg.Adjust())
+	assert.DeepEqual(t, cfg.DoDBs, []string{"db2"})
+	assert.DeepEqual(t, cfg.DoTables, []filter.TableName{
+		{Schema: "db5", Table: "t1"},
+		{Schema: "db1", Table: "t1"},
+		{Schema: "db3", Table: "~^t_.*$"},
+	})
+	assert.DeepEqual(t, cfg.IgnoreDBs, []string{"db4"})
+
+	assert.NilError(t, ioutil.WriteFile(file, []byte("replicate-do-dbs = [\"db1\"]\n"), 0644))
+	cfg = NewConfig()
+	cfg.Dir = "data"
+	cfg.FilterRulesFile = file
+	assert.ErrorContains(t, cfg.Adjust(), "load filter rules file")
+}
+
+func TestMatchTableRules(t *testing.T) {
+	cfg := &Config{
+		DoDBs:        []string{"db2"},
+		DoTables:     []filter.TableName{{Schema: "db1", Table: "~^t.*$"}, {Schema: "db1", Table: "oders"}},
+		IgnoreTables: []filter.TableName{{Schema: "db1", Table: "t2"}},
+	}
+	tables := []schemaTable{
+		{schema: "db1", table: "orders"},
+		{schema: "db1", table: "t1"},
+		{schema: "db1", table: "t2"},
+		{schema: "db2", table: "t1"},
+	}
+	matches, selected := matchTableRules(cfg, tables)
+	assert.DeepEqual(t, selected, []string{"`db1`.`t1`", "`db2`.`t1`"})
+	assert.Equal(t, len(matches), 4)
+	assert.Equal(t, matches[0].rule, "replicate-do-db db2")
+	assert.DeepEqual(t, matches[0].tables, []string{"`db2`.`t1`"})
+	assert.DeepEqual(t, matches[1].tables, []string{"`db1`.`t1`", "`db1`.`t2`"})
+	assert.Equal(t, matches[3].rule, "replicate-ignore-table db1.t2")
+	assert.DeepEqual(t, matches[3].tables, []string{"`db1`.`t2`"})
+	// the typo matches nothing
+	assert.DeepEqual(t, unmatchedDoRules(matches), []string{"replicate-do-table db1.oders"})
+
+	var buf bytes.Buffer
+	printTableRules(&buf, matches, selected, len(tables))
+	assert.Assert(t, bytes.Contains(buf.Bytes(), []byte("replicate-do-table db1.oders: 0\n")), buf.String())
+	assert.Assert(t, bytes.HasSuffix(buf.Bytes(), []byte("selected tables: 2\n  `db1`.`t1`\n  `db2`.`t1`\n")), buf.String())
+}
+
+func TestValidateTableRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filterrules")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	schemaFile := filepath.Join(dir, "schema.sql")
+	assert.NilError(t, ioutil.WriteFile(schemaFile, []byte(
+		"create database db1;\nuse db1;\ncreate table orders (id int primary key);\ncreate table mysql.user (a int);\n"), 0644))
+
+	cfg := &Config{SchemaFile: schemaFile}
+	r := &PITR{cfg: cfg}
+	// no rule to validate
+	assert.NilError(t, r.validateTableRules(context.Background(), 0))
+
+	tables, err := r.historyTables(context.Background(), 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sortedTables(tables), []schemaTable{{schema: "db1", table: "orders"}})
+
+	cfg.DoTables = []filter.TableName{{Schema: "db1", Table: "oders"}}
+	assert.ErrorContains(t, r.validateTableRules(context.Background(), 0), "select none of the 1 history tables")
+	cfg.DoTables = append(cfg.DoTables, filter.TableName{Schema: "db1", Table: "orders"})
+	assert.NilError(t, r.validateTableRules(context.Background(), 0))
+}
@@ -0,0 +1,252 @@
+package pitr
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const flashbackFileName = "flashback"
+
+// spoolBlock is the position of a transaction's statements in the spool file.
+type spoolBlock struct {
+	offset int64
+	size   int
+}
+
+// flashback reads the binlogs in [startTS, stop-tso], and writes the SQL statements which undo their
+// DML changes to flashback.sql in output dir. The transactions are undone in the descending order of
+// commit ts, and the statements of every transaction are wrapped in a transaction.
+func (r *PITR) flashback(ctx context.Context, sources [][]string, fileSize int64, startTS int64) (err error) {
+	if err = os.MkdirAll(defaultOutputDir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	ddlHandle, err = NewDDLHandle()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ddlHandle.configure(r.cfg)
+	ddlHandle.setSampler(r.opts.sampler)
+	defer ddlHandle.Close()
+
+	if err = r.ExecuteHistoryDDLs(ctx, startTS); err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+
+	// the statements are written to spool in the order of commit ts, and then copied to output in the reverse order
+	spoolName := filepath.Join(defaultOutputDir, flashbackFileName+".tmp")
+	spool, err := os.OpenFile(spoolName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Annotatef(err, "open spool file %s", spoolName)
+	}
+	defer func() {
+		spool.Close()
+		if err := os.Remove(spoolName); err != nil {
+			log.Warn("remove spool file", zap.String("file", spoolName), zap.Error(err))
+		}
+	}()
+
+	r.progress.start(phaseFlashback, fileSize)
+	quit := make(chan struct{})
+	defer close(quit)
+	go r.progress.run(progressLogInterval, quit)
+	var readerCh chan *binlogFileReader
+	if len(sources) > 1 {
+		readerCh = readBinlogSources(sources, r.cfg.RelaxCorruption, r.opts, r.progress, quit, nil, nil)
+	} else {
+		readerCh = readBinlogFiles(sources[0], 1, r.cfg.RelaxCorruption, r.opts, r.progress, quit)
+	}
+
+	writer := bufio.NewWriter(spool)
+	var (
+		blocks []spoolBlock
+		offset int64
+	)
+	for reader := range readerCh {
+		for binlog := range reader.binlogCh {
+			if err := ctx.Err(); err != nil {
+				return errors.Trace(err)
+			}
+
+			if !isAcceptableBinlog(binlog, startTS, r.cfg.StopTSO) {
+				// the DDLs before startTS are loaded from PD, otherwise they are needed to update the table info
+				if binlog.CommitTs < startTS && binlog.Tp == pb.BinlogType_DDL && !r.loadsHistoryDDLs() {
+					if err := ddlHandle.ExecuteDDL("", string(binlog.GetDdlQuery())); err != nil {
+						return errors.Trace(err)
+					}
+				}
+				continue
+			}
+
+			switch binlog.Tp {
+			case pb.BinlogType_DDL:
+				schema, table, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if r.filter.skip(schema, table) {
+					continue
+				}
+				return errors.Errorf("DDL `%s` at %s can't be undone by flashback, choose a range without DDLs of the selected tables",
+					binlog.DdlQuery, formatTSO(binlog.CommitTs))
+			case pb.BinlogType_DML:
+				stmts, err := r.undoStatements(binlog)
+				if err != nil {
+					return errors.Annotatef(err, "generate undo statements of binlog %s", formatTSO(binlog.CommitTs))
+				}
+				if len(stmts) == 0 {
+					continue
+				}
+
+				var sb strings.Builder
+				sb.WriteString("BEGIN;\n")
+				for i := len(stmts) - 1; i >= 0; i-- {
+					sb.WriteString(stmts[i])
+					sb.WriteString(";\n")
+				}
+				sb.WriteString("COMMIT;\n")
+				n, err := writer.WriteString(sb.String())
+				if err != nil {
+					return errors.Trace(err)
+				}
+				blocks = append(blocks, spoolBlock{offset: offset, size: n})
+				offset += int64(n)
+			}
+		}
+		if err := reader.err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+
+	fileName := filepath.Join(defaultOutputDir, flashbackFileName+sqlFileSuffix+compressSuffix(r.cfg.Compress)+encryptSuffixOf(r.opts.cipher))
+	output, err := newSQLWriter(r.opts, fileName, r.cfg.Compress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = copyBlocksReversed(output.writer, spool, blocks); err == nil {
+		err = output.Close()
+	} else {
+		output.abort()
+	}
+	if err != nil {
+		return errors.Annotatef(err, "write flashback file %s", fileName)
+	}
+
+	log.Info("flashback finished", zap.String("file", fileName), zap.Int("transactions", len(blocks)))
+	return nil
+}
+
+// undoStatements returns the statements which undo the events of the DML binlog, in the order of events.
+func (r *PITR) undoStatements(binlog *pb.Binlog) ([]string, error) {
+	dml := binlog.DmlData
+	if dml == nil {
+		return nil, errors.New("dml binlog's data can't be empty")
+	}
+
+	stmts := make([]string, 0, len(dml.Events))
+	for i := range dml.Events {
+		event := &dml.Events[i]
+		if r.filter.skip(event.GetSchemaName(), event.GetTableName()) {
+			continue
+		}
+		if r.rowFilter != nil {
+			// the update is undone if any of its images matches the row filter
+			evs, err := rewriteDML(event)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			var matched bool
+			for _, ev := range evs {
+				if matched, err = r.rowFilter.match(ev); err != nil {
+					return nil, errors.Trace(err)
+				}
+				if matched {
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		reversed, err := reverseEvent(event)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		info, err := ddlHandle.GetTableInfo(event.GetSchemaName(), event.GetTableName())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		stmt, err := eventToSQL(reversed, info)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+// reverseEvent returns the event which undoes ev, insert is reversed to delete, delete is reversed to insert,
+// and the values before and after update are swapped.
+func reverseEvent(ev *pb.Event) (*pb.Event, error) {
+	reversed := &pb.Event{
+		SchemaName: ev.SchemaName,
+		TableName:  ev.TableName,
+		Row:        ev.Row,
+	}
+
+	switch ev.GetTp() {
+	case pb.EventType_Insert:
+		reversed.Tp = pb.EventType_Delete
+	case pb.EventType_Delete:
+		reversed.Tp = pb.EventType_Insert
+	case pb.EventType_Update:
+		reversed.Tp = pb.EventType_Update
+		reversed.Row = make([][]byte, 0, len(ev.Row))
+		for _, c := range ev.Row {
+			col := &pb.Column{}
+			if err := col.Unmarshal(c); err != nil {
+				return nil, errors.Trace(err)
+			}
+			col.Value, col.ChangedValue = col.ChangedValue, col.Value
+			data, err := col.Marshal()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reversed.Row = append(reversed.Row, data)
+		}
+	default:
+		return nil, errors.Errorf("unknown event type %v", ev.GetTp())
+	}
+	return reversed, nil
+}
+
+// copyBlocksReversed copies the blocks in src to w from the last one to the first one.
+func copyBlocksReversed(w io.Writer, src io.ReaderAt, blocks []spoolBlock) error {
+	var buf []byte
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		if cap(buf) < block.size {
+			buf = make([]byte, block.size)
+		}
+		buf = buf[:block.size]
+		if _, err := src.ReadAt(buf, block.offset); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
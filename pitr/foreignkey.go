@@ -0,0 +1,224 @@
+package pitr
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/ast"
+	"go.uber.org/zap"
+)
+
+const (
+	// foreignKeyModeDisableChecks disables the foreign key checks at the head of every sql file and in the
+	// sessions of dest-db, so the tables can be replayed in any order
+	foreignKeyModeDisableChecks = "disable-checks"
+	// foreignKeyModeOrdered writes the statements of all the tables to replay.sql in the order of foreign keys
+	foreignKeyModeOrdered = "ordered"
+
+	// replayFileName is the file of the statements of all the tables ordered by foreign keys in output dir
+	replayFileName = "replay" + sqlFileSuffix
+	// disableForeignKeyChecks is the first statement of every sql file in disable-checks mode
+	disableForeignKeyChecks = "SET FOREIGN_KEY_CHECKS=0;"
+)
+
+// dropForeignKey drops the foreign key by its name.
+func dropForeignKey(table *ast.CreateTableStmt, name string) (*ast.CreateTableStmt, error) {
+	for i, c := range table.Constraints {
+		if c.Tp == ast.ConstraintForeignKey && strings.EqualFold(c.Name, name) {
+			table.Constraints = append(table.Constraints[:i:i], table.Constraints[i+1:]...)
+			return table, nil
+		}
+	}
+	return nil, errors.Errorf("can't drop foreign key %s, check that it exists", name)
+}
+
+// foreignKeys returns the parent tables referenced by the foreign keys of every table, both are keyed by
+// tableOutputKey. A reference without database is in the database of the child table, and the references of
+// a table to itself are excluded.
+func (t *schemaTracker) foreignKeys() map[string][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	parents := make(map[string][]string)
+	for _, db := range t.dbs {
+		for _, table := range db.tables {
+			child := tableOutputKey(db.stmt.Name, table.Table.Name.O)
+			for _, c := range table.Constraints {
+				if c.Tp != ast.ConstraintForeignKey || c.Refer == nil || c.Refer.Table == nil {
+					continue
+				}
+				schema := c.Refer.Table.Schema.O
+				if len(schema) == 0 {
+					schema = db.stmt.Name
+				}
+				if parent := tableOutputKey(schema, c.Refer.Table.Name.O); parent != child {
+					parents[child] = append(parents[child], parent)
+				}
+			}
+		}
+	}
+	return parents
+}
+
+// sortByForeignKeys returns the tables sorted by the foreign keys, the parent tables are before their child
+// tables, and the tables without dependency between them are sorted by name. The references to the tables not
+// in tables are ignored, and an error is returned if the foreign keys form a cycle.
+func sortByForeignKeys(tables []string, parents map[string][]string) ([]string, error) {
+	exists := make(map[string]string, len(tables))
+	for _, table := range tables {
+		exists[strings.ToLower(table)] = table
+	}
+	children := make(map[string][]string)
+	inDegrees := make(map[string]int, len(tables))
+	for _, table := range tables {
+		key := strings.ToLower(table)
+		seen := make(map[string]bool)
+		for _, parent := range parents[key] {
+			if _, ok := exists[parent]; !ok || seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			children[parent] = append(children[parent], key)
+			inDegrees[key]++
+		}
+	}
+
+	var ready []string
+	for key := range exists {
+		if inDegrees[key] == 0 {
+			ready = append(ready, key)
+		}
+	}
+	sorted := make([]string, 0, len(tables))
+	for len(ready) != 0 {
+		sort.Strings(ready)
+		key := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, exists[key])
+		for _, child := range children[key] {
+			if inDegrees[child]--; inDegrees[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	if len(sorted) != len(exists) {
+		var cycle []string
+		for key, degree := range inDegrees {
+			if degree > 0 {
+				cycle = append(cycle, exists[key])
+			}
+		}
+		sort.Strings(cycle)
+		return nil, errors.Errorf("the foreign keys of tables %s form a cycle, use foreign-key-mode %s instead",
+			strings.Join(cycle, ", "), foreignKeyModeDisableChecks)
+	}
+	return sorted, nil
+}
+
+// writeReplayFile writes the merged statements of all the tables to replay.sql in output dir, the DELETE
+// statements are written first from the child tables to the parent tables, then the other statements from the
+// parent tables to the child tables, so the rows are deleted before their parents and inserted after them.
+// The UPDATE statements changing the foreign keys to the deleted rows are only safe in safe-mode, which splits
+// them to DELETE and REPLACE. The DDLs can't be ordered, an error is returned if any table has them.
+func (m *Merge) writeReplayFile() (string, error) {
+	dirs, err := m.tables()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	tableFiles := make(map[string][]string, len(dirs))
+	tables := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		table := m.outputName(dir)
+		names, err := m.tableOutputFiles(table)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		tableFiles[table] = names
+		tables = append(tables, table)
+	}
+	tables, err = sortByForeignKeys(tables, ddlHandle.tracker.foreignKeys())
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	name := filepath.Join(m.outputDir, replayFileName+compressSuffix(m.compress)+encryptSuffixOf(m.opts.cipher))
+	w, err := newSQLWriter(m.opts, name, m.compress)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var count int
+	writeStatements := func(table string, deletes bool) error {
+		for _, file := range tableFiles[table] {
+			err := readStatements(filepath.Join(m.outputDir, file), m.opts.cipher, func(stmt string) error {
+				if !strings.HasPrefix(stmt, "DELETE FROM ") && !strings.HasPrefix(stmt, "INSERT INTO ") &&
+					!strings.HasPrefix(stmt, "REPLACE INTO ") && !strings.HasPrefix(stmt, "UPDATE ") {
+					return errors.Errorf("the statement of table %s can't be ordered by foreign keys, use foreign-key-mode %s instead: %s",
+						table, foreignKeyModeDisableChecks, stmt)
+				}
+				if strings.HasPrefix(stmt, "DELETE FROM ") != deletes {
+					return nil
+				}
+				n, err := w.writer.WriteString(stmt + "\n")
+				w.written += int64(n)
+				count++
+				return errors.Trace(err)
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+	for i := len(tables) - 1; i >= 0; i-- {
+		if err = writeStatements(tables[i], true); err != nil {
+			break
+		}
+	}
+	for i := 0; i < len(tables) && err == nil; i++ {
+		err = writeStatements(tables[i], false)
+	}
+	if err == nil {
+		err = w.Close()
+	} else {
+		w.abort()
+	}
+	if err != nil {
+		return "", errors.Annotatef(err, "write replay file %s", name)
+	}
+
+	log.Info("replay file is written", zap.String("file", name), zap.Int("tables", len(tables)), zap.Int("statements", count))
+	return name, nil
+}
+
+// readStatements calls fn with every statement of the sql file, one statement is in one line, the file is
+// decompressed and decrypted by c by its suffixes.
+func readStatements(name string, c *payloadCipher, fn func(stmt string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r, err := newDecompressReader(name, f, c)
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), int(maxMemorySize))
+	for scanner.Scan() {
+		if stmt := scanner.Text(); len(stmt) != 0 {
+			if err := fn(stmt); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return errors.Annotatef(scanner.Err(), "read sql file %s", name)
+}
@@ -0,0 +1,88 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSortByForeignKeys(t *testing.T) {
+	var tracker schemaTracker
+	tracker.reset()
+	for _, ddl := range []string{
+		"create database shop",
+		"use shop; create table customers (id int primary key, referrer int, foreign key (referrer) references customers (id))",
+		"use shop; create table orders (id int primary key, customer int, constraint fk_customer foreign key (customer) references customers (id))",
+		"use shop; create table items (id int primary key, order_id int, foreign key (order_id) references shop.orders (id))",
+		"use shop; create table notes (id int primary key, order_id int)",
+		"use shop; alter table notes add constraint fk_order foreign key (order_id) references orders (id)",
+		"use shop; alter table notes drop foreign key fk_order",
+	} {
+		assert.NilError(t, tracker.execute("", ddl), ddl)
+	}
+	assert.ErrorContains(t, tracker.execute("", "use shop; alter table notes drop foreign key fk_order"), "can't drop foreign key fk_order")
+
+	// the reference of customers to itself is excluded
+	parents := tracker.foreignKeys()
+	assert.DeepEqual(t, parents, map[string][]string{
+		"shop_orders": {"shop_customers"},
+		"shop_items":  {"shop_orders"},
+	})
+	sorted, err := sortByForeignKeys([]string{"shop_items", "shop_notes", "shop_Orders", "shop_customers"}, parents)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sorted, []string{"shop_customers", "shop_Orders", "shop_items", "shop_notes"})
+	// the parent tables not in the output are ignored
+	sorted, err = sortByForeignKeys([]string{"shop_items", "shop_notes"}, parents)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sorted, []string{"shop_items", "shop_notes"})
+
+	parents["shop_customers"] = []string{"shop_items"}
+	_, err = sortByForeignKeys([]string{"shop_items", "shop_notes", "shop_orders", "shop_customers"}, parents)
+	assert.ErrorContains(t, err, "the foreign keys of tables shop_customers, shop_items, shop_orders form a cycle")
+}
+
+func TestWriteReplayFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	ddl.ResetDB()
+	for _, sql := range []string{
+		"use test; create table parent (id int primary key)",
+		"use test; create table child (id int primary key, parent_id int, foreign key (parent_id) references parent (id))",
+	} {
+		assert.NilError(t, ddl.ExecuteDDL("", sql), sql)
+	}
+
+	m := &Merge{tempDir: filepath.Join(dir, "temp"), outputDir: filepath.Join(dir, "output"), outputFormat: outputFormatSQL, compress: compressNone}
+	for table, stmts := range map[string]string{
+		"test_parent": "DELETE FROM `test`.`parent` WHERE `id` = 1 LIMIT 1;\nINSERT INTO `test`.`parent` (`id`) VALUES (2);\n",
+		"test_child": "INSERT INTO `test`.`child` (`id`,`parent_id`) VALUES (1,2);\n" +
+			"DELETE FROM `test`.`child` WHERE `id` = 2 LIMIT 1;\n",
+	} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, table), 0700))
+		assert.NilError(t, os.MkdirAll(m.outputDir, 0700))
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(m.outputDir, table+sqlFileSuffix), []byte(stmts), 0600))
+	}
+
+	name, err := m.writeReplayFile()
+	assert.NilError(t, err)
+	assert.Equal(t, name, filepath.Join(m.outputDir, replayFileName))
+	data, err := ioutil.ReadFile(name)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "DELETE FROM `test`.`child` WHERE `id` = 2 LIMIT 1;\n"+
+		"DELETE FROM `test`.`parent` WHERE `id` = 1 LIMIT 1;\n"+
+		"INSERT INTO `test`.`parent` (`id`) VALUES (2);\n"+
+		"INSERT INTO `test`.`child` (`id`,`parent_id`) VALUES (1,2);\n")
+
+	// the DDLs can't be ordered
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(m.outputDir, "test_parent"+sqlFileSuffix), []byte("TRUNCATE TABLE `test`.`parent`;\n"), 0600))
+	_, err = m.writeReplayFile()
+	assert.ErrorContains(t, err, "use foreign-key-mode disable-checks instead")
+}
@@ -0,0 +1,351 @@
+package pitr
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	tidbconfig "github.com/pingcap/tidb/config"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	gcServicePrefix = "pitr"
+	// updateServiceGCSafePointMethod is the gRPC method of PD v4.0 or later to register a service GC safepoint
+	updateServiceGCSafePointMethod = "/pdpb.PD/UpdateServiceGCSafePoint"
+	pdClusterAPI                   = "/pd/api/v1/cluster"
+	pdLeaderAPI                    = "/pd/api/v1/leader"
+)
+
+// gcSafePointKeeper registers a service GC safepoint in PD, so TiKV doesn't GC the versions after it while
+// PITR reads the history DDL jobs and the metadata from TiKV. The TTL is renewed until it's closed, and the
+// safepoint is removed by Close, it expires after the TTL if PITR exits unexpectedly.
+type gcSafePointKeeper struct {
+	conn      *grpc.ClientConn
+	clusterID uint64
+	serviceID string
+	safePoint uint64
+	ttl       time.Duration
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startGCSafePointKeeper registers the service GC safepoint at safePoint in the PD leader of urls.
+// It returns nil if PD doesn't support the service GC safepoint, which is added in PD v4.0.
+func startGCSafePointKeeper(ctx context.Context, urls string, security tidbconfig.Security, serviceID string, safePoint uint64, ttl time.Duration, timeout time.Duration) (*gcSafePointKeeper, error) {
+	clusterID, leader, err := pdLeader(urls, security, timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dialOpt, err := pdDialOption(security)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, leader, dialOpt, grpc.WithBlock())
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect PD leader %s", leader)
+	}
+
+	k := &gcSafePointKeeper{
+		conn:      conn,
+		clusterID: clusterID,
+		serviceID: serviceID,
+		safePoint: safePoint,
+		ttl:       ttl,
+		quit:      make(chan struct{}),
+	}
+	if err := k.update(ctx, ttl); err != nil {
+		conn.Close()
+		if status.Code(errors.Cause(err)) == codes.Unimplemented {
+			log.Warn("PD doesn't support the service GC safepoint, the history DDL jobs may be GC-ed while reading them, use PD v4.0 or later",
+				zap.String("pd", leader))
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	log.Info("service GC safepoint is registered", zap.String("service", serviceID),
+		zap.String("safepoint", formatTSO(int64(safePoint))), zap.Duration("ttl", ttl))
+
+	k.wg.Add(1)
+	go k.run()
+	return k, nil
+}
+
+// keepGCSafePoint registers the service GC safepoint at the current TSO if the history DDL jobs are read from
+// TiKV, it only warns if the safepoint can't be registered, and returns nil in this case.
+func (r *PITR) keepGCSafePoint(ctx context.Context) *gcSafePointKeeper {
+	if len(r.cfg.PDURLs) == 0 || r.cfg.GCTTL <= 0 {
+		return nil
+	}
+	timeout := time.Duration(r.cfg.PDTimeout) * time.Second
+	k, err := func() (*gcSafePointKeeper, error) {
+		ts, err := currentTSO(r.cfg.PDURLs, r.cfg.pdSecurity())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		serviceID := gcServicePrefix
+		if len(r.cfg.RunID) != 0 {
+			serviceID += "-" + r.cfg.RunID
+		}
+		return startGCSafePointKeeper(ctx, r.cfg.PDURLs, r.cfg.pdSecurity(), serviceID, ts, time.Duration(r.cfg.GCTTL)*time.Second, timeout)
+	}()
+	if err != nil {
+		log.Warn("register service GC safepoint failed, the history DDL jobs may be GC-ed while reading them", zap.Error(err))
+		return nil
+	}
+	return k
+}
+
+// run renews the TTL of the safepoint every third of the TTL.
+func (k *gcSafePointKeeper) run() {
+	defer k.wg.Done()
+	ticker := time.NewTicker(k.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), k.ttl/3)
+			if err := k.update(ctx, k.ttl); err != nil {
+				log.Warn("renew service GC safepoint failed", zap.String("service", k.serviceID), zap.Error(err))
+			}
+			cancel()
+		case <-k.quit:
+			return
+		}
+	}
+}
+
+// Close stops renewing the safepoint and removes it, a nil gcSafePointKeeper does nothing.
+func (k *gcSafePointKeeper) Close() {
+	if k == nil {
+		return
+	}
+	close(k.quit)
+	k.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.ttl/3)
+	defer cancel()
+	// PD removes the service safepoint whose TTL is not positive
+	if err := k.update(ctx, 0); err != nil {
+		log.Warn("remove service GC safepoint failed, it expires after the TTL", zap.String("service", k.serviceID),
+			zap.Duration("ttl", k.ttl), zap.Error(err))
+	} else {
+		log.Info("service GC safepoint is removed", zap.String("service", k.serviceID))
+	}
+	k.conn.Close()
+}
+
+// update sets the TTL of the safepoint, it fails if the GC safepoint of TiKV is already after the safepoint.
+func (k *gcSafePointKeeper) update(ctx context.Context, ttl time.Duration) error {
+	req := &updateServiceGCSafePointRequest{
+		clusterID: k.clusterID,
+		serviceID: k.serviceID,
+		ttl:       int64(ttl / time.Second),
+		safePoint: k.safePoint,
+	}
+	resp := &updateServiceGCSafePointResponse{}
+	if err := k.conn.Invoke(ctx, updateServiceGCSafePointMethod, req, resp); err != nil {
+		return errors.Annotate(err, "update service GC safepoint")
+	}
+	if len(resp.errMsg) != 0 {
+		return errors.Errorf("update service GC safepoint: %s", resp.errMsg)
+	}
+	if ttl > 0 && resp.minSafePoint > k.safePoint {
+		return errors.Errorf("GC safepoint %s is already after %s", formatTSO(int64(resp.minSafePoint)), formatTSO(int64(k.safePoint)))
+	}
+	return nil
+}
+
+// pdLeader returns the cluster id and the address of the PD leader by the HTTP API of any PD in urls.
+func pdLeader(urls string, security tidbconfig.Security, timeout time.Duration) (uint64, string, error) {
+	client, scheme, err := newPDHTTPClient(security, timeout)
+	if err != nil {
+		return 0, "", errors.Trace(err)
+	}
+	var lastErr error
+	for _, addr := range pdAddrs(urls, scheme) {
+		var cluster struct {
+			ID uint64 `json:"id"`
+		}
+		var leader struct {
+			ClientURLs []string `json:"client_urls"`
+		}
+		if lastErr = getJSON(client, addr+pdClusterAPI, &cluster); lastErr != nil {
+			continue
+		}
+		if lastErr = getJSON(client, addr+pdLeaderAPI, &leader); lastErr != nil {
+			continue
+		}
+		if len(leader.ClientURLs) == 0 {
+			lastErr = errors.Errorf("no leader of PD %s", addr)
+			continue
+		}
+		leaderURL := leader.ClientURLs[0]
+		if i := strings.Index(leaderURL, "://"); i >= 0 {
+			leaderURL = leaderURL[i+3:]
+		}
+		return cluster.ID, leaderURL, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("pd-urls is empty")
+	}
+	return 0, "", errors.Trace(lastErr)
+}
+
+// getJSON requests the url and decodes the JSON response to v.
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return errors.Annotatef(err, "request %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request %s, got status %s", url, resp.Status)
+	}
+	return errors.Annotatef(json.NewDecoder(resp.Body).Decode(v), "decode the response of %s", url)
+}
+
+// updateServiceGCSafePointRequest is pdpb.UpdateServiceGCSafePointRequest, the kvproto in go.mod is older
+// than the service GC safepoint, so the message is encoded here.
+type updateServiceGCSafePointRequest struct {
+	clusterID uint64
+	serviceID string
+	ttl       int64
+	safePoint uint64
+}
+
+func (r *updateServiceGCSafePointRequest) Reset()         { *r = updateServiceGCSafePointRequest{} }
+func (r *updateServiceGCSafePointRequest) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *updateServiceGCSafePointRequest) ProtoMessage()  {}
+
+// Marshal encodes the request, the header is the field 1 with the cluster id as its field 1.
+func (r *updateServiceGCSafePointRequest) Marshal() ([]byte, error) {
+	header := appendVarintField(nil, 1, r.clusterID)
+	b := appendBytesField(nil, 1, header)
+	b = appendBytesField(b, 2, []byte(r.serviceID))
+	b = appendVarintField(b, 3, uint64(r.ttl))
+	return appendVarintField(b, 4, r.safePoint), nil
+}
+
+// updateServiceGCSafePointResponse is the fields used in pdpb.UpdateServiceGCSafePointResponse.
+type updateServiceGCSafePointResponse struct {
+	// errMsg is the message of the error in the header
+	errMsg       string
+	minSafePoint uint64
+}
+
+func (r *updateServiceGCSafePointResponse) Reset()         { *r = updateServiceGCSafePointResponse{} }
+func (r *updateServiceGCSafePointResponse) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *updateServiceGCSafePointResponse) ProtoMessage()  {}
+
+func (r *updateServiceGCSafePointResponse) Unmarshal(data []byte) error {
+	return decodeFields(data, func(field uint64, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			// the error of the header is its field 2, and the message is the field 2 of the error
+			return decodeFields(bytes, func(field uint64, _ uint64, bytes []byte) error {
+				if field != 2 {
+					return nil
+				}
+				return decodeFields(bytes, func(field uint64, _ uint64, bytes []byte) error {
+					if field == 2 {
+						r.errMsg = string(bytes)
+					}
+					return nil
+				})
+			})
+		case 4:
+			r.minSafePoint = varint
+		}
+		return nil
+	})
+}
+
+// the wire types of protobuf
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarintField(b []byte, field uint64, v uint64) []byte {
+	b = appendVarint(b, field<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field uint64, v []byte) []byte {
+	b = appendVarint(b, field<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// decodeFields calls fn with every field of the message, varint is set for the varint fields, and bytes is
+// set for the length-delimited fields, the fixed fields are skipped.
+func decodeFields(data []byte, fn func(field uint64, varint uint64, bytes []byte) error) error {
+	readVarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid varint in protobuf message")
+		}
+		data = data[n:]
+		return v, nil
+	}
+	skip := func(n uint64) ([]byte, error) {
+		if uint64(len(data)) < n {
+			return nil, errors.New("truncated protobuf message")
+		}
+		skipped := data[:n]
+		data = data[n:]
+		return skipped, nil
+	}
+
+	for len(data) > 0 {
+		key, err := readVarint()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		var varint, length uint64
+		var bytes []byte
+		switch key & 7 {
+		case wireVarint:
+			varint, err = readVarint()
+		case wireBytes:
+			if length, err = readVarint(); err == nil {
+				bytes, err = skip(length)
+			}
+		case wireFixed64:
+			_, err = skip(8)
+		case wireFixed32:
+			_, err = skip(4)
+		default:
+			return errors.Errorf("unsupported wire type %d in protobuf message", key&7)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := fn(key>>3, varint, bytes); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package pitr
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tidbconfig "github.com/pingcap/tidb/config"
+	"gotest.tools/assert"
+)
+
+func TestServiceGCSafePointMessages(t *testing.T) {
+	req := &updateServiceGCSafePointRequest{clusterID: 300, serviceID: "pitr-1", ttl: 600, safePoint: 1 << 40}
+	data, err := req.Marshal()
+	assert.NilError(t, err)
+
+	fields := make(map[uint64]interface{})
+	assert.NilError(t, decodeFields(data, func(field uint64, varint uint64, bytes []byte) error {
+		if field == 1 {
+			return decodeFields(bytes, func(field uint64, varint uint64, _ []byte) error {
+				fields[10+field] = varint
+				return nil
+			})
+		}
+		if bytes != nil {
+			fields[field] = string(bytes)
+		} else {
+			fields[field] = varint
+		}
+		return nil
+	}))
+	assert.DeepEqual(t, fields, map[uint64]interface{}{
+		11: uint64(300),
+		2:  "pitr-1",
+		3:  uint64(600),
+		4:  uint64(1 << 40),
+	})
+
+	// header { cluster_id: 300, error { type: 1, message: "mismatch" } }, service_id, ttl, min_safe_point
+	errMsg := appendVarintField(nil, 1, 1)
+	errMsg = appendBytesField(errMsg, 2, []byte("mismatch"))
+	header := appendVarintField(nil, 1, 300)
+	header = appendBytesField(header, 2, errMsg)
+	data = appendBytesField(nil, 1, header)
+	data = appendBytesField(data, 2, []byte("pitr-1"))
+	data = appendVarintField(data, 3, 600)
+	data = appendVarintField(data, 4, 12345)
+	resp := &updateServiceGCSafePointResponse{}
+	assert.NilError(t, resp.Unmarshal(data))
+	assert.Equal(t, resp.errMsg, "mismatch")
+	assert.Equal(t, resp.minSafePoint, uint64(12345))
+
+	assert.ErrorContains(t, resp.Unmarshal(data[:len(data)-1]), "invalid varint")
+	assert.ErrorContains(t, resp.Unmarshal([]byte{0x0a, 0x05, 0x01}), "truncated")
+}
+
+func TestPDLeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case pdClusterAPI:
+			fmt.Fprint(w, `{"id": 6800000000000000000, "max_peer_count": 3}`)
+		case pdLeaderAPI:
+			fmt.Fprint(w, `{"name": "pd-0", "client_urls": ["http://10.0.0.1:2379"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	clusterID, leader, err := pdLeader("127.0.0.1:1,"+server.URL, tidbconfig.Security{}, time.Second)
+	assert.NilError(t, err)
+	assert.Equal(t, clusterID, uint64(6800000000000000000))
+	assert.Equal(t, leader, "10.0.0.1:2379")
+
+	_, _, err = pdLeader(server.URL+"/not-pd", tidbconfig.Security{}, time.Second)
+	assert.ErrorContains(t, err, "404")
+}
@@ -0,0 +1,87 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// GenConfig is the config of the gen subcommand, which writes the binlog files of a synthetic workload like
+// drainer, so the runbooks can be validated without the production data.
+type GenConfig struct {
+	WorkloadConfig
+	// Dir is the dir of the binlog files, it should be empty or not exist
+	Dir string
+	// StartTime is the datetime of the first binlog in the local time zone, it's used if StartTS is 0
+	StartTime string
+	// JSON prints the result as a JSON object
+	JSON bool
+}
+
+// genResult is the result of the gen subcommand.
+type genResult struct {
+	Dir string `json:"dir"`
+	workloadStats
+	StartDatetime string `json:"start-datetime"`
+	StopDatetime  string `json:"stop-datetime"`
+	Bytes         int64  `json:"bytes"`
+}
+
+// Gen writes the binlog files of the workload to cfg.Dir, and prints the size and the commit ts range of them
+// to w, which are the bounds of start-tso and stop-tso of a run on them.
+func Gen(w io.Writer, cfg *GenConfig) error {
+	if len(cfg.Dir) == 0 {
+		return errors.New("dir should be set")
+	}
+	if infos, err := ioutil.ReadDir(cfg.Dir); err == nil && len(infos) != 0 {
+		return errors.Errorf("dir %s is not empty, the binlogs would be mixed with the existing files", cfg.Dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	workload := cfg.WorkloadConfig
+	if workload.StartTS == 0 && len(cfg.StartTime) != 0 {
+		ts, err := dateTimeToTSO(cfg.StartTime, time.Local)
+		if err != nil {
+			return errors.Annotatef(err, "parse start-time %s", cfg.StartTime)
+		}
+		workload.StartTS = ts
+	}
+
+	stats, err := writeWorkload(cfg.Dir, workload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	size, err := dirTreeSize(cfg.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	result := genResult{
+		Dir:           cfg.Dir,
+		workloadStats: stats,
+		StartDatetime: tsoDatetime(stats.StartTS, time.Local),
+		StopDatetime:  tsoDatetime(stats.StopTS, time.Local),
+		Bytes:         size,
+	}
+	log.Info("binlogs are generated", zap.String("dir", cfg.Dir), zap.Int("binlogs", stats.Binlogs),
+		zap.Int("ddls", stats.DDLs), zap.Int64("events", stats.Events), zap.Int64("bytes", size))
+
+	if cfg.JSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return errors.Trace(err)
+	}
+	fmt.Fprintf(w, "written %d DML binlogs and %d DDLs to %s, %d events (%d inserts, %d updates, %d deletes), %s\n",
+		stats.Binlogs, stats.DDLs, cfg.Dir, stats.Events, stats.Inserts, stats.Updates, stats.Deletes, formatSize(size))
+	fmt.Fprintf(w, "commit ts: %d (%s) - %d (%s)\n", stats.StartTS, result.StartDatetime, stats.StopTS, result.StopDatetime)
+	return nil
+}
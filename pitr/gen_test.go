@@ -0,0 +1,87 @@
+package pitr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestGen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gen")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	schemaFile := filepath.Join(dir, "schema.sql")
+	assert.NilError(t, ioutil.WriteFile(schemaFile, []byte("create table orders (id int unsigned, amount decimal(10, 2), "+
+		"note varchar(8), created datetime, primary key (id));\ncreate table users (id bigint primary key, name blob)"), 0600))
+	cfg := &GenConfig{
+		WorkloadConfig: WorkloadConfig{Database: "shop", SchemaFile: schemaFile, Binlogs: 20, EventsPerBinlog: 3, RowSize: 16,
+			UpdateRatio: 0.3, DeleteRatio: 0.2, KeyOrder: keyOrderRandom, DDLInterval: 5, Interval: time.Second, Seed: 1},
+		Dir:       filepath.Join(dir, "binlog"),
+		StartTime: "2020-01-02 03:04:05",
+		JSON:      true,
+	}
+	var out bytes.Buffer
+	assert.NilError(t, Gen(&out, cfg))
+	var result genResult
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &result), out.String())
+	startTS, err := dateTimeToTSO(cfg.StartTime, time.Local)
+	assert.NilError(t, err)
+	assert.Equal(t, result.StartTS, startTS)
+	assert.Equal(t, result.StartDatetime, cfg.StartTime)
+	// CREATE DATABASE, two CREATE TABLEs and an ADD COLUMN every 5 DML binlogs
+	assert.Equal(t, result.DDLs, 6)
+	assert.Equal(t, result.Binlogs, 20)
+	assert.Equal(t, result.Events, int64(60))
+
+	files, err := searchFiles(cfg.Dir)
+	assert.NilError(t, err)
+	var binlogs []*pb.Binlog
+	for _, file := range files {
+		f, err := os.Open(file)
+		assert.NilError(t, err)
+		r := bufio.NewReader(f)
+		for {
+			binlog, _, err := Decode(r)
+			if errors.Cause(err) == io.EOF {
+				break
+			}
+			assert.NilError(t, err)
+			binlogs = append(binlogs, binlog)
+		}
+		f.Close()
+	}
+	assert.Equal(t, len(binlogs), 26)
+	assert.Equal(t, string(binlogs[0].DdlQuery), "CREATE DATABASE `shop`")
+	assert.Assert(t, strings.HasPrefix(string(binlogs[1].DdlQuery), "USE `shop`; CREATE TABLE `orders`"), string(binlogs[1].DdlQuery))
+	assert.Assert(t, strings.Contains(string(binlogs[8].DdlQuery), "ADD COLUMN `c1` bigint"), string(binlogs[8].DdlQuery))
+	var events int64
+	for i, binlog := range binlogs {
+		if i > 0 {
+			assert.Assert(t, binlog.CommitTs > binlogs[i-1].CommitTs)
+		}
+		if binlog.Tp == pb.BinlogType_DML {
+			events += int64(len(binlog.DmlData.Events))
+		}
+	}
+	assert.Equal(t, events, result.Events)
+	assert.Equal(t, binlogs[len(binlogs)-1].CommitTs, result.StopTS)
+
+	assert.ErrorContains(t, Gen(&out, cfg), "is not empty")
+	cfg.Dir = filepath.Join(dir, "binlog2")
+	assert.NilError(t, ioutil.WriteFile(schemaFile, []byte("create table t (id varchar(10) primary key)"), 0600))
+	assert.ErrorContains(t, Gen(&out, cfg), "the primary key of table t")
+	cfg.KeyOrder = "reversed"
+	assert.ErrorContains(t, Gen(&out, cfg), "unknown key order reversed")
+}
@@ -0,0 +1,26 @@
+package pitr
+
+import "strings"
+
+// expressionIndexPrefix is the prefix of the hidden virtual columns of the expression indexes in TiDB.
+const expressionIndexPrefix = "_V$_"
+
+// isGenerated returns true if the column is a virtual or stored generated column of the table, or the hidden
+// column of an expression index.
+func (info *tableInfo) isGenerated(name string) bool {
+	return info.generatedColumns[strings.ToLower(name)] || strings.HasPrefix(name, expressionIndexPrefix)
+}
+
+// dropGeneratedColumns removes the generated columns from the columns of a row event. Whether the row events
+// have the values of the virtual generated columns depends on the version of TiDB, and the values of generated
+// columns can't be specified by INSERT or UPDATE, they're computed by the downstream from the other columns, so
+// the statements never have them, and the other columns still identify the row in WHERE.
+func (info *tableInfo) dropGeneratedColumns(cols []sqlColumn) []sqlColumn {
+	kept := make([]sqlColumn, 0, len(cols))
+	for _, col := range cols {
+		if !info.isGenerated(col.name) {
+			kept = append(kept, col)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,61 @@
+package pitr
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func TestGeneratedColumns(t *testing.T) {
+	var tracker schemaTracker
+	for _, ddl := range []string{
+		"create database test_gen",
+		"use test_gen; create table t1 (a int, b int, c int as (a + b) virtual, D int as (a * b) stored, unique key uk_c (c))",
+	} {
+		assert.NilError(t, tracker.execute("", ddl), ddl)
+	}
+	info, err := tracker.tableInfo("test_gen", "t1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.columns, []string{"a", "b"})
+	assert.DeepEqual(t, info.generatedColumns, map[string]bool{"c": true, "d": true})
+	// the unique key on the generated column doesn't identify the rows
+	assert.Assert(t, !info.hasKey())
+
+	// the virtual column c has no value in the older versions, it's NULL in the row
+	schema, table := "test_gen", "t1"
+	var row [][]byte
+	for _, col := range []*pb.Column{
+		{Name: "a", Tp: []byte{mysql.TypeLong}, Value: encodeDatum(t, types.NewIntDatum(1)), ChangedValue: encodeDatum(t, types.NewIntDatum(2))},
+		{Name: "b", Tp: []byte{mysql.TypeLong}, Value: encodeDatum(t, types.NewIntDatum(3)), ChangedValue: encodeDatum(t, types.NewIntDatum(3))},
+		{Name: "c", Tp: []byte{mysql.TypeLong}, Value: encodeDatum(t, types.Datum{}), ChangedValue: encodeDatum(t, types.Datum{})},
+		{Name: "d", Tp: []byte{mysql.TypeLong}, Value: encodeDatum(t, types.NewIntDatum(3)), ChangedValue: encodeDatum(t, types.NewIntDatum(6))},
+		{Name: "_V$_idx_0", Tp: []byte{mysql.TypeLong}, Value: encodeDatum(t, types.NewIntDatum(4)), ChangedValue: encodeDatum(t, types.NewIntDatum(5))},
+	} {
+		data, err := col.Marshal()
+		assert.NilError(t, err)
+		row = append(row, data)
+	}
+
+	for _, c := range []struct {
+		tp       pb.EventType
+		expected string
+	}{
+		{pb.EventType_Insert, "INSERT INTO `test_gen`.`t1` (`a`,`b`) VALUES (1,3)"},
+		{pb.EventType_Update, "UPDATE `test_gen`.`t1` SET `a` = 2,`b` = 3 WHERE `a` = 1 AND `b` = 3 LIMIT 1"},
+		{pb.EventType_Delete, "DELETE FROM `test_gen`.`t1` WHERE `a` = 1 AND `b` = 3 LIMIT 1"},
+	} {
+		sql, err := eventToSQL(&pb.Event{Tp: c.tp, SchemaName: &schema, TableName: &table, Row: row}, info)
+		assert.NilError(t, err)
+		assert.Equal(t, sql, c.expected)
+	}
+
+	sqls, err := eventToSQLs(&pb.Event{Tp: pb.EventType_Update, SchemaName: &schema, TableName: &table, Row: row}, info, true)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sqls, []string{
+		"DELETE FROM `test_gen`.`t1` WHERE `a` = 1 AND `b` = 3 LIMIT 1",
+		"REPLACE INTO `test_gen`.`t1` (`a`,`b`) VALUES (2,3)",
+	})
+}
@@ -0,0 +1,205 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	obinlog "github.com/pingcap/tidb-tools/tidb-binlog/slave_binlog_proto/go-binlog"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// binlogStreamMethod is the method of BinlogStream in stream.proto.
+const binlogStreamMethod = "/pitr.BinlogStream/Subscribe"
+
+// encodedMessage is a protobuf message already encoded, the gRPC codec sends it as is, so the service
+// needs no generated code. The request of Subscribe is empty, and the binlogs are in the open binlog
+// protocol of drainer's kafka sink.
+type encodedMessage []byte
+
+func (m *encodedMessage) Reset()         { *m = nil }
+func (m *encodedMessage) String() string { return fmt.Sprintf("%d bytes", len(*m)) }
+func (*encodedMessage) ProtoMessage()    {}
+
+func (m *encodedMessage) Marshal() ([]byte, error) {
+	return *m, nil
+}
+
+func (m *encodedMessage) Unmarshal(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// binlogStreamServer is the handler of BinlogStream.
+type binlogStreamServer interface {
+	subscribe(stream grpc.ServerStream) error
+}
+
+var binlogStreamDesc = grpc.ServiceDesc{
+	ServiceName: "pitr.BinlogStream",
+	HandlerType: (*binlogStreamServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		Handler:       subscribeHandler,
+		ServerStreams: true,
+	}},
+	Metadata: "stream.proto",
+}
+
+func subscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	var req encodedMessage
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	return srv.(binlogStreamServer).subscribe(stream)
+}
+
+// grpcSink streams the merged binlogs to the subscriber of BinlogStream, it serves only one subscriber,
+// which receives all the binlogs in the order of commit ts, and the run fails if the subscriber disconnects.
+type grpcSink struct {
+	ctx    context.Context
+	addr   string
+	server *grpc.Server
+
+	binlogCh chan encodedMessage
+
+	mu         sync.Mutex
+	subscribed bool
+	// done is closed when the stream of the subscriber ends, err is why it ends
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+var _ binlogSink = &grpcSink{}
+
+func newGRPCSink(ctx context.Context, addr string) (*grpcSink, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "listen on %s", addr)
+	}
+	s := &grpcSink{
+		ctx:      ctx,
+		addr:     listener.Addr().String(),
+		server:   grpc.NewServer(),
+		binlogCh: make(chan encodedMessage, 64),
+		done:     make(chan struct{}),
+	}
+	s.server.RegisterService(&binlogStreamDesc, s)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			log.Warn("gRPC server of merged binlogs stopped", zap.String("addr", s.addr), zap.Error(err))
+		}
+	}()
+	log.Info("wait for the subscriber of merged binlogs", zap.String("addr", s.addr), zap.String("method", binlogStreamMethod))
+	return s, nil
+}
+
+func (s *grpcSink) subscribe(stream grpc.ServerStream) error {
+	s.mu.Lock()
+	if s.subscribed {
+		s.mu.Unlock()
+		return status.Error(codes.AlreadyExists, "another subscriber is receiving the merged binlogs")
+	}
+	s.subscribed = true
+	s.mu.Unlock()
+	log.Info("subscriber of merged binlogs connected", zap.String("addr", s.addr))
+
+	for {
+		select {
+		case msg, ok := <-s.binlogCh:
+			if !ok {
+				s.finish(nil)
+				return nil
+			}
+			if err := stream.SendMsg(&msg); err != nil {
+				s.finish(errors.Annotate(err, "send merged binlog to the subscriber"))
+				return err
+			}
+		case <-stream.Context().Done():
+			s.finish(errors.Annotate(stream.Context().Err(), "the subscriber disconnected"))
+			return stream.Context().Err()
+		}
+	}
+}
+
+// finish ends the stream of the subscriber by err, nil means all the binlogs are sent.
+func (s *grpcSink) finish(err error) {
+	s.doneOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// Apply sends the binlog to the subscriber, it waits if no subscriber is connected.
+func (s *grpcSink) Apply(binlog *pb.Binlog) error {
+	values, err := encodeOpenBinlog(binlog)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, value := range values {
+		select {
+		case s.binlogCh <- value:
+		case <-s.done:
+			return errors.Trace(s.err)
+		case <-s.ctx.Done():
+			return errors.Trace(s.ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Close ends the stream after the subscriber receives all the binlogs, and stops the server.
+func (s *grpcSink) Close() error {
+	close(s.binlogCh)
+	var err error
+	select {
+	case <-s.done:
+		err = s.err
+	case <-s.ctx.Done():
+		err = s.ctx.Err()
+	}
+	// the stream is already ended, the server waits until its status is sent
+	s.server.GracefulStop()
+	return errors.Trace(err)
+}
+
+func (s *grpcSink) abort() {
+	s.server.Stop()
+}
+
+// BinlogStreamClient receives the merged binlogs from BinlogStream of a run with dest-type grpc.
+type BinlogStreamClient struct {
+	stream grpc.ClientStream
+}
+
+// SubscribeBinlogs subscribes the merged binlogs on conn.
+func SubscribeBinlogs(ctx context.Context, conn *grpc.ClientConn) (*BinlogStreamClient, error) {
+	stream, err := conn.NewStream(ctx, &binlogStreamDesc.Streams[0], binlogStreamMethod)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := stream.SendMsg(&encodedMessage{}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &BinlogStreamClient{stream: stream}, nil
+}
+
+// Recv returns the next merged binlog, io.EOF means all the binlogs are received.
+func (c *BinlogStreamClient) Recv() (*obinlog.Binlog, error) {
+	binlog := &obinlog.Binlog{}
+	if err := c.stream.RecvMsg(binlog); err != nil {
+		return nil, err
+	}
+	return binlog, nil
+}
@@ -0,0 +1,48 @@
+package pitr
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	obinlog "github.com/pingcap/tidb-tools/tidb-binlog/slave_binlog_proto/go-binlog"
+	"google.golang.org/grpc"
+	"gotest.tools/assert"
+)
+
+func TestGRPCSink(t *testing.T) {
+	ctx := context.Background()
+	sink, err := newGRPCSink(ctx, "127.0.0.1:0")
+	assert.NilError(t, err)
+
+	conn, err := grpc.Dial(sink.addr, grpc.WithInsecure())
+	assert.NilError(t, err)
+	defer conn.Close()
+	client, err := SubscribeBinlogs(ctx, conn)
+	assert.NilError(t, err)
+
+	binlog := genKafkaSinkBinlog(t)
+	assert.NilError(t, sink.Apply(binlog))
+	closed := make(chan error, 1)
+	go func() {
+		closed <- sink.Close()
+	}()
+
+	msg, err := client.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, msg.GetCommitTs(), binlog.CommitTs)
+	assert.Equal(t, msg.GetType(), obinlog.BinlogType_DML)
+	table := msg.GetDmlData().GetTables()[0]
+	assert.Equal(t, table.GetTableName(), "t1")
+	assert.Equal(t, table.GetMutations()[0].GetType(), obinlog.MutationType_Update)
+	_, err = client.Recv()
+	assert.Equal(t, err, io.EOF)
+	assert.NilError(t, <-closed)
+
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.DestType = destTypeGRPC
+	assert.ErrorContains(t, cfg.validate(), "dest-grpc-addr is required")
+	cfg.DestGRPCAddr = ":8262"
+	assert.NilError(t, cfg.validate())
+}
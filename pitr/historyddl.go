@@ -0,0 +1,349 @@
+package pitr
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	tidbconfig "github.com/pingcap/tidb/config"
+	"github.com/pingcap/tidb/store"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPDMaxRetry = 3
+	// defaultPDTimeout is the default timeout in seconds of connecting to PD and fetching the history DDL jobs
+	defaultPDTimeout = 60
+	// defaultGCTTL is the default TTL in seconds of the service GC safepoint
+	defaultGCTTL = 300
+
+	pdRetryInterval    = time.Second
+	pdMaxRetryInterval = 30 * time.Second
+
+	// tidbHistoryDDLAPI is the status API of TiDB which returns all the history DDL jobs
+	tidbHistoryDDLAPI = "/ddl/history"
+)
+
+// the sources of the history DDL jobs
+const (
+	ddlSourcePD   = "pd"
+	ddlSourceTiDB = "tidb"
+	ddlSourceFile = "file"
+)
+
+// tiStoreMu makes the attempts of fetching history DDL jobs exclusive, an attempt abandoned by timeout
+// may still be running, and the tikv driver is registered globally.
+var tiStoreMu sync.Mutex
+
+// historyDDLCache is the history DDL jobs fetched from TiKV, Version is the ts of the snapshot,
+// so all the jobs finished before Version are included. the jobs are sorted by schema version.
+type historyDDLCache struct {
+	Version int64 `json:"version"`
+	// Source is the cluster the jobs are fetched from, see Config.historyDDLOrigin
+	Source string       `json:"source,omitempty"`
+	Jobs   []*model.Job `json:"jobs"`
+}
+
+// covers returns true if all the jobs finished before beginTS are in the cache.
+func (c *historyDDLCache) covers(beginTS int64) bool {
+	return c != nil && c.Version >= beginTS
+}
+
+// fetchedFrom returns false if the cache is fetched from another cluster, it's unknown if either is empty.
+func (c *historyDDLCache) fetchedFrom(source string) bool {
+	return c.Source == "" || source == "" || c.Source == source
+}
+
+func loadHistoryDDLCache(file string) (*historyDDLCache, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cache := &historyDDLCache{}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, errors.Annotatef(err, "decode history ddl cache %s", file)
+	}
+	return cache, nil
+}
+
+// saveHistoryDDLCache writes the cache to a temp file and renames it, so a broken cache is never left.
+func saveHistoryDDLCache(file string, cache *historyDDLCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Annotatef(err, "write history ddl cache %s", tmp)
+	}
+	return errors.Trace(os.Rename(tmp, file))
+}
+
+// isSQLFile returns true if the history ddl file is a SQL dump, otherwise it's JSON.
+func isSQLFile(file string) bool {
+	return strings.EqualFold(filepath.Ext(file), sqlFileSuffix)
+}
+
+// readHistoryDDLFile reads the history DDL jobs from a JSON file, which is an array of jobs like the output
+// of TiDB's `/ddl/history` HTTP API, or the cache written by history-ddl-cache.
+func readHistoryDDLFile(file string) (*historyDDLCache, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cache, err := decodeHistoryDDLJobs(data, file)
+	return cache, errors.Trace(err)
+}
+
+// decodeHistoryDDLJobs decodes the JSON array of jobs or the cache from source, the jobs are sorted by schema version.
+func decodeHistoryDDLJobs(data []byte, source string) (*historyDDLCache, error) {
+	var err error
+	cache := &historyDDLCache{}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &cache.Jobs)
+	} else {
+		err = json.Unmarshal(data, cache)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "decode history ddl jobs of %s", source)
+	}
+
+	for _, job := range cache.Jobs {
+		if job.BinlogInfo == nil {
+			return nil, errors.Errorf("history ddl job %d in %s has no binlog info", job.ID, source)
+		}
+	}
+	sort.SliceStable(cache.Jobs, func(i, j int) bool {
+		return cache.Jobs[i].BinlogInfo.SchemaVersion < cache.Jobs[j].BinlogInfo.SchemaVersion
+	})
+	return cache, nil
+}
+
+// fetchTiDBHistoryDDLJobs gets all the history DDL jobs by the status API of TiDB, it's used when the ports of
+// PD and TiKV are not reachable. The version of the result is the local time before the request.
+func fetchTiDBHistoryDDLJobs(ctx context.Context, addr string, timeout time.Duration) (*historyDDLCache, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	url := strings.TrimSuffix(addr, "/") + tidbHistoryDDLAPI
+	version := int64(oracle.ComposeTS(time.Now().UnixNano()/int64(time.Millisecond), 0))
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Annotatef(err, "request %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request %s, got status %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read the response of %s", url)
+	}
+	cache, err := decodeHistoryDDLJobs(data, url)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cache.Version = version
+	return cache, nil
+}
+
+// getHistoryDDLJobs returns all the history DDL jobs which finished before beginTS, and maybe some later ones.
+// they are read from the cache file if it's fetched from the same cluster and covers beginTS, otherwise they are fetched from TiKV or the status API
+// of TiDB by ddl-source and saved to it.
+func (r *PITR) getHistoryDDLJobs(ctx context.Context, beginTS int64) ([]*model.Job, error) {
+	// ExecuteHistoryDDLs is called by both Map and Reduce, only fetch once in a run
+	if r.historyDDLs.covers(beginTS) {
+		return r.historyDDLs.Jobs, nil
+	}
+
+	source := r.cfg.historyDDLSource()
+	if file := r.cfg.HistoryDDLFile; source == ddlSourceFile {
+		cache, err := readHistoryDDLFile(file)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if cache.Version != 0 && cache.Version < beginTS {
+			log.Warn("history ddl file is older than the first binlog, the DDLs between them may be missed",
+				zap.String("file", file), zap.String("version", formatTSO(cache.Version)), zap.String("begin-ts", formatTSO(beginTS)))
+		}
+		log.Info("load history ddl jobs from file", zap.String("file", file), zap.Int("jobs", len(cache.Jobs)))
+		r.historyDDLs = cache
+		return cache.Jobs, nil
+	}
+
+	cacheFile := r.cfg.HistoryDDLCache
+	origin := r.cfg.historyDDLOrigin()
+	if len(cacheFile) != 0 {
+		cache, err := loadHistoryDDLCache(cacheFile)
+		switch {
+		case err == nil && !cache.fetchedFrom(origin):
+			log.Warn("history ddl cache is fetched from another cluster, fetch again", zap.String("file", cacheFile),
+				zap.String("cache-source", cache.Source), zap.String("source", origin))
+		case err == nil && cache.covers(beginTS):
+			log.Info("load history ddl jobs from cache", zap.String("file", cacheFile),
+				zap.String("version", formatTSO(cache.Version)), zap.Int("jobs", len(cache.Jobs)))
+			r.historyDDLs = cache
+			r.report.setHistoryDDLCache(cacheFile, cache.Version, true)
+			return cache.Jobs, nil
+		case err == nil:
+			log.Warn("history ddl cache is older than the first binlog, fetch again", zap.String("file", cacheFile),
+				zap.String("version", formatTSO(cache.Version)), zap.String("begin-ts", formatTSO(beginTS)))
+		case !os.IsNotExist(errors.Cause(err)):
+			log.Warn("load history ddl cache failed, fetch again", zap.String("file", cacheFile), zap.Error(err))
+		}
+	}
+
+	timeout := time.Duration(r.cfg.PDTimeout) * time.Second
+	addr, fetch := r.cfg.PDURLs, func() (*historyDDLCache, error) {
+		return fetchHistoryDDLJobsWithTimeout(ctx, r.cfg.PDURLs, r.cfg.pdSecurity(), timeout)
+	}
+	if source == ddlSourceTiDB {
+		addr, fetch = r.cfg.TiDBStatusAddr, func() (*historyDDLCache, error) {
+			return fetchTiDBHistoryDDLJobs(ctx, r.cfg.TiDBStatusAddr, timeout)
+		}
+	}
+	if len(addr) == 0 {
+		return nil, errors.Errorf("history ddl cache %s doesn't cover %s, and neither pd-urls nor tidb-status-addr is set", cacheFile, formatTSO(beginTS))
+	}
+
+	var cache *historyDDLCache
+	err := withBackoff(ctx, r.cfg.PDMaxRetry, func() error {
+		var err error
+		cache, err = fetch()
+		return err
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "fetch history ddl jobs from %s", addr)
+	}
+	cache.Source = origin
+	r.historyDDLs = cache
+
+	if len(cacheFile) != 0 {
+		if err := saveHistoryDDLCache(cacheFile, cache); err != nil {
+			return nil, errors.Trace(err)
+		}
+		log.Info("history ddl jobs are saved to cache", zap.String("file", cacheFile), zap.Int("jobs", len(cache.Jobs)))
+		r.report.setHistoryDDLCache(cacheFile, cache.Version, false)
+	}
+	return cache.Jobs, nil
+}
+
+// withBackoff calls fn until it succeeds or has been retried maxRetry times, the interval
+// between retries doubles from pdRetryInterval up to pdMaxRetryInterval.
+func withBackoff(ctx context.Context, maxRetry int, fn func() error) error {
+	var err error
+	interval := pdRetryInterval
+	for i := 0; i <= maxRetry; i++ {
+		if i > 0 {
+			log.Warn("fetch history ddl jobs failed, will retry", zap.Int("retry", i), zap.Duration("after", interval), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
+			case <-time.After(interval):
+			}
+			if interval *= 2; interval > pdMaxRetryInterval {
+				interval = pdMaxRetryInterval
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if errors.Cause(err) == context.Canceled {
+			break
+		}
+	}
+	return errors.Trace(err)
+}
+
+// fetchHistoryDDLJobsWithTimeout returns an error if fetching doesn't finish in timeout, the abandoned
+// attempt closes its store when it finishes.
+func fetchHistoryDDLJobsWithTimeout(ctx context.Context, urls string, security tidbconfig.Security, timeout time.Duration) (*historyDDLCache, error) {
+	type result struct {
+		cache *historyDDLCache
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		cache, err := fetchHistoryDDLJobs(urls, security)
+		resultCh <- result{cache: cache, err: err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.cache, res.err
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	case <-time.After(timeout):
+		return nil, errors.Errorf("timeout after %s", timeout)
+	}
+}
+
+// currentTSO returns the current version of TiKV.
+func currentTSO(urls string, security tidbconfig.Security) (uint64, error) {
+	tiStoreMu.Lock()
+	defer tiStoreMu.Unlock()
+
+	tiStore, err := createTiStore(urls, security)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() {
+		tiStore.Close()
+		store.UnRegister("tikv")
+	}()
+
+	version, err := tiStore.CurrentVersion()
+	return version.Ver, errors.Trace(err)
+}
+
+// fetchHistoryDDLJobs gets all the history DDL jobs from the current snapshot of TiKV.
+func fetchHistoryDDLJobs(urls string, security tidbconfig.Security) (*historyDDLCache, error) {
+	tiStoreMu.Lock()
+	defer tiStoreMu.Unlock()
+
+	tiStore, err := createTiStore(urls, security)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		tiStore.Close()
+		store.UnRegister("tikv")
+	}()
+
+	version, err := tiStore.CurrentVersion()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	snapMeta, err := getSnapshotMeta(tiStore, version)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	jobs, err := snapMeta.GetAllHistoryDDLJobs()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// jobs from GetAllHistoryDDLJobs are sorted by job id, need sorted by schema version
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].BinlogInfo.SchemaVersion < jobs[j].BinlogInfo.SchemaVersion
+	})
+	return &historyDDLCache{Version: int64(version.Ver), Jobs: jobs}, nil
+}
@@ -0,0 +1,203 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"gotest.tools/assert"
+)
+
+func TestHistoryDDLCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history-ddl.json")
+
+	r := &PITR{cfg: &Config{HistoryDDLCache: file}}
+	_, err = r.getHistoryDDLJobs(context.Background(), 100)
+	assert.ErrorContains(t, err, "neither pd-urls nor tidb-status-addr is set")
+
+	cache := &historyDDLCache{
+		Version: 100,
+		Jobs: []*model.Job{
+			{ID: 1, Query: "create database test", BinlogInfo: &model.HistoryInfo{SchemaVersion: 1, FinishedTS: 10}},
+			{ID: 2, Query: "create table test.t(id int)", BinlogInfo: &model.HistoryInfo{SchemaVersion: 2, FinishedTS: 20}},
+		},
+	}
+	err = saveHistoryDDLCache(file, cache)
+	assert.Assert(t, err == nil)
+	loaded, err := loadHistoryDDLCache(file)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, loaded.Version, int64(100))
+	assert.Equal(t, len(loaded.Jobs), 2)
+	assert.Equal(t, loaded.Jobs[1].Query, "create table test.t(id int)")
+	assert.Equal(t, loaded.Jobs[1].BinlogInfo.FinishedTS, uint64(20))
+
+	// the cache is older than begin ts
+	_, err = r.getHistoryDDLJobs(context.Background(), 101)
+	assert.ErrorContains(t, err, "doesn't cover")
+
+	r.filter = newTableFilter(r.cfg)
+	jobs, err := r.loadHistoryDDLJobs(context.Background(), 15)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, len(jobs), 1)
+	assert.Equal(t, jobs[0].ID, int64(1))
+	assert.Assert(t, r.historyDDLs != nil)
+}
+
+func TestWithBackoff(t *testing.T) {
+	calls := 0
+	err := withBackoff(context.Background(), 0, func() error {
+		calls++
+		return errors.New("unavailable")
+	})
+	assert.ErrorContains(t, err, "unavailable")
+	assert.Equal(t, calls, 1)
+
+	calls = 0
+	err = withBackoff(context.Background(), 2, func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, calls, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = withBackoff(ctx, 3, func() error {
+		calls++
+		return errors.New("unavailable")
+	})
+	assert.Equal(t, errors.Cause(err), context.Canceled)
+	assert.Equal(t, calls, 1)
+}
+
+func TestReadHistoryDDLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// the jobs of `/ddl/history` are sorted by id
+	file := filepath.Join(dir, "history.json")
+	err = ioutil.WriteFile(file, []byte(`[
+		{"id": 3, "query": "alter table test.t add column c int", "binlog": {"SchemaVersion": 3, "FinishedTS": 30}},
+		{"id": 2, "query": "create table test.t(id int)", "binlog": {"SchemaVersion": 2, "FinishedTS": 20}}
+	]`), 0600)
+	assert.Assert(t, err == nil)
+	cache, err := readHistoryDDLFile(file)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, cache.Version, int64(0))
+	assert.Equal(t, len(cache.Jobs), 2)
+	assert.Equal(t, cache.Jobs[0].ID, int64(2))
+
+	r := &PITR{cfg: &Config{HistoryDDLFile: file}}
+	r.filter = newTableFilter(r.cfg)
+	assert.Assert(t, r.loadsHistoryDDLs())
+	jobs, err := r.loadHistoryDDLJobs(context.Background(), 25)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, len(jobs), 1)
+	assert.Equal(t, jobs[0].Query, "create table test.t(id int)")
+
+	// the file of history-ddl-cache
+	err = saveHistoryDDLCache(file, &historyDDLCache{Version: 100, Jobs: cache.Jobs})
+	assert.Assert(t, err == nil)
+	cache, err = readHistoryDDLFile(file)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, cache.Version, int64(100))
+	assert.Equal(t, len(cache.Jobs), 2)
+
+	err = ioutil.WriteFile(file, []byte(`[{"id": 1, "query": "create database test"}]`), 0600)
+	assert.Assert(t, err == nil)
+	_, err = readHistoryDDLFile(file)
+	assert.ErrorContains(t, err, "has no binlog info")
+
+	r.cfg.HistoryDDLFile = filepath.Join(dir, "history.SQL")
+	assert.Assert(t, !r.loadsHistoryDDLs())
+}
+
+func TestParseUseStmt(t *testing.T) {
+	db, ok := parseUseStmt("USE `test`;")
+	assert.Assert(t, ok)
+	assert.Equal(t, db, "test")
+
+	db, ok = parseUseStmt(" use test ")
+	assert.Assert(t, ok)
+	assert.Equal(t, db, "test")
+
+	_, ok = parseUseStmt("create table user(id int)")
+	assert.Assert(t, !ok)
+}
+
+func TestFetchTiDBHistoryDDLJobs(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tidbHistoryDDLAPI {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		fmt.Fprint(w, `[
+			{"id": 3, "query": "alter table test.t add column c int", "binlog": {"SchemaVersion": 3, "FinishedTS": 30}},
+			{"id": 2, "query": "create table test.t(id int)", "binlog": {"SchemaVersion": 2, "FinishedTS": 20}}
+		]`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "history")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the address without a scheme uses http
+	addr := strings.TrimPrefix(server.URL, "http://")
+	r := &PITR{cfg: &Config{TiDBStatusAddr: addr, PDTimeout: 1, HistoryDDLCache: filepath.Join(dir, "cache.json")}, report: newRunReport()}
+	r.filter = newTableFilter(r.cfg)
+	assert.Equal(t, r.cfg.historyDDLSource(), ddlSourceTiDB)
+	assert.Assert(t, r.loadsHistoryDDLs())
+	jobs, err := r.loadHistoryDDLJobs(context.Background(), 25)
+	assert.NilError(t, err)
+	assert.Equal(t, len(jobs), 1)
+	assert.Equal(t, jobs[0].Query, "create table test.t(id int)")
+	assert.Assert(t, r.historyDDLs.Version > 30)
+
+	// the jobs are fetched once in a run, and saved to the cache
+	_, err = r.loadHistoryDDLJobs(context.Background(), 25)
+	assert.NilError(t, err)
+	assert.Equal(t, requests, 1)
+	cache, err := loadHistoryDDLCache(r.cfg.HistoryDDLCache)
+	assert.NilError(t, err)
+	assert.Equal(t, len(cache.Jobs), 2)
+	assert.Equal(t, cache.Source, "tidb "+addr)
+	assert.DeepEqual(t, r.report.HistoryDDLCache, &reportHistoryDDLCache{File: r.cfg.HistoryDDLCache, Version: cache.Version})
+
+	// the next run loads the cache
+	r = &PITR{cfg: r.cfg, report: newRunReport()}
+	_, err = r.getHistoryDDLJobs(context.Background(), 25)
+	assert.NilError(t, err)
+	assert.Equal(t, requests, 1)
+	assert.Assert(t, r.report.HistoryDDLCache.Hit)
+
+	// the cache of another cluster is not used
+	r = &PITR{cfg: r.cfg, report: newRunReport()}
+	r.cfg.TiDBStatusAddr = strings.Replace(addr, "127.0.0.1", "localhost", 1)
+	_, err = r.getHistoryDDLJobs(context.Background(), 25)
+	assert.NilError(t, err)
+	assert.Equal(t, requests, 2)
+	assert.Assert(t, !r.report.HistoryDDLCache.Hit)
+
+	_, err = fetchTiDBHistoryDDLJobs(context.Background(), server.URL+"/not-tidb", time.Second)
+	assert.ErrorContains(t, err, "404")
+}
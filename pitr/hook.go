@@ -0,0 +1,90 @@
+package pitr
+
+import (
+	"plugin"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// eventHookSymbol is the symbol exported by the event hook plugin, it should be a func(string) (pitr.EventHook, error),
+// which is called with event-hook-config.
+const eventHookSymbol = "NewEventHook"
+
+// EventHook customizes the merged output without changing the merge core, like filtering, counting or
+// transforming the rows. Reduce calls it with every DDL and every merged row of a table before they're
+// written to the output, in the order of the output and before route-rules renames the tables. The tables
+// are reduced concurrently, so the methods should be safe for concurrent use.
+//
+// The interface is stable, the methods will not be changed, so the plugins built with an older version
+// only need to be built again.
+type EventHook interface {
+	// OnEvent is called with a merged row of the binlog at commitTS, the event can be modified in place,
+	// and it's dropped from the output if false is returned.
+	OnEvent(commitTS int64, event *pb.Event) (bool, error)
+	// OnDDL is called with a DDL at commitTS, it's dropped from the output if false is returned, but it's
+	// still executed to track the schema.
+	OnDDL(commitTS int64, query string) (bool, error)
+	// Close is called when the run finishes.
+	Close() error
+}
+
+// NewEventHookFunc is the type of NewEventHook exported by the event hook plugin.
+type NewEventHookFunc = func(config string) (EventHook, error)
+
+// loadEventHook opens the Go plugin built by `go build -buildmode=plugin` and creates the event hook with config.
+func loadEventHook(file string, config string) (EventHook, error) {
+	p, err := plugin.Open(file)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open event hook plugin %s", file)
+	}
+	sym, err := p.Lookup(eventHookSymbol)
+	if err != nil {
+		return nil, errors.Annotatef(err, "event hook plugin %s", file)
+	}
+	newHook, ok := sym.(NewEventHookFunc)
+	if !ok {
+		return nil, errors.Errorf("%s of event hook plugin %s should be a func(string) (pitr.EventHook, error), but got %T",
+			eventHookSymbol, file, sym)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		return nil, errors.Annotatef(err, "create event hook by plugin %s", file)
+	}
+	return hook, nil
+}
+
+// SetEventHook sets the hook called by Reduce, nil means no hook. It's used to run PITR as a library, or
+// event-hook-plugin can be set to load the hook from a Go plugin.
+func (r *PITR) SetEventHook(hook EventHook) {
+	r.hook = hook
+}
+
+// applyHook calls the hook with the binlog, the events dropped by the hook are removed from the binlog, and
+// false is returned if the whole binlog is dropped.
+func applyHook(hook EventHook, binlog *pb.Binlog) (bool, error) {
+	if hook == nil {
+		return true, nil
+	}
+	if binlog.Tp == pb.BinlogType_DDL {
+		keep, err := hook.OnDDL(binlog.CommitTs, string(binlog.DdlQuery))
+		return keep, errors.Annotatef(err, "event hook on DDL at commit ts %d", binlog.CommitTs)
+	}
+
+	events := binlog.GetDmlData().GetEvents()
+	kept := events[:0]
+	for i := range events {
+		keep, err := hook.OnEvent(binlog.CommitTs, &events[i])
+		if err != nil {
+			return false, errors.Annotatef(err, "event hook on event at commit ts %d", binlog.CommitTs)
+		}
+		if keep {
+			kept = append(kept, events[i])
+		}
+	}
+	if len(kept) == 0 {
+		return false, nil
+	}
+	binlog.DmlData.Events = kept
+	return true, nil
+}
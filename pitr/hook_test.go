@@ -0,0 +1,69 @@
+package pitr
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+// testHook drops the deletes and the DDLs dropping tables, and counts the rows.
+type testHook struct {
+	sync.Mutex
+	rows   int
+	closed bool
+}
+
+func (h *testHook) OnEvent(commitTS int64, event *pb.Event) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+	h.rows++
+	return event.GetTp() != pb.EventType_Delete, nil
+}
+
+func (h *testHook) OnDDL(commitTS int64, query string) (bool, error) {
+	return !strings.HasPrefix(strings.ToLower(query), "drop table"), nil
+}
+
+func (h *testHook) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestEventHook(t *testing.T) {
+	hook := &testHook{}
+	w := &collectWriter{}
+	tm := NewTableMerge("", "", w)
+	tm.name = "test_t1"
+	tm.hook = hook
+
+	genBinlog := func(ts int64, events ...*Event) *pb.Binlog {
+		binlog := newDMLBinlog(ts)
+		for _, e := range events {
+			ev, err := e.toPb()
+			assert.NilError(t, err)
+			binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		}
+		return binlog
+	}
+	binlog := genBinlog(10,
+		genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0),
+		genSpillEvent(t, pb.EventType_Delete, 2, 2, 200, 0),
+	)
+	assert.NilError(t, tm.writeBinlog(binlog))
+	assert.NilError(t, tm.writeBinlog(genBinlog(20, genSpillEvent(t, pb.EventType_Delete, 3, 3, 300, 0))))
+	assert.NilError(t, tm.writeBinlog(genTestDDL("test", "t1", "truncate table test.t1", 30)))
+	assert.NilError(t, tm.writeBinlog(genTestDDL("test", "t1", "drop table test.t1", 40)))
+	assert.DeepEqual(t, w.events, []string{"Insert id=1 v=100", "DDL truncate table test.t1"})
+	assert.Equal(t, hook.rows, 3)
+
+	r := &PITR{}
+	r.SetEventHook(hook)
+	assert.NilError(t, r.Close())
+	assert.Assert(t, hook.closed)
+
+	_, err := loadEventHook("not-exist.so", "")
+	assert.ErrorContains(t, err, "open event hook plugin not-exist.so")
+}
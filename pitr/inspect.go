@@ -0,0 +1,220 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// inspectedDDL is a DDL binlog in the inspected file.
+type inspectedDDL struct {
+	CommitTS int64  `json:"commit-ts"`
+	Query    string `json:"query"`
+}
+
+// fileInspection is the summary of a binlog file printed by the inspect subcommand.
+type fileInspection struct {
+	File string `json:"file"`
+	Size int64  `json:"size"`
+
+	FirstCommitTS int64 `json:"first-commit-ts"`
+	LastCommitTS  int64 `json:"last-commit-ts"`
+	Binlogs       int64 `json:"binlogs"`
+
+	// Tables is the events of every table, the key is `schema`.`table`
+	Tables map[string]*tableSummary `json:"tables"`
+	DDLs   []inspectedDDL           `json:"ddls"`
+	// Gap is the damaged region skipped by relax-corruption, nil if the file is not corrupted
+	Gap *corruptionGap `json:"gap,omitempty"`
+}
+
+func (s *fileInspection) table(schema, table string) *tableSummary {
+	key := quoteSchema(schema, table)
+	ts, ok := s.Tables[key]
+	if !ok {
+		ts = &tableSummary{}
+		s.Tables[key] = ts
+	}
+	return ts
+}
+
+func (s *fileInspection) addBinlog(binlog *pb.Binlog) error {
+	s.Binlogs++
+	if s.FirstCommitTS == 0 || binlog.CommitTs < s.FirstCommitTS {
+		s.FirstCommitTS = binlog.CommitTs
+	}
+	if binlog.CommitTs > s.LastCommitTS {
+		s.LastCommitTS = binlog.CommitTs
+	}
+
+	switch binlog.Tp {
+	case pb.BinlogType_DML:
+		for _, event := range binlog.GetDmlData().GetEvents() {
+			ts := s.table(event.GetSchemaName(), event.GetTableName())
+			switch event.GetTp() {
+			case pb.EventType_Insert:
+				ts.Inserts++
+			case pb.EventType_Update:
+				ts.Updates++
+			case pb.EventType_Delete:
+				ts.Deletes++
+			}
+		}
+	case pb.BinlogType_DDL:
+		query := string(binlog.DdlQuery)
+		s.DDLs = append(s.DDLs, inspectedDDL{CommitTS: binlog.CommitTs, Query: query})
+		schema, table, err := parserSchemaTableFromDDL(query)
+		if err != nil {
+			return errors.Annotatef(err, "parse ddl %s", query)
+		}
+		s.table(schema, table).DDLs++
+	}
+	return nil
+}
+
+// print prints the summary in human readable format.
+func (s *fileInspection) print(w io.Writer) {
+	fmt.Fprintf(w, "file: %s\n", redactStorageURI(s.File))
+	fmt.Fprintf(w, "  size: %d bytes (%s)\n", s.Size, formatSize(s.Size))
+	fmt.Fprintf(w, "  binlogs: %d\n", s.Binlogs)
+	if s.Binlogs > 0 {
+		fmt.Fprintf(w, "  first commit ts: %s\n", formatTSO(s.FirstCommitTS))
+		fmt.Fprintf(w, "  last commit ts: %s\n", formatTSO(s.LastCommitTS))
+	}
+	if s.Gap != nil {
+		fmt.Fprintf(w, "  damaged at offset %d, skipped by %s: %s\n", s.Gap.Offset, s.Gap.Mode, s.Gap.Error)
+	}
+
+	tables := make([]string, 0, len(s.Tables))
+	for table := range s.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	fmt.Fprintf(w, "  tables: %d\n", len(tables))
+	if len(tables) != 0 {
+		fmt.Fprintf(w, "    %-40s %12s %12s %12s %8s\n", "table", "insert", "update", "delete", "ddl")
+		for _, table := range tables {
+			ts := s.Tables[table]
+			fmt.Fprintf(w, "    %-40s %12d %12d %12d %8d\n", table, ts.Inserts, ts.Updates, ts.Deletes, ts.DDLs)
+		}
+	}
+	fmt.Fprintf(w, "  ddls: %d\n", len(s.DDLs))
+	for _, ddl := range s.DDLs {
+		fmt.Fprintf(w, "    %s %s\n", formatTSO(ddl.CommitTS), ddl.Query)
+	}
+}
+
+// inspectFile scans all the binlogs in file, the damaged region is handled by relax.
+func inspectFile(file, relax string) (*fileInspection, error) {
+	s := &fileInspection{File: file, Tables: make(map[string]*tableSummary)}
+	gap, err := scanSourceBinlogFile(file, relax, runOptions{}, func(binlog *pb.Binlog, _ int64) error {
+		return s.addBinlog(binlog)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.Gap = gap
+
+	// the size before decompressing
+	rc, size, err := openBinlogFile(file, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rc.Close()
+	s.Size = size
+	return s, nil
+}
+
+// inspectPaths returns the binlog files of paths, a path is a binlog file, or a directory or storage uri
+// whose binlog files are returned in order.
+func inspectPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		var isDir bool
+		if strings.Contains(p, "://") {
+			_, name, err := splitStorageURI(p)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			isDir = len(filterBinlogNames([]string{filepath.Base(name)})) == 0
+		} else {
+			info, err := os.Stat(p)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			isDir = info.IsDir()
+		}
+
+		if !isDir {
+			files = append(files, p)
+			continue
+		}
+		dirFiles, err := searchFiles(p)
+		if err != nil {
+			return nil, errors.Annotatef(err, "search binlog files in %s", redactStorageURI(p))
+		}
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// Inspect prints the commit ts range, the events of every table, the DDLs and the size of the binlog files
+// in paths, which helps to pick start-tso and stop-tso. a path can be a binlog file, or a directory or
+// storage uri of binlog files. the damaged files are handled by relax like relax-corruption, and the
+// summaries are printed as a JSON array if jsonFormat is true.
+func Inspect(w io.Writer, paths []string, relax string, jsonFormat bool) error {
+	if !isValidRelaxCorruption(relax) {
+		return errors.Errorf("unknown relax-corruption %s, should be %s, %s or %s", relax, relaxAbort, relaxSkipTail, relaxSkipFile)
+	}
+	files, err := inspectPaths(paths)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(files) == 0 {
+		return errors.New("no binlog file to inspect")
+	}
+
+	summaries := make([]*fileInspection, 0, len(files))
+	for _, file := range files {
+		s, err := inspectFile(file, relax)
+		if err != nil {
+			return errors.Annotatef(err, "inspect %s", redactStorageURI(file))
+		}
+		if !jsonFormat {
+			s.print(w)
+		}
+		summaries = append(summaries, s)
+	}
+
+	if jsonFormat {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Trace(enc.Encode(summaries))
+	}
+
+	var size, first, last int64
+	for _, s := range summaries {
+		size += s.Size
+		if s.Binlogs == 0 {
+			continue
+		}
+		if first == 0 || s.FirstCommitTS < first {
+			first = s.FirstCommitTS
+		}
+		if s.LastCommitTS > last {
+			last = s.LastCommitTS
+		}
+	}
+	fmt.Fprintf(w, "total: %d files, %d bytes (%s)\n", len(summaries), size, formatSize(size))
+	if first != 0 {
+		fmt.Fprintf(w, "commit ts: [%s, %s]\n", formatTSO(first), formatTSO(last))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	var data []byte
+	for _, binlog := range []*pb.Binlog{
+		genTestDDL("test", "tb1", "create table test.tb1 (a int primary key)", 100),
+		genTestDML("test", "tb1", 200),
+		genTestDML("test", "tb2", 300),
+	} {
+		payload, err := binlog.Marshal()
+		assert.Assert(t, err == nil)
+		data = append(data, binlogfile.Encode(payload)...)
+	}
+	file := filepath.Join(dir, binlogfile.BinlogName(0))
+	assert.NilError(t, ioutil.WriteFile(file, data, 0600))
+
+	var sb strings.Builder
+	assert.NilError(t, Inspect(&sb, []string{dir}, relaxAbort, false))
+	out := sb.String()
+	assert.Assert(t, strings.Contains(out, "file: "+file+"\n"), out)
+	assert.Assert(t, strings.Contains(out, "binlogs: 3\n"), out)
+	assert.Assert(t, strings.Contains(out, "first commit ts: "+formatTSO(100)), out)
+	assert.Assert(t, strings.Contains(out, "last commit ts: "+formatTSO(300)), out)
+	assert.Assert(t, strings.Contains(out, "ddls: 1\n    "+formatTSO(100)+" create table test.tb1"), out)
+	assert.Assert(t, strings.Contains(out, "commit ts: ["+formatTSO(100)+", "+formatTSO(300)+"]"), out)
+
+	sb.Reset()
+	assert.NilError(t, Inspect(&sb, []string{file}, relaxAbort, true))
+	var summaries []*fileInspection
+	assert.NilError(t, json.Unmarshal([]byte(sb.String()), &summaries))
+	assert.Equal(t, len(summaries), 1)
+	assert.Equal(t, summaries[0].Size, int64(len(data)))
+	assert.DeepEqual(t, *summaries[0].Tables["`test`.`tb1`"], tableSummary{Inserts: 1, Updates: 1, Deletes: 1, DDLs: 1})
+	assert.DeepEqual(t, *summaries[0].Tables["`test`.`tb2`"], tableSummary{Inserts: 1, Updates: 1, Deletes: 1})
+
+	// the truncated tail is skipped
+	assert.NilError(t, ioutil.WriteFile(file, data[:len(data)-5], 0600))
+	assert.ErrorContains(t, Inspect(&sb, []string{file}, relaxAbort, false), "decode binlog file")
+	sb.Reset()
+	assert.NilError(t, Inspect(&sb, []string{file}, relaxSkipTail, false))
+	assert.Assert(t, strings.Contains(sb.String(), "skipped by skip-tail"), sb.String())
+
+	assert.ErrorContains(t, Inspect(&sb, []string{file}, "ignore", false), "unknown relax-corruption")
+	assert.ErrorContains(t, Inspect(&sb, []string{filepath.Join(dir, "empty")}, relaxAbort, false), "no such file")
+}
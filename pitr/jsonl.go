@@ -0,0 +1,158 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+const (
+	// outputFormatJSONL outputs an event in a JSON object per line, for audit systems or analysis by jq
+	outputFormatJSONL = "jsonl"
+
+	jsonlFileSuffix = ".jsonl"
+
+	// jsonlTypeDDL is the type of the JSON object of DDL binlog, the DML types are the lower case event types
+	jsonlTypeDDL = "ddl"
+)
+
+// jsonlEvent is the JSON object of an event in jsonl format, type is the first field so the lines can be
+// counted by prefix.
+type jsonlEvent struct {
+	Type     string `json:"type"`
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	CommitTS int64  `json:"commit-ts"`
+	// Before is the row before update or delete, After is the row after insert or update
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+	Query  string                 `json:"query,omitempty"`
+}
+
+// jsonlTypes is the type of every event type in jsonl format.
+var jsonlTypes = map[pb.EventType]string{
+	pb.EventType_Insert: "insert",
+	pb.EventType_Update: "update",
+	pb.EventType_Delete: "delete",
+}
+
+// jsonlPrefix returns the prefix of the lines of the type, like `{"type":"insert"`.
+func jsonlPrefix(tp string) string {
+	return fmt.Sprintf(`{"type":%q`, tp)
+}
+
+// jsonlEncoder encodes the events of binlogs to JSON objects.
+type jsonlEncoder struct{}
+
+func (jsonlEncoder) encode(binlog *pb.Binlog) ([]byte, error) {
+	lines, err := binlogToJSONL(binlog)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var data []byte
+	for _, line := range lines {
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+// binlogToJSONL returns the JSON objects of the events in binlog.
+func binlogToJSONL(binlog *pb.Binlog) ([][]byte, error) {
+	var events []*jsonlEvent
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		query := string(binlog.DdlQuery)
+		schema, table, err := parserSchemaTableFromDDL(query)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		events = append(events, &jsonlEvent{Type: jsonlTypeDDL, Schema: schema, Table: table, CommitTS: binlog.CommitTs, Query: query})
+	case pb.BinlogType_DML:
+		dmls := binlog.GetDmlData().GetEvents()
+		for i := range dmls {
+			ev := &dmls[i]
+			tp, ok := jsonlTypes[ev.GetTp()]
+			if !ok {
+				return nil, errors.Errorf("unknown event type %v", ev.GetTp())
+			}
+			event := &jsonlEvent{Type: tp, Schema: ev.GetSchemaName(), Table: ev.GetTableName(), CommitTS: binlog.CommitTs}
+			row, changed, err := jsonlRow(ev.GetRow(), ev.GetTp() == pb.EventType_Update)
+			if err != nil {
+				return nil, errors.Annotatef(err, "event of %s", quoteSchema(event.Schema, event.Table))
+			}
+			switch ev.GetTp() {
+			case pb.EventType_Insert:
+				event.After = row
+			case pb.EventType_Update:
+				event.Before, event.After = row, changed
+			case pb.EventType_Delete:
+				event.Before = row
+			}
+			events = append(events, event)
+		}
+	default:
+		return nil, errors.Errorf("unknown binlog type %v", binlog.Tp)
+	}
+
+	lines := make([][]byte, 0, len(events))
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// jsonlRow decodes the values of the row, and the changed values of update.
+func jsonlRow(row [][]byte, withChangedValue bool) (values, changed map[string]interface{}, err error) {
+	values = make(map[string]interface{}, len(row))
+	if withChangedValue {
+		changed = make(map[string]interface{}, len(row))
+	}
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if values[col.Name], err = jsonValue(col.Value, col.Tp[0]); err != nil {
+			return nil, nil, errors.Annotatef(err, "decode value of column %s", col.Name)
+		}
+		if withChangedValue {
+			if changed[col.Name], err = jsonValue(col.ChangedValue, col.Tp[0]); err != nil {
+				return nil, nil, errors.Annotatef(err, "decode changed value of column %s", col.Name)
+			}
+		}
+	}
+	return values, changed, nil
+}
+
+// jsonValue decodes the column value, numbers are kept as JSON numbers, binary values which are not
+// valid UTF-8 are encoded in base64, and other values are formatted as strings.
+func jsonValue(data []byte, tp byte) (interface{}, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	val = formatValue(val, tp)
+
+	switch v := val.GetValue().(type) {
+	case nil, int64, uint64, float32, float64, string:
+		return v, nil
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v), nil
+		}
+		return v, nil
+	case types.BinaryLiteral:
+		return []byte(v), nil
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
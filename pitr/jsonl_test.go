@@ -0,0 +1,68 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestBinlogToJSONL(t *testing.T) {
+	lines, err := binlogToJSONL(genTestDDL("test", "t1", "create table test.t1 (id int primary key, v int)", 100))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, toStrings(lines), []string{
+		`{"type":"ddl","schema":"test","table":"t1","commit-ts":100,"query":"create table test.t1 (id int primary key, v int)"}`,
+	})
+
+	for _, c := range []struct {
+		tp       pb.EventType
+		expected string
+	}{
+		{pb.EventType_Insert, `{"type":"insert","schema":"test","table":"t1","commit-ts":200,"after":{"id":1,"v":10}}`},
+		{pb.EventType_Update, `{"type":"update","schema":"test","table":"t1","commit-ts":200,"before":{"id":1,"v":10},"after":{"id":1,"v":11}}`},
+		{pb.EventType_Delete, `{"type":"delete","schema":"test","table":"t1","commit-ts":200,"before":{"id":1,"v":10}}`},
+	} {
+		lines, err := binlogToJSONL(genRowBinlog(c.tp, 1, 10, 200))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, toStrings(lines), []string{c.expected})
+		assert.Assert(t, strings.HasPrefix(c.expected, jsonlPrefix(jsonlTypes[c.tp])))
+	}
+}
+
+func toStrings(lines [][]byte) []string {
+	s := make([]string, 0, len(lines))
+	for _, line := range lines {
+		s = append(s, string(line))
+	}
+	return s
+}
+
+func TestJSONLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	w, err := newBinlogWriter(runOptions{}, outputFormatJSONL, filepath.Join(dir, "test_t1"), compressGzip, 0)
+	assert.NilError(t, err)
+	for _, binlog := range []*pb.Binlog{
+		genRowBinlog(pb.EventType_Insert, 1, 10, 200),
+		genRowBinlog(pb.EventType_Insert, 2, 10, 200),
+		genRowBinlog(pb.EventType_Update, 1, 10, 300),
+		genRowBinlog(pb.EventType_Delete, 2, 10, 400),
+	} {
+		assert.NilError(t, w.Write(binlog))
+	}
+	assert.NilError(t, w.Close())
+	_, err = os.Stat(filepath.Join(dir, "test_t1.jsonl.gz"))
+	assert.NilError(t, err)
+
+	counts, err := countOutputRows(dir, outputFormatJSONL, runOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(counts), 1)
+	assert.DeepEqual(t, *counts["test_t1"], rowCount{Inserts: 2, Deletes: 1})
+	assert.Equal(t, sqlFileTable("test_t1.000001.jsonl"), "test_t1")
+}
@@ -0,0 +1,366 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	ptypes "github.com/pingcap/parser/types"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	obinlog "github.com/pingcap/tidb-tools/tidb-binlog/slave_binlog_proto/go-binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultKafkaVersion = "0.8.2.0"
+	// drainer writes all the binlogs to partition 0 of the topic
+	kafkaPartitionID = 0
+)
+
+// kafkaPartition reads the messages of drainer in one partition of Kafka.
+type kafkaPartition interface {
+	// offsets returns the oldest offset and the offset of the next message to be produced
+	offsets() (oldest int64, newest int64, err error)
+	// consume calls fn for the messages in [from, end), it stops when fn returns errStopScan
+	consume(ctx context.Context, from, end int64, fn func(offset int64, value []byte) error) error
+	close() error
+}
+
+type saramaPartition struct {
+	topic    string
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+var _ kafkaPartition = &saramaPartition{}
+
+func newSaramaPartition(addrs []string, topic, version string) (*saramaPartition, error) {
+	cfg := sarama.NewConfig()
+	v, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg.Version = v
+	// the messages may be as large as the binlogs of a transaction
+	cfg.Consumer.Fetch.Default = 1 << 20
+	cfg.Consumer.Return.Errors = true
+
+	client, err := sarama.NewClient(addrs, cfg)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect to kafka %v", addrs)
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, errors.Trace(err)
+	}
+	return &saramaPartition{topic: topic, client: client, consumer: consumer}, nil
+}
+
+func (p *saramaPartition) offsets() (int64, int64, error) {
+	oldest, err := p.client.GetOffset(p.topic, kafkaPartitionID, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "get oldest offset of topic %s", p.topic)
+	}
+	newest, err := p.client.GetOffset(p.topic, kafkaPartitionID, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "get newest offset of topic %s", p.topic)
+	}
+	return oldest, newest, nil
+}
+
+func (p *saramaPartition) consume(ctx context.Context, from, end int64, fn func(offset int64, value []byte) error) error {
+	if from >= end {
+		return nil
+	}
+	pc, err := p.consumer.ConsumePartition(p.topic, kafkaPartitionID, from)
+	if err != nil {
+		return errors.Annotatef(err, "consume topic %s from offset %d", p.topic, from)
+	}
+	defer pc.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case err := <-pc.Errors():
+			return errors.Annotatef(err, "consume topic %s", p.topic)
+		case msg := <-pc.Messages():
+			if err := fn(msg.Offset, msg.Value); err != nil {
+				if errors.Cause(err) == errStopScan {
+					return nil
+				}
+				return errors.Trace(err)
+			}
+			if msg.Offset+1 >= end {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *saramaPartition) close() error {
+	if err := p.consumer.Close(); err != nil {
+		log.Warn("close kafka consumer failed", zap.Error(err))
+	}
+	return errors.Trace(p.client.Close())
+}
+
+// decodeKafkaBinlog decodes the message of drainer, and converts it to the binlog written by drainer's file sink.
+func decodeKafkaBinlog(value []byte) (*pb.Binlog, error) {
+	slave := &obinlog.Binlog{}
+	if err := slave.Unmarshal(value); err != nil {
+		return nil, errors.Annotate(err, "unmarshal kafka message")
+	}
+
+	switch slave.Type {
+	case obinlog.BinlogType_DDL:
+		ddl := slave.GetDdlData()
+		binlog, err := ddlBinlog(ddl.GetSchemaName(), string(ddl.GetDdlQuery()), slave.CommitTs)
+		return binlog, errors.Trace(err)
+
+	case obinlog.BinlogType_DML:
+		events := make([]pb.Event, 0, len(slave.GetDmlData().GetTables()))
+		for _, table := range slave.GetDmlData().GetTables() {
+			for _, mut := range table.GetMutations() {
+				event, err := kafkaMutationToEvent(table, mut)
+				if err != nil {
+					return nil, errors.Annotatef(err, "table %s", quoteSchema(table.GetSchemaName(), table.GetTableName()))
+				}
+				events = append(events, *event)
+			}
+		}
+		return &pb.Binlog{Tp: pb.BinlogType_DML, CommitTs: slave.CommitTs, DmlData: &pb.DMLData{Events: events}}, nil
+	}
+	return nil, errors.Errorf("unknown binlog type %d in kafka message", slave.Type)
+}
+
+// ddlBinlog returns the DDL binlog written by drainer, the query is prefixed with the use statement of
+// schema unless it creates a database.
+func ddlBinlog(schema, query string, commitTS int64) (*pb.Binlog, error) {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse DDL %s", query)
+	}
+	if _, ok := stmt.(*ast.CreateDatabaseStmt); ok || len(schema) == 0 {
+		query += ";"
+	} else {
+		query = fmt.Sprintf("use %s; %s;", quoteName(schema), query)
+	}
+	return &pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: commitTS, DdlQuery: []byte(query)}, nil
+}
+
+// kafkaMutationToEvent converts a row of kafka message to the event, for update the row of mutation is
+// the new values and change row is the old values.
+func kafkaMutationToEvent(table *obinlog.Table, mut *obinlog.TableMutation) (*pb.Event, error) {
+	var tp pb.EventType
+	switch mut.GetType() {
+	case obinlog.MutationType_Insert:
+		tp = pb.EventType_Insert
+	case obinlog.MutationType_Update:
+		tp = pb.EventType_Update
+	case obinlog.MutationType_Delete:
+		tp = pb.EventType_Delete
+	default:
+		return nil, errors.Errorf("unknown mutation type %v", mut.GetType())
+	}
+
+	infos := table.GetColumnInfo()
+	cols := mut.GetRow().GetColumns()
+	if len(cols) != len(infos) {
+		return nil, errors.Errorf("the row has %d columns, but the table has %d columns", len(cols), len(infos))
+	}
+	var changed []*obinlog.Column
+	if tp == pb.EventType_Update {
+		changed = mut.GetChangeRow().GetColumns()
+		if len(changed) != len(infos) {
+			return nil, errors.Errorf("the old row has %d columns, but the table has %d columns", len(changed), len(infos))
+		}
+	}
+
+	sc := &stmtctx.StatementContext{TimeZone: time.Local}
+	row := make([][]byte, 0, len(cols))
+	for i, info := range infos {
+		col := pb.Column{
+			Name:      info.GetName(),
+			Tp:        []byte{mysqlTypeByName(info.GetMysqlType())},
+			MysqlType: info.GetMysqlType(),
+		}
+		var err error
+		if tp == pb.EventType_Update {
+			// the value of update is the old value, and the changed value is the new value
+			if col.Value, err = codec.EncodeValue(sc, nil, kafkaColumnDatum(changed[i])); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if col.ChangedValue, err = codec.EncodeValue(sc, nil, kafkaColumnDatum(cols[i])); err != nil {
+				return nil, errors.Trace(err)
+			}
+		} else if col.Value, err = codec.EncodeValue(sc, nil, kafkaColumnDatum(cols[i])); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		data, err := col.Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row = append(row, data)
+	}
+
+	schema, name := table.GetSchemaName(), table.GetTableName()
+	return &pb.Event{SchemaName: &schema, TableName: &name, Tp: tp, Row: row}, nil
+}
+
+// kafkaColumnDatum returns the datum of the column value, the time and decimal values are strings,
+// and the enum and set values are their indexes.
+func kafkaColumnDatum(col *obinlog.Column) types.Datum {
+	switch {
+	case col.GetIsNull():
+		return types.Datum{}
+	case col.Int64Value != nil:
+		return types.NewIntDatum(col.GetInt64Value())
+	case col.Uint64Value != nil:
+		return types.NewUintDatum(col.GetUint64Value())
+	case col.DoubleValue != nil:
+		return types.NewFloat64Datum(col.GetDoubleValue())
+	case col.StringValue != nil:
+		return types.NewStringDatum(col.GetStringValue())
+	case col.BytesValue != nil:
+		return types.NewBytesDatum(col.GetBytesValue())
+	}
+	return types.Datum{}
+}
+
+// mysqlTypeByName returns the type of the name converted by types.TypeToStr.
+func mysqlTypeByName(name string) byte {
+	switch name {
+	case "decimal":
+		return mysql.TypeNewDecimal
+	case "date":
+		return mysql.TypeDate
+	}
+	for tp := 0; tp <= 0xff; tp++ {
+		if ptypes.TypeStr(byte(tp)) == name || ptypes.TypeToStr(byte(tp), "binary") == name {
+			return byte(tp)
+		}
+	}
+	return mysql.TypeVarString
+}
+
+// findKafkaOffset returns the first offset in [oldest, newest) whose binlog's commit ts is not less than ts,
+// the binlogs are written in the order of commit ts, so it's searched by binary search.
+func findKafkaOffset(ctx context.Context, p kafkaPartition, oldest, newest, ts int64) (int64, error) {
+	lo, hi := oldest, newest
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		var commitTS int64
+		err := p.consume(ctx, mid, mid+1, func(offset int64, value []byte) error {
+			binlog, err := decodeKafkaBinlog(value)
+			if err != nil {
+				return errors.Annotatef(err, "offset %d", offset)
+			}
+			commitTS = binlog.CommitTs
+			return errStopScan
+		})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if commitTS < ts {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// convertKafkaBinlogs writes the binlogs in [startTS, stopTS] of the partition to outDir in the format of
+// drainer's file sink, only the messages produced before it starts are read. It returns the number of binlogs.
+func convertKafkaBinlogs(ctx context.Context, p kafkaPartition, startTS, stopTS int64, outDir string) (int, error) {
+	oldest, newest, err := p.offsets()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	from := oldest
+	if startTS > 0 {
+		if from, err = findKafkaOffset(ctx, p, oldest, newest, startTS); err != nil {
+			return 0, errors.Annotate(err, "find the offset of start-tso")
+		}
+	}
+	log.Info("read binlogs from kafka", zap.Int64("oldest offset", oldest), zap.Int64("start offset", from),
+		zap.Int64("end offset", newest), zap.String("start-tso", formatTSO(startTS)))
+
+	binlogger, err := OpenMyBinlogger(outDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer binlogger.Close()
+
+	var count int
+	err = p.consume(ctx, from, newest, func(offset int64, value []byte) error {
+		binlog, err := decodeKafkaBinlog(value)
+		if err != nil {
+			return errors.Annotatef(err, "offset %d", offset)
+		}
+		if stopTS > 0 && binlog.CommitTs > stopTS {
+			return errStopScan
+		}
+		data, err := binlog.Marshal()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := binlogger.WriteTail(&tb.Entity{Payload: data}); err != nil {
+			return errors.Trace(err)
+		}
+		count++
+		return nil
+	})
+	return count, errors.Trace(err)
+}
+
+// kafkaConvertDir returns the dir to save the binlogs read from kafka, it's not in the temp dir because
+// the sub dirs of the temp dir are the temp files of tables.
+func kafkaConvertDir(tempDir string) string {
+	return filepath.Clean(tempDir) + "_kafka"
+}
+
+// readKafkaSource reads the binlogs from kafka to a dir, and returns the dir as the binlog dir.
+func (r *PITR) readKafkaSource(ctx context.Context) (string, error) {
+	addrs := strings.Split(r.cfg.KafkaAddrs, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	p, err := newSaramaPartition(addrs, r.cfg.KafkaTopic, r.cfg.KafkaVersion)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer p.close()
+
+	outDir := kafkaConvertDir(r.cfg.TempDir)
+	if err := os.RemoveAll(outDir); err != nil {
+		return "", errors.Trace(err)
+	}
+	count, err := convertKafkaBinlogs(ctx, p, r.cfg.StartTSO, r.cfg.StopTSO, outDir)
+	if err != nil {
+		return "", errors.Annotatef(err, "read binlogs from kafka topic %s", r.cfg.KafkaTopic)
+	}
+	if count == 0 {
+		return "", errors.Errorf("no binlog in kafka topic %s is in the range [%s, %s]",
+			r.cfg.KafkaTopic, formatTSO(r.cfg.StartTSO), formatTSO(r.cfg.StopTSO))
+	}
+	log.Info("binlogs are read from kafka", zap.String("topic", r.cfg.KafkaTopic), zap.String("output", outDir), zap.Int("binlogs", count))
+	return outDir, nil
+}
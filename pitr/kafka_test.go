@@ -0,0 +1,136 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	obinlog "github.com/pingcap/tidb-tools/tidb-binlog/slave_binlog_proto/go-binlog"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+// memPartition is a kafka partition in memory, the offset of the first message is base.
+type memPartition struct {
+	base     int64
+	messages [][]byte
+	// reads is the number of messages consumed
+	reads int
+}
+
+func (p *memPartition) offsets() (int64, int64, error) {
+	return p.base, p.base + int64(len(p.messages)), nil
+}
+
+func (p *memPartition) consume(ctx context.Context, from, end int64, fn func(offset int64, value []byte) error) error {
+	for offset := from; offset < end; offset++ {
+		p.reads++
+		if err := fn(offset, p.messages[offset-p.base]); err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *memPartition) close() error {
+	return nil
+}
+
+func kafkaDDL(t *testing.T, commitTS int64, schema, query string) []byte {
+	data, err := (&obinlog.Binlog{
+		Type:     obinlog.BinlogType_DDL,
+		CommitTs: commitTS,
+		DdlData:  &obinlog.DDLData{SchemaName: &schema, DdlQuery: []byte(query)},
+	}).Marshal()
+	assert.NilError(t, err)
+	return data
+}
+
+func kafkaRow(id int64, name string) *obinlog.Row {
+	return &obinlog.Row{Columns: []*obinlog.Column{{Int64Value: &id}, {StringValue: &name}}}
+}
+
+func kafkaDML(t *testing.T, commitTS int64, muts ...*obinlog.TableMutation) []byte {
+	schema, table := "test", "t1"
+	data, err := (&obinlog.Binlog{
+		Type:     obinlog.BinlogType_DML,
+		CommitTs: commitTS,
+		DmlData: &obinlog.DMLData{Tables: []*obinlog.Table{{
+			SchemaName: &schema,
+			TableName:  &table,
+			ColumnInfo: []*obinlog.ColumnInfo{{Name: "id", MysqlType: "int", IsPrimaryKey: true}, {Name: "name", MysqlType: "varchar"}},
+			Mutations:  muts,
+		}}},
+	}).Marshal()
+	assert.NilError(t, err)
+	return data
+}
+
+func TestConvertKafkaBinlogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	insert, update := obinlog.MutationType_Insert, obinlog.MutationType_Update
+	p := &memPartition{base: 100, messages: [][]byte{
+		kafkaDDL(t, 10, "", "create database test"),
+		kafkaDDL(t, 20, "test", "create table t1 (id int primary key, name varchar(20))"),
+		kafkaDML(t, 30, &obinlog.TableMutation{Type: &insert, Row: kafkaRow(1, "a")}),
+		kafkaDML(t, 40, &obinlog.TableMutation{Type: &update, Row: kafkaRow(1, "b"), ChangeRow: kafkaRow(1, "a")}),
+		kafkaDML(t, 50, &obinlog.TableMutation{Type: &insert, Row: kafkaRow(2, "c")}),
+	}}
+
+	offset, err := findKafkaOffset(context.Background(), p, 100, 105, 35)
+	assert.NilError(t, err)
+	assert.Equal(t, offset, int64(103))
+	offset, err = findKafkaOffset(context.Background(), p, 100, 105, 60)
+	assert.NilError(t, err)
+	assert.Equal(t, offset, int64(105))
+
+	outDir := filepath.Join(dir, "out")
+	count, err := convertKafkaBinlogs(context.Background(), p, 20, 40, outDir)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 3)
+
+	files, err := searchFiles(outDir)
+	assert.NilError(t, err)
+	var converted []*pb.Binlog
+	for _, file := range files {
+		assert.NilError(t, scanBinlogFile(file, runOptions{}, func(binlog *pb.Binlog) error {
+			converted = append(converted, binlog)
+			return nil
+		}))
+	}
+	assert.Equal(t, len(converted), 3)
+	assert.Equal(t, converted[0].Tp, pb.BinlogType_DDL)
+	assert.Equal(t, string(converted[0].DdlQuery), "use `test`; create table t1 (id int primary key, name varchar(20));")
+
+	assert.Equal(t, converted[2].CommitTs, int64(40))
+	events := converted[2].DmlData.Events
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].GetTp(), pb.EventType_Update)
+	assert.Equal(t, events[0].GetSchemaName()+"."+events[0].GetTableName(), "test.t1")
+
+	col := &pb.Column{}
+	assert.NilError(t, col.Unmarshal(events[0].Row[1]))
+	assert.Equal(t, col.Name, "name")
+	assert.DeepEqual(t, col.Tp, []byte{mysql.TypeVarchar})
+	_, oldValue, err := codec.DecodeOne(col.Value)
+	assert.NilError(t, err)
+	_, newValue, err := codec.DecodeOne(col.ChangedValue)
+	assert.NilError(t, err)
+	assert.Equal(t, oldValue.GetString(), "a")
+	assert.Equal(t, newValue.GetString(), "b")
+
+	// the database is created without use
+	ddl, err := decodeKafkaBinlog(p.messages[0])
+	assert.NilError(t, err)
+	assert.Equal(t, string(ddl.DdlQuery), "create database test;")
+}
@@ -0,0 +1,467 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	obinlog "github.com/pingcap/tidb-tools/tidb-binlog/slave_binlog_proto/go-binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+const (
+	// kafkaProtocolOpenBinlog is the protocol of drainer's kafka sink, a binlog is a message
+	kafkaProtocolOpenBinlog = "open-binlog"
+	// kafkaProtocolCanalJSON is the flat message of canal in JSON, a row is a message
+	kafkaProtocolCanalJSON = "canal-json"
+
+	defaultKafkaMaxMessageBytes = 1 << 30
+)
+
+// kafkaSink publishes the merged binlogs to partition 0 of a topic, so the consumers read them in
+// the order of commit ts.
+type kafkaSink struct {
+	topic    string
+	producer sarama.SyncProducer
+	encode   func(binlog *pb.Binlog) ([][]byte, error)
+	maxBytes int
+}
+
+var _ binlogSink = &kafkaSink{}
+
+func newKafkaSink(cfg KafkaSinkConfig) (*kafkaSink, error) {
+	sc := sarama.NewConfig()
+	v, err := sarama.ParseKafkaVersion(cfg.Version)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sc.Version = v
+	sc.Producer.Partitioner = sarama.NewManualPartitioner
+	sc.Producer.RequiredAcks = sarama.WaitForAll
+	sc.Producer.Return.Successes = true
+	sc.Producer.MaxMessageBytes = cfg.MaxMessageBytes
+
+	var addrs []string
+	for _, addr := range strings.Split(cfg.Addrs, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+	producer, err := sarama.NewSyncProducer(addrs, sc)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect to kafka %v", addrs)
+	}
+	return newKafkaSinkWithProducer(producer, cfg), nil
+}
+
+func newKafkaSinkWithProducer(producer sarama.SyncProducer, cfg KafkaSinkConfig) *kafkaSink {
+	s := &kafkaSink{topic: cfg.Topic, producer: producer, maxBytes: cfg.MaxMessageBytes, encode: encodeOpenBinlog}
+	if cfg.Protocol == kafkaProtocolCanalJSON {
+		s.encode = encodeCanalJSON
+	}
+	return s
+}
+
+// Apply sends the messages of binlog, it returns after all of them are acked.
+func (s *kafkaSink) Apply(binlog *pb.Binlog) error {
+	values, err := s.encode(binlog)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	msgs := make([]*sarama.ProducerMessage, 0, len(values))
+	for _, value := range values {
+		if len(value) > s.maxBytes {
+			return errors.Errorf("the message of size %d is larger than max-message-bytes %d", len(value), s.maxBytes)
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{Topic: s.topic, Partition: kafkaPartitionID, Value: sarama.ByteEncoder(value)})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.Annotatef(s.producer.SendMessages(msgs), "send messages to topic %s", s.topic)
+}
+
+// Close closes the producer, all the messages are already acked by Apply.
+func (s *kafkaSink) Close() error {
+	return errors.Trace(s.producer.Close())
+}
+
+func (s *kafkaSink) abort() {
+	if err := s.producer.Close(); err != nil {
+		log.Warn("close kafka producer failed", zap.Error(err))
+	}
+}
+
+// columnValue decodes the value of column, the time, decimal and JSON values are strings, and the
+// enum and set values are their indexes.
+func columnValue(data []byte, tp byte) (interface{}, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	val = formatValue(val, tp)
+	return val.GetValue(), nil
+}
+
+// encodeOpenBinlog encodes binlog as a message of drainer's kafka sink, which can be read by --kafka-addrs.
+func encodeOpenBinlog(binlog *pb.Binlog) ([][]byte, error) {
+	msg := &obinlog.Binlog{CommitTs: binlog.CommitTs}
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		schema, _, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+		if err != nil {
+			return nil, errors.Annotatef(err, "parse DDL %s", binlog.DdlQuery)
+		}
+		query, err := lastStatement(string(binlog.DdlQuery))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		msg.Type = obinlog.BinlogType_DDL
+		msg.DdlData = &obinlog.DDLData{SchemaName: &schema, DdlQuery: []byte(query)}
+	case pb.BinlogType_DML:
+		msg.Type = obinlog.BinlogType_DML
+		msg.DmlData = &obinlog.DMLData{}
+		var table *obinlog.Table
+		events := binlog.GetDmlData().GetEvents()
+		for i := range events {
+			ev := &events[i]
+			cols, err := decodeColumns(ev.GetRow())
+			if err != nil {
+				return nil, errors.Annotatef(err, "table %s", quoteSchema(ev.GetSchemaName(), ev.GetTableName()))
+			}
+			// the events of a table are together after merging
+			if table == nil || table.GetSchemaName() != ev.GetSchemaName() || table.GetTableName() != ev.GetTableName() {
+				schema, name := ev.GetSchemaName(), ev.GetTableName()
+				table = &obinlog.Table{SchemaName: &schema, TableName: &name}
+				for _, col := range cols {
+					table.ColumnInfo = append(table.ColumnInfo, &obinlog.ColumnInfo{Name: col.Name, MysqlType: col.MysqlType})
+				}
+				msg.DmlData.Tables = append(msg.DmlData.Tables, table)
+			}
+
+			mut, err := openBinlogMutation(ev.GetTp(), cols)
+			if err != nil {
+				return nil, errors.Annotatef(err, "table %s", quoteSchema(ev.GetSchemaName(), ev.GetTableName()))
+			}
+			table.Mutations = append(table.Mutations, mut)
+		}
+	default:
+		return nil, errors.Errorf("unknown binlog type %v", binlog.Tp)
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return [][]byte{data}, nil
+}
+
+func decodeColumns(row [][]byte) ([]*pb.Column, error) {
+	cols := make([]*pb.Column, 0, len(row))
+	for _, data := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(data); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// openBinlogMutation converts the row to mutation, for update the row of mutation is the new values and
+// change row is the old values.
+func openBinlogMutation(tp pb.EventType, cols []*pb.Column) (*obinlog.TableMutation, error) {
+	var mutType obinlog.MutationType
+	switch tp {
+	case pb.EventType_Insert:
+		mutType = obinlog.MutationType_Insert
+	case pb.EventType_Update:
+		mutType = obinlog.MutationType_Update
+	case pb.EventType_Delete:
+		mutType = obinlog.MutationType_Delete
+	default:
+		return nil, errors.Errorf("unknown event type %v", tp)
+	}
+
+	mut := &obinlog.TableMutation{Type: &mutType, Row: &obinlog.Row{}}
+	if tp == pb.EventType_Update {
+		mut.ChangeRow = &obinlog.Row{}
+	}
+	for _, col := range cols {
+		value, err := openBinlogColumn(col.Value, col.Tp[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", col.Name)
+		}
+		if tp != pb.EventType_Update {
+			mut.Row.Columns = append(mut.Row.Columns, value)
+			continue
+		}
+		changed, err := openBinlogColumn(col.ChangedValue, col.Tp[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", col.Name)
+		}
+		mut.Row.Columns = append(mut.Row.Columns, changed)
+		mut.ChangeRow.Columns = append(mut.ChangeRow.Columns, value)
+	}
+	return mut, nil
+}
+
+func openBinlogColumn(data []byte, tp byte) (*obinlog.Column, error) {
+	value, err := columnValue(data, tp)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	col := &obinlog.Column{}
+	switch v := value.(type) {
+	case nil:
+		isNull := true
+		col.IsNull = &isNull
+	case int64:
+		col.Int64Value = &v
+	case uint64:
+		col.Uint64Value = &v
+	case float32:
+		f := float64(v)
+		col.DoubleValue = &f
+	case float64:
+		col.DoubleValue = &v
+	case string:
+		col.StringValue = &v
+	case []byte:
+		col.BytesValue = v
+	case types.BinaryLiteral:
+		col.BytesValue = v
+	default:
+		s := fmt.Sprintf("%v", v)
+		col.StringValue = &s
+	}
+	return col, nil
+}
+
+// lastStatement returns the last statement of the DDL, which doesn't include the `use db` statement.
+func lastStatement(ddl string) (string, error) {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return "", errors.Annotatef(err, "parse DDL %s", ddl)
+	}
+	if len(stmts) == 0 {
+		return "", errors.Errorf("no statement in DDL %s", ddl)
+	}
+	return strings.TrimSuffix(strings.TrimSpace(stmts[len(stmts)-1].Text()), ";"), nil
+}
+
+// canalMessage is the flat message of canal, the values are strings.
+type canalMessage struct {
+	ID        int64                `json:"id"`
+	Database  string               `json:"database"`
+	Table     string               `json:"table"`
+	PKNames   []string             `json:"pkNames"`
+	IsDDL     bool                 `json:"isDdl"`
+	Type      string               `json:"type"`
+	ES        int64                `json:"es"`
+	TS        int64                `json:"ts"`
+	SQL       string               `json:"sql"`
+	SQLType   map[string]int       `json:"sqlType"`
+	MySQLType map[string]string    `json:"mysqlType"`
+	Data      []map[string]*string `json:"data"`
+	Old       []map[string]*string `json:"old"`
+	// TiDB is the extension of TiCDC, which keeps the commit ts
+	TiDB struct {
+		CommitTs int64 `json:"commitTs"`
+	} `json:"_tidb"`
+}
+
+// encodeCanalJSON encodes the binlog as canal-json messages, a DDL or a row is a message.
+func encodeCanalJSON(binlog *pb.Binlog) ([][]byte, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	es := binlog.CommitTs >> 18
+	var msgs []*canalMessage
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		schema, table, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+		if err != nil {
+			return nil, errors.Annotatef(err, "parse DDL %s", binlog.DdlQuery)
+		}
+		query, err := lastStatement(string(binlog.DdlQuery))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		msgs = append(msgs, &canalMessage{Database: schema, Table: table, IsDDL: true, Type: canalDDLType(query), ES: es, TS: now, SQL: query})
+	case pb.BinlogType_DML:
+		events := binlog.GetDmlData().GetEvents()
+		for i := range events {
+			msg, err := canalRowMessage(&events[i])
+			if err != nil {
+				return nil, errors.Annotatef(err, "table %s", quoteSchema(events[i].GetSchemaName(), events[i].GetTableName()))
+			}
+			msg.ES, msg.TS = es, now
+			msgs = append(msgs, msg)
+		}
+	default:
+		return nil, errors.Errorf("unknown binlog type %v", binlog.Tp)
+	}
+
+	values := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		msg.TiDB.CommitTs = binlog.CommitTs
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+func canalRowMessage(ev *pb.Event) (*canalMessage, error) {
+	cols, err := decodeColumns(ev.GetRow())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	msg := &canalMessage{
+		Database:  ev.GetSchemaName(),
+		Table:     ev.GetTableName(),
+		SQLType:   make(map[string]int, len(cols)),
+		MySQLType: make(map[string]string, len(cols)),
+	}
+	switch ev.GetTp() {
+	case pb.EventType_Insert:
+		msg.Type = "INSERT"
+	case pb.EventType_Update:
+		msg.Type = "UPDATE"
+	case pb.EventType_Delete:
+		msg.Type = "DELETE"
+	default:
+		return nil, errors.Errorf("unknown event type %v", ev.GetTp())
+	}
+
+	data := make(map[string]*string, len(cols))
+	var old map[string]*string
+	if ev.GetTp() == pb.EventType_Update {
+		old = make(map[string]*string, len(cols))
+	}
+	for _, col := range cols {
+		msg.SQLType[col.Name] = jdbcType(col.Tp[0])
+		msg.MySQLType[col.Name] = col.MysqlType
+		value, err := canalValue(col.Value, col.Tp[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", col.Name)
+		}
+		if old == nil {
+			data[col.Name] = value
+			continue
+		}
+		// the data of update is the new values, and old is the old values
+		old[col.Name] = value
+		if data[col.Name], err = canalValue(col.ChangedValue, col.Tp[0]); err != nil {
+			return nil, errors.Annotatef(err, "column %s", col.Name)
+		}
+	}
+	msg.Data = []map[string]*string{data}
+	if old != nil {
+		msg.Old = []map[string]*string{old}
+	}
+	return msg, nil
+}
+
+// canalValue formats the value as canal, NULL is nil, the enum and set values are their names.
+func canalValue(data []byte, tp byte) (*string, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var s string
+	switch tp {
+	case mysql.TypeEnum:
+		if val.IsNull() {
+			return nil, nil
+		}
+		s = val.GetMysqlEnum().Name
+	case mysql.TypeSet:
+		if val.IsNull() {
+			return nil, nil
+		}
+		s = val.GetMysqlSet().Name
+	default:
+		val = formatValue(val, tp)
+		switch v := val.GetValue().(type) {
+		case nil:
+			return nil, nil
+		case []byte:
+			s = string(v)
+		case types.BinaryLiteral:
+			s = string(v)
+		default:
+			s = fmt.Sprintf("%v", v)
+		}
+	}
+	return &s, nil
+}
+
+// canalDDLType returns the event type of DDL in canal.
+func canalDDLType(query string) string {
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	if err != nil {
+		return "QUERY"
+	}
+	switch stmt.(type) {
+	case *ast.CreateTableStmt:
+		return "CREATE"
+	case *ast.DropTableStmt:
+		return "ERASE"
+	case *ast.AlterTableStmt:
+		return "ALTER"
+	case *ast.TruncateTableStmt:
+		return "TRUNCATE"
+	case *ast.RenameTableStmt:
+		return "RENAME"
+	case *ast.CreateIndexStmt:
+		return "CINDEX"
+	case *ast.DropIndexStmt:
+		return "DINDEX"
+	}
+	return "QUERY"
+}
+
+// jdbcType returns the java.sql.Types of the column type used by canal.
+func jdbcType(tp byte) int {
+	switch tp {
+	case mysql.TypeTiny:
+		return -6 // TINYINT
+	case mysql.TypeShort:
+		return 5 // SMALLINT
+	case mysql.TypeInt24, mysql.TypeLong:
+		return 4 // INTEGER
+	case mysql.TypeLonglong:
+		return -5 // BIGINT
+	case mysql.TypeFloat:
+		return 7 // REAL
+	case mysql.TypeDouble:
+		return 8 // DOUBLE
+	case mysql.TypeDecimal, mysql.TypeNewDecimal:
+		return 3 // DECIMAL
+	case mysql.TypeBit:
+		return -7 // BIT
+	case mysql.TypeDate, mysql.TypeNewDate, mysql.TypeYear:
+		return 91 // DATE
+	case mysql.TypeDuration:
+		return 92 // TIME
+	case mysql.TypeDatetime, mysql.TypeTimestamp:
+		return 93 // TIMESTAMP
+	case mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		return 2004 // BLOB
+	case mysql.TypeEnum, mysql.TypeSet:
+		return 4 // INTEGER
+	case mysql.TypeString:
+		return 1 // CHAR
+	}
+	return 12 // VARCHAR
+}
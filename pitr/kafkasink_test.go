@@ -0,0 +1,109 @@
+package pitr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func genKafkaSinkBinlog(t *testing.T) *pb.Binlog {
+	schema, table := "test", "t1"
+	colID := &pb.Column{
+		Name:         "id",
+		Tp:           []byte{mysql.TypeLong},
+		MysqlType:    "int",
+		Value:        encodeDatum(t, types.NewIntDatum(1)),
+		ChangedValue: encodeDatum(t, types.NewIntDatum(1)),
+	}
+	colName := &pb.Column{
+		Name:         "name",
+		Tp:           []byte{mysql.TypeVarchar},
+		MysqlType:    "varchar",
+		Value:        encodeDatum(t, types.Datum{}),
+		ChangedValue: encodeDatum(t, types.NewStringDatum("x")),
+	}
+	var row [][]byte
+	for _, col := range []*pb.Column{colID, colName} {
+		data, err := col.Marshal()
+		assert.NilError(t, err)
+		row = append(row, data)
+	}
+	return &pb.Binlog{
+		Tp:       pb.BinlogType_DML,
+		CommitTs: 417318403368288260,
+		DmlData:  &pb.DMLData{Events: []pb.Event{{Tp: pb.EventType_Update, SchemaName: &schema, TableName: &table, Row: row}}},
+	}
+}
+
+func TestEncodeOpenBinlog(t *testing.T) {
+	binlog := genKafkaSinkBinlog(t)
+	values, err := encodeOpenBinlog(binlog)
+	assert.NilError(t, err)
+	assert.Equal(t, len(values), 1)
+
+	// it's the same binlog after reading from kafka
+	decoded, err := decodeKafkaBinlog(values[0])
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.CommitTs, binlog.CommitTs)
+	sql, err := eventToSQL(&decoded.DmlData.Events[0], &tableInfo{uniqueKeys: []indexInfo{{columns: []string{"id"}}}})
+	assert.NilError(t, err)
+	assert.Equal(t, sql, "UPDATE `test`.`t1` SET `id` = 1,`name` = 'x' WHERE `id` = 1 LIMIT 1")
+
+	values, err = encodeOpenBinlog(&pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: 10, DdlQuery: []byte("use `test`; create table t2 (id int);")})
+	assert.NilError(t, err)
+	decoded, err = decodeKafkaBinlog(values[0])
+	assert.NilError(t, err)
+	assert.Equal(t, string(decoded.DdlQuery), "use `test`; create table t2 (id int);")
+}
+
+func TestEncodeCanalJSON(t *testing.T) {
+	values, err := encodeCanalJSON(genKafkaSinkBinlog(t))
+	assert.NilError(t, err)
+	assert.Equal(t, len(values), 1)
+	msg := &canalMessage{}
+	assert.NilError(t, json.Unmarshal(values[0], msg))
+	assert.Equal(t, msg.Database+"."+msg.Table, "test.t1")
+	assert.Equal(t, msg.Type, "UPDATE")
+	assert.Equal(t, msg.ES, int64(1591943372224))
+	assert.Equal(t, msg.TiDB.CommitTs, int64(417318403368288260))
+	assert.DeepEqual(t, msg.MySQLType, map[string]string{"id": "int", "name": "varchar"})
+	assert.DeepEqual(t, msg.SQLType, map[string]int{"id": 4, "name": 12})
+	assert.Equal(t, *msg.Data[0]["name"], "x")
+	assert.Assert(t, msg.Old[0]["name"] == nil)
+	assert.Equal(t, *msg.Old[0]["id"], "1")
+
+	values, err = encodeCanalJSON(&pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: 10, DdlQuery: []byte("use `test`; truncate table t1;")})
+	assert.NilError(t, err)
+	msg = &canalMessage{}
+	assert.NilError(t, json.Unmarshal(values[0], msg))
+	assert.Assert(t, msg.IsDDL)
+	assert.Equal(t, msg.Type, "TRUNCATE")
+	assert.Equal(t, msg.SQL, "truncate table t1")
+	assert.Equal(t, msg.Database+"."+msg.Table, "test.t1")
+}
+
+func TestKafkaSink(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+		decoded, err := decodeKafkaBinlog(value)
+		assert.NilError(t, err)
+		assert.Equal(t, decoded.CommitTs, int64(417318403368288260))
+		return nil
+	})
+	producer.ExpectSendMessageAndFail(sarama.ErrNotLeaderForPartition)
+	sink := newKafkaSinkWithProducer(producer, KafkaSinkConfig{Topic: "pitr", Protocol: kafkaProtocolOpenBinlog, MaxMessageBytes: 1024})
+
+	binlog := genKafkaSinkBinlog(t)
+	assert.NilError(t, sink.Apply(binlog))
+	assert.ErrorContains(t, sink.Apply(binlog), "send messages to topic pitr")
+
+	sink.maxBytes = 10
+	assert.ErrorContains(t, sink.Apply(binlog), "larger than max-message-bytes 10")
+	assert.NilError(t, sink.Close())
+}
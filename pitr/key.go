@@ -2,6 +2,8 @@ package pitr
 
 import (
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -12,6 +14,114 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// noPKPolicyRowID identifies the rows of tables without primary key or unique key by _tidb_rowid
+	// if binlogs have it, otherwise by all the columns
+	noPKPolicyRowID = "rowid"
+	// noPKPolicyAppendOnly keeps all the changes of tables without primary key or unique key
+	noPKPolicyAppendOnly = "append-only"
+	// noPKPolicyError fails when a table without primary key or unique key is changed
+	noPKPolicyError = "error"
+
+	// rowIDColumn is the hidden handle of the tables without integer primary key in TiDB
+	rowIDColumn = "_tidb_rowid"
+)
+
+// MergeKey chooses the unique index identifying the rows of the tables matched by the patterns, instead of the
+// primary key, e.g. the primary key is an AUTO_RANDOM surrogate but the rows are identified by a unique key.
+type MergeKey struct {
+	// SchemaPattern and TablePattern are case-insensitive and support the wildcards * and ?
+	SchemaPattern string `toml:"schema-pattern" json:"schema-pattern"`
+	TablePattern  string `toml:"table-pattern" json:"table-pattern"`
+	// Index is the name of the unique index, PRIMARY is the primary key
+	Index string `toml:"index" json:"index"`
+}
+
+// checkMergeKeys checks the patterns and the index names of the merge keys.
+func checkMergeKeys(keys []*MergeKey) error {
+	for _, key := range keys {
+		if len(key.SchemaPattern) == 0 || len(key.TablePattern) == 0 || len(key.Index) == 0 {
+			return errors.New("schema-pattern, table-pattern and index are required by merge-keys")
+		}
+		for _, pattern := range []string{key.SchemaPattern, key.TablePattern} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Annotatef(err, "invalid pattern %s in merge-keys", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeKeyIndex returns the name of the unique index chosen as the merge key of the table, the first matched
+// merge key is used, empty means the primary key or the first unique key.
+func mergeKeyIndex(mergeKeys []*MergeKey, schema, table string) string {
+	for _, key := range mergeKeys {
+		if matchPattern(key.SchemaPattern, schema) && matchPattern(key.TablePattern, table) {
+			return key.Index
+		}
+	}
+	return ""
+}
+
+// useMergeKey moves the unique index chosen by merge-keys to the first of uniqueKeys, so the rows are identified
+// by it. The table without the index keeps its primary key with a warning, the index may be added by a later DDL.
+func (info *tableInfo) useMergeKey(mergeKeys []*MergeKey, sampler *sampledLogger) {
+	index := mergeKeyIndex(mergeKeys, info.schema, info.table)
+	if len(index) == 0 {
+		return
+	}
+	for i := range info.uniqueKeys {
+		if !strings.EqualFold(info.uniqueKeys[i].name, index) {
+			continue
+		}
+		info.uniqueKeys[0], info.uniqueKeys[i] = info.uniqueKeys[i], info.uniqueKeys[0]
+		info.primaryKey = nil
+		for j := range info.uniqueKeys {
+			if info.uniqueKeys[j].name == primaryKeyName {
+				info.primaryKey = &info.uniqueKeys[j]
+			}
+		}
+		return
+	}
+	sampler.warn("the unique index of merge-keys is not in the table, use its primary key", zap.String("schema", info.schema),
+		zap.String("table", info.table), zap.String("index", index))
+}
+
+// hasKey returns true if the table has primary key or unique key.
+func (info *tableInfo) hasKey() bool {
+	return len(info.uniqueKeys) != 0
+}
+
+// keyColumns returns the columns identifying a row, they are the first unique key if the table has one, which
+// is the unique index of merge-keys or the primary key, otherwise _tidb_rowid if the row has it, otherwise all
+// the columns. Identical rows without _tidb_rowid can't be told apart, use append-only no-pk-policy to keep them.
+func (info *tableInfo) keyColumns(values map[string]interface{}) []string {
+	if info.hasKey() {
+		return info.uniqueKeys[0].columns
+	}
+	if _, ok := values[rowIDColumn]; ok {
+		return []string{rowIDColumn}
+	}
+	return info.columns
+}
+
+// checkNoPK checks the table without primary key or unique key can be merged by policy, it returns
+// true if the changes of the table should be appended without merging.
+func checkNoPK(info *tableInfo, policy string) (bool, error) {
+	if info.hasKey() {
+		return false, nil
+	}
+	switch policy {
+	case noPKPolicyAppendOnly:
+		return true, nil
+	case noPKPolicyError:
+		return false, errors.Errorf("table %s.%s has no primary key or unique key, set no-pk-policy to %s or %s to merge it",
+			info.schema, info.table, noPKPolicyRowID, noPKPolicyAppendOnly)
+	default:
+		return false, nil
+	}
+}
+
 // key is combine with schema, table and pk/uk => schema-name|table-name|pk/uk
 func getInsertAndDeleteRowKey(row [][]byte, info *tableInfo) (string, []*pb.Column, error) {
 	values := make(map[string]interface{})
@@ -39,14 +149,9 @@ func getInsertAndDeleteRowKey(row [][]byte, info *tableInfo) (string, []*pb.Colu
 		values[col.Name] = val.GetValue()
 	}
 	key := fmt.Sprintf("%s|%s|", info.schema, info.table)
-	var columns []string
-	if len(info.uniqueKeys) != 0 {
-		columns = info.uniqueKeys[0].columns
-	} else {
-		columns = info.columns
-	}
+	columns := info.keyColumns(values)
 	for _, col := range columns {
-		key += fmt.Sprintf("%v|", values[col])
+		key += info.keyValue(col, values[col]) + "|"
 	}
 
 	return key, cols, nil
@@ -89,15 +194,10 @@ func getUpdateRowKey(row [][]byte, info *tableInfo) (string, string, []*pb.Colum
 	}
 	key := fmt.Sprintf("%s|%s|", info.schema, info.table)
 	cKey := fmt.Sprintf("%s|%s|", info.schema, info.table)
-	var columns []string
-	if len(info.uniqueKeys) != 0 {
-		columns = info.uniqueKeys[0].columns
-	} else {
-		columns = info.columns
-	}
+	columns := info.keyColumns(values)
 	for _, col := range columns {
-		key += fmt.Sprintf("%v|", values[col])
-		cKey += fmt.Sprintf("%v|", changedValues[col])
+		key += info.keyValue(col, values[col]) + "|"
+		cKey += info.keyValue(col, changedValues[col]) + "|"
 	}
 
 	return key, cKey, cols, nil
@@ -2,7 +2,6 @@ package pitr
 
 import (
 	"gotest.tools/assert"
-	"os"
 	"strings"
 	"testing"
 
@@ -11,7 +10,6 @@ import (
 )
 
 func TestGetHashKey(t *testing.T) {
-	os.RemoveAll(defaultTiDBDir)
 	ddl, err := NewDDLHandle()
 	assert.Assert(t, err == nil)
 	ddlHandle = ddl
@@ -295,3 +293,55 @@ func genTestDeleteEvent(schema, table string) []pb.Event {
 		},
 	}
 }
+
+func TestKeyColumns(t *testing.T) {
+	info := &tableInfo{schema: "test", table: "t1", columns: []string{"a", "b"}}
+	assert.DeepEqual(t, info.keyColumns(map[string]interface{}{"a": 1, "b": 2}), []string{"a", "b"})
+	assert.DeepEqual(t, info.keyColumns(map[string]interface{}{"a": 1, "b": 2, rowIDColumn: 3}), []string{rowIDColumn})
+
+	for policy, expected := range map[string]bool{noPKPolicyRowID: false, noPKPolicyAppendOnly: true} {
+		appendOnly, err := checkNoPK(info, policy)
+		assert.NilError(t, err)
+		assert.Equal(t, appendOnly, expected)
+	}
+	_, err := checkNoPK(info, noPKPolicyError)
+	assert.ErrorContains(t, err, "no primary key or unique key")
+
+	info.uniqueKeys = []indexInfo{{name: "uk", columns: []string{"b"}}}
+	assert.DeepEqual(t, info.keyColumns(map[string]interface{}{"a": 1, "b": 2, rowIDColumn: 3}), []string{"b"})
+	appendOnly, err := checkNoPK(info, noPKPolicyError)
+	assert.NilError(t, err)
+	assert.Assert(t, !appendOnly)
+}
+
+func TestMergeKeys(t *testing.T) {
+	assert.ErrorContains(t, checkMergeKeys([]*MergeKey{{SchemaPattern: "db1", Index: "uk"}}), "are required by merge-keys")
+	assert.ErrorContains(t, checkMergeKeys([]*MergeKey{{SchemaPattern: "db1", TablePattern: "[", Index: "uk"}}), "invalid pattern")
+
+	mergeKeys := []*MergeKey{
+		{SchemaPattern: "db1", TablePattern: "orders_*", Index: "uk_order"},
+		{SchemaPattern: "db1", TablePattern: "t2", Index: "uk_not_exist"},
+	}
+	assert.NilError(t, checkMergeKeys(mergeKeys))
+
+	tracker := schemaTracker{mergeKeys: mergeKeys}
+	for _, ddl := range []string{
+		"create database db1",
+		"use db1; create table orders_1 (id bigint primary key, shop int, order_no int, unique key uk_order (shop, order_no))",
+		"use db1; create table t2 (id int primary key, a int unique)",
+	} {
+		assert.NilError(t, tracker.execute("", ddl), ddl)
+	}
+
+	// the rows are identified by the unique key, the primary key is still known
+	info, err := tracker.tableInfo("db1", "ORDERS_1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.keyColumns(nil), []string{"shop", "order_no"})
+	assert.Equal(t, info.primaryKey.name, primaryKeyName)
+	assert.DeepEqual(t, info.primaryKey.columns, []string{"id"})
+
+	// the table without the index uses its primary key
+	info, err = tracker.tableInfo("db1", "t2")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.keyColumns(nil), []string{"id"})
+}
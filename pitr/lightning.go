@@ -0,0 +1,134 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	"go.uber.org/zap"
+)
+
+// lightningDirName is the dir in output dir of the data and schema files in the layout of TiDB Lightning,
+// it can be used as data-source-dir of Lightning.
+const lightningDirName = "lightning"
+
+// lightningDataName returns the name of the data file of db.table in Lightning, the file is named like
+// db.table.csv, or db.table.000001.csv if the output is rotated, and the compression suffix is kept.
+func lightningDataName(schema, table, outputFile, outputName string) string {
+	return fmt.Sprintf("%s.%s%s", schema, table, strings.TrimPrefix(outputFile, outputName))
+}
+
+// outputTables returns the schema and table of the lower case output names of all the tables tracked by
+// the DDLs, the tables skipped by the filter are not returned.
+func (m *Merge) outputTables() (map[string]filter.TableName, error) {
+	schemas, err := ddlHandle.getAllDatabaseNames()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	names := make(map[string]filter.TableName)
+	for _, schema := range schemas {
+		if m.filter.skip(schema, "") {
+			continue
+		}
+		tables, err := ddlHandle.tracker.tables(schema)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, table := range tables {
+			if m.filter.skip(schema, table) {
+				continue
+			}
+			names[tableOutputKey(schema, table)] = filter.TableName{Schema: schema, Table: table}
+		}
+	}
+	return names, nil
+}
+
+// writeLightningFiles writes the output in the layout of TiDB Lightning to the lightning dir in output dir,
+// it's called after Reduce and writeSchemaFile. {db}-schema-create.sql and {db}.{table}-schema.sql are
+// written for every selected database and table, and the csv files of the tables are hard linked as
+// {db}.{table}.csv, so the files are not copied.
+func (m *Merge) writeLightningFiles() (string, error) {
+	dir := filepath.Join(m.outputDir, lightningDirName)
+	// remove the files written by the last run
+	if err := os.RemoveAll(dir); err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	names, err := m.outputTables()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	schemas := make(map[string]struct{})
+	for _, name := range names {
+		// the files are named by the target names of route-rules
+		targetSchema, targetTable := m.router.route(name.Schema, name.Table)
+		if _, ok := schemas[targetSchema]; !ok {
+			createDB, err := ddlHandle.tracker.showCreateDatabase(name.Schema)
+			if err != nil {
+				return "", errors.Annotatef(err, "show create database %s", name.Schema)
+			}
+			if targetSchema != name.Schema {
+				if createDB, err = renameCreateDatabase(createDB, targetSchema); err != nil {
+					return "", errors.Trace(err)
+				}
+			}
+			file := filepath.Join(dir, fmt.Sprintf("%s-schema-create.sql", targetSchema))
+			if err := ioutil.WriteFile(file, []byte(createDB+";\n"), 0600); err != nil {
+				return "", errors.Annotatef(err, "write schema file %s", file)
+			}
+			schemas[targetSchema] = struct{}{}
+		}
+
+		createTable, err := ddlHandle.tracker.showCreateTable(name.Schema, name.Table)
+		if err != nil {
+			return "", errors.Annotatef(err, "show create table %s", quoteSchema(name.Schema, name.Table))
+		}
+		if createTable, err = m.router.routeStmt(name.Schema, createTable); err != nil {
+			return "", errors.Trace(err)
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%s.%s-schema.sql", targetSchema, targetTable))
+		if err := ioutil.WriteFile(file, []byte(createTable+";\n"), 0600); err != nil {
+			return "", errors.Annotatef(err, "write schema file %s", file)
+		}
+	}
+
+	tables, err := m.tables()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var files int
+	for _, tableDir := range tables {
+		outputName := m.outputName(tableDir)
+		name, ok := names[strings.ToLower(outputName)]
+		if !ok {
+			// the table is dropped or skipped, its data can't be imported without schema
+			log.Warn("the table is not in the schema, its output is not written to lightning dir", zap.String("table", outputName))
+			continue
+		}
+		outputFiles, err := m.tableOutputFiles(outputName)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		targetSchema, targetTable := m.router.route(name.Schema, name.Table)
+		for _, outputFile := range outputFiles {
+			link := filepath.Join(dir, lightningDataName(targetSchema, targetTable, outputFile, outputName))
+			if err := os.Link(filepath.Join(m.outputDir, outputFile), link); err != nil {
+				return "", errors.Annotatef(err, "link %s to %s", outputFile, link)
+			}
+			files++
+		}
+	}
+
+	log.Info("lightning files are written", zap.String("dir", dir), zap.Int("tables", len(names)), zap.Int("data files", files))
+	return dir, nil
+}
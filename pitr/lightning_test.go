@@ -0,0 +1,86 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestWriteLightningFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightning")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	ddl.ResetDB()
+	for _, sql := range []string{
+		"use test; create table t1 (id int primary key, v int)",
+		"use test; create table t2 (id int primary key)",
+		"create database db2",
+		"use db2; create table t1 (a int)",
+	} {
+		assert.NilError(t, ddl.ExecuteDDL("", sql), sql)
+	}
+
+	doDBs, doTables, err := parseTables("test.*")
+	assert.NilError(t, err)
+	m := &Merge{
+		tempDir:      filepath.Join(dir, "temp"),
+		outputDir:    filepath.Join(dir, "output"),
+		outputFormat: outputFormatCSV,
+		compress:     compressNone,
+		filter:       newTableFilter(&Config{DoDBs: doDBs, DoTables: doTables}),
+	}
+	// test_t3 is dropped, it has no schema
+	for _, table := range []string{"test_t1", "test_t3"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, table), 0700))
+		w, err := newBinlogWriter(runOptions{}, m.outputFormat, filepath.Join(m.outputDir, table), m.compress, 0)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Write(genRowBinlog(pb.EventType_Insert, 1, 10, 200)))
+		assert.NilError(t, w.Close())
+	}
+
+	lightningDir, err := m.writeLightningFiles()
+	assert.NilError(t, err)
+	infos, err := ioutil.ReadDir(lightningDir)
+	assert.NilError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.DeepEqual(t, names, []string{"test-schema-create.sql", "test.t1-schema.sql", "test.t1.csv", "test.t2-schema.sql"})
+
+	data, err := ioutil.ReadFile(filepath.Join(lightningDir, "test.t1-schema.sql"))
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(string(data), "CREATE TABLE `t1`"), string(data))
+	data, err = ioutil.ReadFile(filepath.Join(lightningDir, "test.t1.csv"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "id,v\n1,10\n")
+
+	// the rotated files
+	assert.Equal(t, lightningDataName("test", "t1", "test_t1.000001.csv.gz", "test_t1"), "test.t1.000001.csv.gz")
+
+	_, err = m.writeManifest()
+	assert.NilError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(m.outputDir, manifestFileName))
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(data), `"lightning-dir": "lightning"`))
+}
+
+func TestValidateLightning(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.Lightning = true
+	assert.ErrorContains(t, cfg.validate(), "lightning requires output-format csv")
+	cfg.OutputFormat = outputFormatCSV
+	assert.NilError(t, cfg.validate())
+	cfg.Compress = compressLZ4
+	assert.ErrorContains(t, cfg.validate(), "lightning can't be used with encrypt-key-file or compress lz4")
+}
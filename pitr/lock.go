@@ -0,0 +1,137 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// lockFileSuffix is the suffix of the lock file next to a locked dir, it's not in the dir because the
+// dir may be removed and created again by the run.
+const lockFileSuffix = ".lock"
+
+// dirLock is an advisory lock of a dir, the lock file saves the run holding it, so the runs on the same
+// temp dir or output dir fail instead of corrupting each other's files.
+type dirLock struct {
+	file string
+	run  *tempDirRun
+}
+
+// lockFile returns the lock file of dir.
+func lockFile(dir string) string {
+	return filepath.Clean(dir) + lockFileSuffix
+}
+
+// lockDir locks dir for the run of runID. The lock held by a dead process on this host is taken over, the
+// lock held by another run fails unless force is true.
+func lockDir(dir string, runID string, force bool) (*dirLock, error) {
+	l := &dirLock{file: lockFile(dir), run: currentRun(runID)}
+	data, err := json.Marshal(l.run)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.file), 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for {
+		f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(l.file)
+				return nil, errors.Annotatef(err, "write lock file %s", l.file)
+			}
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Annotatef(err, "create lock file %s", l.file)
+		}
+
+		holder, err := readLockHolder(l.file)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch {
+		case holder == nil:
+			// the holder removed the lock just now
+			continue
+		case force:
+			log.Warn("force unlock the lock held by another run", zap.String("lock", l.file), zap.Stringer("holder", holder))
+		case holder.Host == l.run.Host && !processAlive(holder.PID):
+			log.Warn("take over the lock held by a dead process", zap.String("lock", l.file), zap.Stringer("holder", holder))
+		default:
+			return nil, errors.Errorf("another PITR run (%s) holds the lock %s, use --force-unlock if it's not running",
+				holder, l.file)
+		}
+		if err := os.Remove(l.file); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Annotatef(err, "remove lock file %s", l.file)
+		}
+	}
+}
+
+// readLockHolder reads the run holding the lock file, nil if the lock file doesn't exist.
+func readLockHolder(file string) (*tempDirRun, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "read lock file %s", file)
+	}
+	holder := &tempDirRun{}
+	if err := json.Unmarshal(data, holder); err != nil {
+		return nil, errors.Annotatef(err, "decode lock file %s, remove it if no PITR run is using the dir", file)
+	}
+	return holder, nil
+}
+
+// unlock removes the lock file if it's still held by this run, it may be taken over by a forced run.
+func (l *dirLock) unlock() {
+	holder, err := readLockHolder(l.file)
+	if err != nil {
+		log.Warn("read lock file", zap.String("lock", l.file), zap.Error(err))
+		return
+	}
+	if holder == nil {
+		return
+	}
+	if holder.PID != l.run.PID || !holder.StartTime.Equal(l.run.StartTime) {
+		log.Warn("the lock is taken over by another run", zap.String("lock", l.file), zap.Stringer("holder", holder))
+		return
+	}
+	if err := os.Remove(l.file); err != nil {
+		log.Warn("remove lock file", zap.String("lock", l.file), zap.Error(err))
+	}
+}
+
+// lockDirs locks the temp dir and the output dir written by the run, the locks are released by the
+// returned function.
+func (r *PITR) lockDirs() (func(), error) {
+	tempDir := r.cfg.TempDir
+	if tempDir == "" {
+		tempDir = defaultTempDir
+	}
+	var locks []*dirLock
+	unlock := func() {
+		for _, l := range locks {
+			l.unlock()
+		}
+	}
+	for _, dir := range []string{tempDir, defaultOutputDir} {
+		l, err := lockDir(dir, r.cfg.RunID, r.cfg.ForceUnlock)
+		if err != nil {
+			unlock()
+			return nil, errors.Annotatef(err, "lock %s", dir)
+		}
+		locks = append(locks, l)
+	}
+	return unlock, nil
+}
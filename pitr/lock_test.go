@@ -0,0 +1,57 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-lock")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	tempDir := filepath.Join(dir, "temp")
+	l, err := lockDir(tempDir, "run-1", false)
+	assert.NilError(t, err)
+	assert.Equal(t, l.file, tempDir+lockFileSuffix)
+
+	// the lock is held by a running process
+	_, err = lockDir(tempDir, "run-2", false)
+	assert.ErrorContains(t, err, "another PITR run (pid")
+	assert.ErrorContains(t, err, "run id run-1) holds the lock")
+
+	// the forced run takes over the lock, and it's not removed by the old run
+	forced, err := lockDir(tempDir, "run-2", true)
+	assert.NilError(t, err)
+	l.unlock()
+	holder, err := readLockHolder(l.file)
+	assert.NilError(t, err)
+	assert.Equal(t, holder.RunID, "run-2")
+	forced.unlock()
+	holder, err = readLockHolder(l.file)
+	assert.NilError(t, err)
+	assert.Assert(t, holder == nil)
+
+	// the lock held by a dead process on this host is taken over
+	dead := currentRun("run-3")
+	dead.PID = 1 << 30
+	data, err := json.Marshal(dead)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(l.file, data, 0600))
+	l, err = lockDir(tempDir, "run-4", false)
+	assert.NilError(t, err)
+	l.unlock()
+
+	// the lock held by a process on another host
+	dead.Host = "another-" + dead.Host
+	data, err = json.Marshal(dead)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(l.file, data, 0600))
+	_, err = lockDir(tempDir, "run-5", false)
+	assert.ErrorContains(t, err, "use --force-unlock")
+}
@@ -0,0 +1,53 @@
+package pitr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// defaultLogMaxSize is the size of a log file in MB before it's rotated
+	defaultLogMaxSize = 300
+)
+
+// newRunID returns the id tagging the logs of a run, it's the start time with a random suffix, so the runs
+// started at the same second on one host are still different.
+func newRunID() string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405")
+	}
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
+
+// InitLogger initializes the global logger by the log options of cfg, the log file is rotated by
+// log-max-size, and every line has the run id of cfg, a new run id is generated if it's empty.
+func InitLogger(cfg *Config) error {
+	if len(cfg.RunID) == 0 {
+		cfg.RunID = newRunID()
+	}
+	logCfg := &log.Config{
+		Level:  cfg.LogLevel,
+		Format: cfg.LogFormat,
+		File: log.FileLogConfig{
+			Filename:   cfg.LogFile,
+			MaxSize:    cfg.LogMaxSize,
+			MaxDays:    cfg.LogMaxDays,
+			MaxBackups: cfg.LogMaxBackups,
+		},
+	}
+	lg, props, err := log.InitLogger(logCfg)
+	if err != nil {
+		return errors.Annotate(err, "init logger")
+	}
+	log.ReplaceGlobals(lg.With(zap.String("run-id", cfg.RunID)), props)
+	return nil
+}
@@ -0,0 +1,86 @@
+package pitr
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// defaultLogSampleLimit is the number of the repetitive logs printed for every message
+const defaultLogSampleLimit = 10
+
+// sampledLogger prints the first limit logs of every message, the later ones with the same message are only
+// counted, and the counts are printed at the end of the run and written to the report. It's used for the logs
+// which may be repeated for every row, binlog or history DDL job. A nil sampledLogger prints all the logs.
+type sampledLogger struct {
+	mu     sync.Mutex
+	limit  int64
+	counts map[string]int64
+}
+
+func newSampledLogger(limit int) *sampledLogger {
+	return &sampledLogger{limit: int64(limit), counts: make(map[string]int64)}
+}
+
+// sample counts the message, and returns true if the log should be printed.
+func (s *sampledLogger) sample(msg string) (printed bool, last bool) {
+	if s == nil || s.limit <= 0 {
+		return true, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[msg]++
+	n := s.counts[msg]
+	return n <= s.limit, n == s.limit
+}
+
+func (s *sampledLogger) log(logFn func(msg string, fields ...zap.Field), msg string, fields []zap.Field) {
+	printed, last := s.sample(msg)
+	if !printed {
+		return
+	}
+	if last {
+		fields = append(fields, zap.String("note", "the later logs with the same message are only counted"))
+	}
+	logFn(msg, fields...)
+}
+
+func (s *sampledLogger) warn(msg string, fields ...zap.Field) {
+	s.log(log.Warn, msg, fields)
+}
+
+func (s *sampledLogger) info(msg string, fields ...zap.Field) {
+	s.log(log.Info, msg, fields)
+}
+
+// suppressed returns the count of every message which has logs not printed.
+func (s *sampledLogger) suppressed() map[string]int64 {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int64)
+	for msg, n := range s.counts {
+		if s.limit > 0 && n > s.limit {
+			counts[msg] = n
+		}
+	}
+	return counts
+}
+
+// logSummary prints the count of the messages which have logs not printed.
+func (s *sampledLogger) logSummary() {
+	counts := s.suppressed()
+	msgs := make([]string, 0, len(counts))
+	for msg := range counts {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		log.Info("repetitive logs are sampled", zap.String("message", msg), zap.Int64("count", counts[msg]),
+			zap.Int64("printed", s.limit))
+	}
+}
@@ -0,0 +1,32 @@
+package pitr
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSampledLogger(t *testing.T) {
+	s := newSampledLogger(2)
+	for i, expected := range []bool{true, true, false, false} {
+		printed, last := s.sample("skip binlog")
+		assert.Equal(t, printed, expected)
+		assert.Equal(t, last, i == 1)
+	}
+	printed, _ := s.sample("ignore job")
+	assert.Assert(t, printed)
+	assert.DeepEqual(t, s.suppressed(), map[string]int64{"skip binlog": 4})
+
+	// all the logs are printed without limit
+	s = newSampledLogger(0)
+	for i := 0; i < 5; i++ {
+		printed, _ := s.sample("skip binlog")
+		assert.Assert(t, printed)
+	}
+	assert.Equal(t, len(s.suppressed()), 0)
+
+	var nilLogger *sampledLogger
+	printed, _ = nilLogger.sample("skip binlog")
+	assert.Assert(t, printed)
+	assert.Equal(t, len(nilLogger.suppressed()), 0)
+}
@@ -0,0 +1,204 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const manifestFileName = "manifest.json"
+
+// sqlPartSuffix is the suffix of the rotated files of text formats after trimming ".sql", ".jsonl" or ".csv", like ".000001"
+var sqlPartSuffix = regexp.MustCompile(`\.\d{6}$`)
+
+type manifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// manifestTable is the output files of a table, they should be replayed in the order of Files.
+// SchemaVersion and DDLJobID are the schema revision of the table at the end of the output, they're
+// 0 if the history DDL jobs are not fetched.
+type manifestTable struct {
+	Name  string         `json:"name"`
+	Files []manifestFile `json:"files"`
+
+	SchemaVersion int64 `json:"schema-version,omitempty"`
+	DDLJobID      int64 `json:"ddl-job-id,omitempty"`
+}
+
+// manifestSlice is the output files of the tables in a time window, the binlogs in it are committed
+// in [StartTSO, StopTSO).
+type manifestSlice struct {
+	Name     string          `json:"name"`
+	StartTSO int64           `json:"start-tso"`
+	StopTSO  int64           `json:"stop-tso"`
+	Tables   []manifestTable `json:"tables"`
+}
+
+// outputManifest describes the files in output dir, the schema file should be replayed first, and then
+// the files of every table, the tables can be replayed in parallel, and the auto id file is executed at last.
+// If the output is sliced, the tables are in Slices instead, which should be replayed in order. The output
+// at the earlier stop points is in Stops.
+// SchemaVersion is the schema version of the cluster at stop-tso, the downstream tools can check the schema
+// they apply the output to is at this revision.
+type outputManifest struct {
+	Format        string `json:"format"`
+	Compress      string `json:"compress"`
+	Encrypted     bool   `json:"encrypted"`
+	SchemaFile    string `json:"schema-file,omitempty"`
+	SchemaVersion int64  `json:"schema-version,omitempty"`
+	// AutoIDFile is the statements rebasing the auto ids of the tables
+	AutoIDFile string `json:"auto-id-file,omitempty"`
+	// ReplayFile is the statements of all the tables ordered by foreign keys
+	ReplayFile string `json:"replay-file,omitempty"`
+	// LightningDir is the dir of the files in the layout of TiDB Lightning
+	LightningDir string          `json:"lightning-dir,omitempty"`
+	Tables       []manifestTable `json:"tables"`
+	Slices       []manifestSlice `json:"slices,omitempty"`
+	Stops        []manifestStop  `json:"stops,omitempty"`
+}
+
+// writeManifest writes the manifest of the output files of all the tables to output dir.
+func (m *Merge) writeManifest() (string, error) {
+	tables, err := m.tables()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	manifest := &outputManifest{
+		Format:    m.outputFormat,
+		Compress:  m.compress,
+		Encrypted: m.opts.cipher != nil,
+	}
+	if _, err := os.Stat(filepath.Join(m.outputDir, schemaFileName)); err == nil {
+		manifest.SchemaFile = schemaFileName
+	}
+	if _, err := os.Stat(filepath.Join(m.outputDir, autoIDFileName)); err == nil {
+		manifest.AutoIDFile = autoIDFileName
+	}
+	replayFile := replayFileName + compressSuffix(m.compress) + encryptSuffixOf(m.opts.cipher)
+	if _, err := os.Stat(filepath.Join(m.outputDir, replayFile)); err == nil {
+		manifest.ReplayFile = replayFile
+	}
+	var revisions map[string]schemaRevision
+	manifest.SchemaVersion, revisions = schemaRevisions(m.ddlJobs, m.stopTS, m.opts.sampler)
+	if _, err := os.Stat(filepath.Join(m.outputDir, lightningDirName)); err == nil {
+		manifest.LightningDir = lightningDirName
+	}
+	if m.sliceInterval > 0 {
+		manifest.Tables = []manifestTable{}
+		slices, err := readSliceDirs(m.outputDir)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		for _, slice := range slices {
+			start, stop, err := sliceTSORange(slice, m.sliceInterval)
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			s := manifestSlice{Name: slice, StartTSO: start, StopTSO: stop}
+			if s.Tables, err = m.manifestTables(tables, slice, nil); err != nil {
+				return "", errors.Trace(err)
+			}
+			manifest.Slices = append(manifest.Slices, s)
+		}
+	} else if manifest.Tables, err = m.manifestTables(tables, "", revisions); err != nil {
+		return "", errors.Trace(err)
+	}
+	if manifest.Stops, err = m.manifestStops(tables); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	name := filepath.Join(m.outputDir, manifestFileName)
+	if err := ioutil.WriteFile(name, append(data, '\n'), 0600); err != nil {
+		return "", errors.Annotatef(err, "write manifest %s", name)
+	}
+	log.Info("manifest is written", zap.String("file", name), zap.Int("tables", len(tables)), zap.Int("slices", len(manifest.Slices)))
+	return name, nil
+}
+
+// manifestTables returns the output files of the tables in the dir of output dir, empty dir means output dir.
+// The tables have the schema revisions in revisions, which can be nil.
+func (m *Merge) manifestTables(tables []string, dir string, revisions map[string]schemaRevision) ([]manifestTable, error) {
+	result := make([]manifestTable, 0, len(tables))
+	for _, table := range tables {
+		// the output of a renamed table has its final name
+		table = m.outputName(table)
+		names, err := m.tableOutputFiles(path.Join(dir, table))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		t := manifestTable{Name: table, Files: make([]manifestFile, 0, len(names))}
+		if revision, ok := revisions[strings.ToLower(table)]; ok {
+			t.SchemaVersion, t.DDLJobID = revision.SchemaVersion, revision.DDLJobID
+		}
+		for _, name := range names {
+			info, err := os.Stat(filepath.Join(m.outputDir, name))
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			t.Files = append(t.Files, manifestFile{Name: name, Size: info.Size()})
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// tableOutputFiles returns the output files of the table in order, the names are relative to output dir,
+// table can be in a slice dir like slice-20200101-000000/schema_table.
+func (m *Merge) tableOutputFiles(table string) ([]string, error) {
+	if isTextFormat(m.outputFormat) {
+		prefix := filepath.Join(m.outputDir, table)
+		if m.outputFileSize <= 0 {
+			name := table + textFileSuffix(m.outputFormat) + compressSuffix(m.compress) + encryptSuffixOf(m.opts.cipher)
+			if _, err := os.Stat(filepath.Join(m.outputDir, name)); os.IsNotExist(err) {
+				return nil, nil
+			}
+			return []string{name}, nil
+		}
+
+		var names []string
+		for i := 0; ; i++ {
+			name := sqlPartName(prefix, i, m.outputFormat, m.compress, m.opts.cipher)
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				return names, nil
+			}
+			names = append(names, path.Join(path.Dir(table), filepath.Base(name)))
+		}
+	}
+
+	files, err := searchBaseFiles(filepath.Join(m.outputDir, table))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, path.Join(table, filepath.Base(file)))
+	}
+	return names, nil
+}
+
+// sqlFileTable returns the table name of the output file of a text format, the compression suffix is already trimmed.
+func sqlFileTable(name string) string {
+	for _, suffix := range []string{sqlFileSuffix, jsonlFileSuffix, csvFileSuffix} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return sqlPartSuffix.ReplaceAllString(name, "")
+}
@@ -0,0 +1,131 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func writeTestDDLs(t *testing.T, w binlogWriter, n int) {
+	for i := 0; i < n; i++ {
+		err := w.Write(genTestDDL("test", "t1", "create table if not exists test.t1 (id int)", int64(i+1)))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, w.Close())
+}
+
+func TestOutputManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := &Merge{
+		tempDir:        filepath.Join(dir, "temp"),
+		outputDir:      filepath.Join(dir, "output"),
+		outputFormat:   outputFormatSQL,
+		compress:       compressNone,
+		outputFileSize: 100,
+	}
+	for _, table := range []string{"test_t1", "test_t2"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, table), 0700))
+	}
+
+	// every DDL is 45 bytes, so 3 DDLs are written to every file
+	w, err := newBinlogWriter(runOptions{}, m.outputFormat, filepath.Join(m.outputDir, "test_t1"), m.compress, m.outputFileSize)
+	assert.NilError(t, err)
+	writeTestDDLs(t, w, 7)
+	_, err = m.writeManifest()
+	assert.NilError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(m.outputDir, manifestFileName))
+	assert.NilError(t, err)
+	manifest := &outputManifest{}
+	assert.NilError(t, json.Unmarshal(data, manifest))
+	assert.Equal(t, manifest.Format, outputFormatSQL)
+	assert.Equal(t, len(manifest.Tables), 1)
+	assert.Equal(t, manifest.Tables[0].Name, "test_t1")
+	assert.DeepEqual(t, manifest.Tables[0].Files, []manifestFile{
+		{Name: "test_t1.000000.sql", Size: 135},
+		{Name: "test_t1.000001.sql", Size: 135},
+		{Name: "test_t1.000002.sql", Size: 45},
+	})
+	assert.Equal(t, sqlFileTable("test_t1.000001.sql"), "test_t1")
+	assert.Equal(t, sqlFileTable("test_t1.sql"), "test_t1")
+
+	// the pb files
+	m.outputFormat = outputFormatPB
+	w, err = newBinlogWriter(runOptions{}, m.outputFormat, filepath.Join(m.outputDir, "test_t2"), m.compress, m.outputFileSize)
+	assert.NilError(t, err)
+	writeTestDDLs(t, w, 7)
+	names, err := m.tableOutputFiles("test_t2")
+	assert.NilError(t, err)
+	assert.Equal(t, len(names), 4)
+
+	var ddls int
+	for _, name := range names {
+		assert.NilError(t, scanBinlogFile(filepath.Join(m.outputDir, name), runOptions{}, func(binlog *pb.Binlog) error {
+			ddls++
+			return nil
+		}))
+	}
+	assert.Equal(t, ddls, 7)
+}
+
+func TestManifestSchemaRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	job := func(id, schemaID int64, query string, table string) *model.Job {
+		info := &model.HistoryInfo{SchemaVersion: id, FinishedTS: uint64(id * 10)}
+		if len(table) != 0 {
+			info.TableInfo = &model.TableInfo{Name: model.NewCIStr(table)}
+		} else {
+			info.DBInfo = &model.DBInfo{Name: model.NewCIStr("test")}
+		}
+		return &model.Job{ID: id, SchemaID: schemaID, Query: query, State: model.JobStateSynced, BinlogInfo: info}
+	}
+	m := &Merge{
+		tempDir:      filepath.Join(dir, "temp"),
+		outputDir:    filepath.Join(dir, "output"),
+		outputFormat: outputFormatSQL,
+		compress:     compressNone,
+		stopTS:       35,
+		ddlJobs: []*model.Job{
+			job(1, 1, "create database test", ""),
+			// the schema is got by the schema id
+			job(2, 1, "create table t1 (id int)", "t1"),
+			job(3, 1, "alter table test.t1 add column c int", "t1"),
+			job(4, 1, "create table test.t2 (id int)", "t2"),
+		},
+	}
+	for _, table := range []string{"test_t1", "test_t2"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, table), 0700))
+		w, err := newBinlogWriter(runOptions{}, m.outputFormat, filepath.Join(m.outputDir, table), m.compress, 0)
+		assert.NilError(t, err)
+		writeTestDDLs(t, w, 1)
+	}
+	_, err = m.writeManifest()
+	assert.NilError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(m.outputDir, manifestFileName))
+	assert.NilError(t, err)
+	manifest := &outputManifest{}
+	assert.NilError(t, json.Unmarshal(data, manifest))
+	// the job after stop-tso is not counted
+	assert.Equal(t, manifest.SchemaVersion, int64(3))
+	assert.Equal(t, len(manifest.Tables), 2)
+	assert.Equal(t, manifest.Tables[0].SchemaVersion, int64(3))
+	assert.Equal(t, manifest.Tables[0].DDLJobID, int64(3))
+	assert.Equal(t, manifest.Tables[1].DDLJobID, int64(0))
+
+	version, tables := schemaRevisions(m.ddlJobs, 0, nil)
+	assert.Equal(t, version, int64(4))
+	assert.DeepEqual(t, tables["test_t2"], schemaRevision{SchemaVersion: 4, DDLJobID: 4})
+}
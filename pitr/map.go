@@ -2,6 +2,7 @@ package pitr
 
 import (
 	"hash/crc32"
+	"path/filepath"
 
 	"github.com/cznic/mathutil"
 	"github.com/pingcap/errors"
@@ -20,10 +21,12 @@ type PBFile struct {
 	binlogger *myBinlogger
 	dml       map[int]*pb.Binlog
 	ddl       []*pb.Binlog
+	// quota limits the total size of temp files, can be nil
+	quota *diskQuota
 }
 
 func NewPbFile(dir, schema, table string, num int) (*PBFile, error) {
-	b, err := OpenMyBinlogger(dir + "/" + schema + "_" + table)
+	b, err := OpenMyBinlogger(filepath.Join(dir, schema+"_"+table))
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +45,9 @@ func (f *PBFile) getHashCode(key string) int {
 }
 
 func (f *PBFile) AddDMLEvent(ev pb.Event, commitTS int64, key string) error {
-	f.flushDDL(true)
+	if err := f.flushDDL(true); err != nil {
+		return errors.Trace(err)
+	}
 	h := f.getHashCode(key)
 	if f.dml[h] == nil {
 		f.dml[h] = &pb.Binlog{
@@ -63,7 +68,9 @@ func (f *PBFile) AddDMLEvent(ev pb.Event, commitTS int64, key string) error {
 func (f *PBFile) AddDDLEvent(binlog *pb.Binlog) error {
 	dml := f.dml
 	for n := range dml {
-		f.flushDML(n, true)
+		if err := f.flushDML(n, true); err != nil {
+			return errors.Trace(err)
+		}
 	}
 	f.ddl = append(f.ddl, binlog)
 	if len(f.ddl) >= Max_Event_Num {
@@ -85,6 +92,9 @@ func (f *PBFile) flushDML(n int, b bool) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err = f.quota.add(sum); err != nil {
+		return errors.Trace(err)
+	}
 	f.dml[n] = &pb.Binlog{
 		Tp:       pb.BinlogType_DML,
 		CommitTs: 0,
@@ -112,20 +122,46 @@ func (f *PBFile) flushDDL(b bool) error {
 			return errors.Trace(err)
 		}
 		n, err = f.binlogger.WriteTail(&tb.Entity{Payload: data})
+		if err != nil {
+			return errors.Trace(err)
+		}
 		sum += n
 	}
 	f.ddl = nil
+	if err := f.quota.add(sum); err != nil {
+		return errors.Trace(err)
+	}
 	if sum > 0 && b {
 		f.binlogger.ManualRotate()
 	}
 	return nil
 }
 
+// flush writes all the cached events to file, and returns the position of the file.
+func (f *PBFile) flush() (tempFilePos, error) {
+	for n, v := range f.dml {
+		if v != nil && len(v.DmlData.Events) > 0 {
+			if err := f.flushDML(n, false); err != nil {
+				return tempFilePos{}, errors.Trace(err)
+			}
+		}
+	}
+	if err := f.flushDDL(false); err != nil {
+		return tempFilePos{}, errors.Trace(err)
+	}
+
+	return f.binlogger.position(), nil
+}
+
 func (f *PBFile) Roate() error {
 	return f.binlogger.ManualRotate()
 }
 
+// Close flushes the cached events and closes the file, it can be called more than once.
 func (f *PBFile) Close() {
+	if f.binlogger == nil {
+		return
+	}
 	for n, v := range f.dml {
 		if v != nil && len(v.DmlData.Events) > 0 {
 			f.flushDML(n, false)
@@ -133,7 +169,6 @@ func (f *PBFile) Close() {
 	}
 	f.flushDDL(false)
 
-	if f.binlogger != nil {
-		f.binlogger.Close()
-	}
+	f.binlogger.Close()
+	f.binlogger = nil
 }
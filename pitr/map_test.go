@@ -47,7 +47,7 @@ func TestPbFile(t *testing.T) {
 	files, err := searchFiles(dirPath + "/" + "db1_tb1")
 	assert.Assert(t, err == nil)
 
-	files, _, err = filterFiles(files, 0, 1000000000)
+	files, _, err = filterFiles(files, 0, 1000000000, runOptions{})
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(files) == 3)
 
@@ -75,7 +75,7 @@ func TestPbFileDDL(t *testing.T) {
 	files, err := searchFiles(dirPath + "/" + "db1_tb1")
 	assert.Assert(t, err == nil)
 
-	files, _, err = filterFiles(files, 0, 40)
+	files, _, err = filterFiles(files, 0, 40, runOptions{})
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(files) == 1)
 
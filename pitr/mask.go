@@ -0,0 +1,226 @@
+package pitr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// maskHash replaces the value of a string column by the hex of its salted sha256, it's cut to the length
+	// of the value if the value is shorter, so the same value is masked to the same string in all tables
+	maskHash = "hash"
+	// maskNull replaces the value by NULL
+	maskNull = "null"
+	// maskReplace replaces the value by a static value
+	maskReplace = "replace"
+)
+
+// maskRule is the action applied to the columns of the tables matched by table.
+type maskRule struct {
+	// Table is like db.table or db.*
+	Table   string   `yaml:"table"`
+	Columns []string `yaml:"columns"`
+	Action  string   `yaml:"action"`
+	// Value is the static value of replace, it's converted to the type of the column
+	Value string `yaml:"value"`
+}
+
+// maskRules is the content of mask-rules-file.
+type maskRules struct {
+	// Salt is prepended to the values before hashing, so the masked values can't be looked up by the common values
+	Salt  string     `yaml:"salt"`
+	Rules []maskRule `yaml:"rules"`
+}
+
+// columnMasker masks the columns of the rows split by Map, so the merged binlogs have no sensitive values.
+type columnMasker struct {
+	salt string
+	// tables is the rule of every lower case column name, the key is `schema`.`table` or `schema`.`*` in lower case
+	tables map[string]map[string]*maskRule
+	sc     *stmtctx.StatementContext
+}
+
+// loadColumnMasker reads the YAML mask rules file, it returns nil if file is empty.
+func loadColumnMasker(file string) (*columnMasker, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read mask rules file %s", file)
+	}
+	rules := &maskRules{}
+	if err := yaml.UnmarshalStrict(data, rules); err != nil {
+		return nil, errors.Annotatef(err, "load mask rules file %s", file)
+	}
+	m, err := newColumnMasker(rules)
+	return m, errors.Annotatef(err, "mask rules file %s", file)
+}
+
+func newColumnMasker(rules *maskRules) (*columnMasker, error) {
+	m := &columnMasker{
+		salt:   rules.Salt,
+		tables: make(map[string]map[string]*maskRule),
+		sc:     &stmtctx.StatementContext{TimeZone: time.Local},
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		names := strings.SplitN(strings.TrimSpace(rule.Table), ".", 2)
+		if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 {
+			return nil, errors.Errorf("invalid table %s in mask rules, should be like db.table or db.*", rule.Table)
+		}
+		switch rule.Action {
+		case maskHash, maskNull, maskReplace:
+		default:
+			return nil, errors.Errorf("unknown action %s of table %s in mask rules, should be %s, %s or %s", rule.Action, rule.Table, maskHash, maskNull, maskReplace)
+		}
+		if len(rule.Columns) == 0 {
+			return nil, errors.Errorf("no column in the mask rule of table %s", rule.Table)
+		}
+
+		key := quoteSchema(strings.ToLower(names[0]), strings.ToLower(names[1]))
+		columns, ok := m.tables[key]
+		if !ok {
+			columns = make(map[string]*maskRule)
+			m.tables[key] = columns
+		}
+		for _, col := range rule.Columns {
+			col = strings.ToLower(col)
+			if _, ok := columns[col]; ok {
+				return nil, errors.Errorf("duplicate mask rule of column %s in table %s", col, key)
+			}
+			columns[col] = rule
+		}
+	}
+	return m, nil
+}
+
+// ruleOf returns the rule of the column, the rule of the table is used before the rule of db.*.
+func (m *columnMasker) ruleOf(schema, table, column string) *maskRule {
+	schema, column = strings.ToLower(schema), strings.ToLower(column)
+	if rule, ok := m.tables[quoteSchema(schema, strings.ToLower(table))][column]; ok {
+		return rule
+	}
+	return m.tables[quoteSchema(schema, "*")][column]
+}
+
+// mask replaces the values of the masked columns in the row of Insert or Delete event, Update event should be
+// split by rewriteDML first. A nil columnMasker keeps all the values.
+// Reduce merges the rows by the keys of info, so masking the key columns is an error, the masked rows would be
+// merged into one. info is nil if the rows are not merged.
+func (m *columnMasker) mask(ev *pb.Event, info *tableInfo) error {
+	if m == nil {
+		return nil
+	}
+	schema, table := ev.GetSchemaName(), ev.GetTableName()
+	cols := make([]*pb.Column, 0, len(ev.Row))
+	values := make(map[string]interface{}, len(ev.Row))
+	for _, data := range ev.Row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(data); err != nil {
+			return errors.Trace(err)
+		}
+		cols = append(cols, col)
+		values[col.Name] = nil
+	}
+	// the rows are merged by the first unique key, and the other unique keys are checked when they're replayed
+	var keyColumns []string
+	if info != nil {
+		keyColumns = info.keyColumns(values)
+		for _, uk := range info.uniqueKeys {
+			keyColumns = append(keyColumns, uk.columns...)
+		}
+	}
+
+	// the row may be shared with the source binlog, it's copied before the first masked column
+	copied := false
+	for i, col := range cols {
+		rule := m.ruleOf(schema, table, col.Name)
+		if rule == nil {
+			continue
+		}
+		for _, key := range keyColumns {
+			if strings.EqualFold(key, col.Name) {
+				return errors.Errorf("column %s of table %s identifies the rows in Reduce, it can't be masked, or the rows would be merged by the masked values",
+					col.Name, quoteSchema(schema, table))
+			}
+		}
+		_, val, err := codec.DecodeOne(col.Value)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		masked, err := m.maskValue(rule, val)
+		if err != nil {
+			return errors.Annotatef(err, "mask column %s of table %s", col.Name, quoteSchema(schema, table))
+		}
+		if col.Value, err = codec.EncodeValue(m.sc, nil, masked); err != nil {
+			return errors.Trace(err)
+		}
+		if !copied {
+			ev.Row = append([][]byte(nil), ev.Row...)
+			copied = true
+		}
+		if ev.Row[i], err = col.Marshal(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// maskValue returns the masked value, NULL is kept.
+func (m *columnMasker) maskValue(rule *maskRule, val types.Datum) (types.Datum, error) {
+	if val.IsNull() {
+		return val, nil
+	}
+	switch rule.Action {
+	case maskNull:
+		return types.Datum{}, nil
+	case maskHash:
+		if val.Kind() != types.KindBytes && val.Kind() != types.KindString {
+			return val, errors.Errorf("%s only supports the string columns, use %s or %s instead", maskHash, maskNull, maskReplace)
+		}
+		value := val.GetBytes()
+		sum := sha256.Sum256(append([]byte(m.salt), value...))
+		hashed := hex.EncodeToString(sum[:])
+		if len(value) < len(hashed) {
+			hashed = hashed[:len(value)]
+		}
+		return types.NewBytesDatum([]byte(hashed)), nil
+	default:
+		return replaceValue(rule.Value, val)
+	}
+}
+
+// replaceValue converts the static value to the kind of val.
+func replaceValue(value string, val types.Datum) (types.Datum, error) {
+	switch val.Kind() {
+	case types.KindInt64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return types.NewIntDatum(v), errors.Annotatef(err, "replace an integer column by %s", value)
+	case types.KindUint64:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return types.NewUintDatum(v), errors.Annotatef(err, "replace an unsigned integer column by %s", value)
+	case types.KindFloat32, types.KindFloat64:
+		v, err := strconv.ParseFloat(value, 64)
+		return types.NewFloat64Datum(v), errors.Annotatef(err, "replace a float column by %s", value)
+	case types.KindMysqlDecimal:
+		dec := new(types.MyDecimal)
+		err := dec.FromString([]byte(value))
+		return types.NewDecimalDatum(dec), errors.Annotatef(err, "replace a decimal column by %s", value)
+	case types.KindBytes, types.KindString:
+		return types.NewBytesDatum([]byte(value)), nil
+	default:
+		return val, errors.Errorf("%s doesn't support the column of kind %d", maskReplace, val.Kind())
+	}
+}
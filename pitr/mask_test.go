@@ -0,0 +1,158 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func TestColumnMasker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-mask")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "mask.yaml")
+	assert.NilError(t, ioutil.WriteFile(file, []byte(`
+salt: s1
+rules:
+  - table: db.users
+    columns: [Email, token]
+    action: hash
+  - table: db.users
+    columns: [phone]
+    action: "null"
+  - table: db.*
+    columns: [age, email]
+    action: replace
+    value: "18"
+`), 0600))
+	m, err := loadColumnMasker(file)
+	assert.NilError(t, err)
+
+	schema, table := "db", "users"
+	var row [][]byte
+	for _, col := range []*pb.Column{
+		{Name: "id", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(1)},
+		{Name: "email", Tp: []byte{mysql.TypeVarchar}, Value: encodeDatum(t, types.NewStringDatum("a@b.com"))},
+		{Name: "token", Tp: []byte{mysql.TypeVarchar}, Value: encodeDatum(t, types.NewDatum(nil))},
+		{Name: "phone", Tp: []byte{mysql.TypeVarchar}, Value: encodeDatum(t, types.NewStringDatum("123"))},
+		{Name: "age", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(42)},
+	} {
+		data, _ := col.Marshal()
+		row = append(row, data)
+	}
+	source := append([][]byte(nil), row...)
+	ev := &pb.Event{Tp: pb.EventType_Insert, SchemaName: &schema, TableName: &table, Row: row}
+	assert.NilError(t, m.mask(ev, nil))
+	// the source row is not changed
+	assert.DeepEqual(t, row, source)
+
+	values, err := decodeRow(ev.Row)
+	assert.NilError(t, err)
+	assert.Equal(t, values["id"].GetInt64(), int64(1))
+	email := string(values["email"].GetBytes())
+	assert.Equal(t, len(email), len("a@b.com"))
+	assert.Assert(t, email != "a@b.com")
+	assert.Assert(t, values["token"].IsNull())
+	assert.Assert(t, values["phone"].IsNull())
+	assert.Equal(t, values["age"].GetInt64(), int64(18))
+
+	// the same value is hashed to the same string
+	ev2 := &pb.Event{Tp: pb.EventType_Delete, SchemaName: &schema, TableName: &table, Row: source[:2]}
+	assert.NilError(t, m.mask(ev2, nil))
+	values, err = decodeRow(ev2.Row)
+	assert.NilError(t, err)
+	assert.Equal(t, string(values["email"].GetBytes()), email)
+
+	// the rule of db.* is used by the other tables
+	other := "orders"
+	ev3 := &pb.Event{Tp: pb.EventType_Insert, SchemaName: &schema, TableName: &other, Row: source[1:2]}
+	assert.NilError(t, m.mask(ev3, nil))
+	values, err = decodeRow(ev3.Row)
+	assert.NilError(t, err)
+	assert.Equal(t, string(values["email"].GetBytes()), "18")
+
+	// hash doesn't support the integer columns
+	m, err = newColumnMasker(&maskRules{Rules: []maskRule{{Table: "db.users", Columns: []string{"id"}, Action: maskHash}}})
+	assert.NilError(t, err)
+	ev4 := &pb.Event{Tp: pb.EventType_Insert, SchemaName: &schema, TableName: &table, Row: source[:1]}
+	assert.ErrorContains(t, m.mask(ev4, nil), "only supports the string columns")
+}
+
+func TestColumnMaskerKeyColumns(t *testing.T) {
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	assert.NilError(t, ddl.ExecuteDDL("", "create database db"))
+	assert.NilError(t, ddl.ExecuteDDL("", "use db; create table users (id int primary key, email varchar(20) unique, phone varchar(20))"))
+	info, err := ddl.GetTableInfo("db", "users")
+	assert.NilError(t, err)
+
+	schema, table := "db", "users"
+	newEvent := func(id int64) *pb.Event {
+		var row [][]byte
+		for _, col := range []*pb.Column{
+			{Name: "id", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(id)},
+			{Name: "email", Tp: []byte{mysql.TypeVarchar}, Value: encodeDatum(t, types.NewStringDatum(fmt.Sprintf("%d@b.com", id)))},
+			{Name: "phone", Tp: []byte{mysql.TypeVarchar}, Value: encodeDatum(t, types.NewStringDatum("123"))},
+		} {
+			data, _ := col.Marshal()
+			row = append(row, data)
+		}
+		return &pb.Event{Tp: pb.EventType_Insert, SchemaName: &schema, TableName: &table, Row: row}
+	}
+
+	// every row is still identified by its key after masking
+	m, err := newColumnMasker(&maskRules{Rules: []maskRule{{Table: "db.users", Columns: []string{"phone"}, Action: maskNull}}})
+	assert.NilError(t, err)
+	keys := make(map[string]bool)
+	for id := int64(1); id <= 3; id++ {
+		ev := newEvent(id)
+		assert.NilError(t, m.mask(ev, info))
+		key, _, err := getInsertAndDeleteRowKey(ev.Row, info)
+		assert.NilError(t, err)
+		keys[key] = true
+	}
+	assert.Equal(t, len(keys), 3)
+
+	// masking the primary key or a unique key would merge the rows into one
+	for _, col := range []string{"ID", "email"} {
+		m, err := newColumnMasker(&maskRules{Rules: []maskRule{{Table: "db.users", Columns: []string{col}, Action: maskNull}}})
+		assert.NilError(t, err)
+		assert.ErrorContains(t, m.mask(newEvent(1), info), "it can't be masked")
+		// the rows of an append-only table are not merged
+		assert.NilError(t, m.mask(newEvent(1), nil))
+	}
+}
+
+func TestLoadColumnMaskerInvalid(t *testing.T) {
+	m, err := loadColumnMasker("")
+	assert.NilError(t, err)
+	assert.Assert(t, m == nil)
+
+	dir, err := ioutil.TempDir("", "pitr-mask")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		content string
+		msg     string
+	}{
+		{"rules:\n  - table: db.t\n    columns: [c]\n    action: shuffle\n", "unknown action shuffle"},
+		{"rules:\n  - table: db\n    columns: [c]\n    action: hash\n", "invalid table db"},
+		{"rules:\n  - table: db.t\n    column: c\n    action: hash\n", "not found in type"},
+		{"rules:\n  - table: db.t\n    columns: [c, C]\n    action: hash\n", "duplicate mask rule"},
+	} {
+		file := filepath.Join(dir, "mask.yaml")
+		assert.NilError(t, ioutil.WriteFile(file, []byte(c.content), 0600))
+		_, err := loadColumnMasker(file)
+		assert.ErrorContains(t, err, c.msg)
+	}
+}
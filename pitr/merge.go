@@ -2,21 +2,26 @@ package pitr
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser"
 	"github.com/pingcap/parser/ast"
 	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
-	tb "github.com/pingcap/tipb/go-binlog"
+	"github.com/tsthght/PITR/pitr/storage"
 	"go.uber.org/zap"
 )
 
@@ -38,30 +43,257 @@ var (
 type Merge struct {
 	// tempDir used to save splited binlog file
 	tempDir string
+	// dirCase checks the temp dirs of the tables on a case-insensitive file system, nil on a case-sensitive one
+	dirCase *tableDirCase
 
 	// outputDir used to save merged binlog file
 	outputDir string
 
 	// which binlog file need merge
 	binlogFiles []string
+	// sources is the binlog files of every data dir, if there are more than one source,
+	// the binlogs of them are merged by commit ts in Map, otherwise binlogFiles is used.
+	sources [][]string
 
 	// memory maybe not enough, need split all binlog files into multiple temp files
 	splitNum int
 
+	// concurrency is the number of workers in Map
+	concurrency int
+	// reduceConcurrency is the max number of tables reduced at the same time, 0 means no limit
+	reduceConcurrency int
+	// relaxCorruption is how to handle the corrupted binlog files in Map
+	relaxCorruption string
+
+	// outputFormat is the format of merged binlog files, pb, sql, jsonl or csv
+	outputFormat string
+	// compress is the codec used to compress merged binlog files
+	compress string
+	// outputFileSize is the size to rotate the output files of every table, 0 means the default
+	outputFileSize int64
+	// sliceInterval splits the output into the slice dirs of the time windows, 0 means not sliced
+	sliceInterval time.Duration
+	// encryptTemp encrypts the temp files by the cipher of opts
+	encryptTemp bool
+
+	// stopTS is stop-tso, the binlogs after it in the last binlog file are not merged, 0 means no limit
+	stopTS int64
+	// stops is the earlier stop points in ascending order, the output at every stop point is written to
+	// its dir in output dir
+	stops []int64
+	// pendingStops is the stop points whose schema is not written by Map yet
+	pendingStops []int64
+
+	// fileSize is the total size of binlog files
+	fileSize int64
+	progress *progress
+
+	// filter skips the binlogs of tables not selected, nil means handle all the tables
+	filter *tableFilter
+	// rowFilter skips the rows not matching the expressions of their tables, nil means keeping all the rows
+	rowFilter *rowFilter
+	// masker masks the columns of the split rows, nil means keeping all the values
+	masker *columnMasker
+	// router renames the tables in the output, nil means keeping the names
+	router *tableRouter
+	// hook is called with the DDLs and merged rows of every table in Reduce, nil means no hook
+	hook EventHook
+	// ddlJobs is the history DDL jobs sorted by schema version, the schema revisions in the manifest are
+	// got from them, nil if they're not fetched
+	ddlJobs []*model.Job
+	// noPKPolicy is how to merge the tables without primary key or unique key
+	noPKPolicy string
+	// preserveTxn keeps the DML binlogs of the tables without merging the rows across transactions
+	preserveTxn bool
+	// skipDDL drops the DDLs of the tables from the output
+	skipDDL bool
+	// renamePolicy is how to merge the tables renamed in the window
+	renamePolicy string
+
+	// report records the details of merging, can be nil
+	report *runReport
+	// opts is the settings of the run passed down to the readers and writers
+	opts runOptions
+
+	// baseDir is the merged output of a previous run, the binlogs in it are folded into the output
+	// before the binlogs after baseCommitTS, empty means no base.
+	baseDir string
+	// baseCommitTS is the max commit ts of binlogs in baseDir, the binlogs not after it are already merged
+	baseCommitTS int64
+	// baseDDLsInHistory is true if the DDLs in baseDir or the BR backup are already executed by the history DDLs,
+	// so they are not executed again when reading the binlogs before baseCommitTS or backupTS.
+	baseDDLsInHistory bool
+	// backupTS is the ts of the BR backup dest-db is restored from, the binlogs not after it are in the backup
+	backupTS int64
+
+	// quota limits the size of temp files
+	quota *diskQuota
+	// memQuota limits the memory used by the events in Reduce, nil means no limit
+	memQuota *memoryQuota
+
+	// store saves the events split by Map when temp-store is kv, nil means the events are saved in temp files
+	store *storage.Store
+	// kvSegments is the commit ts of the last DDL of every table in Map, the events of a table after it are
+	// saved in the segment, only used when store is not nil
+	kvSegments map[string]int64
+
+	// autoIDs tracks the max ids of the tables in Reduce
+	autoIDs *autoIDTracker
+
+	// cp saves the progress of Map and Reduce
+	cp *checkpoint
+	// resumed is true if the temp files are restored from checkpoint
+	resumed bool
+
 	wg sync.WaitGroup
 }
 
-// NewMerge returns a new Merge
-func NewMerge(binlogFiles []string, allFileSize int64) (*Merge, error) {
-	err := os.Mkdir(defaultTempDir, 0700)
-	if err != nil {
-		return nil, err
+// NewMerge returns a new Merge, cfg can be nil, which means using default config
+func NewMerge(cfg *Config, binlogFiles []string, allFileSize int64) (*Merge, error) {
+	var (
+		cp      *checkpoint
+		resumed bool
+	)
+	tempDir := defaultTempDir
+	if cfg != nil && cfg.TempDir != "" {
+		tempDir = cfg.TempDir
+	}
+	tempStore := tempStoreFile
+	if cfg != nil && cfg.TempStore != "" {
+		tempStore = cfg.TempStore
+	}
+	if cfg != nil && cfg.resumeTempDir() {
+		var err error
+		cp, err = loadCheckpoint(tempDir)
+		if err == nil {
+			log.Info("resume from checkpoint",
+				zap.Int64("map commit ts", cp.MapCommitTS),
+				zap.Bool("map finished", cp.MapFinished),
+				zap.Int("reduced tables", len(cp.ReducedTables)))
+			if cpStore := cp.TempStore; cpStore != tempStore && (cpStore != "" || tempStore != tempStoreFile) {
+				return nil, errors.Errorf("temp-store %s is different from %s used by the last run", tempStore, cpStore)
+			}
+			run, err := newCheckpointRun(cfg)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if err = cp.checkRun(run); err != nil {
+				return nil, errors.Trace(err)
+			}
+			// the events written to store after the checkpoint are overwritten when they are written again
+			if !cp.MapFinished && tempStore == tempStoreFile {
+				if err = cp.restoreTempFiles(tempDir); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+			resumed = true
+		} else {
+			log.Warn("load checkpoint failed, will start from the beginning", zap.Error(err))
+			if err = os.RemoveAll(tempDir); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
 	}
 
+	if !resumed {
+		// the temp dir is removed after merging, so never use an existing dir
+		if _, err := os.Stat(tempDir); err == nil {
+			return nil, errors.Errorf("temp dir %s already exists (%s), use --resume to continue the last run, "+
+				"or --on-leftover-temp %s to remove it", tempDir, describeLeftoverTemp(tempDir), onLeftoverClean)
+		}
+		if err := os.MkdirAll(tempDir, 0700); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cp = newCheckpoint(tempDir)
+		if tempStore != tempStoreFile {
+			cp.TempStore = tempStore
+		}
+		if cfg != nil {
+			var err error
+			if cp.Run, err = newCheckpointRun(cfg); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	// the temp dir is owned by this run now, it's told from the dir left by a crash by the run file
+	var runID string
+	if cfg != nil {
+		runID = cfg.RunID
+	}
+	if err := writeTempDirRun(tempDir, runID); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var err error
 	ddlHandle, err = NewDDLHandle()
 	if err != nil {
 		return nil, err
 	}
+	ddlHandle.configure(cfg)
+
+	concurrency := 1
+	var reduceConcurrency int
+	outputFormat := outputFormatPB
+	compress := compressNone
+	relax := relaxAbort
+	noPKPolicy := noPKPolicyRowID
+	renamePolicy := renamePolicyMerge
+	var preserveTxn, skipDDL bool
+	var quota, outputFileSize, maxMemory int64
+	var sliceInterval time.Duration
+	var encryptTemp bool
+	var stopTS int64
+	var stops []int64
+	if cfg != nil {
+		stopTS = cfg.StopTSO
+		stops = append(stops, cfg.StopTSOs...)
+		sort.Slice(stops, func(i, j int) bool { return stops[i] < stops[j] })
+		if cfg.Compress != "" {
+			compress = cfg.Compress
+		}
+		if cfg.Concurrency > 0 {
+			concurrency = cfg.Concurrency
+		}
+		if cfg.ReduceConcurrency > 0 {
+			reduceConcurrency = cfg.ReduceConcurrency
+		}
+		if cfg.OutputFormat != "" {
+			outputFormat = cfg.OutputFormat
+		}
+		if cfg.RelaxCorruption != "" {
+			relax = cfg.RelaxCorruption
+		}
+		if cfg.NoPKPolicy != "" {
+			noPKPolicy = cfg.NoPKPolicy
+		}
+		if cfg.RenamePolicy != "" {
+			renamePolicy = cfg.RenamePolicy
+		}
+		preserveTxn = cfg.PreserveTxn
+		skipDDL = cfg.SkipDDL
+		if cfg.TempQuota != "" {
+			if quota, err = parseSize(cfg.TempQuota); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		encryptTemp = cfg.EncryptTemp
+		if cfg.MaxMemory != "" {
+			if maxMemory, err = parseSize(cfg.MaxMemory); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if cfg.OutputFileSize != "" {
+			if outputFileSize, err = parseSize(cfg.OutputFileSize); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if cfg.SliceInterval != "" {
+			if sliceInterval, err = time.ParseDuration(cfg.SliceInterval); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
 
 	var snum int
 	if allFileSize <= maxMemorySize {
@@ -69,37 +301,207 @@ func NewMerge(binlogFiles []string, allFileSize int64) (*Merge, error) {
 	} else {
 		snum = int(allFileSize / maxMemorySize)
 	}
-	return &Merge{
-		tempDir:     defaultTempDir,
-		outputDir:   defaultOutputDir,
-		binlogFiles: binlogFiles,
-		splitNum:    snum,
-	}, nil
+	m := &Merge{
+		tempDir:           tempDir,
+		outputDir:         defaultOutputDir,
+		binlogFiles:       binlogFiles,
+		splitNum:          snum,
+		concurrency:       concurrency,
+		relaxCorruption:   relax,
+		reduceConcurrency: reduceConcurrency,
+		noPKPolicy:        noPKPolicy,
+		preserveTxn:       preserveTxn,
+		skipDDL:           skipDDL,
+		renamePolicy:      renamePolicy,
+		outputFormat:      outputFormat,
+		compress:          compress,
+		fileSize:          allFileSize,
+		outputFileSize:    outputFileSize,
+		sliceInterval:     sliceInterval,
+		encryptTemp:       encryptTemp,
+		stopTS:            stopTS,
+		stops:             stops,
+		pendingStops:      stops,
+		progress:          newProgress(),
+		autoIDs:           newAutoIDTracker(),
+		cp:                cp,
+		resumed:           resumed,
+	}
+
+	if tempStore == tempStoreKV {
+		if m.store, err = openTempStore(tempDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+		m.kvSegments = make(map[string]int64)
+	}
+	if m.dirCase, err = newTableDirCase(tempDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// the temp files restored from checkpoint are counted in the quota
+	var used int64
+	if resumed && !cp.MapFinished {
+		if used, err = m.tempDirSize(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	m.quota = newDiskQuota(tempDir, quota, used)
+	if maxMemory > 0 {
+		m.memQuota = newMemoryQuota(maxMemory)
+	}
+	return m, nil
 }
 
-// Map split binlog into multiple files
-func (m *Merge) Map() error {
-	fileMap := make(map[string]*PBFile)
-	log.Info("map", zap.Strings("files", m.binlogFiles))
+// mapFinished returns true if Map is already finished in the last run.
+func (m *Merge) mapFinished() bool {
+	return m.resumed && m.cp.MapFinished
+}
 
-	for _, bFile := range m.binlogFiles {
-		f, err := os.OpenFile(bFile, os.O_RDONLY, 0600)
-		if err != nil {
-			return errors.Annotatef(err, "open file %s error", bFile)
+// tempCipher returns the cipher encrypting the temp files, nil means they're not encrypted.
+func (m *Merge) tempCipher() *payloadCipher {
+	if !m.encryptTemp {
+		return nil
+	}
+	return m.opts.cipher
+}
+
+// Map split binlog into multiple files, when ctx is canceled, it saves the checkpoint
+// of binlogs already split and returns.
+func (m *Merge) Map(ctx context.Context) error {
+	log.Info("map", zap.Strings("files", redactStorageURIs(m.binlogFiles)), zap.Int("concurrency", m.concurrency))
+	m.progress.start(phaseMap, m.fileSize)
+
+	var wg sync.WaitGroup
+	workers := make([]*mapWorker, m.concurrency)
+	for i := range workers {
+		workers[i] = newMapWorker(m.tempDir, m.splitNum, &wg)
+		workers[i].rowFilter = m.rowFilter
+		workers[i].masker = m.masker
+		workers[i].report = m.report
+		workers[i].quota = m.quota
+		workers[i].cipher = m.tempCipher()
+		workers[i].store = m.store
+		workers[i].noPKPolicy = m.noPKPolicy
+		go workers[i].run()
+	}
+	defer func() {
+		for _, w := range workers {
+			close(w.taskCh)
 		}
-		reader := bufio.NewReader(f)
-		for {
-			var key, schema, table string
-			var pf *PBFile
-			binlog, _, err := Decode(reader)
-			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					break
-				} else {
+		// the files can be closed only after all the tasks are handled
+		wg.Wait()
+		for _, w := range workers {
+			w.closeFiles()
+		}
+	}()
+
+	// waitWorkers waits all the dispatched tasks finished, after that the workers' temp files can be used safely
+	waitWorkers := func() error {
+		wg.Wait()
+		for _, w := range workers {
+			if w.err != nil {
+				return w.err
+			}
+		}
+		return nil
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	// the gaps of a single source are tracked here, the gaps of multiple sources are tracked by every source
+	gaps := &gapTracker{onGap: m.report.addCorruptionGap}
+	var readerCh chan *binlogFileReader
+	if len(m.sources) > 1 {
+		readerCh = readBinlogSources(m.sources, m.relaxCorruption, m.opts, m.progress, quit, m.report.setInputFileRange, m.report.addCorruptionGap)
+	} else {
+		readerCh = readBinlogFiles(m.binlogFiles, m.concurrency, m.relaxCorruption, m.opts, m.progress, quit)
+	}
+
+	// binlogs with commit ts <= skipCommitTS are already saved in temp files in the last run
+	var skipCommitTS, lastCommitTS int64
+	// saveCheckpoint is true if a binlog file is finished, the checkpoint is saved before the next commit ts.
+	// All the binlogs of a transaction have the same commit ts, and a large transaction may be split into
+	// several binlogs, even across files, so the checkpoint must not be saved in the middle of a commit ts,
+	// or the rest binlogs of it would be skipped after resume.
+	var saveCheckpoint bool
+	// afterStop is the number of binlogs after stop-tso in the last binlog files
+	var afterStop int
+	if m.resumed {
+		skipCommitTS = m.cp.MapCommitTS
+	}
+	// binlogs with commit ts <= mergedCommitTS are already merged in base dir or restored from the BR backup
+	if m.mergedCommitTS() > skipCommitTS {
+		skipCommitTS = m.mergedCommitTS()
+	}
+
+	for r := range readerCh {
+		for binlog := range r.binlogCh {
+			select {
+			case <-ctx.Done():
+				// save the checkpoint, so the binlogs already split needn't be handled again after resume
+				if err := waitWorkers(); err != nil {
 					return err
 				}
+				// the binlog is not handled yet, the binlogs of lastCommitTS are all handled if it's after them
+				if lastCommitTS > skipCommitTS && binlog.CommitTs > lastCommitTS {
+					if err := m.saveMapCheckpoint(workers, lastCommitTS, false); err != nil {
+						return errors.Trace(err)
+					}
+					skipCommitTS = lastCommitTS
+				}
+				log.Info("map is canceled", zap.Int64("checkpoint commit ts", skipCommitTS))
+				return errors.Trace(ctx.Err())
+			default:
 			}
 
+			gaps.add(binlog.CommitTs)
+			// the binlog files are selected by the commit ts of their first binlogs, the last one may have
+			// binlogs after stop-tso. All the binlogs of a transaction have the same commit ts, so a large
+			// transaction split into several binlogs, even across files, is merged or skipped as a whole.
+			if !isAcceptableBinlog(binlog, 0, m.stopTS) {
+				afterStop++
+				continue
+			}
+			if err := m.writeStopSchemas(binlog.CommitTs); err != nil {
+				return errors.Trace(err)
+			}
+			if binlog.CommitTs <= skipCommitTS {
+				if binlog.CommitTs <= m.mergedCommitTS() && m.baseDDLsInHistory {
+					// the DDLs are already executed as history DDLs
+					continue
+				}
+				// only need to update the table info
+				if binlog.Tp == pb.BinlogType_DDL {
+					schema, table, err := m.trackDDL(binlog)
+					if err != nil {
+						return errors.Trace(err)
+					}
+					if m.filter.skipRenamed(schema, table, &ddlHandle.renames) {
+						continue
+					}
+					err = ddlHandle.ExecuteDDL("", string(binlog.GetDdlQuery()))
+					if err != nil {
+						return err
+					}
+					if m.store != nil && binlog.CommitTs > m.mergedCommitTS() {
+						// the DDL is already saved in store, the events after it are in the next segment
+						m.nextSegment(m.tableDir(schema, table), binlog.CommitTs)
+					}
+				}
+				continue
+			}
+			if saveCheckpoint && binlog.CommitTs > lastCommitTS {
+				if err := waitWorkers(); err != nil {
+					return err
+				}
+				if err := m.saveMapCheckpoint(workers, lastCommitTS, false); err != nil {
+					return errors.Trace(err)
+				}
+				skipCommitTS = lastCommitTS
+				saveCheckpoint = false
+			}
+			lastCommitTS = binlog.CommitTs
+
 			switch binlog.Tp {
 
 			case pb.BinlogType_DML:
@@ -107,50 +509,73 @@ func (m *Merge) Map() error {
 				if dml == nil {
 					return errors.New("dml binlog's data can't be empty")
 				}
+				m.progress.addEvents(int64(len(dml.Events)))
+				for _, event := range dml.Events {
+					eventsCounter.WithLabelValues(strings.ToLower(event.GetTp().String())).Inc()
+				}
+				tasks := make(map[string]*mapTask)
 				for _, event := range dml.Events {
-					schema = event.GetSchemaName()
-					table = event.GetTableName()
-					key = fmt.Sprintf("%s_%s", schema, table)
-					if fileMap[key] == nil {
-						pf, err = NewPbFile(m.tempDir, schema, table, m.splitNum)
-						if err != nil {
+					schema := event.GetSchemaName()
+					table := event.GetTableName()
+					if m.filter.skipRenamed(schema, table, &ddlHandle.renames) {
+						m.report.skipTable(schema, table)
+						continue
+					}
+					dir := m.tableDir(schema, table)
+					key := fmt.Sprintf("%s_%s", dir.Schema, dir.Table)
+					task, ok := tasks[key]
+					if !ok {
+						if err := m.dirCase.check(key); err != nil {
 							return errors.Trace(err)
 						}
-						fileMap[key] = pf
-					} else {
-						pf = fileMap[key]
-					}
-					var evs []*pb.Event
-					evs, err = rewriteDML(&event)
-					if err != nil {
-						return err
-					}
-					for _, v := range evs {
-						var hk string
-						hk, err = getHashKey(schema, table, v)
-						if err != nil {
-							return err
+						task = &mapTask{
+							schema:   schema,
+							table:    table,
+							dir:      dir,
+							commitTS: binlog.CommitTs,
+							segment:  m.kvSegments[key],
 						}
-						pf.AddDMLEvent(event, binlog.CommitTs, hk)
+						tasks[key] = task
 					}
+					task.events = append(task.events, event)
+				}
+				for key, task := range tasks {
+					wg.Add(1)
+					workers[workerIndex(key, len(workers))].taskCh <- task
 				}
 			case pb.BinlogType_DDL:
-				schema, table, err = parserSchemaTableFromDDL(string(binlog.DdlQuery))
+				// DDL may change the table info which is used to generate key of DML,
+				// so all the DMLs before it must be handled before execute it.
+				if err := waitWorkers(); err != nil {
+					return err
+				}
+
+				schema, table, err := m.trackDDL(binlog)
 				if err != nil {
 					return errors.Trace(err)
 				}
 				if len(schema) == 0 {
 					return errors.New("DDL has no schema info.")
 				}
-				key = fmt.Sprintf("%s_%s", schema, table)
-				if fileMap[key] == nil {
-					pf, err = NewPbFile(m.tempDir, schema, table, m.splitNum)
+				m.progress.addEvents(1)
+				if m.filter.skipRenamed(schema, table, &ddlHandle.renames) {
+					log.Debug("skip ddl by filter", zap.String("ddl", string(binlog.DdlQuery)))
+					m.report.skipTable(schema, table)
+					continue
+				}
+				eventsCounter.WithLabelValues("ddl").Inc()
+				// the DDL renaming table is saved in the dir of the renamed table's events
+				dir := m.tableDir(schema, table)
+				key := fmt.Sprintf("%s_%s", dir.Schema, dir.Table)
+				if err := m.dirCase.check(key); err != nil {
+					return errors.Trace(err)
+				}
+				var pf *PBFile
+				if m.store == nil {
+					pf, err = workers[workerIndex(key, len(workers))].getPBFile(dir.Schema, dir.Table)
 					if err != nil {
 						return errors.Trace(err)
 					}
-					fileMap[key] = pf
-				} else {
-					pf = fileMap[key]
 				}
 				var rebin *pb.Binlog
 				rebin, err = rewriteDDL(binlog)
@@ -161,22 +586,126 @@ func (m *Merge) Map() error {
 				if err != nil {
 					return err
 				}
-				pf.AddDDLEvent(rebin)
+				m.report.addDDL(binlog.CommitTs, string(binlog.GetDdlQuery()))
+				if m.store != nil {
+					// the events after the DDL are in the next segment
+					err = putDDL(m.store, key, m.kvSegments[key], rebin, m.tempCipher())
+					m.kvSegments[key] = binlog.CommitTs
+				} else {
+					err = pf.AddDDLEvent(rebin)
+				}
+				if err != nil {
+					return errors.Trace(err)
+				}
 			default:
 				panic("unreachable")
 
 			}
 		}
+		if err := r.err(); err != nil {
+			return err
+		}
+		if len(m.sources) <= 1 {
+			m.report.setInputFileRange(r)
+			gaps.fileDone(r.gap)
+		}
 
+		if err := waitWorkers(); err != nil {
+			return err
+		}
+		// the next file may have the rest binlogs of lastCommitTS
+		saveCheckpoint = lastCommitTS > skipCommitTS
+	}
+	gaps.finish()
+	if err := waitWorkers(); err != nil {
+		return err
+	}
+	for _, w := range workers {
+		w.closeFiles()
 	}
-	for _, v := range fileMap {
-		v.Close()
+	// the stop points after the last binlog have the final schema
+	if err := m.writeStopSchemas(math.MaxInt64); err != nil {
+		return errors.Trace(err)
+	}
+	if afterStop > 0 {
+		log.Info("skip the binlogs after stop-tso", zap.String("stop-tso", formatTSO(m.stopTS)), zap.Int("binlogs", afterStop))
+	}
+	if m.renamePolicy == renamePolicyMerge {
+		if err := m.saveRenamed(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if lastCommitTS > skipCommitTS {
+		skipCommitTS = lastCommitTS
+	}
+	if err := m.saveMapCheckpoint(nil, skipCommitTS, true); err != nil {
+		return errors.Trace(err)
+	}
+	if size, err := m.tempDirSize(); err == nil {
+		tempDirSizeGauge.Set(float64(size))
+	} else {
+		log.Warn("get size of temp dir failed", zap.String("dir", m.tempDir), zap.Error(err))
 	}
 
 	ddlHandle.ResetDB()
 	return nil
 }
 
+// mergedCommitTS returns the commit ts before which the binlogs are already merged in base dir or restored
+// from the BR backup, they only update the table info in Map.
+func (m *Merge) mergedCommitTS() int64 {
+	if m.backupTS > m.baseCommitTS {
+		return m.backupTS
+	}
+	return m.baseCommitTS
+}
+
+// saveMapCheckpoint flushes all the temp files of workers, and saves their positions to checkpoint.
+func (m *Merge) saveMapCheckpoint(workers []*mapWorker, commitTS int64, finished bool) error {
+	positions := make(map[string]tempFilePos, len(m.cp.TempFiles))
+	for table, pos := range m.cp.TempFiles {
+		positions[table] = pos
+	}
+	for _, w := range workers {
+		for key, pf := range w.fileMap {
+			pos, err := pf.flush()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			positions[key] = pos
+		}
+	}
+
+	if m.store != nil {
+		if err := m.store.Sync(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(m.cp.saveMap(commitTS, positions, finished))
+}
+
+// tempDirSize returns the total size of temp files.
+func (m *Merge) tempDirSize() (int64, error) {
+	if m.store != nil {
+		return dirSize(m.store.Dir())
+	}
+	tables, err := readSubDirs(m.tempDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var size int64
+	for _, table := range tables {
+		n, err := dirSize(filepath.Join(m.tempDir, table))
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		size += n
+	}
+	return size, nil
+}
+
 // Reduce merge same keys binlog into one, and output to file
 // every file only contain one table's binlog, just like:
 // - output
@@ -184,190 +713,555 @@ func (m *Merge) Map() error {
 //   _ schema1_table2
 //   - schema2_table1
 //   - schema2_table2
-func (m *Merge) Reduce() error {
-	subDirs, err := binlogfile.ReadDir(m.tempDir)
+//
+// when ctx is canceled, the tables not reduced completely are not saved to checkpoint.
+//
+// if baseDir is set, the binlogs of every table in baseDir are merged before the temp files.
+func (m *Merge) Reduce(ctx context.Context) error {
+	allSubDirs, err := m.tables()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	log.Info("", zap.Strings("sub dirs", subDirs))
+	subDirs := make([]string, 0, len(allSubDirs))
+	for _, dir := range allSubDirs {
+		if m.cp.isReduced(dir) {
+			log.Info("table is already reduced, skip it", zap.String("dir", dir))
+			continue
+		}
+		subDirs = append(subDirs, dir)
+	}
+	if len(subDirs) == 0 {
+		return nil
+	}
 
-	resultCh := make(chan error, len(subDirs))
+	log.Info("", zap.Strings("sub dirs", subDirs))
 
+	var totalSize int64
+	sizes := make(map[string]int64, len(subDirs))
 	for _, dir := range subDirs {
-		tableMerge, err := NewTableMerge(path.Join(m.tempDir, dir), path.Join(defaultOutputDir, dir))
+		// the table may only exist in temp dir or base dir
+		size, err := m.tempTableSize(dir)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		if len(m.baseDir) != 0 {
+			baseSize, err := dirSizeIfExists(filepath.Join(m.baseDir, dir))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			size += baseSize
+		}
+		sizes[dir] = size
+		totalSize += size
+	}
+	m.progress.start(phaseReduce, totalSize)
+
+	// the largest tables are reduced first, so they don't start at the end and delay the whole Reduce
+	sort.SliceStable(subDirs, func(i, j int) bool {
+		return sizes[subDirs[i]] > sizes[subDirs[j]]
+	})
+	concurrency := m.reduceConcurrency
+	if concurrency <= 0 || concurrency > len(subDirs) {
+		concurrency = len(subDirs)
+	}
+	log.Info("reduce", zap.Int("tables", len(subDirs)), zap.Int("concurrency", concurrency))
+
+	// cancel the other tables if one table failed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
 
-		go tableMerge.Process(resultCh)
+	// every table is reduced by one worker, the DDLs and DMLs of a table are merged in order by it,
+	// and the tables have no dependency on each other
+	dirCh := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resultCh := make(chan error, 1)
+			for dir := range dirCh {
+				tableMerge, err := m.newTableMerge(dir)
+				if err != nil {
+					setErr(errors.Trace(err))
+					continue
+				}
+				tableMerge.Process(ctx, resultCh)
+				if err := <-resultCh; err != nil {
+					setErr(err)
+				}
+			}
+		}()
 	}
 
-	successNum := 0
-	for {
+	// the tables not started are not reduced if one table failed or ctx is canceled
+Loop:
+	for _, dir := range subDirs {
 		select {
-		case err := <-resultCh:
-			if err != nil {
-				return err
-			}
+		case dirCh <- dir:
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	close(dirCh)
+	// wait all the started tables stopped, so the output files are not written after return
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = errors.Trace(ctx.Err())
+	}
+	return firstErr
+}
 
-			successNum++
-			if successNum == len(subDirs) {
-				return nil
+// newTableMerge creates the TableMerge to reduce the table in the temp dir, the output of the table
+// written by the last run is removed if resumed.
+func (m *Merge) newTableMerge(dir string) (*TableMerge, error) {
+	outputDir := filepath.Join(m.outputDir, m.outputName(dir))
+	if m.resumed {
+		// remove the output of the table which is not reduced completely in the last run
+		if err := os.RemoveAll(outputDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if m.sliceInterval > 0 {
+			if err := removeSlicedOutput(m.outputDir, m.outputName(dir)); err != nil {
+				return nil, errors.Trace(err)
 			}
 		}
+		if err := removeStopOutput(m.outputDir, m.stops, m.outputName(dir)); err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
 
-	return err
+	var writer binlogWriter
+	if m.sliceInterval > 0 {
+		writer = newSlicedWriter(m.opts, m.outputFormat, m.outputDir, m.outputName(dir), m.compress, m.outputFileSize, m.sliceInterval)
+	} else {
+		var err error
+		if writer, err = newBinlogWriter(m.opts, m.outputFormat, outputDir, m.compress, m.outputFileSize); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	tableMerge := NewTableMerge(filepath.Join(m.tempDir, dir), outputDir, writer)
+	tableMerge.name = dir
+	tableMerge.sliceInterval = m.sliceInterval
+	tableMerge.stops = m.newStopWriters(m.outputName(dir))
+	tableMerge.store = m.store
+	tableMerge.noPKPolicy = m.noPKPolicy
+	tableMerge.preserveTxn = m.preserveTxn
+	tableMerge.skipDDL = m.skipDDL
+	tableMerge.router = m.router
+	tableMerge.hook = m.hook
+	tableMerge.autoIDs = m.autoIDs
+	tableMerge.opts = m.opts
+	tableMerge.memQuota = m.memQuota
+	if m.memQuota != nil {
+		tableMerge.spillDir = filepath.Join(spillDir(m.tempDir), dir)
+	}
+	tableMerge.cp = m.cp
+	tableMerge.progress = m.progress
+	tableMerge.report = m.report
+	if len(m.baseDir) != 0 {
+		tableMerge.baseDir = filepath.Join(m.baseDir, dir)
+		tableMerge.baseDDLsInHistory = m.baseDDLsInHistory
+	}
+	return tableMerge, nil
 }
 
 func (m *Merge) Close(reserve bool) {
+	if m.store != nil {
+		if err := m.store.Close(); err != nil {
+			log.Warn("close temp store", zap.String("dir", m.store.Dir()), zap.Error(err))
+		}
+	}
 	if !reserve {
 		if err := os.RemoveAll(m.tempDir); err != nil {
 			log.Warn("remove temp dir", zap.String("dir", m.tempDir), zap.Error(err))
 		}
 	}
+	if m.memQuota != nil {
+		if err := os.RemoveAll(spillDir(m.tempDir)); err != nil {
+			log.Warn("remove spill dir", zap.String("dir", spillDir(m.tempDir)), zap.Error(err))
+		}
+	}
 	ddlHandle.Close()
 }
 
 type TableMerge struct {
+	// name is the name of the table's temp dir, like schema_table
+	name      string
 	inputDir  string
 	outputDir string
 
-	keyEvent map[string]*Event
+	// baseDir saves the table's binlogs merged by a previous run, they are merged before the binlogs
+	// in inputDir, empty means no base.
+	baseDir string
+	// baseDDLsInHistory is true if the DDLs in baseDir are already executed, so they are only written to output.
+	baseDDLsInHistory bool
+
+	// cp is used to save the tables already reduced, can be nil
+	cp *checkpoint
+	// progress is used to track the processed bytes and events, can be nil
+	progress *progress
+	// report records the number of merged rows, can be nil
+	report *runReport
 
-	binlogger binlogfile.Binlogger
+	keyEvent map[string]*Event
+	// memSize is the estimated memory used by keyEvent
+	memSize int64
+	// memQuota limits the memory shared by the tables, the events in keyEvent are spilled to disk
+	// when it's exceeded, can be nil
+	memQuota *memoryQuota
+	// spillDir is the dir to save the spilled events, empty means never spill
+	spillDir string
+	// spill saves the events spilled from keyEvent, nil means no event is spilled
+	spill *spillStore
+	// store saves the events of the table split by Map instead of inputDir, can be nil
+	store *storage.Store
+	// noPKPolicy is how to merge the table if it has no primary key or unique key
+	noPKPolicy string
+	// preserveTxn writes the DML binlogs directly, so the transactions are kept
+	preserveTxn bool
+	// skipDDL drops the DDLs, they're only executed to track the schema
+	skipDDL bool
+	// router renames the tables in the written binlogs, can be nil
+	router *tableRouter
+	// hook is called with the binlogs before they're written, can be nil
+	hook EventHook
+	// autoIDs tracks the max ids of the rows, can be nil
+	autoIDs *autoIDTracker
+	// opts is the settings of the run, the temp files and base files are decrypted by its cipher
+	opts runOptions
+
+	// sliceInterval flushes the merged rows at the end of every time window, so the rows are not merged
+	// across the slices written by slicedWriter, 0 means not sliced
+	sliceInterval time.Duration
+	// stops is the writers of the earlier stop points not reached yet, the merged rows are written to a
+	// stop point when the binlogs after it are reached
+	stops []*stopWriter
+
+	writer binlogWriter
 
 	maxCommitTS int64
 }
 
-func NewTableMerge(inputDir, outputDir string) (*TableMerge, error) {
-	binlogger, err := binlogfile.OpenBinlogger(outputDir)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-
+// NewTableMerge returns the TableMerge which writes the merged binlogs of the table by writer.
+func NewTableMerge(inputDir, outputDir string, writer binlogWriter) *TableMerge {
 	return &TableMerge{
 		inputDir:  inputDir,
 		outputDir: outputDir,
 		keyEvent:  make(map[string]*Event),
-		binlogger: binlogger,
-	}, nil
+		writer:    writer,
+	}
 }
 
-func (tm *TableMerge) Process(resultCh chan error) {
-	fNames, err := binlogfile.ReadDir(tm.inputDir)
+// Process merges the binlogs of the table, and sends the result to resultCh.
+// the table is saved to checkpoint only if it's reduced completely.
+func (tm *TableMerge) Process(ctx context.Context, resultCh chan error) {
+	tm.memQuota.addTable(1)
+	err := tm.process(ctx)
+	tm.releaseMemory()
+	tm.memQuota.addTable(-1)
+	// the output of a failed table is removed, so it never looks complete
+	if err == nil {
+		err = tm.writer.Close()
+	} else {
+		tm.writer.abort()
+	}
+	tm.abortStops()
+	if err == nil && tm.cp != nil {
+		err = tm.cp.saveReducedTable(tm.name)
+	}
 	if err != nil {
 		resultCh <- errors.Trace(err)
+		return
 	}
-	log.Info("reduce", zap.String("dir", tm.inputDir), zap.Strings("files", fNames))
 
-	for _, fName := range fNames {
-		binlogCh, errCh := tm.read(path.Join(tm.inputDir, fName))
+	log.Info("reduce finished", zap.String("dir", tm.inputDir))
+	resultCh <- nil
+}
+
+func (tm *TableMerge) process(ctx context.Context) error {
+	baseFiles, files, err := tm.inputFiles()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("reduce", zap.String("dir", tm.inputDir), zap.Strings("base files", baseFiles), zap.Strings("files", files))
+
+	for i, file := range append(baseFiles, files...) {
+		isBase := i < len(baseFiles)
+		binlogCh, errCh := tm.read(ctx, file)
 
 	Loop:
 		for {
 			select {
 			case binlog, ok := <-binlogCh:
 				if ok {
-					err := tm.analyzeBinlog(binlog)
+					if err := tm.flushStops(binlog.CommitTs); err != nil {
+						return errors.Trace(err)
+					}
+					if err := tm.flushSlice(binlog.CommitTs); err != nil {
+						return errors.Trace(err)
+					}
+					var err error
+					if isBase && binlog.Tp == pb.BinlogType_DDL && tm.baseDDLsInHistory {
+						// the table info is already updated
+						err = tm.writeDDL(binlog)
+					} else {
+						err = tm.analyzeBinlog(binlog)
+					}
 					if err != nil {
-						resultCh <- errors.Trace(err)
+						return errors.Trace(err)
 					}
 					tm.maxCommitTS = binlog.CommitTs
 				} else {
 					break Loop
 				}
 			case err := <-errCh:
-				resultCh <- errors.Trace(err)
+				return errors.Trace(err)
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
 			}
 		}
+		filesCounter.WithLabelValues(phaseReduce).Inc()
+	}
+	// the stop points after the last binlog have the final rows
+	if err := tm.flushStops(math.MaxInt64); err != nil {
+		return errors.Trace(err)
 	}
 
-	err = tm.FlushDMLBinlog(tm.maxCommitTS)
-	if err != nil {
-		resultCh <- errors.Trace(err)
+	if tm.store != nil {
+		size, err := tm.store.TableSize(tm.name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = tm.reduceStore(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		if tm.progress != nil {
+			tm.progress.addBytes(size)
+		}
+		return nil
 	}
+	return errors.Trace(tm.FlushDMLBinlog(tm.maxCommitTS))
+}
 
-	log.Info("reduce finished", zap.String("dir", tm.inputDir))
-	resultCh <- nil
+// flushSlice writes the merged rows of the last slice if the binlog of commitTS is in a later slice.
+func (tm *TableMerge) flushSlice(commitTS int64) error {
+	if tm.sliceInterval <= 0 || tm.maxCommitTS == 0 {
+		return nil
+	}
+	if !sliceStart(commitTS, tm.sliceInterval).After(sliceStart(tm.maxCommitTS, tm.sliceInterval)) {
+		return nil
+	}
+	return errors.Trace(tm.FlushDMLBinlog(tm.maxCommitTS))
+}
+
+// inputFiles returns the binlog files in baseDir and inputDir, both of them may not exist.
+func (tm *TableMerge) inputFiles() (baseFiles []string, files []string, err error) {
+	if len(tm.baseDir) != 0 {
+		baseFiles, err = searchBaseFiles(tm.baseDir)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		// the table may have no new binlogs
+		if _, err = os.Stat(tm.inputDir); os.IsNotExist(err) {
+			return baseFiles, nil, nil
+		}
+	}
+	if tm.store != nil {
+		// the events split by Map are read from store
+		return baseFiles, nil, nil
+	}
+
+	fNames, err := binlogfile.ReadDir(tm.inputDir)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	for _, fName := range fNames {
+		files = append(files, filepath.Join(tm.inputDir, fName))
+	}
+	return baseFiles, files, nil
 }
 
 // FlushDMLBinlog merge some events to one binlog, and then write to file
 func (tm *TableMerge) FlushDMLBinlog(commitTS int64) error {
+	i, err := tm.writeMergedRows(commitTS, tm.writeBinlog)
+	if err != nil {
+		return err
+	}
+
+	mergedRowsCounter.WithLabelValues(tm.name).Add(float64(i))
+	tm.report.addRowsAfterMerge(tm.name, int64(i))
+
+	// all event have already flush to file, clean these event
+	tm.releaseMemory()
+
+	return nil
+}
+
+// writeMergedRows writes the merged rows in memory and the spilled rows by write in the binlogs of commitTS,
+// and returns the number of rows, the rows are kept.
+func (tm *TableMerge) writeMergedRows(commitTS int64, write func(*pb.Binlog) error) (int, error) {
 	binlog := newDMLBinlog(commitTS)
 	i := 0
-	for _, row := range tm.keyEvent {
+	writeEvent := func(row *Event) error {
 		i++
-		r := make([][]byte, 0, 10)
-		for _, c := range row.cols {
-			data, err := c.Marshal()
-			if err != nil {
-				return err
-			}
-			r = append(r, data)
-		}
-
-		log.Debug("generate new event", zap.String("event", fmt.Sprintf("%v", row)))
-		newEvent := pb.Event{
-			SchemaName: &row.schema,
-			TableName:  &row.table,
-			Tp:         row.eventType,
-			Row:        r,
+		newEvent, err := row.toPb()
+		if err != nil {
+			return err
 		}
 		binlog.DmlData.Events = append(binlog.DmlData.Events, newEvent)
 
 		// every binlog contain 1000 rows as default
 		if i%1000 == 0 {
-			err := tm.writeBinlog(binlog)
+			err := write(binlog)
 			if err != nil {
 				return err
 			}
 			binlog = newDMLBinlog(commitTS)
 		}
+		return nil
+	}
+
+	// the events are written in the order of key, so the output doesn't depend on the order of map or
+	// when the events are spilled
+	keys := make([]string, 0, len(tm.keyEvent))
+	for key := range tm.keyEvent {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeEventsBefore := func(key string) error {
+		for ; len(keys) > 0 && keys[0] < key; keys = keys[1:] {
+			if err := writeEvent(tm.keyEvent[keys[0]]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if tm.spill != nil {
+		// the spilled events are in the order of key too, the spilled events of the keys in memory are overwritten
+		err := tm.spill.forEach(func(row *Event) error {
+			if err := writeEventsBefore(row.oldKey); err != nil {
+				return err
+			}
+			if _, ok := tm.keyEvent[row.oldKey]; ok {
+				return nil
+			}
+			return writeEvent(row)
+		})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	for _, key := range keys {
+		if err := writeEvent(tm.keyEvent[key]); err != nil {
+			return 0, err
+		}
 	}
 
 	if len(binlog.DmlData.Events) != 0 {
-		err := tm.writeBinlog(binlog)
+		err := write(binlog)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
+	return i, nil
+}
 
-	// all event have already flush to file, clean these event
+// releaseMemory cleans the events in memory and the spilled events.
+func (tm *TableMerge) releaseMemory() {
 	tm.keyEvent = make(map[string]*Event)
+	tm.memQuota.add(-tm.memSize)
+	tm.memSize = 0
+	if tm.spill != nil {
+		tm.spill.close()
+		tm.spill = nil
+	}
+}
 
+// spillEvents moves the events in memory to the spill store if the memory quota is exceeded.
+func (tm *TableMerge) spillEvents() error {
+	if len(tm.spillDir) == 0 || !tm.memQuota.shouldSpill(tm.memSize) {
+		return nil
+	}
+	if tm.spill == nil {
+		spill, err := openSpillStore(tm.spillDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tm.spill = spill
+	}
+	if err := tm.spill.save(tm.keyEvent); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("spill events to disk", zap.String("table", tm.name), zap.Int("events", len(tm.keyEvent)),
+		zap.Int64("memory", tm.memSize), zap.Int("spilled events", tm.spill.count))
+	spilledEventsCounter.WithLabelValues(tm.name).Add(float64(len(tm.keyEvent)))
+
+	tm.keyEvent = make(map[string]*Event)
+	tm.memQuota.add(-tm.memSize)
+	tm.memSize = 0
 	return nil
 }
 
+// addMemory updates the memory used by keyEvent.
+func (tm *TableMerge) addMemory(n int64) {
+	tm.memSize += n
+	tm.memQuota.add(n)
+}
+
 func (tm *TableMerge) writeBinlog(binlog *pb.Binlog) error {
-	data, err := binlog.Marshal()
-	if err != nil {
+	if tm.skipDDL && binlog.Tp == pb.BinlogType_DDL {
+		return nil
+	}
+	if keep, err := applyHook(tm.hook, binlog); err != nil || !keep {
 		return errors.Trace(err)
 	}
-
-	_, err = tm.binlogger.WriteTail(&tb.Entity{Payload: data})
-	return errors.Trace(err)
+	if err := tm.router.routeBinlog(binlog); err != nil {
+		return errors.Trace(err)
+	}
+	// the binlogs before the stop points not reached yet are in their output too
+	for _, stop := range tm.stops {
+		if err := stop.Write(binlog); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(tm.writer.Write(binlog))
 }
 
 // read reads binlog from pb file
-func (tm *TableMerge) read(file string) (chan *pb.Binlog, chan error) {
+func (tm *TableMerge) read(ctx context.Context, file string) (chan *pb.Binlog, chan error) {
 	binlogChan := make(chan *pb.Binlog, 10)
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 
 	go func() {
-		f, err := os.OpenFile(file, os.O_RDONLY, 0600)
+		// the files in base dir may be compressed
+		f, _, err := openBinlogFile(file, tm.opts.cipher)
 		if err != nil {
-			errChan <- errors.Annotatef(err, "open file %s error", file)
+			errChan <- errors.Annotatef(err, "open file %s error", redactStorageURI(file))
 			return
 		}
+		defer f.Close()
 
 		reader := bufio.NewReader(f)
 		for {
-			binlog, _, err := Decode(reader)
+			binlog, n, err := decodeBinlog(reader, tm.opts)
 			if err != nil {
 				if errors.Cause(err) == io.EOF {
-					log.Info("read file end", zap.String("file", file))
+					log.Info("read file end", zap.String("file", redactStorageURI(file)))
 					close(binlogChan)
 					return
 				} else {
@@ -376,7 +1270,14 @@ func (tm *TableMerge) read(file string) (chan *pb.Binlog, chan error) {
 				}
 			}
 
-			binlogChan <- binlog
+			if tm.progress != nil {
+				tm.progress.addBytes(n)
+			}
+			select {
+			case binlogChan <- binlog:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -391,13 +1292,7 @@ func (tm *TableMerge) analyzeBinlog(binlog *pb.Binlog) error {
 			return err
 		}
 	case pb.BinlogType_DDL:
-		err := ddlHandle.ExecuteDDL("", string(binlog.GetDdlQuery()))
-		if err != nil {
-			return err
-		}
-		// merge DML events to several binlog and write to file, then write this DDL's binlog
-		tm.FlushDMLBinlog(binlog.CommitTs - 1)
-		tm.writeBinlog(binlog)
+		return tm.executeDDL(binlog)
 
 	default:
 		panic("unreachable")
@@ -405,12 +1300,69 @@ func (tm *TableMerge) analyzeBinlog(binlog *pb.Binlog) error {
 	return nil
 }
 
+// writeDDL merges DML events to several binlog and write to file, then write this DDL's binlog.
+// the DML events before a DDL removing all the rows of table are discarded.
+func (tm *TableMerge) writeDDL(binlog *pb.Binlog) error {
+	destructive, err := isDestructiveDDL(string(binlog.GetDdlQuery()))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if destructive {
+		return tm.discardDML(binlog)
+	}
+	if err := tm.FlushDMLBinlog(binlog.CommitTs - 1); err != nil {
+		return errors.Trace(err)
+	}
+	return tm.writeBinlog(binlog)
+}
+
+// discardDML discards the merged DML events which are removed by the DDL, and writes the DDL.
+func (tm *TableMerge) discardDML(binlog *pb.Binlog) error {
+	n := int64(len(tm.keyEvent))
+	if tm.spill != nil {
+		n += int64(tm.spill.count)
+	}
+	tm.releaseMemory()
+	if n > 0 {
+		log.Info("discard the rows before DDL", zap.String("table", tm.name), zap.Int64("rows", n),
+			zap.ByteString("ddl", binlog.GetDdlQuery()))
+		tm.report.addRowsDiscarded(tm.name, n)
+	}
+	return tm.writeBinlog(binlog)
+}
+
 // handleDML split DML binlog to multiple Event and handle them
 func (tm *TableMerge) handleDML(binlog *pb.Binlog) ([]*Event, error) {
 	dml := binlog.DmlData
 	if dml == nil {
 		return nil, errors.New("dml binlog's data can't be empty")
 	}
+	if tm.progress != nil {
+		tm.progress.addEvents(int64(len(dml.Events)))
+	}
+	if len(dml.Events) == 0 {
+		return nil, nil
+	}
+	if tm.autoIDs != nil {
+		if err := tm.autoIDs.observe(dml.Events, tm.router); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	// the events of a table without key are kept in order if it's append-only, and the events of every
+	// transaction are kept together if preserve-txn is set
+	first := dml.Events[0]
+	info, err := ddlHandle.GetTableInfo(first.GetSchemaName(), first.GetTableName())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	appendOnly, err := checkNoPK(info, tm.noPKPolicy)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if appendOnly || tm.preserveTxn {
+		return nil, errors.Trace(tm.appendDML(binlog))
+	}
 
 	for _, event := range dml.Events {
 		schema := event.GetSchemaName()
@@ -456,38 +1408,90 @@ func (tm *TableMerge) handleDML(binlog *pb.Binlog) ([]*Event, error) {
 				newKey:    cKey,
 				cols:      cols,
 			}
+			if key != cKey {
+				// the row of the new key may be deleted before, so the update changing key is handled
+				// as a delete of the old key and an insert of the new key
+				del, ins := splitUpdate(r)
+				if err = tm.HandleEvent(del); err != nil {
+					return nil, errors.Trace(err)
+				}
+				r = ins
+			}
 
 		default:
 			panic("unreachable")
 		}
 
-		tm.HandleEvent(r)
+		if err = tm.HandleEvent(r); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := tm.spillEvents(); err != nil {
+		return nil, errors.Trace(err)
 	}
 
 	return nil, nil
 }
 
+// appendDML writes the binlog of the table without key directly, the events merged before are written first.
+func (tm *TableMerge) appendDML(binlog *pb.Binlog) error {
+	if len(tm.keyEvent) != 0 || tm.spill != nil {
+		if err := tm.FlushDMLBinlog(binlog.CommitTs - 1); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	n := int64(len(binlog.DmlData.Events))
+	mergedRowsCounter.WithLabelValues(tm.name).Add(float64(n))
+	tm.report.addRowsAfterMerge(tm.name, n)
+	return errors.Trace(tm.writeBinlog(binlog))
+}
+
 // HandleEvent handles event, if event's key already exist, then merge this event
 // otherwise save this event
-func (tm *TableMerge) HandleEvent(row *Event) {
+func (tm *TableMerge) HandleEvent(row *Event) error {
 	key := row.oldKey
 	tp := row.eventType
 	oldRow, ok := tm.keyEvent[key]
+	if !ok && tm.spill != nil {
+		// the event of key may be spilled
+		spilled, err := tm.spill.take(key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if spilled != nil {
+			oldRow, ok = spilled, true
+			tm.keyEvent[key] = spilled
+			tm.addMemory(spilled.size())
+		}
+	}
 	if ok {
+		size := oldRow.size()
 		oldRow.Merge(row)
 		if oldRow.isDeleted {
 			delete(tm.keyEvent, key)
-			return
+			tm.addMemory(-size)
+			return nil
 		}
 
 		if tp == pb.EventType_Update {
 			// update may change pk/uk value, so key may be changed
 			delete(tm.keyEvent, key)
+			if replaced, ok := tm.keyEvent[oldRow.oldKey]; ok {
+				tm.addMemory(-replaced.size())
+			} else if tm.spill != nil && oldRow.oldKey != key {
+				// the spilled event of the new key is replaced too
+				if _, err := tm.spill.take(oldRow.oldKey); err != nil {
+					return errors.Trace(err)
+				}
+			}
 			tm.keyEvent[oldRow.oldKey] = oldRow
 		}
+		tm.addMemory(oldRow.size() - size)
 	} else {
 		tm.keyEvent[row.oldKey] = row
+		tm.addMemory(row.size())
 	}
+	return nil
 }
 
 func rewriteDDL(binlog *pb.Binlog) (*pb.Binlog, error) {
@@ -534,6 +1538,20 @@ func newDMLBinlog(commitTS int64) *pb.Binlog {
 	}
 }
 
+// splitUpdate splits the update event into the delete of its before image and the insert of its after image.
+func splitUpdate(e *Event) (*Event, *Event) {
+	del := &Event{schema: e.schema, table: e.table, eventType: pb.EventType_Delete, oldKey: e.oldKey}
+	ins := &Event{schema: e.schema, table: e.table, eventType: pb.EventType_Insert, oldKey: e.newKey}
+	for _, col := range e.cols {
+		before, after := *col, *col
+		before.ChangedValue = nil
+		after.Value, after.ChangedValue = col.ChangedValue, nil
+		del.cols = append(del.cols, &before)
+		ins.cols = append(ins.cols, &after)
+	}
+	return del, ins
+}
+
 func rewriteDML(ev *pb.Event) ([]*pb.Event, error) {
 	var res []*pb.Event
 	switch ev.GetTp() {
@@ -577,7 +1595,7 @@ func getImageRow(row [][]byte, t byte) ([][]byte, error) {
 		col := &pb.Column{}
 		err = col.Unmarshal(c)
 		if err != nil {
-			return nil, nil
+			return nil, errors.Trace(err)
 		}
 		var column *pb.Column
 		if t == beforeImageRow {
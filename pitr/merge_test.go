@@ -1,12 +1,17 @@
 package pitr
 
 import (
+	"context"
 	"fmt"
 	"github.com/pingcap/parser/mysql"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb-binlog/proto/binlog"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
 	tb "github.com/pingcap/tipb/go-binlog"
@@ -18,7 +23,6 @@ func TestMapFunc1(t *testing.T) {
 	srcPath := "./maptest"
 	os.RemoveAll(dstPath + "/")
 	os.RemoveAll(srcPath + "/")
-	os.RemoveAll(defaultTiDBDir)
 	os.RemoveAll(defaultTempDir)
 
 	//generate files
@@ -54,28 +58,28 @@ func TestMapFunc1(t *testing.T) {
 	files, err := searchFiles(srcPath)
 	assert.Assert(t, err == nil)
 
-	files, fileSize, err := filterFiles(files, 0, 300)
+	files, fileSize, err := filterFiles(files, 0, 300, runOptions{})
 	assert.Assert(t, err == nil)
 
 	merge, err := NewMerge(nil, files, fileSize)
 	assert.Assert(t, err == nil)
 
-	err = merge.Map()
+	err = merge.Map(context.Background())
 	assert.Assert(t, err == nil)
 
 	tb1, err := searchFiles(merge.tempDir + "/" + "test_tb1")
 	assert.Assert(t, err == nil)
-	tb1f, _, err := filterFiles(tb1, 0, 300)
+	tb1f, _, err := filterFiles(tb1, 0, 300, runOptions{})
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(tb1f) == 3)
 
 	tb2, err := searchFiles(merge.tempDir + "/" + "test_tb2")
 	assert.Assert(t, err == nil)
-	tb2f, _, err := filterFiles(tb2, 0, 300)
+	tb2f, _, err := filterFiles(tb2, 0, 300, runOptions{})
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(tb2f) == 2)
 
-	err = merge.Reduce()
+	err = merge.Reduce(context.Background())
 	assert.Assert(t, err == nil)
 
 	ddlHandle.ResetDB()
@@ -157,3 +161,466 @@ func generateUpdateColumn(before, after int64) ([]byte, error) {
 	}
 	return bt, nil
 }
+
+func TestReduceTableWithoutKey(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	noKey := &tableInfo{schema: "test", table: "t1", columns: []string{"id", "v"}}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), noKey)
+
+	genBinlog := func(ts int64, events ...*Event) *pb.Binlog {
+		binlog := newDMLBinlog(ts)
+		for _, e := range events {
+			ev, err := e.toPb()
+			assert.NilError(t, err)
+			binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		}
+		return binlog
+	}
+	// the identical rows can't be merged by all the columns
+	changes := genBinlog(10,
+		genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0),
+		genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0),
+		genSpillEvent(t, pb.EventType_Delete, 1, 1, 100, 0))
+
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: &collectWriter{}, noPKPolicy: noPKPolicyError}
+	_, err := tm.handleDML(changes)
+	assert.ErrorContains(t, err, "table test.t1 has no primary key or unique key")
+
+	w := &collectWriter{}
+	tm = &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, noPKPolicy: noPKPolicyAppendOnly}
+	_, err = tm.handleDML(changes)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, w.events, []string{"Insert id=1 v=100", "Insert id=1 v=100", "Delete id=1 v=100"})
+
+	// the changes after primary key is added are merged
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+	w.events = nil
+	_, err = tm.handleDML(genBinlog(20,
+		genSpillEvent(t, pb.EventType_Update, 1, 1, 100, 101),
+		genSpillEvent(t, pb.EventType_Insert, 2, 2, 200, 0),
+		genSpillEvent(t, pb.EventType_Delete, 2, 2, 200, 0)))
+	assert.NilError(t, err)
+	assert.NilError(t, tm.FlushDMLBinlog(20))
+	assert.DeepEqual(t, w.events, []string{"Update id=1->1 v=100->101"})
+}
+
+func TestReducePreserveTxn(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, preserveTxn: true}
+	for _, binlog := range []*pb.Binlog{
+		genRowBinlog(pb.EventType_Insert, 1, 100, 10),
+		genRowBinlog(pb.EventType_Update, 1, 100, 20),
+		genRowBinlog(pb.EventType_Delete, 1, 101, 30),
+	} {
+		_, err := tm.handleDML(binlog)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tm.FlushDMLBinlog(30))
+	// the row inserted and deleted in the window is kept in every transaction
+	assert.DeepEqual(t, w.events, []string{"Insert id=1 v=100", "Update id=1->1 v=100->101", "Delete id=1 v=101"})
+}
+
+func TestReduceSkipDDL(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, skipDDL: true}
+	_, err := tm.handleDML(genRowBinlog(pb.EventType_Insert, 1, 100, 10))
+	assert.NilError(t, err)
+	assert.NilError(t, tm.writeDDL(genTestDDL("test", "t1", "alter table test.t1 add column c int", 20)))
+	_, err = tm.handleDML(genRowBinlog(pb.EventType_Insert, 2, 200, 30))
+	assert.NilError(t, err)
+	assert.NilError(t, tm.writeDDL(genTestDDL("test", "t1", "truncate table test.t1", 40)))
+	assert.NilError(t, tm.FlushDMLBinlog(40))
+	// the rows are still flushed before the DDLs and discarded by truncate, only the DDLs are dropped
+	assert.DeepEqual(t, w.events, []string{"Insert id=1 v=100"})
+}
+
+func TestReduceKeyChanges(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+
+	insert := func(id, v int64) *Event { return genSpillEvent(t, pb.EventType_Insert, id, id, v, 0) }
+	del := func(id, v int64) *Event { return genSpillEvent(t, pb.EventType_Delete, id, id, v, 0) }
+	update := func(oldID, newID, oldV, newV int64) *Event {
+		return genSpillEvent(t, pb.EventType_Update, oldID, newID, oldV, newV)
+	}
+	cases := []struct {
+		events   []*Event
+		expected []string
+	}{
+		{
+			// the row inserted in the window only has its last key
+			events:   []*Event{insert(1, 100), update(1, 2, 100, 101), update(2, 3, 101, 102)},
+			expected: []string{"Insert id=3 v=102"},
+		},
+		{
+			events:   []*Event{update(1, 2, 100, 101), update(2, 3, 101, 102)},
+			expected: []string{"Delete id=1 v=100", "Insert id=3 v=102"},
+		},
+		{
+			// the key is changed back
+			events:   []*Event{update(1, 2, 100, 101), update(2, 1, 101, 102)},
+			expected: []string{"Update id=1->1 v=100->102"},
+		},
+		{
+			// the key of a deleted row is reused
+			events:   []*Event{del(2, 200), update(1, 2, 100, 101)},
+			expected: []string{"Delete id=1 v=100", "Update id=2->2 v=200->101"},
+		},
+		{
+			// two rows swap their keys
+			events:   []*Event{update(1, 3, 100, 100), update(2, 1, 200, 200), update(3, 2, 100, 100)},
+			expected: []string{"Update id=1->1 v=100->200", "Update id=2->2 v=200->100"},
+		},
+	}
+
+	for i, c := range cases {
+		binlog := newDMLBinlog(int64(i + 1))
+		for _, e := range c.events {
+			ev, err := e.toPb()
+			assert.NilError(t, err)
+			binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		}
+
+		// the updates are split by Map, and the updates of base dir are split in Reduce
+		for _, split := range []bool{true, false} {
+			input := binlog
+			if split {
+				input = newDMLBinlog(binlog.CommitTs)
+				for i := range binlog.DmlData.Events {
+					evs, err := rewriteDML(&binlog.DmlData.Events[i])
+					assert.NilError(t, err)
+					for _, ev := range evs {
+						input.DmlData.Events = append(input.DmlData.Events, *ev)
+					}
+				}
+			}
+
+			w := &collectWriter{}
+			tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w}
+			_, err := tm.handleDML(input)
+			assert.NilError(t, err)
+			assert.NilError(t, tm.FlushDMLBinlog(binlog.CommitTs))
+			sort.Strings(w.events)
+			assert.DeepEqual(t, w.events, c.expected)
+		}
+	}
+}
+
+func TestDiscardRowsBeforeDestructiveDDL(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+	dml := func(ts int64, events ...*Event) *pb.Binlog {
+		binlog := newDMLBinlog(ts)
+		for _, e := range events {
+			ev, err := e.toPb()
+			assert.NilError(t, err)
+			binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		}
+		return binlog
+	}
+	ddl := func(ts int64, query string) *pb.Binlog {
+		return &pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: ts, DdlQuery: []byte(query)}
+	}
+
+	cases := []struct {
+		binlogs   []*pb.Binlog
+		expected  []string
+		discarded int64
+	}{
+		{
+			// truncate then insert
+			binlogs: []*pb.Binlog{
+				dml(1, genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0), genSpillEvent(t, pb.EventType_Update, 2, 2, 200, 201)),
+				ddl(2, "use test; truncate table t1"),
+				dml(3, genSpillEvent(t, pb.EventType_Insert, 1, 1, 101, 0)),
+			},
+			expected:  []string{"DDL use test; truncate table t1", "Insert id=1 v=101"},
+			discarded: 2,
+		},
+		{
+			// drop then recreate
+			binlogs: []*pb.Binlog{
+				dml(1, genSpillEvent(t, pb.EventType_Delete, 3, 3, 300, 0)),
+				ddl(2, "use test; drop table t1"),
+				ddl(3, "use test; create table t1 (id int primary key, v int)"),
+				dml(4, genSpillEvent(t, pb.EventType_Insert, 3, 3, 301, 0)),
+			},
+			expected: []string{
+				"DDL use test; drop table t1",
+				"DDL use test; create table t1 (id int primary key, v int)",
+				"Insert id=3 v=301",
+			},
+			discarded: 1,
+		},
+		{
+			// the rows before other DDLs are kept
+			binlogs: []*pb.Binlog{
+				dml(1, genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0)),
+				ddl(2, "use test; create index idx on t1(v)"),
+			},
+			expected: []string{"Insert id=1 v=100", "DDL use test; create index idx on t1(v)"},
+		},
+	}
+
+	for _, c := range cases {
+		w := &collectWriter{}
+		report := newRunReport()
+		tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, report: report}
+		for _, binlog := range c.binlogs {
+			var err error
+			if binlog.Tp == pb.BinlogType_DDL {
+				// the DDLs are not executed by the schema tracker
+				err = tm.writeDDL(binlog)
+			} else {
+				_, err = tm.handleDML(binlog)
+			}
+			assert.NilError(t, err)
+		}
+		assert.NilError(t, tm.FlushDMLBinlog(10))
+		assert.DeepEqual(t, w.events, c.expected)
+		assert.Equal(t, report.table("test_t1").RowsDiscarded, c.discarded)
+	}
+}
+
+func TestReduceConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reduce")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "binlog")
+	b, err := OpenMyBinlogger(srcPath)
+	assert.NilError(t, err)
+	ts := int64(100)
+	// tb1 is the largest table, and tb2 is the smallest
+	for table, dmls := range map[string]int{"tb1": 3, "tb2": 1, "tb3": 2} {
+		ts++
+		data, _ := genTestDDL("test", table, fmt.Sprintf("use test; create table %s (a int primary key, b int, c int)", table), ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+		for i := 0; i < dmls; i++ {
+			ts++
+			data, _ = genTestDML("test", table, ts).Marshal()
+			b.WriteTail(&tb.Entity{Payload: data})
+		}
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.NilError(t, err)
+	files, fileSize, err := filterFiles(files, 0, 0, runOptions{})
+	assert.NilError(t, err)
+
+	cfg := NewConfig()
+	cfg.TempDir = filepath.Join(dir, "temp")
+	cfg.ReduceConcurrency = 1
+	merge, err := NewMerge(cfg, files, fileSize)
+	assert.NilError(t, err)
+	defer merge.Close(false)
+	merge.outputDir = filepath.Join(dir, "output")
+	assert.Equal(t, merge.reduceConcurrency, 1)
+
+	assert.NilError(t, merge.Map(context.Background()))
+	assert.NilError(t, merge.Reduce(context.Background()))
+	for _, table := range []string{"test_tb1", "test_tb2", "test_tb3"} {
+		assert.Assert(t, merge.cp.isReduced(table), table)
+		names, err := merge.tableOutputFiles(table)
+		assert.NilError(t, err)
+		assert.Assert(t, len(names) != 0, table)
+	}
+}
+
+func TestMapStopTSO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "map-stop")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the transaction at 104 is split into 2 binlogs across the files
+	srcPath := filepath.Join(dir, "binlog")
+	b, err := OpenMyBinlogger(srcPath)
+	assert.NilError(t, err)
+	data, _ := genTestDDL("test", "t1", "use test; create table t1 (a int primary key, b int, c int)", 101).Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	for _, ts := range []int64{102, 103, 104} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	assert.NilError(t, b.ManualRotate())
+	for _, ts := range []int64{104, 105, 106} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	events := make(map[int64]int64)
+	for _, stopTS := range []int64{103, 104} {
+		files, err := searchFiles(srcPath)
+		assert.NilError(t, err)
+		files, fileSize, err := filterFiles(files, 0, stopTS, runOptions{})
+		assert.NilError(t, err)
+
+		cfg := NewConfig()
+		cfg.TempDir = filepath.Join(dir, fmt.Sprintf("temp-%d", stopTS))
+		cfg.StopTSO = stopTS
+		merge, err := NewMerge(cfg, files, fileSize)
+		assert.NilError(t, err)
+		merge.report = newRunReport()
+		assert.NilError(t, merge.Map(context.Background()))
+		merge.Close(false)
+
+		// the binlogs after stop-tso in the last file are not merged, and the savepoint is not after stop-tso
+		assert.Equal(t, merge.cp.MapCommitTS, stopTS)
+		events[stopTS] = merge.report.tableEvents()["test_t1"].EventsBeforeMerge
+	}
+	// the file starting with the second half of the transaction at 104 is only read for 104,
+	// and the first half at the end of the first file is skipped for 103
+	assert.Assert(t, events[103] > 0)
+	assert.Equal(t, events[104], 2*events[103])
+}
+
+// cancelAfterContext is canceled when Done is called for the n+1th time, Map calls it once for every binlog.
+type cancelAfterContext struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfterContext) Done() <-chan struct{} {
+	c.n--
+	if c.n >= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (c *cancelAfterContext) Err() error {
+	return context.Canceled
+}
+
+func TestMapCheckpointCommitTS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "map-checkpoint")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the transaction at 104 is split into 2 binlogs across the files
+	srcPath := filepath.Join(dir, "binlog")
+	b, err := OpenMyBinlogger(srcPath)
+	assert.NilError(t, err)
+	data, _ := genTestDDL("test", "t1", "use test; create table t1 (a int primary key, b int, c int)", 101).Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	for _, ts := range []int64{102, 103, 104} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	assert.NilError(t, b.ManualRotate())
+	for _, ts := range []int64{104, 105, 106} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.NilError(t, err)
+	files, fileSize, err := filterFiles(files, 0, 0, runOptions{})
+	assert.NilError(t, err)
+
+	events := make(map[int]int64)
+	// the map is canceled before the second half of the transaction at 104, or the binlog at 105
+	for handled, checkpointTS := range map[int]int64{4: 0, 5: 104} {
+		cfg := NewConfig()
+		cfg.TempDir = filepath.Join(dir, fmt.Sprintf("temp-%d", handled))
+		merge, err := NewMerge(cfg, files, fileSize)
+		assert.NilError(t, err)
+		merge.report = newRunReport()
+		err = merge.Map(&cancelAfterContext{Context: context.Background(), n: handled})
+		assert.Equal(t, errors.Cause(err), context.Canceled)
+		merge.Close(true)
+		// the checkpoint is not saved in the middle of the transaction at 104
+		assert.Equal(t, merge.cp.MapCommitTS, checkpointTS, "handled %d", handled)
+
+		cfg.Resume = true
+		merge, err = NewMerge(cfg, files, fileSize)
+		assert.NilError(t, err)
+		merge.report = newRunReport()
+		assert.NilError(t, merge.Map(context.Background()))
+		merge.Close(false)
+		events[handled] = merge.report.tableEvents()["test_t1"].EventsBeforeMerge
+	}
+	// all the 6 DML binlogs are mapped again after the first resume, and only 105 and 106 after the second
+	assert.Equal(t, events[4], 3*events[5])
+}
+
+func TestMapSkipBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "map-backup")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the backup ts 103 is in the middle of the first file
+	srcPath := filepath.Join(dir, "binlog")
+	b, err := OpenMyBinlogger(srcPath)
+	assert.NilError(t, err)
+	data, _ := genTestDDL("test", "t1", "use test; create table t1 (a int primary key, b int, c int)", 101).Marshal()
+	b.WriteTail(&tb.Entity{Payload: data})
+	for _, ts := range []int64{102, 103, 104} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	assert.NilError(t, b.ManualRotate())
+	for _, ts := range []int64{105, 106} {
+		data, _ = genTestDML("test", "t1", ts).Marshal()
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	events := make(map[int64]int64)
+	for _, backupTS := range []int64{0, 103} {
+		files, err := searchFiles(srcPath)
+		assert.NilError(t, err)
+		files, fileSize, err := filterFiles(files, backupTS+1, 0, runOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, len(files), 2)
+
+		cfg := NewConfig()
+		cfg.TempDir = filepath.Join(dir, fmt.Sprintf("temp-%d", backupTS))
+		merge, err := NewMerge(cfg, files, fileSize)
+		assert.NilError(t, err)
+		merge.report = newRunReport()
+		merge.backupTS = backupTS
+		assert.NilError(t, merge.Map(context.Background()))
+		merge.Close(false)
+		events[backupTS] = merge.report.tableEvents()["test_t1"].EventsBeforeMerge
+	}
+	// the DDL at 101 is tracked, but only the DMLs at 104, 105 and 106 are merged
+	assert.Assert(t, events[103] > 0)
+	assert.Equal(t, 5*events[103], 3*events[0])
+}
@@ -0,0 +1,82 @@
+package pitr
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	filesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "files_total",
+			Help:      "Total number of binlog files processed.",
+		}, []string{"phase"})
+
+	eventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "events_total",
+			Help:      "Total number of events read from binlog files.",
+		}, []string{"type"})
+
+	mergedRowsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "merged_rows_total",
+			Help:      "Total number of rows written after merging.",
+		}, []string{"table"})
+
+	spilledEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "spilled_events_total",
+			Help:      "Total number of events spilled to disk in Reduce.",
+		}, []string{"table"})
+
+	ddlCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "ddls_total",
+			Help:      "Total number of DDLs executed.",
+		})
+
+	tempDirSizeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "temp_dir_size_bytes",
+			Help:      "Size of the temp files generated by Map.",
+		})
+
+	phaseDurationGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "phase_duration_seconds",
+			Help:      "Duration of every phase.",
+		}, []string{"phase"})
+
+	errorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "binlog",
+			Subsystem: "pitr",
+			Name:      "errors_total",
+			Help:      "Total number of errors.",
+		}, []string{"phase"})
+)
+
+func init() {
+	prometheus.MustRegister(filesCounter)
+	prometheus.MustRegister(eventsCounter)
+	prometheus.MustRegister(mergedRowsCounter)
+	prometheus.MustRegister(spilledEventsCounter)
+	prometheus.MustRegister(ddlCounter)
+	prometheus.MustRegister(tempDirSizeGauge)
+	prometheus.MustRegister(phaseDurationGauge)
+	prometheus.MustRegister(errorsCounter)
+}
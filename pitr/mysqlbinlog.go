@@ -0,0 +1,814 @@
+package pitr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	ptypes "github.com/pingcap/parser/types"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"go.uber.org/zap"
+)
+
+// inputFormatMySQL is the ROW based binlog files of MySQL or MariaDB
+const inputFormatMySQL = "mysql"
+
+const (
+	mysqlBinlogMagic      = "\xfebin"
+	mysqlEventHeaderSize  = 19
+	mysqlChecksumSize     = 4
+	mysqlChecksumAlgCRC32 = 1
+
+	mysqlQueryEvent             = 2
+	mysqlFormatDescriptionEvent = 15
+	mysqlXIDEvent               = 16
+	mysqlTableMapEvent          = 19
+	mysqlWriteRowsEventV1       = 23
+	mysqlUpdateRowsEventV1      = 24
+	mysqlDeleteRowsEventV1      = 25
+	mysqlWriteRowsEventV2       = 30
+	mysqlUpdateRowsEventV2      = 31
+	mysqlDeleteRowsEventV2      = 32
+	mysqlTransactionPayload     = 40
+
+	// the column types only used in binlog, they are not in parser's mysql package
+	mysqlTypeTimestamp2 = 17
+	mysqlTypeDatetime2  = 18
+	mysqlTypeTime2      = 19
+
+	// the optional metadata of table map event written if binlog_row_metadata is FULL
+	mysqlMetaSignedness = 1
+	mysqlMetaColumnName = 4
+)
+
+// mysqlTable is the table of the rows events, decoded from the table map event.
+type mysqlTable struct {
+	schema   string
+	table    string
+	types    []byte
+	metas    []uint16
+	unsigned []bool
+	names    []string
+}
+
+// mysqlBinlogDecoder decodes the events of the binlog files of a MySQL server, and groups the row changes
+// to transactions.
+type mysqlBinlogDecoder struct {
+	checksum bool
+	// postHeaderLens is the post header length of every event type from the format description event
+	postHeaderLens []byte
+	tables         map[uint64]*mysqlTable
+
+	// txn is the rows of the transaction not committed
+	txn []pb.Event
+	// lastTS is the commit ts of the last transaction, the commit ts is increased if the timestamps are the same
+	lastTS int64
+	// sampler samples the warnings of the queries skipped
+	sampler *sampledLogger
+}
+
+func newMySQLBinlogDecoder(sampler *sampledLogger) *mysqlBinlogDecoder {
+	return &mysqlBinlogDecoder{tables: make(map[uint64]*mysqlTable), sampler: sampler}
+}
+
+// commitTS returns the commit ts of the transaction committed at the timestamp of event, the timestamps of
+// MySQL are seconds, so the logical part of the ts keeps the order of transactions in the same second.
+func (d *mysqlBinlogDecoder) commitTS(timestamp uint32) int64 {
+	ts := oracle.ComposeTS(int64(timestamp)*1000, 0)
+	if ts <= d.lastTS {
+		ts = d.lastTS + 1
+	}
+	d.lastTS = ts
+	return ts
+}
+
+// postHeaderLen returns the post header length of the event type, or def if it's unknown.
+func (d *mysqlBinlogDecoder) postHeaderLen(tp byte, def int) int {
+	if int(tp) <= len(d.postHeaderLens) && tp > 0 {
+		return int(d.postHeaderLens[tp-1])
+	}
+	return def
+}
+
+// decode decodes an event, and returns the binlog of a committed transaction or DDL, nil if the event
+// doesn't finish one.
+func (d *mysqlBinlogDecoder) decode(event []byte) (*pb.Binlog, error) {
+	timestamp := binary.LittleEndian.Uint32(event)
+	tp := event[4]
+	if tp == mysqlFormatDescriptionEvent {
+		return nil, errors.Trace(d.decodeFormatDescription(event[mysqlEventHeaderSize:]))
+	}
+	if d.checksum {
+		if len(event) < mysqlEventHeaderSize+mysqlChecksumSize {
+			return nil, errors.Errorf("event of type %d is too short", tp)
+		}
+		n := len(event) - mysqlChecksumSize
+		if crc32.ChecksumIEEE(event[:n]) != binary.LittleEndian.Uint32(event[n:]) {
+			return nil, errors.Errorf("checksum mismatch of event type %d", tp)
+		}
+		event = event[:n]
+	}
+	body := event[mysqlEventHeaderSize:]
+
+	switch tp {
+	case mysqlQueryEvent:
+		return d.decodeQuery(body, timestamp)
+	case mysqlXIDEvent:
+		return d.commit(timestamp), nil
+	case mysqlTableMapEvent:
+		return nil, errors.Trace(d.decodeTableMap(body))
+	case mysqlWriteRowsEventV1, mysqlUpdateRowsEventV1, mysqlDeleteRowsEventV1,
+		mysqlWriteRowsEventV2, mysqlUpdateRowsEventV2, mysqlDeleteRowsEventV2:
+		return nil, errors.Trace(d.decodeRows(tp, body))
+	case mysqlTransactionPayload:
+		return nil, errors.New("the compressed transaction payload is not supported, set binlog_transaction_compression to OFF")
+	}
+	return nil, nil
+}
+
+// decodeFormatDescription reads the post header lengths and the checksum algorithm, the algorithm is
+// written since MySQL 5.6.1.
+func (d *mysqlBinlogDecoder) decodeFormatDescription(body []byte) error {
+	// binlog version, server version, create timestamp and header length
+	const fixedSize = 2 + 50 + 4 + 1
+	if len(body) < fixedSize {
+		return errors.New("format description event is too short")
+	}
+	version := string(bytes.TrimRight(body[2:52], "\x00"))
+	lens := body[fixedSize:]
+	d.checksum = false
+	if mysqlVersionAtLeast(version, 5, 6, 1) && len(lens) >= 1+mysqlChecksumSize {
+		alg := lens[len(lens)-1-mysqlChecksumSize]
+		lens = lens[:len(lens)-1-mysqlChecksumSize]
+		d.checksum = alg == mysqlChecksumAlgCRC32
+	}
+	d.postHeaderLens = append([]byte(nil), lens...)
+	log.Info("read binlog of mysql", zap.String("server version", version), zap.Bool("checksum", d.checksum))
+	return nil
+}
+
+// mysqlVersionAtLeast returns true if version like 8.0.23-log or 10.5.8-MariaDB is not less than major.minor.patch.
+func mysqlVersionAtLeast(version string, major, minor, patch int) bool {
+	want := []int{major, minor, patch}
+	parts := strings.SplitN(version, ".", 3)
+	for i := 0; i < len(want); i++ {
+		if i >= len(parts) {
+			return false
+		}
+		digits := strings.TrimLeft(parts[i], "0123456789")
+		v, err := strconv.Atoi(parts[i][:len(parts[i])-len(digits)])
+		if err != nil {
+			return false
+		}
+		if v != want[i] {
+			return v > want[i]
+		}
+	}
+	return true
+}
+
+// commit returns the binlog of the rows of the transaction, nil if it has no row.
+func (d *mysqlBinlogDecoder) commit(timestamp uint32) *pb.Binlog {
+	if len(d.txn) == 0 {
+		return nil
+	}
+	binlog := newDMLBinlog(d.commitTS(timestamp))
+	binlog.DmlData.Events = d.txn
+	d.txn = nil
+	return binlog
+}
+
+// decodeQuery handles the transaction control statements and DDLs, the DMLs in statement format can't be merged.
+func (d *mysqlBinlogDecoder) decodeQuery(body []byte, timestamp uint32) (*pb.Binlog, error) {
+	postHeaderLen := d.postHeaderLen(mysqlQueryEvent, 13)
+	if len(body) < postHeaderLen {
+		return nil, errors.New("query event is too short")
+	}
+	schemaLen := int(body[8])
+	statusLen := int(binary.LittleEndian.Uint16(body[11:]))
+	pos := postHeaderLen + statusLen
+	if len(body) < pos+schemaLen+1 {
+		return nil, errors.New("query event is too short")
+	}
+	schema := string(body[pos : pos+schemaLen])
+	query := strings.TrimSpace(string(body[pos+schemaLen+1:]))
+
+	switch strings.ToUpper(query) {
+	case "BEGIN":
+		return nil, nil
+	case "COMMIT":
+		return d.commit(timestamp), nil
+	case "ROLLBACK":
+		d.txn = nil
+		return nil, nil
+	}
+
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	if err != nil {
+		d.sampler.warn("skip the query which can't be parsed", zap.String("schema", schema), zap.String("query", query), zap.Error(err))
+		return nil, nil
+	}
+	switch stmt.(type) {
+	case ast.DDLNode:
+		if len(d.txn) != 0 {
+			return nil, errors.Errorf("DDL %s is in a transaction with rows", query)
+		}
+		binlog, err := ddlBinlog(schema, query, d.commitTS(timestamp))
+		return binlog, errors.Trace(err)
+	case ast.DMLNode:
+		return nil, errors.Errorf("DML %s is in statement format, set binlog_format to ROW", query)
+	}
+	return nil, nil
+}
+
+// decodeTableMap decodes the table of the following rows events, the column names are in the optional
+// metadata if binlog_row_metadata is FULL.
+func (d *mysqlBinlogDecoder) decodeTableMap(body []byte) error {
+	r := &mysqlBinlogReader{data: body}
+	tableID := r.tableID(d.postHeaderLen(mysqlTableMapEvent, 8))
+	r.skip(2)
+	t := &mysqlTable{}
+	t.schema = string(r.bytes(int(r.uint8())))
+	r.skip(1)
+	t.table = string(r.bytes(int(r.uint8())))
+	r.skip(1)
+	n := int(r.packedInt())
+	t.types = r.bytes(n)
+	metaData := r.bytes(int(r.packedInt()))
+	r.skip((n + 7) / 8)
+	if r.err != nil {
+		return errors.Annotate(r.err, "decode table map event")
+	}
+
+	meta := &mysqlBinlogReader{data: metaData}
+	t.metas = make([]uint16, n)
+	for i, tp := range t.types {
+		switch tp {
+		case mysql.TypeFloat, mysql.TypeDouble, mysql.TypeBlob, mysql.TypeGeometry, mysql.TypeJSON,
+			mysqlTypeTimestamp2, mysqlTypeDatetime2, mysqlTypeTime2:
+			t.metas[i] = uint16(meta.uint8())
+		case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeBit:
+			t.metas[i] = uint16(meta.uintN(2))
+		case mysql.TypeString, mysql.TypeNewDecimal, mysql.TypeEnum, mysql.TypeSet:
+			// the real type or precision is the first byte
+			b := meta.bytes(2)
+			if len(b) == 2 {
+				t.metas[i] = uint16(b[0])<<8 | uint16(b[1])
+			}
+		}
+	}
+	if meta.err != nil {
+		return errors.Annotatef(meta.err, "decode column metadata of table %s", quoteSchema(t.schema, t.table))
+	}
+
+	t.unsigned = make([]bool, n)
+	for r.err == nil && r.remaining() > 0 {
+		tp := r.uint8()
+		value := &mysqlBinlogReader{data: r.bytes(int(r.packedInt()))}
+		switch tp {
+		case mysqlMetaSignedness:
+			// the bits of the numeric columns from the most significant bit
+			bits, j := value.data, 0
+			for i, colTp := range t.types {
+				if !isMySQLNumericType(colTp) {
+					continue
+				}
+				if j/8 < len(bits) && bits[j/8]&(0x80>>uint(j%8)) != 0 {
+					t.unsigned[i] = true
+				}
+				j++
+			}
+		case mysqlMetaColumnName:
+			for value.err == nil && value.remaining() > 0 {
+				t.names = append(t.names, string(value.bytes(int(value.packedInt()))))
+			}
+		}
+		if value.err != nil {
+			r.err = value.err
+		}
+	}
+	if r.err != nil {
+		return errors.Annotatef(r.err, "decode optional metadata of table %s", quoteSchema(t.schema, t.table))
+	}
+	d.tables[tableID] = t
+	return nil
+}
+
+func isMySQLNumericType(tp byte) bool {
+	switch tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong,
+		mysql.TypeNewDecimal, mysql.TypeFloat, mysql.TypeDouble:
+		return true
+	}
+	return false
+}
+
+// decodeRows decodes the rows of the rows event to the events of the transaction, the update rows have the
+// before image and the after image.
+func (d *mysqlBinlogDecoder) decodeRows(tp byte, body []byte) error {
+	r := &mysqlBinlogReader{data: body}
+	postHeaderLen := d.postHeaderLen(tp, 8)
+	tableID := r.tableID(postHeaderLen)
+	r.skip(2)
+	if tp >= mysqlWriteRowsEventV2 {
+		// the extra data includes its length
+		r.skip(int(r.uintN(2)) - 2)
+	}
+	t, ok := d.tables[tableID]
+	if !ok {
+		return errors.Errorf("table map of table id %d is not found", tableID)
+	}
+	if len(t.names) != len(t.types) {
+		return errors.Errorf("the column names of table %s are not in binlog, set binlog_row_metadata to FULL", quoteSchema(t.schema, t.table))
+	}
+
+	n := int(r.packedInt())
+	present := r.bytes((n + 7) / 8)
+	var eventType pb.EventType
+	switch tp {
+	case mysqlWriteRowsEventV1, mysqlWriteRowsEventV2:
+		eventType = pb.EventType_Insert
+	case mysqlUpdateRowsEventV1, mysqlUpdateRowsEventV2:
+		eventType = pb.EventType_Update
+		// the columns of after image
+		r.skip((n + 7) / 8)
+	default:
+		eventType = pb.EventType_Delete
+	}
+	if r.err != nil {
+		return errors.Annotatef(r.err, "decode rows event of table %s", quoteSchema(t.schema, t.table))
+	}
+	if n != len(t.types) {
+		return errors.Errorf("the rows event of table %s has %d columns, but the table map has %d columns", quoteSchema(t.schema, t.table), n, len(t.types))
+	}
+	for i := 0; i < n; i++ {
+		if present[i/8]&(1<<uint(i%8)) == 0 {
+			return errors.Errorf("the rows of table %s don't have all the columns, set binlog_row_image to FULL", quoteSchema(t.schema, t.table))
+		}
+	}
+
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	for r.err == nil && r.remaining() > 0 {
+		values, err := d.decodeRow(r, t)
+		if err != nil {
+			return errors.Annotatef(err, "table %s", quoteSchema(t.schema, t.table))
+		}
+		var changed []types.Datum
+		if eventType == pb.EventType_Update {
+			if changed, err = d.decodeRow(r, t); err != nil {
+				return errors.Annotatef(err, "table %s", quoteSchema(t.schema, t.table))
+			}
+		}
+
+		row := make([][]byte, 0, n)
+		for i := range values {
+			col := pb.Column{Name: t.names[i], Tp: []byte{mysqlColumnType(t.types[i], t.metas[i])}}
+			col.MysqlType = ptypes.TypeStr(col.Tp[0])
+			if col.Value, err = codec.EncodeValue(sc, nil, values[i]); err != nil {
+				return errors.Trace(err)
+			}
+			if changed != nil {
+				if col.ChangedValue, err = codec.EncodeValue(sc, nil, changed[i]); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			data, err := col.Marshal()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			row = append(row, data)
+		}
+		schema, table := t.schema, t.table
+		d.txn = append(d.txn, pb.Event{SchemaName: &schema, TableName: &table, Tp: eventType, Row: row})
+	}
+	return errors.Annotatef(r.err, "decode rows event of table %s", quoteSchema(t.schema, t.table))
+}
+
+// decodeRow decodes the values of a row image.
+func (d *mysqlBinlogDecoder) decodeRow(r *mysqlBinlogReader, t *mysqlTable) ([]types.Datum, error) {
+	nulls := r.bytes((len(t.types) + 7) / 8)
+	values := make([]types.Datum, len(t.types))
+	for i, tp := range t.types {
+		if r.err != nil {
+			break
+		}
+		if nulls[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		v, err := decodeMySQLValue(r, tp, t.metas[i], t.unsigned[i])
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", t.names[i])
+		}
+		values[i] = v
+	}
+	return values, errors.Trace(r.err)
+}
+
+// mysqlColumnType returns the type of the column in the events, the time types of binlog are the time types,
+// and the enum and set are in the metadata of string.
+func mysqlColumnType(tp byte, meta uint16) byte {
+	switch tp {
+	case mysqlTypeTimestamp2:
+		return mysql.TypeTimestamp
+	case mysqlTypeDatetime2:
+		return mysql.TypeDatetime
+	case mysqlTypeTime2:
+		return mysql.TypeDuration
+	case mysql.TypeString:
+		if real := byte(meta >> 8); real == mysql.TypeEnum || real == mysql.TypeSet {
+			return real
+		}
+	}
+	return tp
+}
+
+// decodeMySQLValue decodes the value of a column, the time and decimal values are strings like drainer,
+// the enum and set values are their indexes, and the strings are bytes.
+func decodeMySQLValue(r *mysqlBinlogReader, tp byte, meta uint16, unsigned bool) (types.Datum, error) {
+	integer := func(size int) types.Datum {
+		v := r.uintN(size)
+		if unsigned {
+			return types.NewUintDatum(v)
+		}
+		shift := uint(64 - size*8)
+		return types.NewIntDatum(int64(v<<shift) >> shift)
+	}
+
+	switch tp {
+	case mysql.TypeTiny:
+		return integer(1), nil
+	case mysql.TypeShort:
+		return integer(2), nil
+	case mysql.TypeInt24:
+		return integer(3), nil
+	case mysql.TypeLong:
+		return integer(4), nil
+	case mysql.TypeLonglong:
+		return integer(8), nil
+	case mysql.TypeFloat:
+		return types.NewFloat64Datum(float64(math.Float32frombits(uint32(r.uintN(4))))), nil
+	case mysql.TypeDouble:
+		return types.NewFloat64Datum(math.Float64frombits(r.uintN(8))), nil
+	case mysql.TypeYear:
+		v := int64(r.uint8())
+		if v != 0 {
+			v += 1900
+		}
+		return types.NewIntDatum(v), nil
+	case mysql.TypeNewDecimal:
+		precision, frac := int(meta>>8), int(meta&0xff)
+		dec := new(types.MyDecimal)
+		if _, err := dec.FromBin(r.bytes(types.DecimalBinSize(precision, frac)), precision, frac); err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		return types.NewStringDatum(dec.String()), nil
+	case mysql.TypeDate:
+		v := r.uintN(3)
+		return types.NewStringDatum(fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31)), nil
+	case mysql.TypeDuration:
+		v := integer(3).GetInt64()
+		sign := ""
+		if v < 0 {
+			sign, v = "-", -v
+		}
+		return types.NewStringDatum(fmt.Sprintf("%s%02d:%02d:%02d", sign, v/10000, v/100%100, v%100)), nil
+	case mysql.TypeDatetime:
+		v := r.uintN(8)
+		date, tm := v/1000000, v%1000000
+		return types.NewStringDatum(fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			date/10000, date/100%100, date%100, tm/10000, tm/100%100, tm%100)), nil
+	case mysql.TypeTimestamp:
+		return types.NewStringDatum(time.Unix(int64(r.uintN(4)), 0).UTC().Format("2006-01-02 15:04:05")), nil
+	case mysqlTypeTimestamp2:
+		sec := r.bytes(4)
+		if len(sec) != 4 {
+			return types.Datum{}, errors.Trace(r.err)
+		}
+		s := time.Unix(int64(binary.BigEndian.Uint32(sec)), 0).UTC().Format("2006-01-02 15:04:05")
+		return types.NewStringDatum(s + mysqlFraction(r, int(meta))), nil
+	case mysqlTypeDatetime2:
+		packed := int64(bigEndianUint(r.bytes(5))) - 0x8000000000
+		if packed < 0 {
+			packed = -packed
+		}
+		ymd, hms := packed>>17, packed&(1<<17-1)
+		ym := ymd >> 5
+		s := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", ym/13, ym%13, ymd&31, hms>>12, (hms>>6)&63, hms&63)
+		return types.NewStringDatum(s + mysqlFraction(r, int(meta))), nil
+	case mysqlTypeTime2:
+		return types.NewStringDatum(decodeMySQLTime2(r, int(meta))), nil
+	case mysql.TypeVarchar, mysql.TypeVarString:
+		size := 1
+		if meta > 255 {
+			size = 2
+		}
+		return types.NewBytesDatum(r.bytes(int(r.uintN(size)))), nil
+	case mysql.TypeString:
+		real, length := byte(meta>>8), int(meta&0xff)
+		if real&0x30 != 0x30 {
+			// the high bits of length are in the real type
+			length |= int((real&0x30)^0x30) << 4
+			real |= 0x30
+		}
+		switch real {
+		case mysql.TypeEnum:
+			return types.NewUintDatum(r.uintN(length)), nil
+		case mysql.TypeSet:
+			return types.NewUintDatum(r.uintN(length)), nil
+		}
+		size := 1
+		if length > 255 {
+			size = 2
+		}
+		return types.NewBytesDatum(r.bytes(int(r.uintN(size)))), nil
+	case mysql.TypeBit:
+		nbits := int(meta>>8)*8 + int(meta&0xff)
+		return types.NewBytesDatum(r.bytes((nbits + 7) / 8)), nil
+	case mysql.TypeBlob, mysql.TypeGeometry:
+		return types.NewBytesDatum(r.bytes(int(r.uintN(int(meta))))), nil
+	case mysql.TypeJSON:
+		return types.Datum{}, errors.New("json column is not supported")
+	}
+	return types.Datum{}, errors.Errorf("unsupported column type %d", tp)
+}
+
+// mysqlFraction decodes the fractional seconds of the time types, fsp is the number of digits.
+func mysqlFraction(r *mysqlBinlogReader, fsp int) string {
+	if fsp == 0 {
+		return ""
+	}
+	v := bigEndianUint(r.bytes((fsp + 1) / 2))
+	// the fraction is stored in 2 digits per byte
+	if fsp%2 == 1 {
+		v /= 10
+	}
+	return fmt.Sprintf(".%0*d", fsp, v)
+}
+
+// decodeMySQLTime2 decodes the TIME value of binlog, it's packed with the fraction like my_time_packed_from_binary.
+func decodeMySQLTime2(r *mysqlBinlogReader, fsp int) string {
+	var packed int64
+	switch fsp {
+	case 0:
+		packed = (int64(bigEndianUint(r.bytes(3))) - 0x800000) << 24
+	case 1, 2:
+		intPart := int64(bigEndianUint(r.bytes(3))) - 0x800000
+		frac := int64(int8(r.uint8()))
+		if intPart < 0 && frac != 0 {
+			intPart++
+			frac -= 0x100
+		}
+		packed = intPart<<24 + frac*10000
+	case 3, 4:
+		intPart := int64(bigEndianUint(r.bytes(3))) - 0x800000
+		frac := int64(int16(bigEndianUint(r.bytes(2))))
+		if intPart < 0 && frac != 0 {
+			intPart++
+			frac -= 0x10000
+		}
+		packed = intPart<<24 + frac*100
+	default:
+		packed = int64(bigEndianUint(r.bytes(6))) - 0x800000000000
+	}
+
+	sign := ""
+	if packed < 0 {
+		sign, packed = "-", -packed
+	}
+	hms, micro := packed>>24, packed%(1<<24)
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6))
+	if fsp > 0 {
+		s += fmt.Sprintf(".%06d", micro)[:fsp+1]
+	}
+	return s
+}
+
+func bigEndianUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// mysqlBinlogReader reads the little endian values of an event, err is set if the data is too short.
+type mysqlBinlogReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *mysqlBinlogReader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *mysqlBinlogReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.remaining() < n {
+		r.err = errors.Errorf("the event is truncated at %d, %d bytes are required", r.pos, n)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *mysqlBinlogReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *mysqlBinlogReader) uint8() uint8 {
+	b := r.bytes(1)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *mysqlBinlogReader) uintN(n int) uint64 {
+	var v uint64
+	for i, c := range r.bytes(n) {
+		v |= uint64(c) << (8 * uint(i))
+	}
+	return v
+}
+
+// tableID reads the table id, it's 4 bytes in the old format whose post header length is 6.
+func (r *mysqlBinlogReader) tableID(postHeaderLen int) uint64 {
+	if postHeaderLen == 6 {
+		return r.uintN(4)
+	}
+	return r.uintN(6)
+}
+
+// packedInt reads the length encoded integer.
+func (r *mysqlBinlogReader) packedInt() uint64 {
+	switch b := r.uint8(); b {
+	case 0xfc:
+		return r.uintN(2)
+	case 0xfd:
+		return r.uintN(3)
+	case 0xfe:
+		return r.uintN(8)
+	default:
+		return uint64(b)
+	}
+}
+
+// scanMySQLBinlogFile decodes the events in the binlog file of MySQL, and calls fn for every event.
+func scanMySQLBinlogFile(file string, fn func(event []byte) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	magic := make([]byte, len(mysqlBinlogMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != mysqlBinlogMagic {
+		return errors.Errorf("%s is not a binlog file of mysql", file)
+	}
+	header := make([]byte, mysqlEventHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Annotatef(err, "read event header in %s", file)
+		}
+		size := int(binary.LittleEndian.Uint32(header[9:]))
+		if size < mysqlEventHeaderSize {
+			return errors.Errorf("invalid event size %d in %s", size, file)
+		}
+		event := make([]byte, size)
+		copy(event, header)
+		if _, err := io.ReadFull(reader, event[mysqlEventHeaderSize:]); err != nil {
+			return errors.Annotatef(err, "read event in %s", file)
+		}
+		if err := fn(event); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// mysqlBinlogFiles returns the binlog files of mysql in dir in order, the index file is skipped.
+func mysqlBinlogFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var files []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasSuffix(name, ".index") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	// the binlog files are named like mysql-bin.000001
+	sort.Strings(files)
+	return files, nil
+}
+
+// convertMySQLDir decodes the binlog files of mysql in dir, and writes the transactions and DDLs to outDir
+// in the format of drainer. It returns the number of binlogs, the warnings of the queries skipped are sampled by sampler.
+func convertMySQLDir(ctx context.Context, dir string, outDir string, sampler *sampledLogger) (int, error) {
+	files, err := mysqlBinlogFiles(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	binlogger, err := OpenMyBinlogger(outDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer binlogger.Close()
+
+	d := newMySQLBinlogDecoder(sampler)
+	var count int
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		var pos int64 = int64(len(mysqlBinlogMagic))
+		err := scanMySQLBinlogFile(file, func(event []byte) error {
+			binlog, err := d.decode(event)
+			if err != nil {
+				return errors.Annotatef(err, "event at %d", pos)
+			}
+			pos += int64(len(event))
+			if binlog == nil {
+				return nil
+			}
+			data, err := binlog.Marshal()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if _, err := binlogger.WriteTail(&tb.Entity{Payload: data}); err != nil {
+				return errors.Trace(err)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			return 0, errors.Annotatef(err, "decode %s", file)
+		}
+	}
+	if len(d.txn) != 0 {
+		log.Warn("the last transaction is not committed, skip it", zap.String("dir", dir), zap.Int("rows", len(d.txn)))
+	}
+	return count, nil
+}
+
+// mysqlConvertDir returns the dir to save the binlogs converted from the binlog files of mysql, it's not in
+// the temp dir because the sub dirs of the temp dir are the temp files of tables.
+func mysqlConvertDir(tempDir string) string {
+	return filepath.Clean(tempDir) + "_mysql"
+}
+
+// convertMySQLSources converts the binlog files of mysql in dirs to the format of drainer, and returns the dirs
+// of the converted files, every mysql server is converted to one dir.
+func (r *PITR) convertMySQLSources(ctx context.Context, dirs []string) ([]string, error) {
+	baseDir := mysqlConvertDir(r.cfg.TempDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	converted := make([]string, 0, len(dirs))
+	for i, dir := range dirs {
+		outDir := filepath.Join(baseDir, fmt.Sprintf("%d", i))
+		count, err := convertMySQLDir(ctx, dir, outDir, r.opts.sampler)
+		if err != nil {
+			return nil, errors.Annotatef(err, "convert the binlog files of mysql in %s", dir)
+		}
+		if count == 0 {
+			return nil, errors.Errorf("no transaction is found in the binlog files of mysql in %s", dir)
+		}
+		log.Info("the binlog files of mysql are converted", zap.String("dir", dir),
+			zap.String("output", outDir), zap.Int("binlogs", count))
+		converted = append(converted, outDir)
+	}
+	return converted, nil
+}
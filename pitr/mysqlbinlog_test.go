@@ -0,0 +1,195 @@
+package pitr
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+// mysqlBinlogBuilder writes the events of a binlog file of MySQL 8.0 with CRC32 checksum.
+type mysqlBinlogBuilder struct {
+	data []byte
+}
+
+func newMySQLBinlogBuilder() *mysqlBinlogBuilder {
+	b := &mysqlBinlogBuilder{data: []byte(mysqlBinlogMagic)}
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, "8.0.30")
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, mysqlEventHeaderSize)
+	lens := make([]byte, 40)
+	lens[mysqlQueryEvent-1] = 13
+	lens[mysqlTableMapEvent-1] = 8
+	for _, tp := range []int{mysqlWriteRowsEventV2, mysqlUpdateRowsEventV2, mysqlDeleteRowsEventV2} {
+		lens[tp-1] = 10
+	}
+	body = append(body, lens...)
+	body = append(body, mysqlChecksumAlgCRC32)
+	b.event(mysqlFormatDescriptionEvent, 0, body)
+	return b
+}
+
+func (b *mysqlBinlogBuilder) event(tp byte, timestamp uint32, body []byte) {
+	header := make([]byte, mysqlEventHeaderSize)
+	binary.LittleEndian.PutUint32(header, timestamp)
+	header[4] = tp
+	binary.LittleEndian.PutUint32(header[9:], uint32(mysqlEventHeaderSize+len(body)+mysqlChecksumSize))
+	event := append(header, body...)
+	checksum := make([]byte, mysqlChecksumSize)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(event))
+	b.data = append(b.data, append(event, checksum...)...)
+}
+
+func (b *mysqlBinlogBuilder) query(timestamp uint32, schema, query string) {
+	body := []byte{0, 0, 0, 0, 0, 0, 0, 0, byte(len(schema)), 0, 0, 0, 0}
+	body = append(body, schema...)
+	body = append(body, 0)
+	body = append(body, query...)
+	b.event(mysqlQueryEvent, timestamp, body)
+}
+
+// tableMap writes the table map of table id 1 which is test.t1 (id int, v varchar(20), t datetime).
+func (b *mysqlBinlogBuilder) tableMap(withNames bool) {
+	body := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 2, 't', '1', 0}
+	body = append(body, 3, mysql.TypeLong, mysql.TypeVarchar, mysqlTypeDatetime2)
+	body = append(body, 3, 80, 0, 0)
+	body = append(body, 0x06)
+	body = append(body, mysqlMetaSignedness, 1, 0)
+	if withNames {
+		body = append(body, mysqlMetaColumnName, 7, 2, 'i', 'd', 1, 'v', 1, 't')
+	}
+	b.event(mysqlTableMapEvent, 0, body)
+}
+
+func (b *mysqlBinlogBuilder) rows(tp byte, timestamp uint32, rows ...[]byte) {
+	body := []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 3, 0x07}
+	if tp == mysqlUpdateRowsEventV2 {
+		body = append(body, 0x07)
+	}
+	for _, row := range rows {
+		body = append(body, row...)
+	}
+	b.event(tp, timestamp, body)
+}
+
+func (b *mysqlBinlogBuilder) xid(timestamp uint32) {
+	b.event(mysqlXIDEvent, timestamp, make([]byte, 8))
+}
+
+func TestConvertMySQLDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mysqlbinlog")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	datetime, err := hex.DecodeString("99b042c7ad")
+	assert.NilError(t, err)
+	row := func(nulls byte, id uint32, v string) []byte {
+		data := []byte{nulls, byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24)}
+		if nulls&0x02 == 0 {
+			data = append(data, byte(len(v)))
+			data = append(data, v...)
+		}
+		return append(data, datetime...)
+	}
+
+	b := newMySQLBinlogBuilder()
+	b.query(100, "test", "create table t1 (id int primary key, v varchar(20), t datetime)")
+	b.query(100, "test", "BEGIN")
+	b.tableMap(true)
+	b.rows(mysqlWriteRowsEventV2, 100, row(0, 1, "a"), row(0x02, 0xfffffffe, ""))
+	b.rows(mysqlUpdateRowsEventV2, 100, row(0, 1, "a"), row(0, 1, "b"))
+	b.xid(100)
+	// the rolled back transaction is skipped
+	b.query(200, "test", "BEGIN")
+	b.tableMap(true)
+	b.rows(mysqlDeleteRowsEventV2, 200, row(0, 1, "b"))
+	b.query(200, "test", "ROLLBACK")
+
+	binlogDir := filepath.Join(dir, "mysql")
+	assert.NilError(t, os.MkdirAll(binlogDir, 0700))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(binlogDir, "mysql-bin.000001"), b.data, 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(binlogDir, "mysql-bin.index"), []byte("./mysql-bin.000001\n"), 0600))
+
+	outDir := filepath.Join(dir, "out")
+	count, err := convertMySQLDir(context.Background(), binlogDir, outDir, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+
+	files, err := searchFiles(outDir)
+	assert.NilError(t, err)
+	var converted []*pb.Binlog
+	for _, file := range files {
+		assert.NilError(t, scanBinlogFile(file, runOptions{}, func(binlog *pb.Binlog) error {
+			converted = append(converted, binlog)
+			return nil
+		}))
+	}
+	assert.Equal(t, len(converted), 2)
+	assert.Equal(t, converted[0].Tp, pb.BinlogType_DDL)
+	assert.Equal(t, string(converted[0].DdlQuery), "use `test`; create table t1 (id int primary key, v varchar(20), t datetime);")
+	// the transactions in the same second have increasing commit ts
+	assert.Assert(t, converted[1].CommitTs > converted[0].CommitTs)
+
+	toString := func(data []byte) string {
+		_, value, err := codec.DecodeOne(data)
+		assert.NilError(t, err)
+		if value.IsNull() {
+			return "<nil>"
+		}
+		s, err := value.ToString()
+		assert.NilError(t, err)
+		return s
+	}
+	var events []string
+	for _, ev := range converted[1].DmlData.Events {
+		cols, err := decodeColumns(ev.GetRow())
+		assert.NilError(t, err)
+		s := ev.GetTp().String()
+		for _, col := range cols {
+			s += " " + col.Name + "=" + toString(col.Value)
+			if len(col.ChangedValue) != 0 {
+				s += "->" + toString(col.ChangedValue)
+			}
+		}
+		events = append(events, s)
+	}
+	assert.DeepEqual(t, events, []string{
+		"Insert id=1 v=a t=2023-06-01 12:30:45",
+		"Insert id=-2 v=<nil> t=2023-06-01 12:30:45",
+		"Update id=1->1 v=a->b t=2023-06-01 12:30:45->2023-06-01 12:30:45",
+	})
+
+	// the rows can't be decoded without the column names
+	b = newMySQLBinlogBuilder()
+	b.tableMap(false)
+	b.rows(mysqlWriteRowsEventV2, 100, row(0, 1, "a"))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(binlogDir, "mysql-bin.000001"), b.data, 0600))
+	_, err = convertMySQLDir(context.Background(), binlogDir, filepath.Join(dir, "out2"), nil)
+	assert.ErrorContains(t, err, "set binlog_row_metadata to FULL")
+
+	// the DMLs in statement format can't be merged
+	b = newMySQLBinlogBuilder()
+	b.query(100, "test", "insert into t1 values (1, 'a', now())")
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(binlogDir, "mysql-bin.000001"), b.data, 0600))
+	_, err = convertMySQLDir(context.Background(), binlogDir, filepath.Join(dir, "out3"), nil)
+	assert.ErrorContains(t, err, "set binlog_format to ROW")
+}
+
+func TestMySQLVersionAtLeast(t *testing.T) {
+	assert.Assert(t, mysqlVersionAtLeast("8.0.30-log", 5, 6, 1))
+	assert.Assert(t, mysqlVersionAtLeast("10.5.8-MariaDB", 5, 6, 1))
+	assert.Assert(t, mysqlVersionAtLeast("5.6.1", 5, 6, 1))
+	assert.Assert(t, !mysqlVersionAtLeast("5.5.62", 5, 6, 1))
+	assert.Assert(t, !mysqlVersionAtLeast("5.6.0-log", 5, 6, 1))
+}
@@ -0,0 +1,53 @@
+package pitr
+
+import (
+	"github.com/pingcap/errors"
+)
+
+// runOptions is the settings of a run used by the readers, writers and sinks, it's built by New from
+// the config and passed down by PITR and Merge, so the runs in one process never share them.
+// The zero value keeps the default of every setting, it's used by the subcommands and tests.
+type runOptions struct {
+	// cipher encrypts the output files, and decrypts the encrypted binlogs when reading, nil means
+	// encrypt-key-file is not set
+	cipher *payloadCipher
+	// safeMode makes the DML statements written to sql files and executed in dest-db idempotent,
+	// it's also turned on by conflict-check safe-mode before applying
+	safeMode bool
+	// foreignKeyChecksDisabled disables the foreign key checks in every sql file and session of dest-db
+	foreignKeyChecksDisabled bool
+	// syncMode is how the output files are synced before they're renamed, empty means sync-mode file
+	syncMode string
+	// maxEventSize is the max size of a binlog read from or written to the binlog files, 0 means no limit
+	maxEventSize int64
+	// skipOversizedEvents skips the binlogs larger than maxEventSize instead of failing
+	skipOversizedEvents bool
+	// router renames the tables in the output, nil means keeping the names
+	router *tableRouter
+	// sampler samples the repetitive logs, nil prints all the logs
+	sampler *sampledLogger
+}
+
+// newRunOptions builds the options of a run from cfg.
+func newRunOptions(cfg *Config, router *tableRouter) (runOptions, error) {
+	opts := runOptions{
+		safeMode:                 cfg.SafeMode,
+		foreignKeyChecksDisabled: cfg.ForeignKeyMode == foreignKeyModeDisableChecks,
+		syncMode:                 cfg.SyncMode,
+		skipOversizedEvents:      cfg.OnOversizedEvent == onOversizedSkip,
+		router:                   router,
+		sampler:                  newSampledLogger(cfg.LogSampleLimit),
+	}
+	var err error
+	if len(cfg.MaxEventSize) != 0 {
+		if opts.maxEventSize, err = parseSize(cfg.MaxEventSize); err != nil {
+			return runOptions{}, errors.Annotate(err, "max-event-size")
+		}
+	}
+	if len(cfg.EncryptKeyFile) != 0 {
+		if opts.cipher, err = loadEncryptKey(cfg.EncryptKeyFile); err != nil {
+			return runOptions{}, errors.Trace(err)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,35 @@
+package pitr
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRunOptionsOfEveryRun(t *testing.T) {
+	cfg := NewConfig()
+	cfg.SafeMode = true
+	cfg.MaxEventSize = "1KiB"
+	cfg.OnOversizedEvent = onOversizedSkip
+	cfg.SyncMode = syncModeDir
+	r1, err := New(cfg)
+	assert.NilError(t, err)
+	assert.Assert(t, r1.opts.safeMode && r1.opts.skipOversizedEvents)
+	assert.Equal(t, r1.opts.maxEventSize, int64(1024))
+	assert.Equal(t, r1.opts.syncMode, syncModeDir)
+	assert.Assert(t, r1.opts.sampler != nil)
+
+	// the next run in the same process never gets the settings of the last one
+	r2, err := New(NewConfig())
+	assert.NilError(t, err)
+	assert.Assert(t, !r2.opts.safeMode && !r2.opts.skipOversizedEvents)
+	assert.Equal(t, r2.opts.maxEventSize, int64(1<<30))
+	assert.Equal(t, r2.opts.syncMode, syncModeFile)
+	assert.Assert(t, r2.opts.sampler != r1.opts.sampler)
+	assert.Assert(t, r2.filter.sampler == r2.opts.sampler)
+
+	cfg = NewConfig()
+	cfg.MaxEventSize = "1x"
+	_, err = New(cfg)
+	assert.ErrorContains(t, err, "max-event-size")
+}
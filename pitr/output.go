@@ -0,0 +1,242 @@
+package pitr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+)
+
+const (
+	// outputFormatPB outputs binlog files in drainer's protobuf format, which can be replayed by reparo
+	outputFormatPB = "pb"
+	// outputFormatSQL outputs SQL files, which can be replayed by mysql client
+	outputFormatSQL = "sql"
+
+	sqlFileSuffix = ".sql"
+)
+
+// binlogWriter writes the merged binlogs of one table. The files are written with the suffix ".tmp" and
+// renamed by Close when they're complete, abort removes them instead when the table fails.
+type binlogWriter interface {
+	Write(binlog *pb.Binlog) error
+	Close() error
+	abort()
+}
+
+// textEncoder encodes the binlogs of a table to the output file of a text format other than sql.
+type textEncoder interface {
+	encode(binlog *pb.Binlog) ([]byte, error)
+}
+
+// textFormat is an output format written by sqlWriter, a new text format is added by registering its
+// encoder in textFormats, the merging and the rotation of files are shared by all the formats.
+type textFormat struct {
+	suffix string
+	// newEncoder returns the encoder of an output file, nil means writing SQL statements
+	newEncoder func() textEncoder
+}
+
+var textFormats = map[string]textFormat{
+	outputFormatSQL:   {suffix: sqlFileSuffix},
+	outputFormatJSONL: {suffix: jsonlFileSuffix, newEncoder: func() textEncoder { return jsonlEncoder{} }},
+	outputFormatCSV:   {suffix: csvFileSuffix, newEncoder: func() textEncoder { return &csvEncoder{} }},
+}
+
+// isTextFormat returns true if the output files of the format are written by sqlWriter.
+func isTextFormat(format string) bool {
+	_, ok := textFormats[format]
+	return ok
+}
+
+// textFileSuffix returns the suffix of the output files of the text format.
+func textFileSuffix(format string) string {
+	if f, ok := textFormats[format]; ok {
+		return f.suffix
+	}
+	return sqlFileSuffix
+}
+
+// newTextWriter creates the writer of the text format.
+func newTextWriter(opts runOptions, format, fileName, codec string) (*sqlWriter, error) {
+	w, err := newSQLWriter(opts, fileName, codec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f := textFormats[format]; f.newEncoder != nil {
+		w.encoder = f.newEncoder()
+	} else if opts.foreignKeyChecksDisabled {
+		// every file is replayed in its own session, so every file disables the checks
+		n, err := w.writer.WriteString(disableForeignKeyChecks + "\n")
+		w.written += int64(n)
+		if err != nil {
+			w.abort()
+			return nil, errors.Trace(err)
+		}
+	}
+	return w, nil
+}
+
+// newBinlogWriter returns a binlogWriter of the format, output is the output dir of the table,
+// the text formats write to the file named output + ".sql", ".jsonl" or ".csv".
+// The output is compressed by codec. if fileSize is greater than 0, a new file is created after the size of
+// current file exceeds it, the sql files are named like output + ".000001.sql" in this case.
+func newBinlogWriter(opts runOptions, format, output, codec string, fileSize int64) (binlogWriter, error) {
+	if format == outputFormatPB || format == "" {
+		return newPBWriter(opts, output, codec, fileSize)
+	}
+	if !isTextFormat(format) {
+		return nil, errors.Errorf("unknown output format %s", format)
+	}
+	if fileSize > 0 {
+		return newRotatingSQLWriter(opts, output, format, codec, fileSize)
+	}
+	return newTextWriter(opts, format, output+textFileSuffix(format)+compressSuffix(codec)+encryptSuffixOf(opts.cipher), codec)
+}
+
+// pbWriter writes binlogs to files in drainer's protobuf format, the files are written in dir + ".tmp",
+// which is renamed to dir by Close.
+type pbWriter struct {
+	dir       string
+	tmpDir    string
+	binlogger *myBinlogger
+	// codec is used to compress the binlog files after closing binlogger
+	codec string
+	// fileSize is the size to rotate the binlog file, 0 means binlogfile.SegmentSizeBytes
+	fileSize int64
+	// opts is the settings of the run, like max-event-size and the cipher
+	opts runOptions
+}
+
+func newPBWriter(opts runOptions, dir string, codec string, fileSize int64) (*pbWriter, error) {
+	// remove the files written partly by the last run, the binlogger appends to them
+	tmpDir := dir + tmpOutputSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	binlogger, err := OpenMyBinlogger(tmpDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	binlogger.cipher = opts.cipher
+
+	return &pbWriter{dir: dir, tmpDir: tmpDir, binlogger: binlogger, codec: codec, fileSize: fileSize, opts: opts}, nil
+}
+
+func (w *pbWriter) Write(binlog *pb.Binlog) error {
+	data, err := binlog.Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if w.opts.maxEventSize > 0 && int64(len(data)) > w.opts.maxEventSize {
+		return errors.Trace(w.writeOversized(binlog, len(data)))
+	}
+
+	// rotate before writing, so the last file is never empty
+	if w.fileSize > 0 && w.binlogger.position().Offset >= w.fileSize {
+		if err := w.binlogger.ManualRotate(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	_, err = w.binlogger.WriteTail(&tb.Entity{Payload: data})
+	return errors.Trace(err)
+}
+
+func (w *pbWriter) Close() error {
+	if err := w.binlogger.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if compressSuffix(w.codec) != "" {
+		names, err := binlogfile.ReadBinlogNames(w.tmpDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, name := range names {
+			if _, codec := trimCompressSuffix(name); codec != compressNone {
+				continue
+			}
+			if err := compressFile(filepath.Join(w.tmpDir, name), w.codec); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	if err := syncOutputDirFiles(w.tmpDir, w.opts.syncMode); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(publishOutput(w.tmpDir, w.dir, w.opts.syncMode))
+}
+
+// abort removes the files written partly.
+func (w *pbWriter) abort() {
+	w.binlogger.Close()
+	os.RemoveAll(w.tmpDir)
+}
+
+// rotatingSQLWriter writes binlogs to the files of a text format named like prefix.000000.sql, a new file is created
+// after the size of current file before compression exceeds fileSize.
+type rotatingSQLWriter struct {
+	prefix   string
+	format   string
+	codec    string
+	fileSize int64
+	opts     runOptions
+
+	index  int
+	writer *sqlWriter
+}
+
+func newRotatingSQLWriter(opts runOptions, prefix, format, codec string, fileSize int64) (*rotatingSQLWriter, error) {
+	// remove the files may be written by the last run
+	for i := 0; ; i++ {
+		err := os.Remove(sqlPartName(prefix, i, format, codec, opts.cipher))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	writer, err := newTextWriter(opts, format, sqlPartName(prefix, 0, format, codec, opts.cipher), codec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &rotatingSQLWriter{prefix: prefix, format: format, codec: codec, fileSize: fileSize, opts: opts, writer: writer}, nil
+}
+
+// sqlPartName returns the name of the index-th file of prefix in the text format, c is the cipher encrypting it.
+func sqlPartName(prefix string, index int, format, codec string, c *payloadCipher) string {
+	return fmt.Sprintf("%s.%06d%s%s%s", prefix, index, textFileSuffix(format), compressSuffix(codec), encryptSuffixOf(c))
+}
+
+func (w *rotatingSQLWriter) Write(binlog *pb.Binlog) error {
+	if w.writer.written >= w.fileSize {
+		if err := w.writer.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		w.index++
+		writer, err := newTextWriter(w.opts, w.format, sqlPartName(w.prefix, w.index, w.format, w.codec, w.opts.cipher), w.codec)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		w.writer = writer
+	}
+	return errors.Trace(w.writer.Write(binlog))
+}
+
+func (w *rotatingSQLWriter) Close() error {
+	return errors.Trace(w.writer.Close())
+}
+
+// abort removes the current file and the files already rotated, so no file of the table is left.
+func (w *rotatingSQLWriter) abort() {
+	w.writer.abort()
+	for i := 0; i < w.index; i++ {
+		os.Remove(sqlPartName(w.prefix, i, w.format, w.codec, w.opts.cipher))
+	}
+}
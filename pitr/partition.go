@@ -0,0 +1,405 @@
+package pitr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// alterPartitions changes the partitions of the table by the spec, the partition options are copied, so the
+// table shared with the tracked versions before is not changed.
+func alterPartitions(table *ast.CreateTableStmt, spec *ast.AlterTableSpec) (*ast.CreateTableStmt, error) {
+	if spec.Tp == ast.AlterTablePartition {
+		table.Partition = spec.Partition
+		return table, nil
+	}
+	if table.Partition == nil {
+		return nil, errors.Errorf("table %s is not partitioned", table.Table.Name.O)
+	}
+	partition := *table.Partition
+	partition.Definitions = append([]*ast.PartitionDefinition(nil), table.Partition.Definitions...)
+
+	switch spec.Tp {
+	case ast.AlterTableAddPartitions:
+		if len(partition.Definitions) == 0 && len(spec.PartDefinitions) == 0 {
+			partition.Num += spec.Num
+			break
+		}
+		// the partitions only having the number are named p0, p1... like TiDB
+		for i := len(partition.Definitions); i < int(partition.Num); i++ {
+			partition.Definitions = append(partition.Definitions, newPartitionDefinition(i))
+		}
+		for i := uint64(0); i < spec.Num; i++ {
+			partition.Definitions = append(partition.Definitions, newPartitionDefinition(len(partition.Definitions)))
+		}
+		for _, def := range spec.PartDefinitions {
+			if findPartition(&partition, def.Name.L) >= 0 {
+				return nil, errors.Errorf("duplicate partition name %s", def.Name.O)
+			}
+			partition.Definitions = append(partition.Definitions, def)
+		}
+		if partition.Num != 0 {
+			partition.Num = uint64(len(partition.Definitions))
+		}
+	case ast.AlterTableCoalescePartitions:
+		n := uint64(partitionCount(&partition))
+		if partition.Tp != model.PartitionTypeHash || spec.Num >= n {
+			return nil, errors.Errorf("can't coalesce %d partitions of table %s", spec.Num, table.Table.Name.O)
+		}
+		if len(partition.Definitions) != 0 {
+			partition.Definitions = partition.Definitions[:n-spec.Num]
+		}
+		if partition.Num != 0 {
+			partition.Num = n - spec.Num
+		}
+	case ast.AlterTableDropPartition:
+		for _, name := range spec.PartitionNames {
+			i := findPartition(&partition, name.L)
+			if i < 0 {
+				return nil, errors.Errorf("partition %s doesn't exist", name.O)
+			}
+			partition.Definitions = append(partition.Definitions[:i], partition.Definitions[i+1:]...)
+		}
+	default:
+		// TRUNCATE PARTITION only removes the rows
+		return table, nil
+	}
+	table.Partition = &partition
+	return table, nil
+}
+
+func newPartitionDefinition(i int) *ast.PartitionDefinition {
+	return &ast.PartitionDefinition{
+		Name:   model.NewCIStr(fmt.Sprintf("p%d", i)),
+		Clause: &ast.PartitionDefinitionClauseNone{},
+	}
+}
+
+func findPartition(partition *ast.PartitionOptions, name string) int {
+	for i, def := range partition.Definitions {
+		if def.Name.L == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// partitionCount returns the number of partitions, the partitions by HASH may only have the number.
+func partitionCount(partition *ast.PartitionOptions) int {
+	if len(partition.Definitions) != 0 {
+		return len(partition.Definitions)
+	}
+	return int(partition.Num)
+}
+
+// partitionName returns the name of the i-th partition, the partitions without definition are named p0, p1...
+// like TiDB.
+func partitionName(partition *ast.PartitionOptions, i int) string {
+	if i < len(partition.Definitions) {
+		return partition.Definitions[i].Name.O
+	}
+	return fmt.Sprintf("p%d", i)
+}
+
+// partitionOf returns the name of the partition of the row in the table. Only the partitions by RANGE, LIST or
+// HASH of a column are supported, the partitions by the functions of the columns can't be located without TiDB.
+// NULL is in the first partition like MySQL.
+func (info *tableInfo) partitionOf(row rowValues) (string, error) {
+	partition := info.partition
+	if partition == nil {
+		return "", errors.Errorf("table %s is not partitioned", quoteSchema(info.schema, info.table))
+	}
+
+	var column string
+	if e, ok := partition.Expr.(*ast.ColumnNameExpr); ok {
+		column = e.Name.Name.L
+	} else if partition.Expr == nil && len(partition.ColumnNames) == 1 {
+		column = partition.ColumnNames[0].Name.L
+	}
+	if len(column) == 0 || partition.Tp == model.PartitionTypeKey || partition.Tp == model.PartitionTypeSystemTime {
+		return "", errors.Errorf("the partitions of table %s by %s are not supported, only RANGE, LIST or HASH of a column is supported",
+			quoteSchema(info.schema, info.table), partition.Tp)
+	}
+	value, ok := row[column]
+	if !ok {
+		return "", errors.Errorf("the partition column %s of table %s is not in the row", column, quoteSchema(info.schema, info.table))
+	}
+
+	sc := &stmtctx.StatementContext{}
+	switch partition.Tp {
+	case model.PartitionTypeHash:
+		var id int64
+		switch value.Kind() {
+		case types.KindNull:
+		case types.KindInt64:
+			id = value.GetInt64()
+		case types.KindUint64:
+			id = int64(value.GetUint64())
+		default:
+			return "", errors.Errorf("the partition column %s of table %s is not an integer", column, quoteSchema(info.schema, info.table))
+		}
+		n := int64(partitionCount(partition))
+		if n == 0 {
+			break
+		}
+		i := id % n
+		if i < 0 {
+			i = -i
+		}
+		return partitionName(partition, int(i)), nil
+	default:
+		for _, def := range partition.Definitions {
+			var bounds []ast.ExprNode
+			switch clause := def.Clause.(type) {
+			case *ast.PartitionDefinitionClauseLessThan:
+				if len(clause.Exprs) != 1 {
+					continue
+				}
+				if _, ok := clause.Exprs[0].(*ast.MaxValueExpr); ok || value.IsNull() {
+					return def.Name.O, nil
+				}
+				bounds = clause.Exprs
+			case *ast.PartitionDefinitionClauseIn:
+				for _, values := range clause.Values {
+					if len(values) == 1 {
+						bounds = append(bounds, values[0])
+					}
+				}
+			}
+			for _, expr := range bounds {
+				bound, err := partitionBound(expr)
+				if err != nil {
+					return "", errors.Annotatef(err, "partition %s of table %s", def.Name.O, quoteSchema(info.schema, info.table))
+				}
+				if bound.IsNull() || value.IsNull() {
+					if bound.IsNull() && value.IsNull() {
+						return def.Name.O, nil
+					}
+					continue
+				}
+				cmp, err := value.CompareDatum(sc, &bound)
+				if err != nil {
+					return "", errors.Trace(err)
+				}
+				_, lessThan := def.Clause.(*ast.PartitionDefinitionClauseLessThan)
+				if (lessThan && cmp < 0) || (!lessThan && cmp == 0) {
+					return def.Name.O, nil
+				}
+			}
+		}
+	}
+	return "", errors.Errorf("no partition of table %s has value %v", quoteSchema(info.schema, info.table), value.GetValue())
+}
+
+// partitionBound returns the value of the constant in the definition of a partition.
+func partitionBound(expr ast.ExprNode) (types.Datum, error) {
+	f := &rowFilter{sc: &stmtctx.StatementContext{}}
+	value, err := f.compileValue(expr)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	return value(nil)
+}
+
+// removedPartitions is the partitions whose rows are removed by a DROP PARTITION or TRUNCATE PARTITION DDL.
+type removedPartitions struct {
+	schema string
+	table  string
+	// names is the lower case names of the partitions
+	names map[string]bool
+}
+
+// parseRemovedPartitions returns the partitions removed by the DDL, it returns nil if the DDL removes none.
+func parseRemovedPartitions(ddl string) (*removedPartitions, error) {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var removed *removedPartitions
+	for _, stmt := range stmts {
+		node, ok := stmt.(*ast.AlterTableStmt)
+		if !ok {
+			continue
+		}
+		for _, spec := range node.Specs {
+			if spec.Tp != ast.AlterTableDropPartition && spec.Tp != ast.AlterTableTruncatePartition {
+				continue
+			}
+			if removed == nil {
+				removed = &removedPartitions{table: node.Table.Name.O, names: make(map[string]bool)}
+			}
+			for _, name := range spec.PartitionNames {
+				removed.names[name.L] = true
+			}
+		}
+	}
+	if removed == nil {
+		return nil, nil
+	}
+	if removed.schema, _, err = parserSchemaTableFromDDL(ddl); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return removed, nil
+}
+
+// discardPartitionRows discards the merged events whose rows before and after are all in the removed partitions,
+// they're removed by the DDL anyway. The others are written before the DDL, a row moved into a removed partition
+// by UPDATE is still deleted from its partition before. It must be called before the DDL is executed.
+func (tm *TableMerge) discardPartitionRows(removed *removedPartitions) error {
+	info, err := ddlHandle.GetTableInfo(removed.schema, removed.table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if info.partition == nil {
+		return nil
+	}
+
+	var n int64
+	for key, e := range tm.keyEvent {
+		images, err := eventImages(e)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		inRemoved := true
+		for _, row := range images {
+			name, err := info.partitionOf(row)
+			if err != nil {
+				// the rows are kept if they can't be located, the DDL removes them in downstream
+				tm.opts.sampler.warn("can't locate the partition of the row, keep it", zap.String("table", tm.name), zap.Error(err))
+				return nil
+			}
+			inRemoved = inRemoved && removed.names[strings.ToLower(name)]
+		}
+		if inRemoved {
+			delete(tm.keyEvent, key)
+			tm.addMemory(-e.size())
+			n++
+		}
+	}
+	if n > 0 {
+		log.Info("discard the rows in the removed partitions", zap.String("table", tm.name), zap.Int64("rows", n))
+		tm.report.addRowsDiscarded(tm.name, n)
+	}
+	return nil
+}
+
+// eventImages returns the rows of the merged event, the update has the rows before and after.
+func eventImages(e *Event) ([]rowValues, error) {
+	before := make(rowValues, len(e.cols))
+	after := make(rowValues, len(e.cols))
+	for _, col := range e.cols {
+		_, val, err := codec.DecodeOne(col.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		before[strings.ToLower(col.Name)] = formatValue(val, col.Tp[0])
+		if e.eventType != pb.EventType_Update {
+			continue
+		}
+		_, val, err = codec.DecodeOne(col.ChangedValue)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		after[strings.ToLower(col.Name)] = formatValue(val, col.Tp[0])
+	}
+	if e.eventType != pb.EventType_Update {
+		return []rowValues{before}, nil
+	}
+	return []rowValues{before, after}, nil
+}
+
+// partitionRule keeps the rows of a table in the partitions.
+type partitionRule struct {
+	schema string
+	table  string
+	// names is the lower case names of the partitions
+	names map[string]bool
+}
+
+// parsePartitions parses the rules like `db.orders: p2023, p2024; db.logs: p0`.
+func parsePartitions(s string) ([]*partitionRule, error) {
+	var rules []*partitionRule
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid partitions %s, should be like db.table: p0, p1", item)
+		}
+		names := strings.SplitN(strings.TrimSpace(parts[0]), ".", 2)
+		if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 {
+			return nil, errors.Errorf("invalid table %s in partitions, should be like db.table", parts[0])
+		}
+		key := quoteSchema(strings.ToLower(names[0]), strings.ToLower(names[1]))
+		if seen[key] {
+			return nil, errors.Errorf("duplicate partitions of table %s", key)
+		}
+		seen[key] = true
+
+		rule := &partitionRule{schema: names[0], table: names[1], names: make(map[string]bool)}
+		for _, name := range strings.Split(parts[1], ",") {
+			if name = strings.TrimSpace(name); len(name) != 0 {
+				rule.names[strings.ToLower(name)] = true
+			}
+		}
+		if len(rule.names) == 0 {
+			return nil, errors.Errorf("no partition of table %s in partitions", key)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// withPartitions adds the partitions of tables to the row filter, the rows of the tables are kept only if they're
+// in the partitions and match the expressions of row-filter. The partition of a row is located by the schema
+// tracked when the row is read, so the partitions added and dropped in the window are handled.
+func (f *rowFilter) withPartitions(s string) (*rowFilter, error) {
+	rules, err := parsePartitions(s)
+	if err != nil || len(rules) == 0 {
+		return f, errors.Trace(err)
+	}
+	if f == nil {
+		f = &rowFilter{
+			rules: make(map[string]rowPredicate),
+			sc:    &stmtctx.StatementContext{},
+		}
+	}
+	for _, rule := range rules {
+		rule := rule
+		key := quoteSchema(strings.ToLower(rule.schema), strings.ToLower(rule.table))
+		expr := f.rules[key]
+		f.rules[key] = func(row rowValues) (bool, error) {
+			info, err := ddlHandle.GetTableInfo(rule.schema, rule.table)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			name, err := info.partitionOf(row)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if !rule.names[strings.ToLower(name)] {
+				return false, nil
+			}
+			if expr == nil {
+				return true, nil
+			}
+			return expr(row)
+		}
+	}
+	return f, nil
+}
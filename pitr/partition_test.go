@@ -0,0 +1,192 @@
+package pitr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func TestPartitionOf(t *testing.T) {
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	ddl.ResetDB()
+	for _, sql := range []string{
+		"use test; create table r (id int primary key) partition by range (id) (partition p0 values less than (10), partition p1 values less than (20))",
+		"use test; create table h (id int primary key) partition by hash (id) partitions 4",
+		"use test; create table f (id int primary key, d date) partition by range (year(d)) (partition p0 values less than (2020), partition p1 values less than maxvalue)",
+	} {
+		assert.NilError(t, ddl.ExecuteDDL("", sql), sql)
+	}
+
+	partitionOf := func(table string, id interface{}) (string, error) {
+		info, err := ddl.GetTableInfo("test", table)
+		assert.NilError(t, err)
+		return info.partitionOf(rowValues{"id": types.NewDatum(id)})
+	}
+	for _, c := range []struct {
+		table     string
+		id        interface{}
+		partition string
+	}{
+		{"r", int64(-5), "p0"},
+		{"r", int64(10), "p1"},
+		{"r", nil, "p0"},
+		{"h", int64(6), "p2"},
+		{"h", int64(-7), "p3"},
+		{"h", nil, "p0"},
+	} {
+		partition, err := partitionOf(c.table, c.id)
+		assert.NilError(t, err, "%s: %v", c.table, c.id)
+		assert.Equal(t, partition, c.partition, "%s: %v", c.table, c.id)
+	}
+	_, err = partitionOf("r", int64(20))
+	assert.ErrorContains(t, err, "no partition of table `test`.`r` has value 20")
+	_, err = partitionOf("f", int64(1))
+	assert.ErrorContains(t, err, "not supported")
+
+	// the partitions are tracked across ADD, DROP and COALESCE PARTITION
+	for _, sql := range []string{
+		"use test; alter table r add partition (partition p2 values less than (30))",
+		"use test; alter table r drop partition p0",
+		"use test; alter table r truncate partition p1",
+		"use test; alter table h coalesce partition 1",
+		"use test; alter table h add partition (partition p3)",
+	} {
+		assert.NilError(t, ddl.ExecuteDDL("", sql), sql)
+	}
+	for _, c := range []struct {
+		table     string
+		id        interface{}
+		partition string
+	}{
+		{"r", int64(-5), "p1"},
+		{"r", int64(25), "p2"},
+		{"h", int64(6), "p2"},
+		{"h", int64(7), "p3"},
+	} {
+		partition, err := partitionOf(c.table, c.id)
+		assert.NilError(t, err, "%s: %v", c.table, c.id)
+		assert.Equal(t, partition, c.partition, "%s: %v", c.table, c.id)
+	}
+	assert.ErrorContains(t, ddl.ExecuteDDL("", "use test; alter table r drop partition p0"), "partition p0 doesn't exist")
+	createTable, err := ddl.tracker.showCreateTable("test", "r")
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(createTable, "`p0`") && strings.Contains(createTable, "`p2`"), createTable)
+}
+
+func TestPartitionFilter(t *testing.T) {
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	ddl.ResetDB()
+	sql := "use test; create table orders (id int primary key, v int) partition by range (id) (partition p0 values less than (10), partition p1 values less than (20), partition p2 values less than maxvalue)"
+	assert.NilError(t, ddl.ExecuteDDL("", sql))
+
+	_, err = parsePartitions("test.orders")
+	assert.ErrorContains(t, err, "should be like db.table: p0, p1")
+	_, err = parsePartitions("test.orders: p0; TEST.Orders: p1")
+	assert.ErrorContains(t, err, "duplicate partitions")
+
+	f, err := parseRowFilter("test.orders: v > 0")
+	assert.NilError(t, err)
+	f, err = f.withPartitions("test.orders: P1, p2")
+	assert.NilError(t, err)
+	for _, c := range []struct {
+		id, v   int64
+		matched bool
+	}{
+		{5, 1, false},
+		{15, 1, true},
+		{15, 0, false},
+		{25, 1, true},
+	} {
+		schema, table := "test", "orders"
+		var row [][]byte
+		for _, col := range []*pb.Column{
+			{Name: "id", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(c.id)},
+			{Name: "v", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(c.v)},
+		} {
+			data, err := col.Marshal()
+			assert.NilError(t, err)
+			row = append(row, data)
+		}
+		matched, err := f.match(&pb.Event{SchemaName: &schema, TableName: &table, Tp: pb.EventType_Insert, Row: row})
+		assert.NilError(t, err)
+		assert.Equal(t, matched, c.matched, "id %d, v %d", c.id, c.v)
+	}
+
+	// the events only in the removed partitions are discarded before the DDL
+	removed, err := parseRemovedPartitions("use test; alter table orders truncate partition p0")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed.names, map[string]bool{"p0": true})
+	removed, err = parseRemovedPartitions("use test; alter table orders add column c int")
+	assert.NilError(t, err)
+	assert.Assert(t, removed == nil)
+
+	event := func(tp pb.EventType, id, changedID int64) *Event {
+		return &Event{schema: "test", table: "orders", eventType: tp, cols: []*pb.Column{
+			{Name: "id", Tp: []byte{mysql.TypeLong}, Value: encodeIntValue(id), ChangedValue: encodeIntValue(changedID)},
+		}}
+	}
+	tm := NewTableMerge("", "", nil)
+	tm.keyEvent = map[string]*Event{
+		"1": event(pb.EventType_Insert, 1, 0),
+		"2": event(pb.EventType_Delete, 2, 0),
+		"3": event(pb.EventType_Update, 3, 4),
+		// the row moved into p0 is still deleted from p1
+		"4": event(pb.EventType_Update, 15, 5),
+		"5": event(pb.EventType_Insert, 15, 0),
+	}
+	removed, err = parseRemovedPartitions("use test; alter table orders drop partition p0")
+	assert.NilError(t, err)
+	assert.NilError(t, tm.discardPartitionRows(removed))
+	assert.Equal(t, len(tm.keyEvent), 2)
+	assert.Assert(t, tm.keyEvent["4"] != nil && tm.keyEvent["5"] != nil)
+}
+
+func TestPumpSchemaPartitions(t *testing.T) {
+	partitioned := func(version int64, ids ...int64) *model.HistoryInfo {
+		info := &model.TableInfo{ID: 10, Name: model.NewCIStr("t1"), State: model.StatePublic, Partition: &model.PartitionInfo{Enable: true}}
+		for _, id := range ids {
+			info.Partition.Definitions = append(info.Partition.Definitions, model.PartitionDefinition{ID: id})
+		}
+		return &model.HistoryInfo{SchemaVersion: version, TableInfo: info}
+	}
+	jobs := []*model.Job{
+		{ID: 1, Type: model.ActionCreateSchema, SchemaID: 1, BinlogInfo: &model.HistoryInfo{
+			SchemaVersion: 1, DBInfo: &model.DBInfo{ID: 1, Name: model.NewCIStr("test")}}},
+		{ID: 2, Type: model.ActionCreateTable, SchemaID: 1, TableID: 10, BinlogInfo: partitioned(2, 11, 12)},
+		{ID: 3, Type: model.ActionAddTablePartition, SchemaID: 1, TableID: 10, BinlogInfo: partitioned(3, 11, 12, 13)},
+		{ID: 4, Type: model.ActionDropTablePartition, SchemaID: 1, TableID: 10, BinlogInfo: partitioned(4, 12, 13)},
+		// the truncated partition gets a new id
+		{ID: 5, Type: model.ActionTruncateTablePartition, SchemaID: 1, TableID: 10, BinlogInfo: partitioned(5, 12, 14)},
+	}
+	s := newPumpSchema(jobs)
+	for _, c := range []struct {
+		version int64
+		ids     []int64
+		missing []int64
+	}{
+		{2, []int64{11, 12}, []int64{13}},
+		{3, []int64{11, 12, 13}, nil},
+		{4, []int64{12, 13}, []int64{11}},
+		{5, []int64{12, 14}, []int64{11, 13}},
+	} {
+		s.applyUntil(c.version)
+		for _, id := range c.ids {
+			schema, table, ok := s.SchemaAndTableName(id)
+			assert.Assert(t, ok, "version %d, partition %d", c.version, id)
+			assert.Equal(t, schema+"."+table, "test.t1")
+		}
+		for _, id := range c.missing {
+			_, ok := s.TableByID(id)
+			assert.Assert(t, !ok, "version %d, partition %d", c.version, id)
+		}
+	}
+}
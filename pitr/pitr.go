@@ -1,17 +1,18 @@
 package pitr
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"sort"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
-	"github.com/pingcap/tidb-binlog/pkg/filter"
 	"github.com/pingcap/tidb-binlog/pkg/flags"
 	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tidbconfig "github.com/pingcap/tidb/config"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/meta"
 	"github.com/pingcap/tidb/store"
@@ -23,160 +24,557 @@ import (
 type PITR struct {
 	cfg *Config
 
-	filter *filter.Filter
+	filter *tableFilter
+	// rowFilter filters the rows of tables by expressions, nil means keeping all the rows
+	rowFilter *rowFilter
+	// masker masks the columns of the rows in Map, nil means keeping all the values
+	masker *columnMasker
+	// router renames the tables in the merged binlogs, nil means keeping the names
+	router *tableRouter
+	// report is the report of the current run, nil if report-file is not set and it's not run by Server
+	report *runReport
+	// historyDDLs is the history DDL jobs fetched in this run
+	historyDDLs *historyDDLCache
+	// ddlErrors handles the history DDLs failed to execute, nil means aborting
+	ddlErrors *ddlErrorHandler
+	// hook is called with the DDLs and merged rows in Reduce, nil means no hook
+	hook EventHook
+	// opts is the settings passed down to the readers, writers and sinks of the run
+	opts runOptions
+
+	progress *progress
 }
 
 // New creates a PITR object.
 func New(cfg *Config) (*PITR, error) {
 	log.Info("New PITR", zap.Stringer("config", cfg))
 
-	filter := filter.NewFilter(cfg.IgnoreDBs, cfg.IgnoreTables, cfg.DoDBs, cfg.DoTables)
+	rowFilter, err := parseRowFilter(cfg.RowFilter)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rowFilter, err = rowFilter.withPartitions(cfg.Partitions); err != nil {
+		return nil, errors.Trace(err)
+	}
+	masker, err := loadColumnMasker(cfg.MaskRulesFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	router, err := newTableRouter(cfg.RouteRules)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := checkMergeKeys(cfg.MergeKeys); err != nil {
+		return nil, errors.Trace(err)
+	}
+	opts, err := newRunOptions(cfg, router)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	filter := newTableFilter(cfg)
+	filter.sampler = opts.sampler
+
+	var hook EventHook
+	if len(cfg.EventHookPlugin) != 0 {
+		if hook, err = loadEventHook(cfg.EventHookPlugin, cfg.EventHookConfig); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 
 	return &PITR{
-		cfg:    cfg,
-		filter: filter,
+		cfg:       cfg,
+		filter:    filter,
+		rowFilter: rowFilter,
+		masker:    masker,
+		router:    router,
+		ddlErrors: newDDLErrorHandler(cfg.OnDDLError, defaultOutputDir),
+		hook:      hook,
+		opts:      opts,
+		progress:  newProgress(),
 	}, nil
 }
 
-// Process runs the main procedure.
-func (r *PITR) Process() error {
-	files, err := searchFiles(r.cfg.Dir)
-	if err != nil {
-		return errors.Annotate(err, "searchFiles failed")
+// Process runs the main procedure, it stops when ctx is canceled, and the temp dir is reserved
+// with the checkpoint, so it can be resumed by --resume.
+func (r *PITR) Process(ctx context.Context) (err error) {
+	defer r.opts.sampler.logSummary()
+	if len(r.cfg.ReportFile) != 0 {
+		if r.report == nil {
+			r.report = newRunReport()
+		}
+		r.report.RunID = r.cfg.RunID
+		defer func() {
+			if rerr := r.writeReport(err); rerr != nil {
+				log.Error("write report failed", zap.Error(rerr))
+				if err == nil {
+					err = rerr
+				}
+			}
+		}()
 	}
 
-	files, fileSize, err := filterFiles(files, r.cfg.StartTSO, r.cfg.StopTSO)
-	if err != nil {
-		return errors.Annotate(err, "filterFiles failed")
+	if len(r.cfg.StatusAddr) != 0 {
+		server, err := newStatusServer(r.cfg.StatusAddr, r.progress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer server.close()
+	}
+	if len(r.cfg.PprofAddr) != 0 {
+		server, err := newPprofServer(r.cfg.PprofAddr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer server.close()
 	}
 
-	firstBinlogTs := r.cfg.StartTSO
-	if firstBinlogTs == 0 {
-		firstBinlogTs, _, err = getFirstBinlogCommitTSAndFileSize(files[0])
+	// the safepoint keeps the versions read by the history DDL jobs until the run finishes
+	defer r.keepGCSafePoint(ctx).Close()
+
+	if !r.cfg.DryRun {
+		// the leftover temp dir is checked after locking, it may be used by a running run
+		unlock, err := r.lockDirs()
 		if err != nil {
-			return errors.Annotate(err, "get first binlog commit ts failed")
+			return errors.Trace(err)
+		}
+		defer unlock()
+		if err = r.handleLeftoverTemp(); err != nil {
+			return errors.Trace(err)
 		}
 	}
 
-	merge, err := NewMerge(files, fileSize)
-	if err != nil {
+	var dirs []string
+	if len(r.cfg.KafkaAddrs) != 0 {
+		kafkaDir, err := r.readKafkaSource(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		dirs = []string{kafkaDir}
+		defer func() {
+			if r.cfg.ReserveTempDir || err != nil {
+				return
+			}
+			if rerr := os.RemoveAll(kafkaDir); rerr != nil {
+				log.Warn("remove the binlogs read from kafka failed", zap.Error(rerr))
+			}
+		}()
+	} else if dirs, err = r.cfg.binlogDirs(); err != nil {
 		return errors.Trace(err)
 	}
-	defer merge.Close(r.cfg.reserveTempDir)
+	if codec := inputCodecs[r.cfg.InputFormat]; codec.convert != nil {
+		if dirs, err = codec.convert(r, ctx, dirs); err != nil {
+			return errors.Trace(err)
+		}
+		defer func() {
+			if r.cfg.ReserveTempDir || err != nil {
+				return
+			}
+			if rerr := os.RemoveAll(codec.convertDir(r.cfg.TempDir)); rerr != nil {
+				log.Warn("remove the converted binlogs failed", zap.String("input-format", r.cfg.InputFormat), zap.Error(rerr))
+			}
+		}()
+	}
+	startTS := r.cfg.StartTSO
+	var baseCommitTS int64
+	if len(r.cfg.BaseDir) != 0 {
+		baseCommitTS, err = maxCommitTSOfBase(r.cfg.BaseDir, r.opts)
+		if err != nil {
+			return errors.Annotate(err, "read base dir failed")
+		}
+		// the binlogs before baseCommitTS are already merged in base dir
+		if startTS <= baseCommitTS {
+			startTS = baseCommitTS + 1
+		}
+		if r.cfg.StopTSO != 0 && startTS > r.cfg.StopTSO {
+			return errors.Errorf("stop-tso %s is not after the max commit ts %s of base-dir",
+				formatTSO(r.cfg.StopTSO), formatTSO(baseCommitTS))
+		}
+		log.Info("merge the binlogs after base dir", zap.String("base dir", r.cfg.BaseDir), zap.String("start ts", formatTSO(startTS)))
+	}
+	var backupTS int64
+	if len(r.cfg.BRBackup) != 0 {
+		backupTS, err = readBackupTS(r.cfg.BRBackup)
+		if err != nil {
+			return errors.Annotate(err, "read br backup failed")
+		}
+		// the changes before backupTS are in the backup
+		if startTS > backupTS+1 {
+			return withErrorClass(ErrorClassTSOGap, errors.Errorf("start-tso %s is after the backup ts %s of br-backup, the changes between them are lost",
+				formatTSO(startTS), formatTSO(backupTS)))
+		}
+		startTS = backupTS + 1
+		if r.cfg.StopTSO != 0 && startTS > r.cfg.StopTSO {
+			return errors.Errorf("stop-tso %s is not after the backup ts %s of br-backup",
+				formatTSO(r.cfg.StopTSO), formatTSO(backupTS))
+		}
+		log.Info("merge the binlogs after br backup", zap.String("storage", redactStorageURI(r.cfg.BRBackup)), zap.String("backup ts", formatTSO(backupTS)))
+	}
 
-	err = r.ExecuteHistoryDDLs(firstBinlogTs)
+	sources, fileSize, err := searchSources(dirs, startTS, r.cfg.StopTSO, r.cfg.OnFileGap, r.opts)
 	if err != nil {
-		return errors.Annotate(err, "load history ddls")
+		return errors.Annotate(err, "search binlog files failed")
+	}
+	if backupTS != 0 {
+		if err := checkBinlogsAfterBackup(sources, backupTS, r.opts); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	var files []string
+	for _, source := range sources {
+		files = append(files, source...)
 	}
+	r.report.setRange(startTS, r.cfg.StopTSO)
+	r.report.setInputFiles(files)
 
-	if err := merge.Map(); err != nil {
+	firstBinlogTs := startTS
+	if firstBinlogTs == 0 {
+		// the first binlog of all the dirs
+		for _, source := range sources {
+			ts, _, err := getFirstBinlogCommitTSAndFileSize(source[0], r.opts)
+			if err != nil {
+				return errors.Annotate(err, "get first binlog commit ts failed")
+			}
+			if firstBinlogTs == 0 || ts < firstBinlogTs {
+				firstBinlogTs = ts
+			}
+		}
+	}
+
+	if r.cfg.CheckFilter {
+		return errors.Trace(r.checkTableRules(ctx, files, firstBinlogTs))
+	}
+	if r.cfg.DryRun {
+		return errors.Trace(r.dryRun(ctx, files, fileSize, firstBinlogTs))
+	}
+
+	if r.cfg.Flashback {
+		if err := r.flashback(ctx, sources, fileSize, startTS); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := writeChecksums(defaultOutputDir); err != nil {
+			return errors.Annotate(err, "write checksums")
+		}
+		return errors.Trace(r.uploadOutput(ctx, defaultOutputDir))
+	}
+	if r.cfg.SchemaOnly {
+		if err := r.schemaOnly(ctx, sources, fileSize, startTS); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := writeChecksums(defaultOutputDir); err != nil {
+			return errors.Annotate(err, "write checksums")
+		}
+		return errors.Trace(r.uploadOutput(ctx, defaultOutputDir))
+	}
+
+	if err := r.preflightDiskSpace(fileSize); err != nil {
 		return errors.Trace(err)
 	}
 
-	err = r.ExecuteHistoryDDLs(firstBinlogTs)
+	merge, err := NewMerge(r.cfg, files, fileSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	merge.progress = r.progress
+	merge.filter = r.filter
+	merge.rowFilter = r.rowFilter
+	merge.masker = r.masker
+	merge.router = r.router
+	merge.hook = r.hook
+	merge.report = r.report
+	merge.opts = r.opts
+	ddlHandle.setSampler(r.opts.sampler)
+	r.report.setResumed(merge.resumed)
+	merge.sources = sources
+	if len(r.cfg.BaseDir) != 0 {
+		merge.baseDir = r.cfg.BaseDir
+		merge.baseCommitTS = baseCommitTS
+		merge.baseDDLsInHistory = r.loadsHistoryDDLs()
+	}
+	if backupTS != 0 {
+		// the binlogs in the first file may be before the backup ts
+		merge.backupTS = backupTS
+		merge.baseDDLsInHistory = r.loadsHistoryDDLs()
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go r.progress.run(progressLogInterval, quit)
+	defer func() {
+		// reserve the temp dir if failed, so it can be resumed by the checkpoint
+		merge.Close(r.cfg.ReserveTempDir || err != nil)
+	}()
+
+	if backupTS != 0 {
+		if err := r.prepareRestoredCluster(ctx, merge.cp, backupTS); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	phase := phaseMap
+	defer func() {
+		if err != nil {
+			errorsCounter.WithLabelValues(phase).Inc()
+		}
+	}()
+
+	if !merge.mapFinished() {
+		if err := r.validateTableRules(ctx, firstBinlogTs); err != nil {
+			return errors.Trace(err)
+		}
+		err = r.ExecuteHistoryDDLs(ctx, firstBinlogTs)
+		if err != nil {
+			return errors.Annotate(err, "load history ddls")
+		}
+		if len(r.cfg.SchemaFile) != 0 {
+			if err := r.checkSchema(ctx, files); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		start := time.Now()
+		if err := merge.Map(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		phaseDurationGauge.WithLabelValues(phaseMap).Set(time.Since(start).Seconds())
+	}
+
+	phase = phaseReduce
+	err = r.ExecuteHistoryDDLs(ctx, firstBinlogTs)
 	if err != nil {
 		return errors.Annotate(err, "load history ddls")
 	}
 
-	if err := merge.Reduce(); err != nil {
+	start := time.Now()
+	if err := merge.Reduce(ctx); err != nil {
 		return errors.Trace(err)
 	}
+	phaseDurationGauge.WithLabelValues(phaseReduce).Set(time.Since(start).Seconds())
+	r.report.logDedup()
 
+	if _, err := merge.writeSchemaFile(); err != nil {
+		return errors.Annotate(err, "write schema file")
+	}
+	if _, err := merge.writeAutoIDFile(); err != nil {
+		return errors.Annotate(err, "write auto id file")
+	}
+	if r.cfg.ForeignKeyMode == foreignKeyModeOrdered {
+		if _, err := merge.writeReplayFile(); err != nil {
+			return errors.Annotate(err, "write replay file")
+		}
+	}
+	if r.cfg.Lightning {
+		if _, err := merge.writeLightningFiles(); err != nil {
+			return errors.Annotate(err, "write lightning files")
+		}
+	}
+	if r.historyDDLs != nil {
+		merge.ddlJobs = r.historyDDLs.Jobs
+	}
+	if _, err := merge.writeManifest(); err != nil {
+		return errors.Annotate(err, "write manifest")
+	}
+	if _, err := writeChecksums(merge.outputDir); err != nil {
+		return errors.Annotate(err, "write checksums")
+	}
+
+	if r.cfg.Verify {
+		phase = phaseVerify
+		start = time.Now()
+		if err := r.verify(files, merge); err != nil {
+			return errors.Trace(err)
+		}
+		phaseDurationGauge.WithLabelValues(phaseVerify).Set(time.Since(start).Seconds())
+	}
+	if r.cfg.OutputStorage != "" {
+		phase = phaseUpload
+		if err := r.uploadOutput(ctx, merge.outputDir); err != nil {
+			return withErrorClass(ErrorClassDownstream, errors.Trace(err))
+		}
+	}
+
+	if r.cfg.DestType != destTypeFile {
+		phase = phaseApply
+		start = time.Now()
+		if r.cfg.ConflictCheck != "" {
+			if err := r.checkConflicts(ctx, merge.outputDir); err != nil {
+				return withErrorClass(ErrorClassDownstream, errors.Trace(err))
+			}
+		}
+		sink, err := r.newSink(ctx)
+		if err != nil {
+			return withErrorClass(ErrorClassDownstream, errors.Trace(err))
+		}
+		if err := applyOutput(ctx, merge.outputDir, r.opts, sink); err != nil {
+			return withErrorClass(ErrorClassDownstream, errors.Annotatef(err, "apply merged binlogs to dest-type %s", r.cfg.DestType))
+		}
+		if r.cfg.DestType == destTypeMySQL {
+			if err := r.rebaseAutoIDs(ctx, merge.outputDir); err != nil {
+				return withErrorClass(ErrorClassDownstream, errors.Trace(err))
+			}
+		}
+		phaseDurationGauge.WithLabelValues(phaseApply).Set(time.Since(start).Seconds())
+	}
+
+	if len(r.cfg.SavepointFile) != 0 {
+		if err := r.saveSavepoint(merge); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
+// newSink creates the sink of dest-type.
+func (r *PITR) newSink(ctx context.Context) (binlogSink, error) {
+	switch r.cfg.DestType {
+	case destTypeKafka:
+		return newKafkaSink(r.cfg.DestKafka)
+	case destTypeGRPC:
+		return newGRPCSink(ctx, r.cfg.DestGRPCAddr)
+	}
+	var bytesPerSec int64
+	if r.cfg.ApplyBytesPerSec != "" {
+		var err error
+		if bytesPerSec, err = parseSize(r.cfg.ApplyBytesPerSec); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	sink, err := newMySQLSink(r.cfg.DestDB, newApplyLimiter(r.cfg.ApplyQPS, bytesPerSec), r.opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sink.preserveTxn = r.cfg.PreserveTxn
+	return sink, nil
+}
+
 // Close closes the PITR object.
 func (r *PITR) Close() error {
+	if r.hook != nil {
+		return errors.Annotate(r.hook.Close(), "close event hook")
+	}
 	return nil
 }
 
 func (r *PITR) LoadBaseSchema() ([]string, error) {
-	content, err := ioutil.ReadFile(r.cfg.schemaFile)
-	if err != nil {
-		return nil, err
-	}
+	return readSQLFile(r.cfg.SchemaFile, r.opts.sampler)
+}
 
-	ddls := strings.Split(string(content), "\n")
-	return ddls, nil
+// loadsHistoryDDLs returns true if the history DDL jobs before the first binlog are loaded from PD, TiDB, the cache
+// or a JSON history ddl file.
+func (r *PITR) loadsHistoryDDLs() bool {
+	if len(r.cfg.SchemaFile) != 0 {
+		return false
+	}
+	switch r.cfg.historyDDLSource() {
+	case ddlSourceFile:
+		return !isSQLFile(r.cfg.HistoryDDLFile)
+	case ddlSourcePD, ddlSourceTiDB:
+		return true
+	}
+	return false
 }
 
-func (r *PITR) ExecuteHistoryDDLs(beginTS int64) error {
-	if len(r.cfg.schemaFile) != 0 {
+func (r *PITR) ExecuteHistoryDDLs(ctx context.Context, beginTS int64) error {
+	if len(r.cfg.SchemaFile) != 0 {
 		ddls, err := r.LoadBaseSchema()
 		if err != nil {
 			return err
 		}
-		for _, ddl := range ddls {
-			err := ddlHandle.ExecuteDDL("", ddl)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		historyDDLs, err := r.loadHistoryDDLJobs(beginTS)
+		return r.executeSQLs(ctx, ddls)
+	} else if len(r.cfg.HistoryDDLFile) != 0 && isSQLFile(r.cfg.HistoryDDLFile) {
+		ddls, err := readSQLFile(r.cfg.HistoryDDLFile, r.opts.sampler)
 		if err != nil {
-			return errors.Annotate(err, "load history ddls")
+			return errors.Annotatef(err, "read history ddl file %s", r.cfg.HistoryDDLFile)
 		}
-		err = ddlHandle.ExecuteHistoryDDLs(historyDDLs)
-		if err != nil {
+		return r.executeSQLs(ctx, ddls)
+	}
+
+	historyDDLs, err := r.loadHistoryDDLJobs(ctx, beginTS)
+	if err != nil {
+		return errors.Annotate(err, "load history ddls")
+	}
+	r.report.setHistoryDDLs(len(historyDDLs))
+	err = ddlHandle.ExecuteHistoryDDLs(ctx, historyDDLs, r.ddlErrors)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// executeSQLs executes the DDLs of schema file or SQL history ddl file in order, `USE db` changes
+// the schema of the following DDLs.
+func (r *PITR) executeSQLs(ctx context.Context, ddls []string) error {
+	r.report.setHistoryDDLs(len(ddls))
+	var schema string
+	for _, ddl := range ddls {
+		if err := ctx.Err(); err != nil {
 			return errors.Trace(err)
 		}
+		if db, ok := parseUseStmt(ddl); ok {
+			schema = db
+			continue
+		}
+		err := ddlHandle.ExecuteDDL(schema, ddl)
+		if err = r.ddlErrors.handle(schema, ddl, err); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
+// parseUseStmt returns the schema if ddl is `USE db`.
+func parseUseStmt(ddl string) (string, bool) {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(ddl), ";"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "use") {
+		return "", false
+	}
+	return strings.Trim(fields[1], "`"), true
+}
+
 func isAcceptableBinlog(binlog *pb.Binlog, startTs, endTs int64) bool {
 	return binlog.CommitTs >= startTs && (endTs == 0 || binlog.CommitTs <= endTs)
 }
 
-func (r *PITR) loadHistoryDDLJobs(beginTS int64) ([]*model.Job, error) {
-	// if PDURLs is empty, don't get history ddls
-	if len(r.cfg.PDURLs) == 0 {
+func (r *PITR) loadHistoryDDLJobs(ctx context.Context, beginTS int64) ([]*model.Job, error) {
+	// if there is no source of the history ddls, don't get them
+	if r.cfg.historyDDLSource() == "" {
 		return nil, nil
 	}
 
-	tiStore, err := createTiStore(r.cfg.PDURLs)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	defer func() {
-		tiStore.Close()
-		store.UnRegister("tikv")
-	}()
-
-	snapMeta, err := getSnapshotMeta(tiStore)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	allJobs, err := snapMeta.GetAllHistoryDDLJobs()
+	allJobs, err := r.getHistoryDDLJobs(ctx, beginTS)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	// jobs from GetAllHistoryDDLJobs are sorted by job id, need sorted by schema version
-	sort.Slice(allJobs, func(i, j int) bool {
-		return allJobs[i].BinlogInfo.SchemaVersion < allJobs[j].BinlogInfo.SchemaVersion
-	})
-
-	// only get ddl job which finished ts is less than begin ts
+	// only get ddl job which finished ts is less than begin ts, and belongs to the selected tables
 	jobs := make([]*model.Job, 0, 10)
 	for _, job := range allJobs {
-		if int64(job.BinlogInfo.FinishedTS) < beginTS {
-			jobs = append(jobs, job)
-		} else {
-			log.Info("ignore history ddl job", zap.Reflect("job", job))
+		if int64(job.BinlogInfo.FinishedTS) >= beginTS {
+			r.opts.sampler.info("ignore history ddl job", zap.Reflect("job", job))
+			continue
+		}
+		if r.filter.skipJob(job) {
+			log.Debug("skip history ddl job by filter", zap.Int64("id", job.ID), zap.String("query", job.Query))
+			continue
 		}
+		jobs = append(jobs, job)
 	}
 
 	return jobs, nil
 }
 
-func createTiStore(urls string) (kv.Storage, error) {
-	urlv, err := flags.NewURLsValue(urls)
+func createTiStore(urls string, security tidbconfig.Security) (kv.Storage, error) {
+	tlsConfig, err := security.ToTLSConfig()
+	if err != nil {
+		return nil, errors.Annotate(err, "load the TLS certs of PD")
+	}
+	urlv, err := flags.NewURLsValue(strings.Join(pdAddrs(urls, pdScheme(tlsConfig)), ","))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	// the tikv driver connects PD and TiKV with the TLS certs in the global config of TiDB
+	tidbconfig.GetGlobalConfig().Security = security
 
 	if err := store.Register("tikv", tikv.Driver{}); err != nil {
 		return nil, errors.Trace(err)
@@ -184,17 +582,14 @@ func createTiStore(urls string) (kv.Storage, error) {
 	tiPath := fmt.Sprintf("tikv://%s?disableGC=true", urlv.HostString())
 	tiStore, err := store.New(tiPath)
 	if err != nil {
+		store.UnRegister("tikv")
 		return nil, errors.Trace(err)
 	}
 
 	return tiStore, nil
 }
 
-func getSnapshotMeta(tiStore kv.Storage) (*meta.Meta, error) {
-	version, err := tiStore.CurrentVersion()
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
+func getSnapshotMeta(tiStore kv.Storage, version kv.Version) (*meta.Meta, error) {
 	snapshot, err := tiStore.GetSnapshot(version)
 	if err != nil {
 		return nil, errors.Trace(err)
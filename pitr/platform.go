@@ -0,0 +1,59 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// isCaseInsensitiveFS returns true if the file names in the existing dir are case-insensitive, like the default
+// file systems of macOS and Windows. It's probed by a temp file with upper case name.
+func isCaseInsensitiveFS(dir string) (bool, error) {
+	f, err := ioutil.TempFile(dir, "CASE-PROBE-")
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToLower(filepath.Base(name))))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, errors.Trace(err)
+}
+
+// tableDirCase checks the temp dirs of the tables on a case-insensitive file system, the names of two tables
+// differing only in case are the same dir there, and their events would be mixed. A nil tableDirCase checks
+// nothing, it's used on a case-sensitive file system.
+type tableDirCase struct {
+	// dirs is the temp dirs keyed by their lower case names
+	dirs map[string]string
+}
+
+// newTableDirCase returns the checker of the temp dirs in tempDir, nil if the file system is case-sensitive.
+func newTableDirCase(tempDir string) (*tableDirCase, error) {
+	insensitive, err := isCaseInsensitiveFS(tempDir)
+	if err != nil || !insensitive {
+		return nil, errors.Annotatef(err, "check the case sensitivity of temp dir %s", tempDir)
+	}
+	return &tableDirCase{dirs: make(map[string]string)}, nil
+}
+
+// check returns an error if dir is another temp dir only differing in case.
+func (c *tableDirCase) check(dir string) error {
+	if c == nil {
+		return nil
+	}
+	key := strings.ToLower(dir)
+	if other, ok := c.dirs[key]; ok && other != dir {
+		return errors.Errorf("the temp dirs of tables %s and %s are the same on the case-insensitive file system, "+
+			"use a case-sensitive temp-dir", other, dir)
+	}
+	c.dirs[key] = dir
+	return nil
+}
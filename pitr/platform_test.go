@@ -0,0 +1,40 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestTableDirCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "case")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "Upper"), nil, 0600))
+	_, err = os.Stat(filepath.Join(dir, "upper"))
+	expected := err == nil
+	assert.NilError(t, os.Remove(filepath.Join(dir, "Upper")))
+
+	insensitive, err := isCaseInsensitiveFS(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, insensitive, expected)
+	// the probe file is removed
+	infos, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(infos), 0)
+	c, err := newTableDirCase(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, c != nil, expected)
+
+	var sensitive *tableDirCase
+	assert.NilError(t, sensitive.check("test_Orders"))
+	c = &tableDirCase{dirs: make(map[string]string)}
+	for _, dir := range []string{"test_Orders", "test_items", "test_Orders"} {
+		assert.NilError(t, c.check(dir), dir)
+	}
+	assert.ErrorContains(t, c.check("TEST_orders"), "the temp dirs of tables test_Orders and TEST_orders are the same")
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package pitr
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pingcap/errors"
+)
+
+// diskFullErrnos are the errors of writing to a full disk.
+var diskFullErrnos = []syscall.Errno{syscall.ENOSPC}
+
+// statDirFS returns the device id and available bytes of the filesystem where the existing dir is.
+func statDirFS(dir string, info os.FileInfo) (uint64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, errors.Annotatef(err, "statfs %s", dir)
+	}
+	dev := uint64(info.Sys().(*syscall.Stat_t).Dev)
+	return dev, int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// processAlive returns true if the process of pid exists on this host.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// syncDir fsyncs dir, so the files renamed in it are durable.
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dir.Close()
+	return errors.Annotatef(dir.Sync(), "sync dir %s", name)
+}
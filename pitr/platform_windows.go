@@ -0,0 +1,66 @@
+//go:build windows
+// +build windows
+
+package pitr
+
+import (
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	// processQueryLimitedInformation is the access right to get the exit code of a process
+	processQueryLimitedInformation = 0x1000
+	// stillActive is the exit code of a running process
+	stillActive = 259
+)
+
+// diskFullErrnos are the errors of writing to a full disk, ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL.
+var diskFullErrnos = []syscall.Errno{39, 112}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// statDirFS returns the id of the volume and available bytes of the filesystem where the existing dir is,
+// the id is the hash of the volume name.
+func statDirFS(dir string, _ os.FileInfo) (uint64, int64, error) {
+	name, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var available uint64
+	if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+		return 0, 0, errors.Annotatef(err, "get disk free space of %s", dir)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(filepath.VolumeName(dir))))
+	return h.Sum64(), int64(available), nil
+}
+
+// processAlive returns true if the process of pid exists on this host.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		// the process of another user exists, but can't be opened
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// syncDir does nothing, the dirs can't be flushed on Windows, and NTFS journals the renames.
+func syncDir(name string) error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package pitr
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	phaseMap    = "map"
+	phaseReduce = "reduce"
+	phaseApply  = "apply"
+	phaseVerify = "verify"
+	phaseUpload = "upload"
+
+	phaseFlashback  = "flashback"
+	phaseSchemaOnly = "schema-only"
+
+	progressLogInterval = 30 * time.Second
+)
+
+// progress tracks the processed bytes and events of the current phase.
+type progress struct {
+	// bytes and events are updated atomically, keep them at the beginning for 64-bit alignment
+	bytes  int64
+	events int64
+
+	sync.Mutex
+	phase     string
+	total     int64
+	startTime time.Time
+	// finished is the phases before the current phase
+	finished []phaseRecord
+}
+
+// phaseRecord is a finished phase.
+type phaseRecord struct {
+	Phase          string  `json:"phase"`
+	ElapsedSeconds float64 `json:"elapsed-seconds"`
+	Events         int64   `json:"events"`
+}
+
+// progressStatus is the snapshot of progress.
+type progressStatus struct {
+	Phase          string  `json:"phase"`
+	TotalBytes     int64   `json:"total-bytes"`
+	ProcessedBytes int64   `json:"processed-bytes"`
+	Events         int64   `json:"events"`
+	Percent        float64 `json:"percent"`
+	ElapsedSeconds float64 `json:"elapsed-seconds"`
+	// ETASeconds is -1 if it can't be estimated yet
+	ETASeconds float64 `json:"eta-seconds"`
+}
+
+func newProgress() *progress {
+	return &progress{}
+}
+
+// start starts a new phase, total is the bytes need to be processed in the phase.
+func (p *progress) start(phase string, total int64) {
+	p.Lock()
+	if len(p.phase) != 0 {
+		p.finished = append(p.finished, phaseRecord{
+			Phase:          p.phase,
+			ElapsedSeconds: time.Since(p.startTime).Seconds(),
+			Events:         atomic.LoadInt64(&p.events),
+		})
+	}
+	p.phase = phase
+	p.total = total
+	p.startTime = time.Now()
+	atomic.StoreInt64(&p.bytes, 0)
+	atomic.StoreInt64(&p.events, 0)
+	p.Unlock()
+
+	log.Info("phase started", zap.String("phase", phase), zap.Int64("total bytes", total))
+}
+
+func (p *progress) addBytes(n int64) {
+	atomic.AddInt64(&p.bytes, n)
+}
+
+func (p *progress) addEvents(n int64) {
+	atomic.AddInt64(&p.events, n)
+}
+
+func (p *progress) status() progressStatus {
+	p.Lock()
+	s := progressStatus{
+		Phase:      p.phase,
+		TotalBytes: p.total,
+		ETASeconds: -1,
+	}
+	startTime := p.startTime
+	p.Unlock()
+
+	s.ProcessedBytes = atomic.LoadInt64(&p.bytes)
+	s.Events = atomic.LoadInt64(&p.events)
+	if startTime.IsZero() {
+		return s
+	}
+
+	elapsed := time.Since(startTime)
+	s.ElapsedSeconds = elapsed.Seconds()
+	if s.TotalBytes > 0 {
+		s.Percent = float64(s.ProcessedBytes) * 100 / float64(s.TotalBytes)
+		if s.Percent > 100 {
+			s.Percent = 100
+		}
+	}
+	if s.ProcessedBytes > 0 && s.TotalBytes >= s.ProcessedBytes {
+		s.ETASeconds = elapsed.Seconds() * float64(s.TotalBytes-s.ProcessedBytes) / float64(s.ProcessedBytes)
+	}
+	return s
+}
+
+// finishedPhases returns the phases before the current phase.
+func (p *progress) finishedPhases() []phaseRecord {
+	p.Lock()
+	defer p.Unlock()
+	return append([]phaseRecord(nil), p.finished...)
+}
+
+// logStatus logs the status of current phase.
+func (p *progress) logStatus() {
+	s := p.status()
+	if len(s.Phase) == 0 {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("phase", s.Phase),
+		zap.String("percent", formatPercent(s.Percent)),
+		zap.Int64("processed bytes", s.ProcessedBytes),
+		zap.Int64("total bytes", s.TotalBytes),
+		zap.Int64("events", s.Events),
+		zap.Duration("elapsed", time.Duration(s.ElapsedSeconds)*time.Second),
+	}
+	if s.ETASeconds >= 0 {
+		fields = append(fields, zap.Duration("eta", time.Duration(s.ETASeconds)*time.Second))
+	}
+	log.Info("progress", fields...)
+}
+
+// run logs the status periodically until quit is closed.
+func (p *progress) run(interval time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.logStatus()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func formatPercent(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', 2, 64) + "%"
+}
@@ -0,0 +1,66 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestProgress(t *testing.T) {
+	p := newProgress()
+	s := p.status()
+	assert.Assert(t, s.Phase == "")
+	assert.Assert(t, s.ETASeconds == -1)
+
+	p.start(phaseMap, 200)
+	s = p.status()
+	assert.Assert(t, s.Phase == phaseMap)
+	assert.Assert(t, s.ETASeconds == -1)
+
+	p.addBytes(50)
+	p.addEvents(10)
+	s = p.status()
+	assert.Assert(t, s.ProcessedBytes == 50)
+	assert.Assert(t, s.Events == 10)
+	assert.Assert(t, s.Percent == 25)
+	assert.Assert(t, s.ETASeconds >= 0)
+
+	p.start(phaseReduce, 100)
+	s = p.status()
+	assert.Assert(t, s.Phase == phaseReduce)
+	assert.Assert(t, s.ProcessedBytes == 0)
+	assert.Assert(t, s.Events == 0)
+}
+
+func TestStatusServer(t *testing.T) {
+	p := newProgress()
+	p.start(phaseMap, 100)
+	p.addBytes(10)
+
+	server, err := newStatusServer("127.0.0.1:0", p)
+	assert.Assert(t, err == nil)
+	defer server.close()
+
+	resp, err := http.Get("http://" + server.addr() + "/status")
+	assert.Assert(t, err == nil)
+	defer resp.Body.Close()
+
+	var s progressStatus
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, s.Phase == phaseMap)
+	assert.Assert(t, s.ProcessedBytes == 10)
+	assert.Assert(t, s.TotalBytes == 100)
+
+	ddlCounter.Inc()
+	resp, err = http.Get("http://" + server.addr() + "/metrics")
+	assert.Assert(t, err == nil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, strings.Contains(string(data), "binlog_pitr_ddls_total"))
+}
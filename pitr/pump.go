@@ -0,0 +1,384 @@
+package pitr
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-binlog/drainer/translator"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// inputFormatDrainer is the binlog files written by drainer's file sink
+	inputFormatDrainer = "drainer"
+	// inputFormatPump is the raw binlog files of pump, the prewrite and commit binlogs are paired to transactions
+	inputFormatPump = "pump"
+)
+
+// pumpSchema tracks the table infos by the history DDL jobs, so the rows of the prewrite binlogs
+// can be decoded with the table infos of their schema versions.
+type pumpSchema struct {
+	// jobs are sorted by schema version, jobs[next:] are not applied yet
+	jobs []*model.Job
+	next int
+
+	dbs         map[int64]string
+	tables      map[int64]*model.TableInfo
+	tableSchema map[int64]int64
+	jobByID     map[int64]*model.Job
+}
+
+var _ translator.TableInfoGetter = &pumpSchema{}
+
+func newPumpSchema(jobs []*model.Job) *pumpSchema {
+	s := &pumpSchema{
+		jobs:        jobs,
+		dbs:         make(map[int64]string),
+		tables:      make(map[int64]*model.TableInfo),
+		tableSchema: make(map[int64]int64),
+		jobByID:     make(map[int64]*model.Job, len(jobs)),
+	}
+	for _, job := range jobs {
+		s.jobByID[job.ID] = job
+	}
+	return s
+}
+
+// applyUntil applies the jobs whose schema versions are not greater than version.
+func (s *pumpSchema) applyUntil(version int64) {
+	for ; s.next < len(s.jobs); s.next++ {
+		job := s.jobs[s.next]
+		if job.BinlogInfo.SchemaVersion > version {
+			return
+		}
+		s.applyJob(job)
+	}
+}
+
+func (s *pumpSchema) applyJob(job *model.Job) {
+	info := job.BinlogInfo
+	switch job.Type {
+	case model.ActionCreateSchema:
+		if info.DBInfo != nil {
+			s.dbs[job.SchemaID] = info.DBInfo.Name.O
+		}
+		return
+	case model.ActionDropSchema:
+		delete(s.dbs, job.SchemaID)
+		for id, schemaID := range s.tableSchema {
+			if schemaID == job.SchemaID {
+				s.dropTable(id)
+			}
+		}
+		return
+	case model.ActionDropTable, model.ActionDropView:
+		s.dropTable(job.TableID)
+		return
+	case model.ActionTruncateTable:
+		// the table is recreated with a new id
+		s.dropTable(job.TableID)
+	}
+
+	if info.TableInfo != nil {
+		s.dropTable(info.TableInfo.ID)
+		s.tables[info.TableInfo.ID] = info.TableInfo
+		s.tableSchema[info.TableInfo.ID] = job.SchemaID
+		// the rows of partitioned tables are written with the partition ids
+		if pi := info.TableInfo.GetPartitionInfo(); pi != nil {
+			for _, def := range pi.Definitions {
+				s.tables[def.ID] = info.TableInfo
+				s.tableSchema[def.ID] = job.SchemaID
+			}
+		}
+	}
+}
+
+// dropTable removes the table and its partitions.
+func (s *pumpSchema) dropTable(id int64) {
+	info, ok := s.tables[id]
+	if !ok {
+		return
+	}
+	if pi := info.GetPartitionInfo(); pi != nil {
+		for _, def := range pi.Definitions {
+			delete(s.tables, def.ID)
+			delete(s.tableSchema, def.ID)
+		}
+	}
+	delete(s.tables, info.ID)
+	delete(s.tableSchema, info.ID)
+}
+
+// TableByID implements translator.TableInfoGetter.
+func (s *pumpSchema) TableByID(id int64) (*model.TableInfo, bool) {
+	info, ok := s.tables[id]
+	return info, ok
+}
+
+// SchemaAndTableName implements translator.TableInfoGetter.
+func (s *pumpSchema) SchemaAndTableName(id int64) (string, string, bool) {
+	info, ok := s.tables[id]
+	if !ok {
+		return "", "", false
+	}
+	schema, ok := s.dbs[s.tableSchema[id]]
+	return schema, info.Name.O, ok
+}
+
+// ddlSchema returns the schema name of the DDL job.
+func (s *pumpSchema) ddlSchema(jobID int64) (string, error) {
+	job, ok := s.jobByID[jobID]
+	if !ok {
+		return "", errors.Errorf("DDL job %d is not found in the history DDL jobs", jobID)
+	}
+	// the schema may be created by the previous jobs
+	s.applyUntil(job.BinlogInfo.SchemaVersion - 1)
+	if schema, ok := s.dbs[job.SchemaID]; ok {
+		return schema, nil
+	}
+	if job.BinlogInfo.DBInfo != nil {
+		return job.BinlogInfo.DBInfo.Name.O, nil
+	}
+	return "", errors.Errorf("the schema of DDL job %d is unknown", jobID)
+}
+
+// pumpTxn is a committed transaction of pump.
+type pumpTxn struct {
+	prewrite *tb.Binlog
+	commitTS int64
+}
+
+type pumpTxnHeap []pumpTxn
+
+func (h pumpTxnHeap) Len() int            { return len(h) }
+func (h pumpTxnHeap) Less(i, j int) bool  { return h[i].commitTS < h[j].commitTS }
+func (h pumpTxnHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pumpTxnHeap) Push(x interface{}) { *h = append(*h, x.(pumpTxn)) }
+func (h *pumpTxnHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	txn := old[n-1]
+	*h = old[:n-1]
+	return txn
+}
+
+// pumpPairer pairs the prewrite binlogs with the commit and rollback binlogs of one pump, and returns
+// the committed transactions in the order of commit ts. A committed transaction is returned only if its
+// commit ts is less than the start ts of all the pending prewrites, because the commit binlogs may be
+// written out of order, but a transaction always gets its commit ts after its prewrite binlog is written.
+type pumpPairer struct {
+	prewrites map[int64]*tb.Binlog
+	committed pumpTxnHeap
+	// sampler samples the warnings of the binlogs not paired
+	sampler *sampledLogger
+}
+
+func newPumpPairer(sampler *sampledLogger) *pumpPairer {
+	return &pumpPairer{prewrites: make(map[int64]*tb.Binlog), sampler: sampler}
+}
+
+// add adds a binlog of pump, and returns the transactions which can be handled.
+func (p *pumpPairer) add(binlog *tb.Binlog) []pumpTxn {
+	switch binlog.Tp {
+	case tb.BinlogType_Prewrite, tb.BinlogType_PreDDL:
+		p.prewrites[binlog.StartTs] = binlog
+		return nil
+	case tb.BinlogType_Commit, tb.BinlogType_PostDDL:
+		prewrite, ok := p.prewrites[binlog.StartTs]
+		if !ok {
+			p.sampler.warn("the prewrite binlog of the commit binlog is not found, skip it",
+				zap.Int64("start ts", binlog.StartTs), zap.Int64("commit ts", binlog.CommitTs))
+			return nil
+		}
+		delete(p.prewrites, binlog.StartTs)
+		heap.Push(&p.committed, pumpTxn{prewrite: prewrite, commitTS: binlog.CommitTs})
+	case tb.BinlogType_Rollback:
+		delete(p.prewrites, binlog.StartTs)
+	}
+
+	minStartTS := int64(-1)
+	for startTS := range p.prewrites {
+		if minStartTS < 0 || startTS < minStartTS {
+			minStartTS = startTS
+		}
+	}
+	var txns []pumpTxn
+	for p.committed.Len() > 0 && (minStartTS < 0 || p.committed[0].commitTS < minStartTS) {
+		txns = append(txns, heap.Pop(&p.committed).(pumpTxn))
+	}
+	return txns
+}
+
+// finish returns all the committed transactions left, the prewrites not committed are discarded.
+func (p *pumpPairer) finish() []pumpTxn {
+	for startTS := range p.prewrites {
+		p.sampler.warn("the prewrite binlog is not committed or rolled back, skip it", zap.Int64("start ts", startTS))
+	}
+	p.prewrites = make(map[int64]*tb.Binlog)
+
+	txns := make([]pumpTxn, 0, p.committed.Len())
+	for p.committed.Len() > 0 {
+		txns = append(txns, heap.Pop(&p.committed).(pumpTxn))
+	}
+	return txns
+}
+
+// translatePumpTxn translates the committed transaction to the binlog written by drainer,
+// it returns nil if the transaction has no row change.
+func translatePumpTxn(s *pumpSchema, txn pumpTxn) (*pb.Binlog, error) {
+	tiBinlog := *txn.prewrite
+	tiBinlog.CommitTs = txn.commitTS
+
+	if tiBinlog.DdlJobId > 0 {
+		schema, err := s.ddlSchema(tiBinlog.DdlJobId)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		binlog, err := translator.TiBinlogToPbBinlog(s, schema, "", &tiBinlog, nil)
+		return binlog, errors.Annotatef(err, "translate DDL %s", tiBinlog.DdlQuery)
+	}
+
+	pv := &tb.PrewriteValue{}
+	if err := pv.Unmarshal(tiBinlog.PrewriteValue); err != nil {
+		return nil, errors.Annotatef(err, "unmarshal prewrite value of start ts %d", tiBinlog.StartTs)
+	}
+	s.applyUntil(pv.SchemaVersion)
+	binlog, err := translator.TiBinlogToPbBinlog(s, "", "", &tiBinlog, pv)
+	if err != nil {
+		return nil, errors.Annotatef(err, "translate transaction of commit ts %d", txn.commitTS)
+	}
+	if len(binlog.GetDmlData().GetEvents()) == 0 {
+		return nil, nil
+	}
+	binlog.Tp = pb.BinlogType_DML
+	return binlog, nil
+}
+
+// convertPumpDir pairs the binlogs in the pump binlog files, and writes the transactions to outDir
+// in the format of drainer. It returns the number of transactions written, the warnings of the binlogs not paired
+// are sampled by sampler.
+func convertPumpDir(ctx context.Context, files []string, outDir string, s *pumpSchema, sampler *sampledLogger) (int, error) {
+	binlogger, err := OpenMyBinlogger(outDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer binlogger.Close()
+
+	var count int
+	write := func(txns []pumpTxn) error {
+		for _, txn := range txns {
+			binlog, err := translatePumpTxn(s, txn)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if binlog == nil {
+				continue
+			}
+			data, err := binlog.Marshal()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if _, err := binlogger.WriteTail(&tb.Entity{Payload: data}); err != nil {
+				return errors.Trace(err)
+			}
+			count++
+		}
+		return nil
+	}
+
+	pairer := newPumpPairer(sampler)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if err := scanPumpBinlogFile(file, func(binlog *tb.Binlog) error {
+			return write(pairer.add(binlog))
+		}); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if err := write(pairer.finish()); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return count, nil
+}
+
+// scanPumpBinlogFile decodes all the binlogs of pump in file, and calls fn for every binlog.
+func scanPumpBinlogFile(file string, fn func(binlog *tb.Binlog) error) error {
+	// the binlog files of pump are never encrypted
+	f, _, err := openBinlogFile(file, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		payload, _, err := binlogfile.Decode(reader)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.Annotatef(err, "decode pump binlog file %s", redactStorageURI(file))
+		}
+
+		binlog := &tb.Binlog{}
+		if err := binlog.Unmarshal(payload); err != nil {
+			return errors.Annotatef(err, "unmarshal pump binlog in %s", redactStorageURI(file))
+		}
+		if err = fn(binlog); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// pumpConvertDir returns the dir to save the binlogs converted from pump binlog files, it's not
+// in the temp dir because the sub dirs of the temp dir are the temp files of tables.
+func pumpConvertDir(tempDir string) string {
+	return filepath.Clean(tempDir) + "_pump"
+}
+
+// convertPumpSources converts the pump binlog files in dirs to the format of drainer, and returns
+// the dirs of the converted files, every pump is converted to one dir.
+func (r *PITR) convertPumpSources(ctx context.Context, dirs []string) ([]string, error) {
+	jobs, err := r.getHistoryDDLJobs(ctx, r.cfg.StartTSO)
+	if err != nil {
+		return nil, errors.Annotate(err, "load history ddl jobs to decode pump binlogs")
+	}
+
+	baseDir := pumpConvertDir(r.cfg.TempDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	converted := make([]string, 0, len(dirs))
+	for i, dir := range dirs {
+		files, err := searchFiles(dir)
+		if err != nil {
+			return nil, errors.Annotatef(err, "search files in %s", redactStorageURI(dir))
+		}
+		if err := checkFileGaps(files, r.cfg.OnFileGap, r.opts); err != nil {
+			return nil, errors.Annotatef(err, "check files in %s", redactStorageURI(dir))
+		}
+
+		outDir := filepath.Join(baseDir, fmt.Sprintf("%d", i))
+		count, err := convertPumpDir(ctx, files, outDir, newPumpSchema(jobs), r.opts.sampler)
+		if err != nil {
+			return nil, errors.Annotatef(err, "convert pump binlogs in %s", redactStorageURI(dir))
+		}
+		log.Info("pump binlogs are converted", zap.String("dir", redactStorageURI(dir)),
+			zap.String("output", outDir), zap.Int("transactions", count))
+		converted = append(converted, outDir)
+	}
+	return converted, nil
+}
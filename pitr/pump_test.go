@@ -0,0 +1,149 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"gotest.tools/assert"
+)
+
+func commitTSs(txns []pumpTxn) []int64 {
+	tss := make([]int64, 0, len(txns))
+	for _, txn := range txns {
+		tss = append(tss, txn.commitTS)
+	}
+	return tss
+}
+
+func TestPumpPairer(t *testing.T) {
+	p := newPumpPairer(nil)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 10})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 20})), 0)
+	// the transaction of start ts 10 may commit before 25
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Commit, StartTs: 20, CommitTs: 25})), 0)
+	assert.DeepEqual(t, commitTSs(p.add(&tb.Binlog{Tp: tb.BinlogType_Commit, StartTs: 10, CommitTs: 15})), []int64{15, 25})
+
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 30})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 40})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Commit, StartTs: 40, CommitTs: 45})), 0)
+	// the rolled back transaction doesn't block the later ones
+	assert.DeepEqual(t, commitTSs(p.add(&tb.Binlog{Tp: tb.BinlogType_Rollback, StartTs: 30})), []int64{45})
+
+	// the commit binlog without prewrite is skipped
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Commit, StartTs: 50, CommitTs: 55})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 60})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Prewrite, StartTs: 70})), 0)
+	assert.Equal(t, len(p.add(&tb.Binlog{Tp: tb.BinlogType_Commit, StartTs: 70, CommitTs: 75})), 0)
+	// the prewrite not committed is discarded
+	assert.DeepEqual(t, commitTSs(p.finish()), []int64{75})
+}
+
+func testPumpJobs() []*model.Job {
+	tableInfo := &model.TableInfo{
+		ID:    10,
+		Name:  model.NewCIStr("t1"),
+		State: model.StatePublic,
+		Columns: []*model.ColumnInfo{
+			{ID: 1, Name: model.NewCIStr("id"), Offset: 0, State: model.StatePublic,
+				FieldType: types.FieldType{Tp: mysql.TypeLong, Flen: 11}},
+			{ID: 2, Name: model.NewCIStr("name"), Offset: 1, State: model.StatePublic,
+				FieldType: types.FieldType{Tp: mysql.TypeVarchar, Flen: 20, Charset: "utf8mb4", Collate: "utf8mb4_bin"}},
+		},
+	}
+	return []*model.Job{
+		{ID: 1, Type: model.ActionCreateSchema, SchemaID: 1, BinlogInfo: &model.HistoryInfo{
+			SchemaVersion: 1, DBInfo: &model.DBInfo{ID: 1, Name: model.NewCIStr("test")}}},
+		{ID: 2, Type: model.ActionCreateTable, SchemaID: 1, TableID: 10, BinlogInfo: &model.HistoryInfo{
+			SchemaVersion: 2, TableInfo: tableInfo}},
+	}
+}
+
+func encodePumpRow(t *testing.T, handle int64, id int64, name string) []byte {
+	sc := &stmtctx.StatementContext{TimeZone: time.Local}
+	row, err := tablecodec.EncodeRow(sc, []types.Datum{types.NewIntDatum(id), types.NewStringDatum(name)}, []int64{1, 2}, nil, nil)
+	assert.NilError(t, err)
+	data, err := codec.EncodeValue(sc, nil, types.NewIntDatum(handle))
+	assert.NilError(t, err)
+	return append(data, row...)
+}
+
+func TestConvertPumpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pump")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	pv := &tb.PrewriteValue{SchemaVersion: 2, Mutations: []tb.TableMutation{{
+		TableId:      10,
+		InsertedRows: [][]byte{encodePumpRow(t, 1, 1, "a")},
+		Sequence:     []tb.MutationType{tb.MutationType_Insert},
+	}}}
+	pvData, err := pv.Marshal()
+	assert.NilError(t, err)
+	binlogs := []*tb.Binlog{
+		{Tp: tb.BinlogType_Prewrite, StartTs: 10, DdlJobId: 2, DdlQuery: []byte("create table t1 (id int, name varchar(20))")},
+		{Tp: tb.BinlogType_Commit, StartTs: 10, CommitTs: 11},
+		{Tp: tb.BinlogType_Prewrite, StartTs: 20, PrewriteValue: pvData},
+		{Tp: tb.BinlogType_Prewrite, StartTs: 30, PrewriteValue: pvData},
+		{Tp: tb.BinlogType_Commit, StartTs: 20, CommitTs: 21},
+		{Tp: tb.BinlogType_Rollback, StartTs: 30},
+	}
+	var data []byte
+	for _, binlog := range binlogs {
+		payload, err := binlog.Marshal()
+		assert.NilError(t, err)
+		data = append(data, binlogfile.Encode(payload)...)
+	}
+	file := filepath.Join(dir, binlogfile.BinlogName(0))
+	assert.NilError(t, ioutil.WriteFile(file, data, 0600))
+
+	outDir := filepath.Join(dir, "out")
+	count, err := convertPumpDir(context.Background(), []string{file}, outDir, newPumpSchema(testPumpJobs()), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+
+	files, err := searchFiles(outDir)
+	assert.NilError(t, err)
+	var converted []*pb.Binlog
+	for _, file := range files {
+		assert.NilError(t, scanBinlogFile(file, runOptions{}, func(binlog *pb.Binlog) error {
+			converted = append(converted, binlog)
+			return nil
+		}))
+	}
+	assert.Equal(t, len(converted), 2)
+	assert.Equal(t, converted[0].Tp, pb.BinlogType_DDL)
+	assert.Equal(t, converted[0].CommitTs, int64(11))
+	assert.Equal(t, string(converted[0].DdlQuery), "use test; create table t1 (id int, name varchar(20));")
+
+	assert.Equal(t, converted[1].Tp, pb.BinlogType_DML)
+	assert.Equal(t, converted[1].CommitTs, int64(21))
+	events := converted[1].DmlData.Events
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].GetTp(), pb.EventType_Insert)
+	assert.Equal(t, events[0].GetSchemaName(), "test")
+	assert.Equal(t, events[0].GetTableName(), "t1")
+	assert.Equal(t, len(events[0].Row), 2)
+
+	// the table is unknown before it's created
+	schema := newPumpSchema(testPumpJobs())
+	schema.applyUntil(1)
+	_, ok := schema.TableByID(10)
+	assert.Assert(t, !ok)
+	schema.applyUntil(2)
+	name, table, ok := schema.SchemaAndTableName(10)
+	assert.Assert(t, ok)
+	assert.Equal(t, name+"."+table, "test.t1")
+}
@@ -0,0 +1,86 @@
+package pitr
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of something like statements or bytes, the tokens are refilled at rate per second
+// and at most rate tokens are saved, so the burst is one second of traffic.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// reserve takes n tokens, and returns how long to wait before using them. The tokens may be negative after it,
+// so n larger than the rate is allowed and the later callers wait for it.
+func (b *tokenBucket) reserve(n int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until n tokens are available.
+func (b *tokenBucket) wait(n int64) {
+	if d := b.reserve(n); d > 0 {
+		b.sleep(d)
+	}
+}
+
+// applyLimiter throttles the statements executed in dest-db by apply-qps and apply-bytes-per-sec, nil buckets
+// mean no limit.
+type applyLimiter struct {
+	qps   *tokenBucket
+	bytes *tokenBucket
+}
+
+func newApplyLimiter(qps int, bytesPerSec int64) *applyLimiter {
+	l := &applyLimiter{}
+	if qps > 0 {
+		l.qps = newTokenBucket(int64(qps))
+	}
+	if bytesPerSec > 0 {
+		l.bytes = newTokenBucket(bytesPerSec)
+	}
+	return l
+}
+
+// wait blocks until the statements can be executed.
+func (l *applyLimiter) wait(stmts []string) {
+	if l.qps != nil {
+		l.qps.wait(int64(len(stmts)))
+	}
+	if l.bytes != nil {
+		var size int64
+		for _, stmt := range stmts {
+			size += int64(len(stmt))
+		}
+		l.bytes.wait(size)
+	}
+}
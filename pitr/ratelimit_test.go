@@ -0,0 +1,39 @@
+package pitr
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(100, 0)
+	b := newTokenBucket(10)
+	b.now = func() time.Time { return now }
+	b.last = now
+	var slept time.Duration
+	b.sleep = func(d time.Duration) { slept += d }
+
+	// the burst is one second of tokens
+	assert.Equal(t, b.reserve(10), time.Duration(0))
+	assert.Equal(t, b.reserve(5), 500*time.Millisecond)
+
+	// the tokens taken by the last reservation are refilled first
+	now = now.Add(time.Second)
+	assert.Equal(t, b.reserve(5), time.Duration(0))
+
+	// the tokens are not saved more than the rate
+	now = now.Add(time.Minute)
+	b.wait(20)
+	assert.Equal(t, slept, time.Second)
+}
+
+func TestTableWorker(t *testing.T) {
+	assert.Equal(t, tableWorker("`test`.`t1`", 1), 0)
+	for _, table := range []string{"`test`.`t1`", "`test`.`t2`", "`db`.`t3`"} {
+		w := tableWorker(table, 4)
+		assert.Assert(t, w >= 0 && w < 4)
+		assert.Equal(t, tableWorker(table, 4), w)
+	}
+}
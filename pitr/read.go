@@ -2,8 +2,8 @@ package pitr
 
 import (
 	"bufio"
+	"container/heap"
 	"io"
-	"os"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -25,26 +25,29 @@ type dirPbReader struct {
 	startTS int64
 	endTS   int64
 
-	file   *os.File
+	file   io.ReadCloser
 	reader *bufio.Reader
 	idx    int // index of next file to read in files
+
+	opts runOptions
 }
 
 var _ PbReader = &dirPbReader{}
 
-// newDirPbReader return a Reader to read binlogs with commit ts in [startTS, endTS]
-func newDirPbReader(dir string, startTS int64, endTS int64) (r *dirPbReader, err error) {
+// newDirPbReader return a Reader to read binlogs with commit ts in [startTS, endTS], the binlogs are
+// decoded with the max-event-size and the cipher of opts
+func newDirPbReader(dir string, startTS int64, endTS int64, opts runOptions) (r *dirPbReader, err error) {
 	files, err := searchFiles(dir)
 	if err != nil {
 		return nil, errors.Annotate(err, "searchFiles failed")
 	}
 
-	files, fileSize, err := filterFiles(files, startTS, endTS)
+	files, fileSize, err := filterFiles(files, startTS, endTS, opts)
 	if err != nil {
 		return nil, errors.Annotate(err, "filterFiles failed")
 	}
 
-	log.Info("newDirPbReader", zap.Strings("files", files), zap.Int64("file size", fileSize))
+	log.Info("newDirPbReader", zap.Strings("files", redactStorageURIs(files)), zap.Int64("file size", fileSize))
 
 	r = &dirPbReader{
 		startTS: startTS,
@@ -52,6 +55,7 @@ func newDirPbReader(dir string, startTS int64, endTS int64) (r *dirPbReader, err
 		dir:     dir,
 		files:   files,
 		idx:     0,
+		opts:    opts,
 	}
 
 	// if empty files in dir, return success and later `Read` will return `io.EOF`
@@ -82,9 +86,9 @@ func (r *dirPbReader) nextFile() (err error) {
 		r.file = nil
 	}
 
-	r.file, err = os.OpenFile(bfile, os.O_RDONLY, 0600)
+	r.file, _, err = openBinlogFile(bfile, r.opts.cipher)
 	if err != nil {
-		return errors.Annotatef(err, "open file %s error", bfile)
+		return errors.Trace(err)
 	}
 
 	r.reader = bufio.NewReader(r.file)
@@ -100,7 +104,7 @@ func (r *dirPbReader) read() (binlog *pb.Binlog, err error) {
 	}
 
 	for {
-		binlog, _, err = Decode(r.reader)
+		binlog, _, err = decodeBinlog(r.reader, r.opts)
 		if err == nil {
 			if !isAcceptableBinlog(binlog, r.startTS, r.endTS) {
 				continue
@@ -110,7 +114,7 @@ func (r *dirPbReader) read() (binlog *pb.Binlog, err error) {
 		}
 
 		if errors.Cause(err) == io.EOF {
-			log.Info("read file end", zap.String("file", r.files[r.idx-1]))
+			log.Info("read file end", zap.String("file", redactStorageURI(r.files[r.idx-1])))
 			err = r.nextFile()
 			if err != nil {
 				return nil, err
@@ -121,3 +125,78 @@ func (r *dirPbReader) read() (binlog *pb.Binlog, err error) {
 		return nil, errors.Annotate(err, "decode failed")
 	}
 }
+
+// mergePbReader merges binlogs from multiple readers in the order of commit ts,
+// every reader should return binlogs in the order of commit ts.
+type mergePbReader struct {
+	readers []PbReader
+	heap    binlogHeap
+	inited  bool
+}
+
+var _ PbReader = &mergePbReader{}
+
+func newMergePbReader(readers []PbReader) *mergePbReader {
+	return &mergePbReader{readers: readers}
+}
+
+// readerItem is the next binlog of the reader, idx is the index of reader.
+type readerItem struct {
+	binlog *pb.Binlog
+	idx    int
+}
+
+// binlogHeap is a min heap of commit ts, binlogs with the same commit ts are ordered by the reader's index.
+type binlogHeap []readerItem
+
+func (h binlogHeap) Len() int { return len(h) }
+func (h binlogHeap) Less(i, j int) bool {
+	if h[i].binlog.CommitTs == h[j].binlog.CommitTs {
+		return h[i].idx < h[j].idx
+	}
+	return h[i].binlog.CommitTs < h[j].binlog.CommitTs
+}
+func (h binlogHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *binlogHeap) Push(x interface{}) { *h = append(*h, x.(readerItem)) }
+func (h *binlogHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// push reads the next binlog from the reader, and push it into heap.
+func (r *mergePbReader) push(idx int) error {
+	binlog, err := r.readers[idx].read()
+	if err != nil {
+		if errors.Cause(err) == io.EOF {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+
+	heap.Push(&r.heap, readerItem{binlog: binlog, idx: idx})
+	return nil
+}
+
+func (r *mergePbReader) read() (*pb.Binlog, error) {
+	if !r.inited {
+		for i := range r.readers {
+			if err := r.push(i); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		r.inited = true
+	}
+
+	if r.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	item := heap.Pop(&r.heap).(readerItem)
+	if err := r.push(item.idx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return item.binlog, nil
+}
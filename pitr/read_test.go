@@ -3,7 +3,7 @@ package pitr
 import (
 	"io"
 	"os"
-	"path"
+	"path/filepath"
 
 	"github.com/pingcap/check"
 	"github.com/pingcap/errors"
@@ -30,7 +30,7 @@ func writeBinlogsInDir(dir string, c *check.C) (binlogs []*pb.Binlog) {
 
 	for index := 0; index < 10; index++ {
 		// create the file to write binlog
-		filename := path.Join(dir, binlogfile.BinlogName(uint64(index)))
+		filename := filepath.Join(dir, binlogfile.BinlogName(uint64(index)))
 		file, err := os.Create(filename)
 		c.Assert(err, check.IsNil)
 
@@ -73,7 +73,7 @@ func (s *testReadSuite) TestReader(c *check.C) {
 
 	// read back all binlogs in directory
 	var readBackBinlogs []*pb.Binlog
-	reader, err := newDirPbReader(dir, 0, 0)
+	reader, err := newDirPbReader(dir, 0, 0, runOptions{})
 	c.Assert(err, check.IsNil)
 
 	readBackBinlogs, err = readAll(reader)
@@ -83,7 +83,7 @@ func (s *testReadSuite) TestReader(c *check.C) {
 	// we write the binlog with commit ts start at one(1,2,3,4...)
 	for start := 1; start <= len(binlogs); start++ {
 		for end := start; end <= len(binlogs); end++ {
-			reader, err := newDirPbReader(dir, int64(start), int64(end))
+			reader, err := newDirPbReader(dir, int64(start), int64(end), runOptions{})
 			c.Assert(err, check.IsNil)
 
 			readBackBinlogs, err = readAll(reader)
@@ -92,3 +92,42 @@ func (s *testReadSuite) TestReader(c *check.C) {
 		}
 	}
 }
+
+// sliceReader reads binlogs from slice
+type sliceReader struct {
+	binlogs []*pb.Binlog
+}
+
+func (r *sliceReader) read() (*pb.Binlog, error) {
+	if len(r.binlogs) == 0 {
+		return nil, io.EOF
+	}
+	binlog := r.binlogs[0]
+	r.binlogs = r.binlogs[1:]
+	return binlog, nil
+}
+
+func (s *testReadSuite) TestMergeReader(c *check.C) {
+	newReader := func(tss ...int64) PbReader {
+		r := &sliceReader{}
+		for _, ts := range tss {
+			r.binlogs = append(r.binlogs, &pb.Binlog{CommitTs: ts})
+		}
+		return r
+	}
+
+	reader := newMergePbReader([]PbReader{
+		newReader(1, 4, 5, 9),
+		newReader(),
+		newReader(2, 3, 5),
+		newReader(6),
+	})
+	binlogs, err := readAll(reader)
+	c.Assert(err, check.IsNil)
+
+	var tss []int64
+	for _, binlog := range binlogs {
+		tss = append(tss, binlog.CommitTs)
+	}
+	c.Assert(tss, check.DeepEquals, []int64{1, 2, 3, 4, 5, 5, 6, 9})
+}
@@ -0,0 +1,200 @@
+package pitr
+
+import (
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// columnChange is the change of columns by an ALTER TABLE DDL which only adds, drops or renames columns,
+// the events merged before such a DDL are remapped to the new columns instead of being written before it.
+type columnChange struct {
+	schema string
+	table  string
+	// renamed maps the lower case old name of a column to its new name
+	renamed map[string]string
+	// types is the new field type of the renamed columns, the events are not remapped if it's changed
+	types map[string]byte
+	// dropped is the lower case names of the dropped columns
+	dropped map[string]struct{}
+}
+
+// parseColumnChange returns the change of columns by the DDL, it returns nil if the DDL does other changes.
+func parseColumnChange(ddl string) (*columnChange, error) {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var change *columnChange
+	for _, stmt := range stmts {
+		switch node := stmt.(type) {
+		case *ast.UseStmt:
+		case *ast.AlterTableStmt:
+			if change != nil {
+				return nil, nil
+			}
+			change = &columnChange{
+				table:   node.Table.Name.O,
+				renamed: make(map[string]string),
+				types:   make(map[string]byte),
+				dropped: make(map[string]struct{}),
+			}
+			for _, spec := range node.Specs {
+				switch spec.Tp {
+				case ast.AlterTableAddColumns:
+				case ast.AlterTableDropColumn:
+					change.dropped[spec.OldColumnName.Name.L] = struct{}{}
+				case ast.AlterTableChangeColumn:
+					col := spec.NewColumns[0]
+					change.renamed[spec.OldColumnName.Name.L] = col.Name.Name.O
+					change.types[spec.OldColumnName.Name.L] = col.Tp.Tp
+				default:
+					return nil, nil
+				}
+			}
+		default:
+			return nil, nil
+		}
+	}
+	if change == nil {
+		return nil, nil
+	}
+	if change.schema, _, err = parserSchemaTableFromDDL(ddl); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return change, nil
+}
+
+// rename returns the new names of columns.
+func (c *columnChange) rename(columns []string) []string {
+	names := make([]string, 0, len(columns))
+	for _, name := range columns {
+		if newName, ok := c.renamed[strings.ToLower(name)]; ok {
+			name = newName
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// typesKept returns true if the renamed columns of the events keep their field types.
+func (c *columnChange) typesKept(events map[string]*Event) bool {
+	for _, e := range events {
+		for _, col := range e.cols {
+			tp, ok := c.types[strings.ToLower(col.Name)]
+			if ok && (len(col.Tp) == 0 || col.Tp[0] != tp) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// remap drops and renames the columns of the event.
+func (c *columnChange) remap(e *Event) {
+	cols := e.cols[:0]
+	for _, col := range e.cols {
+		name := strings.ToLower(col.Name)
+		if _, ok := c.dropped[name]; ok {
+			continue
+		}
+		if newName, ok := c.renamed[name]; ok {
+			col.Name = newName
+		}
+		cols = append(cols, col)
+	}
+	e.cols = cols
+}
+
+// executeDDL executes the DDL of the table, and writes it after the events merged before it. If the DDL
+// only changes the columns except the key of table, the events are remapped to the new columns and
+// merged with the events after the DDL instead, and so are the events of a renamed table.
+func (tm *TableMerge) executeDDL(binlog *pb.Binlog) error {
+	ddl := string(binlog.GetDdlQuery())
+	change, err := parseColumnChange(ddl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// the spilled events are not remapped
+	var before *tableInfo
+	if change != nil && len(tm.keyEvent) != 0 && tm.spill == nil {
+		if before, err = ddlHandle.GetTableInfo(change.schema, change.table); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	renames, err := parseRenames(ddl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// the rows are located in the partitions before the DDL, the spilled events are not discarded
+	removed, err := parseRemovedPartitions(ddl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if removed != nil && len(tm.keyEvent) != 0 && tm.spill == nil {
+		if err := tm.discardPartitionRows(removed); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err = ddlHandle.ExecuteDDL("", ddl); err != nil {
+		return err
+	}
+
+	// the spilled events are not renamed
+	if len(renames) != 0 && len(tm.keyEvent) != 0 && tm.spill == nil {
+		tm.renameEvents(renames)
+		return tm.writeBinlog(binlog)
+	}
+
+	if before != nil {
+		after, err := ddlHandle.GetTableInfo(change.schema, change.table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if tm.remapColumns(change, before, after) {
+			return tm.writeBinlog(binlog)
+		}
+	}
+	return tm.writeDDL(binlog)
+}
+
+// remapColumns remaps the merged events to the columns after the change, it returns false if the events
+// can't be remapped because the key of table or the type of a renamed column is changed.
+func (tm *TableMerge) remapColumns(change *columnChange, before, after *tableInfo) bool {
+	if !before.hasKey() || !after.hasKey() || !change.typesKept(tm.keyEvent) {
+		return false
+	}
+	if !equalFoldColumns(change.rename(before.uniqueKeys[0].columns), after.uniqueKeys[0].columns) {
+		return false
+	}
+
+	for _, e := range tm.keyEvent {
+		size := e.size()
+		change.remap(e)
+		tm.addMemory(e.size() - size)
+	}
+	log.Info("remap the merged events to the new columns", zap.String("table", tm.name), zap.Int("events", len(tm.keyEvent)))
+	return true
+}
+
+func equalFoldColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
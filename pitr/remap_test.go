@@ -0,0 +1,102 @@
+package pitr
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"gotest.tools/assert"
+)
+
+func TestParseColumnChange(t *testing.T) {
+	change, err := parseColumnChange("use test; alter table t1 drop column b, change a c int, add column d int")
+	assert.NilError(t, err)
+	assert.Equal(t, change.schema, "test")
+	assert.Equal(t, change.table, "t1")
+	assert.DeepEqual(t, change.renamed, map[string]string{"a": "c"})
+	assert.DeepEqual(t, change.types, map[string]byte{"a": mysql.TypeLong})
+	assert.DeepEqual(t, change.dropped, map[string]struct{}{"b": {}})
+	assert.DeepEqual(t, change.rename([]string{"id", "A"}), []string{"id", "c"})
+
+	for _, ddl := range []string{
+		"use test; alter table t1 add index idx(a)",
+		"use test; alter table t1 drop column b, add primary key(a)",
+		"use test; create table t2 (id int)",
+		"use test; truncate table t1",
+	} {
+		change, err := parseColumnChange(ddl)
+		assert.NilError(t, err)
+		assert.Assert(t, change == nil, ddl)
+	}
+}
+
+func TestRemapColumns(t *testing.T) {
+	info := func(key string, columns ...string) *tableInfo {
+		return &tableInfo{
+			schema:     "test",
+			table:      "t1",
+			columns:    columns,
+			uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{key}}},
+		}
+	}
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), info("id", "id", "a", "b"))
+
+	col := func(name string, value interface{}, changed ...interface{}) *pb.Column {
+		c := &pb.Column{Name: name, Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeDatum(t, types.NewDatum(value))}
+		if len(changed) != 0 {
+			c.ChangedValue = encodeDatum(t, types.NewDatum(changed[0]))
+		}
+		return c
+	}
+	dml := func(tp pb.EventType, cols ...*pb.Column) *pb.Binlog {
+		e := &Event{schema: "test", table: "t1", eventType: tp, cols: cols}
+		ev, err := e.toPb()
+		assert.NilError(t, err)
+		binlog := newDMLBinlog(1)
+		binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		return binlog
+	}
+
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w}
+	for _, binlog := range []*pb.Binlog{
+		dml(pb.EventType_Insert, col("id", 1), col("a", 10), col("b", 100)),
+		dml(pb.EventType_Insert, col("id", 2), col("a", 20), col("b", 200)),
+		dml(pb.EventType_Delete, col("id", 3), col("a", 30), col("b", 300)),
+	} {
+		_, err := tm.handleDML(binlog)
+		assert.NilError(t, err)
+	}
+
+	change, err := parseColumnChange("use test; alter table t1 change a c bigint")
+	assert.NilError(t, err)
+	assert.Assert(t, !tm.remapColumns(change, info("id", "id", "a", "b"), info("id", "id", "c", "b")))
+	// the key of table is changed
+	change, err = parseColumnChange("use test; alter table t1 drop column id")
+	assert.NilError(t, err)
+	assert.Assert(t, !tm.remapColumns(change, info("id", "id", "a", "b"), info("a", "a", "b")))
+
+	change, err = parseColumnChange("use test; alter table t1 drop column b, change a c int, add column d int")
+	assert.NilError(t, err)
+	after := info("id", "id", "c", "d")
+	assert.Assert(t, tm.remapColumns(change, info("id", "id", "a", "b"), after))
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), after)
+
+	for _, binlog := range []*pb.Binlog{
+		dml(pb.EventType_Update, col("id", 1, 1), col("c", 10, 11), col("d", nil, 12)),
+		dml(pb.EventType_Delete, col("id", 2), col("c", 20), col("d", nil)),
+		dml(pb.EventType_Insert, col("id", 3), col("c", 31), col("d", 32)),
+	} {
+		_, err := tm.handleDML(binlog)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tm.FlushDMLBinlog(2))
+	sort.Strings(w.events)
+	assert.DeepEqual(t, w.events, []string{
+		"Insert id=1 c=11 d=12",
+		"Update id=3->3 c=30->31 d=<nil>->32",
+	})
+}
@@ -0,0 +1,279 @@
+package pitr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// renamePolicyMerge merges the events of a table renamed in the window under its final name
+	renamePolicyMerge = "merge"
+	// renamePolicySplit merges the events before and after renaming as different tables
+	renamePolicySplit = "split"
+)
+
+// tableRename is a table renamed by DDL.
+type tableRename struct {
+	old filter.TableName
+	new filter.TableName
+}
+
+// parseRenames returns the tables renamed by the DDL in order, it's empty if the DDL doesn't rename table.
+func parseRenames(ddl string) ([]tableRename, error) {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var (
+		schema  string
+		renames []tableRename
+	)
+	name := func(tn *ast.TableName) filter.TableName {
+		if len(tn.Schema.O) != 0 {
+			return filter.TableName{Schema: tn.Schema.O, Table: tn.Name.O}
+		}
+		return filter.TableName{Schema: schema, Table: tn.Name.O}
+	}
+	for _, stmt := range stmts {
+		switch node := stmt.(type) {
+		case *ast.UseStmt:
+			schema = node.DBName
+		case *ast.RenameTableStmt:
+			if len(node.TableToTables) == 0 {
+				renames = append(renames, tableRename{old: name(node.OldTable), new: name(node.NewTable)})
+			}
+			for _, t2t := range node.TableToTables {
+				renames = append(renames, tableRename{old: name(t2t.OldTable), new: name(t2t.NewTable)})
+			}
+		case *ast.AlterTableStmt:
+			for _, spec := range node.Specs {
+				if spec.Tp == ast.AlterTableRenameTable {
+					renames = append(renames, tableRename{old: name(node.Table), new: name(spec.NewTable)})
+				}
+			}
+		}
+	}
+	return renames, nil
+}
+
+// renameTracker tracks the tables renamed in the window, so the events of a table can be found by
+// its name before the window.
+type renameTracker struct {
+	// origins maps the lower case name of a renamed table to its name before the window and its current name
+	origins map[filter.TableName]tableRename
+	// history is all the tracked renames in order
+	history []tableRename
+}
+
+func lowerName(name filter.TableName) filter.TableName {
+	return filter.TableName{Schema: strings.ToLower(name.Schema), Table: strings.ToLower(name.Table)}
+}
+
+// track tracks the tables renamed by the DDL, and returns them.
+func (t *renameTracker) track(ddl string) ([]tableRename, error) {
+	renames, err := parseRenames(ddl)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, r := range renames {
+		if t.origins == nil {
+			t.origins = make(map[filter.TableName]tableRename)
+		}
+		origin := t.origin(r.old.Schema, r.old.Table)
+		delete(t.origins, lowerName(r.old))
+		t.origins[lowerName(r.new)] = tableRename{old: origin, new: r.new}
+		t.history = append(t.history, r)
+		log.Info("track renamed table", zap.String("table", fmt.Sprintf("%s.%s", r.new.Schema, r.new.Table)),
+			zap.String("origin", fmt.Sprintf("%s.%s", origin.Schema, origin.Table)))
+	}
+	return renames, nil
+}
+
+// origin returns the name of the table before the window.
+func (t *renameTracker) origin(schema, table string) filter.TableName {
+	name := filter.TableName{Schema: schema, Table: table}
+	if r, ok := t.origins[lowerName(name)]; ok {
+		return r.old
+	}
+	return name
+}
+
+// outputNames maps the temp dir of every renamed table to the dir of its final name.
+func (t *renameTracker) outputNames() map[string]string {
+	names := make(map[string]string, len(t.origins))
+	for _, r := range t.origins {
+		dir := fmt.Sprintf("%s_%s", r.old.Schema, r.old.Table)
+		if final := fmt.Sprintf("%s_%s", r.new.Schema, r.new.Table); !strings.EqualFold(dir, final) {
+			names[dir] = final
+		}
+	}
+	return names
+}
+
+// groups maps every table renamed in the window to the first name of all the tables connected by renames,
+// the tables are named like schema_table.
+func (t *renameTracker) groups() map[string]string {
+	parent := make(map[string]string)
+	var find func(name string) string
+	find = func(name string) string {
+		p, ok := parent[name]
+		if !ok || p == name {
+			return name
+		}
+		root := find(p)
+		parent[name] = root
+		return root
+	}
+	for _, r := range t.history {
+		a := find(fmt.Sprintf("%s_%s", r.old.Schema, r.old.Table))
+		b := find(fmt.Sprintf("%s_%s", r.new.Schema, r.new.Table))
+		if a == b {
+			continue
+		}
+		if a > b {
+			a, b = b, a
+		}
+		parent[a], parent[b] = a, a
+	}
+
+	groups := make(map[string]string, len(parent))
+	for name := range parent {
+		groups[name] = find(name)
+	}
+	return groups
+}
+
+// skipRenamed returns true if the events of the table should be skipped, a renamed table is kept
+// if either its name or its name before the window is selected.
+func (f *tableFilter) skipRenamed(schema, table string, renames *renameTracker) bool {
+	if !f.skip(schema, table) {
+		return false
+	}
+	origin := renames.origin(schema, table)
+	return f.skip(origin.Schema, origin.Table)
+}
+
+// outputName returns the name of the table's output, which is the final name of a table renamed
+// in the window with rename-policy merge.
+func (m *Merge) outputName(dir string) string {
+	if m.cp == nil {
+		return dir
+	}
+	if name, ok := m.cp.Renamed[dir]; ok {
+		return name
+	}
+	return dir
+}
+
+// saveRenamed saves the final names of the tables renamed in the window to checkpoint, a name used by
+// another temp dir is not saved, so the outputs of two tables never conflict.
+func (m *Merge) saveRenamed() error {
+	names := ddlHandle.renames.outputNames()
+	if len(names) == 0 {
+		return nil
+	}
+	tables, err := m.tables()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	exists := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		exists[table] = struct{}{}
+	}
+	dirs := make([]string, 0, len(names))
+	for dir := range names {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		final := names[dir]
+		if _, ok := exists[dir]; !ok {
+			delete(names, dir)
+			continue
+		}
+		if _, ok := exists[final]; ok {
+			if _, renamed := names[final]; !renamed {
+				log.Warn("the final name of renamed table is used by another table, keep its name",
+					zap.String("table", dir), zap.String("final name", final))
+				delete(names, dir)
+			}
+		}
+	}
+
+	m.cp.Lock()
+	m.cp.Renamed = names
+	m.cp.Unlock()
+	return nil
+}
+
+// renameEvents renames the table of the merged events, so they are merged with the events after renaming.
+func (tm *TableMerge) renameEvents(renames []tableRename) {
+	var n int
+	for _, r := range renames {
+		oldPrefix := fmt.Sprintf("%s|%s|", r.old.Schema, r.old.Table)
+		newPrefix := fmt.Sprintf("%s|%s|", r.new.Schema, r.new.Table)
+		renamed := make(map[string]*Event)
+		for key, e := range tm.keyEvent {
+			if !strings.EqualFold(e.schema, r.old.Schema) || !strings.EqualFold(e.table, r.old.Table) {
+				continue
+			}
+			delete(tm.keyEvent, key)
+			size := e.size()
+			e.schema, e.table = r.new.Schema, r.new.Table
+			e.oldKey = renameKey(e.oldKey, oldPrefix, newPrefix)
+			e.newKey = renameKey(e.newKey, oldPrefix, newPrefix)
+			renamed[renameKey(key, oldPrefix, newPrefix)] = e
+			tm.addMemory(e.size() - size)
+		}
+		for key, e := range renamed {
+			tm.keyEvent[key] = e
+		}
+		n += len(renamed)
+	}
+	log.Info("rename the merged events", zap.String("table", tm.name), zap.Int("events", n))
+}
+
+func renameKey(key, oldPrefix, newPrefix string) string {
+	if len(key) >= len(oldPrefix) && strings.EqualFold(key[:len(oldPrefix)], oldPrefix) {
+		return newPrefix + key[len(oldPrefix):]
+	}
+	return key
+}
+
+// tableDir returns the name of the table's temp dir, the events of a table renamed in the window are
+// saved in the dir of its name before the window with rename-policy merge.
+func (m *Merge) tableDir(schema, table string) filter.TableName {
+	if m.renamePolicy == renamePolicySplit {
+		return filter.TableName{Schema: schema, Table: table}
+	}
+	return ddlHandle.renames.origin(schema, table)
+}
+
+// trackDDL tracks the tables renamed by the DDL binlog, and returns the table of the DDL, it's the new
+// name of the first table if the DDL renames tables. The DDLs merged in base dir or restored from the BR backup
+// are not tracked.
+func (m *Merge) trackDDL(binlog *pb.Binlog) (schema, table string, err error) {
+	ddl := string(binlog.GetDdlQuery())
+	schema, table, err = parserSchemaTableFromDDL(ddl)
+	if err != nil || binlog.CommitTs <= m.mergedCommitTS() {
+		return schema, table, errors.Trace(err)
+	}
+	renames, err := ddlHandle.renames.track(ddl)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	if len(renames) != 0 {
+		schema, table = renames[0].new.Schema, renames[0].new.Table
+	}
+	return schema, table, nil
+}
@@ -0,0 +1,138 @@
+package pitr
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestParseRenames(t *testing.T) {
+	name := func(schema, table string) filter.TableName {
+		return filter.TableName{Schema: schema, Table: table}
+	}
+	cases := []struct {
+		ddl     string
+		renames []tableRename
+	}{
+		{"use test; rename table t0 to t1", []tableRename{{name("test", "t0"), name("test", "t1")}}},
+		{"rename table db1.t0 to db2.t1, db1.t2 to db1.t0", []tableRename{
+			{name("db1", "t0"), name("db2", "t1")},
+			{name("db1", "t2"), name("db1", "t0")},
+		}},
+		{"use test; alter table t0 rename to t1", []tableRename{{name("test", "t0"), name("test", "t1")}}},
+		{"use test; alter table t0 add column c int", nil},
+		{"use test; create table t1 (id int)", nil},
+	}
+	for _, c := range cases {
+		renames, err := parseRenames(c.ddl)
+		assert.NilError(t, err)
+		assert.Equal(t, len(renames), len(c.renames), c.ddl)
+		for i, r := range renames {
+			assert.Equal(t, r, c.renames[i])
+		}
+	}
+}
+
+func TestRenameTracker(t *testing.T) {
+	tracker := &renameTracker{}
+	for _, ddl := range []string{
+		"use test; rename table t0 to t1",
+		"use test; create table t3 (id int)",
+		"use test; rename table t1 to t2",
+		// swap a and b
+		"use test; rename table a to tmp, b to a, tmp to b",
+	} {
+		_, err := tracker.track(ddl)
+		assert.NilError(t, err)
+	}
+
+	assert.Equal(t, tracker.origin("test", "T2"), filter.TableName{Schema: "test", Table: "t0"})
+	assert.Equal(t, tracker.origin("test", "t1"), filter.TableName{Schema: "test", Table: "t1"})
+	assert.Equal(t, tracker.origin("test", "a"), filter.TableName{Schema: "test", Table: "b"})
+	assert.Equal(t, tracker.origin("test", "tmp"), filter.TableName{Schema: "test", Table: "tmp"})
+	assert.DeepEqual(t, tracker.outputNames(), map[string]string{
+		"test_t0": "test_t2",
+		"test_a":  "test_b",
+		"test_b":  "test_a",
+	})
+	assert.DeepEqual(t, tracker.groups(), map[string]string{
+		"test_t0":  "test_t0",
+		"test_t1":  "test_t0",
+		"test_t2":  "test_t0",
+		"test_a":   "test_a",
+		"test_b":   "test_a",
+		"test_tmp": "test_a",
+	})
+
+	// the renamed table is kept if its name before the window is selected
+	f := newTableFilter(&Config{DoTables: []filter.TableName{{Schema: "test", Table: "t0"}}})
+	assert.Assert(t, !f.skipRenamed("test", "t2", tracker))
+	assert.Assert(t, !f.skipRenamed("test", "t0", tracker))
+	assert.Assert(t, f.skipRenamed("test", "a", tracker))
+	assert.Assert(t, !(*tableFilter)(nil).skipRenamed("test", "a", tracker))
+}
+
+func TestRenameEvents(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	for _, table := range []string{"t0", "t1"} {
+		ddlHandle.tableInfos.Store(quoteSchema("test", table), &tableInfo{
+			schema:     "test",
+			table:      table,
+			columns:    []string{"id", "v"},
+			uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+		})
+	}
+	dml := func(table string, events ...*Event) *pb.Binlog {
+		binlog := newDMLBinlog(1)
+		for _, e := range events {
+			e.table = table
+			ev, err := e.toPb()
+			assert.NilError(t, err)
+			binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		}
+		return binlog
+	}
+
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t0", keyEvent: make(map[string]*Event), writer: w}
+	_, err := tm.handleDML(dml("t0",
+		genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0),
+		genSpillEvent(t, pb.EventType_Update, 2, 2, 200, 201),
+		genSpillEvent(t, pb.EventType_Delete, 3, 3, 300, 0),
+	))
+	assert.NilError(t, err)
+
+	renames, err := parseRenames("use test; rename table t0 to t1")
+	assert.NilError(t, err)
+	tm.renameEvents(renames)
+	for key, e := range tm.keyEvent {
+		assert.Equal(t, e.table, "t1")
+		assert.Equal(t, key, e.oldKey)
+		assert.Assert(t, key[:len("test|t1|")] == "test|t1|", key)
+	}
+
+	// the events after renaming are merged with the events before it
+	_, err = tm.handleDML(dml("t1",
+		genSpillEvent(t, pb.EventType_Update, 1, 1, 100, 101),
+		genSpillEvent(t, pb.EventType_Delete, 2, 2, 201, 0),
+		genSpillEvent(t, pb.EventType_Insert, 3, 3, 301, 0),
+	))
+	assert.NilError(t, err)
+	assert.Equal(t, len(tm.keyEvent), 3)
+	assert.NilError(t, tm.FlushDMLBinlog(2))
+	sort.Strings(w.events)
+	assert.DeepEqual(t, w.events, []string{"Delete id=2->2 v=200->201", "Insert id=1 v=101", "Update id=3->3 v=300->301"})
+}
+
+func TestGroupRowCounts(t *testing.T) {
+	source := rowCounts{"test_t0": {Inserts: 3}, "test_t1": {Inserts: 1, Deletes: 1}, "test_t2": {Inserts: 1}}
+	output := rowCounts{"test_t1": {Inserts: 3}, "test_t2": {Inserts: 1}}
+	assert.Equal(t, len(compareRowCounts(source, output)), 2)
+
+	groups := map[string]string{"test_t0": "test_t0", "test_t1": "test_t0"}
+	assert.Equal(t, len(compareRowCounts(source.group(groups), output.group(groups))), 0)
+	assert.DeepEqual(t, source.group(groups), rowCounts{"test_t0": {Inserts: 4, Deletes: 1}, "test_t2": {Inserts: 1}})
+}
@@ -0,0 +1,125 @@
+package pitr
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// checkReparoReadable checks the binlogs in the table's output dir can be replayed by reparo of tidb-binlog,
+// the files are read like reparo: the names are parsed by binlogfile, and the files are decoded without
+// decompression and decryption. The commit ts of the binlogs should be non-decreasing, and the events
+// should have the fields used by reparo.
+func checkReparoReadable(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var (
+		lastTS int64
+		files  int
+	)
+	for _, info := range infos {
+		name := info.Name()
+		// the lock file of the binlogger is skipped
+		if info.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		files++
+		// the files reparo can't parse are skipped silently by it, so the binlogs in them are lost
+		if _, codec := trimCompressSuffix(name); codec != compressNone {
+			return errors.Errorf("binlog file %s is compressed by %s, it can't be read by reparo", name, codec)
+		}
+		if _, _, err := binlogfile.ParseBinlogName(name); err != nil {
+			return errors.Annotatef(err, "binlog file %s can't be found by reparo", name)
+		}
+		file := filepath.Join(dir, name)
+		if err := scanReparoFile(file, func(binlog *pb.Binlog) error {
+			if binlog.CommitTs < lastTS {
+				return errors.Errorf("commit ts %d is less than the last binlog %d", binlog.CommitTs, lastTS)
+			}
+			lastTS = binlog.CommitTs
+			return errors.Trace(checkReparoBinlog(binlog))
+		}); err != nil {
+			return errors.Annotatef(err, "binlog file %s can't be replayed by reparo", file)
+		}
+	}
+	if files == 0 {
+		return errors.Errorf("no binlog file in %s", dir)
+	}
+	return nil
+}
+
+// scanReparoFile decodes the binlogs in file like reparo, the payloads are unmarshalled directly.
+func scanReparoFile(file string, fn func(binlog *pb.Binlog) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		payload, _, err := binlogfile.Decode(reader)
+		if errors.Cause(err) == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		binlog := &pb.Binlog{}
+		if err := binlog.Unmarshal(payload); err != nil {
+			return errors.Annotate(err, "the payload is not a binlog, it may be encrypted")
+		}
+		if err := fn(binlog); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// checkReparoBinlog checks the binlog has the fields used by reparo to generate the SQL statements.
+func checkReparoBinlog(binlog *pb.Binlog) error {
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		if len(binlog.DdlQuery) == 0 {
+			return errors.Errorf("DDL binlog at %d has no query", binlog.CommitTs)
+		}
+	case pb.BinlogType_DML:
+		for _, event := range binlog.GetDmlData().GetEvents() {
+			if len(event.GetSchemaName()) == 0 || len(event.GetTableName()) == 0 {
+				return errors.Errorf("event at %d has no schema or table", binlog.CommitTs)
+			}
+			if len(event.GetRow()) == 0 {
+				return errors.Errorf("event of %s at %d has no column", quoteSchema(event.GetSchemaName(), event.GetTableName()), binlog.CommitTs)
+			}
+		}
+	default:
+		return errors.Errorf("unknown binlog type %v at %d", binlog.Tp, binlog.CommitTs)
+	}
+	return nil
+}
+
+// checkReparoOutput checks the output of every table in outputDir can be replayed by reparo.
+func checkReparoOutput(outputDir string) error {
+	tables, err := readSubDirs(outputDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, table := range tables {
+		if err := checkReparoReadable(filepath.Join(outputDir, table)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	log.Info("the output can be replayed by reparo", zap.Int("tables", len(tables)))
+	return nil
+}
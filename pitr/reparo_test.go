@@ -0,0 +1,47 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestCheckReparoOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reparo")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTable := func(outputDir, codec string, binlogs ...*pb.Binlog) {
+		w, err := newBinlogWriter(runOptions{}, outputFormatPB, filepath.Join(outputDir, "test_t1"), codec, 0)
+		assert.NilError(t, err)
+		for _, binlog := range binlogs {
+			assert.NilError(t, w.Write(binlog))
+		}
+		assert.NilError(t, w.Close())
+	}
+
+	output := filepath.Join(dir, "output")
+	writeTable(output, compressNone,
+		genTestDDL("test", "t1", "use test; create table t1 (id int primary key, v int)", 100),
+		genRowBinlog(pb.EventType_Insert, 1, 10, 200),
+		genRowBinlog(pb.EventType_Update, 1, 10, 200),
+	)
+	assert.NilError(t, checkReparoOutput(output))
+
+	// the compressed files are skipped by reparo
+	compressed := filepath.Join(dir, "compressed")
+	writeTable(compressed, compressGzip, genRowBinlog(pb.EventType_Insert, 1, 10, 200))
+	assert.ErrorContains(t, checkReparoOutput(compressed), "it can't be read by reparo")
+
+	unordered := filepath.Join(dir, "unordered")
+	writeTable(unordered, compressNone, genRowBinlog(pb.EventType_Insert, 1, 10, 300), genRowBinlog(pb.EventType_Insert, 2, 10, 200))
+	assert.ErrorContains(t, checkReparoOutput(unordered), "commit ts 200 is less than the last binlog 300")
+
+	noQuery := filepath.Join(dir, "no-query")
+	writeTable(noQuery, compressNone, &pb.Binlog{Tp: pb.BinlogType_DDL, CommitTs: 100})
+	assert.ErrorContains(t, checkReparoOutput(noQuery), "DDL binlog at 100 has no query")
+}
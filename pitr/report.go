@@ -0,0 +1,435 @@
+package pitr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// reportInputFile is a binlog file read by Map, the commit ts range is 0 if Map is finished in the last run.
+type reportInputFile struct {
+	Name          string `json:"name"`
+	Size          int64  `json:"size,omitempty"`
+	FirstCommitTS int64  `json:"first-commit-ts,omitempty"`
+	LastCommitTS  int64  `json:"last-commit-ts,omitempty"`
+}
+
+// reportTable is the number of events of one table before and after merging.
+type reportTable struct {
+	EventsBeforeMerge int64 `json:"events-before-merge"`
+	RowsAfterMerge    int64 `json:"rows-after-merge"`
+	// RowsDiscarded is the merged rows discarded because the table is truncated or dropped after them
+	RowsDiscarded int64 `json:"rows-discarded,omitempty"`
+	// Reduction is the percent of the events removed by merging
+	Reduction float64 `json:"reduction"`
+}
+
+// reduction returns the percent of the events removed by merging, 0 if the table has no event.
+func reduction(eventsBeforeMerge, rowsAfterMerge int64) float64 {
+	if eventsBeforeMerge <= 0 || rowsAfterMerge >= eventsBeforeMerge {
+		return 0
+	}
+	return math.Round(float64(eventsBeforeMerge-rowsAfterMerge)*10000/float64(eventsBeforeMerge)) / 100
+}
+
+// reportDedup is the effectiveness of merging of all the tables.
+type reportDedup struct {
+	EventsBeforeMerge int64   `json:"events-before-merge"`
+	RowsAfterMerge    int64   `json:"rows-after-merge"`
+	Reduction         float64 `json:"reduction"`
+	// LowReductionTables is the tables with at least lowReductionMinEvents events whose reduction is below
+	// lowReductionPercent, keeping their full history by preserve-txn costs little more
+	LowReductionTables []string `json:"low-reduction-tables,omitempty"`
+}
+
+const (
+	// lowReductionPercent and lowReductionMinEvents pick the tables whose changes are rarely merged
+	lowReductionPercent   = 10
+	lowReductionMinEvents = 1000
+)
+
+type reportDDL struct {
+	CommitTS int64  `json:"commit-ts"`
+	Query    string `json:"query"`
+}
+
+type reportOutputFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// reportHistoryDDLCache is the history-ddl-cache file, Hit is true if the jobs are loaded from it, otherwise they
+// are fetched and saved to it.
+type reportHistoryDDLCache struct {
+	File    string `json:"file"`
+	Version int64  `json:"version"`
+	Hit     bool   `json:"hit"`
+}
+
+// runReport is the machine-readable report of a run, it's written to report-file at the end of Process.
+// all the methods can be called concurrently, and a nil runReport records nothing.
+type runReport struct {
+	mu sync.Mutex
+
+	// RunID is the id tagging the logs of the run
+	RunID      string     `json:"run-id,omitempty"`
+	StartTime  time.Time  `json:"start-time"`
+	EndTime    time.Time  `json:"end-time"`
+	Error      string     `json:"error,omitempty"`
+	ErrorClass ErrorClass `json:"error-class,omitempty"`
+	ExitCode   int        `json:"exit-code"`
+	Resumed    bool       `json:"resumed"`
+
+	StartTSO int64 `json:"start-tso"`
+	StopTSO  int64 `json:"stop-tso"`
+
+	InputFiles []*reportInputFile `json:"input-files"`
+	// CorruptionGaps is the binlogs lost in the damaged regions skipped by relax-corruption
+	CorruptionGaps []*corruptionGap `json:"corruption-gaps,omitempty"`
+	// SkippedTables is the tables skipped by the table filter
+	SkippedTables []string `json:"skipped-tables"`
+	// Tables is the events of every table, the key is schema_table
+	Tables map[string]*reportTable `json:"tables"`
+	// Dedup is the events of all the tables before and after merging
+	Dedup *reportDedup `json:"dedup,omitempty"`
+
+	HistoryDDLs int `json:"history-ddls"`
+	// HistoryDDLCache is the history-ddl-cache used by the run
+	HistoryDDLCache *reportHistoryDDLCache `json:"history-ddl-cache,omitempty"`
+	// SkippedHistoryDDLs is the history DDLs failed to execute and skipped by on-ddl-error
+	SkippedHistoryDDLs int         `json:"skipped-history-ddls,omitempty"`
+	DDLs               []reportDDL `json:"ddls"`
+
+	OutputFiles []reportOutputFile `json:"output-files"`
+	// OutputDigest is the SHA256 of checksums.txt in the output dir, it's equal for the same output
+	OutputDigest string `json:"output-digest,omitempty"`
+	// SampledLogs is the count of every repetitive log message whose logs are not all printed
+	SampledLogs map[string]int64 `json:"sampled-logs,omitempty"`
+
+	skipped map[string]struct{}
+}
+
+func newRunReport() *runReport {
+	return &runReport{
+		StartTime: time.Now(),
+		Tables:    make(map[string]*reportTable),
+		skipped:   make(map[string]struct{}),
+	}
+}
+
+func (rp *runReport) setRange(startTSO, stopTSO int64) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.StartTSO, rp.StopTSO = startTSO, stopTSO
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setResumed(resumed bool) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.Resumed = resumed
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setInputFiles(files []string) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.InputFiles = make([]*reportInputFile, 0, len(files))
+	for _, file := range files {
+		rp.InputFiles = append(rp.InputFiles, &reportInputFile{Name: redactStorageURI(file)})
+	}
+}
+
+// setInputFileRange sets the size and commit ts range of the input file read by r.
+func (rp *runReport) setInputFileRange(r *binlogFileReader) {
+	if rp == nil {
+		return
+	}
+	name := redactStorageURI(r.name)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, f := range rp.InputFiles {
+		if f.Name == name {
+			f.Size, f.FirstCommitTS, f.LastCommitTS = r.size, r.firstTS, r.lastTS
+			return
+		}
+	}
+}
+
+func (rp *runReport) addCorruptionGap(gap *corruptionGap) {
+	if rp == nil {
+		return
+	}
+	g := *gap
+	g.File = redactStorageURI(g.File)
+	rp.mu.Lock()
+	rp.CorruptionGaps = append(rp.CorruptionGaps, &g)
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) skipTable(schema, table string) {
+	if rp == nil {
+		return
+	}
+	key := quoteSchema(schema, table)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if _, ok := rp.skipped[key]; !ok {
+		rp.skipped[key] = struct{}{}
+		rp.SkippedTables = append(rp.SkippedTables, key)
+	}
+}
+
+func (rp *runReport) table(key string) *reportTable {
+	t, ok := rp.Tables[key]
+	if !ok {
+		t = &reportTable{}
+		rp.Tables[key] = t
+	}
+	return t
+}
+
+func (rp *runReport) addEventsBeforeMerge(key string, n int64) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.table(key).EventsBeforeMerge += n
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) addRowsAfterMerge(key string, n int64) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.table(key).RowsAfterMerge += n
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) addRowsDiscarded(key string, n int64) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.table(key).RowsDiscarded += n
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setHistoryDDLs(n int) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.HistoryDDLs = n
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setHistoryDDLCache(file string, version int64, hit bool) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.HistoryDDLCache = &reportHistoryDDLCache{File: file, Version: version, Hit: hit}
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setSkippedHistoryDDLs(n int) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.SkippedHistoryDDLs = n
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) setSampledLogs(counts map[string]int64) {
+	if rp == nil || len(counts) == 0 {
+		return
+	}
+	rp.mu.Lock()
+	rp.SampledLogs = counts
+	rp.mu.Unlock()
+}
+
+func (rp *runReport) addDDL(commitTS int64, query string) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	rp.DDLs = append(rp.DDLs, reportDDL{CommitTS: commitTS, Query: query})
+	rp.mu.Unlock()
+}
+
+// tableEvents returns a copy of the events of every table.
+func (rp *runReport) tableEvents() map[string]reportTable {
+	if rp == nil {
+		return nil
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	tables := make(map[string]reportTable, len(rp.Tables))
+	for key, t := range rp.Tables {
+		tables[key] = *t
+	}
+	return tables
+}
+
+// dedupLocked sets the reduction of every table, and returns the reduction of all the tables, nil if no table is
+// merged. The caller should hold the mutex.
+func (rp *runReport) dedupLocked() *reportDedup {
+	if len(rp.Tables) == 0 {
+		return nil
+	}
+	dedup := &reportDedup{}
+	for key, t := range rp.Tables {
+		t.Reduction = reduction(t.EventsBeforeMerge, t.RowsAfterMerge)
+		dedup.EventsBeforeMerge += t.EventsBeforeMerge
+		dedup.RowsAfterMerge += t.RowsAfterMerge
+		if t.EventsBeforeMerge >= lowReductionMinEvents && t.Reduction < lowReductionPercent {
+			dedup.LowReductionTables = append(dedup.LowReductionTables, key)
+		}
+	}
+	dedup.Reduction = reduction(dedup.EventsBeforeMerge, dedup.RowsAfterMerge)
+	sort.Strings(dedup.LowReductionTables)
+	return dedup
+}
+
+// logDedup logs the reduction of all the tables after Reduce, and the tables whose changes are rarely merged.
+func (rp *runReport) logDedup() {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	dedup := rp.dedupLocked()
+	rp.mu.Unlock()
+	if dedup == nil {
+		return
+	}
+	log.Info("events are merged", zap.Int64("events before merge", dedup.EventsBeforeMerge),
+		zap.Int64("rows after merge", dedup.RowsAfterMerge), zap.Float64("reduction percent", dedup.Reduction))
+	if len(dedup.LowReductionTables) != 0 {
+		log.Info("the changes of tables are rarely merged, preserve-txn keeps their full history at little more cost",
+			zap.Strings("tables", dedup.LowReductionTables), zap.Float64("max reduction percent", lowReductionPercent))
+	}
+}
+
+// corruptionWarnings returns the damaged regions skipped by relax-corruption.
+func (rp *runReport) corruptionWarnings() []string {
+	if rp == nil {
+		return nil
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	warnings := make([]string, 0, len(rp.CorruptionGaps))
+	for _, gap := range rp.CorruptionGaps {
+		warnings = append(warnings, fmt.Sprintf("the damaged region at %d of %s is skipped: %s", gap.Offset, gap.File, gap.Error))
+	}
+	return warnings
+}
+
+// collectOutputFiles records the size and checksum of all the files in dir, and the digest of the output.
+func (rp *runReport) collectOutputFiles(dir string) error {
+	var files []reportOutputFile
+	var digest string
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sum, err := fileSHA256(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, reportOutputFile{Name: name, Size: info.Size(), SHA256: sum})
+		if name == filepath.Join(dir, checksumFileName) {
+			digest = sum
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	rp.mu.Lock()
+	rp.OutputFiles = files
+	rp.OutputDigest = digest
+	rp.mu.Unlock()
+	return nil
+}
+
+// write finishes the report with the error of run, and writes it to file in JSON.
+func (rp *runReport) write(file string, runErr error) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	rp.EndTime = time.Now()
+	if runErr != nil {
+		rp.Error = runErr.Error()
+		rp.ErrorClass = ClassifyError(runErr)
+		rp.ExitCode = rp.ErrorClass.ExitCode()
+	}
+	rp.Dedup = rp.dedupLocked()
+	data, err := json.MarshalIndent(rp, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = ioutil.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return errors.Annotatef(err, "write report file %s", file)
+	}
+
+	log.Info("report is written", zap.String("file", file))
+	return nil
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Annotatef(err, "read file %s", name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeReport writes the report of run to report-file, the output files are recorded only if the run succeeded.
+func (r *PITR) writeReport(runErr error) error {
+	r.report.setSkippedHistoryDDLs(r.ddlErrors.skippedCount())
+	r.report.setSampledLogs(r.opts.sampler.suppressed())
+	if runErr == nil {
+		if _, err := os.Stat(defaultOutputDir); err == nil {
+			if err := r.report.collectOutputFiles(defaultOutputDir); err != nil {
+				return errors.Annotate(err, "collect output files")
+			}
+		}
+	}
+	return errors.Trace(r.report.write(r.cfg.ReportFile, runErr))
+}
@@ -0,0 +1,73 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"gotest.tools/assert"
+)
+
+func TestRunReport(t *testing.T) {
+	// a nil report records nothing
+	var nilReport *runReport
+	nilReport.skipTable("test", "t1")
+	nilReport.addDDL(1, "create database test")
+
+	dir, err := ioutil.TempDir("", "report")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	outputDir := filepath.Join(dir, "output")
+	assert.Assert(t, os.MkdirAll(filepath.Join(outputDir, "test_t1"), 0700) == nil)
+	assert.Assert(t, ioutil.WriteFile(filepath.Join(outputDir, "test_t1", "binlog-0"), []byte("abc"), 0600) == nil)
+
+	rp := newRunReport()
+	rp.setRange(100, 200)
+	rp.setInputFiles([]string{"data/binlog-0", "data/binlog-1"})
+	rp.setInputFileRange(&binlogFileReader{name: "data/binlog-1", size: 10, firstTS: 120, lastTS: 150})
+	rp.skipTable("test", "t2")
+	rp.skipTable("test", "t2")
+	rp.addEventsBeforeMerge("test_t1", 3)
+	rp.addEventsBeforeMerge("test_t1", 2)
+	rp.addRowsAfterMerge("test_t1", 1)
+	rp.addEventsBeforeMerge("test_t3", 2000)
+	rp.addRowsAfterMerge("test_t3", 1900)
+	rp.addDDL(130, "alter table t1 add column c int")
+	assert.Assert(t, rp.collectOutputFiles(outputDir) == nil)
+
+	file := filepath.Join(dir, "report.json")
+	assert.Assert(t, rp.write(file, errors.New("some error")) == nil)
+
+	data, err := ioutil.ReadFile(file)
+	assert.Assert(t, err == nil)
+	var got runReport
+	assert.Assert(t, json.Unmarshal(data, &got) == nil)
+
+	assert.Equal(t, got.Error, "some error")
+	assert.Equal(t, got.StartTSO, int64(100))
+	assert.DeepEqual(t, got.InputFiles, []*reportInputFile{
+		{Name: "data/binlog-0"},
+		{Name: "data/binlog-1", Size: 10, FirstCommitTS: 120, LastCommitTS: 150},
+	})
+	assert.DeepEqual(t, got.SkippedTables, []string{"`test`.`t2`"})
+	assert.DeepEqual(t, got.Tables, map[string]*reportTable{
+		"test_t1": {EventsBeforeMerge: 5, RowsAfterMerge: 1, Reduction: 80},
+		"test_t3": {EventsBeforeMerge: 2000, RowsAfterMerge: 1900, Reduction: 5},
+	})
+	assert.DeepEqual(t, got.Dedup, &reportDedup{
+		EventsBeforeMerge:  2005,
+		RowsAfterMerge:     1901,
+		Reduction:          5.19,
+		LowReductionTables: []string{"test_t3"},
+	})
+	assert.DeepEqual(t, got.DDLs, []reportDDL{{CommitTS: 130, Query: "alter table t1 add column c int"}})
+	assert.DeepEqual(t, got.OutputFiles, []reportOutputFile{{
+		Name:   filepath.Join(outputDir, "test_t1", "binlog-0"),
+		Size:   3,
+		SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}})
+}
@@ -0,0 +1,226 @@
+package pitr
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// RouteRule maps the tables matched by the patterns to the target names in the output, like the route rules of DM.
+type RouteRule struct {
+	// SchemaPattern and TablePattern are case-insensitive and support the wildcards * and ?, the rule without
+	// TablePattern routes the schema and all its tables
+	SchemaPattern string `toml:"schema-pattern" json:"schema-pattern"`
+	TablePattern  string `toml:"table-pattern" json:"table-pattern"`
+	TargetSchema  string `toml:"target-schema" json:"target-schema"`
+	// TargetTable is the name of the table in output, empty means keeping the name
+	TargetTable string `toml:"target-table" json:"target-table"`
+}
+
+// tableRouter renames the schemas and tables in the merged binlogs by the route rules, the rules with
+// table-pattern are matched before the rules of schemas, and the first matched rule is used.
+type tableRouter struct {
+	tableRules  []*RouteRule
+	schemaRules []*RouteRule
+	// sources is the source name of every routed table, the key is the quoted target name, it's saved by
+	// routeBinlog, so the table info of the routed rows can be got by sourceTable
+	sources sync.Map
+}
+
+// newTableRouter checks the rules, it returns nil if there is no rule.
+func newTableRouter(rules []*RouteRule) (*tableRouter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &tableRouter{}
+	for _, rule := range rules {
+		if len(rule.SchemaPattern) == 0 || len(rule.TargetSchema) == 0 {
+			return nil, errors.New("schema-pattern and target-schema are required by route-rules")
+		}
+		for _, pattern := range []string{rule.SchemaPattern, rule.TablePattern} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Annotatef(err, "invalid pattern %s in route-rules", pattern)
+			}
+		}
+		if len(rule.TablePattern) == 0 {
+			if len(rule.TargetTable) != 0 {
+				return nil, errors.Errorf("target-table %s of route-rules requires table-pattern", rule.TargetTable)
+			}
+			r.schemaRules = append(r.schemaRules, rule)
+		} else {
+			r.tableRules = append(r.tableRules, rule)
+		}
+	}
+	return r, nil
+}
+
+func matchPattern(pattern, name string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return matched
+}
+
+// routeSchema returns the target name of the schema, a nil tableRouter keeps all the names.
+func (r *tableRouter) routeSchema(schema string) string {
+	if r == nil {
+		return schema
+	}
+	for _, rule := range r.schemaRules {
+		if matchPattern(rule.SchemaPattern, schema) {
+			return rule.TargetSchema
+		}
+	}
+	return schema
+}
+
+// route returns the target name of the table.
+func (r *tableRouter) route(schema, table string) (string, string) {
+	if r == nil {
+		return schema, table
+	}
+	for _, rule := range r.tableRules {
+		if matchPattern(rule.SchemaPattern, schema) && matchPattern(rule.TablePattern, table) {
+			if len(rule.TargetTable) != 0 {
+				table = rule.TargetTable
+			}
+			return rule.TargetSchema, table
+		}
+	}
+	return r.routeSchema(schema), table
+}
+
+// routeBinlog renames the tables of the DML events or in the DDL of the binlog.
+func (r *tableRouter) routeBinlog(binlog *pb.Binlog) error {
+	if r == nil {
+		return nil
+	}
+	if binlog.Tp == pb.BinlogType_DDL {
+		ddl, err := r.routeDDL("", string(binlog.GetDdlQuery()))
+		if err != nil {
+			return errors.Annotatef(err, "route DDL %s", binlog.GetDdlQuery())
+		}
+		binlog.DdlQuery = []byte(ddl)
+		return nil
+	}
+	for i := range binlog.GetDmlData().GetEvents() {
+		ev := &binlog.DmlData.Events[i]
+		schema, table := r.route(ev.GetSchemaName(), ev.GetTableName())
+		if schema != ev.GetSchemaName() || table != ev.GetTableName() {
+			r.sources.Store(quoteSchema(schema, table), [2]string{ev.GetSchemaName(), ev.GetTableName()})
+		}
+		ev.SchemaName, ev.TableName = &schema, &table
+	}
+	return nil
+}
+
+// sourceTable returns the source name of the table routed to schema.table, the name is kept if no table is routed
+// to it. The tables merged into one target have the same definition, so any of them is returned.
+func (r *tableRouter) sourceTable(schema, table string) (string, string) {
+	if r == nil {
+		return schema, table
+	}
+	if source, ok := r.sources.Load(quoteSchema(schema, table)); ok {
+		names := source.([2]string)
+		return names[0], names[1]
+	}
+	return schema, table
+}
+
+// routeDDL renames the databases and tables in the statements of ddl, schema is the current database before ddl.
+// The table without database is qualified with the target database if it's routed.
+func (r *tableRouter) routeDDL(schema, ddl string) (string, error) {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var sb strings.Builder
+	for _, stmt := range stmts {
+		switch node := stmt.(type) {
+		case *ast.UseStmt:
+			schema = node.DBName
+			node.DBName = r.routeSchema(node.DBName)
+		case *ast.CreateDatabaseStmt:
+			node.Name = r.routeSchema(node.Name)
+		case *ast.DropDatabaseStmt:
+			node.Name = r.routeSchema(node.Name)
+		case *ast.AlterDatabaseStmt:
+			node.Name = r.routeSchema(node.Name)
+		default:
+			stmt.Accept(&routeVisitor{router: r, schema: schema, visited: make(map[*ast.TableName]struct{})})
+		}
+		restored, err := restoreNode(stmt)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		sb.WriteString(restored)
+		sb.WriteString(";")
+	}
+	return sb.String(), nil
+}
+
+// routeStmt renames the databases and tables in a statement without the trailing semicolon, a nil tableRouter
+// returns the statement as it is.
+func (r *tableRouter) routeStmt(schema, stmt string) (string, error) {
+	if r == nil {
+		return stmt, nil
+	}
+	routed, err := r.routeDDL(schema, stmt)
+	if err != nil {
+		return "", errors.Annotatef(err, "route %s", stmt)
+	}
+	return strings.TrimSuffix(routed, ";"), nil
+}
+
+// renameCreateDatabase returns the CREATE DATABASE statement with the database renamed to schema.
+func renameCreateDatabase(stmt, schema string) (string, error) {
+	node, err := parser.New().ParseOneStmt(stmt, "", "")
+	if err != nil {
+		return "", errors.Annotatef(err, "parse %s", stmt)
+	}
+	createDB, ok := node.(*ast.CreateDatabaseStmt)
+	if !ok {
+		return "", errors.Errorf("%s is not CREATE DATABASE", stmt)
+	}
+	createDB.Name = schema
+	return restoreNode(createDB)
+}
+
+// routeVisitor renames the tables in a statement.
+type routeVisitor struct {
+	router *tableRouter
+	schema string
+	// visited is the renamed tables, a table may be visited twice, like the old table of RENAME TABLE
+	visited map[*ast.TableName]struct{}
+}
+
+func (v *routeVisitor) Enter(in ast.Node) (ast.Node, bool) {
+	tn, ok := in.(*ast.TableName)
+	if !ok {
+		return in, false
+	}
+	if _, ok := v.visited[tn]; ok {
+		return in, true
+	}
+	v.visited[tn] = struct{}{}
+
+	schema := tn.Schema.O
+	if len(schema) == 0 {
+		schema = v.schema
+	}
+	targetSchema, targetTable := v.router.route(schema, tn.Name.O)
+	if targetSchema != schema || targetTable != tn.Name.O {
+		tn.Schema = model.NewCIStr(targetSchema)
+		tn.Name = model.NewCIStr(targetTable)
+	}
+	return in, true
+}
+
+func (v *routeVisitor) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
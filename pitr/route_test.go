@@ -0,0 +1,107 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestTableRouter(t *testing.T) {
+	r, err := newTableRouter(nil)
+	assert.NilError(t, err)
+	assert.Assert(t, r == nil)
+	schema, table := r.route("db", "t")
+	assert.Equal(t, schema+"."+table, "db.t")
+
+	r, err = newTableRouter([]*RouteRule{
+		{SchemaPattern: "db", TargetSchema: "db_restore"},
+		{SchemaPattern: "shard_*", TablePattern: "orders_?", TargetSchema: "shard", TargetTable: "orders"},
+		{SchemaPattern: "DB", TablePattern: "log*", TargetSchema: "log_restore"},
+	})
+	assert.NilError(t, err)
+	for _, c := range []struct {
+		schema, table, expected string
+	}{
+		{"db", "t", "db_restore.t"},
+		{"db", "Log_1", "log_restore.Log_1"},
+		{"shard_1", "orders_2", "shard.orders"},
+		{"shard_1", "orders_12", "shard_1.orders_12"},
+		{"other", "t", "other.t"},
+	} {
+		schema, table := r.route(c.schema, c.table)
+		assert.Equal(t, schema+"."+table, c.expected)
+	}
+
+	ddl, err := r.routeDDL("", "use `db`; create table t (id int primary key)")
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(ddl, "db_restore"), 2)
+	assert.Assert(t, strings.Contains(ddl, "`db_restore`.`t`"), ddl)
+
+	ddl, err = r.routeDDL("", "rename table shard_1.orders_1 to shard_1.orders_xy")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(ddl, "`shard`.`orders` TO `shard_1`.`orders_xy`"), ddl)
+
+	ddl, err = r.routeDDL("", "create database db")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(ddl, "`db_restore`"), ddl)
+
+	ddl, err = r.routeDDL("other", "truncate table t")
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(ddl, "other"), ddl)
+
+	binlog := genRowBinlog(pb.EventType_Insert, 1, 10, 100)
+	binlog.DmlData.Events[0].SchemaName = &schema
+	assert.NilError(t, r.routeBinlog(binlog))
+	assert.Equal(t, binlog.DmlData.Events[0].GetSchemaName(), "db_restore")
+	assert.Equal(t, binlog.DmlData.Events[0].GetTableName(), "t1")
+	// the source name is not changed
+	assert.Equal(t, schema, "db")
+
+	for _, rules := range [][]*RouteRule{
+		{{SchemaPattern: "db"}},
+		{{SchemaPattern: "db", TargetSchema: "db2", TargetTable: "t"}},
+		{{SchemaPattern: "db[", TargetSchema: "db2"}},
+	} {
+		_, err := newTableRouter(rules)
+		assert.Assert(t, err != nil)
+	}
+}
+
+func TestRouteSQLOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	ddl, err := NewDDLHandle()
+	assert.NilError(t, err)
+	ddlHandle = ddl
+	assert.NilError(t, ddl.ExecuteDDL("", "create database test"))
+	assert.NilError(t, ddl.ExecuteDDL("", "use test; create table t1 (id int primary key, v int)"))
+
+	r, err := newTableRouter([]*RouteRule{{SchemaPattern: "test", TablePattern: "t1", TargetSchema: "test_restore", TargetTable: "t"}})
+	assert.NilError(t, err)
+
+	// the table info of the routed rows is got by the source name
+	w, err := newSQLWriter(runOptions{router: r}, filepath.Join(dir, "t.sql"), "")
+	assert.NilError(t, err)
+	for _, binlog := range []*pb.Binlog{
+		genRowBinlog(pb.EventType_Insert, 1, 10, 100),
+		genRowBinlog(pb.EventType_Update, 1, 10, 200),
+		genRowBinlog(pb.EventType_Delete, 1, 11, 300),
+	} {
+		assert.NilError(t, r.routeBinlog(binlog))
+		assert.NilError(t, w.Write(binlog))
+	}
+	assert.NilError(t, w.Close())
+	data, err := ioutil.ReadFile(filepath.Join(dir, "t.sql"))
+	assert.NilError(t, err)
+	sql := string(data)
+	assert.Equal(t, strings.Count(sql, "`test_restore`.`t`"), 3, sql)
+	assert.Assert(t, strings.Contains(sql, "WHERE `id` = 1"), sql)
+	assert.Assert(t, !strings.Contains(sql, "t1"), sql)
+}
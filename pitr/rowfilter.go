@@ -0,0 +1,317 @@
+package pitr
+
+import (
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/opcode"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// rowValues is the values of a row, the key is the column name in lower case.
+type rowValues map[string]types.Datum
+
+// rowPredicate returns true if the row matches the expression.
+type rowPredicate func(row rowValues) (bool, error)
+
+// rowValuer returns the value of the expression for the row.
+type rowValuer func(row rowValues) (types.Datum, error)
+
+// rowFilter filters the rows by the expression of their tables, the rows of tables without expression are kept.
+type rowFilter struct {
+	// rules is the predicate of every table, the key is `schema`.`table` in lower case
+	rules map[string]rowPredicate
+	sc    *stmtctx.StatementContext
+}
+
+// parseRowFilter parses the rules like `db.orders: tenant_id = 42; db.users: tenant_id IN (42, 43)`,
+// the expression supports =, !=, <>, <, <=, >, >=, IN, BETWEEN, IS [NOT] NULL, AND, OR, NOT and parentheses.
+// it returns nil if s is empty.
+func parseRowFilter(s string) (*rowFilter, error) {
+	f := &rowFilter{
+		rules: make(map[string]rowPredicate),
+		sc:    &stmtctx.StatementContext{},
+	}
+	p := parser.New()
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid row filter %s, should be like db.table: expression", item)
+		}
+		names := strings.SplitN(strings.TrimSpace(parts[0]), ".", 2)
+		if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 {
+			return nil, errors.Errorf("invalid table %s in row filter, should be like db.table", parts[0])
+		}
+		key := quoteSchema(strings.ToLower(names[0]), strings.ToLower(names[1]))
+		if _, ok := f.rules[key]; ok {
+			return nil, errors.Errorf("duplicate row filter of table %s", key)
+		}
+
+		stmt, err := p.ParseOneStmt("SELECT * FROM t WHERE "+parts[1], "", "")
+		if err != nil {
+			return nil, errors.Annotatef(err, "parse row filter of table %s", key)
+		}
+		where := stmt.(*ast.SelectStmt).Where
+		pred, err := f.compile(where)
+		if err != nil {
+			return nil, errors.Annotatef(err, "row filter of table %s", key)
+		}
+		f.rules[key] = pred
+	}
+
+	if len(f.rules) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// match returns true if the row of Insert or Delete event should be kept, Update event should be split
+// by rewriteDML first. a nil rowFilter keeps all the rows.
+func (f *rowFilter) match(ev *pb.Event) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	pred, ok := f.rules[quoteSchema(strings.ToLower(ev.GetSchemaName()), strings.ToLower(ev.GetTableName()))]
+	if !ok {
+		return true, nil
+	}
+
+	row, err := decodeRow(ev.GetRow())
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	matched, err := pred(row)
+	return matched, errors.Annotatef(err, "evaluate row filter of table %s", quoteSchema(ev.GetSchemaName(), ev.GetTableName()))
+}
+
+// decodeRow decodes the columns of a row image.
+func decodeRow(cols [][]byte) (rowValues, error) {
+	row := make(rowValues, len(cols))
+	for _, c := range cols {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+		_, val, err := codec.DecodeOne(col.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row[strings.ToLower(col.Name)] = formatValue(val, col.Tp[0])
+	}
+	return row, nil
+}
+
+// compile converts the boolean expression to rowPredicate, the comparison with NULL is false.
+func (f *rowFilter) compile(expr ast.ExprNode) (rowPredicate, error) {
+	switch e := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return f.compile(e.Expr)
+	case *ast.UnaryOperationExpr:
+		if e.Op != opcode.Not {
+			break
+		}
+		pred, err := f.compile(e.V)
+		if err != nil {
+			return nil, err
+		}
+		return func(row rowValues) (bool, error) {
+			matched, err := pred(row)
+			return !matched, err
+		}, nil
+	case *ast.BinaryOperationExpr:
+		switch e.Op {
+		case opcode.LogicAnd, opcode.LogicOr:
+			left, err := f.compile(e.L)
+			if err != nil {
+				return nil, err
+			}
+			right, err := f.compile(e.R)
+			if err != nil {
+				return nil, err
+			}
+			isAnd := e.Op == opcode.LogicAnd
+			return func(row rowValues) (bool, error) {
+				matched, err := left(row)
+				if err != nil || matched != isAnd {
+					return matched, err
+				}
+				return right(row)
+			}, nil
+		case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE:
+			left, err := f.compileValue(e.L)
+			if err != nil {
+				return nil, err
+			}
+			right, err := f.compileValue(e.R)
+			if err != nil {
+				return nil, err
+			}
+			op := e.Op
+			return func(row rowValues) (bool, error) {
+				cmp, isNull, err := f.compare(row, left, right)
+				if err != nil || isNull {
+					return false, err
+				}
+				switch op {
+				case opcode.EQ:
+					return cmp == 0, nil
+				case opcode.NE:
+					return cmp != 0, nil
+				case opcode.LT:
+					return cmp < 0, nil
+				case opcode.LE:
+					return cmp <= 0, nil
+				case opcode.GT:
+					return cmp > 0, nil
+				default:
+					return cmp >= 0, nil
+				}
+			}, nil
+		}
+	case *ast.PatternInExpr:
+		if e.Sel != nil {
+			break
+		}
+		value, err := f.compileValue(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]rowValuer, 0, len(e.List))
+		for _, item := range e.List {
+			v, err := f.compileValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		not := e.Not
+		return func(row rowValues) (bool, error) {
+			for _, item := range list {
+				cmp, isNull, err := f.compare(row, value, item)
+				if err != nil || isNull {
+					return false, err
+				}
+				if cmp == 0 {
+					return !not, nil
+				}
+			}
+			return not, nil
+		}, nil
+	case *ast.BetweenExpr:
+		value, err := f.compileValue(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		left, err := f.compileValue(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := f.compileValue(e.Right)
+		if err != nil {
+			return nil, err
+		}
+		not := e.Not
+		return func(row rowValues) (bool, error) {
+			cmp, isNull, err := f.compare(row, value, left)
+			if err != nil || isNull {
+				return false, err
+			}
+			if cmp < 0 {
+				return not, nil
+			}
+			cmp, isNull, err = f.compare(row, value, right)
+			if err != nil || isNull {
+				return false, err
+			}
+			return (cmp <= 0) != not, nil
+		}, nil
+	case *ast.IsNullExpr:
+		value, err := f.compileValue(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		not := e.Not
+		return func(row rowValues) (bool, error) {
+			v, err := value(row)
+			if err != nil {
+				return false, err
+			}
+			return v.IsNull() != not, nil
+		}, nil
+	}
+
+	return nil, errors.Errorf("unsupported expression %T in row filter", expr)
+}
+
+// compileValue converts the column or constant to rowValuer.
+func (f *rowFilter) compileValue(expr ast.ExprNode) (rowValuer, error) {
+	switch e := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return f.compileValue(e.Expr)
+	case *ast.ColumnNameExpr:
+		name := e.Name.Name.L
+		return func(row rowValues) (types.Datum, error) {
+			v, ok := row[name]
+			if !ok {
+				return types.Datum{}, errors.Errorf("column %s not found", name)
+			}
+			return v, nil
+		}, nil
+	case ast.ValueExpr:
+		v := types.NewDatum(e.GetValue())
+		return func(rowValues) (types.Datum, error) {
+			return v, nil
+		}, nil
+	case *ast.UnaryOperationExpr:
+		// negative number, like -1
+		if value, ok := e.V.(ast.ValueExpr); ok && e.Op == opcode.Minus {
+			var v types.Datum
+			switch x := value.GetValue().(type) {
+			case int64:
+				v = types.NewIntDatum(-x)
+			case float64:
+				v = types.NewFloat64Datum(-x)
+			case *types.MyDecimal:
+				d := new(types.MyDecimal)
+				if err := types.DecimalSub(new(types.MyDecimal), x, d); err != nil {
+					return nil, errors.Trace(err)
+				}
+				v = types.NewDecimalDatum(d)
+			default:
+				return nil, errors.Errorf("unsupported negative value %v in row filter", x)
+			}
+			return func(rowValues) (types.Datum, error) {
+				return v, nil
+			}, nil
+		}
+	}
+
+	return nil, errors.Errorf("unsupported expression %T in row filter, only column and constant can be compared", expr)
+}
+
+// compare compares the values of left and right, isNull is true if any of them is NULL.
+func (f *rowFilter) compare(row rowValues, left, right rowValuer) (cmp int, isNull bool, err error) {
+	l, err := left(row)
+	if err != nil {
+		return 0, false, err
+	}
+	r, err := right(row)
+	if err != nil {
+		return 0, false, err
+	}
+	if l.IsNull() || r.IsNull() {
+		return 0, true, nil
+	}
+	cmp, err = l.CompareDatum(f.sc, &r)
+	return cmp, false, errors.Trace(err)
+}
@@ -0,0 +1,99 @@
+package pitr
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+func genRowFilterEvent(t *testing.T, schema, table string, tenantID int64, name interface{}) *pb.Event {
+	nameValue, err := codec.EncodeValue(&stmtctx.StatementContext{}, nil, types.NewDatum(name))
+	assert.Assert(t, err == nil)
+	cols := []*pb.Column{
+		{Name: "tenant_id", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(tenantID)},
+		{Name: "Name", Tp: []byte{mysql.TypeVarchar}, MysqlType: "varchar", Value: nameValue},
+	}
+
+	var row [][]byte
+	for _, col := range cols {
+		data, err := col.Marshal()
+		assert.Assert(t, err == nil)
+		row = append(row, data)
+	}
+	return &pb.Event{SchemaName: &schema, TableName: &table, Tp: pb.EventType_Insert, Row: row}
+}
+
+func TestParseRowFilter(t *testing.T) {
+	f, err := parseRowFilter(" ; ")
+	assert.Assert(t, err == nil)
+	assert.Assert(t, f == nil)
+
+	f, err = parseRowFilter("db.t1: tenant_id = 42; DB.T2: name IS NOT NULL")
+	assert.Assert(t, err == nil)
+	assert.Equal(t, len(f.rules), 2)
+
+	for _, s := range []string{
+		"db.t1 tenant_id = 42",
+		"db: tenant_id = 42",
+		"db.t1: tenant_id = ",
+		"db.t1: tenant_id = 1; db.t1: tenant_id = 2",
+		"db.t1: tenant_id LIKE 'a%'",
+		"db.t1: tenant_id + 1 = 2",
+		"db.t1: tenant_id IN (SELECT 1)",
+	} {
+		_, err = parseRowFilter(s)
+		assert.Assert(t, err != nil, s)
+	}
+}
+
+func TestRowFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr     string
+		tenantID int64
+		name     interface{}
+		matched  bool
+	}{
+		{"tenant_id = 42", 42, "a", true},
+		{"tenant_id = 42", 43, "a", false},
+		{"tenant_id != 42 AND name = 'a'", 43, "a", true},
+		{"tenant_id < -1 OR name >= 'b'", -2, "a", true},
+		{"NOT (tenant_id <= 42)", 42, "a", false},
+		{"tenant_id > 1.5", 2, "a", true},
+		{"tenant_id IN (1, 2, 3)", 2, "a", true},
+		{"tenant_id NOT IN (1, 2, 3)", 2, "a", false},
+		{"tenant_id BETWEEN 10 AND 20", 20, "a", true},
+		{"tenant_id NOT BETWEEN 10 AND 20", 9, "a", true},
+		{"NAME IS NULL", 1, nil, true},
+		{"name = 'a'", 1, nil, false},
+		{"name != 'a'", 1, nil, false},
+	}
+	for _, tt := range tests {
+		f, err := parseRowFilter("test.t1: " + tt.expr)
+		assert.Assert(t, err == nil, tt.expr)
+		matched, err := f.match(genRowFilterEvent(t, "test", "t1", tt.tenantID, tt.name))
+		assert.Assert(t, err == nil, tt.expr)
+		assert.Equal(t, matched, tt.matched, tt.expr)
+	}
+
+	f, err := parseRowFilter("test.t1: tenant_id = 42")
+	assert.Assert(t, err == nil)
+	// the rows of other tables are kept
+	matched, err := f.match(genRowFilterEvent(t, "test", "t2", 1, "a"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, matched)
+
+	var nilFilter *rowFilter
+	matched, err = nilFilter.match(genRowFilterEvent(t, "test", "t1", 1, "a"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, matched)
+
+	f, err = parseRowFilter("test.t1: unknown = 1")
+	assert.Assert(t, err == nil)
+	_, err = f.match(genRowFilterEvent(t, "test", "t1", 1, "a"))
+	assert.ErrorContains(t, err, "column unknown not found")
+}
@@ -0,0 +1,318 @@
+package pitr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	s3DefaultRegion  = "us-east-1"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3SignAlgorithm  = "AWS4-HMAC-SHA256"
+	s3ListMaxKeysNum = "1000"
+)
+
+// s3Storage reads binlog files from S3-compatible object storage, like AWS S3, MinIO and GCS.
+type s3Storage struct {
+	bucket string
+	prefix string
+
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+
+	// rawQuery is the query of storage uri, used to generate full path of files
+	rawQuery string
+
+	client *http.Client
+}
+
+var _ Storage = &s3Storage{}
+
+// newS3Storage creates a s3Storage from uri like `s3://bucket/prefix?endpoint=xxx&region=xxx`,
+// access key and secret key can be set by `access-key` and `secret-access-key` in the query,
+// or by the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	if len(u.Host) == 0 {
+		return nil, errors.New("bucket is empty in s3 storage uri")
+	}
+
+	query := u.Query()
+	s := &s3Storage{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		endpoint:  strings.TrimRight(query.Get("endpoint"), "/"),
+		region:    query.Get("region"),
+		accessKey: query.Get("access-key"),
+		secretKey: query.Get("secret-access-key"),
+		rawQuery:  u.RawQuery,
+		client:    &http.Client{},
+	}
+
+	if len(s.region) == 0 {
+		s.region = s3DefaultRegion
+	}
+	if len(s.endpoint) == 0 {
+		s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	if len(s.accessKey) == 0 {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(s.secretKey) == 0 {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return s, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *s3Storage) ReadBinlogNames() ([]string, error) {
+	prefix := s.prefix
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	var names []string
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("max-keys", s3ListMaxKeysNum)
+		query.Set("prefix", prefix)
+		if len(token) != 0 {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "decode list objects result of bucket %s", s.bucket)
+		}
+
+		for _, content := range result.Contents {
+			names = append(names, strings.TrimPrefix(content.Key, prefix))
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	names = filterBinlogNames(names)
+	if len(names) == 0 {
+		return nil, errors.Errorf("no binlog file found in s3://%s/%s", s.bucket, s.prefix)
+	}
+
+	return names, nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(http.MethodGet, path.Join(s.prefix, name), nil)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *s3Storage) FullPath(name string) string {
+	u := url.URL{
+		Scheme:   "s3",
+		Host:     s.bucket,
+		Path:     "/" + path.Join(s.prefix, name),
+		RawQuery: s.rawQuery,
+	}
+	return u.String()
+}
+
+// do sends a request without body to the object storage, the url is in path-style, like `endpoint/bucket/key`.
+// caller should close the response's body if error is nil.
+func (s *s3Storage) do(method, key string, query url.Values) (*http.Response, error) {
+	return s.doWithBody(context.Background(), method, key, query, nil, 0)
+}
+
+// doWithBody sends a request with size bytes of body, the body is not signed like the requests without body.
+// A response not in 2xx is returned as *s3RequestError.
+func (s *s3Storage) doWithBody(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	canonicalURI := "/" + s3EscapePath(s.bucket)
+	if len(key) != 0 {
+		canonicalURI += "/" + s3EscapePath(key)
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+
+	reqURL := s.endpoint + canonicalURI
+	if len(canonicalQuery) != 0 {
+		reqURL += "?" + canonicalQuery
+	}
+	// http.NoBody has the content length 0, instead of an unknown length sent in chunks
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, canonicalURI, canonicalQuery, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "request %s %s", method, canonicalURI)
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.Trace(&s3RequestError{method: method, uri: canonicalURI, status: resp.Status, statusCode: resp.StatusCode, message: string(message)})
+	}
+
+	return resp, nil
+}
+
+// s3RequestError is the error of a request responded with the status not in 2xx.
+type s3RequestError struct {
+	method     string
+	uri        string
+	status     string
+	statusCode int
+	message    string
+}
+
+func (e *s3RequestError) Error() string {
+	return fmt.Sprintf("request %s %s failed, status: %s, message: %s", e.method, e.uri, e.status, e.message)
+}
+
+// sign signs the request with AWS Signature Version 4, requests are anonymous if no access key is given.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3Storage) sign(req *http.Request, canonicalURI, canonicalQuery string, now time.Time) {
+	if len(s.accessKey) == 0 || len(s.secretKey) == 0 {
+		return
+	}
+
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format(s3DateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedBody)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedBody,
+		"x-amz-date":           amzDate,
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedBody,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,235 @@
+package pitr
+
+// sampleConfig is printed by --print-sample-config, the values are the defaults except data-dir.
+const sampleConfig = `# PITR configuration file, the options set by command line flags override the values here.
+
+# log level: debug, info, warn, error, fatal
+log-level = "info"
+# log file path, empty means stderr
+log-file = ""
+# format of logs, text or json
+log-format = "text"
+# log-file is rotated when it's larger than log-max-size MB, the rotated files are kept by log-max-days and
+# log-max-backups, 0 means keeping all
+log-max-size = 300
+log-max-days = 0
+log-max-backups = 0
+# number of the repetitive logs printed for every message, the later ones are only counted, 0 means printing all
+log-sample-limit = 10
+# id added to every log line, a new id is generated if it's empty
+run-id = ""
+
+######## source ########
+
+# drainer data directory path, can be a comma separated list of directories or glob patterns
+data-dir = "data.drainer"
+# uri of the storage which saves drainer's binlog files, used instead of data-dir
+# storage = "s3://bucket/prefix?endpoint=http://127.0.0.1:9000"
+# format of the binlog files in data-dir, drainer, pump, ticdc or mysql
+input-format = "drainer"
+# read the binlogs from the topic of drainer's kafka sink instead of data-dir
+# kafka-addrs = "127.0.0.1:9092"
+# kafka-topic = "6789_obinlog"
+kafka-version = "0.8.2.0"
+# how to handle the missing binlog files, abort or warn
+on-file-gap = "abort"
+# how to handle a damaged binlog file, abort, skip-tail or skip-file
+relax-corruption = "abort"
+
+######## range ########
+
+# the range of binlogs to merge in datetime, empty means from the first binlog or never end
+start-datetime = ""
+stop-datetime = ""
+# time zone of start-datetime and stop-datetime, empty means the local time zone
+timezone = ""
+# the range in pd-server tso format, used if the datetimes are empty
+start-tso = 0
+stop-tso = 0
+# the earlier stop points before stop-tso, the output at every one is written to the dir stop-{tso} in output dir
+stop-tsos = []
+
+######## schema ########
+
+# a comma separated list of PD endpoints to fetch the history DDL jobs
+pd-urls = ""
+pd-max-retry = 3
+pd-timeout = 60
+# TTL in seconds of the service GC safepoint registered in PD during the run, 0 means not registering
+gc-ttl = 300
+# the TLS certs to connect PD and TiKV of a secured cluster, pd-urls use https if pd-ssl-ca is set
+pd-ssl-ca = ""
+pd-ssl-cert = ""
+pd-ssl-key = ""
+# file to cache the history DDL jobs fetched from PD
+history-ddl-cache = ""
+# history DDL jobs in JSON or DDL statements in a .sql file, used instead of PD
+history-ddl-file = ""
+# source of the history DDL jobs, pd, tidb or file, empty means inferring it from history-ddl-file, tidb-status-addr and pd-urls
+ddl-source = ""
+# status address of TiDB to fetch the history DDL jobs by ddl-source tidb, like 127.0.0.1:10080
+tidb-status-addr = ""
+# address of HTTP server which exposes the runtime profiles by /debug/pprof
+pprof-addr = ""
+# DDL statements of the base schema like the output of mysqldump --no-data
+schema-file = ""
+# how to handle the history DDLs failed to execute, abort, skip or quarantine
+on-ddl-error = "abort"
+
+######## filters ########
+
+# comma separated list of tables to restore, e.g. db1.t1,db2.*
+tables = ""
+# TOML file of the table rules below, they are added to the rules here
+filter-rules-file = ""
+# only print the tables matched by every table rule
+check-filter = false
+# semicolon separated list of row filters, e.g. db.orders: tenant_id = 42
+row-filter = ""
+# semicolon separated list of partitions to restore, e.g. db.orders: p2023, p2024
+partitions = ""
+# YAML file of the rules masking the columns in the merged binlogs, e.g. hash db.users.email
+mask-rules-file = ""
+# Go plugin exporting NewEventHook, which is called with every DDL and merged row in Reduce, and the config passed to it
+event-hook-plugin = ""
+event-hook-config = ""
+
+# replicate-do-db = ["db1"]
+# replicate-ignore-db = ["db2"]
+
+# [[replicate-do-table]]
+# db-name = "db1"
+# tbl-name = "t1"
+
+# [[replicate-ignore-table]]
+# db-name = "db1"
+# tbl-name = "log"
+
+# rename the schemas and tables in the merged binlogs, the rules with table-pattern are matched first
+# [[route-rules]]
+# schema-pattern = "db1"
+# target-schema = "db1_restore"
+
+# [[route-rules]]
+# schema-pattern = "db2"
+# table-pattern = "orders_*"
+# target-schema = "db2_restore"
+# target-table = "orders"
+
+# the unique index identifying the rows of the matched tables instead of the primary key
+# [[merge-keys]]
+# schema-pattern = "db1"
+# table-pattern = "orders_*"
+# index = "uk_order"
+
+######## merge ########
+
+# number of workers used to split binlog files
+concurrency = 4
+# max number of tables reduced at the same time, the largest tables are reduced first
+reduce-concurrency = 16
+temp-dir = "./temp"
+reserve-tmpdir = false
+# how Map saves the split events in temp-dir, file or kv
+temp-store = "file"
+# max size of the temp files like 100GiB, empty means no limit
+temp-quota = ""
+# max memory of the events in Reduce like 4GiB, empty means no limit
+max-memory = ""
+# how to merge the tables without primary key or unique key, rowid, append-only or error
+no-pk-policy = "rowid"
+# compare the string values of the keys by the collations of their columns, the same as new_collations_enabled_on_first_bootstrap of the source cluster
+new-collations-enabled = false
+# keep the transactions of every table instead of merging the rows across transactions
+preserve-txn = false
+# drop the DDLs from the output, for the downstream whose schema is already at stop-tso
+skip-ddl = false
+# how to merge the tables renamed in the window, merge or split
+rename-policy = "merge"
+# merged output of a previous run, only the binlogs after it are merged
+base-dir = ""
+# storage of a BR full backup, only the binlogs after its backup ts are applied to the restored dest-db
+br-backup = ""
+# restore br-backup by br before applying, br-pd is the PD addresses of the dest cluster
+br-restore = false
+br-path = "br"
+br-pd = ""
+resume = false
+# take over the locks of temp-dir and output dir held by another run, only if it's not running
+force-unlock = false
+# how to handle the temp dir left by a crashed run, abort, resume or clean
+on-leftover-temp = "abort"
+force = false
+dry-run = false
+flashback = false
+# only write the DDLs of the selected tables in the range to ddl.sql in output dir
+schema-only = false
+verify = false
+
+######## output ########
+
+# format of the merged binlog files, pb, sql, jsonl or csv
+output-format = "pb"
+# also write the csv files and schema in the layout of TiDB Lightning to output dir/lightning
+lightning = false
+# size to rotate the output files of every table like 512MiB
+output-file-size = ""
+# how the output files are synced before renamed from .tmp, none, file or dir
+sync-mode = "file"
+# s3 uri to upload the output dir to after it's written, the failed upload is resumed by the upload subcommand
+output-storage = ""
+# max number of files or parts uploaded to output-storage at the same time
+upload-concurrency = 4
+# max size uploaded to output-storage per second like 50MiB, empty means no limit
+upload-rate-limit = ""
+# max size of a binlog read from or written to the binlog files, the merged DML binlogs larger than it are split by rows, 0 means no limit
+max-event-size = "1GiB"
+# how to handle a binlog or a merged row larger than max-event-size, abort or skip
+on-oversized-event = "abort"
+# split the output into the slice dirs of consecutive time windows like 1h, every slice is replayable after the previous ones
+slice-interval = ""
+# codec to compress the merged binlog files: none, gzip, zstd or lz4
+compress = "none"
+# file of the AES key in hex to encrypt the output files
+encrypt-key-file = ""
+encrypt-temp = false
+# file to write the JSON report of the run
+report-file = ""
+# format of the error when the run fails, text or json, json also prints the exit code and class to stderr
+error-format = "text"
+# file to write the savepoint of drainer with the commit ts of the last merged binlog
+savepoint-file = ""
+# address of HTTP server which exposes the progress and metrics
+status-addr = ""
+
+######## sinks ########
+
+# type of destination, file, mysql, kafka or grpc
+dest-type = "file"
+# address of the gRPC server streaming the merged binlogs to a subscriber when dest-type is grpc
+dest-grpc-addr = ""
+# write and execute the idempotent DML statements in sql files and dest-db like drainer's safe mode
+safe-mode = false
+# how to replay the tables with foreign keys, disable-checks or ordered, empty means no special handling
+foreign-key-mode = ""
+# probe the rows to insert in dest-db before applying, error or safe-mode, empty means no check
+conflict-check = ""
+# max number of statements and size of statements executed in dest-db per second, 0 and empty mean no limit
+apply-qps = 0
+apply-bytes-per-sec = ""
+
+[dest-db]
+dsn = ""
+batch-size = 100
+max-retry = 3
+# number of connections executing DMLs, the DMLs of a table are executed by one of them
+worker-count = 1
+
+[dest-kafka]
+addrs = ""
+topic = ""
+version = "0.8.2.0"
+# format of messages, open-binlog or canal-json
+protocol = "open-binlog"
+max-message-bytes = 1073741824
+`
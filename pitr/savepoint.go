@@ -0,0 +1,43 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// savepointContent is the savepoint file of drainer's file checkpoint, drainer continues from the binlog
+// after commitTS if the file is in its data-dir.
+func savepointContent(commitTS int64) string {
+	return fmt.Sprintf("consistent = true\ncommitTS = %d\n", commitTS)
+}
+
+// writeSavepoint writes the savepoint of commitTS to a temp file and renames it, so drainer never reads
+// a broken savepoint.
+func writeSavepoint(file string, commitTS int64) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(savepointContent(commitTS)), 0600); err != nil {
+		return errors.Annotatef(err, "write savepoint %s", tmp)
+	}
+	return errors.Trace(os.Rename(tmp, file))
+}
+
+// saveSavepoint writes the commit ts of the last binlog read by Map to savepoint-file, all the binlogs
+// not after it are in the output, so the replication continued from it has no gap or duplicate.
+func (r *PITR) saveSavepoint(merge *Merge) error {
+	commitTS := merge.cp.MapCommitTS
+	if commitTS == 0 {
+		log.Warn("no binlog is merged, the savepoint is not written", zap.String("file", r.cfg.SavepointFile))
+		return nil
+	}
+	if err := writeSavepoint(r.cfg.SavepointFile, commitTS); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("savepoint is written, continue the replication by drainer's initial-commit-ts or TiCDC's start-ts from it",
+		zap.String("file", r.cfg.SavepointFile), zap.String("commit ts", formatTSO(commitTS)))
+	return nil
+}
@@ -0,0 +1,37 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWriteSavepoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "savepoint")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "savepoint")
+	assert.NilError(t, writeSavepoint(file, 417000000000000000))
+	data, err := ioutil.ReadFile(file)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "consistent = true\ncommitTS = 417000000000000000\n")
+
+	// the savepoint is replaced
+	assert.NilError(t, writeSavepoint(file, 417000000000000001))
+	data, err = ioutil.ReadFile(file)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "consistent = true\ncommitTS = 417000000000000001\n")
+	_, err = os.Stat(file + ".tmp")
+	assert.Assert(t, os.IsNotExist(err))
+
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.SavepointFile = file
+	assert.NilError(t, cfg.validate())
+	cfg.DryRun = true
+	assert.ErrorContains(t, cfg.validate(), "savepoint-file can't be used with flashback or dry-run")
+}
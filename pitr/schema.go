@@ -0,0 +1,122 @@
+package pitr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const schemaFileName = "schema.sql"
+
+// dumpSchema writes the CREATE DATABASE and CREATE TABLE statements of all the databases
+// tracked by the DDLs to w, the databases and tables skipped by f are not written. They are
+// renamed by router, and a target database of several databases is only created once.
+func (d *DDLHandle) dumpSchema(w io.Writer, f *tableFilter, router *tableRouter) error {
+	schemas, err := d.getAllDatabaseNames()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sort.Strings(schemas)
+
+	created := make(map[string]struct{})
+	for _, schema := range schemas {
+		if f.skip(schema, "") {
+			continue
+		}
+
+		target := router.routeSchema(schema)
+		if _, ok := created[target]; !ok {
+			createDB, err := d.tracker.showCreateDatabase(schema)
+			if err != nil {
+				return errors.Annotatef(err, "show create database %s", schema)
+			}
+			if target != schema {
+				if createDB, err = renameCreateDatabase(createDB, target); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s;\n", createDB); err != nil {
+				return errors.Trace(err)
+			}
+			created[target] = struct{}{}
+		}
+		if _, err := fmt.Fprintf(w, "USE %s;\n", quoteName(target)); err != nil {
+			return errors.Trace(err)
+		}
+
+		tables, err := d.tracker.tables(schema)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, table := range tables {
+			if f.skip(schema, table) {
+				continue
+			}
+
+			createTable, err := d.tracker.showCreateTable(schema, table)
+			if err != nil {
+				return errors.Annotatef(err, "show create table %s", quoteSchema(schema, table))
+			}
+			if createTable, err = router.routeStmt(schema, createTable); err != nil {
+				return errors.Trace(err)
+			}
+			// the table may be routed to another database by the rule of table
+			if tableTarget, _ := router.route(schema, table); tableTarget != target {
+				if _, ok := created[tableTarget]; !ok {
+					if _, err := fmt.Fprintf(w, "CREATE DATABASE IF NOT EXISTS %s;\n", quoteName(tableTarget)); err != nil {
+						return errors.Trace(err)
+					}
+					created[tableTarget] = struct{}{}
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s;\n", createTable); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// writeSchemaFile writes the final schema of the selected tables after all the DDLs are executed
+// to schema.sql in output dir, it can be used to create the schema in downstream before replaying DMLs.
+func (m *Merge) writeSchemaFile() (string, error) {
+	if m.resumed && len(m.cp.ReducedTables) != 0 {
+		log.Warn("the DDLs of tables reduced in the last run are not executed again, their schema may be out of date",
+			zap.Int("tables", len(m.cp.ReducedTables)))
+	}
+	return m.writeSchemaTo(m.outputDir)
+}
+
+// writeSchemaTo writes the schema of the selected tables in the schema tracker to schema.sql in dir.
+func (m *Merge) writeSchemaTo(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	name := filepath.Join(dir, schemaFileName)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	if err := ddlHandle.dumpSchema(f, m.filter, m.router); err != nil {
+		return "", errors.Annotatef(err, "write schema to %s", name)
+	}
+	if err := f.Sync(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	log.Info("schema file is written", zap.String("file", name))
+	return name, nil
+}
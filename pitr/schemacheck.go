@@ -0,0 +1,138 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// tableColumns is the column counts of a table's DML events, the value is the min commit ts of the count.
+type tableColumns map[int]int64
+
+// schemaTable is the name of a table, table is empty for a database.
+type schemaTable struct {
+	schema string
+	table  string
+}
+
+// schemaChecker collects the tables of DML events, and the first DDL changing them.
+type schemaChecker struct {
+	filter *tableFilter
+	// dmls is the column counts of every table
+	dmls map[schemaTable]tableColumns
+	// ddls is the min commit ts of DDLs of every table and database
+	ddls map[schemaTable]int64
+}
+
+func newSchemaChecker(f *tableFilter) *schemaChecker {
+	return &schemaChecker{
+		filter: f,
+		dmls:   make(map[schemaTable]tableColumns),
+		ddls:   make(map[schemaTable]int64),
+	}
+}
+
+func (c *schemaChecker) add(binlog *pb.Binlog) error {
+	switch binlog.Tp {
+	case pb.BinlogType_DML:
+		for _, event := range binlog.GetDmlData().GetEvents() {
+			if c.filter.skip(event.GetSchemaName(), event.GetTableName()) {
+				continue
+			}
+			key := schemaTable{schema: event.GetSchemaName(), table: event.GetTableName()}
+			cols, ok := c.dmls[key]
+			if !ok {
+				cols = make(tableColumns)
+				c.dmls[key] = cols
+			}
+			if ts, ok := cols[len(event.Row)]; !ok || binlog.CommitTs < ts {
+				cols[len(event.Row)] = binlog.CommitTs
+			}
+		}
+	case pb.BinlogType_DDL:
+		schema, table, err := parserSchemaTableFromDDL(string(binlog.DdlQuery))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		key := schemaTable{schema: schema, table: table}
+		if ts, ok := c.ddls[key]; !ok || binlog.CommitTs < ts {
+			c.ddls[key] = binlog.CommitTs
+		}
+	}
+	return nil
+}
+
+// check returns the problems of the tables, the DML events before any DDL of their tables should match the schema.
+func (c *schemaChecker) check(getInfo func(schema, table string) (*tableInfo, error)) ([]string, error) {
+	var problems []string
+	for key, cols := range c.dmls {
+		ddlTS, hasDDL := c.ddls[key]
+		if ts, ok := c.ddls[schemaTable{schema: key.schema}]; ok && (!hasDDL || ts < ddlTS) {
+			ddlTS, hasDDL = ts, true
+		}
+
+		var counts []int
+		for n, ts := range cols {
+			if !hasDDL || ts < ddlTS {
+				counts = append(counts, n)
+			}
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		sort.Ints(counts)
+
+		name := quoteSchema(key.schema, key.table)
+		info, err := getInfo(key.schema, key.table)
+		if errors.Cause(err) == ErrTableNotExist {
+			problems = append(problems, fmt.Sprintf("table %s doesn't exist", name))
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "get table info of %s", name)
+		}
+		for _, n := range counts {
+			if n != len(info.columns) {
+				problems = append(problems, fmt.Sprintf("table %s has %d columns, but the binlog at %s has %d columns",
+					name, len(info.columns), formatTSO(cols[n]), n))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkSchema checks that the tables of the DML binlogs in files exist in the schema loaded from
+// schema-file and have the same column counts, so the mismatches are reported before merging.
+// the tables are only checked until they are changed by DDLs in the binlogs.
+func (r *PITR) checkSchema(ctx context.Context, files []string) error {
+	checker := newSchemaChecker(r.filter)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := scanSourceBinlogFile(file, r.cfg.RelaxCorruption, r.opts, func(binlog *pb.Binlog, _ int64) error {
+			if !isAcceptableBinlog(binlog, r.cfg.StartTSO, r.cfg.StopTSO) {
+				return nil
+			}
+			return checker.add(binlog)
+		}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	problems, err := checker.check(ddlHandle.GetTableInfo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(problems) != 0 {
+		return errors.Errorf("schema-file %s doesn't match the binlogs:\n  %s", r.cfg.SchemaFile, strings.Join(problems, "\n  "))
+	}
+	log.Info("schema-file matches the binlogs", zap.String("file", r.cfg.SchemaFile), zap.Int("tables", len(checker.dmls)))
+	return nil
+}
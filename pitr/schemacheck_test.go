@@ -0,0 +1,39 @@
+package pitr
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSchemaChecker(t *testing.T) {
+	c := newSchemaChecker(newTableFilter(&Config{IgnoreDBs: []string{"ignore"}}))
+	// test.t1 has 2 columns in insert and delete events, and 1 column in update event
+	assert.NilError(t, c.add(genTestDML("test", "t1", 10)))
+	assert.NilError(t, c.add(genTestDML("test", "t2", 11)))
+	assert.NilError(t, c.add(genTestDML("test", "missing", 12)))
+	assert.NilError(t, c.add(genTestDML("ignore", "t1", 13)))
+	// the table is created in the binlogs
+	assert.NilError(t, c.add(genTestDDL("test", "created", "create table test.created (a int)", 14)))
+	assert.NilError(t, c.add(genTestDML("test", "created", 15)))
+	// the changes of the database are only checked before the DDL
+	assert.NilError(t, c.add(genTestDDL("other", "", "create database other", 16)))
+	assert.NilError(t, c.add(genTestDML("other", "t1", 17)))
+
+	infos := map[string]*tableInfo{
+		quoteSchema("test", "t1"): {columns: []string{"a", "b"}},
+		quoteSchema("test", "t2"): {columns: []string{"a"}},
+	}
+	problems, err := c.check(func(schema, table string) (*tableInfo, error) {
+		if info, ok := infos[quoteSchema(schema, table)]; ok {
+			return info, nil
+		}
+		return nil, ErrTableNotExist
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, problems, []string{
+		"table `test`.`missing` doesn't exist",
+		"table `test`.`t1` has 2 columns, but the binlog at " + formatTSO(10) + " has 1 columns",
+		"table `test`.`t2` has 1 columns, but the binlog at " + formatTSO(11) + " has 2 columns",
+	})
+}
@@ -0,0 +1,93 @@
+package pitr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const ddlFileName = "ddl"
+
+// schemaOnly reads the binlogs in [startTS, stop-tso], and writes the DDLs of the selected tables to ddl.sql in
+// output dir in the order of commit ts, the DMLs are skipped. The DDLs roll the schema at startTS forward to
+// stop-tso without touching the data.
+func (r *PITR) schemaOnly(ctx context.Context, sources [][]string, fileSize int64, startTS int64) (err error) {
+	if err = os.MkdirAll(defaultOutputDir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	fileName := filepath.Join(defaultOutputDir, ddlFileName+sqlFileSuffix+compressSuffix(r.cfg.Compress)+encryptSuffixOf(r.opts.cipher))
+	output, err := newSQLWriter(r.opts, fileName, r.cfg.Compress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			output.abort()
+			return
+		}
+		err = errors.Annotatef(output.Close(), "write ddl file %s", fileName)
+	}()
+
+	r.progress.start(phaseSchemaOnly, fileSize)
+	quit := make(chan struct{})
+	defer close(quit)
+	go r.progress.run(progressLogInterval, quit)
+	var readerCh chan *binlogFileReader
+	if len(sources) > 1 {
+		readerCh = readBinlogSources(sources, r.cfg.RelaxCorruption, r.opts, r.progress, quit, nil, nil)
+	} else {
+		readerCh = readBinlogFiles(sources[0], 1, r.cfg.RelaxCorruption, r.opts, r.progress, quit)
+	}
+
+	// the renamed tables are selected by their names before the window like Map
+	var renames renameTracker
+	var count int
+	for reader := range readerCh {
+		for binlog := range reader.binlogCh {
+			if err := ctx.Err(); err != nil {
+				return errors.Trace(err)
+			}
+			if binlog.Tp != pb.BinlogType_DDL || !isAcceptableBinlog(binlog, startTS, r.cfg.StopTSO) {
+				continue
+			}
+
+			ddl := string(binlog.GetDdlQuery())
+			schema, table, err := parserSchemaTableFromDDL(ddl)
+			if err != nil {
+				return errors.Annotatef(err, "parse DDL %s at %s", ddl, formatTSO(binlog.CommitTs))
+			}
+			tracked, err := renames.track(ddl)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(tracked) != 0 {
+				schema, table = tracked[0].new.Schema, tracked[0].new.Table
+			}
+			if r.filter.skipRenamed(schema, table, &renames) {
+				log.Debug("skip ddl by filter", zap.String("ddl", ddl))
+				r.report.skipTable(schema, table)
+				continue
+			}
+
+			r.report.addDDL(binlog.CommitTs, ddl)
+			if err := r.router.routeBinlog(binlog); err != nil {
+				return errors.Trace(err)
+			}
+			if err := output.Write(binlog); err != nil {
+				return errors.Annotatef(err, "write ddl file %s", fileName)
+			}
+			count++
+		}
+		if err := reader.err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	log.Info("schema only finished", zap.String("file", fileName), zap.Int("ddls", count))
+	return nil
+}
@@ -0,0 +1,58 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"gotest.tools/assert"
+)
+
+func TestSchemaOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-only")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	outputDir := defaultOutputDir
+	defaultOutputDir = filepath.Join(dir, "output")
+	defer func() {
+		defaultOutputDir = outputDir
+	}()
+
+	srcPath := filepath.Join(dir, "binlog")
+	b, err := OpenMyBinlogger(srcPath)
+	assert.NilError(t, err)
+	for _, binlog := range []*pb.Binlog{
+		genTestDDL("test", "t1", "create table test.t1 (a int primary key, b int, c int)", 101),
+		genTestDDL("test", "t2", "create table test.t2 (a int primary key)", 102),
+		genTestDML("test", "t1", 103),
+		genTestDDL("test", "t1", "alter table test.t1 add column d int", 104),
+		genTestDDL("test", "t1", "drop table test.t1", 106),
+	} {
+		data, err := binlog.Marshal()
+		assert.NilError(t, err)
+		b.WriteTail(&tb.Entity{Payload: data})
+	}
+	b.Close()
+
+	files, err := searchFiles(srcPath)
+	assert.NilError(t, err)
+	files, fileSize, err := filterFiles(files, 0, 105, runOptions{})
+	assert.NilError(t, err)
+
+	cfg := NewConfig()
+	cfg.StopTSO = 105
+	cfg.DoTables = []filter.TableName{{Schema: "test", Table: "t1"}}
+	r := &PITR{cfg: cfg, filter: newTableFilter(cfg), progress: newProgress()}
+	assert.NilError(t, r.schemaOnly(context.Background(), [][]string{files}, fileSize, 0))
+
+	// the DMLs, the DDLs of the other tables and the DDLs after stop-tso are skipped
+	data, err := ioutil.ReadFile(filepath.Join(defaultOutputDir, ddlFileName+sqlFileSuffix))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "create table test.t1 (a int primary key, b int, c int);\n"+
+		"alter table test.t1 add column d int;\n")
+}
@@ -0,0 +1,61 @@
+package pitr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/parser/model"
+	"go.uber.org/zap"
+)
+
+// schemaRevision is the revision of a table's schema in the output, it's the last DDL job changing the table.
+type schemaRevision struct {
+	SchemaVersion int64
+	DDLJobID      int64
+}
+
+// tableOutputKey returns the lower case output name of the table like db_table.
+func tableOutputKey(schema, table string) string {
+	return strings.ToLower(fmt.Sprintf("%s_%s", schema, table))
+}
+
+// schemaRevisions returns the schema version of the cluster and the revision of every table at stopTS by the
+// history DDL jobs sorted by schema version, 0 stopTS means all the jobs. The tables are keyed by tableOutputKey,
+// a renamed table has the revision of the DDL renaming it under its new name.
+func schemaRevisions(jobs []*model.Job, stopTS int64, sampler *sampledLogger) (int64, map[string]schemaRevision) {
+	var version int64
+	tables := make(map[string]schemaRevision)
+	// the jobs of creating databases have the names of the schema ids
+	dbs := make(map[int64]string)
+	for _, job := range jobs {
+		if skipJob(job) || job.BinlogInfo == nil {
+			continue
+		}
+		if stopTS != 0 && int64(job.BinlogInfo.FinishedTS) > stopTS {
+			continue
+		}
+		if job.BinlogInfo.SchemaVersion > version {
+			version = job.BinlogInfo.SchemaVersion
+		}
+		if info := job.BinlogInfo.DBInfo; info != nil {
+			dbs[job.SchemaID] = info.Name.O
+		}
+
+		schema, table, err := parserSchemaTableFromDDL(job.Query)
+		if err != nil {
+			sampler.warn("parse history ddl failed, its table has no schema revision", zap.String("ddl", job.Query), zap.Error(err))
+			continue
+		}
+		if info := job.BinlogInfo.TableInfo; info != nil {
+			table = info.Name.O
+		}
+		if len(schema) == 0 {
+			schema = dbs[job.SchemaID]
+		}
+		if len(schema) == 0 || len(table) == 0 {
+			continue
+		}
+		tables[tableOutputKey(schema, table)] = schemaRevision{SchemaVersion: job.BinlogInfo.SchemaVersion, DDLJobID: job.ID}
+	}
+	return version, tables
+}
@@ -0,0 +1,748 @@
+package pitr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+)
+
+const (
+	// defaultDatabase is the database which exists before any DDL, like a fresh TiDB.
+	defaultDatabase = "test"
+	// primaryKeyName is the name of primary key.
+	primaryKeyName = "PRIMARY"
+)
+
+var (
+	// errNoDatabaseSelected means the DDL doesn't specify the database of a table.
+	errNoDatabaseSelected = errors.New("no database selected")
+	// errDatabaseNotExist means the database not exist.
+	errDatabaseNotExist = errors.New("database not exist")
+)
+
+// schemaTracker tracks the schema of databases and tables in memory, every table is kept as its CREATE TABLE
+// statement parsed by pingcap/parser, and the DDLs are applied to the statement instead of being executed by
+// a local TiDB. the names are case insensitive like TiDB. the zero value is an empty tracker.
+type schemaTracker struct {
+	mu sync.RWMutex
+	// dbs is the databases by lower case name
+	dbs map[string]*trackedDB
+
+	// mergeKeys chooses the unique index identifying the rows of tables, nil means always using the primary key
+	mergeKeys []*MergeKey
+	// newCollation compares the string values of the key columns by the collations of the columns like TiDB with
+	// new_collations_enabled_on_first_bootstrap, otherwise byte-wise like the old collation framework of TiDB
+	newCollation bool
+	// sampler samples the warnings of the tables missing the index of merge-keys, nil prints all of them
+	sampler *sampledLogger
+}
+
+type trackedDB struct {
+	stmt *ast.CreateDatabaseStmt
+	// tables is the CREATE TABLE statements by lower case name, the table name has no schema
+	tables map[string]*ast.CreateTableStmt
+}
+
+// reset drops all the databases, and creates the default database.
+func (t *schemaTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dbs = make(map[string]*trackedDB)
+	t.createDB(&ast.CreateDatabaseStmt{Name: defaultDatabase})
+}
+
+// execute applies the DDL to the tracked schema, schema is the database of the tables without database
+// in the DDL, it can be changed by `USE db` in the DDL.
+func (t *schemaTracker) execute(schema, ddl string) error {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dbs == nil {
+		t.dbs = make(map[string]*trackedDB)
+	}
+	for _, stmt := range stmts {
+		if use, ok := stmt.(*ast.UseStmt); ok {
+			schema = use.DBName
+			continue
+		}
+		if err := t.apply(schema, stmt); err != nil {
+			return errors.Annotatef(err, "ddl %s", ddl)
+		}
+	}
+	return nil
+}
+
+func (t *schemaTracker) apply(schema string, stmt ast.StmtNode) error {
+	switch node := stmt.(type) {
+	case *ast.CreateDatabaseStmt:
+		// the existing database and its tables are kept like the existing table, the DDL may be seen twice,
+		// e.g. in the history DDLs and the binlogs of base dir, or again after resume
+		if _, ok := t.dbs[strings.ToLower(node.Name)]; !ok {
+			t.createDB(node)
+		}
+	case *ast.DropDatabaseStmt:
+		if _, ok := t.dbs[strings.ToLower(node.Name)]; !ok {
+			if node.IfExists {
+				return nil
+			}
+			return errors.Annotatef(errDatabaseNotExist, "can't drop database %s", node.Name)
+		}
+		delete(t.dbs, strings.ToLower(node.Name))
+	case *ast.CreateTableStmt:
+		return errors.Trace(t.createTable(schema, node))
+	case *ast.DropTableStmt:
+		for _, tn := range node.Tables {
+			db, table, err := t.findTable(schema, tn)
+			if err != nil {
+				if node.IfExists && errors.Cause(err) != errNoDatabaseSelected {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			delete(db.tables, table.Table.Name.L)
+		}
+	case *ast.TruncateTableStmt:
+		_, _, err := t.findTable(schema, node.Table)
+		return errors.Trace(err)
+	case *ast.RenameTableStmt:
+		t2ts := node.TableToTables
+		if len(t2ts) == 0 {
+			t2ts = []*ast.TableToTable{{OldTable: node.OldTable, NewTable: node.NewTable}}
+		}
+		for _, t2t := range t2ts {
+			if err := t.renameTable(schema, t2t.OldTable, t2t.NewTable); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	case *ast.AlterTableStmt:
+		return errors.Trace(t.alterTable(schema, node))
+	case *ast.CreateIndexStmt:
+		db, table, err := t.findTable(schema, node.Table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tp := ast.ConstraintIndex
+		if node.Unique {
+			tp = ast.ConstraintUniq
+		}
+		table, err = addConstraint(cloneTable(table), &ast.Constraint{Tp: tp, Name: node.IndexName, Keys: node.IndexColNames, Option: node.IndexOption})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		db.tables[table.Table.Name.L] = table
+	case *ast.DropIndexStmt:
+		db, table, err := t.findTable(schema, node.Table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if table, err = dropIndex(cloneTable(table), node.IndexName); err != nil {
+			if node.IfExists {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		db.tables[table.Table.Name.L] = table
+	default:
+		return errors.Errorf("unknown ddl type %T", stmt)
+	}
+	return nil
+}
+
+func (t *schemaTracker) createDB(stmt *ast.CreateDatabaseStmt) *trackedDB {
+	db := &trackedDB{
+		stmt:   &ast.CreateDatabaseStmt{Name: stmt.Name, Options: stmt.Options},
+		tables: make(map[string]*ast.CreateTableStmt),
+	}
+	t.dbs[strings.ToLower(stmt.Name)] = db
+	return db
+}
+
+// findTable returns the table and its database, the database of tn is schema if it's not specified.
+func (t *schemaTracker) findTable(schema string, tn *ast.TableName) (*trackedDB, *ast.CreateTableStmt, error) {
+	if len(tn.Schema.O) != 0 {
+		schema = tn.Schema.O
+	}
+	if len(schema) == 0 {
+		return nil, nil, errors.Annotatef(errNoDatabaseSelected, "table %s", tn.Name.O)
+	}
+	db, ok := t.dbs[strings.ToLower(schema)]
+	if !ok {
+		return nil, nil, errors.Annotatef(errDatabaseNotExist, "database %s", schema)
+	}
+	table, ok := db.tables[tn.Name.L]
+	if !ok {
+		return nil, nil, errors.Annotatef(ErrTableNotExist, "table %s", quoteSchema(schema, tn.Name.O))
+	}
+	return db, table, nil
+}
+
+// createTable tracks the table created by stmt, the database is created if it doesn't exist, and the
+// existing table is kept.
+func (t *schemaTracker) createTable(schema string, stmt *ast.CreateTableStmt) error {
+	if len(stmt.Table.Schema.O) != 0 {
+		schema = stmt.Table.Schema.O
+	}
+	if len(schema) == 0 {
+		return errors.Annotatef(errNoDatabaseSelected, "table %s", stmt.Table.Name.O)
+	}
+	db, ok := t.dbs[strings.ToLower(schema)]
+	if !ok {
+		db = t.createDB(&ast.CreateDatabaseStmt{Name: schema})
+	}
+	if _, ok := db.tables[stmt.Table.Name.L]; ok {
+		return nil
+	}
+
+	table := &ast.CreateTableStmt{
+		Cols:        stmt.Cols,
+		Constraints: stmt.Constraints,
+		Options:     stmt.Options,
+		Partition:   stmt.Partition,
+	}
+	// the text is kept to find the AUTO_RANDOM column in the comment
+	table.SetText(stmt.Text())
+	if stmt.ReferTable != nil {
+		_, refer, err := t.findTable(schema, stmt.ReferTable)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		*table = *refer
+	}
+	table = cloneTable(table)
+	table.Table = &ast.TableName{Name: stmt.Table.Name}
+
+	// the keys of columns are added after the keys of table like TiDB
+	var err error
+	cols, constraints := table.Cols, table.Constraints
+	table.Cols, table.Constraints = nil, nil
+	for _, col := range cols {
+		col, keys := splitColumnKeys(col)
+		table.Cols = append(table.Cols, col)
+		constraints = append(constraints, keys...)
+	}
+	for _, c := range constraints {
+		if table, err = addConstraint(table, c); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	db.tables[table.Table.Name.L] = table
+	return nil
+}
+
+func (t *schemaTracker) renameTable(schema string, oldName, newName *ast.TableName) error {
+	db, table, err := t.findTable(schema, oldName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(newName.Schema.O) != 0 {
+		schema = newName.Schema.O
+	}
+	newDB, ok := t.dbs[strings.ToLower(schema)]
+	if !ok {
+		return errors.Annotatef(errDatabaseNotExist, "database %s", schema)
+	}
+	if _, ok := newDB.tables[newName.Name.L]; ok && (newDB != db || newName.Name.L != table.Table.Name.L) {
+		return errors.Errorf("table %s already exists", quoteSchema(schema, newName.Name.O))
+	}
+
+	delete(db.tables, table.Table.Name.L)
+	table = cloneTable(table)
+	table.Table = &ast.TableName{Name: newName.Name}
+	newDB.tables[newName.Name.L] = table
+	return nil
+}
+
+func (t *schemaTracker) alterTable(schema string, stmt *ast.AlterTableStmt) error {
+	db, table, err := t.findTable(schema, stmt.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// the table is changed on a copy, so it's not changed if a spec fails
+	table = cloneTable(table)
+	for _, spec := range stmt.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				if findColumn(table, col.Name.Name.L) >= 0 {
+					return errors.Errorf("duplicate column name %s", col.Name.Name.O)
+				}
+				if table, err = addColumn(table, col, spec.Position); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		case ast.AlterTableDropColumn:
+			if table, err = dropColumn(table, spec.OldColumnName.Name); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableModifyColumn:
+			col := spec.NewColumns[0]
+			if table, err = changeColumn(table, col.Name.Name, col, spec.Position); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableChangeColumn:
+			if table, err = changeColumn(table, spec.OldColumnName.Name, spec.NewColumns[0], spec.Position); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableAlterColumn:
+			col := spec.NewColumns[0]
+			i := findColumn(table, col.Name.Name.L)
+			if i < 0 {
+				return errors.Errorf("unknown column %s", col.Name.Name.O)
+			}
+			// only the default value can be set or dropped
+			altered := *table.Cols[i]
+			altered.Options = nil
+			for _, opt := range table.Cols[i].Options {
+				if opt.Tp != ast.ColumnOptionDefaultValue {
+					altered.Options = append(altered.Options, opt)
+				}
+			}
+			altered.Options = append(altered.Options, col.Options...)
+			table.Cols[i] = &altered
+		case ast.AlterTableAddConstraint:
+			if table, err = addConstraint(table, spec.Constraint); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableDropIndex:
+			if table, err = dropIndex(table, spec.Name); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableDropPrimaryKey:
+			if table, err = dropIndex(table, primaryKeyName); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableRenameIndex:
+			i := findIndex(table, spec.FromKey.O)
+			if i < 0 {
+				return errors.Errorf("key %s doesn't exist", spec.FromKey.O)
+			}
+			renamed := *table.Constraints[i]
+			renamed.Name = spec.ToKey.O
+			table.Constraints[i] = &renamed
+		case ast.AlterTableDropForeignKey:
+			if table, err = dropForeignKey(table, spec.Name); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableOption:
+			table.Options = mergeTableOptions(table.Options, spec.Options)
+		case ast.AlterTableAddPartitions, ast.AlterTableCoalescePartitions, ast.AlterTableDropPartition,
+			ast.AlterTablePartition:
+			if table, err = alterPartitions(table, spec); err != nil {
+				return errors.Trace(err)
+			}
+		case ast.AlterTableRenameTable:
+			db.tables[table.Table.Name.L] = table
+			if err := t.renameTable(schema, stmt.Table, spec.NewTable); err != nil {
+				return errors.Trace(err)
+			}
+			return nil
+		default:
+			// the other specs don't change the columns and keys
+		}
+	}
+	db.tables[table.Table.Name.L] = table
+	return nil
+}
+
+// tableInfo returns the columns and unique keys of the table, the generated columns are excluded from the
+// columns and recorded in generatedColumns.
+func (t *schemaTracker) tableInfo(schema, table string) (*tableInfo, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	db, stmt, err := t.findTable(schema, &ast.TableName{Name: model.NewCIStr(table)})
+	if err != nil {
+		if errors.Cause(err) == errDatabaseNotExist {
+			return nil, ErrTableNotExist
+		}
+		return nil, errors.Cause(err)
+	}
+
+	info := &tableInfo{
+		schema: schema,
+		table:  table,
+	}
+	if t.newCollation {
+		info.collations = columnCollations(db.stmt, stmt)
+	}
+	for _, col := range stmt.Cols {
+		if !isGeneratedColumn(col) {
+			info.columns = append(info.columns, col.Name.Name.O)
+			continue
+		}
+		if info.generatedColumns == nil {
+			info.generatedColumns = make(map[string]bool)
+		}
+		info.generatedColumns[col.Name.Name.L] = true
+	}
+	info.autoID = autoIDColumnOf(stmt)
+	info.partition = stmt.Partition
+	for _, c := range stmt.Constraints {
+		name := c.Name
+		switch c.Tp {
+		case ast.ConstraintPrimaryKey:
+			name = primaryKeyName
+		case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+		default:
+			continue
+		}
+		index := indexInfo{name: name}
+		onGenerated := false
+		for _, key := range c.Keys {
+			index.columns = append(index.columns, key.Column.Name.O)
+			onGenerated = onGenerated || info.generatedColumns[key.Column.Name.L]
+		}
+		// the row events may have no values of the virtual generated columns, so the rows can't be identified by
+		// the keys on the generated columns
+		if onGenerated {
+			continue
+		}
+		info.uniqueKeys = append(info.uniqueKeys, index)
+	}
+
+	// put primary key at first place
+	// and set primaryKey
+	for i := 0; i < len(info.uniqueKeys); i++ {
+		if info.uniqueKeys[i].name == primaryKeyName {
+			info.uniqueKeys[i], info.uniqueKeys[0] = info.uniqueKeys[0], info.uniqueKeys[i]
+			info.primaryKey = &info.uniqueKeys[0]
+			break
+		}
+	}
+	info.useMergeKey(t.mergeKeys, t.sampler)
+	return info, nil
+}
+
+// databases returns the names of all the databases.
+func (t *schemaTracker) databases() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.dbs))
+	for _, db := range t.dbs {
+		names = append(names, db.stmt.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tables returns the sorted names of tables in schema.
+func (t *schemaTracker) tables(schema string) ([]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	db, ok := t.dbs[strings.ToLower(schema)]
+	if !ok {
+		return nil, errors.Annotatef(errDatabaseNotExist, "database %s", schema)
+	}
+	names := make([]string, 0, len(db.tables))
+	for _, table := range db.tables {
+		names = append(names, table.Table.Name.O)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// showCreateDatabase returns the CREATE DATABASE statement of schema.
+func (t *schemaTracker) showCreateDatabase(schema string) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	db, ok := t.dbs[strings.ToLower(schema)]
+	if !ok {
+		return "", errors.Annotatef(errDatabaseNotExist, "database %s", schema)
+	}
+	return restoreNode(db.stmt)
+}
+
+// showCreateTable returns the CREATE TABLE statement of the table.
+func (t *schemaTracker) showCreateTable(schema, table string) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, stmt, err := t.findTable(schema, &ast.TableName{Name: model.NewCIStr(table)})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return restoreNode(stmt)
+}
+
+func restoreNode(node ast.Node) (string, error) {
+	var sb strings.Builder
+	if err := node.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+		return "", errors.Trace(err)
+	}
+	return sb.String(), nil
+}
+
+// cloneTable copies the table and its lists, the columns and constraints are shared, so they should be
+// replaced instead of being changed.
+func cloneTable(table *ast.CreateTableStmt) *ast.CreateTableStmt {
+	cloned := *table
+	cloned.Cols = append([]*ast.ColumnDef(nil), table.Cols...)
+	cloned.Constraints = append([]*ast.Constraint(nil), table.Constraints...)
+	cloned.Options = append([]*ast.TableOption(nil), table.Options...)
+	return &cloned
+}
+
+func findColumn(table *ast.CreateTableStmt, name string) int {
+	for i, col := range table.Cols {
+		if col.Name.Name.L == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isGeneratedColumn(col *ast.ColumnDef) bool {
+	for _, opt := range col.Options {
+		if opt.Tp == ast.ColumnOptionGenerated {
+			return true
+		}
+	}
+	return false
+}
+
+// addColumn adds the column at pos, the primary key and unique key of the column are moved to the
+// constraints of table like SHOW CREATE TABLE.
+func addColumn(table *ast.CreateTableStmt, col *ast.ColumnDef, pos *ast.ColumnPosition) (*ast.CreateTableStmt, error) {
+	i, err := columnPosition(table, pos, len(table.Cols))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return insertColumn(table, col, i)
+}
+
+func insertColumn(table *ast.CreateTableStmt, col *ast.ColumnDef, i int) (*ast.CreateTableStmt, error) {
+	col, constraints := splitColumnKeys(col)
+	table.Cols = append(table.Cols, nil)
+	copy(table.Cols[i+1:], table.Cols[i:])
+	table.Cols[i] = col
+
+	var err error
+	for _, c := range constraints {
+		if table, err = addConstraint(table, c); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return table, nil
+}
+
+// changeColumn replaces the column named oldName by col, and moves it to pos if it's specified.
+func changeColumn(table *ast.CreateTableStmt, oldName model.CIStr, col *ast.ColumnDef, pos *ast.ColumnPosition) (*ast.CreateTableStmt, error) {
+	i := findColumn(table, oldName.L)
+	if i < 0 {
+		return nil, errors.Errorf("unknown column %s", oldName.O)
+	}
+	if oldName.L != col.Name.Name.L && findColumn(table, col.Name.Name.L) >= 0 {
+		return nil, errors.Errorf("duplicate column name %s", col.Name.Name.O)
+	}
+	table.Cols = append(table.Cols[:i], table.Cols[i+1:]...)
+	renameKeyColumn(table, oldName.L, col.Name.Name)
+	i, err := columnPosition(table, pos, i)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return insertColumn(table, col, i)
+}
+
+// dropColumn drops the column, and removes it from the keys, the keys without any columns are dropped.
+func dropColumn(table *ast.CreateTableStmt, name model.CIStr) (*ast.CreateTableStmt, error) {
+	i := findColumn(table, name.L)
+	if i < 0 {
+		return nil, errors.Errorf("unknown column %s", name.O)
+	}
+	table.Cols = append(table.Cols[:i], table.Cols[i+1:]...)
+
+	constraints := table.Constraints[:0]
+	for _, c := range table.Constraints {
+		keys := make([]*ast.IndexColName, 0, len(c.Keys))
+		for _, key := range c.Keys {
+			if key.Column.Name.L != name.L {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 && len(c.Keys) != 0 {
+			continue
+		}
+		if len(keys) != len(c.Keys) {
+			changed := *c
+			changed.Keys = keys
+			c = &changed
+		}
+		constraints = append(constraints, c)
+	}
+	table.Constraints = constraints
+	return table, nil
+}
+
+// renameKeyColumn renames the column in the keys.
+func renameKeyColumn(table *ast.CreateTableStmt, oldName string, newName model.CIStr) {
+	if oldName == newName.L {
+		return
+	}
+	for i, c := range table.Constraints {
+		var changed *ast.Constraint
+		for j, key := range c.Keys {
+			if key.Column.Name.L != oldName {
+				continue
+			}
+			if changed == nil {
+				copied := *c
+				copied.Keys = append([]*ast.IndexColName(nil), c.Keys...)
+				changed = &copied
+			}
+			changed.Keys[j] = &ast.IndexColName{Column: &ast.ColumnName{Name: newName}, Length: key.Length}
+		}
+		if changed != nil {
+			table.Constraints[i] = changed
+		}
+	}
+}
+
+// columnPosition returns the index to insert a column at pos, def is the index if pos is not specified.
+func columnPosition(table *ast.CreateTableStmt, pos *ast.ColumnPosition, def int) (int, error) {
+	if pos == nil {
+		return def, nil
+	}
+	switch pos.Tp {
+	case ast.ColumnPositionFirst:
+		return 0, nil
+	case ast.ColumnPositionAfter:
+		i := findColumn(table, pos.RelativeColumn.Name.L)
+		if i < 0 {
+			return 0, errors.Errorf("unknown column %s", pos.RelativeColumn.Name.O)
+		}
+		return i + 1, nil
+	}
+	return def, nil
+}
+
+// splitColumnKeys returns the column without the options of primary key and unique key, and the keys
+// of these options.
+func splitColumnKeys(col *ast.ColumnDef) (*ast.ColumnDef, []*ast.Constraint) {
+	var constraints []*ast.Constraint
+	options := make([]*ast.ColumnOption, 0, len(col.Options))
+	key := []*ast.IndexColName{{Column: &ast.ColumnName{Name: col.Name.Name}}}
+	notNull := false
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case ast.ColumnOptionPrimaryKey:
+			constraints = append(constraints, &ast.Constraint{Tp: ast.ConstraintPrimaryKey, Keys: key})
+			continue
+		case ast.ColumnOptionUniqKey:
+			constraints = append(constraints, &ast.Constraint{Tp: ast.ConstraintUniqKey, Keys: key})
+			continue
+		case ast.ColumnOptionNotNull:
+			notNull = true
+		}
+		options = append(options, opt)
+	}
+	if len(constraints) == 0 {
+		return col, nil
+	}
+
+	split := *col
+	split.Options = options
+	// the columns of primary key are not null
+	if !notNull && constraints[0].Tp == ast.ConstraintPrimaryKey {
+		split.Options = append(split.Options, &ast.ColumnOption{Tp: ast.ColumnOptionNotNull})
+	}
+	return &split, constraints
+}
+
+// isIndex returns true if the constraint is an index, foreign keys and checks are not.
+func isIndex(c *ast.Constraint) bool {
+	switch c.Tp {
+	case ast.ConstraintPrimaryKey, ast.ConstraintKey, ast.ConstraintIndex, ast.ConstraintUniq,
+		ast.ConstraintUniqKey, ast.ConstraintUniqIndex, ast.ConstraintFulltext:
+		return true
+	}
+	return false
+}
+
+// findIndex returns the index of the constraint named name, primaryKeyName is the primary key.
+func findIndex(table *ast.CreateTableStmt, name string) int {
+	for i, c := range table.Constraints {
+		if !isIndex(c) {
+			continue
+		}
+		if c.Tp == ast.ConstraintPrimaryKey {
+			if strings.EqualFold(name, primaryKeyName) {
+				return i
+			}
+			continue
+		}
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addConstraint adds the constraint, an index without name is named by its first column like TiDB.
+func addConstraint(table *ast.CreateTableStmt, c *ast.Constraint) (*ast.CreateTableStmt, error) {
+	if !isIndex(c) {
+		table.Constraints = append(table.Constraints, c)
+		return table, nil
+	}
+	if c.Tp == ast.ConstraintPrimaryKey {
+		if findIndex(table, primaryKeyName) >= 0 {
+			return nil, errors.New("multiple primary key defined")
+		}
+	} else if len(c.Name) == 0 && len(c.Keys) != 0 {
+		first := c.Keys[0].Column.Name.O
+		name := first
+		for i := 2; findIndex(table, name) >= 0; i++ {
+			name = fmt.Sprintf("%s_%d", first, i)
+		}
+		named := *c
+		named.Name = name
+		c = &named
+	} else if findIndex(table, c.Name) >= 0 {
+		return nil, errors.Errorf("duplicate key name %s", c.Name)
+	}
+	for _, key := range c.Keys {
+		if findColumn(table, key.Column.Name.L) < 0 {
+			return nil, errors.Errorf("key column %s doesn't exist in table", key.Column.Name.O)
+		}
+	}
+	table.Constraints = append(table.Constraints, c)
+	return table, nil
+}
+
+// dropIndex drops the index named name, primaryKeyName is the primary key.
+func dropIndex(table *ast.CreateTableStmt, name string) (*ast.CreateTableStmt, error) {
+	i := findIndex(table, name)
+	if i < 0 {
+		return nil, errors.Errorf("can't drop %s, check that column/key exists", name)
+	}
+	table.Constraints = append(table.Constraints[:i], table.Constraints[i+1:]...)
+	return table, nil
+}
+
+// mergeTableOptions replaces the options of the same type.
+func mergeTableOptions(options, changed []*ast.TableOption) []*ast.TableOption {
+	merged := make([]*ast.TableOption, 0, len(options)+len(changed))
+	for _, opt := range options {
+		replaced := false
+		for _, c := range changed {
+			if c.Tp == opt.Tp {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, opt)
+		}
+	}
+	return append(merged, changed...)
+}
@@ -0,0 +1,124 @@
+package pitr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"gotest.tools/assert"
+)
+
+func TestSchemaTrackerTableInfo(t *testing.T) {
+	var tracker schemaTracker
+	for _, ddl := range []string{
+		"create database db1",
+		"use db1; create table t1 (id int primary key, a int unique, b int, c int as (b + 1), unique key (b, a))",
+		"create table db1.t2 like db1.t1",
+		"use db1; alter table t1 add column d varchar(10) first, add unique key uk_d (d)",
+		"use db1; alter table t1 change a a2 bigint after d",
+		"use db1; alter table t1 drop column b",
+		"use db1; create unique index uk_c on t1 (c)",
+	} {
+		assert.NilError(t, tracker.execute("", ddl), ddl)
+	}
+
+	info, err := tracker.tableInfo("db1", "T1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.columns, []string{"d", "a2", "id"})
+	assert.Equal(t, info.primaryKey.name, "PRIMARY")
+	var keys []string
+	for _, key := range info.uniqueKeys {
+		keys = append(keys, key.name+"("+strings.Join(key.columns, ",")+")")
+	}
+	// the unique key (b, a) is named by its first column, and a2 is left after b is dropped, uk_c on the generated
+	// column c is skipped
+	assert.DeepEqual(t, keys, []string{"PRIMARY(id)", "b(a2)", "a(a2)", "uk_d(d)"})
+
+	// t2 is created before the changes of t1
+	info, err = tracker.tableInfo("db1", "t2")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.columns, []string{"id", "a", "b"})
+	assert.Equal(t, len(info.uniqueKeys), 3)
+
+	assert.NilError(t, tracker.execute("db1", "alter table t2 drop primary key, drop index b"))
+	info, err = tracker.tableInfo("db1", "t2")
+	assert.NilError(t, err)
+	assert.Assert(t, info.primaryKey == nil)
+	assert.Equal(t, len(info.uniqueKeys), 1)
+	assert.Equal(t, info.uniqueKeys[0].name, "a")
+
+	_, err = tracker.tableInfo("db2", "t1")
+	assert.Equal(t, err, ErrTableNotExist)
+}
+
+func TestSchemaTrackerDDLs(t *testing.T) {
+	var tracker schemaTracker
+	tracker.reset()
+	assert.DeepEqual(t, tracker.databases(), []string{"test"})
+
+	// the database of table is created if it doesn't exist
+	assert.NilError(t, tracker.execute("db1", "create table t1 (id int primary key)"))
+	// the existing table is kept
+	assert.NilError(t, tracker.execute("db1", "create table t1 (a int)"))
+	assert.ErrorContains(t, tracker.execute("", "create table t3 (id int)"), "no database selected")
+	assert.NilError(t, tracker.execute("", "create database if not exists db1"))
+	assert.DeepEqual(t, tracker.databases(), []string{"db1", "test"})
+
+	assert.NilError(t, tracker.execute("db1", "rename table t1 to test.t2"))
+	tables, err := tracker.tables("db1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(tables), 0)
+	assert.NilError(t, tracker.execute("test", "alter table t2 rename to t3"))
+	tables, err = tracker.tables("test")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tables, []string{"t3"})
+
+	assert.NilError(t, tracker.execute("test", "truncate table t3"))
+	err = tracker.execute("test", "alter table t3 add column id int")
+	assert.ErrorContains(t, err, "duplicate column name id")
+	err = tracker.execute("test", "alter table t3 add column a int, drop column b")
+	assert.ErrorContains(t, err, "unknown column b")
+	// the failed DDL doesn't change the table
+	info, err := tracker.tableInfo("test", "t3")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, info.columns, []string{"id"})
+
+	err = tracker.execute("test", "drop table t4")
+	assert.Equal(t, errors.Cause(err), ErrTableNotExist)
+	assert.NilError(t, tracker.execute("test", "drop table if exists t4, t3"))
+	assert.NilError(t, tracker.execute("", "drop database db1"))
+	err = tracker.execute("", "drop database db1")
+	assert.Equal(t, errors.Cause(err), errDatabaseNotExist)
+	assert.DeepEqual(t, tracker.databases(), []string{"test"})
+}
+
+func TestSchemaTrackerCreateDatabaseTwice(t *testing.T) {
+	var tracker schemaTracker
+	// the history DDLs and the binlogs replayed again after resume have the same DDLs
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, tracker.execute("", "create database db1"))
+		assert.NilError(t, tracker.execute("db1", "create table t1 (id int primary key)"))
+	}
+	assert.DeepEqual(t, tracker.databases(), []string{"db1"})
+	// the tables in the existing database are kept
+	tables, err := tracker.tables("db1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tables, []string{"t1"})
+}
+
+func TestSchemaTrackerShowCreate(t *testing.T) {
+	var tracker schemaTracker
+	assert.NilError(t, tracker.execute("", "create database db1 default character set utf8mb4"))
+	assert.NilError(t, tracker.execute("db1", "create table db1.t1 (id int primary key, a varchar(10) default 'x', key (a))"))
+	assert.NilError(t, tracker.execute("db1", "alter table t1 alter column a set default 'y'"))
+
+	createDB, err := tracker.showCreateDatabase("DB1")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(createDB, "CREATE DATABASE `db1`"), createDB)
+	createTable, err := tracker.showCreateTable("db1", "t1")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(createTable, "CREATE TABLE `t1` (`id` INT NOT NULL,`a` VARCHAR(10) DEFAULT "), createTable)
+	assert.Assert(t, strings.Contains(createTable, "'y'") && !strings.Contains(createTable, "'x'"), createTable)
+	assert.Assert(t, strings.Contains(createTable, "PRIMARY KEY(`id`)"), createTable)
+	assert.Assert(t, strings.Contains(createTable, "`a`(`a`)"), createTable)
+}
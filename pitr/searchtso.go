@@ -0,0 +1,197 @@
+package pitr
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// SearchTSOConfig is the options of the search-tso subcommand.
+type SearchTSOConfig struct {
+	// Dir and Storage are the binlog files like data-dir and storage of Config
+	Dir     string
+	Storage string
+	// Table is the table of the row like db.table
+	Table string
+	// Where is the expression which identifies the row like `id = 42`, it supports the same syntax as row-filter
+	Where string
+	// Around is the approximate datetime of the change, empty means searching all the binlogs
+	Around string
+	// Window is the range searched before and after Around
+	Window time.Duration
+	// TimeZone is the time zone of Around, empty string means the local time zone
+	TimeZone        string
+	RelaxCorruption string
+}
+
+// rowChange is a change of the searched row.
+type rowChange struct {
+	CommitTS int64
+	Tp       pb.EventType
+	// Before and After are the row images, Before is empty for insert and After is empty for delete
+	Before string
+	After  string
+}
+
+// shiftTSO returns the tso d after ts, the logical part is dropped.
+func shiftTSO(ts int64, d time.Duration) int64 {
+	return int64(oracle.ComposeTS(oracle.ExtractPhysical(uint64(ts))+int64(d/time.Millisecond), 0))
+}
+
+// formatRowImage formats the columns of a row image like `id=42, name=abc`.
+func formatRowImage(cols [][]byte) (string, error) {
+	values := make([]string, 0, len(cols))
+	for _, c := range cols {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return "", errors.Trace(err)
+		}
+		_, val, err := codec.DecodeOne(col.Value)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		d := formatValue(val, col.Tp[0])
+		if d.IsNull() {
+			values = append(values, col.Name+"=NULL")
+			continue
+		}
+		s, err := d.ToString()
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		values = append(values, col.Name+"="+s)
+	}
+	return strings.Join(values, ", "), nil
+}
+
+// searchRow returns the changes of the event if any of its images matches f.
+func searchRow(ev *pb.Event, f *rowFilter, commitTS int64) (*rowChange, error) {
+	evs, err := rewriteDML(ev)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var matched bool
+	for _, e := range evs {
+		if matched, err = f.match(e); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if matched {
+			break
+		}
+	}
+	if !matched {
+		return nil, nil
+	}
+
+	change := &rowChange{CommitTS: commitTS, Tp: ev.GetTp()}
+	for _, e := range evs {
+		image, err := formatRowImage(e.GetRow())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if e.GetTp() == pb.EventType_Delete {
+			change.Before = image
+		} else {
+			change.After = image
+		}
+	}
+	return change, nil
+}
+
+// SearchTSO scans the binlogs around the approximate datetime, and prints the commit ts of the changes of the
+// row identified by the expression, which helps to find the exact stop-tso before an incident.
+func SearchTSO(w io.Writer, cfg *SearchTSOConfig) error {
+	names := strings.SplitN(cfg.Table, ".", 2)
+	if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 {
+		return errors.Errorf("invalid table %s, should be like db.table", cfg.Table)
+	}
+	if len(strings.TrimSpace(cfg.Where)) == 0 {
+		return errors.New("the expression of the row is required")
+	}
+	if !isValidRelaxCorruption(cfg.RelaxCorruption) {
+		return errors.Errorf("unknown relax-corruption %s, should be %s, %s or %s", cfg.RelaxCorruption, relaxAbort, relaxSkipTail, relaxSkipFile)
+	}
+	f, err := parseRowFilter(cfg.Table + ": " + cfg.Where)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	source := &Config{Dir: cfg.Dir, Storage: cfg.Storage, TimeZone: cfg.TimeZone}
+	dirs, err := source.binlogDirs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var startTS, stopTS int64
+	if len(cfg.Around) != 0 {
+		loc, err := source.location()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		around, err := dateTimeToTSO(cfg.Around, loc)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		startTS, stopTS = shiftTSO(around, -cfg.Window), shiftTSO(around, cfg.Window)
+	}
+
+	sources, _, err := searchSources(dirs, startTS, stopTS, onGapWarn, runOptions{})
+	if err != nil {
+		return errors.Annotate(err, "search binlog files failed")
+	}
+	log.Info("search the row in binlogs", zap.String("table", cfg.Table), zap.String("where", cfg.Where),
+		zap.String("start ts", formatTSO(startTS)), zap.String("stop ts", formatTSO(stopTS)))
+
+	var changes []*rowChange
+	for _, files := range sources {
+		for _, file := range files {
+			if _, err := scanSourceBinlogFile(file, cfg.RelaxCorruption, runOptions{}, func(binlog *pb.Binlog, _ int64) error {
+				if binlog.Tp != pb.BinlogType_DML || !isAcceptableBinlog(binlog, startTS, stopTS) {
+					return nil
+				}
+				events := binlog.GetDmlData().GetEvents()
+				for i := range events {
+					ev := &events[i]
+					if !strings.EqualFold(ev.GetSchemaName(), names[0]) || !strings.EqualFold(ev.GetTableName(), names[1]) {
+						continue
+					}
+					change, err := searchRow(ev, f, binlog.CommitTs)
+					if err != nil {
+						return errors.Trace(err)
+					}
+					if change != nil {
+						changes = append(changes, change)
+					}
+				}
+				return nil
+			}); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	// the binlogs of multiple dirs are read one dir after another
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].CommitTS < changes[j].CommitTS })
+
+	fmt.Fprintf(w, "changes: %d\n", len(changes))
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s %s\n", formatTSO(c.CommitTS), c.Tp)
+		if len(c.Before) != 0 {
+			fmt.Fprintf(w, "    before: %s\n", c.Before)
+		}
+		if len(c.After) != 0 {
+			fmt.Fprintf(w, "    after:  %s\n", c.After)
+		}
+	}
+	if len(changes) != 0 {
+		fmt.Fprintf(w, "the row before the first change is restored by --stop-tso %d\n", changes[0].CommitTS-1)
+	}
+	return nil
+}
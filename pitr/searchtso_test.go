@@ -0,0 +1,96 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+// genRowBinlog generates a DML binlog of test.t1 (id int, v int), the update changes v to v + 1.
+func genRowBinlog(tp pb.EventType, id, v int64, ts int64) *pb.Binlog {
+	schema, table := "test", "t1"
+	var row [][]byte
+	for _, col := range []*pb.Column{
+		{Name: "id", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(id), ChangedValue: encodeIntValue(id)},
+		{Name: "v", Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeIntValue(v), ChangedValue: encodeIntValue(v + 1)},
+	} {
+		data, _ := col.Marshal()
+		row = append(row, data)
+	}
+	return &pb.Binlog{
+		Tp:       pb.BinlogType_DML,
+		DmlData:  &pb.DMLData{Events: []pb.Event{{Tp: tp, SchemaName: &schema, TableName: &table, Row: row}}},
+		CommitTs: ts,
+	}
+}
+
+func TestSearchTSO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searchtso")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	var data []byte
+	for _, binlog := range []*pb.Binlog{
+		genTestDDL("test", "t1", "create table test.t1 (id int primary key, v int)", 100),
+		genRowBinlog(pb.EventType_Insert, 1, 10, 200),
+		genRowBinlog(pb.EventType_Insert, 2, 10, 300),
+		genTestDML("test", "t2", 300),
+		genRowBinlog(pb.EventType_Update, 1, 10, 400),
+		genRowBinlog(pb.EventType_Delete, 1, 11, 500),
+	} {
+		payload, err := binlog.Marshal()
+		assert.Assert(t, err == nil)
+		data = append(data, binlogfile.Encode(payload)...)
+	}
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, binlogfile.BinlogName(0)), data, 0600))
+
+	cfg := &SearchTSOConfig{Dir: dir, Table: "TEST.t1", Where: "id = 1", RelaxCorruption: relaxAbort}
+	var sb strings.Builder
+	assert.NilError(t, SearchTSO(&sb, cfg))
+	assert.Equal(t, sb.String(), strings.Join([]string{
+		"changes: 3",
+		"  " + formatTSO(200) + " Insert",
+		"    after:  id=1, v=10",
+		"  " + formatTSO(400) + " Update",
+		"    before: id=1, v=10",
+		"    after:  id=1, v=11",
+		"  " + formatTSO(500) + " Delete",
+		"    before: id=1, v=11",
+		"the row before the first change is restored by --stop-tso 199",
+		"",
+	}, "\n"))
+
+	// the update matches by the image after it
+	sb.Reset()
+	cfg.Where = "v = 11"
+	assert.NilError(t, SearchTSO(&sb, cfg))
+	assert.Assert(t, strings.HasPrefix(sb.String(), "changes: 2\n  "+formatTSO(400)+" Update\n"), sb.String())
+
+	sb.Reset()
+	cfg.Where = "id = 3"
+	assert.NilError(t, SearchTSO(&sb, cfg))
+	assert.Equal(t, sb.String(), "changes: 0\n")
+
+	cfg.Table = "t1"
+	assert.ErrorContains(t, SearchTSO(&sb, cfg), "invalid table t1")
+	cfg.Table = "test.t1"
+	cfg.Where = "id ="
+	assert.ErrorContains(t, SearchTSO(&sb, cfg), "parse row filter")
+}
+
+func TestShiftTSO(t *testing.T) {
+	ts, err := dateTimeToTSO("2023-06-01 12:00:00", time.UTC)
+	assert.NilError(t, err)
+	expect, err := dateTimeToTSO("2023-06-01 11:30:00", time.UTC)
+	assert.NilError(t, err)
+	assert.Equal(t, shiftTSO(ts, -30*time.Minute), expect)
+	assert.Equal(t, shiftTSO(expect, 30*time.Minute), ts)
+}
@@ -0,0 +1,93 @@
+package pitr
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	tidbconfig "github.com/pingcap/tidb/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// pdSecurity returns the TLS certs to connect PD and TiKV, the cluster is not secured if pd-ssl-ca is empty.
+func (c *Config) pdSecurity() tidbconfig.Security {
+	return tidbconfig.Security{
+		ClusterSSLCA:   c.PDSSLCA,
+		ClusterSSLCert: c.PDSSLCert,
+		ClusterSSLKey:  c.PDSSLKey,
+	}
+}
+
+// validatePDSecurity checks the TLS certs of PD, the urls should use https if the cluster is secured.
+func (c *Config) validatePDSecurity() error {
+	if (c.PDSSLCert == "") != (c.PDSSLKey == "") {
+		return errors.New("pd-ssl-cert and pd-ssl-key should be set together")
+	}
+	if c.PDSSLCA == "" {
+		if c.PDSSLCert != "" {
+			return errors.New("pd-ssl-cert and pd-ssl-key require pd-ssl-ca")
+		}
+		return nil
+	}
+	if c.PDURLs == "" {
+		return errors.New("pd-ssl-ca requires pd-urls")
+	}
+	for _, addr := range pdAddrs(c.PDURLs, "https://") {
+		if !strings.HasPrefix(addr, "https://") {
+			return errors.Errorf("PD %s should use https when pd-ssl-ca is set", addr)
+		}
+	}
+	return nil
+}
+
+// pdScheme returns the scheme of the PD addresses without one.
+func pdScheme(tlsConfig *tls.Config) string {
+	if tlsConfig != nil {
+		return "https://"
+	}
+	return "http://"
+}
+
+// pdAddrs splits the comma separated PD urls, scheme is added to the addresses without one.
+func pdAddrs(urls string, scheme string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(urls, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = scheme + addr
+		}
+		addrs = append(addrs, strings.TrimSuffix(addr, "/"))
+	}
+	return addrs
+}
+
+// newPDHTTPClient returns the client of the PD HTTP API, and the scheme of the PD addresses without one.
+func newPDHTTPClient(security tidbconfig.Security, timeout time.Duration) (*http.Client, string, error) {
+	tlsConfig, err := security.ToTLSConfig()
+	if err != nil {
+		return nil, "", errors.Annotate(err, "load the TLS certs of PD")
+	}
+	client := &http.Client{Timeout: timeout}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return client, pdScheme(tlsConfig), nil
+}
+
+// pdDialOption returns the gRPC option to connect PD with the TLS certs.
+func pdDialOption(security tidbconfig.Security) (grpc.DialOption, error) {
+	tlsConfig, err := security.ToTLSConfig()
+	if err != nil {
+		return nil, errors.Annotate(err, "load the TLS certs of PD")
+	}
+	if tlsConfig == nil {
+		return grpc.WithInsecure(), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
@@ -0,0 +1,70 @@
+package pitr
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tidbconfig "github.com/pingcap/tidb/config"
+	"gotest.tools/assert"
+)
+
+func TestValidatePDSecurity(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.PDSSLCert = "client.pem"
+	assert.ErrorContains(t, cfg.validate(), "set together")
+	cfg.PDSSLKey = "client-key.pem"
+	assert.ErrorContains(t, cfg.validate(), "require pd-ssl-ca")
+	cfg.PDSSLCA = "ca.pem"
+	assert.ErrorContains(t, cfg.validate(), "requires pd-urls")
+	cfg.PDURLs = "127.0.0.1:2379,https://127.0.0.2:2379"
+	assert.Assert(t, cfg.validate() == nil)
+	cfg.PDURLs = "http://127.0.0.1:2379"
+	assert.ErrorContains(t, cfg.validate(), "should use https")
+
+	assert.DeepEqual(t, pdAddrs(" 127.0.0.1:2379/, http://127.0.0.2:2379,", "https://"),
+		[]string{"https://127.0.0.1:2379", "http://127.0.0.2:2379"})
+}
+
+func TestPDLeaderWithTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case pdClusterAPI:
+			fmt.Fprint(w, `{"id": 1}`)
+		case pdLeaderAPI:
+			fmt.Fprint(w, `{"name": "pd-0", "client_urls": ["https://10.0.0.1:2379"]}`)
+		case pdVersionAPI:
+			fmt.Fprint(w, `{"version": "v4.0.0"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pitr-security")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	assert.NilError(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	// the address without a scheme uses https with the certs
+	addr := strings.TrimPrefix(server.URL, "https://")
+	clusterID, leader, err := pdLeader(addr, tidbconfig.Security{ClusterSSLCA: ca}, time.Second)
+	assert.NilError(t, err)
+	assert.Equal(t, clusterID, uint64(1))
+	assert.Equal(t, leader, "10.0.0.1:2379")
+	assert.Equal(t, len(checkPDReachable(addr, tidbconfig.Security{ClusterSSLCA: ca}, time.Second)), 0)
+
+	_, _, err = pdLeader(server.URL, tidbconfig.Security{}, time.Second)
+	assert.ErrorContains(t, err, "certificate")
+	_, _, err = pdLeader(addr, tidbconfig.Security{ClusterSSLCA: filepath.Join(dir, "not-exist.pem")}, time.Second)
+	assert.ErrorContains(t, err, "load the TLS certs")
+}
@@ -0,0 +1,321 @@
+package pitr
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	jobStateRunning  = "running"
+	jobStateFinished = "finished"
+	jobStateFailed   = "failed"
+	jobStateCanceled = "canceled"
+)
+
+// job is a PITR job submitted to Server.
+type job struct {
+	id     string
+	pitr   *PITR
+	start  time.Time
+	cancel context.CancelFunc
+
+	// the fields below are protected by Server's mutex
+	state string
+	err   error
+	end   time.Time
+}
+
+// jobStatus is the status of job returned by the API.
+type jobStatus struct {
+	ID         string         `json:"id"`
+	State      string         `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	ErrorClass ErrorClass     `json:"error-class,omitempty"`
+	StartTime  time.Time      `json:"start-time"`
+	EndTime    *time.Time     `json:"end-time,omitempty"`
+	Progress   progressStatus `json:"progress"`
+}
+
+// Server runs PITR jobs submitted by HTTP API:
+//
+//	POST   /jobs      submit a job with the config in JSON, returns the job's status
+//	GET    /jobs      list the status of all jobs
+//	GET    /jobs/{id} get the status of the job
+//	DELETE /jobs/{id} cancel the job
+//	GET    /jobs/{id}/dashboard get the details of the job shown in the web UI
+//	GET    /          the web UI showing the progress of jobs
+//
+// only one job can be running at the same time, because the jobs share the temp dir and the tracked schema.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+
+	// process runs the job, it's PITR.Process, and can be replaced in test
+	process func(r *PITR, ctx context.Context) error
+
+	mu      sync.Mutex
+	jobs    []*job
+	running *job
+	nextID  int
+}
+
+// NewServer creates a Server listening on addr.
+func NewServer(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "listen address %s", addr)
+	}
+
+	s := &Server{
+		listener: listener,
+		process:  (*PITR).Process,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/", handleDashboardPage)
+	s.server = &http.Server{Handler: mux}
+
+	return s, nil
+}
+
+// Run serves the API until Close is called.
+func (s *Server) Run() error {
+	log.Info("pitr server started", zap.String("address", s.addr()))
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Close cancels the running job and stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.running != nil {
+		s.running.cancel()
+	}
+	s.mu.Unlock()
+
+	return errors.Trace(s.server.Close())
+}
+
+func (s *Server) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		statuses := make([]jobStatus, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			statuses = append(statuses, j.status())
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, statuses)
+	case http.MethodPost:
+		cfg := NewConfig()
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Annotate(err, "decode config"))
+			return
+		}
+		if err := cfg.Adjust(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := checkSubmittedConfig(cfg); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		j, err := s.submit(cfg)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		s.mu.Lock()
+		status := j.status()
+		s.mu.Unlock()
+		writeJSON(w, http.StatusCreated, status)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", req.Method))
+	}
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	id, view := splitJobPath(id)
+
+	// copy the status under the lock, the dashboard is rendered without holding it
+	s.mu.Lock()
+	var (
+		j      *job
+		status jobStatus
+	)
+	for _, v := range s.jobs {
+		if v.id == id {
+			j = v
+			status = j.status()
+			break
+		}
+	}
+	s.mu.Unlock()
+	if j == nil {
+		writeError(w, http.StatusNotFound, errors.Errorf("job %s not found", id))
+		return
+	}
+
+	if view == "dashboard" {
+		if req.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", req.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, j.dashboard(status))
+		return
+	}
+	if view != "" {
+		writeError(w, http.StatusNotFound, errors.Errorf("unknown path %s", req.URL.Path))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodDelete:
+		s.mu.Lock()
+		running := j.state == jobStateRunning
+		if running {
+			log.Info("cancel job", zap.String("id", id))
+			j.cancel()
+		}
+		status = j.status()
+		s.mu.Unlock()
+		if !running {
+			writeError(w, http.StatusConflict, errors.Errorf("job %s is already %s", id, status.State))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", req.Method))
+	}
+}
+
+// checkSubmittedConfig rejects the config loading or executing the files on the server, the API is not
+// authenticated, so they would run any code sent by the caller.
+func checkSubmittedConfig(cfg *Config) error {
+	if cfg.EventHookPlugin != "" {
+		return errors.New("event-hook-plugin can't be set by the jobs submitted to server, it loads the plugin into the server")
+	}
+	if cfg.BRPath != defaultBRPath {
+		return errors.Errorf("br-path can't be set by the jobs submitted to server, %s in PATH is executed", defaultBRPath)
+	}
+	return nil
+}
+
+// splitJobPath splits the path after /jobs/ to the job id and the view like dashboard.
+func splitJobPath(p string) (id string, view string) {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// submit starts a job if no job is running.
+func (s *Server) submit(cfg *Config) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running != nil {
+		return nil, errors.Errorf("job %s is running", s.running.id)
+	}
+
+	r, err := New(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the events of tables are shown in the web UI even if report-file is not set
+	r.report = newRunReport()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.nextID++
+	j := &job{
+		id:     strconv.Itoa(s.nextID),
+		pitr:   r,
+		start:  time.Now(),
+		cancel: cancel,
+		state:  jobStateRunning,
+	}
+	s.jobs = append(s.jobs, j)
+	s.running = j
+
+	log.Info("job submitted", zap.String("id", j.id), zap.Stringer("config", cfg))
+	go s.run(ctx, j)
+	return j, nil
+}
+
+func (s *Server) run(ctx context.Context, j *job) {
+	err := s.process(j.pitr, ctx)
+	j.cancel()
+	j.pitr.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.end = time.Now()
+	j.err = err
+	switch {
+	case err == nil:
+		j.state = jobStateFinished
+	case errors.Cause(err) == context.Canceled:
+		j.state = jobStateCanceled
+	default:
+		j.state = jobStateFailed
+	}
+	s.running = nil
+	log.Info("job stopped", zap.String("id", j.id), zap.String("state", j.state), zap.Error(err))
+}
+
+// status returns the status of job, should be called with Server's mutex held.
+func (j *job) status() jobStatus {
+	s := jobStatus{
+		ID:        j.id,
+		State:     j.state,
+		StartTime: j.start,
+		Progress:  j.pitr.progress.status(),
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+		s.ErrorClass = ClassifyError(j.err)
+	}
+	if !j.end.IsZero() {
+		end := j.end
+		s.EndTime = &end
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("write response failed", zap.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,151 @@
+package pitr
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Assert(t, err == nil)
+	// the job runs until it's canceled
+	s.process = func(r *PITR, ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	go s.Run()
+	defer s.Close()
+	url := "http://" + s.addr() + "/jobs"
+
+	// invalid config
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"data-dir": "data", "concurrency": 0}`))
+	assert.Assert(t, err == nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"unknown": 1}`))
+	assert.Assert(t, err == nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+	// the plugin and binary on the server can't be chosen by the caller
+	for _, body := range []string{
+		`{"data-dir": "data", "event-hook-plugin": "/tmp/hook.so"}`,
+		`{"data-dir": "data", "br-path": "/tmp/br"}`,
+	} {
+		resp, err = http.Post(url, "application/json", strings.NewReader(body))
+		assert.Assert(t, err == nil)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Assert(t, err == nil)
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden, body)
+		assert.Assert(t, strings.Contains(string(data), "can't be set by the jobs submitted to server"), string(data))
+	}
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"data-dir": "data", "tables": "test.*"}`))
+	assert.Assert(t, err == nil)
+	var status jobStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	assert.Assert(t, err == nil)
+	assert.Equal(t, resp.StatusCode, http.StatusCreated)
+	assert.Equal(t, status.State, jobStateRunning)
+
+	// only one job can be running
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"data-dir": "data"}`))
+	assert.Assert(t, err == nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusConflict)
+
+	req, err := http.NewRequest(http.MethodDelete, url+"/"+status.ID, nil)
+	assert.Assert(t, err == nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Assert(t, err == nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusAccepted)
+
+	for i := 0; i < 100; i++ {
+		resp, err = http.Get(url + "/" + status.ID)
+		assert.Assert(t, err == nil)
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		assert.Assert(t, err == nil)
+		if status.State != jobStateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, status.State, jobStateCanceled)
+	assert.Assert(t, status.EndTime != nil)
+
+	resp, err = http.Get(url)
+	assert.Assert(t, err == nil)
+	var statuses []jobStatus
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(statuses) == 1)
+
+	resp, err = http.Get(url + "/100")
+	assert.Assert(t, err == nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+}
+
+func TestServerDashboard(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.NilError(t, err)
+	started := make(chan struct{})
+	s.process = func(r *PITR, ctx context.Context) error {
+		r.progress.start(phaseMap, 100)
+		r.report.addEventsBeforeMerge("test_t1", 10)
+		r.report.addEventsBeforeMerge("test_t2", 20)
+		r.progress.start(phaseReduce, 100)
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	go s.Run()
+	defer s.Close()
+	url := "http://" + s.addr()
+
+	resp, err := http.Get(url + "/")
+	assert.NilError(t, err)
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(page), "pitr jobs"))
+
+	resp, err = http.Post(url+"/jobs", "application/json", strings.NewReader(`{"data-dir": "data"}`))
+	assert.NilError(t, err)
+	var status jobStatus
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	<-started
+
+	resp, err = http.Get(url + "/jobs/" + status.ID + "/dashboard")
+	assert.NilError(t, err)
+	var d jobDashboard
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&d))
+	resp.Body.Close()
+	assert.Equal(t, d.State, jobStateRunning)
+	assert.Equal(t, d.Progress.Phase, phaseReduce)
+	assert.Equal(t, len(d.Phases), 1)
+	assert.Equal(t, d.Phases[0].Phase, phaseMap)
+	assert.Equal(t, len(d.Tables), 2)
+	// the tables with the most events are the first
+	assert.Equal(t, d.Tables[0].Table, "test_t2")
+	assert.Equal(t, d.Tables[0].EventsBeforeMerge, int64(20))
+
+	resp, err = http.Get(url + "/jobs/" + status.ID + "/unknown")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+}
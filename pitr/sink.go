@@ -0,0 +1,424 @@
+package pitr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const retryInterval = time.Second
+
+// binlogSink replays the merged binlogs to a downstream.
+type binlogSink interface {
+	// Apply applies the binlog, it may be cached until Close
+	Apply(binlog *pb.Binlog) error
+	// Close flushes the cached binlogs, and closes the sink
+	Close() error
+	// abort closes the sink without flushing
+	abort()
+}
+
+var _ binlogSink = &mysqlSink{}
+
+// mysqlSink replays the merged binlogs to the downstream TiDB/MySQL.
+type mysqlSink struct {
+	db *sql.DB
+
+	batchSize int
+	maxRetry  int
+	limiter   *applyLimiter
+	// safeMode executes the DMLs in safe mode, so the failed commit can be retried
+	safeMode bool
+	// preserveTxn dispatches the DMLs only between the transactions, so the binlogs of a transaction split into
+	// every table are executed in one batch, it's used with one worker
+	preserveTxn bool
+	// lastCommitTS is the commit ts of the last DML binlog applied
+	lastCommitTS int64
+
+	// workers execute the DMLs, the DMLs of a table are always executed by the same worker, so a large table
+	// only uses one connection of downstream, and the order of its DMLs is kept
+	workers []*sinkWorker
+	// pending is the number of batches not executed by workers
+	pending  sync.WaitGroup
+	stopOnce sync.Once
+
+	errMu sync.Mutex
+	// err is the first error of workers
+	err error
+
+	// tableInfos caches the table infos of downstream, it is cleaned after executing DDL
+	tableInfos map[string]*tableInfo
+}
+
+// sinkWorker executes the batches of DML statements in its goroutine.
+type sinkWorker struct {
+	// dmls is the DML statements not sent to the worker yet
+	dmls    []string
+	batches chan []string
+}
+
+func newMySQLSink(cfg DBConfig, limiter *applyLimiter, opts runOptions) (*mysqlSink, error) {
+	dsn := cfg.DSN
+	if opts.foreignKeyChecksDisabled {
+		var err error
+		if dsn, err = withSessionVariable(dsn, "foreign_key_checks", "0"); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open downstream %s", redactDSN(cfg.DSN))
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Annotatef(err, "connect downstream %s", redactDSN(cfg.DSN))
+	}
+
+	s := &mysqlSink{
+		db:         db,
+		batchSize:  cfg.BatchSize,
+		maxRetry:   cfg.MaxRetry,
+		limiter:    limiter,
+		safeMode:   opts.safeMode,
+		tableInfos: make(map[string]*tableInfo),
+	}
+	workerCount := cfg.WorkerCount
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+	for i := 0; i < workerCount; i++ {
+		w := &sinkWorker{batches: make(chan []string, 1)}
+		s.workers = append(s.workers, w)
+		go s.runWorker(w)
+	}
+	return s, nil
+}
+
+// Apply executes the binlog in downstream, DMLs are executed in batch.
+func (s *mysqlSink) Apply(binlog *pb.Binlog) error {
+	if err := s.workerErr(); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		if err := s.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(s.execDDL(string(binlog.DdlQuery)))
+	case pb.BinlogType_DML:
+		if s.preserveTxn && binlog.CommitTs != s.lastCommitTS {
+			// the binlogs of the last transaction are all cached
+			for _, w := range s.workers {
+				if len(w.dmls) >= s.batchSize {
+					s.dispatch(w)
+				}
+			}
+			s.lastCommitTS = binlog.CommitTs
+		}
+		events := binlog.GetDmlData().GetEvents()
+		for i := range events {
+			info, err := s.getTableInfo(events[i].GetSchemaName(), events[i].GetTableName())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			sqls, err := eventToSQLs(&events[i], info, s.safeMode)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			w := s.workers[tableWorker(quoteSchema(events[i].GetSchemaName(), events[i].GetTableName()), len(s.workers))]
+			w.dmls = append(w.dmls, sqls...)
+			if len(w.dmls) >= s.batchSize && !s.preserveTxn {
+				s.dispatch(w)
+			}
+		}
+	default:
+		return errors.Errorf("unknown binlog type %v", binlog.Tp)
+	}
+
+	return nil
+}
+
+// tableWorker returns the index of the worker executing the DMLs of table.
+func tableWorker(table string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(table))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// dispatch sends the cached DMLs of the worker to its goroutine, it blocks if the worker is busy.
+func (s *mysqlSink) dispatch(w *sinkWorker) {
+	if len(w.dmls) == 0 {
+		return
+	}
+	s.pending.Add(1)
+	w.batches <- w.dmls
+	w.dmls = nil
+}
+
+func (s *mysqlSink) runWorker(w *sinkWorker) {
+	for batch := range w.batches {
+		// the batches after an error are skipped, the apply is stopped by the error
+		if s.workerErr() == nil {
+			if err := s.execBatch(batch); err != nil {
+				s.errMu.Lock()
+				if s.err == nil {
+					s.err = err
+				}
+				s.errMu.Unlock()
+			}
+		}
+		s.pending.Done()
+	}
+}
+
+func (s *mysqlSink) workerErr() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// Flush executes the cached DML statements of all workers, and waits for them.
+func (s *mysqlSink) Flush() error {
+	for _, w := range s.workers {
+		s.dispatch(w)
+	}
+	s.pending.Wait()
+	return errors.Trace(s.workerErr())
+}
+
+// execBatch executes the DML statements in one transaction.
+func (s *mysqlSink) execBatch(dmls []string) error {
+	s.limiter.wait(dmls)
+	return s.withRetry(func() error {
+		txn, err := s.db.Begin()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, dml := range dmls {
+			if _, err := txn.Exec(dml); err != nil {
+				txn.Rollback()
+				return errors.Annotatef(err, "execute %s", dml)
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			return errors.Trace(&commitError{err: err})
+		}
+		return nil
+	})
+}
+
+// commitError is returned when the commit of a transaction failed, the transaction may be committed in
+// dest-db already, e.g. the connection is broken after the commit is sent.
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string {
+	return fmt.Sprintf("commit: %v", e.err)
+}
+
+// isRetryableExecError returns false if the transaction may be committed by the failed commit, executing
+// it again applies the INSERT statements twice unless they are in safe mode.
+func isRetryableExecError(err error, safeMode bool) bool {
+	if _, ok := errors.Cause(err).(*commitError); ok {
+		return safeMode
+	}
+	return true
+}
+
+// execDDL executes the statements of DDL in one connection, so the `use db` statement in it takes effect.
+func (s *mysqlSink) execDDL(ddl string) error {
+	stmts, _, err := parser.New().Parse(ddl, "", "")
+	if err != nil {
+		return errors.Annotatef(err, "parse ddl %s", ddl)
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	schema, _, err := parserSchemaTableFromDDL(ddl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	log.Info("execute ddl in downstream", zap.String("ddl", ddl))
+	s.limiter.wait([]string{ddl})
+	err = s.withRetry(func() error {
+		conn, err := s.db.Conn(context.Background())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer conn.Close()
+
+		// the database is not created in downstream if the create database DDL is before the recovery range
+		if len(schema) != 0 {
+			createDB := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema))
+			if _, err := conn.ExecContext(context.Background(), createDB); err != nil {
+				return errors.Annotatef(err, "execute %s", createDB)
+			}
+		}
+		for _, stmt := range stmts {
+			if _, err := conn.ExecContext(context.Background(), stmt.Text()); err != nil {
+				return errors.Annotatef(err, "execute %s", stmt.Text())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	s.tableInfos = make(map[string]*tableInfo)
+	return nil
+}
+
+func (s *mysqlSink) getTableInfo(schema, table string) (*tableInfo, error) {
+	key := quoteSchema(schema, table)
+	if info, ok := s.tableInfos[key]; ok {
+		return info, nil
+	}
+
+	info, err := getTableInfo(s.db, schema, table)
+	if err != nil {
+		return nil, errors.Annotatef(err, "get table info of %s from downstream", key)
+	}
+	s.tableInfos[key] = info
+	return info, nil
+}
+
+// withRetry calls fn until it succeeds or fails maxRetry times, the failed commit is not retried unless in safe mode.
+func (s *mysqlSink) withRetry(fn func() error) error {
+	var err error
+	for i := 0; i <= s.maxRetry; i++ {
+		if i > 0 {
+			log.Warn("execute failed, will retry", zap.Int("retry", i), zap.Error(err))
+			time.Sleep(retryInterval * time.Duration(i))
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isRetryableExecError(err, s.safeMode) {
+			break
+		}
+	}
+	return errors.Trace(err)
+}
+
+// Close flushes the cached DMLs, and closes the connection.
+func (s *mysqlSink) Close() error {
+	err := s.Flush()
+	s.stopWorkers()
+	if err1 := s.db.Close(); err == nil {
+		err = err1
+	}
+	return errors.Trace(err)
+}
+
+func (s *mysqlSink) abort() {
+	s.stopWorkers()
+	s.db.Close()
+}
+
+// stopWorkers stops the goroutines of workers after the batches sent to them.
+func (s *mysqlSink) stopWorkers() {
+	s.stopOnce.Do(func() {
+		for _, w := range s.workers {
+			close(w.batches)
+		}
+	})
+}
+
+// applyOutput replays the merged binlogs in outputDir to the sink in the order of commit ts,
+// it stops when ctx is canceled. The sink is closed when it returns.
+func applyOutput(ctx context.Context, outputDir string, opts runOptions, sink binlogSink) error {
+	count, err := replayDir(ctx, outputDir, opts, sink.Apply)
+	if err != nil {
+		sink.abort()
+		return errors.Trace(err)
+	}
+
+	if err = sink.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("apply merged binlogs finished", zap.Int("binlogs", count))
+	return nil
+}
+
+// replayDir calls apply with the merged binlogs of the table dirs in dir in the order of commit ts,
+// it returns the number of binlogs applied.
+func replayDir(ctx context.Context, dir string, opts runOptions, apply func(binlog *pb.Binlog) error) (int, error) {
+	tables, err := readSubDirs(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	readers := make([]PbReader, 0, len(tables))
+	for _, table := range tables {
+		reader, err := newDirPbReader(filepath.Join(dir, table), 0, 0, opts)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		defer reader.close()
+		readers = append(readers, reader)
+	}
+
+	reader := newMergePbReader(readers)
+	var count int
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, errors.Trace(err)
+		}
+		binlog, err := reader.read()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return count, nil
+			}
+			return count, errors.Trace(err)
+		}
+
+		if err = apply(binlog); err != nil {
+			return count, errors.Annotatef(err, "apply binlog with commit ts %d", binlog.CommitTs)
+		}
+		count++
+	}
+}
+
+// withSessionVariable returns the DSN setting the session variable in every connection.
+func withSessionVariable(dsn, name, value string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.Annotatef(err, "parse downstream %s", redactDSN(dsn))
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params[name] = value
+	return cfg.FormatDSN(), nil
+}
+
+// redactDSN hides the password in DSN.
+func redactDSN(dsn string) string {
+	if len(dsn) == 0 {
+		return dsn
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "******"
+	}
+	if len(cfg.Passwd) != 0 {
+		cfg.Passwd = "******"
+	}
+	return cfg.FormatDSN()
+}
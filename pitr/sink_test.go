@@ -0,0 +1,28 @@
+package pitr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"gotest.tools/assert"
+)
+
+func TestRedactDSN(t *testing.T) {
+	dsn := redactDSN("root:secret@tcp(127.0.0.1:3306)/")
+	assert.Assert(t, !strings.Contains(dsn, "secret"))
+	assert.Assert(t, strings.Contains(dsn, "127.0.0.1:3306"))
+
+	assert.Assert(t, redactDSN("root@tcp(127.0.0.1:3306)/") == "root@tcp(127.0.0.1:3306)/")
+	assert.Assert(t, redactDSN("") == "")
+}
+
+func TestIsRetryableExecError(t *testing.T) {
+	assert.Assert(t, isRetryableExecError(errors.Annotate(errors.New("bad connection"), "execute INSERT"), false))
+	commitErr := errors.Trace(&commitError{err: errors.New("bad connection")})
+	assert.Assert(t, !isRetryableExecError(commitErr, false))
+	assert.ErrorContains(t, commitErr, "commit: bad connection")
+
+	// the statements in safe mode are idempotent
+	assert.Assert(t, isRetryableExecError(commitErr, true))
+}
@@ -0,0 +1,135 @@
+package pitr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+const (
+	slicePrefix = "slice-"
+	// sliceTimeLayout is the local start time of a slice in its dir name, so the dirs are sorted by time
+	sliceTimeLayout = "20060102-150405"
+)
+
+// sliceStart returns the start of the slice which the commit ts is in, the slices are aligned to the
+// local time, so the slices of 1h start at the beginning of every hour, and the slices of 24h start at midnight.
+func sliceStart(commitTS int64, interval time.Duration) time.Time {
+	t := oracle.GetTimeFromTS(uint64(commitTS))
+	_, offset := t.Zone()
+	zone := time.Duration(offset) * time.Second
+	return t.Add(zone).Truncate(interval).Add(-zone)
+}
+
+// sliceDirName returns the name of the dir in output dir of the slice starting at start.
+func sliceDirName(start time.Time) string {
+	return slicePrefix + start.Format(sliceTimeLayout)
+}
+
+// sliceTSORange returns the start and stop tso of the slice dir, the stop tso is exclusive.
+func sliceTSORange(dir string, interval time.Duration) (int64, int64, error) {
+	start, err := time.ParseInLocation(sliceTimeLayout, strings.TrimPrefix(dir, slicePrefix), time.Local)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "invalid slice dir %s", dir)
+	}
+	stop := start.Add(interval)
+	return int64(oracle.ComposeTS(start.UnixNano()/int64(time.Millisecond), 0)),
+		int64(oracle.ComposeTS(stop.UnixNano()/int64(time.Millisecond), 0)), nil
+}
+
+// readSliceDirs returns the slice dirs in output dir in the order of time.
+func readSliceDirs(outputDir string) ([]string, error) {
+	dirs, err := readSubDirs(outputDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	slices := dirs[:0]
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir, slicePrefix) {
+			slices = append(slices, dir)
+		}
+	}
+	return slices, nil
+}
+
+// removeSlicedOutput removes the output dir or files of the table in all the slices.
+func removeSlicedOutput(outputDir, table string) error {
+	for _, pattern := range []string{table, table + ".*"} {
+		names, err := filepath.Glob(filepath.Join(outputDir, slicePrefix+"*", pattern))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, name := range names {
+			if err := os.RemoveAll(name); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// slicedWriter writes the binlogs of a table to the slice dirs by their commit ts, the binlogs of every
+// slice are written by a binlogWriter of the output format, which is created by the first binlog in the slice.
+type slicedWriter struct {
+	outputDir string
+	// table is the name of the output of the table in every slice
+	table    string
+	format   string
+	codec    string
+	fileSize int64
+	interval time.Duration
+	opts     runOptions
+
+	writer binlogWriter
+	// start is the start of the slice written by writer
+	start time.Time
+}
+
+func newSlicedWriter(opts runOptions, format, outputDir, table, codec string, fileSize int64, interval time.Duration) *slicedWriter {
+	return &slicedWriter{
+		outputDir: outputDir,
+		table:     table,
+		format:    format,
+		codec:     codec,
+		fileSize:  fileSize,
+		interval:  interval,
+		opts:      opts,
+	}
+}
+
+func (w *slicedWriter) Write(binlog *pb.Binlog) error {
+	// the binlogs are written in the order of commit ts, a binlog before the current slice is kept in it
+	if start := sliceStart(binlog.CommitTs, w.interval); w.writer == nil || start.After(w.start) {
+		if err := w.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		writer, err := newBinlogWriter(w.opts, w.format, filepath.Join(w.outputDir, sliceDirName(start), w.table), w.codec, w.fileSize)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		w.writer, w.start = writer, start
+	}
+	return errors.Trace(w.writer.Write(binlog))
+}
+
+func (w *slicedWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+	err := w.writer.Close()
+	w.writer = nil
+	return errors.Trace(err)
+}
+
+// abort removes the output of the current slice, the earlier slices are complete.
+func (w *slicedWriter) abort() {
+	if w.writer != nil {
+		w.writer.abort()
+		w.writer = nil
+	}
+}
@@ -0,0 +1,130 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"gotest.tools/assert"
+)
+
+func timeToTSO(t time.Time) int64 {
+	return int64(oracle.ComposeTS(t.UnixNano()/int64(time.Millisecond), 0))
+}
+
+func TestSliceStart(t *testing.T) {
+	base := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	for _, c := range []struct {
+		at       time.Time
+		interval time.Duration
+		expected time.Time
+	}{
+		{base, time.Hour, base},
+		{base.Add(59 * time.Minute), time.Hour, base},
+		{base.Add(61 * time.Minute), time.Hour, base.Add(time.Hour)},
+		{base.Add(20 * time.Minute), 15 * time.Minute, base.Add(15 * time.Minute)},
+		{base, 24 * time.Hour, time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)},
+	} {
+		start := sliceStart(timeToTSO(c.at), c.interval)
+		assert.Assert(t, start.Equal(c.expected), "%s %s", c.at, start)
+	}
+
+	name := sliceDirName(base)
+	assert.Equal(t, name, "slice-20200102-100000")
+	start, stop, err := sliceTSORange(name, time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, start, timeToTSO(base))
+	assert.Equal(t, stop, timeToTSO(base.Add(time.Hour)))
+	_, _, err = sliceTSORange("slice-x", time.Hour)
+	assert.ErrorContains(t, err, "invalid slice dir")
+}
+
+func TestSlicedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-slice")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := &Merge{
+		tempDir:       filepath.Join(dir, "temp"),
+		outputDir:     filepath.Join(dir, "output"),
+		outputFormat:  outputFormatSQL,
+		compress:      compressNone,
+		sliceInterval: time.Hour,
+	}
+	assert.NilError(t, os.MkdirAll(filepath.Join(m.tempDir, "test_t1"), 0700))
+
+	base := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	w := newSlicedWriter(runOptions{}, m.outputFormat, m.outputDir, "test_t1", m.compress, 0, m.sliceInterval)
+	for _, at := range []time.Time{base, base.Add(time.Minute), base.Add(3 * time.Hour)} {
+		ddl := genTestDDL("test", "t1", "create table if not exists test.t1 (id int)", timeToTSO(at))
+		assert.NilError(t, w.Write(ddl))
+	}
+	assert.NilError(t, w.Close())
+
+	slices, err := readSliceDirs(m.outputDir)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, slices, []string{"slice-20200102-100000", "slice-20200102-130000"})
+
+	_, err = m.writeManifest()
+	assert.NilError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(m.outputDir, manifestFileName))
+	assert.NilError(t, err)
+	manifest := &outputManifest{}
+	assert.NilError(t, json.Unmarshal(data, manifest))
+	assert.Equal(t, len(manifest.Tables), 0)
+	assert.Equal(t, len(manifest.Slices), 2)
+	assert.Equal(t, manifest.Slices[1].StartTSO, timeToTSO(base.Add(3*time.Hour)))
+	assert.DeepEqual(t, manifest.Slices[0].Tables, []manifestTable{
+		{Name: "test_t1", Files: []manifestFile{{Name: "slice-20200102-100000/test_t1.sql", Size: 90}}},
+	})
+
+	// the output of the table is removed from all the slices when it's reduced again
+	assert.NilError(t, removeSlicedOutput(m.outputDir, "test_t1"))
+	for _, slice := range slices {
+		infos, err := ioutil.ReadDir(filepath.Join(m.outputDir, slice))
+		assert.NilError(t, err)
+		assert.Equal(t, len(infos), 0)
+	}
+}
+
+func TestFlushSlice(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+
+	base := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	w := &collectWriter{}
+	tm := NewTableMerge("", "", w)
+	tm.name = "test_t1"
+	tm.sliceInterval = time.Hour
+	for _, c := range []struct {
+		at    time.Time
+		event *Event
+	}{
+		{base, genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0)},
+		{base.Add(time.Minute), genSpillEvent(t, pb.EventType_Update, 1, 1, 100, 101)},
+		{base.Add(time.Hour), genSpillEvent(t, pb.EventType_Update, 1, 1, 101, 102)},
+	} {
+		binlog := newDMLBinlog(timeToTSO(c.at))
+		ev, err := c.event.toPb()
+		assert.NilError(t, err)
+		binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+
+		assert.NilError(t, tm.flushSlice(binlog.CommitTs))
+		_, err = tm.handleDML(binlog)
+		assert.NilError(t, err)
+		tm.maxCommitTS = binlog.CommitTs
+	}
+	assert.NilError(t, tm.FlushDMLBinlog(tm.maxCommitTS))
+	// the rows in the first hour are merged, but they are not merged with the update in the next hour
+	assert.DeepEqual(t, w.events, []string{"Insert id=1 v=101", "Update id=1->1 v=101->102"})
+}
@@ -0,0 +1,34 @@
+package pitr
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// inputCodec converts the files of an input format to the binlog files of drainer, which are the events read by
+// Map, so a new input format is added by registering its converter in inputCodecs without changing Map and Reduce.
+type inputCodec struct {
+	// convert converts the files in dirs, and returns the dirs of the converted binlog files, every source dir
+	// is converted to one dir. nil means the files are binlog files of drainer already.
+	convert func(r *PITR, ctx context.Context, dirs []string) ([]string, error)
+	// convertDir returns the dir saving the converted files, it's removed after the run
+	convertDir func(tempDir string) string
+}
+
+var inputCodecs = map[string]inputCodec{
+	inputFormatDrainer: {},
+	inputFormatPump:    {convert: (*PITR).convertPumpSources, convertDir: pumpConvertDir},
+	inputFormatTiCDC:   {convert: (*PITR).convertTiCDCSources, convertDir: ticdcConvertDir},
+	inputFormatMySQL:   {convert: (*PITR).convertMySQLSources, convertDir: mysqlConvertDir},
+}
+
+// inputFormats returns the names of the input formats.
+func inputFormats() string {
+	names := make([]string, 0, len(inputCodecs))
+	for name := range inputCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
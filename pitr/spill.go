@@ -0,0 +1,206 @@
+package pitr
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/goleveldb/leveldb/opt"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// the estimated memory of the structs of an event and a column besides their data
+	eventOverhead  = 160
+	columnOverhead = 144
+)
+
+// memoryQuota limits the memory used by the events of the tables in Reduce, a nil memoryQuota or zero
+// limit means no limit.
+type memoryQuota struct {
+	limit int64
+	// used and tables are updated atomically
+	used   int64
+	tables int64
+}
+
+func newMemoryQuota(limit int64) *memoryQuota {
+	return &memoryQuota{limit: limit}
+}
+
+func (q *memoryQuota) add(n int64) {
+	if q != nil {
+		atomic.AddInt64(&q.used, n)
+	}
+}
+
+// addTable updates the number of tables being reduced, the memory is shared by them.
+func (q *memoryQuota) addTable(n int64) {
+	if q != nil {
+		atomic.AddInt64(&q.tables, n)
+	}
+}
+
+// shouldSpill returns true if the quota is exceeded and the table using size bytes takes more than its share.
+func (q *memoryQuota) shouldSpill(size int64) bool {
+	if q == nil || q.limit <= 0 || atomic.LoadInt64(&q.used) <= q.limit {
+		return false
+	}
+	tables := atomic.LoadInt64(&q.tables)
+	if tables <= 0 {
+		tables = 1
+	}
+	return size > 0 && size >= q.limit/tables
+}
+
+// size returns the estimated memory used by the event.
+func (e *Event) size() int64 {
+	n := int64(eventOverhead + len(e.schema) + len(e.table) + len(e.oldKey) + len(e.newKey))
+	for _, col := range e.cols {
+		n += int64(columnOverhead + len(col.Name) + len(col.Tp) + len(col.MysqlType) + len(col.Value) + len(col.ChangedValue))
+	}
+	return n
+}
+
+// spillStore saves the events spilled from memory in leveldb, the key is the old key of event.
+type spillStore struct {
+	dir string
+	db  *leveldb.DB
+	// count is the number of events in the store
+	count int
+}
+
+// openSpillStore opens a store in dir, the files left in dir are removed.
+func openSpillStore(dir string) (*spillStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the events are read only once, so the caches are kept small
+	db, err := leveldb.OpenFile(dir, &opt.Options{
+		BlockCacheCapacity: 8 * opt.MiB,
+		WriteBuffer:        16 * opt.MiB,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "open spill store %s", dir)
+	}
+	return &spillStore{dir: dir, db: db}, nil
+}
+
+// save writes the events to the store, the events of the same keys in the store are overwritten.
+func (s *spillStore) save(events map[string]*Event) error {
+	batch := new(leveldb.Batch)
+	for key, e := range events {
+		value, err := encodeSpillEvent(e)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		batch.Put([]byte(key), value)
+	}
+	if err := s.db.Write(batch, nil); err != nil {
+		return errors.Annotatef(err, "write spill store %s", s.dir)
+	}
+	s.count += len(events)
+	return nil
+}
+
+// take removes the event of key from the store and returns it, it returns nil if key is not found.
+func (s *spillStore) take(key string) (*Event, error) {
+	value, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = s.db.Delete([]byte(key), nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.count--
+	return decodeSpillEvent(key, value)
+}
+
+// forEach calls fn with the events in the order of key.
+func (s *spillStore) forEach(fn func(e *Event) error) error {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		e, err := decodeSpillEvent(string(iter.Key()), iter.Value())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = fn(e); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(iter.Error())
+}
+
+// close closes the store and removes its files.
+func (s *spillStore) close() {
+	if err := s.db.Close(); err != nil {
+		log.Warn("close spill store failed", zap.String("dir", s.dir), zap.Error(err))
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Warn("remove spill store failed", zap.String("dir", s.dir), zap.Error(err))
+	}
+}
+
+// encodeSpillEvent encodes the event as the new key followed by the pb event, the old key is the key in store.
+func encodeSpillEvent(e *Event) ([]byte, error) {
+	ev := pb.Event{SchemaName: &e.schema, TableName: &e.table, Tp: e.eventType}
+	for _, col := range e.cols {
+		data, err := col.Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ev.Row = append(ev.Row, data)
+	}
+	data, err := ev.Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	value := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(e.newKey)+len(data))
+	value = value[:binary.PutUvarint(value, uint64(len(e.newKey)))]
+	value = append(value, e.newKey...)
+	return append(value, data...), nil
+}
+
+func decodeSpillEvent(key string, value []byte) (*Event, error) {
+	n, size := binary.Uvarint(value)
+	if size <= 0 || uint64(len(value)-size) < n {
+		return nil, errors.Errorf("invalid spilled event of key %q", key)
+	}
+	newKey := string(value[size : size+int(n)])
+
+	ev := &pb.Event{}
+	if err := ev.Unmarshal(value[size+int(n):]); err != nil {
+		return nil, errors.Annotatef(err, "decode spilled event of key %q", key)
+	}
+	cols, err := decodeColumns(ev.GetRow())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Event{
+		schema:    ev.GetSchemaName(),
+		table:     ev.GetTableName(),
+		eventType: ev.GetTp(),
+		oldKey:    key,
+		newKey:    newKey,
+		cols:      cols,
+	}, nil
+}
+
+// spillDir returns the dir to save the spilled events of tables, it's not in the temp dir because
+// the sub dirs of the temp dir are the temp files of tables.
+func spillDir(tempDir string) string {
+	return filepath.Clean(tempDir) + "_spill"
+}
@@ -0,0 +1,167 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+// collectWriter saves the events written by TableMerge.
+type collectWriter struct {
+	events []string
+}
+
+func (w *collectWriter) Write(binlog *pb.Binlog) error {
+	if binlog.Tp == pb.BinlogType_DDL {
+		w.events = append(w.events, "DDL "+string(binlog.DdlQuery))
+		return nil
+	}
+	for _, ev := range binlog.GetDmlData().GetEvents() {
+		cols, err := decodeColumns(ev.GetRow())
+		if err != nil {
+			return err
+		}
+		s := ev.GetTp().String()
+		for _, col := range cols {
+			_, value, err := codec.DecodeOne(col.Value)
+			if err != nil {
+				return err
+			}
+			s += fmt.Sprintf(" %s=%v", col.Name, collectValue(col, value))
+			if len(col.ChangedValue) != 0 {
+				_, changed, err := codec.DecodeOne(col.ChangedValue)
+				if err != nil {
+					return err
+				}
+				s += fmt.Sprintf("->%v", collectValue(col, changed))
+			}
+		}
+		w.events = append(w.events, s)
+	}
+	return nil
+}
+
+// collectValue returns the value to print, the strings are decoded as bytes, so they are formatted by the type
+// of the column like the keys.
+func collectValue(col *pb.Column, value types.Datum) interface{} {
+	if value.Kind() == types.KindBytes && len(col.Tp) != 0 {
+		value = formatValue(value, col.Tp[0])
+	}
+	return value.GetValue()
+}
+
+func (w *collectWriter) Close() error {
+	return nil
+}
+
+func (w *collectWriter) abort() {}
+
+func genSpillEvent(t *testing.T, tp pb.EventType, oldID, newID, oldValue, newValue int64) *Event {
+	col := func(name string, value, changed int64) *pb.Column {
+		c := &pb.Column{Name: name, Tp: []byte{mysql.TypeLong}, MysqlType: "int", Value: encodeDatum(t, types.NewIntDatum(value))}
+		if tp == pb.EventType_Update {
+			c.ChangedValue = encodeDatum(t, types.NewIntDatum(changed))
+		}
+		return c
+	}
+	return &Event{
+		schema:    "test",
+		table:     "t1",
+		eventType: tp,
+		oldKey:    fmt.Sprintf("%d", oldID),
+		newKey:    fmt.Sprintf("%d", newID),
+		cols:      []*pb.Column{col("id", oldID, newID), col("v", oldValue, newValue)},
+	}
+}
+
+// reduceRandomEvents merges the random changes of rows, the events are spilled if quota is not nil.
+func reduceRandomEvents(t *testing.T, seed int64, quota *memoryQuota, dir string) ([]string, bool) {
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, memQuota: quota}
+	if quota != nil {
+		tm.spillDir = filepath.Join(dir, "test_t1")
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	rows := make(map[int64]int64)
+	var spilled bool
+	for i := 0; i < 2000; i++ {
+		id := r.Int63n(50)
+		value, ok := rows[id]
+		var e *Event
+		switch {
+		case !ok:
+			rows[id] = r.Int63()
+			e = genSpillEvent(t, pb.EventType_Insert, id, id, rows[id], 0)
+		case r.Intn(3) == 0:
+			delete(rows, id)
+			e = genSpillEvent(t, pb.EventType_Delete, id, id, value, 0)
+		default:
+			// the primary key may be changed
+			newID := id
+			if n := r.Int63n(50); r.Intn(4) == 0 {
+				if _, ok := rows[n]; !ok {
+					newID = n
+				}
+			}
+			delete(rows, id)
+			rows[newID] = r.Int63()
+			e = genSpillEvent(t, pb.EventType_Update, id, newID, value, rows[newID])
+		}
+		assert.NilError(t, tm.HandleEvent(e))
+		assert.NilError(t, tm.spillEvents())
+		spilled = spilled || tm.spill != nil
+		if i == 1000 {
+			assert.NilError(t, tm.FlushDMLBinlog(1))
+		}
+	}
+	assert.NilError(t, tm.FlushDMLBinlog(2))
+	tm.releaseMemory()
+	// the events are written in the order of key, so they are not sorted here to check the output is
+	// the same whether they are spilled or not
+	return w.events, spilled
+}
+
+func TestSpillEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for seed := int64(0); seed < 5; seed++ {
+		expected, _ := reduceRandomEvents(t, seed, nil, dir)
+		for _, limit := range []int64{4096, 8192} {
+			quota := newMemoryQuota(limit)
+			events, spilled := reduceRandomEvents(t, seed, quota, dir)
+			assert.Assert(t, spilled)
+			assert.DeepEqual(t, events, expected)
+			assert.Equal(t, quota.used, int64(0))
+		}
+
+		_, err := os.Stat(filepath.Join(dir, "test_t1"))
+		assert.Assert(t, os.IsNotExist(err))
+	}
+}
+
+func TestMemoryQuota(t *testing.T) {
+	var q *memoryQuota
+	q.add(100)
+	assert.Assert(t, !q.shouldSpill(100))
+
+	q = newMemoryQuota(100)
+	q.addTable(2)
+	q.add(80)
+	assert.Assert(t, !q.shouldSpill(80))
+	q.add(40)
+	// the table using less than its share isn't spilled
+	assert.Assert(t, !q.shouldSpill(40))
+	assert.Assert(t, q.shouldSpill(80))
+}
@@ -0,0 +1,349 @@
+package pitr
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// sqlWriter writes binlogs to file as SQL statements, or in the format of encoder.
+type sqlWriter struct {
+	// encoder encodes the binlogs instead of SQL statements if it's not nil
+	encoder textEncoder
+
+	// name is the name of the file, it's written to name + ".tmp" and renamed when it's closed
+	name string
+	file *os.File
+	// encryptor encrypts the compressed data if encrypt-key-file is set
+	encryptor  io.WriteCloser
+	compressor io.WriteCloser
+	writer     *bufio.Writer
+	// written is the bytes written before compression
+	written int64
+	// opts is the settings of the run, like the safe mode of the statements and the cipher
+	opts runOptions
+}
+
+// newSQLWriter creates the sql file, codec is used to compress the file, and the file is encrypted
+// after compression if encrypt-key-file is set. The file is written to fileName + ".tmp", and renamed to
+// fileName by Close, so a file which is not written completely never has its name.
+func newSQLWriter(opts runOptions, fileName string, codec string) (*sqlWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// truncate the file, it may be written partly by the last run
+	f, err := os.OpenFile(fileName+tmpOutputSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open sql file %s", fileName)
+	}
+
+	var encryptor io.WriteCloser = nopWriteCloser{f}
+	if opts.cipher != nil {
+		if encryptor, err = newEncryptWriter(opts.cipher, f); err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	compressor, err := newCompressWriter(codec, encryptor)
+	if err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return &sqlWriter{
+		name:       fileName,
+		file:       f,
+		encryptor:  encryptor,
+		compressor: compressor,
+		writer:     bufio.NewWriter(compressor),
+		opts:       opts,
+	}, nil
+}
+
+func (w *sqlWriter) Write(binlog *pb.Binlog) error {
+	if w.encoder != nil {
+		data, err := w.encoder.encode(binlog)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		n, err := w.writer.Write(data)
+		w.written += int64(n)
+		return errors.Trace(err)
+	}
+
+	switch binlog.Tp {
+	case pb.BinlogType_DDL:
+		ddl := strings.TrimSpace(string(binlog.DdlQuery))
+		if len(ddl) == 0 {
+			return nil
+		}
+		if !strings.HasSuffix(ddl, ";") {
+			ddl += ";"
+		}
+		n, err := w.writer.WriteString(ddl + "\n")
+		w.written += int64(n)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	case pb.BinlogType_DML:
+		events := binlog.GetDmlData().GetEvents()
+		for i := range events {
+			// the rows may be routed, the table info is tracked by the source name
+			info, err := ddlHandle.GetTableInfo(w.opts.router.sourceTable(events[i].GetSchemaName(), events[i].GetTableName()))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			sqls, err := eventToSQLs(&events[i], info, w.opts.safeMode)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			for _, sql := range sqls {
+				n, err := w.writer.WriteString(sql + ";\n")
+				w.written += int64(n)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	default:
+		return errors.Errorf("unknown binlog type %v", binlog.Tp)
+	}
+
+	return nil
+}
+
+func (w *sqlWriter) Close() error {
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if err := w.compressor.Close(); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if err := w.encryptor.Close(); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if err := syncOutputFile(w.file, w.opts.syncMode); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if err := w.file.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(publishOutput(w.file.Name(), w.name, w.opts.syncMode))
+}
+
+// abort removes the file written partly.
+func (w *sqlWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// sqlColumn is a column in event, the values are formatted as SQL literals.
+type sqlColumn struct {
+	name         string
+	value        string
+	changedValue string
+}
+
+// eventToSQL generates INSERT, UPDATE or DELETE statement for the event, info is the table's info.
+func eventToSQL(ev *pb.Event, info *tableInfo) (string, error) {
+	schema := ev.GetSchemaName()
+	table := ev.GetTableName()
+
+	tp := ev.GetTp()
+	cols, err := decodeSQLColumns(ev.GetRow(), tp == pb.EventType_Update)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	cols = info.dropGeneratedColumns(cols)
+	if len(cols) == 0 {
+		return "", errors.Errorf("event of %s has no column", quoteSchema(schema, table))
+	}
+
+	var sb strings.Builder
+	switch tp {
+	case pb.EventType_Insert:
+		sb.WriteString(insertSQL("INSERT", schema, table, cols, false))
+	case pb.EventType_Update:
+		sets := make([]string, 0, len(cols))
+		for _, col := range cols {
+			sets = append(sets, fmt.Sprintf("%s = %s", quoteName(col.name), col.changedValue))
+		}
+		where := whereClause(info, cols)
+		fmt.Fprintf(&sb, "UPDATE %s SET %s WHERE %s LIMIT 1", quoteSchema(schema, table), strings.Join(sets, ","), where)
+	case pb.EventType_Delete:
+		where := whereClause(info, cols)
+		fmt.Fprintf(&sb, "DELETE FROM %s WHERE %s LIMIT 1", quoteSchema(schema, table), where)
+	default:
+		return "", errors.Errorf("unknown event type %v", tp)
+	}
+
+	return sb.String(), nil
+}
+
+// eventToSQLs generates the statements of the event, the statements are idempotent in safe mode like drainer's
+// safe mode: INSERT is replaced by REPLACE, and UPDATE is replaced by DELETE of the old row and REPLACE of the
+// new row, so they can be executed again after a partial failure.
+func eventToSQLs(ev *pb.Event, info *tableInfo, safeMode bool) ([]string, error) {
+	tp := ev.GetTp()
+	if !safeMode || (tp != pb.EventType_Insert && tp != pb.EventType_Update) {
+		sql, err := eventToSQL(ev, info)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []string{sql}, nil
+	}
+
+	schema := ev.GetSchemaName()
+	table := ev.GetTableName()
+	cols, err := decodeSQLColumns(ev.GetRow(), tp == pb.EventType_Update)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cols = info.dropGeneratedColumns(cols)
+	if len(cols) == 0 {
+		return nil, errors.Errorf("event of %s has no column", quoteSchema(schema, table))
+	}
+	if tp == pb.EventType_Insert {
+		return []string{insertSQL("REPLACE", schema, table, cols, false)}, nil
+	}
+	return []string{
+		fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1", quoteSchema(schema, table), whereClause(info, cols)),
+		insertSQL("REPLACE", schema, table, cols, true),
+	}, nil
+}
+
+// insertSQL generates the INSERT or REPLACE statement of the row, the changed values of an update are used
+// if changed is true.
+func insertSQL(verb, schema, table string, cols []sqlColumn, changed bool) string {
+	names := make([]string, 0, len(cols))
+	values := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, quoteName(col.name))
+		if changed {
+			values = append(values, col.changedValue)
+		} else {
+			values = append(values, col.value)
+		}
+	}
+	return fmt.Sprintf("%s INTO %s (%s) VALUES (%s)", verb, quoteSchema(schema, table), strings.Join(names, ","), strings.Join(values, ","))
+}
+
+// whereClause generates the condition to locate the row, uses the columns of primary key or
+// unique key if the table has, otherwise uses all the columns.
+func whereClause(info *tableInfo, cols []sqlColumn) string {
+	colMap := make(map[string]sqlColumn, len(cols))
+	for _, col := range cols {
+		colMap[col.name] = col
+	}
+
+	whereCols := cols
+	if len(info.uniqueKeys) != 0 {
+		keyCols := make([]sqlColumn, 0, len(info.uniqueKeys[0].columns))
+		for _, name := range info.uniqueKeys[0].columns {
+			col, ok := colMap[name]
+			if !ok {
+				// the key is changed by DDL, just use all the columns
+				keyCols = cols
+				break
+			}
+			keyCols = append(keyCols, col)
+		}
+		whereCols = keyCols
+	}
+
+	conds := make([]string, 0, len(whereCols))
+	for _, col := range whereCols {
+		if col.value == "NULL" {
+			conds = append(conds, fmt.Sprintf("%s IS NULL", quoteName(col.name)))
+		} else {
+			conds = append(conds, fmt.Sprintf("%s = %s", quoteName(col.name), col.value))
+		}
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func decodeSQLColumns(row [][]byte, withChangedValue bool) ([]sqlColumn, error) {
+	cols := make([]sqlColumn, 0, len(row))
+	for _, c := range row {
+		col := &pb.Column{}
+		if err := col.Unmarshal(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		value, err := formatSQLValue(col.Value, col.Tp[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "format value of column %s", col.Name)
+		}
+		sc := sqlColumn{
+			name:  col.Name,
+			value: value,
+		}
+		if withChangedValue {
+			sc.changedValue, err = formatSQLValue(col.ChangedValue, col.Tp[0])
+			if err != nil {
+				return nil, errors.Annotatef(err, "format changed value of column %s", col.Name)
+			}
+		}
+		cols = append(cols, sc)
+	}
+
+	return cols, nil
+}
+
+// formatSQLValue decodes the column value, and formats it as SQL literal.
+func formatSQLValue(data []byte, tp byte) (string, error) {
+	_, val, err := codec.DecodeOne(data)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	val = formatValue(val, tp)
+
+	switch v := val.GetValue().(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		return quoteSQLString(v), nil
+	case []byte:
+		return "x'" + hex.EncodeToString(v) + "'", nil
+	case types.BinaryLiteral:
+		return "x'" + hex.EncodeToString(v) + "'", nil
+	default:
+		return quoteSQLString(fmt.Sprintf("%v", v)), nil
+	}
+}
+
+var sqlStringReplacer = strings.NewReplacer(
+	"\\", "\\\\",
+	"'", "\\'",
+	"\x00", "\\0",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\x1a", "\\Z",
+)
+
+func quoteSQLString(s string) string {
+	return "'" + sqlStringReplacer.Replace(s) + "'"
+}
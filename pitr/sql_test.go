@@ -0,0 +1,143 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"gotest.tools/assert"
+)
+
+func encodeDatum(t *testing.T, d types.Datum) []byte {
+	b, err := codec.EncodeValue(nil, nil, d)
+	assert.Assert(t, err == nil)
+	return b
+}
+
+func TestFormatSQLValue(t *testing.T) {
+	cases := []struct {
+		value    types.Datum
+		tp       byte
+		expected string
+	}{
+		{types.NewIntDatum(-10), mysql.TypeLong, "-10"},
+		{types.NewUintDatum(10), mysql.TypeLonglong, "10"},
+		{types.NewFloat64Datum(1.5), mysql.TypeDouble, "1.5"},
+		{types.NewStringDatum("it's\n"), mysql.TypeVarchar, `'it\'s\n'`},
+		{types.NewBytesDatum([]byte{0x1, 0xab}), mysql.TypeBlob, "x'01ab'"},
+		{types.Datum{}, mysql.TypeLong, "NULL"},
+	}
+
+	for _, c := range cases {
+		value, err := formatSQLValue(encodeDatum(t, c.value), c.tp)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, value, c.expected)
+	}
+}
+
+func TestEventToSQL(t *testing.T) {
+	// table infos are cached in ddl handle, so no need to execute the DDLs
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test_sql", "tb1"), &tableInfo{
+		schema:     "test_sql",
+		table:      "tb1",
+		columns:    []string{"a", "b"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"a"}}},
+	})
+	ddlHandle.tableInfos.Store(quoteSchema("test_sql", "tb2"), &tableInfo{
+		schema:  "test_sql",
+		table:   "tb2",
+		columns: []string{"a", "b"},
+	})
+
+	genEvent := func(table string, tp pb.EventType) *pb.Event {
+		schema := "test_sql"
+		colA := &pb.Column{
+			Name:         "a",
+			Tp:           []byte{mysql.TypeLong},
+			Value:        encodeDatum(t, types.NewIntDatum(1)),
+			ChangedValue: encodeDatum(t, types.NewIntDatum(2)),
+		}
+		colB := &pb.Column{
+			Name:         "b",
+			Tp:           []byte{mysql.TypeVarchar},
+			Value:        encodeDatum(t, types.Datum{}),
+			ChangedValue: encodeDatum(t, types.NewStringDatum("x")),
+		}
+		var row [][]byte
+		for _, col := range []*pb.Column{colA, colB} {
+			data, err := col.Marshal()
+			assert.Assert(t, err == nil)
+			row = append(row, data)
+		}
+		return &pb.Event{
+			Tp:         tp,
+			SchemaName: &schema,
+			TableName:  &table,
+			Row:        row,
+		}
+	}
+
+	cases := []struct {
+		table    string
+		tp       pb.EventType
+		expected string
+	}{
+		{"tb1", pb.EventType_Insert, "INSERT INTO `test_sql`.`tb1` (`a`,`b`) VALUES (1,NULL)"},
+		{"tb1", pb.EventType_Update, "UPDATE `test_sql`.`tb1` SET `a` = 2,`b` = 'x' WHERE `a` = 1 LIMIT 1"},
+		{"tb1", pb.EventType_Delete, "DELETE FROM `test_sql`.`tb1` WHERE `a` = 1 LIMIT 1"},
+		{"tb2", pb.EventType_Delete, "DELETE FROM `test_sql`.`tb2` WHERE `a` = 1 AND `b` IS NULL LIMIT 1"},
+	}
+	for _, c := range cases {
+		info, err := ddlHandle.GetTableInfo("test_sql", c.table)
+		assert.Assert(t, err == nil)
+		sql, err := eventToSQL(genEvent(c.table, c.tp), info)
+		assert.Assert(t, err == nil)
+		assert.Equal(t, sql, c.expected)
+	}
+
+	safeCases := []struct {
+		tp       pb.EventType
+		expected []string
+	}{
+		{pb.EventType_Insert, []string{"REPLACE INTO `test_sql`.`tb1` (`a`,`b`) VALUES (1,NULL)"}},
+		{pb.EventType_Update, []string{
+			"DELETE FROM `test_sql`.`tb1` WHERE `a` = 1 LIMIT 1",
+			"REPLACE INTO `test_sql`.`tb1` (`a`,`b`) VALUES (2,'x')",
+		}},
+		{pb.EventType_Delete, []string{"DELETE FROM `test_sql`.`tb1` WHERE `a` = 1 LIMIT 1"}},
+	}
+	info, err := ddlHandle.GetTableInfo("test_sql", "tb1")
+	assert.Assert(t, err == nil)
+	for _, c := range safeCases {
+		sqls, err := eventToSQLs(genEvent("tb1", c.tp), info, true)
+		assert.Assert(t, err == nil)
+		assert.DeepEqual(t, sqls, c.expected)
+	}
+
+	dir := "./test_sql_writer"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	w, err := newBinlogWriter(runOptions{}, outputFormatSQL, dir+"/test_sql_tb1", compressNone, 0)
+	assert.Assert(t, err == nil)
+	err = w.Write(&pb.Binlog{
+		Tp:       pb.BinlogType_DDL,
+		DdlQuery: []byte("use `test_sql`;truncate table tb1"),
+	})
+	assert.Assert(t, err == nil)
+	binlog := newDMLBinlog(10)
+	binlog.DmlData.Events = append(binlog.DmlData.Events, *genEvent("tb1", pb.EventType_Insert))
+	err = w.Write(binlog)
+	assert.Assert(t, err == nil)
+	err = w.Close()
+	assert.Assert(t, err == nil)
+
+	data, err := ioutil.ReadFile(dir + "/test_sql_tb1.sql")
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(data), "use `test_sql`;truncate table tb1;\n"+cases[0].expected+";\n")
+}
@@ -0,0 +1,196 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"go.uber.org/zap"
+)
+
+const defaultDelimiter = ";"
+
+// sqlStatement is a statement split from a SQL file.
+type sqlStatement struct {
+	text string
+	// line is the line number where the statement starts
+	line int
+	// delimiter is the delimiter which ends the statement
+	delimiter string
+}
+
+// splitSQL splits content into statements like mysql client, the delimiter can be changed by a
+// `DELIMITER xx` line. the comments are removed except the executable comments like `/*!40101 ... */`.
+func splitSQL(content string) []sqlStatement {
+	var (
+		stmts     []sqlStatement
+		sb        strings.Builder
+		delimiter = defaultDelimiter
+		line      = 1
+		startLine = 1
+	)
+	emit := func() {
+		if text := strings.TrimSpace(sb.String()); len(text) != 0 {
+			stmts = append(stmts, sqlStatement{text: text, line: startLine, delimiter: delimiter})
+		}
+		sb.Reset()
+	}
+
+	for i := 0; i < len(content); {
+		if strings.TrimSpace(sb.String()) == "" {
+			startLine = line
+			// DELIMITER is a command of mysql client, it must be at the beginning of a line
+			if i == 0 || content[i-1] == '\n' {
+				end := strings.IndexByte(content[i:], '\n')
+				if end < 0 {
+					end = len(content) - i
+				}
+				fields := strings.Fields(content[i : i+end])
+				if len(fields) == 2 && strings.EqualFold(fields[0], "delimiter") {
+					delimiter = fields[1]
+					sb.Reset()
+					i += end
+					continue
+				}
+			}
+		}
+
+		c := content[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// copy the quoted string, the quote is escaped by backslash or doubled
+			j := i + 1
+			for j < len(content) {
+				if content[j] == '\\' && c != '`' {
+					j += 2
+					continue
+				}
+				if content[j] == c {
+					if j+1 < len(content) && content[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(content) {
+				j = len(content) - 1
+			}
+			sb.WriteString(content[i : j+1])
+			line += strings.Count(content[i:j+1], "\n")
+			i = j + 1
+		case c == '#' || strings.HasPrefix(content[i:], "--") && (i+2 == len(content) || isSpace(content[i+2])):
+			end := strings.IndexByte(content[i:], '\n')
+			if end < 0 {
+				end = len(content) - i
+			}
+			i += end
+		case strings.HasPrefix(content[i:], "/*"):
+			end := strings.Index(content[i+2:], "*/")
+			if end < 0 {
+				end = len(content) - i - 2
+			} else {
+				end += 2
+			}
+			comment := content[i : i+2+end]
+			if strings.HasPrefix(comment, "/*!") || strings.HasPrefix(comment, "/*T!") {
+				sb.WriteString(comment)
+			} else {
+				sb.WriteByte(' ')
+			}
+			line += strings.Count(comment, "\n")
+			i += len(comment)
+		case strings.HasPrefix(content[i:], delimiter):
+			emit()
+			i += len(delimiter)
+		default:
+			if c == '\n' {
+				line++
+			}
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	emit()
+	return stmts
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// readSQLFile reads the DDL and USE statements in file, like a schema file dumped by mysqldump,
+// the other statements like SET and INSERT are skipped, the warnings of them are sampled by sampler.
+func readSQLFile(file string, sampler *sampledLogger) ([]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := parser.New()
+	ddls := make([]string, 0, 16)
+	for _, stmt := range splitSQL(string(content)) {
+		texts := []string{stmt.text}
+		if _, err := p.ParseOneStmt(stmt.text, "", ""); err != nil {
+			// the routines and triggers are not supported by TiDB, and some statements of mysqldump like
+			// LOCK TABLES can't be parsed, they are skipped
+			if stmt.delimiter != defaultDelimiter || !startsWithDDLKeyword(stmt.text) {
+				sampler.warn("skip unsupported statement", zap.String("file", file), zap.Int("line", stmt.line), zap.Error(err))
+				continue
+			}
+			// be compatible with the old format which has one statement per line without delimiter
+			if texts = splitLines(stmt.text); len(texts) <= 1 {
+				return nil, errors.Annotatef(err, "parse the statement at line %d of %s", stmt.line, file)
+			}
+		}
+
+		for _, text := range texts {
+			node, err := p.ParseOneStmt(text, "", "")
+			if err != nil {
+				return nil, errors.Annotatef(err, "parse the statement at line %d of %s", stmt.line, file)
+			}
+			switch node.(type) {
+			case ast.DDLNode, *ast.UseStmt:
+				ddls = append(ddls, text)
+			default:
+				log.Debug("skip statement which is not DDL", zap.String("file", file), zap.String("sql", text))
+			}
+		}
+	}
+	return ddls, nil
+}
+
+// startsWithDDLKeyword returns true if the first word of the statement is a keyword of DDL or USE.
+func startsWithDDLKeyword(text string) bool {
+	// skip the beginning of executable comment like /*!50003
+	if strings.HasPrefix(text, "/*!") {
+		text = strings.TrimLeft(text[3:], "0123456789")
+	}
+	text = strings.TrimSpace(text)
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end >= 0 {
+		text = text[:end]
+	}
+	switch strings.ToUpper(text) {
+	case "CREATE", "ALTER", "DROP", "RENAME", "TRUNCATE", "USE":
+		return true
+	}
+	return false
+}
+
+// splitLines returns the not empty lines of s.
+func splitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,99 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const mysqldumpSchema = `-- MySQL dump 10.13  Distrib 5.7.29, for Linux (x86_64)
+--
+-- Host: 127.0.0.1    Database: test
+-- ------------------------------------------------------
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8 */;
+
+CREATE DATABASE /*!32312 IF NOT EXISTS*/ ` + "`test`" + ` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;
+
+USE ` + "`test`" + `;
+
+--
+-- Table structure for table ` + "`t1`" + `
+--
+
+DROP TABLE IF EXISTS ` + "`t1`" + `;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+CREATE TABLE ` + "`t1`" + ` (
+  ` + "`id`" + ` int(11) NOT NULL,
+  ` + "`name`" + ` varchar(20) DEFAULT 'a;b' COMMENT 'it''s -- not a comment',
+  PRIMARY KEY (` + "`id`" + `) /* the primary key; */
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+LOCK TABLES ` + "`t1`" + ` WRITE;
+INSERT INTO ` + "`t1`" + ` VALUES (1,'x;y');
+UNLOCK TABLES;
+
+# trigger isn't supported by TiDB
+DELIMITER ;;
+/*!50003 CREATE*/ /*!50017 DEFINER=` + "`root`@`%`" + `*/ /*!50003 TRIGGER trg BEFORE INSERT ON t1 FOR EACH ROW BEGIN
+  SET NEW.name = 'trigger';
+END */;;
+DELIMITER ;
+CREATE TABLE t2 (id int)
+`
+
+func TestSplitSQL(t *testing.T) {
+	stmts := splitSQL("create table t1 (\n  id int -- the id\n);\n\n/* comment */ drop table `a;b`;\nDELIMITER //\nselect 1; select 2//\n  delimiter ;\nselect 'it''s'")
+	assert.Equal(t, len(stmts), 4)
+	assert.Equal(t, stmts[0].text, "create table t1 (\n  id int \n)")
+	assert.Equal(t, stmts[0].line, 1)
+	assert.Equal(t, stmts[1].text, "drop table `a;b`")
+	assert.Equal(t, stmts[1].line, 5)
+	assert.Equal(t, stmts[2].text, "select 1; select 2")
+	assert.Equal(t, stmts[2].delimiter, "//")
+	assert.Equal(t, stmts[3].text, "select 'it''s'")
+	assert.Equal(t, stmts[3].delimiter, ";")
+}
+
+func TestReadSQLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "schema.sql")
+	err = ioutil.WriteFile(file, []byte(mysqldumpSchema), 0600)
+	assert.Assert(t, err == nil)
+	ddls, err := readSQLFile(file, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(ddls), 5)
+	assert.Equal(t, ddls[0], "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 */")
+	assert.Equal(t, ddls[1], "USE `test`")
+	assert.Equal(t, ddls[2], "DROP TABLE IF EXISTS `t1`")
+	assert.Equal(t, ddls[3], "CREATE TABLE `t1` (\n  `id` int(11) NOT NULL,\n  `name` varchar(20) DEFAULT 'a;b' COMMENT 'it''s -- not a comment',\n  PRIMARY KEY (`id`)  \n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	assert.Equal(t, ddls[4], "CREATE TABLE t2 (id int)")
+
+	// the old format has one statement per line
+	err = ioutil.WriteFile(file, []byte("create database test\ncreate table test.t1 (id int)\n"), 0600)
+	assert.Assert(t, err == nil)
+	ddls, err = readSQLFile(file, nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, ddls, []string{"create database test", "create table test.t1 (id int)"})
+
+	err = ioutil.WriteFile(file, []byte("create tablex t1 (id int);"), 0600)
+	assert.Assert(t, err == nil)
+	_, err = readSQLFile(file, nil)
+	assert.ErrorContains(t, err, "line 1")
+}
+
+func TestStartsWithDDLKeyword(t *testing.T) {
+	assert.Assert(t, startsWithDDLKeyword("create table t (id int)"))
+	assert.Assert(t, startsWithDDLKeyword("/*!50003 CREATE*/ TRIGGER trg"))
+	assert.Assert(t, startsWithDDLKeyword("Use test"))
+	assert.Assert(t, !startsWithDDLKeyword("LOCK TABLES `t1` WRITE"))
+	assert.Assert(t, !startsWithDDLKeyword("/*!40101 SET NAMES utf8 */"))
+}
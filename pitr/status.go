@@ -0,0 +1,74 @@
+package pitr
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// statusServer exposes the status and metrics of PITR by HTTP, or the runtime profiles.
+type statusServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+func newStatusServer(addr string, p *progress) (*statusServer, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.status()); err != nil {
+			log.Warn("write status failed", zap.Error(err))
+		}
+	})
+	return startHTTPServer("status", addr, mux)
+}
+
+// newPprofServer starts the HTTP server exposing the runtime profiles by /debug/pprof, they can be read by
+// `go tool pprof http://addr/debug/pprof/profile` while PITR is running.
+func newPprofServer(addr string) (*statusServer, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return startHTTPServer("pprof", addr, mux)
+}
+
+// startHTTPServer listens on addr and serves handler in background, name is the name of the server in logs.
+func startHTTPServer(name, addr string, handler http.Handler) (*statusServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "listen %s address %s", name, addr)
+	}
+
+	s := &statusServer{
+		listener: listener,
+		server:   &http.Server{Handler: handler},
+	}
+	go func() {
+		log.Info(name+" server started", zap.String("address", listener.Addr().String()))
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(name+" server stopped", zap.Error(err))
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *statusServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *statusServer) close() {
+	if err := s.server.Close(); err != nil {
+		log.Warn("close status server failed", zap.Error(err))
+	}
+}
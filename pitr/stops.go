@@ -0,0 +1,222 @@
+package pitr
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+// stopPrefix is the prefix of the dirs in output dir of the earlier stop points, like stop-418000000000000000
+const stopPrefix = "stop-"
+
+// stopDirName returns the name of the dir in output dir of the stop point.
+func stopDirName(stopTS int64) string {
+	return stopPrefix + strconv.FormatInt(stopTS, 10)
+}
+
+// stopTSOValue is the flag of stop-tso, which can be a comma separated list of stop points. The last one
+// is saved in StopTSO, and the earlier ones are saved in StopTSOs.
+type stopTSOValue struct {
+	c *Config
+}
+
+func (v stopTSOValue) String() string {
+	if v.c == nil {
+		return "0"
+	}
+	tsos := make([]string, 0, len(v.c.StopTSOs)+1)
+	for _, tso := range v.c.StopTSOs {
+		tsos = append(tsos, strconv.FormatInt(tso, 10))
+	}
+	return strings.Join(append(tsos, strconv.FormatInt(v.c.StopTSO, 10)), ",")
+}
+
+func (v stopTSOValue) Set(s string) error {
+	var tsos []int64
+	for _, item := range strings.Split(s, ",") {
+		tso, err := strconv.ParseInt(strings.TrimSpace(item), 10, 64)
+		if err != nil {
+			return errors.Annotatef(err, "invalid stop-tso %s", item)
+		}
+		tsos = append(tsos, tso)
+	}
+	sort.Slice(tsos, func(i, j int) bool { return tsos[i] < tsos[j] })
+	v.c.StopTSO = tsos[len(tsos)-1]
+	v.c.StopTSOs = tsos[:len(tsos)-1]
+	return nil
+}
+
+// validateStopTSOs checks the earlier stop points and the flags which can't be used with them.
+func (c *Config) validateStopTSOs() error {
+	if len(c.StopTSOs) == 0 {
+		return nil
+	}
+	if c.StopTSO == 0 {
+		return errors.New("stop-tsos requires stop-tso or stop-datetime as the last stop point")
+	}
+	stops := append([]int64(nil), c.StopTSOs...)
+	sort.Slice(stops, func(i, j int) bool { return stops[i] < stops[j] })
+	for i, stop := range stops {
+		if stop <= c.StartTSO || stop >= c.StopTSO || (i > 0 && stop == stops[i-1]) {
+			return errors.Errorf("the stop points should be distinct and in (start-tso %d, stop-tso %d), but got %d",
+				c.StartTSO, c.StopTSO, stop)
+		}
+	}
+	if c.DestType != destTypeFile || c.Flashback || c.Verify || c.BaseDir != "" || c.SliceInterval != "" || c.Lightning {
+		return errors.New("multiple stop points can't be used with dest-type mysql or kafka, flashback, verify, base-dir, slice-interval or lightning, they read the output of one stop point")
+	}
+	if c.TempStore == tempStoreKV {
+		return errors.Errorf("multiple stop points can't be used with temp-store %s, the events are not read in the order of commit ts", tempStoreKV)
+	}
+	return nil
+}
+
+// removeStopOutput removes the output dir or files of the table in the dirs of all the stop points.
+func removeStopOutput(outputDir string, stops []int64, table string) error {
+	for _, stop := range stops {
+		for _, pattern := range []string{table, table + ".*"} {
+			names, err := filepath.Glob(filepath.Join(outputDir, stopDirName(stop), pattern))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			for _, name := range names {
+				if err := os.RemoveAll(name); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeStopSchemas writes the schema at the stop points before commitTS to their dirs, it's called by Map
+// before the binlog of commitTS is handled, so the schema tracker has all the DDLs before the stop points.
+func (m *Merge) writeStopSchemas(commitTS int64) error {
+	for ; len(m.pendingStops) > 0 && m.pendingStops[0] < commitTS; m.pendingStops = m.pendingStops[1:] {
+		if _, err := m.writeSchemaTo(filepath.Join(m.outputDir, stopDirName(m.pendingStops[0]))); err != nil {
+			return errors.Annotatef(err, "write schema file at stop-tso %s", formatTSO(m.pendingStops[0]))
+		}
+	}
+	return nil
+}
+
+// stopWriter writes the binlogs of a table at an earlier stop point, the writer is created by the first
+// binlog, so the tables without binlogs before the stop point have no output in its dir.
+type stopWriter struct {
+	stopTS int64
+	// newWriter creates the writer of the output format in the dir of the stop point
+	newWriter func() (binlogWriter, error)
+
+	writer binlogWriter
+}
+
+func (w *stopWriter) Write(binlog *pb.Binlog) error {
+	if w.writer == nil {
+		writer, err := w.newWriter()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		w.writer = writer
+	}
+	return errors.Trace(w.writer.Write(binlog))
+}
+
+func (w *stopWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+	err := w.writer.Close()
+	w.writer = nil
+	return errors.Trace(err)
+}
+
+func (w *stopWriter) abort() {
+	if w.writer != nil {
+		w.writer.abort()
+		w.writer = nil
+	}
+}
+
+// newStopWriters returns the writers of the table at the earlier stop points in the order of stop ts.
+func (m *Merge) newStopWriters(table string) []*stopWriter {
+	writers := make([]*stopWriter, 0, len(m.stops))
+	for _, stop := range m.stops {
+		output := filepath.Join(m.outputDir, stopDirName(stop), table)
+		writers = append(writers, &stopWriter{
+			stopTS: stop,
+			newWriter: func() (binlogWriter, error) {
+				return newBinlogWriter(m.opts, m.outputFormat, output, m.compress, m.outputFileSize)
+			},
+		})
+	}
+	return writers
+}
+
+// flushStops writes the merged rows to the stop points before the binlog of commitTS and closes their
+// writers. The rows are kept and merged with the later binlogs, so one pass over the binlogs writes the
+// state of the table at every stop point.
+func (tm *TableMerge) flushStops(commitTS int64) error {
+	for len(tm.stops) > 0 && tm.stops[0].stopTS < commitTS {
+		stop := tm.stops[0]
+		_, err := tm.writeMergedRows(tm.maxCommitTS, func(binlog *pb.Binlog) error {
+			if keep, err := applyHook(tm.hook, binlog); err != nil || !keep {
+				return errors.Trace(err)
+			}
+			if err := tm.router.routeBinlog(binlog); err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(stop.Write(binlog))
+		})
+		if err != nil {
+			return errors.Annotatef(err, "write the rows at stop-tso %s", formatTSO(stop.stopTS))
+		}
+		tm.stops = tm.stops[1:]
+		if err := stop.Close(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// abortStops removes the output of the stop points not flushed when the table fails.
+func (tm *TableMerge) abortStops() {
+	for _, stop := range tm.stops {
+		stop.abort()
+	}
+	tm.stops = nil
+}
+
+// manifestStop is the output at an earlier stop point in its dir of output dir, it's replayed like the
+// output dir to restore to StopTSO.
+type manifestStop struct {
+	Name          string          `json:"name"`
+	StopTSO       int64           `json:"stop-tso"`
+	SchemaFile    string          `json:"schema-file,omitempty"`
+	SchemaVersion int64           `json:"schema-version,omitempty"`
+	Tables        []manifestTable `json:"tables"`
+}
+
+// manifestStops returns the output of the tables at the earlier stop points.
+func (m *Merge) manifestStops(tables []string) ([]manifestStop, error) {
+	var stops []manifestStop
+	for _, stop := range m.stops {
+		s := manifestStop{Name: stopDirName(stop), StopTSO: stop}
+		if _, err := os.Stat(filepath.Join(m.outputDir, s.Name, schemaFileName)); err == nil {
+			s.SchemaFile = path.Join(s.Name, schemaFileName)
+		}
+		var revisions map[string]schemaRevision
+		s.SchemaVersion, revisions = schemaRevisions(m.ddlJobs, stop, m.opts.sampler)
+		var err error
+		if s.Tables, err = m.manifestTables(tables, s.Name, revisions); err != nil {
+			return nil, errors.Trace(err)
+		}
+		stops = append(stops, s)
+	}
+	return stops, nil
+}
@@ -0,0 +1,72 @@
+package pitr
+
+import (
+	"math"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestStopTSOFlag(t *testing.T) {
+	cfg := NewConfig()
+	assert.NilError(t, cfg.FlagSet.Parse([]string{"--data-dir", "data", "--stop-tso", "300, 100,200"}))
+	assert.Equal(t, cfg.StopTSO, int64(300))
+	assert.DeepEqual(t, cfg.StopTSOs, []int64{100, 200})
+	assert.NilError(t, cfg.validate())
+
+	cfg.StartTSO = 100
+	assert.ErrorContains(t, cfg.validate(), "should be distinct and in (start-tso 100, stop-tso 300), but got 100")
+	cfg.StartTSO = 0
+	cfg.SliceInterval = "1h"
+	assert.ErrorContains(t, cfg.validate(), "multiple stop points can't be used with")
+
+	cfg = NewConfig()
+	assert.ErrorContains(t, cfg.FlagSet.Parse([]string{"--stop-tso", "100,x"}), "invalid stop-tso x")
+}
+
+func TestFlushStops(t *testing.T) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "t1"), &tableInfo{
+		schema:     "test",
+		table:      "t1",
+		columns:    []string{"id", "v"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"id"}}},
+	})
+
+	w := &collectWriter{}
+	stopWriters := []*collectWriter{{}, {}, {}}
+	tm := NewTableMerge("", "", w)
+	tm.name = "test_t1"
+	for i, stopTS := range []int64{5, 15, 25} {
+		tm.stops = append(tm.stops, &stopWriter{stopTS: stopTS, writer: stopWriters[i]})
+	}
+	for _, c := range []struct {
+		commitTS int64
+		event    *Event
+	}{
+		{10, genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0)},
+		{15, genSpillEvent(t, pb.EventType_Update, 1, 1, 100, 101)},
+		{20, genSpillEvent(t, pb.EventType_Update, 1, 1, 101, 102)},
+		{30, genSpillEvent(t, pb.EventType_Delete, 1, 1, 102, 0)},
+	} {
+		binlog := newDMLBinlog(c.commitTS)
+		ev, err := c.event.toPb()
+		assert.NilError(t, err)
+		binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+
+		assert.NilError(t, tm.flushStops(binlog.CommitTs))
+		_, err = tm.handleDML(binlog)
+		assert.NilError(t, err)
+		tm.maxCommitTS = binlog.CommitTs
+	}
+	assert.NilError(t, tm.flushStops(math.MaxInt64))
+	assert.NilError(t, tm.FlushDMLBinlog(tm.maxCommitTS))
+
+	// every stop point has the rows merged up to it, and the rows are still merged with the later binlogs
+	assert.Equal(t, len(stopWriters[0].events), 0)
+	assert.DeepEqual(t, stopWriters[1].events, []string{"Insert id=1 v=101"})
+	assert.DeepEqual(t, stopWriters[2].events, []string{"Insert id=1 v=102"})
+	assert.Equal(t, len(w.events), 0)
+	assert.Equal(t, len(tm.stops), 0)
+}
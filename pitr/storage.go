@@ -0,0 +1,161 @@
+package pitr
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	bf "github.com/pingcap/tidb-binlog/pkg/binlogfile"
+)
+
+// Storage is where the binlog files are saved, it can be a local directory
+// or an S3-compatible object storage.
+type Storage interface {
+	// ReadBinlogNames returns the sorted binlog file names in the storage.
+	ReadBinlogNames() ([]string, error)
+	// Open opens the file for reading, and returns the size of the file.
+	Open(name string) (io.ReadCloser, int64, error)
+	// FullPath returns the uri of the file, which can be passed to openBinlogFile. It may have the credentials
+	// of the storage, redact it by redactStorageURI before writing it to log or errors.
+	FullPath(name string) string
+}
+
+// NewStorage creates a Storage from uri, uri without scheme means a local directory.
+// s3 uri looks like `s3://bucket/prefix?endpoint=http://127.0.0.1:9000&region=us-east-1`.
+func NewStorage(uri string) (Storage, error) {
+	if !strings.Contains(uri, "://") {
+		return &localStorage{dir: uri}, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse storage uri %s", redactStorageURI(uri))
+	}
+
+	switch u.Scheme {
+	case "local", "file":
+		return &localStorage{dir: u.Path}, nil
+	case "s3":
+		return newS3Storage(u)
+	default:
+		return nil, errors.Errorf("unsupported storage scheme %s", u.Scheme)
+	}
+}
+
+// openBinlogFile opens the file with the full path returned by searchFiles,
+// the compressed file is decompressed transparently, and the encrypted file is decrypted by c.
+// the returned size is the size of file before decompressing.
+func openBinlogFile(fullPath string, c *payloadCipher) (io.ReadCloser, int64, error) {
+	dir, name, err := splitStorageURI(fullPath)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	s, err := NewStorage(dir)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	rc, size, err := s.Open(name)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	// the binlog files may be compressed, decompress them by the suffix of file name
+	r, err := newDecompressReader(name, rc, c)
+	if err != nil {
+		rc.Close()
+		return nil, 0, errors.Trace(err)
+	}
+	return r, size, nil
+}
+
+// splitStorageURI splits the full path of the file into storage uri and file name.
+func splitStorageURI(fullPath string) (string, string, error) {
+	if !strings.Contains(fullPath, "://") {
+		dir, name := filepath.Split(fullPath)
+		return dir, name, nil
+	}
+
+	u, err := url.Parse(fullPath)
+	if err != nil {
+		return "", "", errors.Annotatef(err, "parse storage uri %s", redactStorageURI(fullPath))
+	}
+	name := path.Base(u.Path)
+	u.Path = path.Dir(u.Path)
+	return u.String(), name, nil
+}
+
+// filterBinlogNames returns the valid binlog file names in names, sorted by index.
+func filterBinlogNames(names []string) []string {
+	binlogNames := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, _, err := bf.ParseBinlogName(name); err != nil {
+			continue
+		}
+		binlogNames = append(binlogNames, name)
+	}
+	sort.Strings(binlogNames)
+
+	return binlogNames
+}
+
+// redactStorageURI hides the secret key in uri, so the uri can be printed to log.
+func redactStorageURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+	query := u.Query()
+	for _, key := range []string{"secret-access-key", "secret_access_key"} {
+		if query.Get(key) != "" {
+			query.Set(key, "xxxxxx")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactStorageURIs hides the secret keys in uris, the full paths of the files on S3 have the credentials of the
+// storage, so they should be redacted before written to log.
+func redactStorageURIs(uris []string) []string {
+	redacted := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		redacted = append(redacted, redactStorageURI(uri))
+	}
+	return redacted
+}
+
+type localStorage struct {
+	dir string
+}
+
+var _ Storage = &localStorage{}
+
+func (s *localStorage) ReadBinlogNames() ([]string, error) {
+	return bf.ReadBinlogNames(s.dir)
+}
+
+func (s *localStorage) Open(name string) (io.ReadCloser, int64, error) {
+	fullPath := s.FullPath(name)
+	fd, err := os.OpenFile(fullPath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, 0, errors.Annotatef(err, "open file %s error", fullPath)
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, 0, errors.Annotatef(err, "get file stat %s error", fullPath)
+	}
+
+	return fd, stat.Size(), nil
+}
+
+func (s *localStorage) FullPath(name string) string {
+	return filepath.Join(s.dir, name)
+}
@@ -0,0 +1,268 @@
+// Package storage saves the events split by Map in an embedded LSM store. The events of a table are
+// grouped by the DDL before them, and the events of a row are adjacent in the order of commit ts, so
+// Reduce can merge the events one row at a time without holding the whole table in memory.
+//
+// The keys of a table are prefixed by the length of the table name and the name, followed by
+//
+//	segment | 0x00                                       the DDL which ends the segment
+//	segment | 0x01 | row key | commit ts | sequence      the DML event of a row
+//	0xff... | 0xff                                       the max commit ts of the DML events
+//
+// segment is the commit ts of the DDL which starts the segment, 0 for the first one. All the integers are
+// big endian, so the keys are sorted in the order of segment, row and commit ts.
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/goleveldb/leveldb/opt"
+	"github.com/pingcap/goleveldb/leveldb/util"
+)
+
+// Kind is the kind of a record.
+type Kind byte
+
+const (
+	// KindDDL is the DDL which ends a segment
+	KindDDL Kind = 0x00
+	// KindEvent is a DML event
+	KindEvent Kind = 0x01
+
+	kindMeta Kind = 0xff
+)
+
+// syncKey is out of the keys of tables, it's written to sync the store.
+var syncKey = []byte{0xff, 0xff, 0xff, 0xff}
+
+// Record is a record of a table in the store.
+type Record struct {
+	Kind    Kind
+	Segment int64
+	// RowKey, CommitTS and Seq are only set for KindEvent
+	RowKey   string
+	CommitTS int64
+	Seq      uint32
+	Value    []byte
+}
+
+// Store is an embedded LSM store in a dir, it's safe to be used concurrently.
+type Store struct {
+	dir string
+	db  *leveldb.DB
+}
+
+// Open opens the store in dir, it's created if not exists.
+func Open(dir string) (*Store, error) {
+	db, err := leveldb.OpenFile(dir, &opt.Options{
+		BlockCacheCapacity: 32 * opt.MiB,
+		WriteBuffer:        64 * opt.MiB,
+		// the store is read only once in Reduce
+		CompactionTableSize: 32 * opt.MiB,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "open store %s", dir)
+	}
+	return &Store{dir: dir, db: db}, nil
+}
+
+// Dir returns the dir of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return errors.Trace(s.db.Close())
+}
+
+// Write writes the batch to the store.
+func (s *Store) Write(b *Batch) error {
+	return errors.Trace(s.db.Write(&b.b, nil))
+}
+
+// Sync flushes all the written batches to disk.
+func (s *Store) Sync() error {
+	b := new(leveldb.Batch)
+	b.Put(syncKey, nil)
+	return errors.Trace(s.db.Write(b, &opt.WriteOptions{Sync: true}))
+}
+
+// Tables returns the tables in the store in order.
+func (s *Store) Tables() ([]string, error) {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var tables []string
+	for ok := iter.First(); ok && !bytes.Equal(iter.Key(), syncKey); {
+		table, _, err := splitTable(iter.Key())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tables = append(tables, table)
+		// the meta key is the last key of the table
+		ok = iter.Seek(append(metaKey(table), 0))
+	}
+	return tables, errors.Trace(iter.Error())
+}
+
+// TableSize returns the approximate size of the table on disk.
+func (s *Store) TableSize(table string) (int64, error) {
+	sizes, err := s.db.SizeOf([]util.Range{*util.BytesPrefix(tablePrefix(table))})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return sizes.Sum(), nil
+}
+
+// MaxCommitTS returns the max commit ts of the DML events of the table, 0 if there is no DML event.
+func (s *Store) MaxCommitTS(table string) (int64, error) {
+	value, err := s.db.Get(metaKey(table), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if len(value) != 8 {
+		return 0, errors.Errorf("invalid max commit ts of table %s", table)
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// Scan calls fn with the DDL and event records of the table in order, the value of record is only
+// valid in fn.
+func (s *Store) Scan(table string, fn func(r *Record) error) error {
+	iter := s.db.NewIterator(util.BytesPrefix(tablePrefix(table)), nil)
+	defer iter.Release()
+
+	prefixLen := len(tablePrefix(table))
+	for iter.Next() {
+		r, err := decodeRecord(iter.Key()[prefixLen:])
+		if err != nil {
+			return errors.Annotatef(err, "decode key of table %s", table)
+		}
+		if r.Kind == kindMeta {
+			continue
+		}
+		r.Value = iter.Value()
+		if err = fn(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(iter.Error())
+}
+
+// Batch is a batch of records written to the store atomically.
+type Batch struct {
+	b    leveldb.Batch
+	size int64
+}
+
+// PutDDL puts the DDL which ends the segment of the table.
+func (b *Batch) PutDDL(table string, segment int64, value []byte) {
+	key := appendUint64(tablePrefix(table), uint64(segment))
+	key = append(key, byte(KindDDL))
+	b.put(key, value)
+}
+
+// PutEvent puts the DML event of the row in the segment of the table, seq orders the events of the
+// row with the same commit ts.
+func (b *Batch) PutEvent(table string, segment int64, rowKey string, commitTS int64, seq uint32, value []byte) {
+	key := appendUint64(tablePrefix(table), uint64(segment))
+	key = append(key, byte(KindEvent))
+	key = appendString(key, rowKey)
+	key = appendUint64(key, uint64(commitTS))
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[len(key)-4:], seq)
+	b.put(key, value)
+}
+
+// PutMaxCommitTS puts the max commit ts of the DML events of the table, it overwrites the last one,
+// so the events of a table should be put in the order of commit ts.
+func (b *Batch) PutMaxCommitTS(table string, commitTS int64) {
+	b.put(metaKey(table), appendUint64(nil, uint64(commitTS)))
+}
+
+func (b *Batch) put(key, value []byte) {
+	b.b.Put(key, value)
+	b.size += int64(len(key) + len(value))
+}
+
+// Len returns the number of records in the batch.
+func (b *Batch) Len() int {
+	return b.b.Len()
+}
+
+// Size returns the bytes of keys and values in the batch.
+func (b *Batch) Size() int64 {
+	return b.size
+}
+
+// Reset resets the batch, so it can be reused.
+func (b *Batch) Reset() {
+	b.b.Reset()
+	b.size = 0
+}
+
+func tablePrefix(table string) []byte {
+	return appendString(make([]byte, 0, 4+len(table)+32), table)
+}
+
+func metaKey(table string) []byte {
+	key := appendUint64(tablePrefix(table), math.MaxUint64)
+	return append(key, byte(kindMeta))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("key is too short")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return "", nil, errors.New("key is too short")
+	}
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
+
+func splitTable(key []byte) (string, []byte, error) {
+	return readString(key)
+}
+
+// decodeRecord decodes the key without table prefix.
+func decodeRecord(key []byte) (*Record, error) {
+	if len(key) < 9 {
+		return nil, errors.New("key is too short")
+	}
+	r := &Record{Segment: int64(binary.BigEndian.Uint64(key)), Kind: Kind(key[8])}
+	if r.Kind != KindEvent {
+		return r, nil
+	}
+
+	rowKey, rest, err := readString(key[9:])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(rest) != 12 {
+		return nil, errors.New("invalid key of event")
+	}
+	r.RowKey = rowKey
+	r.CommitTS = int64(binary.BigEndian.Uint64(rest))
+	r.Seq = binary.BigEndian.Uint32(rest[8:])
+	return r, nil
+}
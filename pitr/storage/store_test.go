@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir)
+	assert.NilError(t, err)
+
+	b := new(Batch)
+	b.PutEvent("test_t2", 0, "b", 20, 0, []byte("t2 b"))
+	b.PutEvent("test_t1", 30, "a", 40, 1, []byte("a 40 1"))
+	b.PutEvent("test_t1", 0, "b", 10, 0, []byte("b 10"))
+	b.PutEvent("test_t1", 0, "a", 20, 0, []byte("a 20"))
+	b.PutEvent("test_t1", 0, "a", 10, 0, []byte("a 10"))
+	b.PutEvent("test_t1", 30, "a", 40, 0, []byte("a 40 0"))
+	b.PutDDL("test_t1", 0, []byte("ddl 30"))
+	b.PutMaxCommitTS("test_t1", 40)
+	assert.Equal(t, b.Len(), 8)
+	assert.Assert(t, b.Size() > 0)
+	assert.NilError(t, s.Write(b))
+	assert.NilError(t, s.Sync())
+
+	// the store is reopened after crash
+	assert.NilError(t, s.Close())
+	s, err = Open(dir)
+	assert.NilError(t, err)
+	defer s.Close()
+
+	tables, err := s.Tables()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tables, []string{"test_t1", "test_t2"})
+
+	ts, err := s.MaxCommitTS("test_t1")
+	assert.NilError(t, err)
+	assert.Equal(t, ts, int64(40))
+	ts, err = s.MaxCommitTS("test_t2")
+	assert.NilError(t, err)
+	assert.Equal(t, ts, int64(0))
+
+	var records []string
+	err = s.Scan("test_t1", func(r *Record) error {
+		records = append(records, fmt.Sprintf("%d %d %s %d %d %s", r.Kind, r.Segment, r.RowKey, r.CommitTS, r.Seq, r.Value))
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, records, []string{
+		"0 0  0 0 ddl 30",
+		"1 0 a 10 0 a 10",
+		"1 0 a 20 0 a 20",
+		"1 0 b 10 0 b 10",
+		"1 30 a 40 0 a 40 0",
+		"1 30 a 40 1 a 40 1",
+	})
+}
@@ -0,0 +1,100 @@
+package pitr
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestS3Storage(t *testing.T) {
+	objects := make(map[string][]byte)
+	var nextTS int64 = 1
+	for i := 0; i < 3; i++ {
+		var data []byte
+		for j := 0; j < 2; j++ {
+			binlog := &pb.Binlog{
+				CommitTs: nextTS,
+				Tp:       pb.BinlogType_DDL,
+				DdlQuery: []byte("create database test"),
+			}
+			nextTS++
+			payload, err := binlog.Marshal()
+			assert.Assert(t, err == nil)
+			data = append(data, binlogfile.Encode(payload)...)
+		}
+		objects["prefix/"+binlogfile.BinlogName(uint64(i))] = data
+	}
+	objects["prefix/savepoint"] = []byte("commitTS = 1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket" {
+			assert.Assert(t, r.URL.Query().Get("prefix") == "prefix/")
+			var sb strings.Builder
+			sb.WriteString("<ListBucketResult><IsTruncated>false</IsTruncated>")
+			for key, data := range objects {
+				sb.WriteString(fmt.Sprintf("<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(data)))
+			}
+			sb.WriteString("</ListBucketResult>")
+			w.Write([]byte(sb.String()))
+			return
+		}
+
+		data, ok := objects[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	uri := "s3://bucket/prefix?endpoint=" + server.URL
+	files, err := searchFiles(uri)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(files) == 3)
+
+	files, fileSize, err := filterFiles(files, 0, 0, runOptions{})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(files) == 3)
+	assert.Assert(t, fileSize > 0)
+
+	reader, err := newDirPbReader(uri, 2, 5, runOptions{})
+	assert.Assert(t, err == nil)
+	binlogs, err := readAll(reader)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(binlogs) == 4)
+}
+
+func TestRedactStorageURI(t *testing.T) {
+	uri := redactStorageURI("s3://bucket/prefix?access-key=ak&secret-access-key=sk")
+	assert.Assert(t, !strings.Contains(uri, "sk"))
+	assert.Assert(t, strings.Contains(uri, "ak"))
+
+	assert.Assert(t, redactStorageURI("/data/binlog") == "/data/binlog")
+
+	// the full paths of the files on S3 have the credentials
+	s, err := NewStorage("s3://bucket/prefix?access-key=ak&secret-access-key=sk")
+	assert.Assert(t, err == nil)
+	files := redactStorageURIs([]string{s.FullPath("binlog-0000000000000001"), "/data/binlog-0000000000000002"})
+	assert.Assert(t, !strings.Contains(files[0], "sk"))
+	assert.Assert(t, strings.Contains(files[0], "binlog-0000000000000001"))
+	assert.Assert(t, files[1] == "/data/binlog-0000000000000002")
+}
+
+func TestSplitStorageURI(t *testing.T) {
+	dir, name, err := splitStorageURI("s3://bucket/prefix/binlog-0000000000000001?region=us-west-1")
+	assert.Assert(t, err == nil)
+	assert.Assert(t, dir == "s3://bucket/prefix?region=us-west-1")
+	assert.Assert(t, name == "binlog-0000000000000001")
+
+	dir, name, err = splitStorageURI("/data/binlog-0000000000000001")
+	assert.Assert(t, err == nil)
+	assert.Assert(t, dir == "/data/")
+	assert.Assert(t, name == "binlog-0000000000000001")
+}
@@ -0,0 +1,78 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	// syncModeNone renames the output files without fsync, a crash of the host may lose the renamed data
+	syncModeNone = "none"
+	// syncModeFile fsyncs every output file before it's renamed
+	syncModeFile = "file"
+	// syncModeDir also fsyncs the dir after renaming, so the renaming is durable too
+	syncModeDir = "dir"
+
+	// tmpOutputSuffix is the suffix of the output files and pb dirs being written, they're renamed
+	// to the names without it when they're complete
+	tmpOutputSuffix = ".tmp"
+)
+
+func isValidSyncMode(mode string) bool {
+	return mode == syncModeNone || mode == syncModeFile || mode == syncModeDir
+}
+
+// syncOutputFile fsyncs f unless sync-mode is none.
+func syncOutputFile(f *os.File, mode string) error {
+	if mode == syncModeNone {
+		return nil
+	}
+	return errors.Annotatef(f.Sync(), "sync %s", f.Name())
+}
+
+// syncOutputDirFiles fsyncs all the files in dir unless sync-mode is none.
+func syncOutputDirFiles(dir, mode string) error {
+	if mode == syncModeNone {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		// Windows can only flush the files opened for writing
+		f, err := os.OpenFile(filepath.Join(dir, info.Name()), os.O_RDWR, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = syncOutputFile(f, mode)
+		f.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// publishOutput renames the complete output tmp to name, and fsyncs the dir of name with sync-mode dir.
+// name is replaced if it exists, a dir is removed first because it can't be replaced by renaming.
+func publishOutput(tmp, name, mode string) error {
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		if err := os.RemoveAll(name); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return errors.Annotatef(err, "rename output %s", tmp)
+	}
+	if mode != syncModeDir {
+		return nil
+	}
+	return errors.Trace(syncDir(filepath.Dir(name)))
+}
@@ -0,0 +1,53 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOutputRenamedWhenComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-mode")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	for _, mode := range []string{syncModeNone, syncModeFile, syncModeDir} {
+		opts := runOptions{syncMode: mode}
+		for _, format := range []string{outputFormatSQL, outputFormatPB} {
+			output := filepath.Join(dir, mode, format, "test_t1")
+			name := output
+			if format == outputFormatSQL {
+				name += sqlFileSuffix
+			}
+
+			w, err := newBinlogWriter(opts, format, output, compressNone, 0)
+			assert.NilError(t, err)
+			assert.NilError(t, w.Write(genTestDDL("test", "t1", "create table test.t1 (id int)", 1)))
+			assert.Assert(t, exists(name+tmpOutputSuffix))
+			assert.Assert(t, !exists(name))
+			assert.NilError(t, w.Close())
+			assert.Assert(t, !exists(name+tmpOutputSuffix))
+			assert.Assert(t, exists(name))
+
+			// the output of the last run is kept until the new one is complete, and nothing is left by abort
+			w, err = newBinlogWriter(opts, format, output, compressNone, 0)
+			assert.NilError(t, err)
+			assert.NilError(t, w.Write(genTestDDL("test", "t1", "drop table test.t1", 2)))
+			w.abort()
+			assert.Assert(t, !exists(name+tmpOutputSuffix))
+			assert.Assert(t, exists(name))
+		}
+	}
+
+	cfg := NewConfig()
+	cfg.Dir = "data"
+	cfg.SyncMode = "always"
+	assert.ErrorContains(t, cfg.validate(), "unknown sync-mode always")
+}
@@ -0,0 +1,139 @@
+package pitr
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// the table infos of downstream are read from information_schema, the tables of the merged binlogs are tracked
+// in memory by schemaTracker instead
+const (
+	colsSQL = `
+SELECT column_name, extra FROM information_schema.columns
+WHERE table_schema = ? AND table_name = ?;`
+	uniqKeysSQL = `
+SELECT non_unique, index_name, seq_in_index, column_name 
+FROM information_schema.statistics
+WHERE table_schema = ? AND table_name = ?
+ORDER BY seq_in_index ASC;`
+)
+
+// getTableInfo returns information like (non-generated) column names and
+// unique keys about the specified table
+func getTableInfo(db *sql.DB, schema string, table string) (info *tableInfo, err error) {
+	info = &tableInfo{
+		schema: schema,
+		table:  table,
+	}
+
+	if info.columns, info.generatedColumns, err = getColsOfTbl(db, schema, table); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if info.uniqueKeys, err = getUniqKeys(db, schema, table); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// put primary key at first place
+	// and set primaryKey
+	for i := 0; i < len(info.uniqueKeys); i++ {
+		if info.uniqueKeys[i].name == "PRIMARY" {
+			info.uniqueKeys[i], info.uniqueKeys[0] = info.uniqueKeys[0], info.uniqueKeys[i]
+			info.primaryKey = &info.uniqueKeys[0]
+			break
+		}
+	}
+
+	return
+}
+
+// getColsOfTbl returns a slice of the names of all columns,
+// generated columns are excluded and returned by their lower case names.
+// https://dev.mysql.com/doc/mysql-infoschema-excerpt/5.7/en/columns-table.html
+func getColsOfTbl(db *sql.DB, schema, table string) ([]string, map[string]bool, error) {
+	rows, err := db.Query(colsSQL, schema, table)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	cols := make([]string, 0, 1)
+	var generated map[string]bool
+	for rows.Next() {
+		var name, extra string
+		err = rows.Scan(&name, &extra)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		isGenerated := strings.Contains(extra, "VIRTUAL GENERATED") || strings.Contains(extra, "STORED GENERATED")
+		if isGenerated {
+			if generated == nil {
+				generated = make(map[string]bool)
+			}
+			generated[strings.ToLower(name)] = true
+			continue
+		}
+		cols = append(cols, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	// if no any columns returns, means the table not exist.
+	if len(cols) == 0 {
+		return nil, nil, ErrTableNotExist
+	}
+
+	return cols, generated, nil
+}
+
+// https://dev.mysql.com/doc/mysql-infoschema-excerpt/5.7/en/statistics-table.html
+func getUniqKeys(db *sql.DB, schema, table string) (uniqueKeys []indexInfo, err error) {
+	rows, err := db.Query(uniqKeysSQL, schema, table)
+	if err != nil {
+		err = errors.Trace(err)
+		return
+	}
+	defer rows.Close()
+
+	var nonUnique int
+	var keyName string
+	var columnName string
+	var seqInIndex int // start at 1
+
+	// get pk and uk
+	// key for PRIMARY or other index name
+	for rows.Next() {
+		err = rows.Scan(&nonUnique, &keyName, &seqInIndex, &columnName)
+		if err != nil {
+			err = errors.Trace(err)
+			return
+		}
+
+		if nonUnique == 1 {
+			continue
+		}
+
+		var i int
+		// Search for indexInfo with the current keyName
+		for i = 0; i < len(uniqueKeys); i++ {
+			if uniqueKeys[i].name == keyName {
+				uniqueKeys[i].columns = append(uniqueKeys[i].columns, columnName)
+				break
+			}
+		}
+		// If we don't find the indexInfo with the loop above, create a new one
+		if i == len(uniqueKeys) {
+			uniqueKeys = append(uniqueKeys, indexInfo{keyName, []string{columnName}})
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return
+}
@@ -0,0 +1,160 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// tempDirRunFileName saves the run which created the temp dir, so a temp dir left by a crashed run can be told
+	tempDirRunFileName = "run.json"
+
+	// onLeftoverAbort, onLeftoverResume and onLeftoverClean are the values of on-leftover-temp
+	onLeftoverAbort  = "abort"
+	onLeftoverResume = "resume"
+	onLeftoverClean  = "clean"
+)
+
+// tempDirRun is the run which created the temp dir.
+type tempDirRun struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	RunID     string    `json:"run-id,omitempty"`
+	StartTime time.Time `json:"start-time"`
+}
+
+func (run *tempDirRun) String() string {
+	s := fmt.Sprintf("pid %d on %s started at %s", run.PID, run.Host, run.StartTime.Format(time.RFC3339))
+	if len(run.RunID) != 0 {
+		s += ", run id " + run.RunID
+	}
+	return s
+}
+
+// currentRun returns the current process as the run of runID.
+func currentRun(runID string) *tempDirRun {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &tempDirRun{PID: os.Getpid(), Host: host, RunID: runID, StartTime: time.Now()}
+}
+
+// writeTempDirRun saves the current process as the run of tempDir.
+func writeTempDirRun(tempDir string, runID string) error {
+	data, err := json.Marshal(currentRun(runID))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	file := filepath.Join(tempDir, tempDirRunFileName)
+	return errors.Annotatef(ioutil.WriteFile(file, data, 0600), "write %s", file)
+}
+
+// readTempDirRun reads the run which created tempDir, nil if it's created by a version without the run file.
+func readTempDirRun(tempDir string) (*tempDirRun, error) {
+	file := filepath.Join(tempDir, tempDirRunFileName)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "read %s", file)
+	}
+	run := &tempDirRun{}
+	if err := json.Unmarshal(data, run); err != nil {
+		return nil, errors.Annotatef(err, "decode %s", file)
+	}
+	return run, nil
+}
+
+// tempSiblingDirs returns the dirs next to the temp dir, they save the converted binlogs and the spilled
+// events of a run, and are written again by every run.
+func tempSiblingDirs(tempDir string) []string {
+	dirs := []string{spillDir(tempDir), kafkaConvertDir(tempDir)}
+	for _, format := range []string{inputFormatPump, inputFormatTiCDC, inputFormatMySQL} {
+		dirs = append(dirs, inputCodecs[format].convertDir(tempDir))
+	}
+	return dirs
+}
+
+// describeLeftoverTemp returns the size of tempDir and the run which left it.
+func describeLeftoverTemp(tempDir string) string {
+	size, err := dirTreeSize(tempDir)
+	if err != nil {
+		log.Warn("get the size of temp dir", zap.String("dir", tempDir), zap.Error(err))
+	}
+	run, err := readTempDirRun(tempDir)
+	if err != nil {
+		log.Warn("read the run of temp dir", zap.String("dir", tempDir), zap.Error(err))
+	}
+	if run == nil {
+		return fmt.Sprintf("%s, left by an unknown run", formatSize(size))
+	}
+	return fmt.Sprintf("%s, left by %s", formatSize(size), run)
+}
+
+// resumeTempDir returns true if the temp dir left by the last run is resumed.
+func (c *Config) resumeTempDir() bool {
+	return c.Resume || c.OnLeftoverTemp == onLeftoverResume
+}
+
+// handleLeftoverTemp checks the temp dir and its sibling dirs left by a crashed or reserved run before
+// the run starts. The sibling dirs are always removed because they are written again, the temp dir is
+// resumed, removed or fails the run by on-leftover-temp.
+func (r *PITR) handleLeftoverTemp() error {
+	tempDir := r.cfg.TempDir
+	if tempDir == "" {
+		tempDir = defaultTempDir
+	}
+	for _, dir := range tempSiblingDirs(tempDir) {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		size, err := dirTreeSize(dir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.Warn("remove the dir left by the last run", zap.String("dir", dir), zap.String("size", formatSize(size)))
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if _, err := os.Stat(tempDir); err != nil {
+		return nil
+	}
+	desc := describeLeftoverTemp(tempDir)
+	switch {
+	case r.cfg.resumeTempDir():
+		log.Info("resume the temp dir left by the last run", zap.String("dir", tempDir), zap.String("leftover", desc))
+	case r.cfg.OnLeftoverTemp == onLeftoverClean:
+		log.Warn("remove the temp dir left by the last run", zap.String("dir", tempDir), zap.String("leftover", desc))
+		if err := os.RemoveAll(tempDir); err != nil {
+			return errors.Trace(err)
+		}
+	default:
+		return errors.Errorf("temp dir %s already exists (%s), use --resume to continue the last run, "+
+			"or --on-leftover-temp %s to remove it", tempDir, desc, onLeftoverClean)
+	}
+	return nil
+}
+
+// validateOnLeftoverTemp checks on-leftover-temp, resume is the same as on-leftover-temp resume.
+func (c *Config) validateOnLeftoverTemp() error {
+	switch c.OnLeftoverTemp {
+	case "", onLeftoverAbort, onLeftoverResume, onLeftoverClean:
+	default:
+		return errors.Errorf("on-leftover-temp should be %s, %s or %s, but got %s", onLeftoverAbort, onLeftoverResume, onLeftoverClean, c.OnLeftoverTemp)
+	}
+	if c.Resume && c.OnLeftoverTemp != "" && c.OnLeftoverTemp != onLeftoverResume {
+		return errors.Errorf("resume can't be used with on-leftover-temp %s", c.OnLeftoverTemp)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestHandleLeftoverTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pitr-leftover")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	tempDir := filepath.Join(dir, "temp")
+	r := &PITR{cfg: &Config{TempDir: tempDir}}
+	// nothing is left
+	assert.NilError(t, r.handleLeftoverTemp())
+
+	// the temp dir and the converted binlogs left by a crashed run
+	assert.NilError(t, os.MkdirAll(filepath.Join(tempDir, "test_t1"), 0700))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(tempDir, "test_t1", "binlog-0"), make([]byte, 2048), 0600))
+	assert.NilError(t, writeTempDirRun(tempDir, "20201010101010-abcdef"))
+	assert.NilError(t, os.MkdirAll(pumpConvertDir(tempDir), 0700))
+	run, err := readTempDirRun(tempDir)
+	assert.NilError(t, err)
+	assert.Equal(t, run.PID, os.Getpid())
+
+	err = r.handleLeftoverTemp()
+	assert.ErrorContains(t, err, "KiB, left by pid")
+	assert.ErrorContains(t, err, "run id 20201010101010-abcdef")
+	_, err = os.Stat(pumpConvertDir(tempDir))
+	assert.Assert(t, os.IsNotExist(err))
+
+	r.cfg.OnLeftoverTemp = onLeftoverResume
+	assert.NilError(t, r.handleLeftoverTemp())
+	_, err = os.Stat(tempDir)
+	assert.NilError(t, err)
+
+	r.cfg.OnLeftoverTemp = onLeftoverClean
+	assert.NilError(t, r.handleLeftoverTemp())
+	_, err = os.Stat(tempDir)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// the temp dir of an old version without the run file
+	assert.NilError(t, os.MkdirAll(tempDir, 0700))
+	r.cfg.OnLeftoverTemp = onLeftoverAbort
+	assert.ErrorContains(t, r.handleLeftoverTemp(), "left by an unknown run")
+
+	cfg := &Config{Resume: true, OnLeftoverTemp: onLeftoverClean}
+	assert.ErrorContains(t, cfg.validateOnLeftoverTemp(), "resume can't be used")
+	cfg.OnLeftoverTemp = "ignore"
+	assert.ErrorContains(t, cfg.validateOnLeftoverTemp(), "but got ignore")
+}
@@ -0,0 +1,253 @@
+package pitr
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/tsthght/PITR/pitr/storage"
+)
+
+const (
+	// tempStoreFile saves the events split by Map in the binlog files of every table
+	tempStoreFile = "file"
+	// tempStoreKV saves the events split by Map in an embedded LSM store keyed by table, row and commit ts
+	tempStoreKV = "kv"
+
+	// kvDirName is the dir of the store in temp dir
+	kvDirName = "kv"
+)
+
+// openTempStore opens the store in temp dir.
+func openTempStore(tempDir string) (*storage.Store, error) {
+	return storage.Open(filepath.Join(tempDir, kvDirName))
+}
+
+// tables returns the sorted table dirs to be reduced, which are the union of the tables in temp files
+// or store and the tables in base dir.
+func (m *Merge) tables() ([]string, error) {
+	if m.store == nil {
+		return mergeSubDirs(m.tempDir, m.baseDir)
+	}
+
+	tables, err := m.store.Tables()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(m.baseDir) == 0 {
+		return tables, nil
+	}
+	baseDirs, err := readSubDirs(m.baseDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	exists := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		exists[table] = struct{}{}
+	}
+	for _, dir := range baseDirs {
+		if _, ok := exists[dir]; !ok {
+			tables = append(tables, dir)
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// tempTableSize returns the size of the temp files or the records in store of the table.
+func (m *Merge) tempTableSize(table string) (int64, error) {
+	if m.store != nil {
+		return m.store.TableSize(table)
+	}
+	return dirSizeIfExists(filepath.Join(m.tempDir, table))
+}
+
+// nextSegment starts the next segment of the table in dir changed by the DDL which is already saved in store.
+func (m *Merge) nextSegment(dir filter.TableName, commitTS int64) {
+	m.kvSegments[fmt.Sprintf("%s_%s", dir.Schema, dir.Table)] = commitTS
+}
+
+// putEvent puts the event split by Map to batch, the event may be encrypted.
+func putEvent(batch *storage.Batch, table string, segment int64, key string, commitTS int64, seq uint32, ev *pb.Event, cipher *payloadCipher) error {
+	value, err := ev.Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cipher != nil {
+		if value, err = cipher.encryptPayload(value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	batch.PutEvent(table, segment, key, commitTS, seq, value)
+	return nil
+}
+
+// putDDL puts the DDL which ends the segment of table to store.
+func putDDL(store *storage.Store, table string, segment int64, binlog *pb.Binlog, cipher *payloadCipher) error {
+	value, err := binlog.Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cipher != nil {
+		if value, err = cipher.encryptPayload(value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	batch := new(storage.Batch)
+	batch.PutDDL(table, segment, value)
+	return errors.Trace(store.Write(batch))
+}
+
+// reduceStore merges the events of the table in store after the binlogs of base dir. The events of a row
+// are adjacent in a segment, so a row is written once all its events are merged, only the rows of base
+// dir are kept in memory until the end of segment.
+func (tm *TableMerge) reduceStore(ctx context.Context) error {
+	maxCommitTS, err := tm.store.MaxCommitTS(tm.name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var (
+		segment int64 = -1
+		// ddl ends the segment, nil for the last segment
+		ddl *pb.Binlog
+		// commitTS is the commit ts of the rows written in the segment
+		commitTS int64
+		rowKey   string
+		binlog   *pb.Binlog
+		rows     int64
+		// discard is true if the DDL removes all the rows of table, so the rows of the segment are discarded
+		discard   bool
+		discarded int64
+	)
+	writeRows := func() error {
+		if binlog != nil && len(binlog.DmlData.Events) != 0 {
+			if err := tm.writeBinlog(binlog); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		binlog = newDMLBinlog(commitTS)
+		return nil
+	}
+	appendRow := func(ev pb.Event) error {
+		if discard {
+			discarded++
+			return nil
+		}
+		binlog.DmlData.Events = append(binlog.DmlData.Events, ev)
+		rows++
+		if len(binlog.DmlData.Events) >= 1000 {
+			return errors.Trace(writeRows())
+		}
+		return nil
+	}
+	finishRow := func() error {
+		row, ok := tm.keyEvent[rowKey]
+		if !ok {
+			return nil
+		}
+		delete(tm.keyEvent, rowKey)
+		tm.addMemory(-row.size())
+		ev, err := row.toPb()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(appendRow(ev))
+	}
+	finishSegment := func() error {
+		if err := finishRow(); err != nil {
+			return errors.Trace(err)
+		}
+		if err := writeRows(); err != nil {
+			return errors.Trace(err)
+		}
+		mergedRowsCounter.WithLabelValues(tm.name).Add(float64(rows))
+		tm.report.addRowsAfterMerge(tm.name, rows)
+		tm.report.addRowsDiscarded(tm.name, discarded)
+		rows, discarded = 0, 0
+		// the rows of base dir are written before the DDL
+		if ddl != nil {
+			tm.maxCommitTS = ddl.CommitTs
+			return errors.Trace(tm.analyzeBinlog(ddl))
+		}
+		if commitTS > tm.maxCommitTS {
+			tm.maxCommitTS = commitTS
+		}
+		return errors.Trace(tm.FlushDMLBinlog(tm.maxCommitTS))
+	}
+
+	err = tm.store.Scan(tm.name, func(r *storage.Record) error {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		value, err := decryptPayload(r.Value, tm.opts.cipher)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if r.Segment != segment {
+			if segment >= 0 {
+				if err := finishSegment(); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			segment, ddl, rowKey, commitTS, discard = r.Segment, nil, "", maxCommitTS, false
+			binlog = newDMLBinlog(commitTS)
+		}
+
+		switch r.Kind {
+		case storage.KindDDL:
+			// the DDL is the first record of the segment
+			ddl = &pb.Binlog{}
+			if err := ddl.Unmarshal(value); err != nil {
+				return errors.Annotatef(err, "decode DDL of table %s", tm.name)
+			}
+			commitTS = ddl.CommitTs - 1
+			binlog.CommitTs = commitTS
+			if discard, err = isDestructiveDDL(string(ddl.GetDdlQuery())); err != nil {
+				return errors.Trace(err)
+			}
+		case storage.KindEvent:
+			if r.RowKey != rowKey {
+				if err := finishRow(); err != nil {
+					return errors.Trace(err)
+				}
+				rowKey = r.RowKey
+			}
+			ev := &pb.Event{}
+			if err := ev.Unmarshal(value); err != nil {
+				return errors.Annotatef(err, "decode event of table %s", tm.name)
+			}
+			if tm.progress != nil {
+				tm.progress.addEvents(1)
+			}
+			if len(r.RowKey) == 0 {
+				// the events of an append-only table are written in order without merging
+				return errors.Trace(appendRow(*ev))
+			}
+			cols, err := decodeColumns(ev.GetRow())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(tm.HandleEvent(&Event{
+				schema:    ev.GetSchemaName(),
+				table:     ev.GetTableName(),
+				eventType: ev.GetTp(),
+				oldKey:    r.RowKey,
+				cols:      cols,
+			}))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if segment < 0 {
+		// the table only exists in base dir
+		return errors.Trace(tm.FlushDMLBinlog(tm.maxCommitTS))
+	}
+	return errors.Trace(finishSegment())
+}
@@ -0,0 +1,56 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/tsthght/PITR/pitr/storage"
+	"gotest.tools/assert"
+)
+
+func TestReduceStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempstore")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := openTempStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+
+	// the update of row 2 is split into delete and insert by Map
+	events := []struct {
+		key      string
+		commitTS int64
+		seq      uint32
+		event    *Event
+	}{
+		{"1", 10, 0, genSpillEvent(t, pb.EventType_Insert, 1, 1, 100, 0)},
+		{"1", 20, 0, genSpillEvent(t, pb.EventType_Delete, 1, 1, 100, 0)},
+		{"2", 20, 2, genSpillEvent(t, pb.EventType_Delete, 2, 2, 200, 0)},
+		{"2", 20, 3, genSpillEvent(t, pb.EventType_Insert, 2, 2, 201, 0)},
+		{"3", 30, 0, genSpillEvent(t, pb.EventType_Insert, 3, 3, 300, 0)},
+	}
+	batch := new(storage.Batch)
+	for _, e := range events {
+		ev, err := e.event.toPb()
+		assert.NilError(t, err)
+		assert.NilError(t, putEvent(batch, "test_t1", 0, e.key, e.commitTS, e.seq, &ev, nil))
+	}
+	batch.PutMaxCommitTS("test_t1", 30)
+	assert.NilError(t, store.Write(batch))
+
+	w := &collectWriter{}
+	tm := &TableMerge{name: "test_t1", keyEvent: make(map[string]*Event), writer: w, store: store}
+	// row 3 is deleted in base dir, so the insert after it becomes an update
+	tm.keyEvent["3"] = genSpillEvent(t, pb.EventType_Delete, 3, 3, 299, 0)
+	assert.NilError(t, tm.reduceStore(context.Background()))
+	assert.DeepEqual(t, w.events, []string{
+		"Update id=2->2 v=200->201",
+		"Update id=3->3 v=299->300",
+	})
+	assert.Equal(t, len(tm.keyEvent), 0)
+	assert.Equal(t, tm.maxCommitTS, int64(30))
+}
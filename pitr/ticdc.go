@@ -0,0 +1,539 @@
+package pitr
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tb "github.com/pingcap/tipb/go-binlog"
+	"go.uber.org/zap"
+)
+
+// inputFormatTiCDC is the canal-json files written by TiCDC's storage sink
+const inputFormatTiCDC = "ticdc"
+
+var (
+	// ticdcDataFile is the name of the data files in the dir of a table version
+	ticdcDataFile = regexp.MustCompile(`^CDC\d+\.json$`)
+	// ticdcCSVFile is the name of the data files written by the csv protocol
+	ticdcCSVFile = regexp.MustCompile(`^CDC\d+\.csv$`)
+	// ticdcSchemaFile is the name of the table definitions in the meta dir of a table or database
+	ticdcSchemaFile = regexp.MustCompile(`^schema_\d+_\d+\.json$`)
+)
+
+// ticdcTableDefinition is the schema file written by TiCDC's storage sink, Query is empty if the file is
+// written for the table existing when the changefeed starts, otherwise it's the DDL at TableVersion.
+type ticdcTableDefinition struct {
+	Schema       string `json:"Schema"`
+	Table        string `json:"Table"`
+	TableVersion int64  `json:"TableVersion"`
+	Query        string `json:"Query"`
+	Columns      []struct {
+		Name string `json:"ColumnName"`
+	} `json:"TableColumns"`
+}
+
+// ticdcMessage is a canal-json message of TiCDC, the commit ts is in _tidb if enable-tidb-extension is set.
+type ticdcMessage struct {
+	Database  string                   `json:"database"`
+	Table     string                   `json:"table"`
+	IsDDL     bool                     `json:"isDdl"`
+	Type      string                   `json:"type"`
+	Query     string                   `json:"sql"`
+	MySQLType map[string]string        `json:"mysqlType"`
+	Data      []map[string]interface{} `json:"data"`
+	Old       []map[string]interface{} `json:"old"`
+	TiDB      *struct {
+		CommitTS int64 `json:"commitTs"`
+	} `json:"_tidb"`
+}
+
+// ticdcChange is a DDL or a row change read from the files of TiCDC.
+type ticdcChange struct {
+	commitTS int64
+	// ddl is the binlog of DDL, nil for a row change
+	ddl   *pb.Binlog
+	event *pb.Event
+}
+
+// ticdcStream reads the changes in the data files of a dir in order, the files are named by their indexes.
+type ticdcStream struct {
+	files []string
+	// columns is the order of the columns in the table definition, nil means sorting them by name
+	columns []string
+
+	file    *os.File
+	scanner *bufio.Scanner
+	pending []ticdcChange
+	lastTS  int64
+	head    *ticdcChange
+}
+
+// next reads the next change to head, head is nil if all the files are read.
+func (s *ticdcStream) next() error {
+	for len(s.pending) == 0 {
+		if s.scanner == nil {
+			if len(s.files) == 0 {
+				s.head = nil
+				return nil
+			}
+			f, err := os.Open(s.files[0])
+			if err != nil {
+				return errors.Trace(err)
+			}
+			s.file, s.scanner = f, bufio.NewScanner(f)
+			s.scanner.Buffer(make([]byte, 64*1024), int(maxMemorySize))
+		}
+		if !s.scanner.Scan() {
+			err := s.scanner.Err()
+			s.file.Close()
+			if err != nil {
+				return errors.Annotatef(err, "read %s", s.files[0])
+			}
+			s.file, s.scanner, s.files = nil, nil, s.files[1:]
+			continue
+		}
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		changes, err := decodeTiCDCMessage(line, s.columns)
+		if err != nil {
+			return errors.Annotatef(err, "decode message in %s", s.files[0])
+		}
+		s.pending = changes
+	}
+
+	change := s.pending[0]
+	s.pending = s.pending[1:]
+	if change.commitTS < s.lastTS {
+		return errors.Errorf("commit ts %d in %s is less than the last change %d", change.commitTS, s.files[0], s.lastTS)
+	}
+	s.lastTS = change.commitTS
+	s.head = &change
+	return nil
+}
+
+func (s *ticdcStream) close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+type ticdcStreamHeap []*ticdcStream
+
+func (h ticdcStreamHeap) Len() int            { return len(h) }
+func (h ticdcStreamHeap) Less(i, j int) bool  { return h[i].head.commitTS < h[j].head.commitTS }
+func (h ticdcStreamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *ticdcStreamHeap) Push(x interface{}) { *h = append(*h, x.(*ticdcStream)) }
+func (h *ticdcStreamHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	*h = old[:n-1]
+	return s
+}
+
+// decodeTiCDCMessage decodes a canal-json message to the changes, every row is an event, the columns
+// are in the order of columns.
+func decodeTiCDCMessage(line []byte, columns []string) ([]ticdcChange, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	msg := &ticdcMessage{}
+	if err := decoder.Decode(msg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if msg.TiDB == nil || msg.TiDB.CommitTS == 0 {
+		return nil, errors.New("the commit ts is not found, set enable-tidb-extension in the sink-uri of the changefeed")
+	}
+	commitTS := msg.TiDB.CommitTS
+
+	if msg.IsDDL {
+		binlog, err := ddlBinlog(msg.Database, msg.Query, commitTS)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []ticdcChange{{commitTS: commitTS, ddl: binlog}}, nil
+	}
+
+	var tp pb.EventType
+	switch msg.Type {
+	case "INSERT":
+		tp = pb.EventType_Insert
+	case "UPDATE":
+		tp = pb.EventType_Update
+	case "DELETE":
+		tp = pb.EventType_Delete
+	case "TIDB_WATERMARK":
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unknown message type %s of table %s", msg.Type, quoteSchema(msg.Database, msg.Table))
+	}
+	if tp == pb.EventType_Update && len(msg.Old) != len(msg.Data) {
+		return nil, errors.Errorf("update of table %s has %d rows, but %d old rows", quoteSchema(msg.Database, msg.Table), len(msg.Data), len(msg.Old))
+	}
+
+	changes := make([]ticdcChange, 0, len(msg.Data))
+	for i, data := range msg.Data {
+		var old map[string]interface{}
+		if tp == pb.EventType_Update {
+			old = msg.Old[i]
+		}
+		event, err := ticdcRowToEvent(msg, tp, data, old, columns)
+		if err != nil {
+			return nil, errors.Annotatef(err, "table %s", quoteSchema(msg.Database, msg.Table))
+		}
+		changes = append(changes, ticdcChange{commitTS: commitTS, event: event})
+	}
+	return changes, nil
+}
+
+// ticdcRowToEvent converts a row of canal-json to the event, the old values of update only have the
+// changed columns, the other columns are the same as the new values.
+func ticdcRowToEvent(msg *ticdcMessage, tp pb.EventType, data, old map[string]interface{}, columns []string) (*pb.Event, error) {
+	names := columns
+	if len(names) == 0 {
+		names = make([]string, 0, len(data))
+		for name := range data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	sc := &stmtctx.StatementContext{TimeZone: time.Local}
+	row := make([][]byte, 0, len(names))
+	for _, name := range names {
+		value, ok := data[name]
+		if !ok {
+			continue
+		}
+		mysqlType := msg.MySQLType[name]
+		colTp, datum, err := ticdcColumnDatum(value, mysqlType)
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", name)
+		}
+		col := pb.Column{Name: name, Tp: []byte{colTp}, MysqlType: mysqlType}
+		if col.Value, err = codec.EncodeValue(sc, nil, datum); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if tp == pb.EventType_Update {
+			// the value of update is the old value, and the changed value is the new value
+			col.ChangedValue = col.Value
+			if oldValue, ok := old[name]; ok {
+				if _, datum, err = ticdcColumnDatum(oldValue, mysqlType); err != nil {
+					return nil, errors.Annotatef(err, "old value of column %s", name)
+				}
+				if col.Value, err = codec.EncodeValue(sc, nil, datum); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+
+		b, err := col.Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row = append(row, b)
+	}
+	if len(row) == 0 {
+		return nil, errors.New("the row has no column")
+	}
+	if len(row) != len(data) {
+		return nil, errors.Errorf("the row has %d columns, but %d columns are in the table definition", len(data), len(row))
+	}
+
+	schema, table := msg.Database, msg.Table
+	return &pb.Event{SchemaName: &schema, TableName: &table, Tp: tp, Row: row}, nil
+}
+
+// ticdcColumnDatum returns the type and datum of the value in canal-json, the values are strings, the binary
+// values are encoded in ISO-8859-1, the enum and set values are their indexes, and the bit values are integers.
+// The time and decimal values are kept as strings like drainer.
+func ticdcColumnDatum(value interface{}, mysqlType string) (byte, types.Datum, error) {
+	name := strings.ToLower(strings.TrimSpace(mysqlType))
+	unsigned := strings.Contains(name, "unsigned")
+	if i := strings.IndexAny(name, "( "); i >= 0 {
+		name = name[:i]
+	}
+	tp := mysqlTypeByName(name)
+	if value == nil {
+		return tp, types.Datum{}, nil
+	}
+	s := fmt.Sprintf("%v", value)
+
+	switch tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeYear:
+		if unsigned {
+			v, err := strconv.ParseUint(s, 10, 64)
+			return tp, types.NewUintDatum(v), errors.Trace(err)
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		return tp, types.NewIntDatum(v), errors.Trace(err)
+	case mysql.TypeFloat, mysql.TypeDouble:
+		v, err := strconv.ParseFloat(s, 64)
+		return tp, types.NewFloat64Datum(v), errors.Trace(err)
+	case mysql.TypeEnum, mysql.TypeSet:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return tp, types.NewUintDatum(v), errors.Annotatef(err, "the value of %s should be its index", name)
+	case mysql.TypeBit:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return tp, types.NewBytesDatum(types.NewBinaryLiteralFromUint(v, -1)), errors.Trace(err)
+	}
+	if strings.Contains(name, "blob") || strings.Contains(name, "binary") {
+		// every byte is a rune of ISO-8859-1
+		b := make([]byte, 0, len(s))
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+		return tp, types.NewBytesDatum(b), nil
+	}
+	return tp, types.NewStringDatum(s), nil
+}
+
+// readTiCDCDir finds the data files and table definitions in the output dir of TiCDC's storage sink, the
+// data files of every dir are a stream, and the DDLs in the table definitions are sorted by commit ts.
+func readTiCDCDir(dir string) ([]*ticdcStream, []ticdcChange, error) {
+	var (
+		defs    []*ticdcTableDefinition
+		streams = make(map[string]*ticdcStream)
+		names   []string
+	)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		switch {
+		case ticdcCSVFile.MatchString(name):
+			return errors.Errorf("%s is written by the csv protocol, only canal-json is supported", file)
+		case ticdcSchemaFile.MatchString(name) && filepath.Base(filepath.Dir(file)) == "meta":
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			def := &ticdcTableDefinition{}
+			if err := json.Unmarshal(data, def); err != nil {
+				return errors.Annotatef(err, "decode table definition %s", file)
+			}
+			defs = append(defs, def)
+		case ticdcDataFile.MatchString(name):
+			parent := filepath.Dir(file)
+			s, ok := streams[parent]
+			if !ok {
+				s = &ticdcStream{}
+				streams[parent] = s
+				names = append(names, parent)
+			}
+			s.files = append(s.files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	// the data files of a table version are in {schema}/{table}/{version}/...
+	columns := make(map[string][]string)
+	var ddls []ticdcChange
+	for _, def := range defs {
+		if len(def.Table) != 0 {
+			names := make([]string, 0, len(def.Columns))
+			for _, col := range def.Columns {
+				names = append(names, col.Name)
+			}
+			columns[path.Join(def.Schema, def.Table, strconv.FormatInt(def.TableVersion, 10))] = names
+		}
+		if len(def.Query) == 0 {
+			continue
+		}
+		binlog, err := ddlBinlog(def.Schema, def.Query, def.TableVersion)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		ddls = append(ddls, ticdcChange{commitTS: def.TableVersion, ddl: binlog})
+	}
+	sort.SliceStable(ddls, func(i, j int) bool { return ddls[i].commitTS < ddls[j].commitTS })
+
+	sort.Strings(names)
+	result := make([]*ticdcStream, 0, len(names))
+	for _, name := range names {
+		s := streams[name]
+		// the index of data files has a fixed width, so they are sorted by name
+		sort.Strings(s.files)
+		if rel, err := filepath.Rel(dir, name); err == nil {
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			if len(parts) >= 3 {
+				s.columns = columns[path.Join(parts[0], parts[1], parts[2])]
+			}
+		}
+		result = append(result, s)
+	}
+	return result, ddls, nil
+}
+
+// convertTiCDCDir merges the changes in the output dir of TiCDC by commit ts, and writes them to outDir in
+// the format of drainer, the rows with the same commit ts are a transaction. It returns the number of binlogs.
+func convertTiCDCDir(ctx context.Context, dir string, outDir string) (int, error) {
+	streams, ddls, err := readTiCDCDir(dir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() {
+		for _, s := range streams {
+			s.close()
+		}
+	}()
+
+	binlogger, err := OpenMyBinlogger(outDir)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer binlogger.Close()
+
+	var count int
+	write := func(binlog *pb.Binlog) error {
+		data, err := binlog.Marshal()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := binlogger.WriteTail(&tb.Entity{Payload: data}); err != nil {
+			return errors.Trace(err)
+		}
+		count++
+		return nil
+	}
+
+	h := make(ticdcStreamHeap, 0, len(streams))
+	for _, s := range streams {
+		if err := s.next(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if s.head != nil {
+			h = append(h, s)
+		}
+	}
+	heap.Init(&h)
+
+	var (
+		txn     *pb.Binlog
+		lastDDL *pb.Binlog
+	)
+	flush := func() error {
+		if txn == nil {
+			return nil
+		}
+		err := write(txn)
+		txn = nil
+		return errors.Trace(err)
+	}
+	writeDDL := func(binlog *pb.Binlog) error {
+		// the DDL changing several tables is in the definitions of all of them
+		if lastDDL != nil && lastDDL.CommitTs == binlog.CommitTs && bytes.Equal(lastDDL.DdlQuery, binlog.DdlQuery) {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return errors.Trace(err)
+		}
+		lastDDL = binlog
+		return errors.Trace(write(binlog))
+	}
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		s := h[0]
+		change := s.head
+		for len(ddls) > 0 && ddls[0].commitTS <= change.commitTS {
+			if err := writeDDL(ddls[0].ddl); err != nil {
+				return 0, errors.Trace(err)
+			}
+			ddls = ddls[1:]
+		}
+
+		if change.ddl != nil {
+			if err := writeDDL(change.ddl); err != nil {
+				return 0, errors.Trace(err)
+			}
+		} else {
+			if txn != nil && txn.CommitTs != change.commitTS {
+				if err := flush(); err != nil {
+					return 0, errors.Trace(err)
+				}
+			}
+			if txn == nil {
+				txn = newDMLBinlog(change.commitTS)
+			}
+			txn.DmlData.Events = append(txn.DmlData.Events, *change.event)
+		}
+
+		if err := s.next(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if s.head == nil {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	for _, ddl := range ddls {
+		if err := writeDDL(ddl.ddl); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	return count, nil
+}
+
+// ticdcConvertDir returns the dir to save the binlogs converted from the files of TiCDC, it's not in
+// the temp dir because the sub dirs of the temp dir are the temp files of tables.
+func ticdcConvertDir(tempDir string) string {
+	return filepath.Clean(tempDir) + "_ticdc"
+}
+
+// convertTiCDCSources converts the output dirs of TiCDC's storage sink in dirs to the format of drainer,
+// and returns the dirs of the converted files, every changefeed is converted to one dir.
+func (r *PITR) convertTiCDCSources(ctx context.Context, dirs []string) ([]string, error) {
+	baseDir := ticdcConvertDir(r.cfg.TempDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	converted := make([]string, 0, len(dirs))
+	for i, dir := range dirs {
+		outDir := filepath.Join(baseDir, fmt.Sprintf("%d", i))
+		count, err := convertTiCDCDir(ctx, dir, outDir)
+		if err != nil {
+			return nil, errors.Annotatef(err, "convert the files of TiCDC in %s", dir)
+		}
+		if count == 0 {
+			return nil, errors.Errorf("no change is found in the files of TiCDC in %s", dir)
+		}
+		log.Info("the files of TiCDC are converted", zap.String("dir", dir),
+			zap.String("output", outDir), zap.Int("binlogs", count))
+		converted = append(converted, outDir)
+	}
+	return converted, nil
+}
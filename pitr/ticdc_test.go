@@ -0,0 +1,76 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestConvertTiCDCDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ticdc")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, content string) {
+		file := filepath.Join(dir, "changefeed", name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(file), 0700))
+		assert.NilError(t, ioutil.WriteFile(file, []byte(content), 0600))
+	}
+	writeFile("metadata", `{"checkpoint-ts":500}`)
+	writeFile("test/t1/meta/schema_100_1.json", `{"Schema":"test","Table":"t1","TableVersion":100,"Query":"","TableColumns":[{"ColumnName":"id"},{"ColumnName":"v"}]}`)
+	writeFile("test/t1/meta/schema_300_2.json", `{"Schema":"test","Table":"t1","TableVersion":300,"Query":"ALTER TABLE t1 ADD COLUMN c varchar(10)","TableColumns":[{"ColumnName":"id"},{"ColumnName":"v"},{"ColumnName":"c"}]}`)
+	writeFile("test/t1/100/CDC000001.json", `{"database":"test","table":"t1","isDdl":false,"type":"INSERT","mysqlType":{"id":"int","v":"int"},"data":[{"id":"1","v":"10"}],"old":null,"_tidb":{"commitTs":200}}
+{"database":"test","table":"t1","isDdl":false,"type":"UPDATE","mysqlType":{"id":"int","v":"int"},"data":[{"id":"1","v":"11"}],"old":[{"v":"10"}],"_tidb":{"commitTs":250}}
+`)
+	writeFile("test/t1/100/meta/CDC.index", "CDC000001.json\n")
+	writeFile("test/t1/300/CDC000001.json", `{"database":"test","table":"t1","isDdl":false,"type":"INSERT","mysqlType":{"id":"int","v":"int","c":"varchar"},"data":[{"id":"2","v":null,"c":"x"}],"old":null,"_tidb":{"commitTs":400}}
+`)
+	writeFile("test/t2/100/CDC000001.json", `{"database":"test","table":"t2","isDdl":false,"type":"DELETE","mysqlType":{"id":"bigint unsigned"},"data":[{"id":"18446744073709551615"}],"old":null,"_tidb":{"commitTs":200}}
+`)
+
+	outDir := filepath.Join(dir, "out")
+	count, err := convertTiCDCDir(context.Background(), filepath.Join(dir, "changefeed"), outDir)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 4)
+
+	files, err := searchFiles(outDir)
+	assert.NilError(t, err)
+	var converted []*pb.Binlog
+	for _, file := range files {
+		assert.NilError(t, scanBinlogFile(file, runOptions{}, func(binlog *pb.Binlog) error {
+			converted = append(converted, binlog)
+			return nil
+		}))
+	}
+	assert.Equal(t, len(converted), 4)
+
+	// the rows of the tables with the same commit ts are a transaction
+	assert.Equal(t, converted[0].CommitTs, int64(200))
+	assert.Equal(t, len(converted[0].DmlData.Events), 2)
+	assert.Equal(t, converted[0].DmlData.Events[1].GetTableName(), "t2")
+	w := &collectWriter{}
+	assert.NilError(t, w.Write(converted[0]))
+	assert.NilError(t, w.Write(converted[1]))
+	assert.NilError(t, w.Write(converted[3]))
+	assert.DeepEqual(t, w.events, []string{
+		"Insert id=1 v=10",
+		"Delete id=18446744073709551615",
+		"Update id=1->1 v=10->11",
+		"Insert id=2 v=<nil> c=x",
+	})
+
+	assert.Equal(t, converted[2].Tp, pb.BinlogType_DDL)
+	assert.Equal(t, converted[2].CommitTs, int64(300))
+	assert.Equal(t, string(converted[2].DdlQuery), "use `test`; ALTER TABLE t1 ADD COLUMN c varchar(10);")
+
+	// the commit ts is required
+	writeFile("test/t2/100/CDC000002.json", `{"database":"test","table":"t2","isDdl":false,"type":"INSERT","mysqlType":{"id":"int"},"data":[{"id":"2"}]}
+`)
+	_, err = convertTiCDCDir(context.Background(), filepath.Join(dir, "changefeed"), filepath.Join(dir, "out2"))
+	assert.ErrorContains(t, err, "set enable-tidb-extension")
+}
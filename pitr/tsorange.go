@@ -0,0 +1,154 @@
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pingcap/errors"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// TSORangeConfig is the config of the range subcommand.
+type TSORangeConfig struct {
+	// Dir and Storage are the binlog files like data-dir and storage of Config
+	Dir     string
+	Storage string
+	// TimeZone is the time zone of the printed datetime, empty string means the local time zone
+	TimeZone        string
+	RelaxCorruption string
+	// JSON prints the ranges as a JSON object
+	JSON bool
+}
+
+// commitTSRange is the commit ts range of some binlogs, the datetimes are the wall-clock of the tso.
+type commitTSRange struct {
+	MinCommitTS int64  `json:"min-commit-ts"`
+	MinDatetime string `json:"min-datetime"`
+	MaxCommitTS int64  `json:"max-commit-ts"`
+	MaxDatetime string `json:"max-datetime"`
+	Binlogs     int64  `json:"binlogs"`
+}
+
+func (r *commitTSRange) add(commitTS int64) {
+	r.Binlogs++
+	if r.MinCommitTS == 0 || commitTS < r.MinCommitTS {
+		r.MinCommitTS = commitTS
+	}
+	if commitTS > r.MaxCommitTS {
+		r.MaxCommitTS = commitTS
+	}
+}
+
+func (r *commitTSRange) merge(other *commitTSRange) {
+	if other.Binlogs == 0 {
+		return
+	}
+	r.Binlogs += other.Binlogs
+	if r.MinCommitTS == 0 || other.MinCommitTS < r.MinCommitTS {
+		r.MinCommitTS = other.MinCommitTS
+	}
+	if other.MaxCommitTS > r.MaxCommitTS {
+		r.MaxCommitTS = other.MaxCommitTS
+	}
+}
+
+// setDatetime sets the datetimes of the range in loc.
+func (r *commitTSRange) setDatetime(loc *time.Location) {
+	if r.Binlogs == 0 {
+		return
+	}
+	r.MinDatetime = tsoDatetime(r.MinCommitTS, loc)
+	r.MaxDatetime = tsoDatetime(r.MaxCommitTS, loc)
+}
+
+// fileTSORange is the commit ts range of a binlog file.
+type fileTSORange struct {
+	File string `json:"file"`
+	commitTSRange
+	// Gap is the damaged region skipped by relax-corruption, nil if the file is not corrupted
+	Gap *corruptionGap `json:"gap,omitempty"`
+}
+
+// tsoRanges is the result of the range subcommand.
+type tsoRanges struct {
+	commitTSRange
+	Files []*fileTSORange `json:"files"`
+}
+
+// tsoDatetime returns the wall-clock of tso in loc.
+func tsoDatetime(tso int64, loc *time.Location) string {
+	return oracle.GetTimeFromTS(uint64(tso)).In(loc).Format(timeFormat)
+}
+
+// TSORange prints the min and max commit ts of all the binlog files in data-dir or storage, and the range
+// of every file, both in tso and the wall-clock, which are the valid bounds of start-tso and stop-tso.
+// All the binlogs are scanned because the commit ts is not in the name of the files.
+func TSORange(w io.Writer, cfg *TSORangeConfig) error {
+	if !isValidRelaxCorruption(cfg.RelaxCorruption) {
+		return errors.Errorf("unknown relax-corruption %s, should be %s, %s or %s", cfg.RelaxCorruption, relaxAbort, relaxSkipTail, relaxSkipFile)
+	}
+	source := &Config{Dir: cfg.Dir, Storage: cfg.Storage, TimeZone: cfg.TimeZone}
+	dirs, err := source.binlogDirs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	loc, err := source.location()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ranges := &tsoRanges{}
+	for _, dir := range dirs {
+		files, err := searchFiles(dir)
+		if err != nil {
+			return errors.Annotatef(err, "search files in %s", redactStorageURI(dir))
+		}
+		// the missing files are only warned, the range is still printed
+		if err := checkFileGaps(files, onGapWarn, runOptions{}); err != nil {
+			return errors.Annotatef(err, "check files in %s", redactStorageURI(dir))
+		}
+		for _, file := range files {
+			r := &fileTSORange{File: redactStorageURI(file)}
+			r.Gap, err = scanSourceBinlogFile(file, cfg.RelaxCorruption, runOptions{}, func(binlog *pb.Binlog, _ int64) error {
+				r.add(binlog.CommitTs)
+				return nil
+			})
+			if err != nil {
+				return errors.Annotatef(err, "scan %s", redactStorageURI(file))
+			}
+			r.setDatetime(loc)
+			ranges.merge(&r.commitTSRange)
+			ranges.Files = append(ranges.Files, r)
+		}
+	}
+	if len(ranges.Files) == 0 {
+		return errors.New("no binlog file found")
+	}
+	ranges.setDatetime(loc)
+
+	if cfg.JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Trace(enc.Encode(ranges))
+	}
+	for _, r := range ranges.Files {
+		if r.Binlogs == 0 {
+			fmt.Fprintf(w, "%s: no binlog\n", r.File)
+		} else {
+			fmt.Fprintf(w, "%s: [%d(%s), %d(%s)], %d binlogs\n", r.File, r.MinCommitTS, r.MinDatetime,
+				r.MaxCommitTS, r.MaxDatetime, r.Binlogs)
+		}
+		if r.Gap != nil {
+			fmt.Fprintf(w, "  damaged at offset %d, skipped by %s: %s\n", r.Gap.Offset, r.Gap.Mode, r.Gap.Error)
+		}
+	}
+	fmt.Fprintf(w, "total: %d files, %d binlogs\n", len(ranges.Files), ranges.Binlogs)
+	if ranges.Binlogs != 0 {
+		fmt.Fprintf(w, "min commit ts: %d(%s)\n", ranges.MinCommitTS, ranges.MinDatetime)
+		fmt.Fprintf(w, "max commit ts: %d(%s)\n", ranges.MaxCommitTS, ranges.MaxDatetime)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package pitr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"gotest.tools/assert"
+)
+
+func TestTSORange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tso-range")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for i, binlogs := range [][]*pb.Binlog{
+		{genTestDDL("test", "tb1", "create table test.tb1 (a int primary key)", 100), genTestDML("test", "tb1", 200)},
+		{genTestDML("test", "tb1", 300)},
+	} {
+		var data []byte
+		for _, binlog := range binlogs {
+			payload, err := binlog.Marshal()
+			assert.NilError(t, err)
+			data = append(data, binlogfile.Encode(payload)...)
+		}
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, binlogfile.BinlogName(uint64(i))), data, 0600))
+	}
+
+	var sb strings.Builder
+	cfg := &TSORangeConfig{Dir: dir, TimeZone: "UTC", RelaxCorruption: relaxAbort}
+	assert.NilError(t, TSORange(&sb, cfg))
+	out := sb.String()
+	first := filepath.Join(dir, binlogfile.BinlogName(0))
+	assert.Assert(t, strings.Contains(out, first+": [100("+tsoDatetime(100, time.UTC)+"), 200("), out)
+	assert.Assert(t, strings.Contains(out, "total: 2 files, 3 binlogs\n"), out)
+	assert.Assert(t, strings.Contains(out, "min commit ts: 100("), out)
+	assert.Assert(t, strings.Contains(out, "max commit ts: 300("), out)
+
+	sb.Reset()
+	cfg.JSON = true
+	assert.NilError(t, TSORange(&sb, cfg))
+	var ranges tsoRanges
+	assert.NilError(t, json.Unmarshal([]byte(sb.String()), &ranges))
+	assert.Equal(t, ranges.MinCommitTS, int64(100))
+	assert.Equal(t, ranges.MaxCommitTS, int64(300))
+	assert.Equal(t, len(ranges.Files), 2)
+	assert.Equal(t, ranges.Files[1].MinCommitTS, int64(300))
+	assert.Equal(t, ranges.Files[1].MinDatetime, tsoDatetime(300, time.UTC))
+
+	cfg.RelaxCorruption = "ignore"
+	assert.ErrorContains(t, TSORange(&sb, cfg), "unknown relax-corruption")
+	cfg.RelaxCorruption, cfg.Dir = relaxAbort, filepath.Join(dir, "empty")
+	assert.ErrorContains(t, TSORange(&sb, cfg), "search files in")
+}
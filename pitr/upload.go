@@ -0,0 +1,663 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUploadConcurrency = 4
+
+	// s3MaxParts is the max number of parts of a multipart upload, the part size of a larger file is increased
+	s3MaxParts = 10000
+	// uploadStateSuffix is the suffix of the state file next to the output dir like the lock file, it records
+	// the multipart uploads in progress and the uploaded files, so a failed upload is resumed from them
+	uploadStateSuffix = ".upload.json"
+	// uploadReadChunk is the max size read at a time by rateLimitedReader, so one read doesn't wait for long
+	uploadReadChunk = 32 * 1024
+
+	uploadMaxRetry         = 5
+	uploadMaxRetryInterval = 30 * time.Second
+)
+
+var (
+	// uploadPartSize is the part size of multipart uploads, the files not larger than it are uploaded by one request
+	uploadPartSize int64 = 64 * 1024 * 1024
+	// uploadRetryInterval is the interval before the first retry of a failed request, it doubles for the next retry
+	uploadRetryInterval = time.Second
+)
+
+// UploadConfig is the config of uploading the output dir to object storage, it's used by output-storage
+// and the upload subcommand.
+type UploadConfig struct {
+	// Dir is the output dir
+	Dir string
+	// Storage is the s3 uri the files in Dir are uploaded to, with the same relative names
+	Storage     string
+	Concurrency int
+	// RateLimit is the max size uploaded per second like 50MiB, empty means no limit
+	RateLimit string
+}
+
+func (c *UploadConfig) validate() error {
+	if _, err := newUploadStorage(c.Storage); err != nil {
+		return errors.Trace(err)
+	}
+	if c.Concurrency <= 0 {
+		return errors.Errorf("upload-concurrency should be greater than 0, but got %d", c.Concurrency)
+	}
+	if c.RateLimit != "" {
+		limit, err := parseSize(c.RateLimit)
+		if err != nil {
+			return errors.Annotate(err, "upload-rate-limit")
+		}
+		if limit <= 0 {
+			return errors.Errorf("upload-rate-limit should be greater than 0, but got %s", c.RateLimit)
+		}
+	}
+	return nil
+}
+
+// newUploadStorage returns the storage of output-storage, only s3 is supported.
+func newUploadStorage(uri string) (*s3Storage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse output-storage %s", redactStorageURI(uri))
+	}
+	if u.Scheme != "s3" {
+		return nil, errors.Errorf("unsupported output-storage scheme %s, only s3 is supported", u.Scheme)
+	}
+	return newS3Storage(u)
+}
+
+// fileStamp identifies the content of an output file, a rewritten output file has a new modification time
+// because it's renamed from .tmp when complete.
+type fileStamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod-time"`
+}
+
+// multipartUpload is a multipart upload in progress.
+type multipartUpload struct {
+	fileStamp
+	UploadID string `json:"upload-id"`
+	PartSize int64  `json:"part-size"`
+}
+
+// uploadState is saved to the state file when a multipart upload is created or a file is uploaded.
+type uploadState struct {
+	// Storage is the redacted output-storage, the state of another storage is not resumed
+	Storage string `json:"storage"`
+	// Uploads is the multipart uploads in progress keyed by the relative name of file
+	Uploads map[string]*multipartUpload `json:"uploads"`
+	// Done is the uploaded files keyed by the relative name
+	Done map[string]fileStamp `json:"done"`
+}
+
+// uploadFile is a file to upload, it's uploaded by one request if upload is nil, otherwise by its parts.
+type uploadFile struct {
+	name  string
+	path  string
+	stamp fileStamp
+
+	upload *multipartUpload
+	mu     sync.Mutex
+	etags  map[int]string
+	// pending is the number of parts not uploaded yet, the upload is completed by the last part
+	pending int32
+}
+
+// uploadTask uploads a part of the file, part 0 means the whole file.
+type uploadTask struct {
+	file   *uploadFile
+	part   int
+	offset int64
+	size   int64
+}
+
+type uploader struct {
+	cfg      *UploadConfig
+	storage  *s3Storage
+	limiter  *tokenBucket
+	progress *progress
+
+	stateFile string
+	mu        sync.Mutex
+	state     *uploadState
+}
+
+// Upload uploads the output dir to the s3 storage, the upload left by a failed run is resumed from the
+// state file next to the output dir.
+func Upload(ctx context.Context, cfg *UploadConfig) error {
+	return errors.Trace(uploadOutput(ctx, cfg, newProgress()))
+}
+
+// uploadOutput uploads the files in the output dir, at most Concurrency files or parts are uploaded at the
+// same time, and the bytes of all of them are limited by RateLimit. checksums.txt is uploaded after all the
+// other files, so the output in the storage is complete if it's there.
+func uploadOutput(ctx context.Context, cfg *UploadConfig, p *progress) error {
+	if err := cfg.validate(); err != nil {
+		return errors.Trace(err)
+	}
+	storage, err := newUploadStorage(cfg.Storage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u := &uploader{
+		cfg:       cfg,
+		storage:   storage,
+		progress:  p,
+		stateFile: filepath.Clean(cfg.Dir) + uploadStateSuffix,
+	}
+	if cfg.RateLimit != "" {
+		limit, err := parseSize(cfg.RateLimit)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		u.limiter = newTokenBucket(limit)
+	}
+	if err := u.loadState(); err != nil {
+		return errors.Trace(err)
+	}
+
+	files, total, err := u.listFiles()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("upload output", zap.String("dir", cfg.Dir), zap.String("storage", redactStorageURI(cfg.Storage)),
+		zap.Int("files", len(files)), zap.Int64("size", total), zap.Int("uploaded files", len(u.state.Done)))
+	p.start(phaseUpload, total)
+
+	var checksums []*uploadFile
+	for i, file := range files {
+		if file.name == checksumFileName {
+			checksums = []*uploadFile{file}
+			files = append(files[:i:i], files[i+1:]...)
+			break
+		}
+	}
+	if err := u.uploadFiles(ctx, files); err != nil {
+		return errors.Trace(err)
+	}
+	if err := u.uploadFiles(ctx, checksums); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := os.Remove(u.stateFile); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	log.Info("output is uploaded", zap.String("storage", redactStorageURI(cfg.Storage)))
+	return nil
+}
+
+// loadState loads the state of the last upload of the dir to the same storage.
+func (u *uploader) loadState() error {
+	storage := redactStorageURI(u.cfg.Storage)
+	u.state = &uploadState{Storage: storage, Uploads: make(map[string]*multipartUpload), Done: make(map[string]fileStamp)}
+	data, err := ioutil.ReadFile(u.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	state := &uploadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return errors.Annotatef(err, "parse upload state %s", u.stateFile)
+	}
+	if state.Storage != storage {
+		log.Warn("the last upload is to another storage, upload from the beginning", zap.String("storage", state.Storage))
+		return nil
+	}
+	if state.Uploads != nil {
+		u.state.Uploads = state.Uploads
+	}
+	if state.Done != nil {
+		u.state.Done = state.Done
+	}
+	log.Info("resume the last upload", zap.String("state", u.stateFile), zap.Int("uploaded files", len(u.state.Done)),
+		zap.Int("multipart uploads", len(u.state.Uploads)))
+	return nil
+}
+
+// saveState saves the state, the caller should hold u.mu.
+func (u *uploader) saveState() error {
+	data, err := json.Marshal(u.state)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := u.stateFile + tmpOutputSuffix
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Annotatef(err, "write upload state %s", tmp)
+	}
+	return errors.Trace(os.Rename(tmp, u.stateFile))
+}
+
+// listFiles returns the files not uploaded yet in lexical order and their total size.
+func (u *uploader) listFiles() ([]*uploadFile, int64, error) {
+	var (
+		files []*uploadFile
+		total int64
+	)
+	err := filepath.Walk(u.cfg.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(u.cfg.Dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		stamp := fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		if u.state.Done[rel] == stamp {
+			return nil
+		}
+		files = append(files, &uploadFile{name: rel, path: name, stamp: stamp})
+		total += stamp.Size
+		return nil
+	})
+	if err != nil {
+		return nil, 0, errors.Annotatef(err, "list files in %s", u.cfg.Dir)
+	}
+	return files, total, nil
+}
+
+// uploadFiles uploads the files by Concurrency workers, it returns the first error after all the workers exit.
+func (u *uploader) uploadFiles(ctx context.Context, files []*uploadFile) error {
+	uctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	tasks := make(chan *uploadTask)
+	var wg sync.WaitGroup
+	for i := 0; i < u.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				if err := u.runTask(uctx, task); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// the multipart uploads are created or resumed here in order, and their parts are uploaded by the workers
+generate:
+	for _, file := range files {
+		fileTasks, err := u.prepare(uctx, file)
+		if err != nil {
+			fail(err)
+			break
+		}
+		for _, task := range fileTasks {
+			select {
+			case tasks <- task:
+			case <-uctx.Done():
+				break generate
+			}
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	if firstErr != nil {
+		return errors.Trace(firstErr)
+	}
+	return errors.Trace(ctx.Err())
+}
+
+// prepare returns the tasks uploading the file, the parts uploaded by the multipart upload of the last run are
+// skipped if it's for the same file.
+func (u *uploader) prepare(ctx context.Context, file *uploadFile) ([]*uploadTask, error) {
+	if file.stamp.Size <= uploadPartSize {
+		return []*uploadTask{{file: file, size: file.stamp.Size}}, nil
+	}
+
+	partSize := uploadPartSize
+	if file.stamp.Size > partSize*s3MaxParts {
+		partSize = (file.stamp.Size + s3MaxParts - 1) / s3MaxParts
+	}
+	var uploaded map[int]s3Part
+	u.mu.Lock()
+	upload := u.state.Uploads[file.name]
+	u.mu.Unlock()
+	if upload != nil && (upload.fileStamp != file.stamp || upload.PartSize != partSize) {
+		upload = nil
+	}
+	if upload != nil {
+		var err error
+		if uploaded, err = u.listParts(ctx, file.name, upload.UploadID); err != nil {
+			// the upload may be aborted or expired by the lifecycle rule of the bucket
+			log.Warn("list uploaded parts failed, upload the file from the beginning", zap.String("file", file.name), zap.Error(err))
+			upload = nil
+		}
+	}
+	if upload == nil {
+		uploadID, err := u.createMultipartUpload(ctx, file.name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		upload = &multipartUpload{fileStamp: file.stamp, UploadID: uploadID, PartSize: partSize}
+		u.mu.Lock()
+		u.state.Uploads[file.name] = upload
+		err = u.saveState()
+		u.mu.Unlock()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	file.upload = upload
+	file.etags = make(map[int]string)
+	var tasks []*uploadTask
+	for part, offset := 1, int64(0); offset < file.stamp.Size; part, offset = part+1, offset+partSize {
+		size := partSize
+		if offset+size > file.stamp.Size {
+			size = file.stamp.Size - offset
+		}
+		if p, ok := uploaded[part]; ok && p.Size == size {
+			file.etags[part] = p.ETag
+			u.progress.addBytes(size)
+			continue
+		}
+		tasks = append(tasks, &uploadTask{file: file, part: part, offset: offset, size: size})
+	}
+	file.pending = int32(len(tasks))
+	if len(uploaded) != 0 {
+		log.Info("resume multipart upload", zap.String("file", file.name), zap.Int("uploaded parts", len(file.etags)),
+			zap.Int("parts", len(file.etags)+len(tasks)))
+	}
+	if len(tasks) == 0 {
+		return nil, errors.Trace(u.complete(ctx, file))
+	}
+	return tasks, nil
+}
+
+// runTask uploads the part, and completes the file if it's the last part.
+func (u *uploader) runTask(ctx context.Context, task *uploadTask) error {
+	file := task.file
+	if task.part == 0 {
+		err := withUploadRetry(ctx, fmt.Sprintf("upload %s", file.name), func() error {
+			_, err := u.putObject(ctx, file, nil, 0, task.size)
+			return err
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		u.progress.addBytes(task.size)
+		return errors.Trace(u.finish(file))
+	}
+
+	query := url.Values{}
+	query.Set("partNumber", fmt.Sprint(task.part))
+	query.Set("uploadId", file.upload.UploadID)
+	var etag string
+	err := withUploadRetry(ctx, fmt.Sprintf("upload part %d of %s", task.part, file.name), func() error {
+		var err error
+		etag, err = u.putObject(ctx, file, query, task.offset, task.size)
+		return err
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u.progress.addBytes(task.size)
+	file.mu.Lock()
+	file.etags[task.part] = etag
+	file.mu.Unlock()
+	if atomic.AddInt32(&file.pending, -1) == 0 {
+		return errors.Trace(u.complete(ctx, file))
+	}
+	return nil
+}
+
+// putObject uploads size bytes of the file from offset, and returns the ETag.
+func (u *uploader) putObject(ctx context.Context, file *uploadFile, query url.Values, offset, size int64) (string, error) {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	var body io.Reader = io.NewSectionReader(f, offset, size)
+	if u.limiter != nil {
+		body = &rateLimitedReader{r: body, limiter: u.limiter}
+	}
+	resp, err := u.storage.doWithBody(ctx, http.MethodPut, u.key(file.name), query, body, size)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// finish records the file is uploaded.
+func (u *uploader) finish(file *uploadFile) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.state.Uploads, file.name)
+	u.state.Done[file.name] = file.stamp
+	return errors.Trace(u.saveState())
+}
+
+func (u *uploader) key(name string) string {
+	return path.Join(u.storage.prefix, name)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3ListPartsResult struct {
+	IsTruncated          bool     `xml:"IsTruncated"`
+	NextPartNumberMarker string   `xml:"NextPartNumberMarker"`
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// s3CompleteMultipartUploadResult is the result of completing a multipart upload, it may be an error even with
+// the status 200, because the status is sent before the parts are concatenated.
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (u *uploader) createMultipartUpload(ctx context.Context, name string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+	result := &s3InitiateMultipartUploadResult{}
+	err := withUploadRetry(ctx, fmt.Sprintf("create multipart upload of %s", name), func() error {
+		resp, err := u.storage.doWithBody(ctx, http.MethodPost, u.key(name), query, nil, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer resp.Body.Close()
+		return errors.Trace(xml.NewDecoder(resp.Body).Decode(result))
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(result.UploadID) == 0 {
+		return "", errors.Errorf("no upload id in the result of creating multipart upload of %s", name)
+	}
+	return result.UploadID, nil
+}
+
+// listParts returns the uploaded parts of the multipart upload keyed by the part number.
+func (u *uploader) listParts(ctx context.Context, name, uploadID string) (map[int]s3Part, error) {
+	parts := make(map[int]s3Part)
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("uploadId", uploadID)
+		if len(marker) != 0 {
+			query.Set("part-number-marker", marker)
+		}
+		result := &s3ListPartsResult{}
+		err := withUploadRetry(ctx, fmt.Sprintf("list parts of %s", name), func() error {
+			resp, err := u.storage.doWithBody(ctx, http.MethodGet, u.key(name), query, nil, 0)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer resp.Body.Close()
+			return errors.Trace(xml.NewDecoder(resp.Body).Decode(result))
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, part := range result.Parts {
+			parts[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// complete completes the multipart upload of the file by its parts in order.
+func (u *uploader) complete(ctx context.Context, file *uploadFile) error {
+	request := &s3CompleteMultipartUpload{}
+	file.mu.Lock()
+	for part, etag := range file.etags {
+		request.Parts = append(request.Parts, s3Part{PartNumber: part, ETag: etag})
+	}
+	file.mu.Unlock()
+	sort.Slice(request.Parts, func(i, j int) bool { return request.Parts[i].PartNumber < request.Parts[j].PartNumber })
+	data, err := xml.Marshal(request)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", file.upload.UploadID)
+	err = withUploadRetry(ctx, fmt.Sprintf("complete multipart upload of %s", file.name), func() error {
+		resp, err := u.storage.doWithBody(ctx, http.MethodPost, u.key(file.name), query, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer resp.Body.Close()
+		result := &s3CompleteMultipartUploadResult{}
+		if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+			return errors.Trace(err)
+		}
+		if result.XMLName.Local == "Error" {
+			// it's retried like a 5xx response
+			return errors.Trace(&s3RequestError{method: http.MethodPost, uri: u.key(file.name), status: resp.Status,
+				statusCode: http.StatusInternalServerError, message: result.Code + ": " + result.Message})
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(u.finish(file))
+}
+
+// withUploadRetry calls fn until it succeeds, the network errors and the responses of 5xx and 429 are retried
+// at most uploadMaxRetry times, the interval doubles from uploadRetryInterval up to uploadMaxRetryInterval.
+func withUploadRetry(ctx context.Context, request string, fn func() error) error {
+	interval := uploadRetryInterval
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if i == uploadMaxRetry || ctx.Err() != nil || !isRetryableUploadError(err) {
+			return errors.Annotate(err, request)
+		}
+		log.Warn("upload request failed, will retry", zap.String("request", request), zap.Int("retry", i+1),
+			zap.Duration("after", interval), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > uploadMaxRetryInterval {
+			interval = uploadMaxRetryInterval
+		}
+	}
+}
+
+func isRetryableUploadError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *s3RequestError:
+		return e.statusCode/100 == 5 || e.statusCode == http.StatusTooManyRequests
+	case *url.Error:
+		// the request is not sent or the connection is broken
+		return true
+	}
+	return false
+}
+
+// rateLimitedReader waits for the tokens of the bytes read from r, the limiter is shared by all the uploads.
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > uploadReadChunk {
+		p = p[:uploadReadChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(int64(n))
+	}
+	return n, err
+}
+
+// uploadOutput uploads dir to output-storage if it's set.
+func (r *PITR) uploadOutput(ctx context.Context, dir string) error {
+	if r.cfg.OutputStorage == "" {
+		return nil
+	}
+	start := time.Now()
+	if err := uploadOutput(ctx, r.cfg.uploadConfig(dir), r.progress); err != nil {
+		return errors.Annotatef(err, "upload output to %s, it can be resumed by the upload subcommand", redactStorageURI(r.cfg.OutputStorage))
+	}
+	phaseDurationGauge.WithLabelValues(phaseUpload).Set(time.Since(start).Seconds())
+	return nil
+}
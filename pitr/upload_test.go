@@ -0,0 +1,175 @@
+package pitr
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// fakeS3 is an in-memory object storage supporting the requests of multipart upload.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	// completed is the keys in the order they're complete
+	completed []string
+	uploads   map[string]map[int][]byte
+	nextID    int
+	// puts is the number of PUT requests of every key and part, including the failed ones
+	puts map[string]int
+	// fail returns the status to respond to the request, 0 means not failed
+	fail func(r *http.Request) int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	if r.Method == http.MethodPut {
+		s.puts[key+"#"+query.Get("partNumber")]++
+	}
+	if status := s.fail(r); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Get("uploadId") == "":
+		s.nextID++
+		id := fmt.Sprint(s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut:
+		if id := query.Get("uploadId"); id != "" {
+			var part int
+			fmt.Sscan(query.Get("partNumber"), &part)
+			s.uploads[id][part] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, id, part))
+			return
+		}
+		s.objects[key] = body
+		s.completed = append(s.completed, key)
+	case r.Method == http.MethodGet:
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for part, data := range parts {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>\"%s-%d\"</ETag><Size>%d</Size></Part>", part, query.Get("uploadId"), part, len(data))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == http.MethodPost:
+		id := query.Get("uploadId")
+		request := &s3CompleteMultipartUpload{}
+		if err := xml.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for i, part := range request.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"%s-%d"`, id, i+1) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			data = append(data, s.uploads[id][part.PartNumber]...)
+		}
+		delete(s.uploads, id)
+		s.objects[key] = data
+		s.completed = append(s.completed, key)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	}
+}
+
+func TestUploadOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(size int64, interval time.Duration) {
+		uploadPartSize, uploadRetryInterval = size, interval
+	}(uploadPartSize, uploadRetryInterval)
+	uploadPartSize, uploadRetryInterval = 10, time.Millisecond
+
+	output := filepath.Join(dir, "output")
+	files := map[string]string{
+		"test_t1.sql":      "insert",
+		"test_t2/binlog-0": "0123456789abcdefghijABCDE",
+		checksumFileName:   "checksums",
+	}
+	assert.NilError(t, os.MkdirAll(filepath.Join(output, "test_t2"), 0700))
+	for name, content := range files {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(output, name), []byte(content), 0600))
+	}
+
+	s3 := &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+		puts:    make(map[string]int),
+	}
+	// the part 2 is failed by 503 once and retried, the part 3 is failed by 403 in the first run, which uploads
+	// the files and parts in order by one worker
+	var unavailable bool
+	s3.fail = func(r *http.Request) int {
+		switch r.URL.Query().Get("partNumber") {
+		case "2":
+			if !unavailable {
+				unavailable = true
+				return http.StatusServiceUnavailable
+			}
+		case "3":
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	cfg := &UploadConfig{Dir: output, Storage: "s3://bucket/prefix?endpoint=" + server.URL, Concurrency: 1, RateLimit: "1MiB"}
+	err = Upload(context.Background(), cfg)
+	assert.ErrorContains(t, err, "upload part 3 of test_t2/binlog-0")
+	assert.ErrorContains(t, err, "403")
+	_, err = os.Stat(output + uploadStateSuffix)
+	assert.NilError(t, err)
+	s3.Lock()
+	_, ok := s3.objects["prefix/"+checksumFileName]
+	assert.Assert(t, !ok)
+	s3.fail = func(*http.Request) int { return 0 }
+	s3.Unlock()
+
+	// the upload is resumed from the uploaded files and parts
+	cfg.Concurrency = 2
+	assert.NilError(t, Upload(context.Background(), cfg))
+	s3.Lock()
+	defer s3.Unlock()
+	for name, content := range files {
+		assert.Equal(t, string(s3.objects["prefix/"+name]), content)
+	}
+	assert.Equal(t, s3.completed[len(s3.completed)-1], "prefix/"+checksumFileName)
+	assert.Equal(t, len(s3.completed), 3)
+	assert.Equal(t, s3.puts["prefix/test_t1.sql#"], 1)
+	assert.Equal(t, s3.puts["prefix/test_t2/binlog-0#1"], 1)
+	assert.Equal(t, s3.puts["prefix/test_t2/binlog-0#2"], 2)
+	assert.Equal(t, s3.puts["prefix/test_t2/binlog-0#3"], 2)
+	_, err = os.Stat(output + uploadStateSuffix)
+	assert.Assert(t, os.IsNotExist(err))
+
+	cfg.Storage = "local:///backup"
+	assert.ErrorContains(t, Upload(context.Background(), cfg), "only s3 is supported")
+}
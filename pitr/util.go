@@ -3,8 +3,13 @@ package pitr
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
 )
 
 // copy file
@@ -44,3 +49,85 @@ func quoteName(name string) string {
 func escapeName(name string) string {
 	return strings.Replace(name, "`", "``", -1)
 }
+
+// dirSize returns the total size of regular files in dir, sub directories are not included.
+func dirSize(dir string) (int64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TIB", 1 << 40}, {"TB", 1 << 40}, {"T", 1 << 40},
+	{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+	{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+	{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses the size like 1024, 512MiB or 100G, the units are 1024 based and case insensitive.
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size %s, should be like 1024, 512MiB or 100G", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// formatSize formats the size in bytes with 1024 based unit, like 1.5GiB.
+func formatSize(size int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if size >= u.size {
+			return strconv.FormatFloat(float64(size)/float64(u.size), 'f', 1, 64) + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+// diskQuota limits the bytes written to the files in dir, a nil diskQuota or zero limit means no limit.
+type diskQuota struct {
+	dir   string
+	limit int64
+	// used is updated atomically
+	used int64
+}
+
+func newDiskQuota(dir string, limit int64, used int64) *diskQuota {
+	return &diskQuota{dir: dir, limit: limit, used: used}
+}
+
+// add adds n bytes to the used size, and returns error if the quota is exceeded.
+func (q *diskQuota) add(n int64) error {
+	if q == nil || q.limit <= 0 {
+		return nil
+	}
+	if used := atomic.AddInt64(&q.used, n); used > q.limit {
+		return errors.Errorf("the files in %s exceed the quota %d bytes, use a larger quota or merge fewer tables by --tables at a time", q.dir, q.limit)
+	}
+	return nil
+}
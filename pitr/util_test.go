@@ -19,3 +19,39 @@ func TestQuoteFunc(t *testing.T) {
 	s = escapeName("test`test")
 	assert.Assert(t, strings.EqualFold("test``test", s))
 }
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+	}{
+		{"1024", 1024},
+		{"10b", 10},
+		{"512MiB", 512 << 20},
+		{" 100G ", 100 << 30},
+		{"1.5kb", 1536},
+		{"2T", 2 << 40},
+	}
+	for _, tt := range tests {
+		size, err := parseSize(tt.s)
+		assert.Assert(t, err == nil, tt.s)
+		assert.Equal(t, size, tt.size, tt.s)
+	}
+
+	for _, s := range []string{"", "G", "-1G", "10X"} {
+		_, err := parseSize(s)
+		assert.Assert(t, err != nil, s)
+	}
+}
+
+func TestDiskQuota(t *testing.T) {
+	var q *diskQuota
+	assert.Assert(t, q.add(100) == nil)
+
+	q = newDiskQuota("temp", 0, 0)
+	assert.Assert(t, q.add(100) == nil)
+
+	q = newDiskQuota("temp", 100, 50)
+	assert.Assert(t, q.add(50) == nil)
+	assert.ErrorContains(t, q.add(1), "exceed the quota")
+}
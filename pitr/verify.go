@@ -0,0 +1,279 @@
+package pitr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"go.uber.org/zap"
+)
+
+// rowCounts is the number of inserted and deleted rows of every table, keyed by schema_table.
+type rowCounts map[string]*rowCount
+
+type rowCount struct {
+	Inserts int64
+	Deletes int64
+}
+
+// net returns the net row change of the table, update doesn't change the number of rows.
+func (c *rowCount) net() int64 {
+	return c.Inserts - c.Deletes
+}
+
+func (rc rowCounts) add(schema, table string, tp pb.EventType) {
+	rc.addKey(fmt.Sprintf("%s_%s", schema, table), tp)
+}
+
+func (rc rowCounts) addKey(key string, tp pb.EventType) {
+	c, ok := rc[key]
+	if !ok {
+		c = &rowCount{}
+		rc[key] = c
+	}
+	switch tp {
+	case pb.EventType_Insert:
+		c.Inserts++
+	case pb.EventType_Delete:
+		c.Deletes++
+	}
+}
+
+// group returns the counts of rc added by groups, the table not in groups is its own group.
+func (rc rowCounts) group(groups map[string]string) rowCounts {
+	grouped := make(rowCounts, len(rc))
+	for key, c := range rc {
+		if g, ok := groups[key]; ok {
+			key = g
+		}
+		grouped.merge(rowCounts{key: c})
+	}
+	return grouped
+}
+
+// merge adds the counts of other to rc.
+func (rc rowCounts) merge(other rowCounts) {
+	for key, o := range other {
+		c, ok := rc[key]
+		if !ok {
+			c = &rowCount{}
+			rc[key] = c
+		}
+		c.Inserts += o.Inserts
+		c.Deletes += o.Deletes
+	}
+}
+
+// countSourceRows counts the rows changed by the binlogs after skipCommitTS in files, the tables skipped by f
+// and the rows skipped by rf are not counted. Map splits all these binlogs, so all of them are counted,
+// the damaged regions are skipped by relax in the same way as Map. The tables renamed by these binlogs
+// are tracked by the returned renameTracker.
+func countSourceRows(files []string, f *tableFilter, rf *rowFilter, skipCommitTS int64, relax string, opts runOptions) (rowCounts, *renameTracker, error) {
+	counts := make(rowCounts)
+	renames := &renameTracker{}
+	for _, file := range files {
+		if _, err := scanSourceBinlogFile(file, relax, opts, func(binlog *pb.Binlog, _ int64) error {
+			if binlog.CommitTs <= skipCommitTS {
+				return nil
+			}
+			if binlog.Tp == pb.BinlogType_DDL {
+				_, err := renames.track(string(binlog.GetDdlQuery()))
+				return errors.Trace(err)
+			}
+			for _, event := range binlog.GetDmlData().GetEvents() {
+				if f.skipRenamed(event.GetSchemaName(), event.GetTableName(), renames) {
+					continue
+				}
+				if rf == nil {
+					counts.add(event.GetSchemaName(), event.GetTableName(), event.GetTp())
+					continue
+				}
+				// update changes the number of rows if only one of its images matches the row filter
+				evs, err := rewriteDML(&event)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				for _, ev := range evs {
+					matched, err := rf.match(ev)
+					if err != nil {
+						return errors.Trace(err)
+					}
+					if matched {
+						counts.add(ev.GetSchemaName(), ev.GetTableName(), ev.GetTp())
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	return counts, renames, nil
+}
+
+// countOutputRows counts the rows changed by the merged binlogs in outputDir, the rows are counted by the
+// output name of table like the text formats, the tables in the events may be renamed by route-rules.
+func countOutputRows(outputDir string, outputFormat string, opts runOptions) (rowCounts, error) {
+	if outputFormat == outputFormatSQL || outputFormat == outputFormatJSONL {
+		return countSQLOutputRows(outputDir, outputFormat, opts)
+	}
+
+	counts := make(rowCounts)
+	tables, err := readSubDirs(outputDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, table := range tables {
+		reader, err := newDirPbReader(filepath.Join(outputDir, table), 0, 0, opts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for {
+			binlog, err := reader.read()
+			if err != nil {
+				reader.close()
+				if errors.Cause(err) == io.EOF {
+					break
+				}
+				return nil, errors.Trace(err)
+			}
+			for _, event := range binlog.GetDmlData().GetEvents() {
+				counts.addKey(table, event.GetTp())
+			}
+		}
+	}
+	return counts, nil
+}
+
+// countSQLOutputRows counts the INSERT, REPLACE and DELETE statements in the sql files, or the insert and delete objects
+// in the jsonl files, every statement or object is in one line, the compressed files are decompressed.
+func countSQLOutputRows(outputDir string, outputFormat string, opts runOptions) (rowCounts, error) {
+	insertPrefix, deletePrefix := "INSERT INTO ", "DELETE FROM "
+	if outputFormat == outputFormatJSONL {
+		insertPrefix, deletePrefix = jsonlPrefix(jsonlTypes[pb.EventType_Insert]), jsonlPrefix(jsonlTypes[pb.EventType_Delete])
+	}
+	suffix := textFileSuffix(outputFormat)
+
+	infos, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	counts := make(rowCounts)
+	for _, info := range infos {
+		name := info.Name()
+		base, _ := trimCompressSuffix(strings.TrimSuffix(name, encryptSuffix))
+		if info.IsDir() || name == schemaFileName || name == autoIDFileName || base == replayFileName || !strings.HasSuffix(base, suffix) {
+			continue
+		}
+		// the rotated files of a table are counted together
+		table := sqlFileTable(base)
+		c, ok := counts[table]
+		if !ok {
+			c = &rowCount{}
+			counts[table] = c
+		}
+
+		f, err := os.Open(filepath.Join(outputDir, name))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r, err := newDecompressReader(name, f, opts.cipher)
+		if err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), int(maxMemorySize))
+		for scanner.Scan() {
+			line := scanner.Text()
+			// the inserts are replaced by REPLACE in safe mode
+			if strings.HasPrefix(line, insertPrefix) || strings.HasPrefix(line, "REPLACE INTO ") {
+				c.Inserts++
+			} else if strings.HasPrefix(line, deletePrefix) {
+				c.Deletes++
+			}
+		}
+		err = scanner.Err()
+		r.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "read sql file %s", name)
+		}
+	}
+	return counts, nil
+}
+
+// compareRowCounts returns the discrepancies of net row changes between source and output, sorted by table.
+func compareRowCounts(source, output rowCounts) []string {
+	tables := make(map[string]struct{}, len(source))
+	for table := range source {
+		tables[table] = struct{}{}
+	}
+	for table := range output {
+		tables[table] = struct{}{}
+	}
+
+	var diffs []string
+	for table := range tables {
+		var sourceNet, outputNet int64
+		if c, ok := source[table]; ok {
+			sourceNet = c.net()
+		}
+		if c, ok := output[table]; ok {
+			outputNet = c.net()
+		}
+		if sourceNet != outputNet {
+			diffs = append(diffs, fmt.Sprintf("table %s: net row change of source binlogs is %d, but merged binlogs is %d", table, sourceNet, outputNet))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// verify checks the net row change of every table in merged binlogs is the same as the source binlogs.
+func (r *PITR) verify(files []string, m *Merge) error {
+	source, renames, err := countSourceRows(files, r.filter, r.rowFilter, m.mergedCommitTS(), r.cfg.RelaxCorruption, r.opts)
+	if err != nil {
+		return errors.Annotate(err, "count rows of source binlogs")
+	}
+	if len(m.baseDir) != 0 {
+		// the rows in base dir are folded into output
+		base, err := countOutputRows(m.baseDir, outputFormatPB, r.opts)
+		if err != nil {
+			return errors.Annotate(err, "count rows of base binlogs")
+		}
+		source.merge(base)
+	}
+	output, err := countOutputRows(m.outputDir, r.cfg.OutputFormat, r.opts)
+	if err != nil {
+		return errors.Annotate(err, "count rows of merged binlogs")
+	}
+
+	// the rows of a renamed table may be merged under any of its names, so they are compared together
+	groups := renames.groups()
+	diffs := compareRowCounts(source.group(groups), output.group(groups))
+	for _, diff := range diffs {
+		log.Error("verify failed", zap.String("discrepancy", diff))
+	}
+	if len(diffs) != 0 {
+		return errors.Errorf("verify failed, %d tables have discrepancy, the first one is: %s", len(diffs), diffs[0])
+	}
+
+	// the merged binlogs are replayed by reparo if they are not compressed or encrypted
+	if r.cfg.OutputFormat == outputFormatPB && compressSuffix(r.cfg.Compress) == "" && r.opts.cipher == nil {
+		if err := checkReparoOutput(m.outputDir); err != nil {
+			return errors.Annotate(err, "verify failed")
+		}
+	}
+
+	log.Info("verify passed", zap.Int("tables", len(source)))
+	return nil
+}
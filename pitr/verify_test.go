@@ -0,0 +1,75 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	"gotest.tools/assert"
+)
+
+func TestCountSourceRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, binlogfile.BinlogName(0))
+	f, err := os.Create(file)
+	assert.Assert(t, err == nil)
+	for i, schema := range []string{"test", "test", "ignore"} {
+		data, err := genTestDML(schema, "tb1", int64(i+1)).Marshal()
+		assert.Assert(t, err == nil)
+		_, err = f.Write(binlogfile.Encode(data))
+		assert.Assert(t, err == nil)
+	}
+	f.Close()
+
+	counts, _, err := countSourceRows([]string{file}, newTableFilter(&Config{IgnoreDBs: []string{"ignore"}}), nil, 0, relaxAbort, runOptions{})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(counts) == 1)
+	assert.DeepEqual(t, *counts["test_tb1"], rowCount{Inserts: 2, Deletes: 2})
+}
+
+func TestCountSQLOutputRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test_tb1.sql"), []byte(
+		"create table tb1 (a int primary key);\n"+
+			"INSERT INTO `test`.`tb1` (`a`) VALUES (1);\n"+
+			"INSERT INTO `test`.`tb1` (`a`) VALUES (2);\n"+
+			"UPDATE `test`.`tb1` SET `a`=3 WHERE `a`=4 LIMIT 1;\n"+
+			"DELETE FROM `test`.`tb1` WHERE `a`=5 LIMIT 1;\n"), 0600)
+	assert.Assert(t, err == nil)
+	err = ioutil.WriteFile(filepath.Join(dir, schemaFileName), []byte("INSERT INTO `x`.`y` (`a`) VALUES (1);\n"), 0600)
+	assert.Assert(t, err == nil)
+
+	counts, err := countOutputRows(dir, outputFormatSQL, runOptions{})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(counts) == 1)
+	assert.DeepEqual(t, *counts["test_tb1"], rowCount{Inserts: 2, Deletes: 1})
+}
+
+func TestCompareRowCounts(t *testing.T) {
+	source := rowCounts{
+		"test_tb1": {Inserts: 3, Deletes: 1},
+		"test_tb2": {Inserts: 1, Deletes: 1},
+		"test_tb3": {Inserts: 1},
+	}
+	output := rowCounts{
+		"test_tb1": {Inserts: 2},
+		"test_tb3": {Inserts: 2},
+	}
+
+	diffs := compareRowCounts(source, output)
+	assert.DeepEqual(t, diffs, []string{
+		"table test_tb3: net row change of source binlogs is 1, but merged binlogs is 2",
+	})
+
+	output["test_tb4"] = &rowCount{Deletes: 1}
+	diffs = compareRowCounts(source, output)
+	assert.Assert(t, len(diffs) == 2)
+}
@@ -0,0 +1,427 @@
+package pitr
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-binlog/pkg/filter"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/tsthght/PITR/pitr/storage"
+)
+
+const (
+	binlogChanSize = 1024
+
+	// mergedChunkSize is the number of binlogs in one chunk when merging the binlogs of multiple sources,
+	// Map saves checkpoint after every chunk.
+	mergedChunkSize = 100000
+)
+
+// mapTask is the events of one table in a DML binlog.
+type mapTask struct {
+	schema string
+	table  string
+	// dir is the temp dir of the table, see tableDir of Merge, empty means the table's name
+	dir      filter.TableName
+	commitTS int64
+	events   []pb.Event
+	// segment is the segment of the table in store, see kvSegments of Merge
+	segment int64
+}
+
+// mapWorker splits the DML events into temp files. Every table is handled by only one worker,
+// so the events of one table are still written in the order of commit ts.
+type mapWorker struct {
+	tempDir  string
+	splitNum int
+	// rowFilter skips the rows not matching the expressions, can be nil
+	rowFilter *rowFilter
+	// masker masks the columns after the row is filtered and its key is got, can be nil
+	masker *columnMasker
+	// report records the number of events split to temp files, can be nil
+	report *runReport
+	// quota limits the size of temp files, can be nil
+	quota *diskQuota
+	// cipher encrypts the temp files, nil means not encrypted
+	cipher *payloadCipher
+	// store saves the events instead of temp files if it's not nil
+	store *storage.Store
+	// noPKPolicy is how to merge the tables without primary key or unique key
+	noPKPolicy string
+
+	fileMap map[string]*PBFile
+
+	taskCh chan *mapTask
+	wg     *sync.WaitGroup
+
+	// err is the first error when handle task, it can be read after wg.Wait()
+	err error
+}
+
+// dirName returns the name of the task's temp dir.
+func (t *mapTask) dirName() filter.TableName {
+	if len(t.dir.Table) == 0 {
+		return filter.TableName{Schema: t.schema, Table: t.table}
+	}
+	return t.dir
+}
+
+func newMapWorker(tempDir string, splitNum int, wg *sync.WaitGroup) *mapWorker {
+	return &mapWorker{
+		tempDir:  tempDir,
+		splitNum: splitNum,
+		fileMap:  make(map[string]*PBFile),
+		taskCh:   make(chan *mapTask, binlogChanSize),
+		wg:       wg,
+	}
+}
+
+func (w *mapWorker) run() {
+	for task := range w.taskCh {
+		// skip all the tasks after error, Map will stop when it finds the error
+		if w.err == nil {
+			w.err = w.handle(task)
+		}
+		w.wg.Done()
+	}
+}
+
+func (w *mapWorker) handle(task *mapTask) error {
+	info, appendOnly, err := w.appendOnly(task)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// the rows of an append-only table are not merged, so their keys can be masked
+	if appendOnly {
+		info = nil
+	}
+	if w.store != nil {
+		return errors.Trace(w.handleStore(task, info, appendOnly))
+	}
+	dir := task.dirName()
+	pf, err := w.getPBFile(dir.Schema, dir.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var count int64
+	defer func() {
+		w.report.addEventsBeforeMerge(fmt.Sprintf("%s_%s", dir.Schema, dir.Table), count)
+	}()
+
+	for _, event := range task.events {
+		// update is split into delete of the before image and insert of the after image, so the
+		// events of a row are merged by its key even if the update changes primary key or unique key
+		evs, err := rewriteDML(&event)
+		if err != nil {
+			return err
+		}
+		for _, v := range evs {
+			// the before and after image of update are filtered separately, so a row
+			// updated out of the filter is deleted, and updated into the filter is inserted
+			matched, err := w.rowFilter.match(v)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if !matched {
+				continue
+			}
+			// all the events of an append-only table are written to one file in order
+			var hk string
+			if !appendOnly {
+				if hk, err = getHashKey(task.schema, task.table, v); err != nil {
+					return err
+				}
+			}
+			if err := w.masker.mask(v, info); err != nil {
+				return errors.Trace(err)
+			}
+			if err := pf.AddDMLEvent(*v, task.commitTS, hk); err != nil {
+				return errors.Trace(err)
+			}
+			count++
+		}
+	}
+
+	return nil
+}
+
+// appendOnly returns the info of the task's table, and true if its events should be appended without merging.
+func (w *mapWorker) appendOnly(task *mapTask) (*tableInfo, bool, error) {
+	info, err := ddlHandle.GetTableInfo(task.schema, task.table)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	appendOnly, err := checkNoPK(info, w.noPKPolicy)
+	return info, appendOnly, errors.Trace(err)
+}
+
+// handleStore writes the events of task to store in a batch, the events of a row are sorted by commit ts
+// and their index in task, so writing the task again after resume doesn't duplicate them. The events of
+// an append-only table are saved as one row, so they are kept in order.
+func (w *mapWorker) handleStore(task *mapTask, info *tableInfo, appendOnly bool) error {
+	dir := task.dirName()
+	table := fmt.Sprintf("%s_%s", dir.Schema, dir.Table)
+	batch := new(storage.Batch)
+	for i := range task.events {
+		evs, err := rewriteDML(&task.events[i])
+		if err != nil {
+			return err
+		}
+		for j, v := range evs {
+			matched, err := w.rowFilter.match(v)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if !matched {
+				continue
+			}
+			var hk string
+			if !appendOnly {
+				if hk, err = getHashKey(task.schema, task.table, v); err != nil {
+					return err
+				}
+			}
+			if err = w.masker.mask(v, info); err != nil {
+				return errors.Trace(err)
+			}
+			if err = putEvent(batch, table, task.segment, hk, task.commitTS, uint32(i*2+j), v, w.cipher); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	batch.PutMaxCommitTS(table, task.commitTS)
+	if err := w.quota.add(batch.Size()); err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.store.Write(batch); err != nil {
+		return errors.Trace(err)
+	}
+	// the max commit ts isn't an event
+	w.report.addEventsBeforeMerge(table, int64(batch.Len()-1))
+	return nil
+}
+
+func (w *mapWorker) getPBFile(schema, table string) (*PBFile, error) {
+	key := fmt.Sprintf("%s_%s", schema, table)
+	if pf, ok := w.fileMap[key]; ok {
+		return pf, nil
+	}
+
+	pf, err := NewPbFile(w.tempDir, schema, table, w.splitNum)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pf.quota = w.quota
+	pf.binlogger.cipher = w.cipher
+	w.fileMap[key] = pf
+	return pf, nil
+}
+
+// closeFiles flushes and closes all the temp files of the worker.
+func (w *mapWorker) closeFiles() {
+	for _, pf := range w.fileMap {
+		pf.Close()
+	}
+}
+
+// workerIndex returns the index of the worker which handles the table.
+func workerIndex(key string, workerNum int) int {
+	return int(crc32.ChecksumIEEE([]byte(key)) % uint32(workerNum))
+}
+
+// binlogFileReader decodes the binlogs in one binlog file.
+type binlogFileReader struct {
+	name string
+	// relax is how to handle the corrupted file, see relax-corruption
+	relax string
+	// opts is the settings of the run used to decode the binlogs
+	opts     runOptions
+	binlogCh chan *pb.Binlog
+	// errCh receives the error before binlogCh is closed
+	errCh chan error
+
+	// the fields below can be read after binlogCh is closed
+	size    int64
+	firstTS int64
+	lastTS  int64
+	// gap is the damaged region skipped, nil if the file isn't corrupted
+	gap *corruptionGap
+}
+
+func (r *binlogFileReader) run(p *progress, quit chan struct{}) {
+	defer close(r.binlogCh)
+
+	gap, err := scanSourceBinlogFile(r.name, r.relax, r.opts, func(binlog *pb.Binlog, n int64) error {
+		p.addBytes(n)
+		if r.firstTS == 0 {
+			r.firstTS = binlog.CommitTs
+		}
+		r.lastTS = binlog.CommitTs
+
+		select {
+		case r.binlogCh <- binlog:
+			return nil
+		case <-quit:
+			return errStopScan
+		}
+	})
+	if err != nil {
+		if errors.Cause(err) != errStopScan {
+			r.errCh <- errors.Trace(err)
+		}
+		return
+	}
+	r.gap = gap
+	filesCounter.WithLabelValues(phaseMap).Inc()
+}
+
+// err returns the error of reader, should be called after binlogCh is closed.
+func (r *binlogFileReader) err() error {
+	select {
+	case err := <-r.errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// readBinlogFiles decodes at most concurrency binlog files at the same time,
+// and returns the readers in the order of files, the decoded bytes are added to p.
+func readBinlogFiles(files []string, concurrency int, relax string, opts runOptions, p *progress, quit chan struct{}) chan *binlogFileReader {
+	readerCh := make(chan *binlogFileReader, concurrency)
+	sem := make(chan struct{}, concurrency)
+
+	go func() {
+		defer close(readerCh)
+
+		for _, name := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				return
+			}
+
+			r := &binlogFileReader{
+				name:     name,
+				relax:    relax,
+				opts:     opts,
+				binlogCh: make(chan *pb.Binlog, binlogChanSize),
+				errCh:    make(chan error, 1),
+			}
+			go func() {
+				r.run(p, quit)
+				<-sem
+			}()
+
+			select {
+			case readerCh <- r:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return readerCh
+}
+
+// sourceReader reads the binlogs of one source in order.
+type sourceReader struct {
+	readerCh chan *binlogFileReader
+	cur      *binlogFileReader
+	// onFile is called after a file is read completely, can be nil
+	onFile func(r *binlogFileReader)
+	// gaps reports the binlogs lost in the corrupted files of the source
+	gaps gapTracker
+}
+
+var _ PbReader = &sourceReader{}
+
+func (s *sourceReader) read() (*pb.Binlog, error) {
+	for {
+		if s.cur == nil {
+			r, ok := <-s.readerCh
+			if !ok {
+				s.gaps.finish()
+				return nil, io.EOF
+			}
+			s.cur = r
+		}
+
+		if binlog, ok := <-s.cur.binlogCh; ok {
+			s.gaps.add(binlog.CommitTs)
+			return binlog, nil
+		}
+		if err := s.cur.err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.gaps.fileDone(s.cur.gap)
+		if s.onFile != nil {
+			s.onFile(s.cur)
+		}
+		s.cur = nil
+	}
+}
+
+// readBinlogSources merges the binlogs of multiple sources in the order of commit ts, the files of one source
+// are read in order. The merged binlogs are split into chunks, every chunk is returned as a binlogFileReader.
+// onFile is called with the reader of every file after the file is read completely, and onGap is called with
+// the binlogs lost in every corrupted file of a source, both can be nil.
+func readBinlogSources(sources [][]string, relax string, opts runOptions, p *progress, quit chan struct{},
+	onFile func(r *binlogFileReader), onGap func(gap *corruptionGap)) chan *binlogFileReader {
+	readers := make([]PbReader, 0, len(sources))
+	for _, files := range sources {
+		readers = append(readers, &sourceReader{
+			readerCh: readBinlogFiles(files, 1, relax, opts, p, quit),
+			onFile:   onFile,
+			gaps:     gapTracker{onGap: onGap},
+		})
+	}
+	merged := newMergePbReader(readers)
+	readerCh := make(chan *binlogFileReader, 1)
+
+	go func() {
+		defer close(readerCh)
+
+		for chunk := 0; ; chunk++ {
+			r := &binlogFileReader{
+				name:     fmt.Sprintf("merged chunk %d", chunk),
+				binlogCh: make(chan *pb.Binlog, binlogChanSize),
+				errCh:    make(chan error, 1),
+			}
+			select {
+			case readerCh <- r:
+			case <-quit:
+				return
+			}
+
+			for i := 0; i < mergedChunkSize; i++ {
+				binlog, err := merged.read()
+				if err != nil {
+					if errors.Cause(err) != io.EOF {
+						r.errCh <- errors.Trace(err)
+					}
+					close(r.binlogCh)
+					return
+				}
+
+				select {
+				case r.binlogCh <- binlog:
+				case <-quit:
+					close(r.binlogCh)
+					return
+				}
+			}
+			close(r.binlogCh)
+		}
+	}()
+
+	return readerCh
+}
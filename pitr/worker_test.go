@@ -0,0 +1,137 @@
+package pitr
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/check"
+	"github.com/pingcap/tidb-binlog/pkg/binlogfile"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+)
+
+type testWorkerSuite struct{}
+
+var _ = check.Suite(&testWorkerSuite{})
+
+func (s *testWorkerSuite) TestReadBinlogFiles(c *check.C) {
+	dir := c.MkDir()
+	binlogs := writeBinlogsInDir(dir, c)
+
+	files, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+
+	for _, concurrency := range []int{1, 3, 16} {
+		quit := make(chan struct{})
+		var readBinlogs []*pb.Binlog
+		for r := range readBinlogFiles(files, concurrency, relaxAbort, runOptions{}, newProgress(), quit) {
+			for binlog := range r.binlogCh {
+				readBinlogs = append(readBinlogs, binlog)
+			}
+			c.Assert(r.err(), check.IsNil)
+		}
+		close(quit)
+
+		c.Assert(readBinlogs, check.DeepEquals, binlogs)
+	}
+}
+
+func (s *testWorkerSuite) TestReadBinlogFilesQuit(c *check.C) {
+	dir := c.MkDir()
+	writeBinlogsInDir(dir, c)
+
+	files, err := searchFiles(dir)
+	c.Assert(err, check.IsNil)
+
+	quit := make(chan struct{})
+	readerCh := readBinlogFiles(files, 2, relaxAbort, runOptions{}, newProgress(), quit)
+	r := <-readerCh
+	<-r.binlogCh
+	close(quit)
+
+	// readerCh will be closed after quit
+	for range readerCh {
+	}
+}
+
+func (s *testWorkerSuite) TestWorkerIndex(c *check.C) {
+	for _, key := range []string{"test_tb1", "test_tb2", "db_t"} {
+		index := workerIndex(key, 4)
+		c.Assert(index >= 0 && index < 4, check.IsTrue)
+		c.Assert(workerIndex(key, 4), check.Equals, index)
+	}
+	c.Assert(workerIndex("test_tb1", 1), check.Equals, 0)
+}
+
+func (s *testWorkerSuite) TestReadBinlogSources(c *check.C) {
+	// the binlogs with odd commit ts are in dir1, and even commit ts are in dir2
+	var sources [][]string
+	for i := 0; i < 2; i++ {
+		dir := c.MkDir()
+		for index := 0; index < 3; index++ {
+			var data []byte
+			for j := 0; j < 5; j++ {
+				ts := int64(index*10+j*2+i) + 1
+				binlogData, err := genTestDDL("test", "tb1", "create database test", ts).Marshal()
+				c.Assert(err, check.IsNil)
+				data = append(data, binlogfile.Encode(binlogData)...)
+			}
+			err := ioutil.WriteFile(filepath.Join(dir, binlogfile.BinlogName(uint64(index))), data, 0600)
+			c.Assert(err, check.IsNil)
+		}
+
+		files, err := searchFiles(dir)
+		c.Assert(err, check.IsNil)
+		sources = append(sources, files)
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	var commitTSs []int64
+	for r := range readBinlogSources(sources, relaxAbort, runOptions{}, newProgress(), quit, nil, nil) {
+		for binlog := range r.binlogCh {
+			commitTSs = append(commitTSs, binlog.CommitTs)
+		}
+		c.Assert(r.err(), check.IsNil)
+	}
+
+	c.Assert(commitTSs, check.HasLen, 30)
+	for i := 1; i < len(commitTSs); i++ {
+		c.Assert(commitTSs[i] > commitTSs[i-1], check.IsTrue)
+	}
+}
+
+func (s *testWorkerSuite) TestWorkerSplitUpdate(c *check.C) {
+	ddlHandle = &DDLHandle{}
+	ddlHandle.tableInfos.Store(quoteSchema("test", "tb1"), &tableInfo{
+		schema:     "test",
+		table:      "tb1",
+		columns:    []string{"a"},
+		uniqueKeys: []indexInfo{{name: "PRIMARY", columns: []string{"a"}}},
+	})
+
+	dir := c.MkDir()
+	var wg sync.WaitGroup
+	w := newMapWorker(dir, 1, &wg)
+	ev, err := generateUpdateEvent("test", "tb1", 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(w.handle(&mapTask{schema: "test", table: "tb1", commitTS: 1, events: []pb.Event{*ev}}), check.IsNil)
+	w.closeFiles()
+
+	names, err := binlogfile.ReadDir(filepath.Join(dir, "test_tb1"))
+	c.Assert(err, check.IsNil)
+	var tps []pb.EventType
+	tm := &TableMerge{}
+	for _, name := range names {
+		binlogCh, errCh := tm.read(context.Background(), filepath.Join(dir, "test_tb1", name))
+		for binlog := range binlogCh {
+			for _, e := range binlog.DmlData.Events {
+				tps = append(tps, e.GetTp())
+			}
+		}
+		c.Assert(len(errCh), check.Equals, 0)
+	}
+	// the update changing primary key is saved as delete and insert
+	c.Assert(tps, check.DeepEquals, []pb.EventType{pb.EventType_Delete, pb.EventType_Insert})
+}
@@ -0,0 +1,520 @@
+package pitr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	pb "github.com/pingcap/tidb-binlog/proto/binlog"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tb "github.com/pingcap/tipb/go-binlog"
+)
+
+const (
+	// workloadSchema is the default database of the tables in the synthetic workloads
+	workloadSchema = "pitr_bench"
+
+	// keyOrderSequential inserts the rows in the order of primary key
+	keyOrderSequential = "sequential"
+	// keyOrderRandom inserts the rows with random primary keys
+	keyOrderRandom = "random"
+)
+
+// WorkloadConfig is a synthetic workload of drainer binlogs, the tables are like
+// `t1 (id bigint primary key, v bigint, payload varchar(row-size))` or the ones in SchemaFile.
+type WorkloadConfig struct {
+	Tables int
+	// Database is the database of the tables, empty means pitr_bench
+	Database string
+	// SchemaFile is the CREATE TABLE statements of the tables used instead of Tables, every table should have a
+	// primary key of one integer column
+	SchemaFile string
+	// Binlogs is the number of DML binlogs, every binlog has EventsPerBinlog events of random tables
+	Binlogs         int
+	EventsPerBinlog int
+	// RowSize is the size of the payload of every row in bytes, it's the max size of a string column in SchemaFile
+	RowSize int
+	// UpdateRatio and DeleteRatio are the ratios of updates and deletes in the events, the others are inserts
+	UpdateRatio float64
+	DeleteRatio float64
+	// UpdateSkew is the exponent of the zipf distribution of the rows updated and deleted, it should be greater
+	// than 1, and a larger one updates the recently inserted rows more often. 0 means the uniform distribution
+	UpdateSkew float64
+	// KeyOrder is the order of the primary keys of the inserted rows, sequential or random, empty means sequential
+	KeyOrder string
+	// DDLInterval is the number of DML binlogs between the DDLs adding a column to a random table, 0 means no DDL
+	// after the tables are created
+	DDLInterval int
+	// StartTS is the commit ts of the first binlog, 0 means now, and the binlogs are Interval apart
+	StartTS  int64
+	Interval time.Duration
+	Seed     int64
+}
+
+func (c *WorkloadConfig) validate() error {
+	if (c.Tables <= 0 && len(c.SchemaFile) == 0) || c.Binlogs <= 0 || c.EventsPerBinlog <= 0 {
+		return errors.New("the number of tables, binlogs and events per binlog should be greater than 0")
+	}
+	if c.RowSize < 0 {
+		return errors.Errorf("row size should not be negative, but got %d", c.RowSize)
+	}
+	if c.UpdateRatio < 0 || c.DeleteRatio < 0 || c.UpdateRatio+c.DeleteRatio > 1 {
+		return errors.Errorf("update ratio %v and delete ratio %v should not be negative, and their sum should not be greater than 1",
+			c.UpdateRatio, c.DeleteRatio)
+	}
+	if c.UpdateSkew != 0 && c.UpdateSkew <= 1 {
+		return errors.Errorf("update skew should be greater than 1 or 0, but got %v", c.UpdateSkew)
+	}
+	if c.KeyOrder != "" && c.KeyOrder != keyOrderSequential && c.KeyOrder != keyOrderRandom {
+		return errors.Errorf("unknown key order %s, should be %s or %s", c.KeyOrder, keyOrderSequential, keyOrderRandom)
+	}
+	if c.DDLInterval < 0 || c.Interval < 0 {
+		return errors.New("DDL interval and interval should not be negative")
+	}
+	return nil
+}
+
+// workloadStats is the size of a generated workload.
+type workloadStats struct {
+	Binlogs int   `json:"binlogs"`
+	DDLs    int   `json:"ddls"`
+	Events  int64 `json:"events"`
+	Inserts int64 `json:"inserts"`
+	Updates int64 `json:"updates"`
+	Deletes int64 `json:"deletes"`
+	// StartTS and StopTS are the commit ts of the first and the last binlog
+	StartTS int64 `json:"start-ts"`
+	StopTS  int64 `json:"stop-ts"`
+}
+
+// workloadTable is the columns and the rows of a table in the workload.
+type workloadTable struct {
+	name string
+	// create is the CREATE TABLE statement of the table, cols is changed by the DDLs after it
+	create *ast.CreateTableStmt
+	cols   []*ast.ColumnDef
+	// pk is the index of the primary key column in cols
+	pk     int
+	nextID int64
+	// ids is the primary keys of the existing rows in the order of inserting
+	ids  []int64
+	rows map[int64][]types.Datum
+}
+
+// newWorkloadTable returns the table created by stmt, it should have a primary key of one integer column.
+func newWorkloadTable(stmt *ast.CreateTableStmt) (*workloadTable, error) {
+	t := &workloadTable{name: stmt.Table.Name.O, create: stmt, cols: stmt.Cols, pk: -1, nextID: 1, rows: make(map[int64][]types.Datum)}
+	var pkName string
+	for _, col := range stmt.Cols {
+		for _, opt := range col.Options {
+			switch opt.Tp {
+			case ast.ColumnOptionPrimaryKey:
+				pkName = col.Name.Name.L
+			case ast.ColumnOptionGenerated:
+				return nil, errors.Errorf("generated column %s of table %s is not supported", col.Name.Name.O, t.name)
+			}
+		}
+		if _, err := workloadIntMax(col); err != nil && !isWorkloadValueType(col.Tp.Tp) {
+			return nil, errors.Errorf("the type of column %s of table %s is not supported", col.Name.Name.O, t.name)
+		}
+	}
+	for _, c := range stmt.Constraints {
+		if c.Tp == ast.ConstraintPrimaryKey {
+			if len(c.Keys) != 1 {
+				return nil, errors.Errorf("the primary key of table %s should have one column", t.name)
+			}
+			pkName = c.Keys[0].Column.Name.L
+		}
+	}
+	for i, col := range stmt.Cols {
+		if col.Name.Name.L == pkName {
+			t.pk = i
+		}
+	}
+	if t.pk < 0 {
+		return nil, errors.Errorf("table %s should have a primary key", t.name)
+	}
+	if _, err := workloadIntMax(t.cols[t.pk]); err != nil {
+		return nil, errors.Annotatef(err, "the primary key of table %s", t.name)
+	}
+	return t, nil
+}
+
+// isWorkloadValueType returns true if the values of the non-integer type can be generated.
+func isWorkloadValueType(tp byte) bool {
+	switch tp {
+	case mysql.TypeFloat, mysql.TypeDouble, mysql.TypeNewDecimal,
+		mysql.TypeVarchar, mysql.TypeString, mysql.TypeVarString,
+		mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob,
+		mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		return true
+	}
+	return false
+}
+
+// workloadIntMax returns the max value of the integer column, an error is returned if it's not an integer.
+func workloadIntMax(col *ast.ColumnDef) (int64, error) {
+	bits := map[byte]uint{
+		mysql.TypeTiny: 8, mysql.TypeShort: 16, mysql.TypeInt24: 24, mysql.TypeLong: 32, mysql.TypeLonglong: 64,
+	}[col.Tp.Tp]
+	if bits == 0 {
+		return 0, errors.Errorf("column %s is not an integer", col.Name.Name.O)
+	}
+	if bits == 64 {
+		return math.MaxInt64, nil
+	}
+	if mysql.HasUnsignedFlag(col.Tp.Flag) {
+		return 1<<bits - 1, nil
+	}
+	return 1<<(bits-1) - 1, nil
+}
+
+// workloadGenerator generates the binlogs of a workload, the updates and deletes only change the existing rows
+// with their current values, so the binlogs are like the ones written by drainer for a real cluster.
+type workloadGenerator struct {
+	cfg      WorkloadConfig
+	database string
+	rand     *rand.Rand
+	tables   []*workloadTable
+	ts       int64
+	// columns is the number of columns added by the DDLs
+	columns int
+	stats   workloadStats
+}
+
+func newWorkloadGenerator(cfg WorkloadConfig) (*workloadGenerator, error) {
+	g := &workloadGenerator{
+		cfg:      cfg,
+		database: cfg.Database,
+		rand:     rand.New(rand.NewSource(cfg.Seed)),
+		ts:       cfg.StartTS,
+	}
+	if len(g.database) == 0 {
+		g.database = workloadSchema
+	}
+	if g.ts == 0 {
+		g.ts = int64(oracle.ComposeTS(time.Now().UnixNano()/int64(time.Millisecond), 0))
+	}
+	if g.cfg.Interval == 0 {
+		g.cfg.Interval = time.Millisecond
+	}
+
+	sql := cfg.SchemaFile
+	if len(sql) != 0 {
+		data, err := ioutil.ReadFile(sql)
+		if err != nil {
+			return nil, errors.Annotatef(err, "read schema file %s", sql)
+		}
+		sql = string(data)
+	} else {
+		var sb strings.Builder
+		for i := 1; i <= cfg.Tables; i++ {
+			fmt.Fprintf(&sb, "CREATE TABLE t%d (id bigint PRIMARY KEY, v bigint, payload varchar(%d));\n", i, cfg.RowSize+1)
+		}
+		sql = sb.String()
+	}
+	stmts, _, err := parser.New().Parse(sql, "", "")
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse schema file %s", cfg.SchemaFile)
+	}
+	for _, stmt := range stmts {
+		create, ok := stmt.(*ast.CreateTableStmt)
+		if !ok {
+			return nil, errors.Errorf("the schema file %s should only have CREATE TABLE statements, but got %s", cfg.SchemaFile, stmt.Text())
+		}
+		t, err := newWorkloadTable(create)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		g.tables = append(g.tables, t)
+	}
+	if len(g.tables) == 0 {
+		return nil, errors.Errorf("no table is created by the schema file %s", cfg.SchemaFile)
+	}
+	return g, nil
+}
+
+// nextTS returns the commit ts of the next binlog, the binlogs are Interval apart.
+func (g *workloadGenerator) nextTS() int64 {
+	if g.stats.StartTS != 0 {
+		g.ts = int64(oracle.ComposeTS(oracle.ExtractPhysical(uint64(g.ts))+int64(g.cfg.Interval/time.Millisecond), 0))
+		if g.cfg.Interval < time.Millisecond {
+			g.ts++
+		}
+	} else {
+		g.stats.StartTS = g.ts
+	}
+	g.stats.StopTS = g.ts
+	return g.ts
+}
+
+// ddl returns the DDL binlog of the query in the database of the workload.
+func (g *workloadGenerator) ddl(query string) *pb.Binlog {
+	g.stats.DDLs++
+	return &pb.Binlog{
+		Tp:       pb.BinlogType_DDL,
+		CommitTs: g.nextTS(),
+		DdlQuery: []byte(fmt.Sprintf("USE %s; %s", quoteName(g.database), query)),
+	}
+}
+
+// ddls returns the binlogs creating the database and the tables.
+func (g *workloadGenerator) ddls() ([]*pb.Binlog, error) {
+	binlogs := []*pb.Binlog{{
+		Tp:       pb.BinlogType_DDL,
+		CommitTs: g.nextTS(),
+		DdlQuery: []byte(fmt.Sprintf("CREATE DATABASE %s", quoteName(g.database))),
+	}}
+	g.stats.DDLs++
+	for _, t := range g.tables {
+		// the tables are always created in the database of the workload
+		t.create.Table.Schema = model.CIStr{}
+		query, err := restoreNode(t.create)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		binlogs = append(binlogs, g.ddl(query))
+	}
+	return binlogs, nil
+}
+
+// addColumn returns the DDL binlog adding a nullable column to a random table, the existing rows have NULL in it.
+func (g *workloadGenerator) addColumn() (*pb.Binlog, error) {
+	t := g.tables[g.rand.Intn(len(g.tables))]
+	g.columns++
+	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s bigint", quoteName(t.name), quoteName(fmt.Sprintf("c%d", g.columns)))
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t.cols = append(append([]*ast.ColumnDef(nil), t.cols...), stmts[0].(*ast.AlterTableStmt).Specs[0].NewColumns[0])
+	for id, row := range t.rows {
+		t.rows[id] = append(row, types.Datum{})
+	}
+	return g.ddl(query), nil
+}
+
+// pick returns the index of an existing row of the table, the recently inserted rows are picked more often
+// with update skew.
+func (g *workloadGenerator) pick(t *workloadTable) int {
+	if g.cfg.UpdateSkew == 0 || len(t.ids) == 1 {
+		return g.rand.Intn(len(t.ids))
+	}
+	return len(t.ids) - 1 - int(rand.NewZipf(g.rand, g.cfg.UpdateSkew, 1, uint64(len(t.ids)-1)).Uint64())
+}
+
+// newID returns the primary key of a new row.
+func (g *workloadGenerator) newID(t *workloadTable) (int64, error) {
+	max, err := workloadIntMax(t.cols[t.pk])
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if int64(len(t.ids)) >= max {
+		return 0, errors.Errorf("the primary keys of table %s are used up", t.name)
+	}
+	if g.cfg.KeyOrder != keyOrderRandom {
+		if t.nextID > max {
+			return 0, errors.Errorf("the primary keys of table %s are used up", t.name)
+		}
+		t.nextID++
+		return t.nextID - 1, nil
+	}
+	for {
+		id := g.rand.Int63n(max) + 1
+		if _, ok := t.rows[id]; !ok {
+			return id, nil
+		}
+	}
+}
+
+// value returns a random value of the column.
+func (g *workloadGenerator) value(col *ast.ColumnDef) types.Datum {
+	if max, err := workloadIntMax(col); err == nil {
+		if mysql.HasUnsignedFlag(col.Tp.Flag) {
+			return types.NewUintDatum(uint64(g.rand.Int63n(max)))
+		}
+		return types.NewIntDatum(g.rand.Int63n(max))
+	}
+
+	switch col.Tp.Tp {
+	case mysql.TypeFloat, mysql.TypeDouble:
+		return types.NewFloat64Datum(float64(g.rand.Intn(1000000)) / 100)
+	case mysql.TypeNewDecimal:
+		digits := col.Tp.Flen - col.Tp.Decimal
+		if digits <= 0 || digits > 18 {
+			digits = 18
+		}
+		return types.NewDecimalDatum(types.NewDecFromInt(g.rand.Int63n(int64(math.Pow10(digits)))))
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		t := time.Unix(int64(oracle.ExtractPhysical(uint64(g.ts))/1000)-g.rand.Int63n(365*24*3600), 0).UTC()
+		if col.Tp.Tp == mysql.TypeDate {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		return types.NewTimeDatum(types.Time{Time: types.FromGoTime(t), Type: col.Tp.Tp})
+	}
+
+	size := g.cfg.RowSize
+	if col.Tp.Flen > 0 && col.Tp.Flen < size {
+		size = col.Tp.Flen
+	}
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte('a' + g.rand.Intn(26))
+	}
+	if types.IsBinaryStr(col.Tp) || types.IsTypeBlob(col.Tp.Tp) {
+		return types.NewBytesDatum(b)
+	}
+	return types.NewStringDatum(string(b))
+}
+
+// newRow returns the random values of a row with the primary key.
+func (g *workloadGenerator) newRow(t *workloadTable, id int64) []types.Datum {
+	row := make([]types.Datum, len(t.cols))
+	for i, col := range t.cols {
+		if i == t.pk {
+			row[i] = types.NewIntDatum(id)
+			if mysql.HasUnsignedFlag(col.Tp.Flag) {
+				row[i] = types.NewUintDatum(uint64(id))
+			}
+			continue
+		}
+		row[i] = g.value(col)
+	}
+	return row
+}
+
+// dml returns the next DML binlog.
+func (g *workloadGenerator) dml() (*pb.Binlog, error) {
+	events := make([]pb.Event, 0, g.cfg.EventsPerBinlog)
+	for i := 0; i < g.cfg.EventsPerBinlog; i++ {
+		t := g.tables[g.rand.Intn(len(g.tables))]
+		tp := pb.EventType_Insert
+		if len(t.ids) != 0 {
+			if r := g.rand.Float64(); r < g.cfg.UpdateRatio {
+				tp = pb.EventType_Update
+			} else if r < g.cfg.UpdateRatio+g.cfg.DeleteRatio {
+				tp = pb.EventType_Delete
+			}
+		}
+
+		var values, changed []types.Datum
+		switch tp {
+		case pb.EventType_Insert:
+			id, err := g.newID(t)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			values = g.newRow(t, id)
+			t.ids = append(t.ids, id)
+			t.rows[id] = values
+			g.stats.Inserts++
+		case pb.EventType_Update:
+			id := t.ids[g.pick(t)]
+			values, changed = t.rows[id], g.newRow(t, id)
+			t.rows[id] = changed
+			g.stats.Updates++
+		case pb.EventType_Delete:
+			i := g.pick(t)
+			id := t.ids[i]
+			values = t.rows[id]
+			t.ids = append(t.ids[:i], t.ids[i+1:]...)
+			delete(t.rows, id)
+			g.stats.Deletes++
+		}
+		row, err := encodeWorkloadRow(t, values, changed)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		schema, table := g.database, t.name
+		events = append(events, pb.Event{SchemaName: &schema, TableName: &table, Tp: tp, Row: row})
+	}
+	g.stats.Binlogs++
+	g.stats.Events += int64(len(events))
+	return &pb.Binlog{Tp: pb.BinlogType_DML, CommitTs: g.nextTS(), DmlData: &pb.DMLData{Events: events}}, nil
+}
+
+// encodeWorkloadRow encodes the row like drainer, changed is the values after update, nil for insert and delete.
+func encodeWorkloadRow(t *workloadTable, values, changed []types.Datum) ([][]byte, error) {
+	row := make([][]byte, 0, len(t.cols))
+	for i, col := range t.cols {
+		c := &pb.Column{Name: col.Name.Name.O, Tp: []byte{col.Tp.Tp}, MysqlType: types.TypeToStr(col.Tp.Tp, col.Tp.Charset)}
+		var err error
+		if c.Value, err = codec.EncodeValue(nil, nil, values[i]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if changed != nil {
+			if c.ChangedValue, err = codec.EncodeValue(nil, nil, changed[i]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		data, err := c.Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row = append(row, data)
+	}
+	return row, nil
+}
+
+// writeWorkload writes the binlog files of the workload to dir like drainer, it returns the size of the workload.
+func writeWorkload(dir string, cfg WorkloadConfig) (workloadStats, error) {
+	if err := cfg.validate(); err != nil {
+		return workloadStats{}, errors.Trace(err)
+	}
+	g, err := newWorkloadGenerator(cfg)
+	if err != nil {
+		return workloadStats{}, errors.Trace(err)
+	}
+	b, err := OpenMyBinlogger(dir)
+	if err != nil {
+		return workloadStats{}, errors.Trace(err)
+	}
+	defer b.Close()
+
+	write := func(binlog *pb.Binlog) error {
+		data, err := binlog.Marshal()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = b.WriteTail(&tb.Entity{Payload: data})
+		return errors.Annotatef(err, "write binlogs to %s", dir)
+	}
+	ddls, err := g.ddls()
+	if err != nil {
+		return workloadStats{}, errors.Trace(err)
+	}
+	for _, binlog := range ddls {
+		if err := write(binlog); err != nil {
+			return workloadStats{}, errors.Trace(err)
+		}
+	}
+	for i := 0; i < cfg.Binlogs; i++ {
+		if cfg.DDLInterval > 0 && i > 0 && i%cfg.DDLInterval == 0 {
+			binlog, err := g.addColumn()
+			if err != nil {
+				return workloadStats{}, errors.Trace(err)
+			}
+			if err := write(binlog); err != nil {
+				return workloadStats{}, errors.Trace(err)
+			}
+		}
+		binlog, err := g.dml()
+		if err != nil {
+			return workloadStats{}, errors.Trace(err)
+		}
+		if err := write(binlog); err != nil {
+			return workloadStats{}, errors.Trace(err)
+		}
+	}
+	return g.stats, nil
+}
@@ -0,0 +1,104 @@
+#!/bin/bash
+# Checks the binlogs merged by pitr have the same result as the source binlogs when they are replayed by reparo.
+#
+# The source binlogs in the drainer data dir are replayed to a MySQL container by reparo directly, and the
+# output of pitr is replayed to another one table by table, then the data of the two MySQLs are compared.
+# The binlogs should start from an empty cluster, so no base schema is needed.
+#
+# usage: tests/reparo/run.sh <drainer data dir> [stop-datetime]
+#
+# environments:
+#   PITR          path of pitr binary, default ./bin/pitr
+#   REPARO        path of reparo binary, default reparo
+#   MYSQL_IMAGE   image of MySQL, default mysql:5.7
+
+set -euo pipefail
+# the dirs are sorted by bytes
+export LC_ALL=C
+
+if [ $# -lt 1 ]; then
+	echo "usage: $0 <drainer data dir> [stop-datetime]"
+	exit 1
+fi
+
+DATA_DIR=$(cd "$1" && pwd)
+STOP_DATETIME=${2:-}
+PITR=$(realpath "${PITR:-./bin/pitr}")
+REPARO=${REPARO:-reparo}
+MYSQL_IMAGE=${MYSQL_IMAGE:-mysql:5.7}
+
+DIRECT_PORT=3316
+MERGED_PORT=3317
+WORK_DIR=$(mktemp -d)
+
+cleanup() {
+	docker rm -f pitr-test-direct pitr-test-merged >/dev/null 2>&1 || true
+	rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+start_mysql() {
+	docker run -d --name "$1" -e MYSQL_ALLOW_EMPTY_PASSWORD=yes -p "$2:3306" "$MYSQL_IMAGE" >/dev/null
+	for _ in $(seq 60); do
+		if mysql -h 127.0.0.1 -P "$2" -u root -e "SELECT 1" >/dev/null 2>&1; then
+			return
+		fi
+		sleep 2
+	done
+	echo "MySQL on port $2 is not ready"
+	exit 1
+}
+
+# replay <data dir> <port> replays the binlogs in the dir to the MySQL by reparo
+replay() {
+	cat >"$WORK_DIR/reparo.toml" <<CONFIG
+data-dir = "$1"
+log-level = "warn"
+dest-type = "mysql"
+stop-datetime = "$STOP_DATETIME"
+safe-mode = false
+
+[dest-db]
+host = "127.0.0.1"
+port = $2
+user = "root"
+password = ""
+CONFIG
+	"$REPARO" -config "$WORK_DIR/reparo.toml"
+}
+
+# dump <port> dumps the schema and data of all the user databases, the auto increment ids are removed,
+# because the merged binlogs may have less inserts
+dump() {
+	local dbs
+	dbs=$(mysql -h 127.0.0.1 -P "$1" -u root -N -e "SELECT schema_name FROM information_schema.schemata WHERE schema_name NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys') ORDER BY schema_name")
+	if [ -z "$dbs" ]; then
+		return
+	fi
+	# shellcheck disable=SC2086
+	mysqldump -h 127.0.0.1 -P "$1" -u root --skip-comments --skip-dump-date --order-by-primary --databases $dbs |
+		sed -E 's/ AUTO_INCREMENT=[0-9]+//'
+}
+
+start_mysql pitr-test-direct $DIRECT_PORT
+start_mysql pitr-test-merged $MERGED_PORT
+
+echo "replay the source binlogs"
+replay "$DATA_DIR" $DIRECT_PORT
+
+echo "merge the binlogs"
+(cd "$WORK_DIR" && "$PITR" --data-dir "$DATA_DIR" --stop-datetime "$STOP_DATETIME" --verify)
+
+echo "replay the merged binlogs"
+# the DDLs of databases are in the dirs like db_, which are sorted before the tables of the databases
+for dir in "$WORK_DIR"/new_binlog/*/; do
+	replay "$dir" $MERGED_PORT
+done
+
+dump $DIRECT_PORT >"$WORK_DIR/direct.sql"
+dump $MERGED_PORT >"$WORK_DIR/merged.sql"
+if ! diff -u "$WORK_DIR/direct.sql" "$WORK_DIR/merged.sql"; then
+	echo "the data replayed from the merged binlogs is different from the source binlogs"
+	exit 1
+fi
+echo "the data replayed from the merged binlogs is the same as the source binlogs"